@@ -0,0 +1,92 @@
+package main
+
+import (
+  "context"
+  "crypto/tls"
+  "crypto/x509"
+  "os"
+  "os/exec"
+  "os/signal"
+  "strconv"
+  "syscall"
+
+  "gowatcher/pkg/watcher"
+)
+
+// agentCommand runs `gowatcher agent` until SIGINT or SIGTERM, which stop
+// the running encodes and give them back for other agents
+func agentCommand(args []string) {
+  if len(args) > 0 {
+    fatal("agent takes no arguments, it is configured from the environment")
+  }
+
+  cfg := watcher.AgentConfig{
+    Coordinator: os.Getenv("COORDINATOR_ADDR"),
+    Token:       os.Getenv("AGENTS_TOKEN"),
+    Root:        os.Getenv("AGENT_ROOT"),
+    Name:        os.Getenv("AGENT_NAME"),
+    WorkingDir:  os.Getenv("AGENT_DIR"),
+    TLS:         &tls.Config{MinVersion: tls.VersionTLS12},
+  }
+
+  if cfg.Coordinator == "" || cfg.Token == "" {
+    fatal("agent needs COORDINATOR_ADDR and AGENTS_TOKEN")
+  }
+
+  if caFile := os.Getenv("COORDINATOR_CA_FILE"); caFile != "" {
+    pem, err := os.ReadFile(caFile)
+
+    if err != nil {
+      fatal("Could not read COORDINATOR_CA_FILE", "error", err)
+    }
+
+    cfg.TLS.RootCAs = x509.NewCertPool()
+
+    if !cfg.TLS.RootCAs.AppendCertsFromPEM(pem) {
+      fatal("COORDINATOR_CA_FILE has no certificates", "file", caFile)
+    }
+  }
+
+  if certFile, keyFile := os.Getenv("AGENT_CERT_FILE"), os.Getenv("AGENT_KEY_FILE"); certFile != "" || keyFile != "" {
+    cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+    if err != nil {
+      fatal("Could not load AGENT_CERT_FILE and AGENT_KEY_FILE", "error", err)
+    }
+
+    cfg.TLS.Certificates = []tls.Certificate{cert}
+  }
+
+  if workers := os.Getenv("AGENT_WORKERS"); workers != "" {
+    n, err := strconv.Atoi(workers)
+
+    if err != nil || n <= 0 {
+      fatal("AGENT_WORKERS must be a positive number", "value", workers)
+    }
+
+    cfg.Workers = n
+  }
+
+  path := os.Getenv("FFMPEG_PATH")
+
+  if path == "" {
+    path = "ffmpeg"
+  }
+
+  var err error
+
+  if cfg.FFmpegPath, err = exec.LookPath(path); err != nil {
+    fatal("FFMPEG_PATH is not an ffmpeg that can run", "value", path, "error", err)
+  }
+
+  agent, err := watcher.NewAgent(cfg)
+
+  if err != nil {
+    fatal("Could not start agent", "error", err)
+  }
+
+  ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer stop()
+
+  agent.Run(ctx)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+  "context"
+  "log/slog"
+  "os"
+  "sync"
+  "time"
+
+  "gowatcher/pkg/watcher"
+)
+
+// batch and encode exit codes, 1 is left to fatal errors
+const (
+  exitFailures    = 2
+  exitInterrupted = 3
+)
+
+// runBatch encodes what is in the queue directories of every watcher at the
+// same time, logs a summary and returns the exit code. A signal aborts the
+// running encodes
+func runBatch(ws []*watcher.Watcher, interrupt <-chan os.Signal) int {
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  go func() {
+    select {
+    case sig := <-interrupt:
+      slog.Info("Aborting batch", "signal", sig.String())
+      cancel()
+    case <-ctx.Done():
+    }
+  }()
+
+  startedAt := time.Now()
+
+  var mu sync.Mutex
+  var wg sync.WaitGroup
+  var jobs []*watcher.Job
+
+  for _, w := range ws {
+    wg.Add(1)
+
+    go func(w *watcher.Watcher) {
+      defer wg.Done()
+
+      done, err := w.RunOnce(ctx)
+
+      if err != nil {
+        fatal("Watcher error", "error", err)
+      }
+
+      mu.Lock()
+      jobs = append(jobs, done...)
+      mu.Unlock()
+    }(w)
+  }
+
+  wg.Wait()
+
+  counts := make(map[watcher.JobState]int)
+
+  for _, j := range jobs {
+    v := j.View()
+    counts[v.State]++
+
+    if v.State == watcher.JobFailed {
+      slog.Error("Failed", "job", v.ID, "input", v.Input, "error", v.Error)
+    }
+  }
+
+  slog.Info("Batch complete",
+    "jobs", len(jobs),
+    "done", counts[watcher.JobDone],
+    "failed", counts[watcher.JobFailed],
+    "cancelled", counts[watcher.JobCancelled],
+    "unfinished", counts[watcher.JobQueued]+counts[watcher.JobRunning],
+    "took", time.Since(startedAt).Round(time.Second).String(),
+  )
+
+  switch {
+  case ctx.Err() != nil:
+    return exitInterrupted
+  case counts[watcher.JobFailed] > 0:
+    return exitFailures
+  }
+
+  return 0
+}
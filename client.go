@@ -0,0 +1,1221 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "text/tabwriter"
+  "time"
+
+  "gowatcher/pkg/watcher"
+)
+
+// usage lists the subcommands
+func usage(w io.Writer) {
+  fmt.Fprint(w, `usage: gowatcher [command]
+
+  run            watch the queue directory and encode, the default
+  run --once     encode what is in the queue directory now, then exit
+  run --dry-run  log what would be encoded and how, without doing it
+  encode <file> [--profile X] [--out dir]
+                 encode one file with the same settings, keeping the input
+  status         what the running daemon is doing
+  health [--ready]
+                 exit 0 when the daemon is live, or ready for work, else 1,
+                 for Docker's HEALTHCHECK
+  tui            full screen view of the queue, progress and failures, with
+                 keys to pause, skip and retry
+  jobs [state]   list jobs, optionally only queued, running, done, failed or cancelled
+  logs <id>      print a job's ffmpeg output
+  stats [window...]
+                 encodes, sizes, fps and speed over the last 1h, 24h, 7d, 30d
+                 and all, or windows like 12h and 90d, by profile
+  cancel <id> [--requeue|--fail]
+                 cancel a queued or running job, killing its ffmpeg and
+                 removing its partial outputs. --requeue starts a running
+                 job over, --fail moves its input to the failed directory
+  reload         reload CONFIG_FILE, like SIGHUP
+  forget <file>  remove a file from the ledger so it is encoded again
+  pending        list the files waiting for approval with APPROVAL=true
+  approve <file> [--profile X]
+                 encode a file waiting for approval, with profile X
+  reject <file> [--reason text]
+                 move a file waiting for approval to the rejected directory
+  prune [--dry-run]
+                 apply the finished and originals retentions now, or list
+                 what they would take
+  reencode --profile X [--since 2024-01-31] [--dry-run]
+                 encode the kept or archived originals again whose outputs
+                 came from an earlier version of profile X
+  restore [name|ulid...] [--all] [--to dir]
+                 list the originals ORIGINALS_POLICY=trash moved to the
+                 trash, or put them back where they were queued, or in dir
+  enqueue <url> [--name X]
+                 download a file over http(s) and encode it, named X
+  import <dir> [--filter '*.mkv'...] [--link|--copy|--move] [--dry-run]
+                 queue the files of an existing library that the filters,
+                 INCLUDE_EXTENSIONS and EXCLUDE_GLOBS allow, symlinking them
+                 into the queue directory unless --copy or --move. A
+                 --filter matches the name or the path under dir
+  snapshot export [file]
+                 write the queue and job state as JSON to file or stdout
+  snapshot import <file> [--map /old=/new...] [--copy|--link] [--failed]
+                  [--dry-run]
+                 requeue a snapshot's queued and running jobs, and its
+                 failed ones with --failed, with their profile, priority
+                 and retries. Inputs are looked for at their path, rewritten
+                 by --map, then by name in the queue directory, and moved
+                 into it unless --copy or --link
+  publish <url> [--name X]
+                 add the file to REDIS_STREAM for whichever worker takes it
+  agent          encode the ffmpeg runs of the coordinator at COORDINATOR_ADDR
+  doctor [--json]
+                 check ffmpeg, ffprobe, the profiles, directories, free space,
+                 inotify limits, destinations and notifiers with the same
+                 settings as run, and say how to fix what is wrong
+  migrate [--dry-run] [--json]
+                 bring the ledger, stats history and encodes log in BASE_DIR
+                 up to this version's state, keeping the files it rewrites
+                 as .bak. run does what older instances can still read by
+                 itself, the rest needs this with the daemon stopped
+  service install|uninstall|start|stop [--name X]
+                 run gowatcher as a Windows service, install takes
+                 --env KEY=VALUE for its environment and run's flags
+
+The commands other than run talk to the daemon over CONTROL_SOCKET, which
+defaults to BASE_DIR/gowatcher.sock. forget edits the ledger file itself
+when the daemon is not running, publish only needs REDIS_URL, agent talks
+to COORDINATOR_ADDR over gRPC, restore works on BASE_DIR/.trash or
+TRASH_DIR itself and doctor and migrate need no daemon
+`)
+}
+
+// controlSocket is where the daemon listens for the other subcommands
+func controlSocket() string {
+  if path := os.Getenv("CONTROL_SOCKET"); path != "" {
+    return path
+  }
+
+  if base := os.Getenv("BASE_DIR"); base != "" {
+    return filepath.Join(base, "gowatcher.sock")
+  }
+
+  return ""
+}
+
+// client calls the daemon's control API over its unix socket
+type client struct {
+  http *http.Client
+}
+
+func newClient(socket string) *client {
+  return &client{http: &http.Client{
+    Timeout: 10 * time.Second,
+    Transport: &http.Transport{
+      DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+        var d net.Dialer
+        return d.DialContext(ctx, "unix", socket)
+      },
+    },
+  }}
+}
+
+// do sends a request and returns the response body, API errors are turned
+// into Go errors
+func (c *client) do(method string, path string) ([]byte, error) {
+  return c.send(method, path, nil)
+}
+
+// send is do with a JSON request body
+func (c *client) send(method string, path string, body io.Reader) ([]byte, error) {
+  req, err := http.NewRequest(method, "http://gowatcher"+path, body)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if body != nil {
+    req.Header.Set("Content-Type", "application/json")
+  }
+
+  resp, err := c.http.Do(req)
+
+  if err != nil {
+    return nil, fmt.Errorf("is gowatcher running? %w", err)
+  }
+
+  defer resp.Body.Close()
+
+  data, err := io.ReadAll(resp.Body)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if resp.StatusCode >= 300 {
+    var apiErr struct {
+      Error string `json:"error"`
+    }
+
+    if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+      return nil, fmt.Errorf("%s", apiErr.Error)
+    }
+
+    return nil, fmt.Errorf("%s", resp.Status)
+  }
+
+  return data, nil
+}
+
+// get decodes a JSON response into v
+func (c *client) get(path string, v interface{}) error {
+  body, err := c.do(http.MethodGet, path)
+
+  if err != nil {
+    return err
+  }
+
+  return json.Unmarshal(body, v)
+}
+
+// runClient runs one of the subcommands that talk to a running daemon
+func runClient(command string, args []string) error {
+  socket := controlSocket()
+
+  if command == "forget" {
+    return forget(socket, args)
+  }
+
+  if command == "publish" {
+    return publish(args)
+  }
+
+  if command == "restore" {
+    return restore(args)
+  }
+
+  if socket == "" {
+    return fmt.Errorf("set CONTROL_SOCKET or BASE_DIR to find the daemon")
+  }
+
+  c := newClient(socket)
+
+  switch command {
+  case "status":
+    return c.status()
+  case "health":
+    return c.health(args)
+  case "jobs":
+    state := ""
+
+    if len(args) > 0 {
+      state = args[0]
+    }
+
+    return c.jobs(state)
+  case "logs":
+    id, err := jobID(args)
+
+    if err != nil {
+      return err
+    }
+
+    body, err := c.do(http.MethodGet, "/jobs/"+id+"/log")
+
+    if err != nil {
+      return err
+    }
+
+    _, err = os.Stdout.Write(body)
+
+    return err
+  case "cancel":
+    return c.cancel(args)
+  case "enqueue":
+    return c.enqueue(args)
+  case "stats":
+    return c.stats(args)
+  case "reencode":
+    return c.reencode(args)
+  case "prune":
+    return c.prune(args)
+  case "import":
+    return c.importLibrary(args)
+  case "snapshot":
+    return c.snapshot(args)
+  case "pending":
+    return c.pending()
+  case "approve", "reject":
+    return c.approval(command, args)
+  case "tui":
+    return c.tui()
+  case "reload":
+    if _, err := c.do(http.MethodPost, "/reload"); err != nil {
+      return err
+    }
+
+    fmt.Println("Reloaded")
+
+    return nil
+  }
+
+  usage(os.Stderr)
+
+  return fmt.Errorf("unknown command %q", command)
+}
+
+// forget asks the daemon to drop a file from the ledger, or drops it from
+// the ledger file when there is no daemon to ask
+func forget(socket string, args []string) error {
+  if len(args) != 1 {
+    return fmt.Errorf("expected a file")
+  }
+
+  file, err := filepath.Abs(args[0])
+
+  if err != nil {
+    return err
+  }
+
+  var removed int
+  var opErr *net.OpError
+
+  body, err := newClient(socket).do(http.MethodPost, "/forget?path="+url.QueryEscape(file))
+
+  switch {
+  case err == nil:
+    var resp struct {
+      Forgotten int `json:"forgotten"`
+    }
+
+    if err = json.Unmarshal(body, &resp); err != nil {
+      return err
+    }
+
+    removed = resp.Forgotten
+  case socket == "" || errors.As(err, &opErr):
+    if removed, err = forgetOffline(file); err != nil {
+      return err
+    }
+  default:
+    return err
+  }
+
+  if removed == 0 {
+    fmt.Printf("%s is not in the ledger\n", file)
+    return nil
+  }
+
+  fmt.Printf("Forgot %s, it will be encoded again\n", file)
+
+  return nil
+}
+
+// forgetOffline edits the ledger file from the daemon's LEDGER and
+// LEDGER_FILE settings
+func forgetOffline(file string) (int, error) {
+  path := os.Getenv("LEDGER_FILE")
+
+  if path == "" {
+    base := os.Getenv("BASE_DIR")
+
+    if base == "" {
+      return 0, fmt.Errorf("set LEDGER_FILE or BASE_DIR to find the ledger")
+    }
+
+    path = filepath.Join(base, "ledger.jsonl")
+  }
+
+  mode := watcher.LedgerMode(os.Getenv("LEDGER"))
+
+  if mode == "" {
+    // entries are still matched by their path
+    mode = watcher.LedgerPath
+  }
+
+  ledger, err := watcher.OpenLedger(path, mode)
+
+  if err != nil {
+    return 0, err
+  }
+
+  return ledger.Forget(file)
+}
+
+// restore lists the trash, or moves originals out of it. It needs no
+// daemon, the trash is a directory
+func restore(args []string) error {
+  flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+  all := flags.Bool("all", false, "restore everything in the trash")
+  to := flags.String("to", "", "restore into this directory rather than where they were queued")
+
+  if err := flags.Parse(args); err != nil {
+    return err
+  }
+
+  // the flags may come after the names too
+  var refs []string
+
+  for rest := flags.Args(); len(rest) > 0; rest = flags.Args() {
+    refs = append(refs, rest[0])
+
+    if err := flags.Parse(rest[1:]); err != nil {
+      return err
+    }
+  }
+
+  dir := os.Getenv("TRASH_DIR")
+
+  if dir == "" {
+    base := os.Getenv("BASE_DIR")
+
+    if base == "" {
+      return fmt.Errorf("set TRASH_DIR or BASE_DIR to find the trash")
+    }
+
+    dir = filepath.Join(base, ".trash")
+  }
+
+  trash, err := watcher.OpenTrash(dir)
+
+  if err != nil {
+    return err
+  }
+
+  trashed, err := trash.List()
+
+  if err != nil {
+    return err
+  }
+
+  if *all {
+    refs = refs[:0]
+
+    for _, t := range trashed {
+      refs = append(refs, t.Name)
+    }
+  }
+
+  if len(refs) == 0 && !*all {
+    tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(tw, "NAME\tSIZE\tTRASHED\tJOB\tFROM")
+
+    for _, t := range trashed {
+      fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.Name, watcher.FormatSize(t.Bytes), t.TrashedAt.Local().Format("2006-01-02 15:04"), t.JobUID, t.Input)
+    }
+
+    tw.Flush()
+    fmt.Printf("%d originals in %s\n", len(trashed), dir)
+
+    return nil
+  }
+
+  failed := 0
+
+  for _, ref := range refs {
+    dest, err := trash.Restore(ref, *to)
+
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "%s\n", err)
+      failed++
+
+      continue
+    }
+
+    fmt.Printf("Restored %s to %s\n", ref, dest)
+  }
+
+  if failed > 0 {
+    return fmt.Errorf("%d of %d not restored", failed, len(refs))
+  }
+
+  return nil
+}
+
+func jobID(args []string) (string, error) {
+  if len(args) != 1 {
+    return "", fmt.Errorf("expected a job id")
+  }
+
+  return args[0], nil
+}
+
+// cancel stops a job, then requeues or fails it when asked to
+func (c *client) cancel(args []string) error {
+  flags := flag.NewFlagSet("cancel", flag.ContinueOnError)
+  requeue := flags.Bool("requeue", false, "start a running job over once it has stopped")
+  fail := flags.Bool("fail", false, "fail the job, moving its input to the failed directory")
+
+  if err := flags.Parse(args); err != nil {
+    return err
+  }
+
+  // the flags may come after the id too
+  ids := flags.Args()
+
+  if len(ids) > 0 {
+    if err := flags.Parse(ids[1:]); err != nil {
+      return err
+    }
+
+    ids = append(ids[:1], flags.Args()...)
+  }
+
+  id, err := jobID(ids)
+
+  if err != nil {
+    return err
+  }
+
+  then, done := watcher.CancelStop, "Cancelled"
+
+  switch {
+  case *requeue && *fail:
+    return fmt.Errorf("--requeue or --fail, not both")
+  case *requeue:
+    then, done = watcher.CancelRequeue, "Cancelled and requeued"
+  case *fail:
+    then, done = watcher.CancelFail, "Cancelled and failed"
+  }
+
+  if _, err = c.do(http.MethodPost, "/jobs/"+id+"/cancel?then="+string(then)); err != nil {
+    return err
+  }
+
+  fmt.Printf("%s job %s\n", done, id)
+
+  return nil
+}
+
+// urlArgs parses enqueue and publish's arguments, a URL and an optional
+// --name before or after it
+func urlArgs(command string, args []string) (string, string, error) {
+  flags := flag.NewFlagSet(command, flag.ContinueOnError)
+  name := flags.String("name", "", "file name the outputs are named after, default the URL's")
+
+  if err := flags.Parse(args); err != nil {
+    return "", "", err
+  }
+
+  // the flag may come after the URL too
+  urls := flags.Args()
+
+  if len(urls) > 0 {
+    if err := flags.Parse(urls[1:]); err != nil {
+      return "", "", err
+    }
+
+    urls = append(urls[:1], flags.Args()...)
+  }
+
+  if len(urls) != 1 {
+    return "", "", fmt.Errorf("expected a URL")
+  }
+
+  return urls[0], *name, nil
+}
+
+// enqueue asks the daemon to download a URL and encode it
+func (c *client) enqueue(args []string) error {
+  rawURL, name, err := urlArgs("enqueue", args)
+
+  if err != nil {
+    return err
+  }
+
+  query := url.Values{"url": {rawURL}}
+
+  if name != "" {
+    query.Set("name", name)
+  }
+
+  body, err := c.do(http.MethodPost, "/enqueue?"+query.Encode())
+
+  if err != nil {
+    return err
+  }
+
+  var job watcher.JobView
+
+  if err = json.Unmarshal(body, &job); err != nil {
+    return err
+  }
+
+  fmt.Printf("Queued job %d, encoding once %s is downloaded\n", job.ID, filepath.Base(job.Input))
+
+  return nil
+}
+
+// pending lists the files waiting for approval
+func (c *client) pending() error {
+  var view watcher.ApprovalsView
+
+  if err := c.get("/pending", &view); err != nil {
+    return err
+  }
+
+  tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(tw, "NAME\tSIZE\tWAITING\tPROFILE\tPATH")
+
+  for _, p := range view.Pending {
+    profile := p.Profile
+
+    if p.Spec {
+      profile += " (job spec)"
+    }
+
+    fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Name, watcher.FormatSize(p.Size), time.Since(p.FoundAt).Round(time.Second), profile, p.Path)
+  }
+
+  tw.Flush()
+  fmt.Printf("%d files pending approval, profiles: %s\n", len(view.Pending), strings.Join(view.Profiles, ", "))
+
+  return nil
+}
+
+// approval approves or rejects a file waiting for approval, given by its
+// name or path
+func (c *client) approval(command string, args []string) error {
+  flags := flag.NewFlagSet(command, flag.ExitOnError)
+  profile := flags.String("profile", "", "encode it with this profile rather than its own")
+  reason := flags.String("reason", "", "why it was rejected, written next to it")
+  flags.Parse(args)
+
+  // the flags may come after the file too
+  ref := flags.Arg(0)
+
+  if flags.NArg() > 0 {
+    flags.Parse(flags.Args()[1:])
+  }
+
+  if ref == "" || flags.NArg() > 0 {
+    return fmt.Errorf("usage: gowatcher %s <file> [--profile X|--reason text]", command)
+  }
+
+  // a bare name is looked up among the pending files
+  if strings.ContainsRune(ref, os.PathSeparator) {
+    abs, err := filepath.Abs(ref)
+
+    if err != nil {
+      return err
+    }
+
+    ref = abs
+  }
+
+  query := url.Values{"path": {ref}}
+
+  if command == "reject" {
+    if *reason != "" {
+      query.Set("reason", *reason)
+    }
+
+    body, err := c.do(http.MethodPost, "/pending/reject?"+query.Encode())
+
+    if err != nil {
+      return err
+    }
+
+    var resp struct {
+      Rejected string `json:"rejected"`
+    }
+
+    if err = json.Unmarshal(body, &resp); err != nil {
+      return err
+    }
+
+    fmt.Printf("Rejected %s, moved it to %s\n", filepath.Base(ref), resp.Rejected)
+
+    return nil
+  }
+
+  if *profile != "" {
+    query.Set("profile", *profile)
+  }
+
+  body, err := c.do(http.MethodPost, "/pending/approve?"+query.Encode())
+
+  if err != nil {
+    return err
+  }
+
+  var job watcher.JobView
+
+  if err = json.Unmarshal(body, &job); err != nil {
+    return err
+  }
+
+  fmt.Printf("Approved %s, queued as job %d with profile %s\n", filepath.Base(job.Input), job.ID, job.Profile)
+
+  return nil
+}
+
+// reencode asks the daemon to queue the originals encoded with an earlier
+// version of a profile
+func (c *client) reencode(args []string) error {
+  flags := flag.NewFlagSet("reencode", flag.ExitOnError)
+  profile := flags.String("profile", "", "the profile whose changes to encode the originals with")
+  since := flags.String("since", "", "only originals encoded since, like 2024-01-31")
+  dryRun := flags.Bool("dry-run", false, "list the originals without queueing them")
+  flags.Parse(args)
+
+  if *profile == "" {
+    return fmt.Errorf("usage: gowatcher reencode --profile X [--since 2024-01-31] [--dry-run]")
+  }
+
+  query := url.Values{"profile": {*profile}}
+
+  if *since != "" {
+    if _, err := watcher.ParseSince(*since); err != nil {
+      return err
+    }
+
+    query.Set("since", *since)
+  }
+
+  if *dryRun {
+    query.Set("dry_run", "true")
+  }
+
+  body, err := c.do(http.MethodPost, "/reencode?"+query.Encode())
+
+  if err != nil {
+    return err
+  }
+
+  var view watcher.ReencodeView
+
+  if err = json.Unmarshal(body, &view); err != nil {
+    return err
+  }
+
+  for _, original := range view.Originals {
+    fmt.Println(original)
+  }
+
+  if view.DryRun {
+    fmt.Printf("Would queue %d originals\n", len(view.Originals))
+  } else {
+    fmt.Printf("Queued %d originals\n", len(view.Originals))
+  }
+
+  return nil
+}
+
+// listFlag collects a repeated flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+  return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+  *l = append(*l, value)
+  return nil
+}
+
+// importLibrary asks the daemon to queue the files of a library
+func (c *client) importLibrary(args []string) error {
+  flags := flag.NewFlagSet("import", flag.ContinueOnError)
+  var filters listFlag
+  flags.Var(&filters, "filter", "only files whose name or path under the library matches, repeated for more")
+  link := flags.Bool("link", false, "symlink the files into the queue directory, the default")
+  copyFiles := flags.Bool("copy", false, "copy the files into the queue directory")
+  move := flags.Bool("move", false, "move the files into the queue directory")
+  dryRun := flags.Bool("dry-run", false, "list the files without queueing them")
+
+  if err := flags.Parse(args); err != nil {
+    return err
+  }
+
+  // the flags may come after the directory too
+  dirs := flags.Args()
+
+  if len(dirs) > 0 {
+    if err := flags.Parse(dirs[1:]); err != nil {
+      return err
+    }
+
+    dirs = append(dirs[:1], flags.Args()...)
+  }
+
+  if len(dirs) != 1 {
+    return fmt.Errorf("usage: gowatcher import <dir> [--filter '*.mkv'...] [--link|--copy|--move] [--dry-run]")
+  }
+
+  mode := watcher.ImportLink
+  modes := 0
+
+  for _, m := range []struct {
+    set  bool
+    mode watcher.ImportMode
+  }{{*link, watcher.ImportLink}, {*copyFiles, watcher.ImportCopy}, {*move, watcher.ImportMove}} {
+    if m.set {
+      mode = m.mode
+      modes++
+    }
+  }
+
+  if modes > 1 {
+    return fmt.Errorf("--link, --copy or --move, only one")
+  }
+
+  // the daemon does not run in this working directory
+  dir, err := filepath.Abs(dirs[0])
+
+  if err != nil {
+    return err
+  }
+
+  query := url.Values{"dir": {dir}, "mode": {string(mode)}, "filter": filters}
+
+  if *dryRun {
+    query.Set("dry_run", "true")
+  }
+
+  // copying a library takes longer than the other calls
+  c.http.Timeout = 0
+
+  body, err := c.do(http.MethodPost, "/import?"+query.Encode())
+
+  if err != nil {
+    return err
+  }
+
+  var view watcher.ImportView
+
+  if err = json.Unmarshal(body, &view); err != nil {
+    return err
+  }
+
+  for _, file := range view.Files {
+    fmt.Println(file)
+  }
+
+  if view.DryRun {
+    fmt.Printf("Would import %d files, %d already in the queue\n", len(view.Files), view.Skipped)
+  } else {
+    fmt.Printf("Imported %d files by %s, %d already in the queue\n", len(view.Files), view.Mode, view.Skipped)
+  }
+
+  return nil
+}
+
+// snapshot exports the daemon's jobs, or has it requeue an exported
+// snapshot's
+func (c *client) snapshot(args []string) error {
+  usage := fmt.Errorf("usage: gowatcher snapshot export [file] | import <file> [--map /old=/new...] [--copy|--link] [--failed] [--dry-run]")
+
+  if len(args) == 0 {
+    return usage
+  }
+
+  switch args[0] {
+  case "export":
+    if len(args) > 2 {
+      return usage
+    }
+
+    body, err := c.do(http.MethodGet, "/snapshot")
+
+    if err != nil {
+      return err
+    }
+
+    var s watcher.Snapshot
+
+    if err = json.Unmarshal(body, &s); err != nil {
+      return err
+    }
+
+    data, _ := json.MarshalIndent(s, "", "  ")
+    data = append(data, '\n')
+
+    if len(args) == 1 || args[1] == "-" {
+      _, err = os.Stdout.Write(data)
+      return err
+    }
+
+    if err = os.WriteFile(args[1], data, 0644); err != nil {
+      return err
+    }
+
+    fmt.Fprintf(os.Stderr, "Exported %d jobs to %s\n", len(s.Jobs), args[1])
+
+    return nil
+  case "import":
+  default:
+    return usage
+  }
+
+  flags := flag.NewFlagSet("snapshot import", flag.ContinueOnError)
+  var maps listFlag
+  flags.Var(&maps, "map", "rewrite inputs under /old to /new, repeated for more")
+  copyFiles := flags.Bool("copy", false, "copy the inputs into the queue directory")
+  link := flags.Bool("link", false, "symlink the inputs into the queue directory")
+  failed := flags.Bool("failed", false, "requeue the failed jobs too")
+  dryRun := flags.Bool("dry-run", false, "list the jobs without queueing them")
+
+  if err := flags.Parse(args[1:]); err != nil {
+    return err
+  }
+
+  // the flags may come after the file too
+  files := flags.Args()
+
+  if len(files) > 0 {
+    if err := flags.Parse(files[1:]); err != nil {
+      return err
+    }
+
+    files = append(files[:1], flags.Args()...)
+  }
+
+  if len(files) != 1 || (*copyFiles && *link) {
+    return usage
+  }
+
+  var data []byte
+  var err error
+
+  if files[0] == "-" {
+    data, err = io.ReadAll(os.Stdin)
+  } else {
+    data, err = os.ReadFile(files[0])
+  }
+
+  if err != nil {
+    return err
+  }
+
+  mode := watcher.ImportMove
+
+  if *copyFiles {
+    mode = watcher.ImportCopy
+  } else if *link {
+    mode = watcher.ImportLink
+  }
+
+  query := url.Values{"mode": {string(mode)}}
+
+  // the daemon does not run in this working directory
+  for _, m := range maps {
+    from, to, ok := strings.Cut(m, "=")
+
+    if !ok {
+      return fmt.Errorf("--map must be /old=/new, not %q", m)
+    }
+
+    if to, err = filepath.Abs(to); err != nil {
+      return err
+    }
+
+    query.Add("map", from+"="+to)
+  }
+
+  if *failed {
+    query.Set("failed", "true")
+  }
+
+  if *dryRun {
+    query.Set("dry_run", "true")
+  }
+
+  // copying the inputs takes longer than the other calls
+  c.http.Timeout = 0
+
+  body, err := c.send(http.MethodPost, "/snapshot?"+query.Encode(), bytes.NewReader(data))
+
+  if err != nil {
+    return err
+  }
+
+  var view watcher.SnapshotImportView
+
+  if err = json.Unmarshal(body, &view); err != nil {
+    return err
+  }
+
+  for _, input := range view.Queued {
+    fmt.Println(input)
+  }
+
+  for _, input := range view.Restored {
+    fmt.Println(input, "(restored)")
+  }
+
+  for _, input := range view.Missing {
+    fmt.Println(input, "(missing)")
+  }
+
+  verb := "Queued"
+
+  if view.DryRun {
+    verb = "Would queue"
+  }
+
+  fmt.Printf("%s %d jobs, restored %d already queued, %d missing, %d skipped\n", verb, len(view.Queued), len(view.Restored), len(view.Missing), view.Skipped)
+
+  return nil
+}
+
+// prune asks the daemon to apply its retentions and lists what they took
+func (c *client) prune(args []string) error {
+  flags := flag.NewFlagSet("prune", flag.ExitOnError)
+  dryRun := flags.Bool("dry-run", false, "list what would be pruned without touching it")
+  flags.Parse(args)
+
+  path := "/prune"
+
+  if *dryRun {
+    path += "?dry_run=true"
+  }
+
+  body, err := c.do(http.MethodPost, path)
+
+  if err != nil {
+    return err
+  }
+
+  var pruned []watcher.PrunedView
+
+  if err = json.Unmarshal(body, &pruned); err != nil {
+    return err
+  }
+
+  tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(tw, "ACTION\tREASON\tSIZE\tAGE\tPATH")
+
+  var total int64
+
+  for _, p := range pruned {
+    total += p.Bytes
+    age := time.Since(p.ModTime).Round(time.Hour).String()
+    fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Action, p.Reason, watcher.FormatSize(p.Bytes), age, p.Path)
+  }
+
+  if len(pruned) > 0 {
+    tw.Flush()
+    fmt.Println()
+  }
+
+  if *dryRun {
+    fmt.Printf("Would prune %d entries, %s\n", len(pruned), watcher.FormatSize(total))
+  } else {
+    fmt.Printf("Pruned %d entries, %s\n", len(pruned), watcher.FormatSize(total))
+  }
+
+  return nil
+}
+
+func (c *client) status() error {
+  var status watcher.StatusView
+
+  if err := c.get("/status", &status); err != nil {
+    return err
+  }
+
+  switch {
+  case status.Paused:
+    fmt.Println("State:   paused")
+  case status.Held:
+    fmt.Println("State:   outside the encode schedule")
+  case status.Deferred != "":
+    fmt.Printf("State:   deferring jobs that are not urgent, %s\n", status.Deferred)
+  default:
+    fmt.Println("State:   running")
+  }
+
+  fmt.Printf("Waiting: %d\n", status.Queued)
+
+  states := make([]string, 0, len(status.Counts))
+
+  for state, n := range status.Counts {
+    states = append(states, fmt.Sprintf("%s %d", state, n))
+  }
+
+  sort.Strings(states)
+
+  if len(states) > 0 {
+    fmt.Printf("Jobs:    %s\n", strings.Join(states, ", "))
+  }
+
+  if len(status.Active) == 0 {
+    fmt.Println("Nothing is encoding")
+    return nil
+  }
+
+  fmt.Println()
+
+  return printJobs(status.Active)
+}
+
+// health prints the daemon's /healthz, or /readyz with --ready, and fails
+// when it is not ok
+func (c *client) health(args []string) error {
+  flags := flag.NewFlagSet("health", flag.ExitOnError)
+  ready := flags.Bool("ready", false, "check that the daemon is ready for work, not only live")
+  flags.Parse(args)
+
+  path := "/healthz"
+
+  if *ready {
+    path = "/readyz"
+  }
+
+  resp, err := c.http.Get("http://gowatcher" + path)
+
+  if err != nil {
+    return fmt.Errorf("is gowatcher running? %w", err)
+  }
+
+  defer resp.Body.Close()
+
+  var h watcher.HealthView
+
+  if err = json.NewDecoder(resp.Body).Decode(&h); err != nil {
+    return fmt.Errorf("%s", resp.Status)
+  }
+
+  fmt.Printf("Live: %t, ready: %t, waiting: %d, encoding: %d\n", h.Live, h.Ready, h.Queued, h.Running)
+
+  for _, problem := range h.Problems {
+    fmt.Printf("  %s\n", problem)
+  }
+
+  if resp.StatusCode != http.StatusOK {
+    return fmt.Errorf("%s", resp.Status)
+  }
+
+  return nil
+}
+
+// stats prints the daemon's encode stats for each window, with a line per
+// profile when there is more than one
+func (c *client) stats(windows []string) error {
+  var views []watcher.StatsWindow
+
+  if err := c.get("/stats?window="+url.QueryEscape(strings.Join(windows, ",")), &views); err != nil {
+    return err
+  }
+
+  tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(tw, "WINDOW\tPROFILE\tDONE\tFAILED\tINPUT\tOUTPUT\tRATIO\tFPS\tSPEED\tAVG TIME")
+
+  for _, v := range views {
+    printStats(tw, v.Window, "all", v.StatsSummary)
+
+    if len(v.Profiles) < 2 {
+      continue
+    }
+
+    names := make([]string, 0, len(v.Profiles))
+
+    for name := range v.Profiles {
+      names = append(names, name)
+    }
+
+    sort.Strings(names)
+
+    for _, name := range names {
+      printStats(tw, "", name, *v.Profiles[name])
+    }
+  }
+
+  return tw.Flush()
+}
+
+func printStats(tw io.Writer, window string, profile string, s watcher.StatsSummary) {
+  ratio, fps, speed, took := "-", "-", "-", "-"
+
+  if s.Ratio > 0 {
+    ratio = fmt.Sprintf("%.0f%%", s.Ratio*100)
+  }
+
+  if s.FPS > 0 {
+    fps = fmt.Sprintf("%.1f", s.FPS)
+  }
+
+  if s.Speed > 0 {
+    speed = fmt.Sprintf("%.2fx", s.Speed)
+  }
+
+  if s.AvgWallSeconds > 0 {
+    took = time.Duration(s.AvgWallSeconds * float64(time.Second)).Round(time.Second).String()
+  }
+
+  fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", window, profile, s.Done, s.Failed,
+    watcher.FormatSize(s.InputBytes), watcher.FormatSize(s.OutputBytes), ratio, fps, speed, took)
+}
+
+func (c *client) jobs(state string) error {
+  var jobs []watcher.JobView
+
+  if err := c.get("/jobs?state="+state, &jobs); err != nil {
+    return err
+  }
+
+  return printJobs(jobs)
+}
+
+// printJobs writes jobs as a table
+func printJobs(jobs []watcher.JobView) error {
+  tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(tw, "ID\tSTATE\tPROFILE\tPROGRESS\tINPUT")
+
+  for _, j := range jobs {
+    progress := ""
+
+    switch {
+    case j.Percent != nil && j.ETASeconds != nil:
+      progress = fmt.Sprintf("%.1f%% eta %s", *j.Percent, (time.Duration(*j.ETASeconds) * time.Second).String())
+    case j.Percent != nil:
+      progress = fmt.Sprintf("%.1f%%", *j.Percent)
+    case j.Error != "":
+      progress = j.Error
+    }
+
+    fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", j.ID, j.State, j.Profile, progress, j.Input)
+  }
+
+  return tw.Flush()
+}
+
+// publish adds a URL to the Redis stream the workers read
+func publish(args []string) error {
+  rawURL, name, err := urlArgs("publish", args)
+
+  if err != nil {
+    return err
+  }
+
+  stream := streamFromEnv()
+
+  if stream == nil {
+    return fmt.Errorf("set REDIS_URL to publish")
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+  defer cancel()
+
+  id, err := watcher.PublishURL(ctx, *stream, rawURL, name)
+
+  if err != nil {
+    return err
+  }
+
+  fmt.Printf("Published %s as entry %s\n", rawURL, id)
+
+  return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "flag"
+  "fmt"
+  "os"
+  "os/signal"
+  "syscall"
+  "text/tabwriter"
+
+  "gowatcher/pkg/watcher"
+)
+
+// doctorCommand runs `gowatcher doctor [--json]`, the checks of
+// watcher.Doctor with the settings the daemon would get, for each root of
+// CONFIG_FILE when it has roots. It prints what each found and what to do
+// about what is wrong, and exits 1 when a check failed
+func doctorCommand(args []string) {
+  flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+  asJSON := flags.Bool("json", false, "print the checks as JSON")
+  flags.Parse(args)
+
+  ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer cancel()
+
+  cfg, fileRoots := configFromEnv()
+  var checks []watcher.DoctorCheck
+
+  if len(fileRoots) == 0 {
+    checks = watcher.Doctor(ctx, cfg)
+  }
+
+  for _, fr := range fileRoots {
+    rootCfg, err := fr.Apply(cfg)
+
+    if err != nil {
+      checks = append(checks, watcher.DoctorCheck{Name: "root " + fr.Name, Status: watcher.DoctorFail, Detail: err.Error(), Fix: "fix the root in CONFIG_FILE"})
+      continue
+    }
+
+    for _, c := range watcher.Doctor(ctx, rootCfg) {
+      c.Name = fr.Name + ": " + c.Name
+      checks = append(checks, c)
+    }
+  }
+
+  failed, warned := 0, 0
+
+  for _, c := range checks {
+    switch c.Status {
+    case watcher.DoctorFail:
+      failed++
+    case watcher.DoctorWarn:
+      warned++
+    }
+  }
+
+  if *asJSON {
+    data, _ := json.MarshalIndent(checks, "", "  ")
+    fmt.Println(string(data))
+  } else {
+    printDoctor(checks)
+    fmt.Printf("\n%d checks, %d failed, %d warnings\n", len(checks), failed, warned)
+  }
+
+  if failed > 0 {
+    os.Exit(1)
+  }
+}
+
+// printDoctor prints the checks, each one's fix under it
+func printDoctor(checks []watcher.DoctorCheck) {
+  tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+  for _, c := range checks {
+    status := "ok"
+
+    switch c.Status {
+    case watcher.DoctorFail:
+      status = "FAIL"
+    case watcher.DoctorWarn:
+      status = "WARN"
+    }
+
+    fmt.Fprintf(tw, "%s\t%s\t%s\n", status, c.Name, c.Detail)
+
+    if c.Fix != "" {
+      fmt.Fprintf(tw, "\t\t-> %s\n", c.Fix)
+    }
+  }
+
+  tw.Flush()
+}
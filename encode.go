@@ -0,0 +1,114 @@
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "os/signal"
+  "path/filepath"
+  "syscall"
+
+  "gowatcher/pkg/watcher"
+)
+
+// encodeCommand runs `gowatcher encode <file> [--profile X] [--out dir]`,
+// one file through the same pipeline as the daemon without watching
+// anything. The input is left where it is whatever the outcome. It exits 0
+// when the file was encoded or skipped, 2 when it failed and 3 when
+// interrupted, like batch mode
+func encodeCommand(args []string) {
+  flags := flag.NewFlagSet("encode", flag.ExitOnError)
+  profile := flags.String("profile", "", "profile to encode with, default PROFILE or the config file's")
+  out := flags.String("out", "", "directory for the outputs, default the finished directory")
+  dryRun := flags.Bool("dry-run", false, "log what would be encoded and how, without doing it")
+  flags.Parse(args)
+
+  // the flags may come after the file too
+  files := flags.Args()
+
+  if len(files) > 0 {
+    flags.Parse(files[1:])
+    files = append(files[:1], flags.Args()...)
+  }
+
+  if len(files) != 1 {
+    fmt.Fprintln(os.Stderr, "usage: gowatcher encode <file> [--profile X] [--out dir]")
+    os.Exit(1)
+  }
+
+  cfg, _ := configFromEnv()
+  cfg.DryRun = cfg.DryRun || *dryRun
+
+  if *profile != "" {
+    p, ok := cfg.Profiles[*profile]
+
+    if !ok {
+      fatal("Profile is not defined", "profile", *profile)
+    }
+
+    cfg.Profile = p
+  }
+
+  if *out != "" {
+    cfg.FinishedDir = *out
+  }
+
+  cfg.Originals = watcher.OriginalsKeep
+  cfg.FailedDir = ""
+
+  // a daemon may be using the working directory, which New empties, so
+  // encode in a directory of our own inside it
+  working := cfg.WorkingDir
+
+  if working == "" {
+    working = filepath.Join(cfg.BaseDir, "working")
+  }
+
+  if err := os.MkdirAll(working, 0755); err != nil {
+    fatal("Working directory error", "error", err)
+  }
+
+  private, err := os.MkdirTemp(working, ".encode-")
+
+  if err != nil {
+    fatal("Working directory error", "error", err)
+  }
+
+  cfg.WorkingDir = private
+
+  // the daemon holds the base directory's lock
+  cfg.SkipLock = true
+
+  w, err := watcher.New(cfg)
+
+  if err != nil {
+    os.RemoveAll(private)
+    fatal("Watcher error", "error", err)
+  }
+
+  ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+  defer cancel()
+
+  j, err := w.EncodeFile(ctx, files[0])
+  os.RemoveAll(private)
+
+  if err != nil {
+    fatal("Encode error", "error", err)
+  }
+
+  v := j.View()
+
+  switch {
+  case ctx.Err() != nil:
+    os.Exit(exitInterrupted)
+  case v.State == watcher.JobFailed:
+    slog.Error("Encode failed", "input", v.Input, "error", v.Error)
+    os.Exit(exitFailures)
+  case v.State == watcher.JobDone:
+    for _, output := range v.Outputs {
+      fmt.Println(output)
+    }
+  }
+}
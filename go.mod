@@ -1,7 +1,10 @@
 module gowatcher
 
-go 1.19
+go 1.21
 
-require github.com/fsnotify/fsnotify v1.6.0
-
-require golang.org/x/sys v0.0.0-20220908164124-27713097b956 // indirect
+require (
+	github.com/fsnotify/fsnotify v1.6.0
+	golang.org/x/sys v0.0.0-20220908164124-27713097b956
+	golang.org/x/text v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
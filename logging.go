@@ -0,0 +1,127 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "gowatcher/pkg/watcher"
+)
+
+// newLogger builds the program's logger from LOG_LEVEL and LOG_FORMAT,
+// writing to stderr or appending to LOG_FILE, rotated as LOG_MAX_SIZE and
+// the rest say
+func newLogger(level string, format string, file string) (*slog.Logger, error) {
+  if file == "" {
+    return newLoggerTo(os.Stderr, level, format)
+  }
+
+  rotation, err := logRotationFromEnv()
+
+  if err != nil {
+    return nil, err
+  }
+
+  f, err := watcher.OpenLogFile(file, rotation)
+
+  if err != nil {
+    return nil, fmt.Errorf("LOG_FILE: %s", err)
+  }
+
+  return newLoggerTo(f, level, format)
+}
+
+// logRotationFromEnv reads LOG_MAX_SIZE, LOG_MAX_AGE, LOG_KEEP,
+// LOG_KEEP_FOR and LOG_COMPRESS
+func logRotationFromEnv() (watcher.LogRotation, error) {
+  var r watcher.LogRotation
+  var err error
+
+  if size := os.Getenv("LOG_MAX_SIZE"); size != "" {
+    if r.MaxSize, err = watcher.ParseSize(size); err != nil || r.MaxSize < 0 {
+      return r, fmt.Errorf("LOG_MAX_SIZE %q is not a valid size", size)
+    }
+  }
+
+  if age := os.Getenv("LOG_MAX_AGE"); age != "" {
+    if r.MaxAge, err = time.ParseDuration(age); err != nil || r.MaxAge < 0 {
+      return r, fmt.Errorf("LOG_MAX_AGE %q is not a valid duration", age)
+    }
+  }
+
+  if keep := os.Getenv("LOG_KEEP"); keep != "" {
+    if r.Keep, err = strconv.Atoi(keep); err != nil || r.Keep <= 0 {
+      return r, fmt.Errorf("LOG_KEEP %q must be a positive number", keep)
+    }
+  }
+
+  if keepFor := os.Getenv("LOG_KEEP_FOR"); keepFor != "" {
+    if r.KeepFor, err = time.ParseDuration(keepFor); err != nil || r.KeepFor < 0 {
+      return r, fmt.Errorf("LOG_KEEP_FOR %q is not a valid duration", keepFor)
+    }
+  }
+
+  if compress := os.Getenv("LOG_COMPRESS"); compress != "" {
+    if r.Compress, err = strconv.ParseBool(compress); err != nil {
+      return r, fmt.Errorf("LOG_COMPRESS %q must be true or false", compress)
+    }
+  }
+
+  return r, nil
+}
+
+func newLoggerTo(w io.Writer, level string, format string) (*slog.Logger, error) {
+  var lvl slog.Level
+
+  if level != "" {
+    if err := lvl.UnmarshalText([]byte(level)); err != nil {
+      return nil, fmt.Errorf("LOG_LEVEL %q must be debug, info, warn or error", level)
+    }
+  }
+
+  opts := &slog.HandlerOptions{Level: lvl}
+
+  switch strings.ToLower(format) {
+  case "", "text":
+    return slog.New(slog.NewTextHandler(w, opts)), nil
+  case "json":
+    return slog.New(slog.NewJSONHandler(w, opts)), nil
+  }
+
+  return nil, fmt.Errorf("LOG_FORMAT %q must be text or json", format)
+}
+
+// exitFuncs are run by fatal before it exits, which skips the deferred
+// calls, e.g. to remove the control sockets
+var (
+  exitMu    sync.Mutex
+  exitFuncs []func()
+)
+
+// atExit has fatal run f before it exits
+func atExit(f func()) {
+  exitMu.Lock()
+  exitFuncs = append(exitFuncs, f)
+  exitMu.Unlock()
+}
+
+// fatal logs an error and exits the program
+func fatal(msg string, args ...any) {
+  slog.Error(msg, args...)
+
+  exitMu.Lock()
+  funcs := exitFuncs
+  exitFuncs = nil
+  exitMu.Unlock()
+
+  for _, f := range funcs {
+    f()
+  }
+
+  os.Exit(1)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+
+  "gowatcher/pkg/watcher"
+)
+
+// migrateCommand runs `gowatcher migrate [--dry-run] [--json]`, bringing the
+// state in BASE_DIR, and in each root's of CONFIG_FILE when it has roots,
+// up to this gowatcher's version with watcher.MigrateState. The daemon
+// must be stopped. It exits 1 when a base directory could not be migrated
+func migrateCommand(args []string) {
+  flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+  dryRun := flags.Bool("dry-run", false, "list the migrations without applying them")
+  asJSON := flags.Bool("json", false, "print what was migrated as JSON")
+  flags.Parse(args)
+
+  cfg, fileRoots := configFromEnv()
+  configs := []watcher.Config{cfg}
+
+  if len(fileRoots) > 0 {
+    configs = configs[:0]
+
+    for _, fr := range fileRoots {
+      rootCfg, err := fr.Apply(cfg)
+
+      if err != nil {
+        fatal("Invalid root in CONFIG_FILE", "root", fr.Name, "error", err)
+      }
+
+      configs = append(configs, rootCfg)
+    }
+  }
+
+  var reports []watcher.StateReport
+  failed := 0
+
+  for _, c := range configs {
+    report, err := watcher.MigrateState(c, *dryRun)
+
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "gowatcher migrate: %s\n", err)
+      failed++
+      continue
+    }
+
+    reports = append(reports, report)
+  }
+
+  if *asJSON {
+    data, _ := json.MarshalIndent(reports, "", "  ")
+    fmt.Println(string(data))
+  } else {
+    for _, r := range reports {
+      printMigration(r)
+    }
+  }
+
+  if failed > 0 {
+    os.Exit(1)
+  }
+}
+
+// printMigration prints what was migrated in a base directory
+func printMigration(r watcher.StateReport) {
+  switch {
+  case r.Newer:
+    fmt.Printf("%s: state version %d, from a newer gowatcher (this one's is %d)\n", r.Dir, r.From, r.To)
+    return
+  case len(r.Migrations) == 0:
+    fmt.Printf("%s: state version %d, up to date\n", r.Dir, r.To)
+    return
+  case r.DryRun:
+    fmt.Printf("%s: state version %d, would migrate to %d\n", r.Dir, r.From, r.To)
+  default:
+    fmt.Printf("%s: migrated state version %d to %d\n", r.Dir, r.From, r.To)
+  }
+
+  rewrote := "rewrote"
+
+  if r.DryRun {
+    rewrote = "would rewrite"
+  }
+
+  for _, m := range r.Migrations {
+    fmt.Printf("  %d  %s\n", m.Version, m.What)
+
+    if len(m.Files) > 0 {
+      fmt.Printf("     %s %s\n", rewrote, strings.Join(m.Files, ", "))
+    }
+  }
+}
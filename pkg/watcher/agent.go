@@ -0,0 +1,538 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "crypto/tls"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "log/slog"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+const (
+  // agentReportInterval is how often an agent reports a task's progress
+  agentReportInterval = 2 * time.Second
+
+  // agentRetry is how long an agent waits after the coordinator could not
+  // be reached
+  agentRetry = 5 * time.Second
+)
+
+// errTaskLost is a task the coordinator took back, it was cancelled or
+// handed to another agent
+var errTaskLost = errors.New("the coordinator took the task back")
+
+// AgentConfig configures an Agent
+type AgentConfig struct {
+  // Coordinator is the coordinator's gRPC address, host:port. TLS checks
+  // its certificate, with the system's CAs when nil, and has this agent's
+  // when the coordinator asks for one
+  Coordinator string
+  TLS         *tls.Config
+
+  // Token is the coordinator's Agents.Token, and Root names the root there
+  // when it has several
+  Token string
+  Root  string
+
+  // Name is the agent in the coordinator's logs, default the host name
+  Name string
+
+  // Workers is how many tasks are encoded at once, default 1
+  Workers int
+
+  // FFmpegPath is the ffmpeg the tasks run, default ffmpeg from PATH
+  FFmpegPath string
+
+  // WorkingDir holds each task's copy of the input and its outputs until it
+  // is over, default gowatcher-agent in the temporary directory
+  WorkingDir string
+}
+
+// Agent encodes the ffmpeg runs a coordinator's Agents dispatch, on a
+// machine that needs ffmpeg and nothing of the coordinator's directories
+type Agent struct {
+  cfg    AgentConfig
+  client *GRPCClient
+}
+
+// agentTaskView is a task as the coordinator sends it
+type agentTaskView struct {
+  id      string
+  jobID   int64
+  jobUID  string
+  input   string
+  working string
+  args    []string
+  dirs    []string
+}
+
+// NewAgent checks the config and removes what tasks left in the working
+// directory when the agent last stopped
+func NewAgent(cfg AgentConfig) (*Agent, error) {
+  if cfg.Coordinator == "" {
+    return nil, fmt.Errorf("the coordinator's address is required")
+  }
+
+  if cfg.Token == "" {
+    return nil, fmt.Errorf("the coordinator's token is required")
+  }
+
+  if cfg.Name == "" {
+    cfg.Name, _ = os.Hostname()
+  }
+
+  if cfg.Workers <= 0 {
+    cfg.Workers = 1
+  }
+
+  if cfg.FFmpegPath == "" {
+    cfg.FFmpegPath = "ffmpeg"
+  }
+
+  if cfg.WorkingDir == "" {
+    cfg.WorkingDir = filepath.Join(os.TempDir(), "gowatcher-agent")
+  }
+
+  if err := os.MkdirAll(cfg.WorkingDir, os.ModePerm); err != nil {
+    return nil, err
+  }
+
+  leftover, _ := filepath.Glob(filepath.Join(cfg.WorkingDir, "task-*"))
+  removeAll(leftover)
+
+  client := NewGRPCClient(cfg.Coordinator, cfg.TLS)
+  client.Root, client.Token = cfg.Root, cfg.Token
+
+  return &Agent{cfg: cfg, client: client}, nil
+}
+
+// Run takes tasks from the coordinator and encodes them until ctx is done.
+// A task running then is given back for another agent
+func (a *Agent) Run(ctx context.Context) error {
+  slog.Info("Agent started", "coordinator", a.cfg.Coordinator, "name", a.cfg.Name, "workers", a.cfg.Workers)
+
+  var wg sync.WaitGroup
+
+  for i := 0; i < a.cfg.Workers; i++ {
+    wg.Add(1)
+
+    go func() {
+      defer wg.Done()
+      a.work(ctx)
+    }()
+  }
+
+  wg.Wait()
+
+  return nil
+}
+
+func (a *Agent) work(ctx context.Context) {
+  for ctx.Err() == nil {
+    t, err := a.take(ctx)
+
+    if err != nil {
+      if ctx.Err() != nil {
+        return
+      }
+
+      slog.Error("Could not take a task from the coordinator", "coordinator", a.cfg.Coordinator, "error", err)
+
+      select {
+      case <-ctx.Done():
+      case <-time.After(agentRetry):
+      }
+
+      continue
+    }
+
+    if t != nil {
+      a.encode(ctx, t)
+    }
+  }
+}
+
+// take asks the coordinator for a task, nil when it had none for a while
+func (a *Agent) take(ctx context.Context) (*agentTaskView, error) {
+  var t agentTaskView
+
+  err := a.client.call(ctx, "TakeTask", pbString(nil, 1, a.cfg.Name), func(msg []byte) error {
+    return pbFields(msg, func(field int, v uint64, data []byte) {
+      switch field {
+      case 1:
+        t.id = string(data)
+      case 2:
+        t.jobID = int64(v)
+      case 3:
+        t.jobUID = string(data)
+      case 4:
+        t.input = string(data)
+      case 5:
+        t.working = string(data)
+      case 6:
+        t.args = append(t.args, string(data))
+      case 7:
+        t.dirs = append(t.dirs, string(data))
+      }
+    })
+  })
+
+  if err != nil || t.id == "" {
+    return nil, err
+  }
+
+  // the id names a directory here
+  if !isULID(t.id) {
+    return nil, fmt.Errorf("the coordinator sent a task id that is not a ULID: %q", t.id)
+  }
+
+  return &t, nil
+}
+
+// encode reads the task's input, runs ffmpeg on it and sends the outputs
+// back, then tells the coordinator how it went
+func (a *Agent) encode(ctx context.Context, t *agentTaskView) {
+  logger := slog.With("task", t.id, "job_id", t.jobID, "job_uid", t.jobUID)
+  dir := filepath.Join(a.cfg.WorkingDir, "task-"+t.id)
+  defer os.RemoveAll(dir)
+
+  // the coordinator's input may have a name of another platform's
+  name := filepath.Base(strings.ReplaceAll(t.input, `\`, "/"))
+
+  if !filepath.IsLocal(name) {
+    name = "input"
+  }
+
+  input := filepath.Join(dir, "input", name)
+  working := filepath.Join(dir, "working")
+
+  logger.Info("Took task", "input", name)
+  started := time.Now()
+
+  err := os.MkdirAll(filepath.Dir(input), os.ModePerm)
+
+  if err == nil {
+    err = os.MkdirAll(working, os.ModePerm)
+  }
+
+  if err == nil {
+    err = a.download(ctx, t, input)
+  }
+
+  if err == nil {
+    err = a.ffmpeg(ctx, t, input, working)
+  }
+
+  if err == nil {
+    err = a.upload(ctx, t, working)
+  }
+
+  var status *GRPCStatusError
+
+  if errors.Is(err, errTaskLost) || (errors.As(err, &status) && status.Code == grpcNotFound) {
+    logger.Warn("Coordinator took the task back, cancelled or handed to another agent")
+    return
+  }
+
+  // on the way out the task goes to another agent
+  abandoned := ctx.Err() != nil
+  finishCtx := ctx
+
+  if abandoned {
+    var cancel context.CancelFunc
+    finishCtx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+  }
+
+  msg := pbString(nil, 1, t.id)
+
+  if err != nil && !abandoned {
+    msg = pbString(msg, 2, err.Error())
+  }
+
+  msg = pbBool(msg, 3, abandoned)
+
+  if finishErr := a.client.call(finishCtx, "FinishTask", msg, func([]byte) error { return nil }); finishErr != nil {
+    logger.Error("Could not tell the coordinator the task is over", "error", finishErr)
+    return
+  }
+
+  switch {
+  case abandoned:
+    logger.Info("Gave the task back")
+  case err != nil:
+    logger.Error("Task failed", "error", err, "took", time.Since(started).Round(time.Second).String())
+  default:
+    logger.Info("Finished task", "took", time.Since(started).Round(time.Second).String())
+  }
+}
+
+// download copies the task's input from the coordinator to path
+func (a *Agent) download(ctx context.Context, t *agentTaskView, path string) error {
+  f, err := os.Create(path)
+
+  if err != nil {
+    return err
+  }
+
+  err = a.client.call(ctx, "ReadInput", pbString(nil, 1, t.id), func(msg []byte) error {
+    var writeErr error
+
+    err := pbFields(msg, func(field int, _ uint64, data []byte) {
+      if field == 1 && writeErr == nil {
+        _, writeErr = f.Write(data)
+      }
+    })
+
+    if err != nil {
+      return err
+    }
+
+    return writeErr
+  })
+
+  if closeErr := f.Close(); err == nil {
+    err = closeErr
+  }
+
+  return err
+}
+
+// agentReport gathers what ffmpeg writes between two reports
+type agentReport struct {
+  mu       sync.Mutex
+  progress bytes.Buffer
+  log      bytes.Buffer
+}
+
+// agentWriter writes to one of a report's buffers
+type agentWriter struct {
+  r   *agentReport
+  buf *bytes.Buffer
+}
+
+func (w agentWriter) Write(p []byte) (int, error) {
+  w.r.mu.Lock()
+  defer w.r.mu.Unlock()
+
+  return w.buf.Write(p)
+}
+
+// message is the ReportTask request with what was written since the last,
+// once it was sent it is gone from the buffers
+func (r *agentReport) message(id string) []byte {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  msg := pbString(nil, 1, id)
+
+  if r.progress.Len() > 0 {
+    msg = pbMessage(msg, 2, r.progress.Bytes())
+  }
+
+  if r.log.Len() > 0 {
+    msg = pbMessage(msg, 3, r.log.Bytes())
+  }
+
+  r.progress.Reset()
+  r.log.Reset()
+
+  return msg
+}
+
+// ffmpeg runs the task's ffmpeg with the coordinator's paths replaced by
+// this agent's, reporting its progress and output as it goes. It is stopped
+// once ctx is done or the coordinator takes the task back
+func (a *Agent) ffmpeg(ctx context.Context, t *agentTaskView, input string, working string) error {
+  local := func(s string) string {
+    return strings.ReplaceAll(strings.ReplaceAll(s, t.input, input), t.working, working)
+  }
+
+  args := make([]string, len(t.args))
+
+  for i, arg := range t.args {
+    args[i] = local(arg)
+  }
+
+  for _, dir := range t.dirs {
+    if err := os.MkdirAll(local(dir), os.ModePerm); err != nil {
+      return err
+    }
+  }
+
+  report := &agentReport{}
+
+  cmd := exec.Command(a.cfg.FFmpegPath, args...)
+  cmd.Stdout = agentWriter{report, &report.progress}
+  cmd.Stderr = agentWriter{report, &report.log}
+  prepareInterrupt(cmd)
+  prepareChild(cmd)
+
+  if err := cmd.Start(); err != nil {
+    return err
+  }
+
+  if err := adoptChild(cmd.Process); err != nil {
+    slog.Warn("Could not tie ffmpeg to the agent, it outlives a crash", "task", t.id, "error", err)
+  }
+
+  exited := make(chan struct{})
+  lost := make(chan struct{})
+  var lostOnce sync.Once
+
+  send := func(reportCtx context.Context) {
+    err := a.client.call(reportCtx, "ReportTask", report.message(t.id), func([]byte) error { return nil })
+
+    var status *GRPCStatusError
+
+    if errors.As(err, &status) && status.Code == grpcNotFound {
+      lostOnce.Do(func() { close(lost) })
+    } else if err != nil && reportCtx.Err() == nil {
+      slog.Warn("Could not report task's progress", "task", t.id, "error", err)
+    }
+  }
+
+  // report as it goes, and stop ffmpeg like runFFmpeg does when the task is
+  // over here
+  go func() {
+    ticker := time.NewTicker(agentReportInterval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        send(ctx)
+        continue
+      case <-exited:
+        return
+      case <-ctx.Done():
+      case <-lost:
+      }
+
+      if err := interrupt(cmd.Process); err != nil {
+        _ = cmd.Process.Kill()
+        return
+      }
+
+      select {
+      case <-exited:
+      case <-time.After(killGrace):
+        _ = cmd.Process.Kill()
+      }
+
+      return
+    }
+  }()
+
+  err := cmd.Wait()
+  close(exited)
+
+  select {
+  case <-lost:
+    return errTaskLost
+  default:
+  }
+
+  if ctx.Err() != nil {
+    return ctx.Err()
+  }
+
+  // the rest of ffmpeg's output, its last lines say why it failed
+  send(ctx)
+
+  return err
+}
+
+// upload sends the files in the working directory to the coordinator's
+// working directory for the task
+func (a *Agent) upload(ctx context.Context, t *agentTaskView, working string) error {
+  r, w := io.Pipe()
+
+  go func() {
+    w.CloseWithError(agentSendFiles(w, t.id, working))
+  }()
+
+  err := a.client.stream(ctx, "PutOutput", r, func([]byte) error { return nil })
+  r.Close()
+
+  return err
+}
+
+// agentSendFiles writes a PutOutput message for each chunk of each file in
+// dir, at least one for each file
+func agentSendFiles(w io.Writer, id string, dir string) error {
+  send := func(path string, data []byte) error {
+    msg := pbMessage(pbString(pbString(nil, 1, id), 2, path), 3, data)
+    prefix := make([]byte, 5, 5+len(msg))
+    binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+
+    _, err := w.Write(append(prefix, msg...))
+
+    return err
+  }
+
+  buf := make([]byte, agentChunk)
+
+  return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+    if err != nil || !entry.Type().IsRegular() {
+      return err
+    }
+
+    rel, err := filepath.Rel(dir, path)
+
+    if err != nil {
+      return err
+    }
+
+    f, err := os.Open(path)
+
+    if err != nil {
+      return err
+    }
+
+    defer f.Close()
+
+    for sent := false; ; sent = true {
+      n, err := io.ReadFull(f, buf)
+
+      if n > 0 || !sent {
+        if sendErr := send(filepath.ToSlash(rel), buf[:n]); sendErr != nil {
+          return sendErr
+        }
+      }
+
+      if err == io.EOF || err == io.ErrUnexpectedEOF {
+        return nil
+      }
+
+      if err != nil {
+        return err
+      }
+    }
+  })
+}
+
+// isULID reports whether s is written like a ULID
+func isULID(s string) bool {
+  if len(s) != 26 {
+    return false
+  }
+
+  for _, c := range s {
+    if !strings.ContainsRune(crockford, c) {
+      return false
+    }
+  }
+
+  return true
+}
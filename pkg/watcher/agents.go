@@ -0,0 +1,615 @@
+package watcher
+
+import (
+  "context"
+  "crypto/subtle"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Agents hands the ffmpeg runs of the jobs to gowatcher agents on other
+// machines, which share no filesystem with this one, the coordinator. It
+// watches the queue and runs each job as usual up to ffmpeg, then puts each
+// run up as a task that an agent takes over the gRPC API, so GRPC_ADDR must
+// be served. The agent reads the input from here, runs ffmpeg on its copy,
+// reports the progress and ffmpeg's output as it goes and sends the files
+// it wrote into the job's working directory, where they are validated,
+// moved to finished and delivered like any other. A task whose agent stops
+// reporting for Lease is handed to another. A run waits for an agent as
+// long as it takes, the job's timeouts still apply. Runs of other programs,
+// resumable segments, split pieces, image sequences and growing inputs are
+// encoded here. Files a profile names besides the input, like a watermark,
+// must be at the same path on the agents, and the sandbox does not apply
+// to them
+type Agents struct {
+  // Token is the secret the agents send with each call, required
+  Token string
+
+  // Lease is how long a task is held for an agent that stopped reporting,
+  // default 1m
+  Lease time.Duration
+}
+
+const (
+  defaultAgentLease = time.Minute
+
+  // agentPoll is how long an agent's call for a task waits for one
+  agentPoll = 30 * time.Second
+
+  // agentChunk is the size of the pieces files are sent in
+  agentChunk = 1 << 20
+)
+
+func (a *Agents) check() error {
+  if a.Token == "" {
+    return fmt.Errorf("a token is required")
+  }
+
+  if a.Lease < 0 {
+    return fmt.Errorf("lease must not be negative")
+  }
+
+  if a.Lease == 0 {
+    a.Lease = defaultAgentLease
+  }
+
+  return nil
+}
+
+// agentTask is an ffmpeg run waiting for an agent or encoding on one.
+// input and working are this machine's paths, the agent replaces them in
+// the args with its own
+type agentTask struct {
+  id      string
+  job     *Job
+  name    string
+  args    []string
+  dirs    []string
+  input   string
+  working string
+
+  // log gets ffmpeg's output and progress its progress lines, as the
+  // agent reports them
+  log      io.Writer
+  progress io.Writer
+
+  // agent is the one that took it, seen when it last reported
+  agent string
+  seen  time.Time
+
+  done chan error
+}
+
+// dispatcher holds the tasks for the agents. A task is in tasks from when
+// it is put up until it is over, and in pending until an agent takes it
+type dispatcher struct {
+  cfg Agents
+
+  mu      sync.Mutex
+  pending []*agentTask
+  tasks   map[string]*agentTask
+
+  // added is closed and replaced when a task is put up, waking the agents
+  // waiting for one
+  added chan struct{}
+}
+
+func newDispatcher(cfg Agents) *dispatcher {
+  return &dispatcher{cfg: cfg, tasks: make(map[string]*agentTask), added: make(chan struct{})}
+}
+
+// takes reports whether the run of the job is encoded by an agent, false
+// for a nil dispatcher
+func (d *dispatcher) takes(j *Job, run ffmpegRun) bool {
+  if d == nil || run.program != "" || run.resume != nil || run.captureFile != "" || j.sequence != nil || j.growing {
+    return false
+  }
+
+  info, err := os.Stat(j.source())
+
+  return err == nil && info.Mode().IsRegular()
+}
+
+// put puts the task up for the agents under a new id, a task handed to
+// another agent gets a new one so the first can no longer touch it
+func (d *dispatcher) put(t *agentTask) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  delete(d.tasks, t.id)
+
+  t.id, t.agent = newULID(), ""
+  d.tasks[t.id] = t
+  d.pending = append(d.pending, t)
+
+  close(d.added)
+  d.added = make(chan struct{})
+}
+
+// remove takes the task off the dispatcher, its agent's next call fails
+func (d *dispatcher) remove(t *agentTask) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  delete(d.tasks, t.id)
+
+  for i, p := range d.pending {
+    if p == t {
+      d.pending = append(d.pending[:i], d.pending[i+1:]...)
+      break
+    }
+  }
+}
+
+// take hands the oldest pending task to the agent, waiting up to agentPoll
+// for one. It returns nil when there was none
+func (d *dispatcher) take(ctx context.Context, agent string) *agentTask {
+  timer := time.NewTimer(agentPoll)
+  defer timer.Stop()
+
+  for {
+    d.mu.Lock()
+
+    if len(d.pending) > 0 {
+      t := d.pending[0]
+      d.pending = d.pending[1:]
+      t.agent, t.seen = agent, time.Now()
+      d.mu.Unlock()
+
+      t.job.logger().Info("Agent took run", "step", t.name, "agent", agent, "task", t.id)
+
+      return t
+    }
+
+    added := d.added
+    d.mu.Unlock()
+
+    select {
+    case <-added:
+    case <-ctx.Done():
+      return nil
+    case <-timer.C:
+      return nil
+    }
+  }
+}
+
+// task is the task with the id taken by an agent, noting that it was heard
+// from
+func (d *dispatcher) task(id string) (*agentTask, error) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  t := d.tasks[id]
+
+  if t == nil || t.agent == "" {
+    return nil, grpcErrorf(grpcNotFound, "no task %q, it was cancelled or handed to another agent", id)
+  }
+
+  t.seen = time.Now()
+
+  return t, nil
+}
+
+// agent is the agent that took the task, "" while it is pending, and
+// whether it has not been heard from for the lease
+func (d *dispatcher) agent(t *agentTask) (string, bool) {
+  d.mu.Lock()
+  defer d.mu.Unlock()
+
+  return t.agent, t.agent != "" && time.Since(t.seen) >= d.cfg.Lease
+}
+
+// finish ends the task with the agent's error, or puts it up again for
+// another agent when this one gave it up
+func (d *dispatcher) finish(t *agentTask, err error, abandoned bool) {
+  if abandoned {
+    agent, _ := d.agent(t)
+    t.job.logger().Warn("Agent gave up run, dispatching again", "step", t.name, "agent", agent)
+    d.put(t)
+    return
+  }
+
+  d.remove(t)
+
+  select {
+  case t.done <- err:
+  default:
+  }
+}
+
+// runAgent runs the job's ffmpeg run on an agent like runFFmpeg runs it
+// here, it returns once the agent finished it or ctx is done
+func (e *encoder) runAgent(ctx context.Context, j *Job, run ffmpegRun, output io.Writer, duration time.Duration) error {
+  logger := j.logger()
+  level, main := e.logLevels(j)
+
+  prog := run.progress
+
+  if prog == nil {
+    prog = newProgress(duration)
+
+    j.mu.Lock()
+    j.progress = prog
+    j.mu.Unlock()
+  }
+
+  progressReader, progressWriter := io.Pipe()
+  progressDone := make(chan struct{})
+
+  go func() {
+    prog.read(progressReader)
+    close(progressDone)
+  }()
+
+  args := run.commandArgs(level)
+  fmt.Fprintf(output, "agent: ffmpeg %s\n\n", strings.Join(args, " "))
+
+  t := &agentTask{
+    job:      j,
+    name:     run.name,
+    args:     args,
+    dirs:     run.dirs,
+    input:    j.source(),
+    working:  e.jobDir(j),
+    log:      newFFmpegLog(output, logger, run.name, main),
+    progress: progressWriter,
+    done:     make(chan error, 1),
+  }
+
+  logger.Info("Dispatching run to an agent", "step", run.name)
+  e.agents.put(t)
+
+  ticker := time.NewTicker(e.progressInterval)
+  defer ticker.Stop()
+
+  var err error
+
+wait:
+  for {
+    select {
+    case err = <-t.done:
+      break wait
+    case <-ctx.Done():
+      e.agents.remove(t)
+      err = ctx.Err()
+      break wait
+    case <-ticker.C:
+      agent, lost := e.agents.agent(t)
+
+      if lost {
+        logger.Warn("Agent stopped reporting, dispatching run again", "step", run.name, "agent", agent, "lease", e.agents.cfg.Lease.String())
+        e.agents.put(t)
+        continue
+      }
+
+      if run.progress == nil && agent != "" {
+        logger.Info("Progress", "step", run.name, "progress", prog.String())
+      }
+    }
+  }
+
+  progressWriter.Close()
+  <-progressDone
+
+  if err == nil && len(run.outputs) > 0 && !run.copiesVideo() {
+    j.mu.Lock()
+    j.frames += prog.frameCount()
+    j.mu.Unlock()
+  }
+
+  return err
+}
+
+// agentCall checks a call of an agent and returns the watcher's dispatcher
+func (w *Watcher) agentCall(r *http.Request) (*dispatcher, error) {
+  d := w.enc.agents
+
+  if d == nil {
+    return nil, grpcErrorf(grpcFailedPrecondition, "this instance does not dispatch to agents")
+  }
+
+  token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+  if subtle.ConstantTimeCompare([]byte(token), []byte(d.cfg.Token)) != 1 {
+    return nil, grpcErrorf(grpcUnauthenticated, "wrong agent token")
+  }
+
+  return d, nil
+}
+
+func (w *Watcher) grpcTakeTask(r *http.Request, req []byte) ([]byte, error) {
+  d, err := w.agentCall(r)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var agent string
+
+  err = pbFields(req, func(field int, _ uint64, data []byte) {
+    if field == 1 {
+      agent = string(data)
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  if agent == "" {
+    return nil, grpcErrorf(grpcInvalidArgument, "agent is required")
+  }
+
+  t := d.take(r.Context(), agent)
+
+  if t == nil {
+    return nil, nil
+  }
+
+  msg := pbString(nil, 1, t.id)
+  msg = pbVarint(msg, 2, uint64(t.job.id))
+  msg = pbString(msg, 3, t.job.uid)
+  msg = pbString(msg, 4, t.input)
+  msg = pbString(msg, 5, t.working)
+
+  // an empty argument is an argument too
+  for _, arg := range t.args {
+    msg = pbMessage(msg, 6, []byte(arg))
+  }
+
+  for _, dir := range t.dirs {
+    msg = pbString(msg, 7, dir)
+  }
+
+  return msg, nil
+}
+
+// grpcReadInput streams the task's input in chunks
+func (w *Watcher) grpcReadInput(rw http.ResponseWriter, r *http.Request, req []byte) error {
+  d, err := w.agentCall(r)
+
+  if err != nil {
+    return err
+  }
+
+  t, err := d.task(pbTaskID(req))
+
+  if err != nil {
+    return err
+  }
+
+  f, err := os.Open(t.input)
+
+  if err != nil {
+    return grpcErrorf(grpcNotFound, "%s", err)
+  }
+
+  defer f.Close()
+
+  buf := make([]byte, agentChunk)
+
+  for {
+    n, err := f.Read(buf)
+
+    if n > 0 {
+      if writeErr := grpcWrite(rw, pbMessage(nil, 1, buf[:n])); writeErr != nil {
+        return writeErr
+      }
+
+      // a large input takes a while, the lease holds while it is read
+      if _, err := d.task(t.id); err != nil {
+        return err
+      }
+    }
+
+    if err == io.EOF {
+      return nil
+    }
+
+    if err != nil {
+      return grpcErrorf(grpcInternal, "reading the input: %s", err)
+    }
+  }
+}
+
+func (w *Watcher) grpcReportTask(r *http.Request, req []byte) ([]byte, error) {
+  d, err := w.agentCall(r)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var id string
+  var progress, log []byte
+
+  err = pbFields(req, func(field int, _ uint64, data []byte) {
+    switch field {
+    case 1:
+      id = string(data)
+    case 2:
+      progress = data
+    case 3:
+      log = data
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  t, err := d.task(id)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if len(log) > 0 {
+    t.log.Write(log)
+  }
+
+  if len(progress) > 0 {
+    t.progress.Write(progress)
+  }
+
+  return nil, nil
+}
+
+// grpcPutOutput writes the files an agent sends into the task's working
+// directory. Each message has a chunk of the file at path, relative to the
+// working directory, a path not seen before starts a new file
+func (w *Watcher) grpcPutOutput(r *http.Request, req []byte) ([]byte, error) {
+  d, err := w.agentCall(r)
+
+  if err != nil {
+    return nil, err
+  }
+
+  // an agent that wrote nothing sends nothing
+  if req == nil {
+    return nil, nil
+  }
+
+  var t *agentTask
+  var f *os.File
+  var current string
+
+  defer func() {
+    if f != nil {
+      f.Close()
+    }
+  }()
+
+  for msg := req; ; {
+    var id, path string
+    var data []byte
+
+    err := pbFields(msg, func(field int, _ uint64, value []byte) {
+      switch field {
+      case 1:
+        id = string(value)
+      case 2:
+        path = string(value)
+      case 3:
+        data = value
+      }
+    })
+
+    if err != nil {
+      return nil, err
+    }
+
+    if t == nil || t.id != id {
+      if t, err = d.task(id); err != nil {
+        return nil, err
+      }
+    }
+
+    if path != current {
+      if !filepath.IsLocal(filepath.FromSlash(path)) {
+        return nil, grpcErrorf(grpcInvalidArgument, "%q is not a path in the working directory", path)
+      }
+
+      if f != nil {
+        if err := f.Close(); err != nil {
+          return nil, grpcErrorf(grpcInternal, "%s", err)
+        }
+      }
+
+      dest := filepath.Join(t.working, filepath.FromSlash(path))
+
+      if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+        return nil, grpcErrorf(grpcInternal, "%s", err)
+      }
+
+      if f, err = os.Create(dest); err != nil {
+        return nil, grpcErrorf(grpcInternal, "%s", err)
+      }
+
+      current = path
+    }
+
+    if _, err := f.Write(data); err != nil {
+      return nil, grpcErrorf(grpcInternal, "%s", err)
+    }
+
+    if msg, err = grpcReadMessage(r.Body); err == io.EOF {
+      break
+    } else if err != nil {
+      return nil, err
+    }
+  }
+
+  if f != nil {
+    err = f.Close()
+    f = nil
+
+    if err != nil {
+      return nil, grpcErrorf(grpcInternal, "%s", err)
+    }
+  }
+
+  return nil, nil
+}
+
+func (w *Watcher) grpcFinishTask(r *http.Request, req []byte) ([]byte, error) {
+  d, err := w.agentCall(r)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var id, message string
+  var abandoned bool
+
+  err = pbFields(req, func(field int, v uint64, data []byte) {
+    switch field {
+    case 1:
+      id = string(data)
+    case 2:
+      message = string(data)
+    case 3:
+      abandoned = v != 0
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  t, err := d.task(id)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var taskErr error
+
+  if message != "" {
+    taskErr = errors.New(message)
+  }
+
+  d.finish(t, taskErr, abandoned)
+
+  return nil, nil
+}
+
+// pbTaskID is the task field of a request naming only a task
+func pbTaskID(req []byte) string {
+  var id string
+
+  pbFields(req, func(field int, _ uint64, data []byte) {
+    if field == 1 {
+      id = string(data)
+    }
+  })
+
+  return id
+}
@@ -0,0 +1,136 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "time"
+)
+
+// queueAgeCheck is how often the queue's oldest job is looked at
+const queueAgeCheck = 30 * time.Second
+
+// queueAgeSample is how the queue stood at a check, queued and finished
+// counting the jobs since the start
+type queueAgeSample struct {
+  at       time.Time
+  oldest   time.Duration
+  queued   int64
+  finished int64
+}
+
+// queueAge is the job waiting longest for a worker, nil when none is, how
+// long it has been since it first arrived and how many have been waiting
+// longer than over
+func (w *Watcher) queueAge(now time.Time, over time.Duration) (*Job, time.Duration, int) {
+  var oldest *Job
+  var age time.Duration
+  count := 0
+
+  for _, j := range w.store.list("") {
+    j.mu.Lock()
+    state, arrivedAt := j.state, j.arrivedAt
+    j.mu.Unlock()
+
+    if state != JobQueued {
+      continue
+    }
+
+    waited := now.Sub(arrivedAt)
+
+    if waited > over {
+      count++
+    }
+
+    if oldest == nil || waited > age {
+      oldest, age = j, waited
+    }
+  }
+
+  return oldest, age, count
+}
+
+// watchQueueAge tells the handlers when the queue falls behind until stop
+// is closed: a "queue_aging" event once a job has been waiting longer than
+// maxAge, and a "backlog_growing" one once, over the last growing, more
+// jobs were queued than finished and the oldest job waiting has been
+// waiting longer at the end than at the start. Each is told again once it
+// cleared and happens again. A paused, held or deferred queue is not behind
+func (w *Watcher) watchQueueAge(maxAge time.Duration, growing time.Duration, stop <-chan struct{}) {
+  ticker := time.NewTicker(queueAgeCheck)
+  defer ticker.Stop()
+
+  var samples []queueAgeSample
+  aging, behind := false, false
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+
+    if w.queue.isPaused() || w.queue.isHeld() || w.queue.deferredFor() != "" {
+      samples, aging, behind = nil, false, false
+      continue
+    }
+
+    now := time.Now()
+    oldest, age, over := w.queueAge(now, maxAge)
+
+    if maxAge > 0 {
+      switch {
+      case over == 0:
+        aging = false
+      case !aging:
+        aging = true
+        w.queueAgeEvent("queue_aging", oldest, age, fmt.Sprintf("%d jobs have been waiting longer than %s, the oldest for %s", over, maxAge, age.Round(time.Second)))
+      }
+    }
+
+    if growing <= 0 {
+      continue
+    }
+
+    s := queueAgeSample{at: now, oldest: age, queued: w.stats.filesQueued.Load(), finished: w.stats.successes.Load() + w.stats.failures.Load()}
+    samples = append(samples, s)
+
+    // the first sample is the last one from before the window
+    for len(samples) > 1 && !samples[1].at.After(now.Add(-growing)) {
+      samples = samples[1:]
+    }
+
+    first := samples[0]
+
+    if now.Sub(first.at) < growing {
+      continue
+    }
+
+    intake, throughput := s.queued-first.queued, s.finished-first.finished
+
+    if oldest == nil || intake <= throughput || s.oldest <= first.oldest {
+      behind = false
+      continue
+    }
+
+    if !behind {
+      behind = true
+      w.queueAgeEvent("backlog_growing", oldest, age, fmt.Sprintf("%d jobs queued and %d finished in the last %s, the oldest has been waiting %s", intake, throughput, growing, age.Round(time.Second)))
+    }
+  }
+}
+
+// queueAgeEvent warns and tells the handlers about the queue falling
+// behind, oldest being the job waiting longest
+func (w *Watcher) queueAgeEvent(event string, oldest *Job, age time.Duration, message string) {
+  queued := w.queue.len()
+
+  oldest.mu.Lock()
+  ev := JobEvent{Event: event, JobID: oldest.id, JobUID: oldest.uid, Input: oldest.input, Queued: queued, DurationSeconds: age.Seconds(), Error: message}
+  oldest.mu.Unlock()
+
+  slog.Warn("Queue falling behind", "event", event, "queued", queued, "oldest", ev.Input, "waiting", age.Round(time.Second).String())
+
+  for _, h := range w.enc.handlers {
+    h.HandleEvent(ev)
+  }
+}
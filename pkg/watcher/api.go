@@ -0,0 +1,354 @@
+package watcher
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+// api serves the HTTP status and control endpoints:
+//
+//	GET  /status              worker pool state and job counts
+//	GET  /healthz             200 while the watcher is live, else 503
+//	GET  /readyz              200 while it is ready for work, see HealthView
+//	GET  /jobs[?state=...]    list jobs, optionally by state
+//	GET  /jobs/{id}           a single job, {id} is its id or ULID
+//	GET  /jobs/{id}/log       the tail of the job's ffmpeg output
+//	GET  /jobs/{id}/preflight the input's pre-flight report, see Preflight
+//	GET  /events[?job=id]     job events as they happen, server-sent events
+//	GET  /stats[?window=24h]  encode stats over time windows, see StatsWindow
+//	POST /jobs/{id}/cancel    cancel a queued or running job, ?then=requeue
+//	                          starts a running one over, ?then=fail fails it
+//	POST /jobs/{id}/requeue   requeue a failed or cancelled job
+//	POST /pause               stop workers from starting new jobs
+//	POST /resume              let workers start new jobs again
+//	POST /reload              reload the config, see Watcher.Reload
+//	POST /forget?path=...     remove a file from the ledger, see Watcher.Forget
+//	POST /enqueue?url=...     download a file and encode it, see Watcher.EnqueueURL
+//	POST /reencode?profile=X  encode the originals again, see Watcher.Reencode
+//	POST /prune[?dry_run=1]   apply the retentions now, see Watcher.Prune
+//	POST /import?dir=...      queue the files of a library, see Watcher.Import
+//	POST /clips?input=...     queue clips of a file, see Watcher.EnqueueClips
+//	GET  /snapshot            the queue and job state, see Watcher.Snapshot
+//	POST /snapshot            requeue a snapshot's jobs, see Watcher.ImportSnapshot
+//	GET  /pending             the files waiting for approval, see Config.Approval
+//	POST /pending/approve?path=...[&profile=X]
+//	                          queue one, see Watcher.Approve
+//	POST /pending/reject?path=...[&reason=...]
+//	                          reject one, see Watcher.Reject
+//	GET  /ui/                 the web dashboard, / redirects to it
+type api struct {
+  w *Watcher
+}
+
+func (a *api) handler() http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/status", a.status)
+  mux.HandleFunc("/healthz", a.health(false))
+  mux.HandleFunc("/readyz", a.health(true))
+  mux.HandleFunc("/jobs", a.jobs)
+  mux.HandleFunc("/jobs/", a.jobAction)
+  mux.HandleFunc("/events", a.events)
+  mux.HandleFunc("/stats", a.stats)
+  mux.HandleFunc("/pause", a.pause(true))
+  mux.HandleFunc("/resume", a.pause(false))
+  mux.HandleFunc("/reload", a.reload)
+  mux.HandleFunc("/forget", a.forget)
+  mux.HandleFunc("/enqueue", a.enqueue)
+  mux.HandleFunc("/reencode", a.reencode)
+  mux.HandleFunc("/prune", a.prune)
+  mux.HandleFunc("/import", a.importLibrary)
+  mux.HandleFunc("/clips", a.clips)
+  mux.HandleFunc("/snapshot", a.snapshot)
+  mux.HandleFunc("/pending", a.pendingAction)
+  mux.HandleFunc("/pending/", a.pendingAction)
+
+  ui, index := dashboard()
+  mux.Handle("/ui/", ui)
+  mux.HandleFunc("/", index)
+
+  return mux
+}
+
+// StatusView is the JSON returned by GET /status
+type StatusView struct {
+  Paused bool `json:"paused"`
+  Held   bool `json:"outside_schedule"`
+  Queued int  `json:"queued"`
+
+  // Deferred is why only urgent jobs start, see Deferral
+  Deferred string `json:"deferred,omitempty"`
+
+  // Overflowing is set while files are left in the queue directories for
+  // a full queue or by the intake limits, see Config.MaxQueued and Intake
+  Overflowing bool `json:"overflowing,omitempty"`
+
+  Workers int              `json:"workers"`
+  Counts  map[JobState]int `json:"counts"`
+  Active  []JobView        `json:"active"`
+
+  // Resources is how many jobs use each resource class and its limit
+  Resources map[string]ResourceUse `json:"resources,omitempty"`
+}
+
+func (a *api) status(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  status := StatusView{
+    Paused: a.w.Paused(),
+    Held:   a.w.OutsideSchedule(),
+    Queued: a.w.Queued(),
+
+    Deferred:    a.w.Deferred(),
+    Overflowing: a.w.overflowing.Load(),
+    Workers:     a.w.pool.size(),
+    Counts:      make(map[JobState]int),
+    Active:      make([]JobView, 0),
+  }
+
+  if usage := a.w.enc.resources.Usage(); len(usage) > 0 {
+    status.Resources = usage
+  }
+
+  for _, j := range a.w.Jobs("") {
+    v := j.View()
+    status.Counts[v.State]++
+
+    if v.State == JobRunning {
+      status.Active = append(status.Active, v)
+    }
+  }
+
+  writeJSON(w, http.StatusOK, status)
+}
+
+func (a *api) jobs(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  views := make([]JobView, 0)
+
+  for _, j := range a.w.Jobs(JobState(r.URL.Query().Get("state"))) {
+    views = append(views, j.View())
+  }
+
+  writeJSON(w, http.StatusOK, views)
+}
+
+// jobAction handles everything under /jobs/{id}
+func (a *api) jobAction(w http.ResponseWriter, r *http.Request) {
+  parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+
+  j, err := a.w.lookupJob(parts[0])
+
+  if err != nil {
+    writeError(w, http.StatusNotFound, err.Error())
+    return
+  }
+
+  if j == nil {
+    writeError(w, http.StatusNotFound, "job not found")
+    return
+  }
+
+  action := ""
+
+  if len(parts) > 1 {
+    action = parts[1]
+  }
+
+  switch {
+  case action == "" && r.Method == http.MethodGet:
+    writeJSON(w, http.StatusOK, j.View())
+  case action == "log" && r.Method == http.MethodGet:
+    j.mu.Lock()
+    jobLog := j.log
+    logPath := j.logPath
+    j.mu.Unlock()
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+    // prefer the full log file, the in-memory tail covers jobs whose file
+    // could not be created or has since been pruned
+    if logPath != "" && copyJobLog(w, logPath) {
+      return
+    }
+
+    if jobLog != nil {
+      w.Write(jobLog.Bytes())
+    }
+  case action == "preflight" && r.Method == http.MethodGet:
+    report := j.preflightReport()
+
+    if report == nil {
+      writeError(w, http.StatusNotFound, "the job has no pre-flight report")
+      return
+    }
+
+    writeJSON(w, http.StatusOK, report)
+  case action == "cancel" && r.Method == http.MethodPost:
+    if err := a.w.Cancel(j, CancelAction(r.URL.Query().Get("then"))); err != nil {
+      writeError(w, http.StatusConflict, err.Error())
+      return
+    }
+
+    writeJSON(w, http.StatusAccepted, j.View())
+  case action == "requeue" && r.Method == http.MethodPost:
+    if err := a.w.Requeue(j); err != nil {
+      writeError(w, http.StatusConflict, err.Error())
+      return
+    }
+
+    writeJSON(w, http.StatusAccepted, j.View())
+  default:
+    writeError(w, http.StatusNotFound, "not found")
+  }
+}
+
+// lookupJob returns the job with the id or ULID, or nil, and an error for a
+// ref that is neither
+func (w *Watcher) lookupJob(ref string) (*Job, error) {
+  // a ULID is 26 characters, an id fewer digits
+  if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+    return w.Job(id), nil
+  }
+
+  if len(ref) == 26 {
+    return w.JobByUID(ref), nil
+  }
+
+  return nil, errors.New("invalid job id")
+}
+
+func (a *api) pause(paused bool) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+      return
+    }
+
+    if paused {
+      a.w.Pause()
+    } else {
+      a.w.Resume()
+    }
+
+    writeJSON(w, http.StatusOK, map[string]bool{"paused": paused})
+  }
+}
+
+func (a *api) reload(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  if a.w.reloader == nil {
+    writeError(w, http.StatusNotImplemented, "reloading is not set up")
+    return
+  }
+
+  if err := a.w.reloader(); err != nil {
+    writeError(w, http.StatusUnprocessableEntity, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func (a *api) forget(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  if a.w.enc.ledger == nil {
+    writeError(w, http.StatusNotImplemented, "the ledger is off")
+    return
+  }
+
+  path := r.URL.Query().Get("path")
+
+  if path == "" {
+    writeError(w, http.StatusBadRequest, "path is required")
+    return
+  }
+
+  removed, err := a.w.Forget(path)
+
+  if err != nil {
+    writeError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, map[string]int{"forgotten": removed})
+}
+
+// enqueue takes the URL and an optional name for the outputs
+func (a *api) enqueue(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  query := r.URL.Query()
+
+  if query.Get("url") == "" {
+    writeError(w, http.StatusBadRequest, "url is required")
+    return
+  }
+
+  j, err := a.w.EnqueueURL(query.Get("url"), query.Get("name"))
+
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusAccepted, j.View())
+}
+
+// RequireToken lets through the requests that only read, GET and HEAD, and
+// the others only with token in an "Authorization: Bearer" header. With no
+// token nothing can be changed through h, the control socket still can
+func RequireToken(token string, h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+      h.ServeHTTP(w, r)
+      return
+    }
+
+    if token == "" {
+      writeError(w, http.StatusForbidden, "the API is read only, set a token to change anything over it")
+      return
+    }
+
+    given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+    if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="gowatcher"`)
+      writeError(w, http.StatusUnauthorized, "a valid bearer token is required")
+      return
+    }
+
+    h.ServeHTTP(w, r)
+  })
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+  writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,231 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "time"
+)
+
+// PendingView is a file waiting for an operator's approval, see
+// Config.Approval. Profile is the one it is encoded with unless another is
+// chosen, Spec is set when that is its job spec's, which cannot be changed
+type PendingView struct {
+  Path    string    `json:"path"`
+  Name    string    `json:"name"`
+  Size    int64     `json:"size"`
+  Profile string    `json:"profile"`
+  Spec    bool      `json:"spec,omitempty"`
+  FoundAt time.Time `json:"found_at"`
+}
+
+// ApprovalsView is the JSON returned by GET /pending: the files waiting for
+// approval, oldest first, and the profiles they can be approved with, the
+// default one first
+type ApprovalsView struct {
+  Profiles []string      `json:"profiles"`
+  Pending  []PendingView `json:"pending"`
+}
+
+// holdForApproval lists a found file that settled as pending approval
+// rather than queueing it, once however often it is seen
+func (w *Watcher) holdForApproval(path string) {
+  if !w.allowed(path) {
+    slog.Info("Ignoring file", "input", path)
+    return
+  }
+
+  if _, held := w.pending.LoadOrStore(path, time.Now()); !held {
+    slog.Info("Pending approval", "input", path)
+  }
+}
+
+// Pending lists the files waiting for approval, dropping those that are no
+// longer there
+func (w *Watcher) Pending() ApprovalsView {
+  profiles := w.profiles.Load()
+  view := ApprovalsView{Profiles: []string{profiles.def.Name}, Pending: make([]PendingView, 0)}
+
+  var names []string
+
+  for name := range profiles.byName {
+    if name != profiles.def.Name {
+      names = append(names, name)
+    }
+  }
+
+  sort.Strings(names)
+  view.Profiles = append(view.Profiles, names...)
+
+  w.pending.Range(func(key, value any) bool {
+    path := key.(string)
+
+    if _, err := os.Stat(path); err != nil {
+      w.pending.Delete(path)
+      return true
+    }
+
+    v := PendingView{Path: path, Name: filepath.Base(path), Size: totalSize([]string{path}), Profile: profiles.def.Name, FoundAt: value.(time.Time)}
+
+    if p := w.specProfile(path); p != nil {
+      v.Profile, v.Spec = p.Name, true
+    }
+
+    view.Pending = append(view.Pending, v)
+
+    return true
+  })
+
+  sort.Slice(view.Pending, func(i, j int) bool { return view.Pending[i].FoundAt.Before(view.Pending[j].FoundAt) })
+
+  return view
+}
+
+// pendingPath is the path of the pending file ref names, its path or, when
+// no other pending file has it, its name
+func (w *Watcher) pendingPath(ref string) (string, error) {
+  if _, ok := w.pending.Load(ref); ok {
+    return ref, nil
+  }
+
+  var matches []string
+
+  w.pending.Range(func(key, _ any) bool {
+    if path := key.(string); filepath.Base(path) == ref {
+      matches = append(matches, path)
+    }
+
+    return true
+  })
+
+  switch len(matches) {
+  case 0:
+    return "", fmt.Errorf("%s is not pending approval", ref)
+  case 1:
+    return matches[0], nil
+  }
+
+  return "", fmt.Errorf("more than one file named %s is pending approval, give its path", ref)
+}
+
+// Approve queues a file pending approval, ref being its path or name, with
+// the named profile or the one it would have had when profile is empty. A
+// job spec naming a profile wins, naming another one is an error
+func (w *Watcher) Approve(ref string, profile string) (*Job, error) {
+  path, err := w.pendingPath(ref)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var p *Profile
+
+  if profile != "" {
+    if p = w.profiles.Load().byName[profile]; p == nil {
+      return nil, fmt.Errorf("unknown profile %q", profile)
+    }
+
+    if spec := w.specProfile(path); spec != nil && spec.Name != p.Name {
+      return nil, fmt.Errorf("its job spec names profile %q", spec.Name)
+    }
+  }
+
+  // whoever takes it off the list first decides
+  if _, ok := w.pending.LoadAndDelete(path); !ok {
+    return nil, fmt.Errorf("%s is not pending approval", ref)
+  }
+
+  j := w.enqueue(path, "", p)
+
+  if j == nil {
+    return nil, fmt.Errorf("%s is not encoded, the file filter rejects it", path)
+  }
+
+  slog.Info("Approved", "input", path, "profile", j.View().Profile)
+
+  return j, nil
+}
+
+// Reject moves a file pending approval, ref being its path or name, to the
+// rejected directory with its job spec, checksum and companions, next to a
+// .reason.txt with reason. It returns where the file went
+func (w *Watcher) Reject(ref string, reason string) (string, error) {
+  path, err := w.pendingPath(ref)
+
+  if err != nil {
+    return "", err
+  }
+
+  dir := w.enc.quarantineDir
+  dest := filepath.Join(dir, filepath.Base(path))
+
+  if _, err := os.Lstat(dest); err == nil {
+    return "", fmt.Errorf("%s is already in the rejected directory", filepath.Base(path))
+  }
+
+  found, ok := w.pending.LoadAndDelete(path)
+
+  if !ok {
+    return "", fmt.Errorf("%s is not pending approval", ref)
+  }
+
+  if err := w.moveWithSidecars(path, dir, "rejected"); err != nil {
+    w.pending.Store(path, found)
+    return "", err
+  }
+
+  text := "rejected by an operator"
+
+  if reason != "" {
+    text += ": " + reason
+  }
+
+  if err := os.WriteFile(dest+reasonSuffix, []byte(text+"\n"), 0644); err != nil {
+    slog.Warn("Could not write rejection reason", "error", err)
+  }
+
+  slog.Warn("Rejected input", "input", path, "to", dest, "reason", reason)
+
+  return dest, nil
+}
+
+// pendingAction serves GET /pending, POST /pending/approve?path=...
+// [&profile=X] and POST /pending/reject?path=...[&reason=...], path being
+// the file's path or name
+func (a *api) pendingAction(w http.ResponseWriter, r *http.Request) {
+  if !a.w.cfg.Approval {
+    writeError(w, http.StatusNotImplemented, "approval is off")
+    return
+  }
+
+  query := r.URL.Query()
+  action := r.URL.Path
+
+  switch {
+  case action == "/pending" && r.Method == http.MethodGet:
+    writeJSON(w, http.StatusOK, a.w.Pending())
+  case action == "/pending/approve" && r.Method == http.MethodPost:
+    j, err := a.w.Approve(query.Get("path"), query.Get("profile"))
+
+    if err != nil {
+      writeError(w, http.StatusConflict, err.Error())
+      return
+    }
+
+    writeJSON(w, http.StatusAccepted, j.View())
+  case action == "/pending/reject" && r.Method == http.MethodPost:
+    dest, err := a.w.Reject(query.Get("path"), query.Get("reason"))
+
+    if err != nil {
+      writeError(w, http.StatusConflict, err.Error())
+      return
+    }
+
+    writeJSON(w, http.StatusOK, map[string]string{"rejected": dest})
+  default:
+    writeError(w, http.StatusNotFound, "not found")
+  }
+}
@@ -0,0 +1,204 @@
+package watcher
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// artifactEncoded, artifactReused and artifactFailed are an ArtifactView's
+// states
+const (
+  artifactEncoded = "encoded"
+  artifactReused  = "reused"
+  artifactFailed  = "failed"
+)
+
+// ArtifactView is one of the outputs of a job encoded on its own, like a
+// rendition encoded in turn or the extracted subtitles. One failing leaves
+// the others to finish, the job fails, and the artifacts that were encoded
+// and validated are kept in the working directory's stateDir for the next
+// encode of the same input, unchanged, with the same profile and commands,
+// which reuses them instead of encoding them again. They are kept for
+// resumeMaxAge
+type ArtifactView struct {
+  Name  string `json:"name"`
+  State string `json:"state"`
+  Error string `json:"error,omitempty"`
+}
+
+// dropLoneArtifact leaves a plan with a single artifact without any, an
+// output failing fails its job as it always has
+func (p *encodePlan) dropLoneArtifact() {
+  if len(p.artifactRuns()) > 1 {
+    return
+  }
+
+  for i := range p.runs {
+    p.runs[i].artifact = ""
+  }
+}
+
+// artifactRuns are the runs of each artifact of the plan, in order
+func (p encodePlan) artifactRuns() map[string][]int {
+  runs := make(map[string][]int)
+
+  for i, run := range p.runs {
+    if run.artifact != "" {
+      runs[run.artifact] = append(runs[run.artifact], i)
+    }
+  }
+
+  return runs
+}
+
+// artifactOutputs are the outputs of the runs at indexes
+func (p encodePlan) artifactOutputs(indexes []int) []string {
+  var outputs []string
+
+  for _, i := range indexes {
+    outputs = append(outputs, p.runs[i].outputs...)
+  }
+
+  return outputs
+}
+
+// pick is the runs at indexes
+func (p encodePlan) pick(indexes []int) []ffmpegRun {
+  runs := make([]ffmpegRun, 0, len(indexes))
+
+  for _, i := range indexes {
+    runs = append(runs, p.runs[i])
+  }
+
+  return runs
+}
+
+// artifactsFailed is the error of a job whose artifacts failed, each one's
+// in the plan's order
+func artifactsFailed(p encodePlan, failed map[string]error) error {
+  var reasons []string
+  seen := make(map[string]bool)
+
+  for _, run := range p.runs {
+    if err := failed[run.artifact]; err != nil && !seen[run.artifact] {
+      seen[run.artifact] = true
+      reasons = append(reasons, fmt.Sprintf("%s: %s", run.artifact, err))
+    }
+  }
+
+  return fmt.Errorf("%d of %d outputs failed, %s", len(failed), len(p.artifactRuns()), strings.Join(reasons, "; "))
+}
+
+// artifactDir is the directory the artifact made by runs is kept in for
+// the job's input, named by the input's name, size and modification time,
+// the profile and the commands with the job's own paths left out
+func (e *encoder) artifactDir(j *Job, runs []ffmpegRun) string {
+  file, jobDir := j.source(), e.jobDir(j)
+
+  h := sha256.New()
+  fmt.Fprintf(h, "%s\x00%s", filepath.Base(j.input), j.profile.Name)
+
+  if info, err := os.Stat(file); err == nil {
+    fmt.Fprintf(h, "\x00%d\x00%d", info.Size(), info.ModTime().UnixNano())
+  }
+
+  for _, run := range runs {
+    fmt.Fprintf(h, "\x00%s", run.program)
+
+    for _, arg := range run.args {
+      arg = strings.ReplaceAll(arg, jobDir, "{working}")
+      fmt.Fprintf(h, "\x00%s", strings.ReplaceAll(arg, file, "{input}"))
+    }
+  }
+
+  return filepath.Join(e.workingDir, stateDir, "artifacts", hex.EncodeToString(h.Sum(nil)[:8]))
+}
+
+// reuseArtifact moves the outputs an earlier encode kept in dir into the
+// job's working directory, it reports whether every one was there
+func reuseArtifact(dir string, outputs []string) bool {
+  if len(outputs) == 0 {
+    return false
+  }
+
+  defer os.RemoveAll(dir)
+
+  for _, out := range outputs {
+    if info, err := os.Stat(filepath.Join(dir, filepath.Base(out))); err != nil || info.Size() == 0 {
+      return false
+    }
+  }
+
+  for i, out := range outputs {
+    if err := os.Rename(filepath.Join(dir, filepath.Base(out)), out); err != nil {
+      removeAll(outputs[:i])
+      return false
+    }
+  }
+
+  return true
+}
+
+// keepArtifact moves the artifact's outputs into dir for the next encode,
+// and removes what earlier encodes kept too long ago
+func keepArtifact(dir string, outputs []string) error {
+  pruneArtifacts(filepath.Dir(dir))
+
+  if err := os.RemoveAll(dir); err != nil {
+    return err
+  }
+
+  if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+    return err
+  }
+
+  for _, out := range outputs {
+    if err := os.Rename(out, filepath.Join(dir, filepath.Base(out))); err != nil {
+      os.RemoveAll(dir)
+      return err
+    }
+  }
+
+  return nil
+}
+
+// pruneArtifacts removes the kept artifacts older than resumeMaxAge
+func pruneArtifacts(root string) {
+  entries, err := os.ReadDir(root)
+
+  if err != nil {
+    return
+  }
+
+  for _, entry := range entries {
+    if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > resumeMaxAge {
+      os.RemoveAll(filepath.Join(root, entry.Name()))
+    }
+  }
+}
+
+// setArtifact records the state of one of the job's artifacts
+func (j *Job) setArtifact(name string, state string, err error) {
+  view := ArtifactView{Name: name, State: state}
+
+  if err != nil {
+    view.Error = err.Error()
+  }
+
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  for i := range j.artifacts {
+    if j.artifacts[i].Name == name {
+      j.artifacts[i] = view
+      return
+    }
+  }
+
+  j.artifacts = append(j.artifacts, view)
+}
@@ -0,0 +1,120 @@
+package watcher
+
+import (
+  "fmt"
+  "slices"
+  "strings"
+  "time"
+)
+
+// audioOnlyFlags leave everything but the audio out of an output
+var audioOnlyFlags = []string{"-vn", "-sn", "-dn"}
+
+// audioExtensions are the files audio encoders are written to, by
+// encoder or codec name
+var audioExtensions = map[string]string{
+  "aac":        "m4a",
+  "libfdk_aac": "m4a",
+  "alac":       "m4a",
+  "libmp3lame": "mp3",
+  "mp3":        "mp3",
+  "flac":       "flac",
+  "libopus":    "opus",
+  "opus":       "opus",
+  "libvorbis":  "ogg",
+  "vorbis":     "ogg",
+  "ac3":        "ac3",
+  "eac3":       "eac3",
+}
+
+// audioDerivative names the audio-only output AudioDerivative adds
+const audioDerivative = "audio"
+
+// audioExtension is the extension for the last audio codec set in flags,
+// mka for copies and codecs it does not know, as Matroska takes any
+func audioExtension(flags []string) string {
+  codec := ""
+
+  for i := 0; i < len(flags)-1; i++ {
+    switch flags[i] {
+    case "-c:a", "-c:a:0", "-codec:a", "-acodec":
+      codec = flags[i+1]
+    }
+  }
+
+  if strings.HasPrefix(codec, "pcm_") {
+    return "wav"
+  }
+
+  if ext, ok := audioExtensions[codec]; ok {
+    return ext
+  }
+
+  return "mka"
+}
+
+// output is r as the profile produces it. Its own video filters replace the
+// profile's, so they get the watermark too
+func (p *Profile) output(r Rendition) Rendition {
+  if p.Watermark != nil && hasVideoFilter(r.OutputFlags) {
+    r.OutputFlags = p.Watermark.apply(r.OutputFlags)
+  }
+
+  if r.AudioOnly || p.AudioOnly {
+    return p.audioOutput(r)
+  }
+
+  return r
+}
+
+// derivative is the audio-only output AudioDerivative adds next to outputs.
+// It gets a suffix when its name could be one of theirs
+func (p *Profile) derivative(outputs []Rendition) Rendition {
+  d := p.audioOutput(Rendition{Name: audioDerivative, OutputFlags: p.AudioDerivative, AudioOnly: true})
+  name := p.outputName("input.ext", d, nil, time.Time{})
+
+  for _, r := range outputs {
+    keepsExtension := r.Extension == "" && p.Extension == ""
+
+    if keepsExtension || p.outputName("input.ext", r, nil, time.Time{}) == name {
+      d.Suffix = "-" + audioDerivative
+      break
+    }
+  }
+
+  return d
+}
+
+// audioOutput is r as an output with only audio in it, named for its codec
+// unless it or an audio-only profile has an extension
+func (p *Profile) audioOutput(r Rendition) Rendition {
+  r.AudioOnly = true
+  r.OutputFlags = append(append([]string(nil), r.OutputFlags...), audioOnlyFlags...)
+
+  if r.Extension == "" && (!p.AudioOnly || p.Extension == "") {
+    r.Extension = audioExtension(append(append([]string(nil), p.OutputFlags...), r.OutputFlags...))
+  }
+
+  return r
+}
+
+// hasAudioOutputs reports whether any output of the profile is audio only
+func (p *Profile) hasAudioOutputs() bool {
+  return p.AudioOnly || p.AudioDerivative != nil || slices.ContainsFunc(p.Renditions, func(r Rendition) bool { return r.AudioOnly })
+}
+
+// checkAudio rejects audio-only outputs where they cannot work
+func (p *Profile) checkAudio() error {
+  if !p.hasAudioOutputs() {
+    return nil
+  }
+
+  switch {
+  case p.Packaging != "":
+    return fmt.Errorf("packages cannot have audio-only outputs")
+  case p.SplitLength > 0:
+    return fmt.Errorf("split_length does not apply to profiles with audio-only outputs")
+  }
+
+  return nil
+}
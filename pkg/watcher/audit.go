@@ -0,0 +1,296 @@
+package watcher
+
+import (
+  "crypto/sha256"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "os/exec"
+  "sync"
+  "time"
+)
+
+// auditOp is what an audit log entry records
+type auditOp string
+
+const (
+  auditEncodeStarted  auditOp = "encode_started"
+  auditEncodeFinished auditOp = "encode_finished"
+  auditEncodeFailed   auditOp = "encode_failed"
+  auditMove           auditOp = "move"
+  auditDelete         auditOp = "delete"
+  auditHook           auditOp = "hook"
+)
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+  Time    time.Time `json:"time"`
+  Op      auditOp   `json:"op"`
+  JobID   int64     `json:"job_id,omitempty"`
+  JobUID  string    `json:"job_uid,omitempty"`
+  Profile string    `json:"profile,omitempty"`
+
+  // Path is the file the operation was on, To where a move put it, and
+  // SHA256 the digest of its content, with checksums on
+  Path   string `json:"path,omitempty"`
+  To     string `json:"to,omitempty"`
+  SHA256 string `json:"sha256,omitempty"`
+  Bytes  int64  `json:"bytes,omitempty"`
+
+  // Reason is why: the originals policy, failed, rejected or a retention
+  Reason string `json:"reason,omitempty"`
+
+  Outputs []string `json:"outputs,omitempty"`
+
+  // Hook and Command are the hook run, pre or post, ExitStatus what it
+  // exited with
+  Hook       string   `json:"hook,omitempty"`
+  Command    []string `json:"command,omitempty"`
+  ExitStatus *int     `json:"exit_status,omitempty"`
+
+  Error string `json:"error,omitempty"`
+}
+
+// AuditLog is an append-only file of everything done to the files, one
+// JSON object per line: every encode started and finished or failed, every
+// input and output moved or deleted, by a job or a retention, and every
+// hook run, with the job it was for. It is only ever appended to, and each
+// line is synced before the operation goes on, so it survives a crash. See
+// OpenAuditLog
+type AuditLog struct {
+  mu  sync.Mutex
+  out *os.File
+
+  // checksums hashes the files moved, deleted and encoded, reading each
+  // input once more
+  checksums bool
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if it
+// is missing. With checksums each entry about a file has its SHA-256
+func OpenAuditLog(path string, checksums bool) (*AuditLog, error) {
+  out, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+  if err != nil {
+    return nil, err
+  }
+
+  return &AuditLog{out: out, checksums: checksums}, nil
+}
+
+// Close closes the file, nothing is recorded after
+func (a *AuditLog) Close() error {
+  if a == nil {
+    return nil
+  }
+
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  err := a.out.Close()
+  a.out = nil
+
+  return err
+}
+
+// record appends the entry, a nil log records nothing. A failed write is
+// logged rather than failing what it records
+func (a *AuditLog) record(entry auditEntry) {
+  if a == nil {
+    return
+  }
+
+  if entry.Time.IsZero() {
+    entry.Time = time.Now()
+  }
+
+  line, err := json.Marshal(entry)
+
+  if err != nil {
+    slog.Error("Could not write audit log", "op", entry.Op, "path", entry.Path, "error", err)
+    return
+  }
+
+  a.mu.Lock()
+  defer a.mu.Unlock()
+
+  if a.out == nil {
+    return
+  }
+
+  if _, err = a.out.Write(append(line, '\n')); err == nil {
+    err = a.out.Sync()
+  }
+
+  if err != nil {
+    slog.Error("Could not write audit log", "op", entry.Op, "path", entry.Path, "error", err)
+  }
+}
+
+// jobEntry is an entry about the job
+func jobEntry(op auditOp, j *Job) auditEntry {
+  entry := auditEntry{Op: op, JobID: j.id, JobUID: j.uid}
+
+  if j.profile != nil {
+    entry.Profile = j.profile.Name
+  }
+
+  return entry
+}
+
+// file fills in the size and, with checksums, the digest of the file at
+// path, for a directory like a package only its path
+func (a *AuditLog) file(entry auditEntry, path string) auditEntry {
+  info, err := os.Stat(path)
+
+  if err != nil || !info.Mode().IsRegular() {
+    return entry
+  }
+
+  entry.Bytes = info.Size()
+
+  if a.checksums && entry.SHA256 == "" {
+    if digest, err := fileDigest(path, sha256.New); err == nil {
+      entry.SHA256 = digest
+    }
+  }
+
+  return entry
+}
+
+// started records the start of the job's encode, its input's digest is
+// kept for where the input goes once it is done
+func (a *AuditLog) started(j *Job) {
+  if a == nil {
+    return
+  }
+
+  entry := a.file(jobEntry(auditEncodeStarted, j), j.source())
+  entry.Path = j.input
+
+  j.mu.Lock()
+  j.inputDigest = entry.SHA256
+  j.mu.Unlock()
+
+  a.record(entry)
+}
+
+// completed records how the job's encode ended
+func (a *AuditLog) completed(j *Job, state JobState, err error) {
+  if a == nil {
+    return
+  }
+
+  op := auditEncodeFinished
+
+  if state != JobDone {
+    op = auditEncodeFailed
+  }
+
+  entry := jobEntry(op, j)
+
+  j.mu.Lock()
+  entry.Path, entry.Outputs = j.input, j.outputs
+  j.mu.Unlock()
+
+  if err != nil {
+    entry.Error = err.Error()
+  }
+
+  a.record(entry)
+}
+
+// moved records the job's file moved from src to dst for reason, the
+// input's digest is the one taken when the encode started
+func (a *AuditLog) moved(j *Job, src string, dst string, reason string) {
+  if a == nil {
+    return
+  }
+
+  entry := auditEntry{Op: auditMove}
+
+  if j != nil {
+    entry = jobEntry(auditMove, j)
+
+    j.mu.Lock()
+    entry.SHA256 = j.inputDigest
+    j.mu.Unlock()
+
+    if src != j.input && src != j.source() {
+      entry.SHA256 = ""
+    }
+  }
+
+  entry = a.file(entry, dst)
+  entry.Path, entry.To, entry.Reason = src, dst, reason
+
+  a.record(entry)
+}
+
+// deleting records the job's file at path about to be deleted for reason,
+// it is hashed while it is still there
+func (a *AuditLog) deleting(j *Job, path string, reason string) {
+  if a == nil {
+    return
+  }
+
+  entry := auditEntry{Op: auditDelete}
+
+  if j != nil {
+    entry = jobEntry(auditDelete, j)
+
+    j.mu.Lock()
+    if path == j.input {
+      entry.SHA256 = j.inputDigest
+    }
+    j.mu.Unlock()
+  }
+
+  entry = a.file(entry, path)
+  entry.Path, entry.Reason = path, reason
+
+  a.record(entry)
+}
+
+// hookRan records the job's pre or post hook and how it exited
+func (a *AuditLog) hookRan(j *Job, name string, h *Hook, err error) {
+  if a == nil {
+    return
+  }
+
+  entry := jobEntry(auditHook, j)
+  entry.Path, entry.Hook, entry.Command = j.input, name, h.Command
+
+  status := 0
+
+  var exitErr *exec.ExitError
+
+  if errors.As(err, &exitErr) {
+    status = exitErr.ExitCode()
+  }
+
+  if err == nil || status != 0 {
+    entry.ExitStatus = &status
+  }
+
+  if err != nil {
+    entry.Error = err.Error()
+  }
+
+  a.record(entry)
+}
+
+// pruned records what a retention deleted or archived
+func (a *AuditLog) pruned(views []PrunedView) {
+  for _, v := range views {
+    reason := fmt.Sprintf("retention %s", v.Reason)
+
+    if v.To != "" {
+      a.record(auditEntry{Op: auditMove, Path: v.Path, To: v.To, Bytes: v.Bytes, Reason: reason})
+    } else {
+      a.record(auditEntry{Op: auditDelete, Path: v.Path, Bytes: v.Bytes, Reason: reason})
+    }
+  }
+}
@@ -0,0 +1,135 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "runtime"
+  "time"
+)
+
+// Autoscale adds and retires workers between Min and Max as the machine's
+// other work comes and goes, Config.Workers is where it starts. Every
+// Interval it retires a worker when the CPU is busier than HighCPU, the
+// load average per CPU is above MaxLoad or free memory is below
+// MinFreeMemory, and adds one when the CPU is idler than LowCPU and jobs are
+// waiting for a worker. A retired worker finishes its encode first. Only
+// Linux reports the load, elsewhere the workers stay as they start
+type Autoscale struct {
+  Min int
+  Max int
+
+  // Interval defaults to 30s
+  Interval time.Duration
+
+  // HighCPU and LowCPU are fractions of the whole machine's CPU time over
+  // the last interval, default 0.9 and 0.7
+  HighCPU float64
+  LowCPU  float64
+
+  // MaxLoad and MinFreeMemory are not checked when zero
+  MaxLoad       float64
+  MinFreeMemory int64
+}
+
+const defaultAutoscaleInterval = 30 * time.Second
+
+// systemLoad is a reading of the machine's CPU time counters, one minute
+// load average and available memory in bytes
+type systemLoad struct {
+  cpuTotal    uint64
+  cpuIdle     uint64
+  loadAverage float64
+  freeMemory  int64
+}
+
+// withDefaults checks the bounds and fills in the thresholds left zero
+func (a Autoscale) withDefaults() (Autoscale, error) {
+  if a.Min < 1 {
+    a.Min = 1
+  }
+
+  if a.Max < a.Min {
+    return a, fmt.Errorf("max workers %d is below min %d", a.Max, a.Min)
+  }
+
+  if a.Interval <= 0 {
+    a.Interval = defaultAutoscaleInterval
+  }
+
+  if a.HighCPU <= 0 {
+    a.HighCPU = 0.9
+  }
+
+  if a.LowCPU <= 0 {
+    a.LowCPU = 0.7
+  }
+
+  if a.LowCPU >= a.HighCPU {
+    return a, fmt.Errorf("low CPU %g must be below high CPU %g", a.LowCPU, a.HighCPU)
+  }
+
+  return a, nil
+}
+
+// autoscale resizes the worker pool by one worker at a time until stop is
+// closed
+func (w *Watcher) autoscale(a Autoscale, stop <-chan struct{}) {
+  last, err := readSystemLoad()
+
+  if err != nil {
+    slog.Warn("Not autoscaling workers", "error", err)
+    return
+  }
+
+  ticker := time.NewTicker(a.Interval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+
+    load, err := readSystemLoad()
+
+    if err != nil {
+      slog.Error("Could not read the system load", "error", err)
+      continue
+    }
+
+    cpu := 0.0
+
+    if total := load.cpuTotal - last.cpuTotal; total > 0 {
+      cpu = 1 - float64(load.cpuIdle-last.cpuIdle)/float64(total)
+    }
+
+    last = load
+    perCPU := load.loadAverage / float64(runtime.NumCPU())
+    workers := w.pool.size()
+    target := workers
+    reason := ""
+
+    switch {
+    case a.MinFreeMemory > 0 && load.freeMemory < a.MinFreeMemory:
+      target, reason = workers-1, "low memory"
+    case cpu > a.HighCPU:
+      target, reason = workers-1, "busy CPU"
+    case a.MaxLoad > 0 && perCPU > a.MaxLoad:
+      target, reason = workers-1, "high load"
+    case cpu < a.LowCPU && w.queue.len() > 0 && int(w.stats.encodesInProgress.Load()) >= workers:
+      target, reason = workers+1, "idle CPU"
+    }
+
+    target = max(a.Min, min(a.Max, target))
+
+    if target == workers {
+      continue
+    }
+
+    slog.Info("Scaling workers", "from", workers, "to", target, "reason", reason,
+      "cpu", fmt.Sprintf("%.0f%%", cpu*100), "load", fmt.Sprintf("%.2f", load.loadAverage), "free_memory", FormatSize(load.freeMemory))
+
+    w.pool.resize(target)
+  }
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "net/http"
+  "net/url"
+  "sort"
+  "strings"
+  "time"
+)
+
+// awsSigner signs requests to one AWS service and region
+type awsSigner struct {
+  service      string
+  region       string
+  accessKey    string
+  secretKey    string
+  sessionToken string
+}
+
+// sign adds an AWS Signature Version 4 Authorization header, signing the
+// host, the x-amz-* headers and the content type. Without an access key the
+// request is left anonymous
+func (s awsSigner) sign(req *http.Request, payloadHash string, now time.Time) {
+  if s.accessKey == "" {
+    return
+  }
+
+  amzDate := now.UTC().Format("20060102T150405Z")
+  date := amzDate[:8]
+
+  req.Header.Set("X-Amz-Date", amzDate)
+  req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+  if s.sessionToken != "" {
+    req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+  }
+
+  signed := map[string]string{"host": req.URL.Host}
+
+  for name, values := range req.Header {
+    lower := strings.ToLower(name)
+
+    if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "content-md5" || lower == "range" {
+      signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+    }
+  }
+
+  names := make([]string, 0, len(signed))
+
+  for name := range signed {
+    names = append(names, name)
+  }
+
+  sort.Strings(names)
+
+  var canonicalHeaders strings.Builder
+
+  for _, name := range names {
+    canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+  }
+
+  signedHeaders := strings.Join(names, ";")
+
+  canonicalRequest := strings.Join([]string{
+    req.Method,
+    req.URL.EscapedPath(),
+    req.URL.RawQuery,
+    canonicalHeaders.String(),
+    signedHeaders,
+    payloadHash,
+  }, "\n")
+
+  scope := date + "/" + s.region + "/" + s.service + "/aws4_request"
+  stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+  key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+  key = hmacSHA256(key, s.region)
+  key = hmacSHA256(key, s.service)
+  key = hmacSHA256(key, "aws4_request")
+
+  signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+  req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+  mac := hmac.New(sha256.New, key)
+  mac.Write([]byte(data))
+
+  return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+  sum := sha256.Sum256(data)
+
+  return hex.EncodeToString(sum[:])
+}
+
+// canonicalQuery is the query string sorted and escaped the way SigV4 signs
+// it, which is also a valid query to send
+func canonicalQuery(query url.Values) string {
+  keys := make([]string, 0, len(query))
+
+  for key := range query {
+    keys = append(keys, key)
+  }
+
+  sort.Strings(keys)
+
+  var parts []string
+
+  for _, key := range keys {
+    for _, value := range query[key] {
+      parts = append(parts, awsEscape(key, true)+"="+awsEscape(value, true))
+    }
+  }
+
+  return strings.Join(parts, "&")
+}
+
+// awsEscape percent encodes everything but the unreserved characters, and
+// a key's slashes only with escapeSlash
+func awsEscape(s string, escapeSlash bool) string {
+  var b strings.Builder
+
+  for i := 0; i < len(s); i++ {
+    ch := s[i]
+
+    switch {
+    case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9', ch == '-', ch == '.', ch == '_', ch == '~':
+      b.WriteByte(ch)
+    case ch == '/' && !escapeSlash:
+      b.WriteByte(ch)
+    default:
+      fmt.Fprintf(&b, "%%%02X", ch)
+    }
+  }
+
+  return b.String()
+}
@@ -0,0 +1,406 @@
+package watcher
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "fmt"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+)
+
+// ffmpegBuild is what an ffmpeg binary was compiled with
+type ffmpegBuild struct {
+  encoders map[string]bool
+  filters  map[string]bool
+  muxers   map[string]bool
+}
+
+// toolVersion is the version ffmpeg or ffprobe at path prints
+func toolVersion(ctx context.Context, path string) (string, error) {
+  out, err := exec.CommandContext(ctx, path, "-version").Output()
+
+  if err != nil {
+    return "", fmt.Errorf("could not run %s -version: %s", path, err)
+  }
+
+  // ffmpeg version 6.1.1-3ubuntu5 Copyright (c) 2000-2023
+  fields := strings.Fields(firstLine(string(out)))
+
+  if len(fields) < 3 || fields[1] != "version" {
+    return "", fmt.Errorf("%s -version printed %q", path, firstLine(string(out)))
+  }
+
+  return fields[2], nil
+}
+
+// ffmpegBuilds holds the build of each ffmpeg binary the profiles use,
+// asking each binary once
+type ffmpegBuilds map[string]*ffmpegBuild
+
+// build lists what the binary at path has, from ffmpeg -encoders, -filters
+// and -muxers
+func (b ffmpegBuilds) build(path string) (*ffmpegBuild, error) {
+  if build, ok := b[path]; ok {
+    return build, nil
+  }
+
+  build := &ffmpegBuild{}
+  lists := []struct {
+    flag  string
+    names *map[string]bool
+  }{
+    {"-encoders", &build.encoders},
+    {"-filters", &build.filters},
+    {"-muxers", &build.muxers},
+  }
+
+  for _, l := range lists {
+    ctx, cancel := context.WithTimeout(context.Background(), hwProbeTimeout)
+    out, err := exec.CommandContext(ctx, path, "-hide_banner", l.flag).Output()
+    cancel()
+
+    if err != nil {
+      return nil, fmt.Errorf("could not run %s %s: %s", path, l.flag, err)
+    }
+
+    *l.names = listedNames(out)
+  }
+
+  b[path] = build
+
+  return build, nil
+}
+
+// listedNames reads the names in one of ffmpeg's lists. The encoders and
+// muxers follow a legend ending in a line of dashes, the filters have an
+// A->V kind after the name instead
+func listedNames(out []byte) map[string]bool {
+  names := make(map[string]bool)
+  listed := false
+  scanner := bufio.NewScanner(bytes.NewReader(out))
+
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+
+    switch {
+    case len(fields) == 0:
+    case len(fields) >= 3 && strings.Contains(fields[2], "->"):
+      names[fields[1]] = true
+    case !listed:
+      listed = strings.Trim(fields[0], "-") == ""
+    case len(fields) >= 2:
+      // a muxer may go by several names, like mov,mp4
+      for _, name := range strings.Split(fields[1], ",") {
+        names[name] = true
+      }
+    }
+  }
+
+  return names
+}
+
+// checkFFmpeg finds the profile's own ffmpeg, when it has one, and rejects
+// the profile when the ffmpeg it runs lacks an encoder, filter or muxer its
+// flags name or fails a tiny test encode with them, before a real input
+// is lost to a typo. def is the default ffmpeg. A container's ffmpeg is in
+// its image, so it is taken as it is
+func (p *Profile) checkFFmpeg(def string, container bool, builds ffmpegBuilds) error {
+  p.ffmpeg = ""
+
+  if container {
+    p.ffmpeg = p.FFmpegPath
+    return nil
+  }
+
+  if p.FFmpegPath != "" {
+    path, err := exec.LookPath(p.FFmpegPath)
+
+    if err != nil {
+      return fmt.Errorf("profile %q: ffmpeg_path: %s", p.Name, err)
+    }
+
+    p.ffmpeg = path
+  }
+
+  path := p.ffmpegPath(def)
+
+  if path == "" || !p.runsFFmpeg() {
+    return nil
+  }
+
+  build, err := builds.build(path)
+
+  if err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  lists := p.ffmpegFlags()
+  missing := func(kind string, names []string, have map[string]bool) error {
+    for _, name := range names {
+      if !have[name] {
+        return fmt.Errorf("profile %q: %s has no %s %s, check its spelling or point ffmpeg_path or FFMPEG_PATH at a build with it", p.Name, path, name, kind)
+      }
+    }
+
+    return nil
+  }
+
+  if err := missing("encoder", flagValues(lists, codecFlag), build.encoders); err != nil {
+    return err
+  }
+
+  if err := missing("filter", append(filterNames(flagValues(lists, filterFlag)), p.deinterlaceFilters()...), build.filters); err != nil {
+    return err
+  }
+
+  muxers := flagValues(lists, func(flag string) bool { return flag == "-f" })
+
+  if p.Packaging != "" {
+    muxers = append(muxers, p.Packaging)
+  }
+
+  if err := missing("muxer", muxers, build.muxers); err != nil {
+    return err
+  }
+
+  return p.testEncode(path)
+}
+
+// ffmpegFlags are the output flag lists the profile's ffmpeg runs are
+// configured with: the shared output flags, each rendition's, the audio
+// derivative's and those of the ffmpeg steps
+func (p *Profile) ffmpegFlags() [][]string {
+  lists := [][]string{p.OutputFlags, p.AudioDerivative}
+
+  for _, r := range p.Renditions {
+    lists = append(lists, r.OutputFlags)
+  }
+
+  for _, s := range p.pipeline() {
+    if s.ffmpegStep() {
+      lists = append(lists, s.Command)
+    }
+  }
+
+  return lists
+}
+
+// flagValues are the distinct values of the flags picked by match. Stream
+// copies and templated values are left out
+func flagValues(lists [][]string, match func(flag string) bool) []string {
+  var values []string
+  seen := make(map[string]bool)
+
+  for _, flags := range lists {
+    for i := 0; i < len(flags)-1; i++ {
+      if !match(flags[i]) {
+        continue
+      }
+
+      value := flags[i+1]
+
+      if value == "copy" || strings.Contains(value, "{") || seen[value] {
+        continue
+      }
+
+      seen[value] = true
+      values = append(values, value)
+    }
+  }
+
+  return values
+}
+
+// codecFlag reports whether flag sets an encoder, like -c:v or -acodec.
+// The hardware variants' encoders are tested on their own
+func codecFlag(flag string) bool {
+  switch flag {
+  case "-c", "-codec", "-vcodec", "-acodec", "-scodec":
+    return true
+  }
+
+  return strings.HasPrefix(flag, "-c:") || strings.HasPrefix(flag, "-codec:")
+}
+
+// filterFlag reports whether flag sets a filtergraph, like -vf or
+// -filter_complex
+func filterFlag(flag string) bool {
+  switch flag {
+  case "-vf", "-af", "-filter", "-filter_complex", "-lavfi":
+    return true
+  }
+
+  return strings.HasPrefix(flag, "-filter:")
+}
+
+// filterNames are the filters in filtergraphs, their names being what
+// comes before each filter's = once the [labels] are taken off. Quoted and
+// escaped option values are skipped over
+func filterNames(graphs []string) []string {
+  var names []string
+  seen := make(map[string]bool)
+
+  add := func(filter string) {
+    for strings.HasPrefix(filter, "[") {
+      _, filter, _ = strings.Cut(filter[1:], "]")
+      filter = strings.TrimSpace(filter)
+    }
+
+    name, _, _ := strings.Cut(filter, "=")
+    name, _, _ = strings.Cut(name, "[")
+    name = strings.TrimSpace(name)
+
+    // anything else is not a name, or a name gowatcher fills in
+    if name == "" || seen[name] || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+      return
+    }
+
+    seen[name] = true
+    names = append(names, name)
+  }
+
+  for _, graph := range graphs {
+    start, quoted := 0, false
+
+    for i := 0; i < len(graph); i++ {
+      switch c := graph[i]; {
+      case c == '\\':
+        i++
+      case c == '\'':
+        quoted = !quoted
+      case !quoted && (c == ',' || c == ';'):
+        add(graph[start:i])
+        start = i + 1
+      }
+    }
+
+    add(graph[start:])
+  }
+
+  return names
+}
+
+// testInput is a fraction of a second of video and audio from lavfi that
+// the test encodes read, both as input 0
+const testInput = "testsrc2=size=320x240:rate=25[out0];anullsrc=r=48000:cl=stereo[out1]"
+
+// testEncode encodes a moment of generated video and audio with each of the
+// profile's outputs' flags into a scratch directory, which catches unknown
+// options and values the lists do not. Outputs that map streams the test
+// input does not have, packages and pipelines are not tried
+func (p *Profile) testEncode(ffmpegPath string) error {
+  if p.Packaging != "" || len(p.pipeline()) > 0 {
+    return nil
+  }
+
+  dir, err := os.MkdirTemp("", "gowatcher-check-")
+
+  if err != nil {
+    return err
+  }
+
+  defer os.RemoveAll(dir)
+
+  renditions := p.Renditions
+
+  if len(renditions) == 0 {
+    renditions = []Rendition{{Name: p.Name}}
+  }
+
+  if p.AudioDerivative != nil {
+    renditions = append(renditions, Rendition{Name: audioDerivative, OutputFlags: append(append([]string(nil), p.AudioDerivative...), audioOnlyFlags...)})
+  }
+
+  for _, r := range renditions {
+    output := append(append([]string(nil), p.OutputFlags...), r.OutputFlags...)
+
+    if !testable(p.InputFlags) || !testable(output) {
+      continue
+    }
+
+    ext := r.Extension
+
+    if ext == "" {
+      ext = p.Extension
+    }
+
+    if ext == "" {
+      ext = "mkv"
+    }
+
+    args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y"}
+    args = append(args, p.InputFlags...)
+    args = append(args, "-f", "lavfi", "-i", testInput)
+    args = append(args, output...)
+    args = append(args, "-t", "0.2", filepath.Join(dir, "check."+ext))
+
+    ctx, cancel := context.WithTimeout(context.Background(), hwProbeTimeout)
+    var stderr bytes.Buffer
+
+    cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+    cmd.Stderr = &stderr
+    cmd.Dir = dir
+
+    err := cmd.Run()
+    cancel()
+
+    if err != nil {
+      // at -loglevel error these are few and all to the point
+      reason := strings.ReplaceAll(strings.TrimSpace(stderr.String()), "\n", "; ")
+
+      if reason == "" {
+        reason = err.Error()
+      }
+
+      return fmt.Errorf("profile %q: output %s failed a test encode: %s", p.Name, r.Name, reason)
+    }
+  }
+
+  return nil
+}
+
+// testable reports whether flags can run on the test input: they must not
+// be templated, read another input or map streams other than its video and
+// audio
+func testable(flags []string) bool {
+  for i, flag := range flags {
+    if strings.Contains(flag, "{") || flag == "-i" {
+      return false
+    }
+
+    if flag == "-map" && i+1 < len(flags) {
+      stream := strings.TrimPrefix(flags[i+1], "-")
+
+      if !strings.HasPrefix(stream, "0:v") && !strings.HasPrefix(stream, "0:a") {
+        return false
+      }
+    }
+  }
+
+  return true
+}
+
+// ffmpegPath is the ffmpeg the profile runs, its own or def
+func (p *Profile) ffmpegPath(def string) string {
+  if p.ffmpeg != "" {
+    return p.ffmpeg
+  }
+
+  return def
+}
+
+// ffmpeg is the binary the job's ffmpeg runs use: its profile's own build,
+// the image's program in a container, or the default
+func (e *encoder) ffmpeg(j *Job) string {
+  switch {
+  case j.profile.ffmpeg != "":
+    return j.profile.ffmpeg
+  case e.sandbox != nil && e.sandbox.container():
+    return e.sandbox.Program
+  }
+
+  return e.ffmpegPath
+}
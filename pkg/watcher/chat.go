@@ -0,0 +1,274 @@
+package watcher
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// ChatService is a chat app a ChatNotifier posts to
+type ChatService string
+
+const (
+  ChatSlack    ChatService = "slack"
+  ChatDiscord  ChatService = "discord"
+  ChatTelegram ChatService = "telegram"
+)
+
+// Chat configures a ChatNotifier
+type Chat struct {
+  Service ChatService
+
+  // Token is a Slack bot token (xoxb-...) with chat:write, a Discord bot
+  // token or a Telegram bot token from BotFather
+  Token string
+
+  // Channel is a Slack channel name or ID, a Discord channel ID, or a
+  // Telegram chat ID or @channelname. The bot must be a member
+  Channel string
+
+  // Completions also posts a summary of every job that finishes, with how
+  // long it took and how much smaller the outputs are. Failures and a
+  // stuck queue are always posted
+  Completions bool
+
+  // APIURL replaces the service's API base URL, e.g. for a proxy
+  APIURL string
+}
+
+var chatAPIs = map[ChatService]string{
+  ChatSlack:    "https://slack.com/api",
+  ChatDiscord:  "https://discord.com/api/v10",
+  ChatTelegram: "https://api.telegram.org",
+}
+
+// chatMaxLength is how much of a message Discord takes, Telegram takes 4096
+// and Slack more
+const chatMaxLength = 2000
+
+// ChatNotifier formats job events into messages for Slack, Discord or
+// Telegram and posts them with the service's bot API
+type ChatNotifier struct {
+  cfg    Chat
+  host   string
+  client *http.Client
+}
+
+func NewChatNotifier(cfg Chat) (*ChatNotifier, error) {
+  if _, ok := chatAPIs[cfg.Service]; !ok {
+    return nil, fmt.Errorf("unknown chat service %q, want slack, discord or telegram", cfg.Service)
+  }
+
+  if cfg.Token == "" || cfg.Channel == "" {
+    return nil, fmt.Errorf("%s needs a token and a channel", cfg.Service)
+  }
+
+  if cfg.APIURL == "" {
+    cfg.APIURL = chatAPIs[cfg.Service]
+  }
+
+  cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
+
+  host, _ := os.Hostname()
+
+  return &ChatNotifier{cfg: cfg, host: host, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// endpoint is the service's API, for Doctor
+func (n *ChatNotifier) endpoint() (*url.URL, error) {
+  return url.Parse(n.cfg.APIURL)
+}
+
+// HandleEvent posts failures, stuck queues, deadlines at risk and missed
+// and, with Completions, finished jobs in the background, retrying a few times before giving up and logging
+// the failure
+func (n *ChatNotifier) HandleEvent(ev JobEvent) {
+  if ev.Event == "finished" && !n.cfg.Completions {
+    return
+  }
+
+  text := n.message(ev)
+
+  go func() {
+    var err error
+
+    for attempt := 1; attempt <= 3; attempt++ {
+      if err = n.post(text); err == nil {
+        return
+      }
+
+      time.Sleep(time.Duration(attempt) * 5 * time.Second)
+    }
+
+    slog.Error("Chat notification failed", "service", n.cfg.Service, "event", ev.Event, "job", ev.JobID, "error", err)
+  }()
+}
+
+// message is the event as a few lines of text, with the file name as code
+// where the service formats it
+func (n *ChatNotifier) message(ev JobEvent) string {
+  name := n.code(filepath.Base(ev.Input))
+  took := (time.Duration(ev.DurationSeconds) * time.Second).String()
+
+  var lines []string
+
+  switch ev.Event {
+  case "finished":
+    lines = append(lines, fmt.Sprintf("Encoded %s in %s", name, took))
+
+    if ev.InputBytes > 0 && ev.OutputBytes > 0 {
+      change := "smaller"
+      percent := 100 - float64(ev.OutputBytes)/float64(ev.InputBytes)*100
+
+      if percent < 0 {
+        change, percent = "larger", -percent
+      }
+
+      lines = append(lines, fmt.Sprintf("%s to %s, %.0f%% %s", FormatSize(ev.InputBytes), FormatSize(ev.OutputBytes), percent, change))
+    }
+
+    if ev.Degraded != "" {
+      lines = append(lines, fmt.Sprintf("Degraded, the input is corrupt (%s salvage)", ev.Degraded))
+    }
+
+    if len(ev.Uploads) > 0 {
+      lines = append(lines, "Uploaded to "+ev.Uploads[0])
+    }
+  case "stuck":
+    lines = append(lines, fmt.Sprintf("Queue stuck, %d waiting", ev.Queued), ev.Error)
+  case "queue_full":
+    lines = append(lines, fmt.Sprintf("Queue full, %d waiting", ev.Queued), ev.Error)
+  case "intake_paused":
+    lines = append(lines, fmt.Sprintf("Intake paused, %d waiting", ev.Queued), ev.Error)
+  case "queue_aging":
+    lines = append(lines, fmt.Sprintf("Queue aging, %d waiting", ev.Queued), ev.Error)
+  case "backlog_growing":
+    lines = append(lines, fmt.Sprintf("Backlog growing, %d waiting", ev.Queued), ev.Error)
+  case "deadline_at_risk":
+    lines = append(lines, fmt.Sprintf("%s may miss its deadline", name), "Due "+ev.Error)
+  case "deadline_missed":
+    lines = append(lines, fmt.Sprintf("%s missed its deadline", name), "Due "+ev.Error)
+  default:
+    lines = append(lines, fmt.Sprintf("Failed to encode %s", name))
+
+    // ffmpeg's exit status is the error for most failures
+    if ev.Error != fmt.Sprintf("exit status %d", ev.ExitStatus) {
+      lines = append(lines, ev.Error)
+    }
+
+    if ev.ExitStatus > 0 {
+      lines = append(lines, fmt.Sprintf("ffmpeg exited with status %d after %s", ev.ExitStatus, took))
+    }
+
+    if ev.LogTail != "" {
+      lines = append(lines, n.code(lastLine([]byte(ev.LogTail))))
+    }
+  }
+
+  if n.host != "" {
+    lines[0] = n.host + ": " + lines[0]
+  }
+
+  text := strings.Join(lines, "\n")
+
+  if n.cfg.Service == ChatSlack {
+    text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+  }
+
+  if runes := []rune(text); len(runes) > chatMaxLength {
+    text = string(runes[:chatMaxLength-1]) + "…"
+  }
+
+  return text
+}
+
+// code marks s as code for Slack and Discord, Telegram messages are sent as
+// plain text
+func (n *ChatNotifier) code(s string) string {
+  if n.cfg.Service == ChatTelegram || s == "" || strings.Contains(s, "`") {
+    return s
+  }
+
+  return "`" + s + "`"
+}
+
+func (n *ChatNotifier) post(text string) error {
+  var endpoint, auth string
+  var payload any
+
+  switch n.cfg.Service {
+  case ChatSlack:
+    endpoint, auth = n.cfg.APIURL+"/chat.postMessage", "Bearer "+n.cfg.Token
+    payload = map[string]any{"channel": n.cfg.Channel, "text": text, "unfurl_links": false}
+  case ChatDiscord:
+    // file names should not ping anyone
+    endpoint, auth = n.cfg.APIURL+"/channels/"+url.PathEscape(n.cfg.Channel)+"/messages", "Bot "+n.cfg.Token
+    payload = map[string]any{"content": text, "allowed_mentions": map[string]any{"parse": []string{}}}
+  case ChatTelegram:
+    endpoint = n.cfg.APIURL + "/bot" + n.cfg.Token + "/sendMessage"
+    payload = map[string]any{"chat_id": n.cfg.Channel, "text": text, "disable_web_page_preview": true}
+  }
+
+  body, err := json.Marshal(payload)
+
+  if err != nil {
+    return err
+  }
+
+  req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+
+  if err != nil {
+    return err
+  }
+
+  req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+  if auth != "" {
+    req.Header.Set("Authorization", auth)
+  }
+
+  resp, err := n.client.Do(req)
+
+  if err != nil {
+    // Telegram's token is in the URL, keep it out of the logs
+    var urlErr *url.Error
+
+    if errors.As(err, &urlErr) {
+      return urlErr.Err
+    }
+
+    return err
+  }
+
+  defer resp.Body.Close()
+
+  // Slack and Telegram report errors in the body, Slack with a 200
+  var result struct {
+    OK          *bool  `json:"ok"`
+    Error       string `json:"error"`
+    Description string `json:"description"`
+    Message     string `json:"message"`
+  }
+
+  json.NewDecoder(resp.Body).Decode(&result)
+
+  if resp.StatusCode >= 300 || (result.OK != nil && !*result.OK) {
+    reason := result.Error + result.Description + result.Message
+
+    if reason == "" {
+      reason = resp.Status
+    }
+
+    return fmt.Errorf("%s: %s", n.cfg.Service, reason)
+  }
+
+  return nil
+}
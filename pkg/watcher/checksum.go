@@ -0,0 +1,224 @@
+package watcher
+
+import (
+  "bufio"
+  "crypto/md5"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "hash"
+  "io"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// checksumSuffix is the sidecar written next to each finished output, in
+// sha256sum's format so "sha256sum -c" checks it
+const checksumSuffix = ".sha256"
+
+// checksumSidecars are the sidecars an input's checksum can arrive in, like
+// movie.mkv.sha256, with the hash each holds
+var checksumSidecars = []struct {
+  suffix string
+  hash   func() hash.Hash
+}{
+  {".sha256", sha256.New},
+  {".md5", md5.New},
+}
+
+// isChecksum reports whether path is a checksum sidecar rather than an input
+func isChecksum(path string) bool {
+  for _, c := range checksumSidecars {
+    if strings.HasSuffix(path, c.suffix) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// isSidecar reports whether path is a job spec or checksum sidecar, which
+// are read with their input rather than queued
+func isSidecar(path string) bool {
+  return isSpec(path) || isChecksum(path)
+}
+
+// findChecksum returns the path of the input's checksum sidecar, or ""
+// without one
+func findChecksum(input string) string {
+  for _, c := range checksumSidecars {
+    if _, err := os.Stat(input + c.suffix); err == nil {
+      return input + c.suffix
+    }
+  }
+
+  return ""
+}
+
+// moveChecksum moves a checksum sidecar, if there is one, next to its
+// input's new path
+func moveChecksum(sidecar string, input string) error {
+  for _, c := range checksumSidecars {
+    if sidecar != "" && strings.HasSuffix(sidecar, c.suffix) {
+      return moveFile(sidecar, input+c.suffix)
+    }
+  }
+
+  return nil
+}
+
+// readChecksum returns the hex digest for file in a sidecar. Like the
+// output of sha256sum or md5sum it is "digest  name" lines, the line naming
+// file wins, or a sidecar can hold the digest alone
+func readChecksum(sidecar string, file string) (string, error) {
+  f, err := os.Open(sidecar)
+
+  if err != nil {
+    return "", err
+  }
+
+  defer f.Close()
+
+  var first string
+  scanner := bufio.NewScanner(f)
+
+  for scanner.Scan() {
+    fields := strings.Fields(scanner.Text())
+
+    if len(fields) == 0 {
+      continue
+    }
+
+    digest := strings.ToLower(fields[0])
+
+    // sha256sum marks a binary read with a *
+    if len(fields) > 1 && filepath.Base(strings.TrimPrefix(fields[1], "*")) == filepath.Base(file) {
+      return digest, nil
+    }
+
+    if first == "" {
+      first = digest
+    }
+  }
+
+  if err = scanner.Err(); err != nil {
+    return "", err
+  }
+
+  if first == "" {
+    return "", fmt.Errorf("%s holds no checksum", filepath.Base(sidecar))
+  }
+
+  return first, nil
+}
+
+// fileDigest is the hex digest of a file's content
+func fileDigest(path string, newHash func() hash.Hash) (string, error) {
+  f, err := os.Open(path)
+
+  if err != nil {
+    return "", err
+  }
+
+  defer f.Close()
+
+  h := newHash()
+
+  if _, err = io.Copy(h, f); err != nil {
+    return "", err
+  }
+
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyInput checks the job's input against its checksum sidecar, an
+// input without one passes
+func verifyInput(j *Job) error {
+  if j.checksumPath == "" {
+    return nil
+  }
+
+  if err := matchChecksum(j.checksumPath, j.input, j.source()); err != nil {
+    return err
+  }
+
+  j.logger().Info("Verified input checksum", "sidecar", j.checksumPath)
+
+  return nil
+}
+
+// matchChecksum checks the content of file against the digest a sidecar
+// has for name
+func matchChecksum(sidecar string, name string, file string) error {
+  want, err := readChecksum(sidecar, name)
+
+  if err != nil {
+    return fmt.Errorf("checksum: %s", err)
+  }
+
+  for _, c := range checksumSidecars {
+    if !strings.HasSuffix(sidecar, c.suffix) {
+      continue
+    }
+
+    got, err := fileDigest(file, c.hash)
+
+    if err != nil {
+      return fmt.Errorf("checksum: %s", err)
+    }
+
+    if got != want {
+      return fmt.Errorf("checksum mismatch: %s says %s, the input is %s", filepath.Base(sidecar), want, got)
+    }
+  }
+
+  return nil
+}
+
+// writeChecksums writes a .sha256 next to each finished output and returns
+// them. A package directory gets one line per file, relative to the
+// directory holding it
+func writeChecksums(j *Job, finished []string) []string {
+  var sidecars []string
+
+  for _, out := range finished {
+    var lines strings.Builder
+
+    err := filepath.WalkDir(out, func(path string, entry fs.DirEntry, err error) error {
+      if err != nil || entry.IsDir() {
+        return err
+      }
+
+      digest, err := fileDigest(path, sha256.New)
+
+      if err != nil {
+        return err
+      }
+
+      rel, err := filepath.Rel(filepath.Dir(out), path)
+
+      if err != nil {
+        return err
+      }
+
+      fmt.Fprintf(&lines, "%s  %s\n", digest, filepath.ToSlash(rel))
+
+      return nil
+    })
+
+    if err == nil {
+      err = os.WriteFile(out+checksumSuffix, []byte(lines.String()), 0644)
+    }
+
+    if err != nil {
+      j.logger().Warn("Could not write checksum", "output", out, "error", err)
+      continue
+    }
+
+    sidecars = append(sidecars, out+checksumSuffix)
+  }
+
+  return sidecars
+}
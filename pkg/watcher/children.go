@@ -0,0 +1,101 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// processesDir is the working directory's stateDir folder recording the
+// children each instance has running, as <instance>-<pid> holding the
+// program's path
+func (s *workingState) processesDir() string {
+  return filepath.Join(s.dir, "processes")
+}
+
+// child records a started child until the returned func is called, so one
+// left running by an instance that crashed or was killed is found by the
+// next start
+func (s *workingState) child(p *os.Process, program string) func() {
+  path := filepath.Join(s.processesDir(), fmt.Sprintf("%s-%d", s.instance, p.Pid))
+
+  if err := os.WriteFile(path, []byte(program+"\n"), 0644); err != nil {
+    slog.Warn("Could not record child process in the working directory", "pid", p.Pid, "error", err)
+    return func() {}
+  }
+
+  return func() { os.Remove(path) }
+}
+
+// reapChildren kills the children this host's dead instances left running,
+// those prepareChild did not take down with them. A pid that went on to a
+// different program is left alone, the record is removed either way.
+// Instances on other hosts sharing the working directory are not looked at
+func (s *workingState) reapChildren() {
+  entries, _ := os.ReadDir(s.processesDir())
+  host := s.instance[:strings.LastIndex(s.instance, "-")]
+
+  for _, entry := range entries {
+    cut := strings.LastIndex(entry.Name(), "-")
+
+    if cut < 0 {
+      continue
+    }
+
+    instance, pidText := entry.Name()[:cut], entry.Name()[cut+1:]
+    pid, err := strconv.Atoi(pidText)
+
+    if err != nil || !strings.HasPrefix(instance, host+"-") || s.alive(instance) {
+      continue
+    }
+
+    path := filepath.Join(s.processesDir(), entry.Name())
+    data, err := os.ReadFile(path)
+    os.Remove(path)
+
+    if program := strings.TrimSpace(string(data)); err == nil && childRunning(pid, program) {
+      if err := killChild(pid); err != nil {
+        slog.Error("Could not kill child process left by a crashed instance", "pid", pid, "program", program, "instance", instance, "error", err)
+      } else {
+        slog.Warn("Killed child process left by a crashed instance", "pid", pid, "program", program, "instance", instance)
+      }
+    }
+  }
+}
+
+// alive reports whether the instance of this host is this one, or is
+// still running as gowatcher. Its file in instancesDir is not telling, a
+// crashed instance restarted straight away has left it fresh
+func (s *workingState) alive(instance string) bool {
+  if instance == s.instance {
+    return true
+  }
+
+  pid, err := strconv.Atoi(instance[strings.LastIndex(instance, "-")+1:])
+
+  if err != nil {
+    return false
+  }
+
+  self, err := os.Executable()
+
+  return err == nil && childRunning(pid, self)
+}
+
+// startedChild ties a child the encoder started to gowatcher where the
+// platform can, see adoptChild, and records it until the returned func is
+// called
+func (e *encoder) startedChild(j *Job, p *os.Process, program string) func() {
+  if err := adoptChild(p); err != nil {
+    j.logger().Warn("Could not tie the child process to gowatcher, it outlives a crash", "pid", p.Pid, "error", err)
+  }
+
+  if e.working == nil {
+    return func() {}
+  }
+
+  return e.working.child(p, program)
+}
@@ -0,0 +1,51 @@
+package watcher
+
+import (
+  "bytes"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "syscall"
+)
+
+// prepareChild starts a child in a process group of its own, so a Ctrl+C
+// in gowatcher's terminal is left to gowatcher's shutdown as on Windows
+// and the child's own children can be killed with it, and has the kernel
+// kill it when gowatcher dies, however it does
+func prepareChild(cmd *exec.Cmd) {
+  if cmd.SysProcAttr == nil {
+    cmd.SysProcAttr = &syscall.SysProcAttr{}
+  }
+
+  cmd.SysProcAttr.Setpgid = true
+  cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+}
+
+// adoptChild has nothing to do, Pdeathsig is set when the child starts
+func adoptChild(p *os.Process) error {
+  return nil
+}
+
+// childRunning reports whether pid is still running program, by its
+// command line
+func childRunning(pid int, program string) bool {
+  cmdline, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+
+  if err != nil || len(cmdline) == 0 {
+    return false
+  }
+
+  name, _, _ := bytes.Cut(cmdline, []byte{0})
+
+  return filepath.Base(string(name)) == filepath.Base(program)
+}
+
+// killChild kills the child's process group, or the child when it has none
+func killChild(pid int) error {
+  if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+    return nil
+  }
+
+  return syscall.Kill(pid, syscall.SIGKILL)
+}
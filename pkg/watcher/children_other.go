@@ -0,0 +1,25 @@
+//go:build !unix && !windows
+
+package watcher
+
+import (
+  "errors"
+  "os"
+  "os/exec"
+)
+
+// prepareChild does nothing on platforms without process groups
+func prepareChild(cmd *exec.Cmd) {}
+
+func adoptChild(p *os.Process) error {
+  return nil
+}
+
+// childRunning cannot tell here, so nothing is reaped
+func childRunning(pid int, program string) bool {
+  return false
+}
+
+func killChild(pid int) error {
+  return errors.New("not supported on this platform")
+}
@@ -0,0 +1,50 @@
+//go:build unix && !linux
+
+package watcher
+
+import (
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "syscall"
+)
+
+// prepareChild starts a child in a process group of its own, so a Ctrl+C
+// in gowatcher's terminal is left to gowatcher's shutdown as on Windows
+// and the child's own children can be killed with it. Only Linux can have
+// it killed when gowatcher dies, here reapChildren does on the next start
+func prepareChild(cmd *exec.Cmd) {
+  if cmd.SysProcAttr == nil {
+    cmd.SysProcAttr = &syscall.SysProcAttr{}
+  }
+
+  cmd.SysProcAttr.Setpgid = true
+}
+
+// adoptChild has nothing to do outside Linux and Windows
+func adoptChild(p *os.Process) error {
+  return nil
+}
+
+// childRunning reports whether pid is still running program, by what ps
+// says it is
+func childRunning(pid int, program string) bool {
+  out, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(pid)).Output()
+
+  if err != nil {
+    return false
+  }
+
+  return filepath.Base(strings.TrimSpace(string(out))) == filepath.Base(program)
+}
+
+// killChild kills the child's process group, or the child when it has none
+func killChild(pid int) error {
+  if err := syscall.Kill(-pid, syscall.SIGKILL); err == nil {
+    return nil
+  }
+
+  return syscall.Kill(pid, syscall.SIGKILL)
+}
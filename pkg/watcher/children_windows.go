@@ -0,0 +1,107 @@
+package watcher
+
+import (
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strings"
+  "sync"
+  "unsafe"
+
+  "golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code of a process that has not exited
+const stillActive = 259
+
+// childJob is the job object the children are put in, created with the
+// first of them
+var (
+  childJob     windows.Handle
+  childJobErr  error
+  childJobOnce sync.Once
+)
+
+// prepareChild has nothing to do, prepareInterrupt gives the child its
+// process group and adoptChild ties it to gowatcher once it started
+func prepareChild(cmd *exec.Cmd) {}
+
+// adoptChild puts a started child in a job object that kills what is in
+// it once its last handle is closed, which gowatcher holds until it exits,
+// however it does
+func adoptChild(p *os.Process) error {
+  childJobOnce.Do(func() {
+    job, err := windows.CreateJobObject(nil, nil)
+
+    if err != nil {
+      childJobErr = err
+      return
+    }
+
+    var info windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+    info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+
+    if _, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+      windows.CloseHandle(job)
+      childJobErr = err
+      return
+    }
+
+    childJob = job
+  })
+
+  if childJobErr != nil {
+    return childJobErr
+  }
+
+  h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(p.Pid))
+
+  if err != nil {
+    return err
+  }
+
+  defer windows.CloseHandle(h)
+
+  return windows.AssignProcessToJobObject(childJob, h)
+}
+
+// childRunning reports whether pid is still running program, by its image
+func childRunning(pid int, program string) bool {
+  h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+
+  if err != nil {
+    return false
+  }
+
+  defer windows.CloseHandle(h)
+
+  var code uint32
+
+  if err = windows.GetExitCodeProcess(h, &code); err != nil || code != stillActive {
+    return false
+  }
+
+  name := make([]uint16, windows.MAX_PATH)
+  size := uint32(len(name))
+
+  if err = windows.QueryFullProcessImageName(h, 0, &name[0], &size); err != nil {
+    return false
+  }
+
+  image := strings.TrimSuffix(strings.ToLower(filepath.Base(windows.UTF16ToString(name[:size]))), ".exe")
+
+  return image == strings.TrimSuffix(strings.ToLower(filepath.Base(program)), ".exe")
+}
+
+// killChild terminates the child
+func killChild(pid int) error {
+  h, err := windows.OpenProcess(windows.PROCESS_TERMINATE, false, uint32(pid))
+
+  if err != nil {
+    return err
+  }
+
+  defer windows.CloseHandle(h)
+
+  return windows.TerminateProcess(h, 1)
+}
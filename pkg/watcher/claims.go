@@ -0,0 +1,384 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "io/fs"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Claims let several instances, on other machines too, share one queue
+// directory. Before encoding a file an instance claims it with a marker in
+// the queue directory's .claims folder, created atomically, and refreshes
+// it while the job runs. The others wait while the claim is held and drop
+// their job once the file is done with. The claim of an instance that died
+// goes stale and is taken over. Each instance needs its own working
+// directory
+type Claims struct {
+  // Node names this instance in claims and must be unique among those
+  // sharing the queue, default the host name
+  Node string
+
+  // Heartbeat is how often a running job's claim is refreshed and other
+  // instances' claims are checked again, default 30s. A claim not
+  // refreshed for StaleAfter, default four heartbeats, is taken over
+  Heartbeat  time.Duration
+  StaleAfter time.Duration
+}
+
+const defaultClaimHeartbeat = 30 * time.Second
+
+// claim states, a running claim is refreshed by its node and the others
+// are what became of the file while it is still in the queue directory
+const (
+  claimRunning   = "running"
+  claimDone      = "done"
+  claimFailed    = "failed"
+  claimCancelled = "cancelled"
+)
+
+// claimInfo is the content of a claim file, one line of space separated
+// fields. size and modTime are the input's, a different file at the same
+// path is new work
+type claimInfo struct {
+  state   string
+  node    string
+  pid     int
+  size    int64
+  modTime int64
+}
+
+func (c claimInfo) String() string {
+  return fmt.Sprintf("%s %s %d %d %d\n", c.state, c.node, c.pid, c.size, c.modTime)
+}
+
+func parseClaim(data []byte) (claimInfo, error) {
+  fields := strings.Fields(string(data))
+
+  if len(fields) != 5 {
+    return claimInfo{}, fmt.Errorf("bad claim %q", strings.TrimSpace(string(data)))
+  }
+
+  c := claimInfo{state: fields[0], node: fields[1]}
+  var err1, err2, err3 error
+
+  c.pid, err1 = strconv.Atoi(fields[2])
+  c.size, err2 = strconv.ParseInt(fields[3], 10, 64)
+  c.modTime, err3 = strconv.ParseInt(fields[4], 10, 64)
+
+  if err := errors.Join(err1, err2, err3); err != nil {
+    return claimInfo{}, fmt.Errorf("bad claim %q", strings.TrimSpace(string(data)))
+  }
+
+  return c, nil
+}
+
+// claimer claims the files of a queue directory for this node
+type claimer struct {
+  cfg      Claims
+  dir      string
+  queueDir string
+
+  mu   sync.Mutex
+  held map[*Job]*heldClaim
+}
+
+// heldClaim is a claim this node holds, refreshed until stop is called
+type heldClaim struct {
+  path  string
+  input string
+  stop  context.CancelFunc
+}
+
+func newClaimer(cfg Claims, queueDir string) (*claimer, error) {
+  if cfg.Node == "" {
+    host, err := os.Hostname()
+
+    if err != nil {
+      return nil, fmt.Errorf("no node name: %s", err)
+    }
+
+    cfg.Node = host
+  }
+
+  if strings.ContainsAny(cfg.Node, " \t\n") {
+    return nil, fmt.Errorf("node name %q has spaces", cfg.Node)
+  }
+
+  if cfg.Heartbeat <= 0 {
+    cfg.Heartbeat = defaultClaimHeartbeat
+  }
+
+  if cfg.StaleAfter <= 0 {
+    cfg.StaleAfter = 4 * cfg.Heartbeat
+  }
+
+  if cfg.StaleAfter <= cfg.Heartbeat {
+    return nil, fmt.Errorf("stale claims must be older than a heartbeat")
+  }
+
+  dir := filepath.Join(queueDir, ".claims")
+
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return nil, err
+  }
+
+  return &claimer{cfg: cfg, dir: dir, queueDir: queueDir, held: make(map[*Job]*heldClaim)}, nil
+}
+
+// path is the input's claim file, empty for inputs outside the queue
+// directory which only this node knows about
+func (c *claimer) path(input string) string {
+  rel, err := filepath.Rel(c.queueDir, input)
+
+  if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+    return ""
+  }
+
+  return filepath.Join(c.dir, url.PathEscape(filepath.ToSlash(rel))+".claim")
+}
+
+// claim tries to claim the job's input. It returns nil once this node holds
+// it, otherwise the claim of the node that has it. Requeued jobs take over
+// claims that are done with
+func (c *claimer) claim(j *Job) (*claimInfo, error) {
+  input := j.input
+  path := c.path(input)
+
+  if path == "" {
+    return nil, nil
+  }
+
+  info, err := os.Stat(input)
+
+  if err != nil {
+    return nil, err
+  }
+
+  mine := claimInfo{state: claimRunning, node: c.cfg.Node, pid: os.Getpid(), size: info.Size(), modTime: info.ModTime().UnixNano()}
+
+  // a second go when the claim went away or went stale meanwhile
+  for attempt := 0; attempt < 3; attempt++ {
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+    if err == nil {
+      _, err = f.WriteString(mine.String())
+
+      if closeErr := f.Close(); err == nil {
+        err = closeErr
+      }
+
+      if err != nil {
+        os.Remove(path)
+        return nil, err
+      }
+
+      // a node that read a stale claim just before could have replaced it
+      if data, err := os.ReadFile(path); err != nil || string(data) != mine.String() {
+        continue
+      }
+
+      c.hold(j, path, input)
+
+      return nil, nil
+    }
+
+    if !errors.Is(err, fs.ErrExist) {
+      return nil, err
+    }
+
+    data, err := os.ReadFile(path)
+
+    if errors.Is(err, fs.ErrNotExist) {
+      continue
+    }
+
+    if err != nil {
+      return nil, err
+    }
+
+    other, err := parseClaim(data)
+
+    if err != nil {
+      return nil, err
+    }
+
+    stat, err := os.Stat(path)
+
+    if errors.Is(err, fs.ErrNotExist) {
+      continue
+    }
+
+    if err != nil {
+      return nil, err
+    }
+
+    switch {
+    case other.state == claimRunning && other.node == c.cfg.Node,
+      other.state != claimRunning && (j.forced || other.size != mine.size || other.modTime != mine.modTime):
+      // ours before a restart, or a file that was done with being
+      // requeued or replaced, claimed again like a new one
+      c.takeOver(path, data)
+    case other.state == claimRunning && time.Since(stat.ModTime()) > c.cfg.StaleAfter:
+      if c.takeStale(path) {
+        j.logger().Warn("Took over a stale claim", "node", other.node, "refreshed", stat.ModTime().Format(time.RFC3339))
+      }
+    default:
+      return &other, nil
+    }
+  }
+
+  return nil, fmt.Errorf("could not claim %s", input)
+}
+
+// takeStale removes a stale claim, unless another node took it over first.
+// The claim is renamed aside before it is checked again so two nodes
+// cannot both remove it
+func (c *claimer) takeStale(path string) bool {
+  aside := path + "." + c.cfg.Node + ".stale"
+
+  if err := os.Rename(path, aside); err != nil {
+    return false
+  }
+
+  defer os.Remove(aside)
+
+  if info, err := os.Stat(aside); err == nil && time.Since(info.ModTime()) <= c.cfg.StaleAfter {
+    // a fresh claim made since, put it back
+    os.Link(aside, path)
+    return false
+  }
+
+  return true
+}
+
+// takeOver removes a claim that is done with so it can be claimed again,
+// unless it changed since it was read as seen. Like takeStale it renames
+// the claim aside first so only one node removes it, the others then race
+// to create it
+func (c *claimer) takeOver(path string, seen []byte) {
+  aside := path + "." + c.cfg.Node + ".taken"
+
+  if err := os.Rename(path, aside); err != nil {
+    return
+  }
+
+  defer os.Remove(aside)
+
+  if data, err := os.ReadFile(aside); err != nil || !bytes.Equal(data, seen) {
+    os.Link(aside, path)
+  }
+}
+
+// hold refreshes the claim every heartbeat until the job releases it
+func (c *claimer) hold(j *Job, path string, input string) {
+  ctx, stop := context.WithCancel(context.Background())
+
+  c.mu.Lock()
+  c.held[j] = &heldClaim{path: path, input: input, stop: stop}
+  c.mu.Unlock()
+
+  go func() {
+    ticker := time.NewTicker(c.cfg.Heartbeat)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        now := time.Now()
+
+        if err := os.Chtimes(path, now, now); err != nil {
+          j.logger().Error("Could not refresh claim", "claim", path, "error", err)
+        }
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+}
+
+// release gives up the job's claim once it is over. While the input is
+// still in the queue directory the claim stays, saying what became of it,
+// so the other nodes leave it alone. Jobs interrupted by shutdown or
+// waiting again are left to whichever node gets to them
+func (c *claimer) release(j *Job) {
+  c.mu.Lock()
+  h := c.held[j]
+  delete(c.held, j)
+  c.mu.Unlock()
+
+  if h == nil {
+    return
+  }
+
+  h.stop()
+
+  v := j.View()
+  state := ""
+
+  switch {
+  case v.State == JobDone:
+    state = claimDone
+  case v.State == JobFailed:
+    state = claimFailed
+  case v.State == JobCancelled && v.Error != errShutdown.Error():
+    state = claimCancelled
+  }
+
+  if info, err := os.Stat(h.input); err == nil && state != "" {
+    final := claimInfo{state: state, node: c.cfg.Node, pid: os.Getpid(), size: info.Size(), modTime: info.ModTime().UnixNano()}
+
+    // renamed into place so the others never read half a claim
+    tmp := h.path + "." + c.cfg.Node + ".tmp"
+
+    if err = os.WriteFile(tmp, []byte(final.String()), 0644); err == nil {
+      err = os.Rename(tmp, h.path)
+    }
+
+    if err != nil {
+      os.Remove(tmp)
+      j.logger().Error("Could not update claim", "claim", h.path, "error", err)
+    }
+
+    return
+  }
+
+  if err := os.Remove(h.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+    j.logger().Error("Could not release claim", "claim", h.path, "error", err)
+  }
+}
+
+// waitForClaim checks again after a heartbeat whether the job's input is
+// still claimed by another node, the job is dropped once the input has
+// gone from the queue directory
+func (e *encoder) waitForClaim(j *Job, other *claimInfo) {
+  j.mu.Lock()
+  first := j.claimedBy != other.node
+  j.claimedBy = other.node
+  j.mu.Unlock()
+
+  if first {
+    j.logger().Info("Claimed by another node, waiting", "node", other.node)
+  }
+
+  time.AfterFunc(e.claims.cfg.Heartbeat, func() {
+    if j.State() != JobQueued {
+      return
+    }
+
+    if _, err := os.Stat(j.input); errors.Is(err, fs.ErrNotExist) {
+      j.finish(JobCancelled, fmt.Errorf("gone from the queue directory, claimed by %s", other.node))
+      return
+    }
+
+    e.queue.push(j)
+  })
+}
@@ -0,0 +1,80 @@
+package watcher
+
+import (
+  "os"
+  "path/filepath"
+  "sync"
+  "testing"
+)
+
+func TestClaimTakeOverOnce(t *testing.T) {
+  queue := t.TempDir()
+  input := filepath.Join(queue, "clip.mov")
+
+  if err := os.WriteFile(input, []byte("clip"), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  var claimers []*claimer
+
+  for _, node := range []string{"a", "b", "c", "d"} {
+    c, err := newClaimer(Claims{Node: node}, queue)
+
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    claimers = append(claimers, c)
+  }
+
+  for round := 0; round < 200; round++ {
+    // a claim done with, requeued on every node at once
+    done := claimInfo{state: claimDone, node: "e", pid: 1}
+
+    if err := os.WriteFile(claimers[0].path(input), []byte(done.String()), 0644); err != nil {
+      t.Fatal(err)
+    }
+
+    var wg sync.WaitGroup
+    start := make(chan struct{})
+    held := make([]bool, len(claimers))
+    jobs := make([]*Job, len(claimers))
+
+    for i, c := range claimers {
+      jobs[i] = &Job{input: input, forced: true, profile: &Profile{}}
+      wg.Add(1)
+
+      go func(i int, c *claimer) {
+        defer wg.Done()
+        <-start
+
+        other, err := c.claim(jobs[i])
+        held[i] = err == nil && other == nil
+      }(i, c)
+    }
+
+    close(start)
+    wg.Wait()
+
+    holders := 0
+
+    for i, c := range claimers {
+      if held[i] {
+        holders++
+      }
+
+      c.mu.Lock()
+      h := c.held[jobs[i]]
+      delete(c.held, jobs[i])
+      c.mu.Unlock()
+
+      if h != nil {
+        h.stop()
+      }
+    }
+
+    if holders != 1 {
+      t.Fatalf("round %d: %d nodes hold the claim, want 1", round, holders)
+    }
+  }
+}
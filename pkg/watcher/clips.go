@@ -0,0 +1,359 @@
+package watcher
+
+import (
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// Clip is a stretch of the input a job spec or POST /clips asks for as an
+// output of its own: from Start to End, seconds or [hh:]mm:ss[.ms], End
+// empty for the rest of the input. Name, clip1 and on by default, goes
+// after the output's name as -<name>, or where the output name template has
+// {clip}, and names the clip's artifact, so a clip that fails leaves the
+// others. A clip is stream copied, cut at the keyframe before Start, unless
+// Encode is set, the spec has output_flags or the input is an image
+// sequence: then it is encoded with the profile's flags, frame accurately,
+// once for each rendition. A copied clip is named like the first rendition
+type Clip struct {
+  Name   string `yaml:"name" json:"name,omitempty"`
+  Start  string `yaml:"start" json:"start,omitempty"`
+  End    string `yaml:"end" json:"end,omitempty"`
+  Encode bool   `yaml:"encode" json:"encode,omitempty"`
+
+  start time.Duration
+  end   time.Duration
+}
+
+// clipRun is what a run that makes a clip needs on top of the others:
+// how long the clip lasts, for its progress and validation, and whether it
+// was copied, which starts it at a keyframe so its length is not checked
+type clipRun struct {
+  length time.Duration
+  copied bool
+}
+
+// checkClips reads the clips' in and out points and names the ones
+// without a name
+func checkClips(clips []Clip) error {
+  names := make(map[string]bool, len(clips))
+
+  for i := range clips {
+    c := &clips[i]
+    var err error
+
+    if c.Name = strings.TrimSpace(c.Name); c.Name == "" {
+      c.Name = fmt.Sprintf("clip%d", i+1)
+    }
+
+    if strings.ContainsAny(c.Name, `/\`) || strings.HasPrefix(c.Name, ".") {
+      return fmt.Errorf("clip name %q must not contain a path separator or start with a dot", c.Name)
+    }
+
+    if names[c.Name] {
+      return fmt.Errorf("more than one clip is named %s", c.Name)
+    }
+
+    names[c.Name] = true
+
+    if c.start, err = parseTimestamp(c.Start); err != nil {
+      return fmt.Errorf("clip %s start: %s", c.Name, err)
+    }
+
+    if c.end, err = parseTimestamp(c.End); err != nil {
+      return fmt.Errorf("clip %s end: %s", c.Name, err)
+    }
+
+    if c.end > 0 && c.end <= c.start {
+      return fmt.Errorf("clip %s end %s is not after start %s", c.Name, c.End, c.Start)
+    }
+  }
+
+  return nil
+}
+
+// length is how long the clip of an input lasting total is, zero when
+// neither is known
+func (c Clip) length(total time.Duration) time.Duration {
+  end := c.end
+
+  if end == 0 || (total > 0 && end > total) {
+    end = total
+  }
+
+  if end <= c.start {
+    return 0
+  }
+
+  return end - c.start
+}
+
+// seekFlags seek the input to the clip's in point, lengthFlags stop the
+// output at its out point
+func (c Clip) seekFlags() []string {
+  if c.start <= 0 {
+    return nil
+  }
+
+  return []string{"-ss", formatSeconds(c.start)}
+}
+
+func (c Clip) lengthFlags() []string {
+  if c.end <= 0 {
+    return nil
+  }
+
+  return []string{"-t", formatSeconds(c.end - c.start)}
+}
+
+// clipsLength is how long the job's clips are together
+func (s *jobSpec) clipsLength(total time.Duration) time.Duration {
+  var length time.Duration
+
+  for _, c := range s.Clips {
+    length += c.length(total)
+  }
+
+  return length
+}
+
+// clipName is the name of the clip's output for the rendition
+func (p *Profile) clipName(input string, r Rendition, probed *probeResult, at time.Time, clip string) string {
+  if strings.Contains(p.NameTemplate, "{clip}") {
+    vars := p.nameVars(input, r, probed, at)
+    vars["clip"] = clip
+
+    return expandName(p.NameTemplate, vars)
+  }
+
+  name := p.outputName(input, r, probed, at)
+  ext := filepath.Ext(name)
+
+  return strings.TrimSuffix(name, ext) + "-" + clip + ext
+}
+
+// copiesClip reports whether the clip is stream copied rather than
+// encoded. A salvaged job's clips are copied whatever they ask for
+func (j *Job) copiesClip(c Clip) bool {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.degraded == salvageCopy {
+    return true
+  }
+
+  return !c.Encode && len(j.spec.OutputFlags) == 0 && j.sequence == nil
+}
+
+// planClips plans a run for each of the job's clips, or one for each of
+// their renditions when they are encoded. They are validated on their own,
+// against their own length
+func (e *encoder) planClips(j *Job, probed *probeResult) encodePlan {
+  file := j.source()
+  prof := j.profile
+  renditions := e.renditions(j, probed)
+  inputFlags, outputFlags, hardware := e.flags(j, probed)
+  salvageInput, salvageOutput := j.salvageFlags()
+
+  var total time.Duration
+
+  if probed != nil {
+    total = probed.duration()
+  }
+
+  var plan encodePlan
+
+  for _, c := range j.spec.Clips {
+    artifact := "clip " + c.Name
+
+    if j.copiesClip(c) {
+      out := filepath.Join(e.jobDir(j), prof.clipName(j.name, renditions[0], probed, j.startedAt, c.Name))
+
+      args := concat(concat(salvageInput, c.seekFlags()), []string{"-i", file})
+      args = concat(args, c.lengthFlags())
+      args = append(args, "-map", "0:v?", "-map", "0:a?", "-c", "copy", "-avoid_negative_ts", "make_zero")
+      args = concat(concat(concat(args, e.metadataFlags(j, probed, 0)), j.spec.outputFlags()), salvageOutput)
+
+      plan.runs = append(plan.runs, ffmpegRun{
+        name:     artifact,
+        args:     append(args, out),
+        outputs:  []string{out},
+        artifact: artifact,
+        clip:     &clipRun{length: c.length(total), copied: true},
+      })
+      plan.unchecked = append(plan.unchecked, out)
+
+      continue
+    }
+
+    plan.hardware = hardware
+
+    for _, r := range renditions {
+      out := filepath.Join(e.jobDir(j), prof.clipName(j.name, r, probed, j.startedAt, c.Name))
+
+      run := ffmpegRun{name: strings.TrimSpace(artifact + " " + r.Name), outputs: []string{out}, artifact: artifact, clip: &clipRun{length: c.length(total)}}
+      run.args = append(run.args, inputFlags...)
+      run.args = append(run.args, c.seekFlags()...)
+      run.args = append(run.args, "-i", file)
+      run.args = append(run.args, outputFlags...)
+      run.args = append(run.args, r.OutputFlags...)
+      run.args = append(run.args, c.lengthFlags()...)
+      run.args = append(run.args, out)
+
+      plan.runs = append(plan.runs, run)
+      plan.unchecked = append(plan.unchecked, out)
+    }
+  }
+
+  return plan
+}
+
+// lasts is how long the run's output lasts: the job's duration, or its
+// clip's
+func (r ffmpegRun) lasts(duration time.Duration) time.Duration {
+  if r.clip != nil {
+    return r.clip.length
+  }
+
+  return duration
+}
+
+// validated are the outputs of an artifact's runs validation checks and
+// how long they must last. A clip's are left out of the job's outputs and
+// checked with its artifact, a copied one only for being readable
+func (p encodePlan) validated(runs []int, duration time.Duration) ([]string, time.Duration) {
+  outputs := p.artifactOutputs(runs)
+
+  if last := p.runs[runs[len(runs)-1]]; last.clip != nil {
+    if last.clip.copied {
+      return outputs, 0
+    }
+
+    return outputs, last.clip.length
+  }
+
+  return p.checked(outputs), duration
+}
+
+// ClipsView is the JSON returned by POST /clips, Queued is where the input
+// was put in the queue directory with the job spec asking for the clips
+type ClipsView struct {
+  Queued string `json:"queued"`
+  Clips  []Clip `json:"clips"`
+}
+
+// EnqueueClips queues clips of an input that stays where it is, like a
+// long master: the input is put into the queue directory by mode, linked
+// unless set, next to a job spec asking for the clips with profile, the
+// default one when empty. It returns where the input is in the queue
+// directory
+func (w *Watcher) EnqueueClips(input string, profile string, clips []Clip, mode ImportMode) (string, error) {
+  if len(clips) == 0 {
+    return "", fmt.Errorf("no clips asked for")
+  }
+
+  if err := checkClips(clips); err != nil {
+    return "", err
+  }
+
+  if profile != "" && w.profiles.Load().byName[profile] == nil {
+    return "", fmt.Errorf("unknown profile %q", profile)
+  }
+
+  switch mode {
+  case "":
+    mode = ImportLink
+  case ImportLink, ImportCopy, ImportMove:
+  default:
+    return "", fmt.Errorf("mode must be link, copy or move, not %q", mode)
+  }
+
+  if mode == ImportLink && w.cfg.Symlinks == SymlinksSkip {
+    return "", fmt.Errorf("linking needs the follow or resolve symlink policy, copy or move instead")
+  }
+
+  path, err := filepath.Abs(input)
+
+  if err != nil {
+    return "", err
+  }
+
+  if info, err := os.Stat(path); err != nil {
+    return "", err
+  } else if !info.Mode().IsRegular() {
+    return "", fmt.Errorf("%s is not a file", path)
+  }
+
+  if !w.filter.Load().allowed(path) {
+    return "", fmt.Errorf("%s is not a file this watcher encodes", path)
+  }
+
+  spec, _ := json.MarshalIndent(struct {
+    Profile string `json:"profile,omitempty"`
+    Clips   []Clip `json:"clips"`
+  }{profile, clips}, "", "  ")
+
+  dest := queuePath(w.queueDir, filepath.Base(path))
+
+  // the spec goes first so it is there once the input is seen
+  if err = os.WriteFile(dest+".job.json", append(spec, '\n'), 0644); err != nil {
+    return "", err
+  }
+
+  if err = importPlace(path, dest, mode); err != nil {
+    os.Remove(dest + ".job.json")
+    return "", err
+  }
+
+  if mode == ImportMove {
+    w.enc.audit.moved(nil, path, dest, "clips")
+  }
+
+  slog.Info("Queued clips", "input", path, "to", dest, "clips", len(clips), "mode", mode)
+
+  w.found(dest)
+
+  return dest, nil
+}
+
+// clips serves POST /clips?input=/masters/tape.mov[&mode=link|copy|move]
+// with {"profile": "web", "clips": [{"name": "intro", "start": "1:30",
+// "end": "2:45"}]} as the body, see Watcher.EnqueueClips
+func (a *api) clips(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  query := r.URL.Query()
+  input := query.Get("input")
+
+  if input == "" {
+    writeError(w, http.StatusBadRequest, "input is required")
+    return
+  }
+
+  var body struct {
+    Profile string `json:"profile"`
+    Clips   []Clip `json:"clips"`
+  }
+
+  if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+    writeError(w, http.StatusBadRequest, "bad clips: "+err.Error())
+    return
+  }
+
+  queued, err := a.w.EnqueueClips(input, body.Profile, body.Clips, ImportMode(query.Get("mode")))
+
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusAccepted, ClipsView{Queued: queued, Clips: body.Clips})
+}
@@ -0,0 +1,252 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "sync"
+)
+
+// CollisionPolicy is what happens when an output already exists in the
+// finished directory
+type CollisionPolicy string
+
+const (
+  // CollisionOverwrite replaces the existing output
+  CollisionOverwrite CollisionPolicy = "overwrite"
+
+  // CollisionSkip keeps the existing output. A job whose outputs all exist
+  // already is not encoded at all. It is marked done and its input disposed
+  // of when the ledger or the encodes file says the outputs were made from
+  // it, otherwise it is cancelled and the input kept
+  CollisionSkip CollisionPolicy = "skip"
+
+  // CollisionSuffix adds -1, -2... to the new output's name until it is free
+  CollisionSuffix CollisionPolicy = "suffix"
+)
+
+// finishedPath is where a working output of the job ends up, in the
+// finished directory or its profile's Destination
+func (e *encoder) finishedPath(j *Job, working string) string {
+  return filepath.Join(e.outputDir(j), filepath.Base(working))
+}
+
+// existingOutputs returns the finished paths of the plan's outputs when
+// every one of them already exists, or nil
+func (e *encoder) existingOutputs(j *Job, plan encodePlan) []string {
+  existing := make([]string, 0)
+
+  for _, run := range plan.runs {
+    for _, out := range run.outputs {
+      dest := e.finishedPath(j, out)
+
+      if _, err := os.Lstat(dest); err != nil {
+        return nil
+      }
+
+      existing = append(existing, dest)
+    }
+  }
+
+  if len(existing) == 0 {
+    return nil
+  }
+
+  return existing
+}
+
+// madeFrom reports whether the existing outputs are known to have been made
+// from the job's input: the ledger's entry for its content lists them, or
+// the encodes file has them for its path from after it was last modified
+func (e *encoder) madeFrom(j *Job, existing []string) bool {
+  j.mu.Lock()
+  key := j.ledgerKey
+  j.mu.Unlock()
+
+  if e.ledger != nil && key != "" && e.ledger.made(key, existing) {
+    return true
+  }
+
+  info, err := os.Stat(j.input)
+
+  return err == nil && e.encodes.made(j.input, info.ModTime(), existing)
+}
+
+// containsAll reports whether have has every one of want
+func containsAll(have []string, want []string) bool {
+  for _, w := range want {
+    if !slices.Contains(have, w) {
+      return false
+    }
+  }
+
+  return true
+}
+
+// moveFinished moves a working output into the finished directory applying
+// the collision policy, returning where the output now is and whether it
+// was moved there, not kept out for an existing one. names are the job's
+// reserved finished paths
+func (e *encoder) moveFinished(ctx context.Context, j *Job, working string, names map[string]string) (string, bool, error) {
+  dest := e.finishedPath(j, working)
+
+  if name, ok := names[working]; ok {
+    dest = name
+  }
+
+  if err := setOwnership(working, e.outputOwner, e.outputMode); err != nil {
+    return dest, false, fmt.Errorf("ownership: %s", err)
+  }
+
+  // a copy to another filesystem keeps the times
+  if err := e.setOutputTimes(j, working); err != nil {
+    return dest, false, fmt.Errorf("times: %s", err)
+  }
+
+  if _, err := os.Lstat(dest); err == nil {
+    switch e.collisions {
+    case CollisionSkip:
+      j.logger().Warn("Finished output exists, keeping it", "output", dest)
+      return dest, false, os.RemoveAll(working)
+    case CollisionSuffix:
+      dest = e.finishing.free(j, dest)
+    default:
+      j.logger().Warn("Overwriting finished output", "output", dest)
+      e.audit.deleting(j, dest, "overwritten")
+
+      // rename replaces files but not directories, like packages
+      if info, err := os.Lstat(dest); err == nil && info.IsDir() {
+        if err = os.RemoveAll(dest); err != nil {
+          return "", false, err
+        }
+      }
+    }
+  }
+
+  // a profile's destination may not be there yet
+  if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+    return dest, false, err
+  }
+
+  if err := e.deliver(ctx, j, working, dest); err != nil {
+    return dest, false, err
+  }
+
+  // but not the extended attributes, so they are copied once it is there
+  if e.outputXattrs {
+    if err := copyXattrs(j.input, dest); err != nil {
+      j.logger().Warn("Could not copy the input's extended attributes", "output", dest, "error", err)
+    }
+  }
+
+  e.audit.moved(j, working, dest, "finished")
+
+  return dest, true, nil
+}
+
+// finishing holds the finished paths the running jobs' outputs are going
+// to, so that jobs of inputs with the same name, like clip.mov and clip.mkv,
+// never move their outputs over each other however they are timed
+type finishing struct {
+  mu   sync.Mutex
+  held map[string]*Job
+}
+
+// reserve holds the finished path of each of the plan's outputs for j and
+// returns them by working path. A path another running job holds gets the
+// input's extension, clip-mov.mp4, so the name depends on the input and
+// not on which job got there first. An output already in the finished
+// directory is left to the collision policy
+func (f *finishing) reserve(j *Job, plan encodePlan, finishedPath func(string) string) map[string]string {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  if f.held == nil {
+    f.held = make(map[string]*Job)
+  }
+
+  names := make(map[string]string)
+
+  for _, run := range plan.runs {
+    for _, out := range run.outputs {
+      dest := finishedPath(out)
+
+      if other, ok := f.held[dest]; ok && other != j {
+        dest = f.freeLocked(j, withSuffix(dest, "-"+inputTag(j)))
+      }
+
+      f.held[dest] = j
+      names[out] = dest
+    }
+  }
+
+  return names
+}
+
+// free holds and returns path with the first -N suffix that is neither in
+// the finished directory nor held by a running job
+func (f *finishing) free(j *Job, path string) string {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  if f.held == nil {
+    f.held = make(map[string]*Job)
+  }
+
+  for n := 1; ; n++ {
+    candidate := withSuffix(path, fmt.Sprintf("-%d", n))
+
+    if _, held := f.held[candidate]; !held {
+      if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+        f.held[candidate] = j
+        return candidate
+      }
+    }
+  }
+}
+
+// freeLocked is path unless another job holds it, then path with the first
+// -N suffix no job holds
+func (f *finishing) freeLocked(j *Job, path string) string {
+  candidate := path
+
+  for n := 1; ; n++ {
+    if other, held := f.held[candidate]; !held || other == j {
+      return candidate
+    }
+
+    candidate = withSuffix(path, fmt.Sprintf("-%d", n))
+  }
+}
+
+// release lets go of the job's finished paths once its outputs are there
+func (f *finishing) release(j *Job) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+
+  for path, holder := range f.held {
+    if holder == j {
+      delete(f.held, path)
+    }
+  }
+}
+
+// withSuffix adds suffix to path's name before its extension
+func withSuffix(path string, suffix string) string {
+  ext := filepath.Ext(path)
+
+  return strings.TrimSuffix(path, ext) + suffix + ext
+}
+
+// inputTag tells apart inputs of the same name, by their extension or
+// else the job's ULID
+func inputTag(j *Job) string {
+  if ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(j.name), ".")); ext != "" {
+    return ext
+  }
+
+  return strings.ToLower(j.uid)
+}
@@ -0,0 +1,78 @@
+package watcher
+
+import (
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestMadeFrom(t *testing.T) {
+  dir := t.TempDir()
+  input := filepath.Join(dir, "clip.mov")
+  output := filepath.Join(dir, "finished", "clip.mp4")
+
+  if err := os.WriteFile(input, []byte("clip"), 0644); err != nil {
+    t.Fatal(err)
+  }
+
+  encodes := &encodeLog{path: filepath.Join(dir, encodesFile)}
+  e := &encoder{encodes: encodes}
+  j := &Job{input: input}
+
+  if e.madeFrom(j, []string{output}) {
+    t.Error("outputs with no record were taken for the input's")
+  }
+
+  // a record from before the input was last written is another file's
+  write := func(r encodeRecord) {
+    line, _ := json.Marshal(r)
+
+    if err := os.WriteFile(encodes.path, append(line, '\n'), 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  write(encodeRecord{Input: input, Outputs: []string{output}, EncodedAt: time.Now().Add(-time.Hour)})
+
+  if e.madeFrom(j, []string{output}) {
+    t.Error("a record older than the input was taken for the input's")
+  }
+
+  write(encodeRecord{Input: input, Outputs: []string{output}, EncodedAt: time.Now().Add(time.Minute)})
+
+  if !e.madeFrom(j, []string{output}) {
+    t.Error("the input's own record was not found")
+  }
+
+  if e.madeFrom(j, []string{output, filepath.Join(dir, "finished", "clip.webm")}) {
+    t.Error("a record missing an output was taken for the input's")
+  }
+
+  if e.madeFrom(&Job{input: filepath.Join(dir, "other.mov")}, []string{output}) {
+    t.Error("another input's record was taken for it")
+  }
+
+  l, err := OpenLedger(filepath.Join(dir, "ledger.jsonl"), LedgerHash)
+
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  key, _, err := l.lookup(input)
+
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if err = l.record(key, "/elsewhere/clip.mov", []string{output}); err != nil {
+    t.Fatal(err)
+  }
+
+  e = &encoder{ledger: l}
+
+  if !e.madeFrom(&Job{input: input, ledgerKey: key}, []string{output}) {
+    t.Error("the ledger's entry for the content was not found")
+  }
+}
@@ -0,0 +1,243 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// companionCheck is how often an input waiting for its companions looks
+// for them again
+const companionCheck = 5 * time.Second
+
+// defaultCompanionExtensions are the companions of an input when
+// Companions names none
+var defaultCompanionExtensions = []string{"srt", "xml", "jpg"}
+
+// Companions groups each input with the files delivered alongside it, named
+// like it with one of Extensions: movie.srt, movie.en.srt, movie.xml and
+// movie.jpg go with movie.mkv. A file with one of the extensions is never
+// queued itself. The companions are copied next to the first output in
+// finished, named after it, and go where the originals policy sends the
+// input, or with it to the failed directory. Hooks and steps get them in
+// GOWATCHER_COMPANIONS, a step can read one with {companion.EXT}
+type Companions struct {
+  // Extensions are the companions' extensions, default srt, xml and jpg
+  Extensions []string
+
+  // Wait holds an input until it has a companion with each extension, or
+  // until it has waited this long, e.g. for a delivery that always brings
+  // its .xml. Zero queues an input with the companions it has
+  Wait time.Duration
+}
+
+func (c *Companions) check() error {
+  if c.Wait < 0 {
+    return fmt.Errorf("wait must not be negative")
+  }
+
+  if len(c.Extensions) == 0 {
+    c.Extensions = defaultCompanionExtensions
+  }
+
+  extensions := make([]string, 0, len(c.Extensions))
+
+  for _, ext := range c.Extensions {
+    ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+
+    if ext == "" || strings.ContainsAny(ext, `./\`) {
+      return fmt.Errorf("%q is not an extension", ext)
+    }
+
+    extensions = append(extensions, ext)
+  }
+
+  c.Extensions = extensions
+
+  return nil
+}
+
+// companion reports whether path is named like a companion rather than an
+// input, false for a nil Companions
+func (c *Companions) companion(path string) bool {
+  if c == nil {
+    return false
+  }
+
+  ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+
+  for _, e := range c.Extensions {
+    if e == ext {
+      return true
+    }
+  }
+
+  return false
+}
+
+// companionStem is the part of the input's name its companions start with,
+// the whole name of a directory of frames
+func companionStem(input string) string {
+  name := filepath.Base(input)
+
+  if info, err := os.Stat(input); err == nil && info.IsDir() {
+    return name
+  }
+
+  return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// find returns the input's companions in its directory, sorted
+func (c *Companions) find(input string) []string {
+  if c == nil {
+    return nil
+  }
+
+  entries, err := os.ReadDir(filepath.Dir(input))
+
+  if err != nil {
+    return nil
+  }
+
+  prefix := companionStem(input) + "."
+  var found []string
+
+  for _, entry := range entries {
+    name := entry.Name()
+
+    if !entry.Type().IsRegular() || name == filepath.Base(input) || !strings.HasPrefix(name, prefix) || !c.companion(name) {
+      continue
+    }
+
+    found = append(found, filepath.Join(filepath.Dir(input), name))
+  }
+
+  sort.Strings(found)
+
+  return found
+}
+
+// missing are the extensions the input has no companion with
+func (c *Companions) missing(input string) []string {
+  have := make(map[string]bool)
+
+  for _, path := range c.find(input) {
+    have[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))] = true
+  }
+
+  var missing []string
+
+  for _, ext := range c.Extensions {
+    if !have[ext] {
+      missing = append(missing, ext)
+    }
+  }
+
+  return missing
+}
+
+// companionPath is where the companion of input goes when input goes to
+// dest: named after dest with what followed the input's name, movie.en.srt
+// of movie.mkv is out.en.srt next to out.mp4
+func companionPath(companion string, input string, dest string) string {
+  suffix := strings.TrimPrefix(filepath.Base(companion), companionStem(input))
+  name := filepath.Base(dest)
+
+  return filepath.Join(filepath.Dir(dest), strings.TrimSuffix(name, filepath.Ext(name))+suffix)
+}
+
+// moveCompanions moves the job's companions next to its input's new path,
+// dest, and the job keeps track of them there
+func moveCompanions(j *Job, input string, dest string) error {
+  j.mu.Lock()
+  companions := j.companions
+  j.mu.Unlock()
+
+  moved := make([]string, 0, len(companions))
+
+  for _, companion := range companions {
+    to := companionPath(companion, input, dest)
+
+    if err := moveFile(companion, to); err != nil {
+      return err
+    }
+
+    moved = append(moved, to)
+  }
+
+  j.mu.Lock()
+  j.companions = moved
+  j.mu.Unlock()
+
+  return nil
+}
+
+// copyCompanions copies the job's companions next to its first output in
+// finished, it returns the copies
+func (e *encoder) copyCompanions(j *Job, finished []string) []string {
+  j.mu.Lock()
+  companions, input := j.companions, j.input
+  j.mu.Unlock()
+
+  if len(companions) == 0 || len(finished) == 0 {
+    return nil
+  }
+
+  copies := make([]string, 0, len(companions))
+
+  for _, companion := range companions {
+    dest := companionPath(companion, input, finished[0])
+
+    if err := copyLocal(companion, dest); err != nil {
+      j.logger().Warn("Could not copy companion to finished", "companion", companion, "error", err)
+      continue
+    }
+
+    copies = append(copies, dest)
+  }
+
+  return copies
+}
+
+// isCompanion reports whether path is an input's companion, see Companions
+func (w *Watcher) isCompanion(path string) bool {
+  return w.cfg.Companions.companion(path)
+}
+
+// companionsReady reports whether a found input has its companions, or has
+// waited long enough for them, else it is checked again shortly
+func (w *Watcher) companionsReady(path string) bool {
+  c := w.cfg.Companions
+
+  if c == nil || c.Wait <= 0 {
+    return true
+  }
+
+  missing := c.missing(path)
+
+  if len(missing) == 0 {
+    w.awaiting.Delete(path)
+    return true
+  }
+
+  first, seen := w.awaiting.LoadOrStore(path, time.Now())
+  waited := time.Since(first.(time.Time))
+
+  if waited >= c.Wait {
+    w.awaiting.Delete(path)
+    slog.Warn("Queueing without all companions", "input", path, "missing", missing, "waited", c.Wait.String())
+    return true
+  }
+
+  if !seen {
+    slog.Info("Waiting for companions", "input", path, "missing", missing, "wait", c.Wait.String())
+  }
+
+  w.settleLater(path, min(c.Wait-waited, companionCheck))
+
+  return false
+}
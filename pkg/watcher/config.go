@@ -0,0 +1,913 @@
+package watcher
+
+import (
+  "fmt"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "gopkg.in/yaml.v3"
+)
+
+// fileConfig is the YAML (or JSON) document CONFIG_FILE points at, e.g.
+//
+//	profile: web
+//	profiles:
+//	  - name: web
+//	    input_flags: -hwaccel auto
+//	    extension: mp4
+//	    parallel: true
+//	    outputs:
+//	      - name: 1080p
+//	        suffix: -1080p
+//	        output_flags: -c:v libx264 -s:v 1920x1080 -c:a aac
+//	      - name: 720p
+//	        suffix: -720p
+//	        output_flags: [-c:v, libx264, -s:v, 1280x720, -c:a, aac]
+//
+// A profile with package: hls or package: dash writes a segmented package
+// per input instead, segment_duration sets the segment length in seconds and
+// each output's bandwidth/resolution/codecs are advertised in the HLS master
+// playlist, the resolution and codecs read from the segments when not set.
+// A dash package has a manifest.mpd switching between the outputs.
+//
+// A profile's output_flags apply to every output, each output's own flags
+// are added after them.
+//
+// hardware lists alternatives to input_flags/output_flags in order of
+// preference. At startup each encoder is test encoded and the first that
+// works is used, a job that fails with it is retried with the software flags:
+//
+//	hardware:
+//	  - encoder: h264_nvenc
+//	    input_flags: -hwaccel cuda
+//	    output_flags: -c:v h264_nvenc -cq 23 -c:a aac
+//	  - encoder: h264_vaapi
+//	    input_flags: -vaapi_device /dev/dri/renderD128
+//	    output_flags: -vf format=nv12,hwupload -c:v h264_vaapi -c:a aac
+//
+// output_name is a template for the output file names, e.g.
+// {basename}-{profile}-{date}.{ext}, see naming.go for the variables. Each
+// output of a profile with several needs a distinct name, so use
+// {rendition} or {suffix}. Packages are still named after the input.
+//
+// resource names the class the profile's software encodes count against
+// and each hardware entry's resource the class of its own, the top level
+// resources caps how many jobs of each class run at once across every root.
+// max_jobs caps the jobs encoding with the profile itself. When jobs of
+// several profiles wait at the same priority each gets a share of the jobs
+// that start by its weight, default 1, so a dump of files for one profile
+// does not hold up the others until it is done:
+//
+//	resources:
+//	  nvenc: 2
+//	  cpu: 4
+//	profiles:
+//	  - name: web
+//	    resource: cpu
+//	    max_jobs: 3
+//	    weight: 3
+//	    hardware:
+//	      - encoder: h264_nvenc
+//	        resource: nvenc
+//
+// deadline is how long after being queued a profile's jobs must be done.
+// A queued job is at risk once what is left is less than the profile's
+// jobs took on average in the last week plus deadline_warning, default a
+// quarter of the deadline: the handlers get a deadline_at_risk event and
+// the job goes ahead of those waiting at its priority. One not done in time
+// gets a deadline_missed event:
+//
+//	profiles:
+//	  - name: news
+//	    deadline: 4h
+//	    deadline_warning: 1h
+//
+// devices spreads a class's jobs over several GPUs instead of piling them
+// onto the first, each job is given the device with the fewest jobs that
+// has room, max_jobs caps each one, see ResourceDevice. A device is an
+// NVIDIA GPU's index or UUID, set as CUDA_VISIBLE_DEVICES, or a render node
+// passed with -hwaccel_device. Without a limit in resources the class is
+// limited to the sum of its devices' max_jobs:
+//
+//	devices:
+//	  nvenc:
+//	    - id: "0"
+//	      max_jobs: 2
+//	    - id: "1"
+//	      max_jobs: 2
+//	  vaapi: [/dev/dri/renderD128, /dev/dri/renderD129]
+//
+// ffmpeg_path runs the profile with another ffmpeg than FFMPEG_PATH or the
+// one on PATH, e.g. a nonfree build for libfdk_aac or a nightly for a new
+// filter. At startup and on reload the encoders, filters and muxers a
+// profile's flags name with -c:v, -vf, -f and the like are looked up in its
+// ffmpeg's -encoders, -filters and -muxers, and each output's flags encode
+// a moment of generated video and audio. A missing name or a failed test
+// encode stops the config from loading rather than failing every input:
+//
+//	profiles:
+//	  - name: podcast
+//	    ffmpeg_path: /opt/ffmpeg-nonfree/bin/ffmpeg
+//	    output_flags: -c:a libfdk_aac -vbr 4
+//
+// log_level is the profile's ffmpeg -loglevel in the job logs and
+// main_log_level what of it also goes to the main log, instead of
+// FFMPEG_LOGLEVEL and FFMPEG_MAIN_LOGLEVEL, e.g. debug while chasing a
+// broken source.
+//
+// env sets environment variables for the profile's ffmpeg, pipeline
+// commands and hooks, the values can use {slot}, the job's index in its
+// resource class, and the other flag variables that need no probe, e.g. to
+// pin each of two nvenc jobs to its own GPU:
+//
+//	resources:
+//	  nvenc: 2
+//	profiles:
+//	  - name: gpu
+//	    resource: nvenc
+//	    env:
+//	      CUDA_VISIBLE_DEVICES: "{slot}"
+//	      AV_LOG_FORCE_COLOR: "1"
+//
+// destination sends a profile's outputs somewhere of their own instead of
+// the finished directory and the upload: an absolute path they are moved
+// to, or a URL like FINISHED_URL's they are written to and then removed
+// from finished, so each kind of output lands where it is used:
+//
+//	profiles:
+//	  - name: proxy
+//	    destination: /mnt/editorial/proxies
+//	  - name: web
+//	    destination: s3://media-web/renditions
+//	  - name: archive
+//	    destination: sftp://tape@staging/ingest
+//
+// two_pass: true runs each output as a -pass 1 analysis to the null muxer
+// followed by the -pass 2 encode, the pass log lives in working until the
+// job is over. It does not apply to packaging profiles.
+//
+// split_length encodes inputs longer than it and split_above in pieces of
+// about that length, split_jobs (default 2) at a time, e.g. to spread a
+// four hour master over more cores than one encoder uses. Pieces are cut at
+// keyframes without audio, once encoded they are joined and the input's
+// audio is encoded in with the profile's audio flags, along with its
+// metadata and chapters. It does not apply to two_pass or packaging
+// profiles, or to trimmed jobs:
+//
+//	split_length: 5m
+//	split_above: 1h
+//	split_jobs: 4
+//
+// resume_segment encodes each output in segments of about that length
+// that survive a crash or a shutdown, so a long encode cut short carries on
+// after the last finished segment when the input is encoded again, rather
+// than starting over. Once the input is encoded the segments are joined
+// into the output. It does not apply to inputs that are split, trimmed or
+// still growing, and not to two_pass, parallel, packaging, steps or
+// loudnorm profiles, or burned in subtitles:
+//
+//	resume_segment: 5m
+//
+// loudnorm normalizes the audio to EBU R128 in two passes, measuring the
+// input's loudness first and then encoding with ffmpeg's loudnorm filter set
+// to the measured values. The filter is added to the profile's -af, so its
+// audio must be encoded rather than copied. target is the integrated
+// loudness in LUFS, true_peak in dBTP and range in LU, sample_rate what the
+// audio is resampled to afterwards. The defaults are the broadcast ones:
+//
+//	loudnorm:
+//	  target: -23
+//	  true_peak: -1
+//	  range: 7
+//	  sample_rate: 48000
+//
+// salvage tries an encode that failed on a corrupt input again, like a
+// field recording cut short, with input_flags (default -err_detect
+// ignore_err -fflags +discardcorrupt+genpts) ahead of the profile's. copy,
+// when that fails too, stream copies the input's video and audio into the
+// first output. A failure counts as a corrupt input when ffmpeg's output
+// has one of errors, by default decoding and demuxing errors like "error
+// while decoding" or "Invalid NAL unit". The job is done but degraded, the
+// outputs get a degraded metadata tag:
+//
+//	salvage:
+//	  copy: true
+//	  errors: ["error while decoding", "Invalid data found when processing input"]
+//
+// audio_only leaves the video out of a profile's outputs, or of one output,
+// for music, podcasts or extracting a soundtrack. Without an extension the
+// file is named for the audio codec, m4a for aac, mp3, flac, opus, ogg for
+// vorbis and wav for pcm, or mka. audio_derivative adds an audio-only output
+// with its flags next to the video ones, -audio is added to its name if it
+// could otherwise be theirs:
+//
+//   - name: podcast
+//     audio_only: true
+//     output_flags: -c:a libmp3lame -b:a 96k -ac 1
+//   - name: episode
+//     output_flags: -c:v libx264 -crf 22 -c:a aac
+//     audio_derivative: -c:a libmp3lame -b:a 128k
+//
+// deinterlace auto runs ffmpeg's idet over the start of each input and
+// filters only the video that needs it: interlaced inputs are deinterlaced
+// with deinterlace_filter, yadif or bwdif, for the field order idet found,
+// telecined ones inverse telecined with fieldmatch and decimate. Progressive
+// inputs are left alone, the filters go ahead of the profile's own -vf.
+// A pre-flight's idet is reused, see Preflight. It needs ffprobe:
+//
+//	deinterlace: auto
+//	deinterlace_filter: bwdif
+//
+// watermark overlays an image on the video at a position, top-left,
+// top-right, bottom-left, bottom-right (the default) or center, margin pixels
+// from the edges. opacity goes from 0 to 1, scale sizes it to a fraction of
+// the video's width or width to pixels. The profile's and outputs' own -vf
+// run first, in the same filtergraph:
+//
+//	watermark:
+//	  image: /etc/gowatcher/logo.png
+//	  position: top-right
+//	  opacity: 0.6
+//	  scale: 0.12
+//
+// metadata preserve copies the input's container metadata and chapters,
+// tags are set on every output with output name variables in their values,
+// encode_date sets creation_time, encoder_tag encoded_by=gowatcher and
+// job_tag gowatcher_job to the job's ULID. probe_report writes ffprobe's JSON report of each output next to it in
+// finished as name.mp4.json, for catalogs:
+//
+//	metadata:
+//	  preserve: true
+//	  tags:
+//	    title: "{basename}"
+//	    comment: Encoded for the archive
+//	  encode_date: true
+//	  encoder_tag: true
+//	  job_tag: true
+//	  probe_report: true
+//
+// subtitles is copy to keep every subtitle stream alongside all the video
+// and audio, drop to leave them out, burn to draw subtitle_stream (counting
+// from 0) into the video, or extract to write each text stream to a .srt in
+// finished named after the output and its language. Left out, ffmpeg keeps
+// at most one:
+//
+//	subtitles: burn
+//	subtitle_stream: 1
+//
+// steps replace a profile's encode with a chain of commands run in turn as
+// one job, see pipeline.go for the variables. output names each step's file
+// in working, keep moves it to finished with the job's outputs and capture
+// saves the command's stdout or stderr as the file:
+//
+//	steps:
+//	  - name: loudness
+//	    command: "{ffmpeg} -i {input} -af loudnorm=print_format=json -f null -"
+//	    output: "{basename}.loudnorm.txt"
+//	    capture: stderr
+//	  - name: encode
+//	    command: [normalize.sh, "{input}", "{output.loudness}", "{output}"]
+//	    output: "{basename}.mp4"
+//	    keep: true
+//	    validate: true
+//	  - name: thumbnail
+//	    command: "{ffmpeg} -i {output.encode} -ss 10 -frames:v 1 {output}"
+//	    output: "{basename}.jpg"
+//	    keep: true
+//	  - name: checksum
+//	    command: sha256sum {output.encode}
+//	    output: "{basename}.mp4.sha256"
+//	    capture: stdout
+//	    keep: true
+//
+// command runs any program on each input instead of ffmpeg, with the step
+// variables. The output name template or {basename}.{ext} names its
+// {output}, which is not validated. ffmpeg is not needed when no profile
+// runs it:
+//
+//	command: [HandBrakeCLI, -i, "{input}", -o, "{output}", --preset, Fast 1080p30]
+//
+// Flags may be written as a single string, split on whitespace like the
+// FFMPEG_*_FLAGS variables, or as a list when an argument contains spaces.
+// They can use the input's probed {width}, {height}, {fps}, {duration} and
+// the like, with one operator and a constant, see flagvars.go:
+//
+//	output_flags: -vf scale={width/2}:-2 -g {fps*2} -maxrate {bitrate*0.8}
+//
+// routes pick the profile from what ffprobe finds in each input, the first
+// whose when holds wins. The conditions are joined by && and compare fields
+// like height, vcodec, container, duration or audio_only, see Route:
+//
+//	routes:
+//	  - when: height > 1080
+//	    profile: uhd-downscale
+//	  - when: vcodec == hevc && container == mp4
+//	    profile: remux
+//	  - when: audio_only
+//	    profile: podcast
+//
+// extends makes a profile start from the settings of another, or of a
+// list of them, and replace or add to what it inherits. A key ending in +
+// appends to the inherited list instead of replacing it, mappings like
+// metadata are merged key by key. An abstract profile is only there to be
+// extended, it cannot be selected itself:
+//
+//	profiles:
+//	  - name: delivery-base
+//	    abstract: true
+//	    input_flags: -hwaccel auto
+//	    output_flags: -c:v libx264 -preset slow -c:a aac -b:a 192k
+//	    extension: mp4
+//	    metadata:
+//	      encode_date: true
+//	  - name: broadcaster-a
+//	    extends: delivery-base
+//	    output_flags+: -b:v 8M -maxrate 8M -bufsize 16M
+//	    metadata:
+//	      tags:
+//	        comment: Broadcaster A
+//	  - name: broadcaster-a-proxy
+//	    extends: broadcaster-a
+//	    output_flags+: -s:v 640x360
+//	    output_name: "{basename}-proxy.{ext}"
+//
+// include reads other config files, one path or a list, relative to the
+// file including them and with globs, e.g. one file per delivery spec. Their
+// profiles, routes and roots are added before the file's own, which can
+// extend them, and the file's other settings win over theirs:
+//
+//	include:
+//	  - base-profiles.yml
+//	  - deliveries/*.yml
+//
+// workers, include_extensions and exclude_globs set the same as the
+// environment variables, which win when both are set:
+//
+//	workers: 2
+//	include_extensions: [mkv, mov, mp4]
+//	exclude_globs: ["*.part"]
+//
+// roots runs several independent trees in one process, each with its own
+// directories and optionally its own profile, workers and filters. Anything
+// a root leaves out is the top level's setting:
+//
+//	roots:
+//	  - name: video
+//	    base_dir: /srv/video
+//	    profile: web
+//	    workers: 2
+//	  - name: podcasts
+//	    base_dir: /srv/podcasts
+//	    finished_dir: /mnt/nas/podcasts
+//	    profile: audio
+//	    include_extensions: [wav, flac]
+type fileConfig struct {
+  Profile           string                      `yaml:"profile"`
+  Profiles          []profileConfig             `yaml:"profiles"`
+  Workers           int                         `yaml:"workers"`
+  IncludeExtensions []string                    `yaml:"include_extensions"`
+  ExcludeGlobs      []string                    `yaml:"exclude_globs"`
+  Roots             []Root                      `yaml:"roots"`
+  Resources         map[string]int              `yaml:"resources"`
+  Devices           map[string][]ResourceDevice `yaml:"devices"`
+  Routes            []routeConfig               `yaml:"routes"`
+}
+
+type routeConfig struct {
+  When    string `yaml:"when"`
+  Profile string `yaml:"profile"`
+}
+
+// ConfigFile is what a config file sets, see fileConfig for the format
+type ConfigFile struct {
+  // Profiles by name, Profile is the one the file selects or empty
+  Profiles map[string]*Profile
+  Profile  string
+
+  // Workers is zero and the lists empty when the file leaves them out
+  Workers           int
+  IncludeExtensions []string
+  ExcludeGlobs      []string
+
+  // Roots are the trees to watch instead of BASE_DIR, empty for one
+  Roots []Root
+
+  // Resources are the limits per resource class, Devices the devices of
+  // the classes spread over several
+  Resources map[string]int
+  Devices   map[string][]ResourceDevice
+
+  // Routes pick profiles by what ffprobe finds in the input
+  Routes []Route
+}
+
+// Root is one of the trees a config file's roots list. Name defaults to
+// the base directory's name, the other directories to the ones under it
+type Root struct {
+  Name         string `yaml:"name"`
+  BaseDir      string `yaml:"base_dir"`
+  QueueDir     string `yaml:"queue_dir"`
+  WorkingDir   string `yaml:"working_dir"`
+  FinishedDir  string `yaml:"finished_dir"`
+  OriginalsDir string `yaml:"originals_dir"`
+  FailedDir    string `yaml:"failed_dir"`
+
+  // Profile, Workers and the filters are the file's when empty
+  Profile           string   `yaml:"profile"`
+  Workers           int      `yaml:"workers"`
+  IncludeExtensions []string `yaml:"include_extensions"`
+  ExcludeGlobs      []string `yaml:"exclude_globs"`
+}
+
+// Apply returns a copy of cfg for the root: its directories replace cfg's,
+// its profile must be one of cfg.Profiles
+func (r Root) Apply(cfg Config) (Config, error) {
+  cfg.Name = r.Name
+  cfg.BaseDir = r.BaseDir
+  cfg.QueueDir = r.QueueDir
+  cfg.WorkingDir = r.WorkingDir
+  cfg.FinishedDir = r.FinishedDir
+  cfg.OriginalsDir = r.OriginalsDir
+  cfg.FailedDir = r.FailedDir
+
+  // two roots sharing a ledger file would rewrite each other's entries
+  cfg.LedgerFile = ""
+
+  if cfg.Remote != nil {
+    return cfg, fmt.Errorf("root %s: roots cannot share a remote directory, they would download the same files", r.Name)
+  }
+
+  if cfg.Stream != nil {
+    return cfg, fmt.Errorf("root %s: roots cannot share a Redis stream consumer", r.Name)
+  }
+
+  if r.Profile != "" {
+    p, ok := cfg.Profiles[r.Profile]
+
+    if !ok {
+      return cfg, fmt.Errorf("root %s: profile %q is not defined", r.Name, r.Profile)
+    }
+
+    cfg.Profile = p
+  }
+
+  if r.Workers > 0 {
+    cfg.Workers = r.Workers
+  }
+
+  if len(r.IncludeExtensions) > 0 {
+    cfg.IncludeExtensions = r.IncludeExtensions
+  }
+
+  if len(r.ExcludeGlobs) > 0 {
+    cfg.ExcludeGlobs = r.ExcludeGlobs
+  }
+
+  return cfg, nil
+}
+
+type profileConfig struct {
+  Name             string            `yaml:"name"`
+  InputFlags       flagList          `yaml:"input_flags"`
+  OutputFlags      flagList          `yaml:"output_flags"`
+  Extension        string            `yaml:"extension"`
+  OutputName       string            `yaml:"output_name"`
+  RemuxVideoCodecs []string          `yaml:"remux_video_codecs"`
+  RemuxAudioCodecs []string          `yaml:"remux_audio_codecs"`
+  Parallel         bool              `yaml:"parallel"`
+  Outputs          []renditionConfig `yaml:"outputs"`
+  Package          string            `yaml:"package"`
+  SegmentDuration  int               `yaml:"segment_duration"`
+  SplitLength      time.Duration     `yaml:"split_length"`
+  SplitAbove       time.Duration     `yaml:"split_above"`
+  SplitJobs        int               `yaml:"split_jobs"`
+  ResumeSegment    time.Duration     `yaml:"resume_segment"`
+  Steps            []stepConfig      `yaml:"steps"`
+  Command          flagList          `yaml:"command"`
+  TwoPass          bool              `yaml:"two_pass"`
+  AudioOnly        bool              `yaml:"audio_only"`
+  AudioDerivative  flagList          `yaml:"audio_derivative"`
+  Deinterlace      string            `yaml:"deinterlace"`
+  Deinterlacer     string            `yaml:"deinterlace_filter"`
+  Watermark        *watermarkConfig  `yaml:"watermark"`
+  Metadata         *metadataConfig   `yaml:"metadata"`
+  Subtitles        string            `yaml:"subtitles"`
+  SubtitleStream   int               `yaml:"subtitle_stream"`
+  Loudnorm         *loudnormConfig   `yaml:"loudnorm"`
+  Salvage          *salvageConfig    `yaml:"salvage"`
+  Hardware         []hardwareConfig  `yaml:"hardware"`
+  Resource         string            `yaml:"resource"`
+  MaxJobs          int               `yaml:"max_jobs"`
+  Weight           int               `yaml:"weight"`
+  Deadline         time.Duration     `yaml:"deadline"`
+  DeadlineWarning  time.Duration     `yaml:"deadline_warning"`
+  FFmpegPath       string            `yaml:"ffmpeg_path"`
+  LogLevel         string            `yaml:"log_level"`
+  MainLogLevel     string            `yaml:"main_log_level"`
+  Env              map[string]string `yaml:"env"`
+  Destination      string            `yaml:"destination"`
+}
+
+type watermarkConfig struct {
+  Image    string  `yaml:"image"`
+  Position string  `yaml:"position"`
+  Margin   int     `yaml:"margin"`
+  Opacity  float64 `yaml:"opacity"`
+  Scale    float64 `yaml:"scale"`
+  Width    int     `yaml:"width"`
+}
+
+type metadataConfig struct {
+  Preserve    bool              `yaml:"preserve"`
+  Tags        map[string]string `yaml:"tags"`
+  EncodeDate  bool              `yaml:"encode_date"`
+  EncoderTag  bool              `yaml:"encoder_tag"`
+  JobTag      bool              `yaml:"job_tag"`
+  ProbeReport bool              `yaml:"probe_report"`
+}
+
+type loudnormConfig struct {
+  Target     float64 `yaml:"target"`
+  TruePeak   float64 `yaml:"true_peak"`
+  Range      float64 `yaml:"range"`
+  SampleRate int     `yaml:"sample_rate"`
+}
+
+type salvageConfig struct {
+  Errors     []string `yaml:"errors"`
+  InputFlags flagList `yaml:"input_flags"`
+  Copy       bool     `yaml:"copy"`
+}
+
+type stepConfig struct {
+  Name     string   `yaml:"name"`
+  Command  flagList `yaml:"command"`
+  Output   string   `yaml:"output"`
+  Keep     bool     `yaml:"keep"`
+  Capture  string   `yaml:"capture"`
+  Validate bool     `yaml:"validate"`
+}
+
+type hardwareConfig struct {
+  Encoder     string   `yaml:"encoder"`
+  InputFlags  flagList `yaml:"input_flags"`
+  OutputFlags flagList `yaml:"output_flags"`
+  Resource    string   `yaml:"resource"`
+}
+
+type renditionConfig struct {
+  Name        string   `yaml:"name"`
+  Suffix      string   `yaml:"suffix"`
+  OutputFlags flagList `yaml:"output_flags"`
+  Extension   string   `yaml:"extension"`
+  Bandwidth   int64    `yaml:"bandwidth"`
+  Resolution  string   `yaml:"resolution"`
+  Codecs      string   `yaml:"codecs"`
+  AudioOnly   bool     `yaml:"audio_only"`
+}
+
+// flagList accepts either a whitespace separated string or a list of strings
+type flagList []string
+
+func (f *flagList) UnmarshalYAML(node *yaml.Node) error {
+  if node.Kind == yaml.ScalarNode {
+    *f = strings.Fields(node.Value)
+    return nil
+  }
+
+  var list []string
+
+  if err := node.Decode(&list); err != nil {
+    return err
+  }
+
+  *f = list
+
+  return nil
+}
+
+// UnmarshalYAML accepts a device as its ID alone or as id and max_jobs
+func (d *ResourceDevice) UnmarshalYAML(node *yaml.Node) error {
+  if node.Kind == yaml.ScalarNode {
+    *d = ResourceDevice{ID: node.Value}
+    return nil
+  }
+
+  type plain ResourceDevice
+
+  return node.Decode((*plain)(d))
+}
+
+// LoadConfigFile reads a YAML or JSON config file, returning its profiles by name and the
+// name of the profile it selects
+func LoadConfigFile(path string) (map[string]*Profile, string, error) {
+  cf, err := ReadConfigFile(path)
+
+  if err != nil {
+    return nil, "", err
+  }
+
+  return cf.Profiles, cf.Profile, nil
+}
+
+// ReadConfigFile reads a YAML or JSON config file
+func ReadConfigFile(path string) (*ConfigFile, error) {
+  node, err := readConfigNode(path, make(map[string]bool))
+
+  if err != nil {
+    return nil, err
+  }
+
+  if err = resolveProfiles(node); err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  var cfg fileConfig
+
+  if err := node.Decode(&cfg); err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  if cfg.Workers < 0 {
+    return nil, fmt.Errorf("config %s: workers must be a positive number", path)
+  }
+
+  for class, limit := range cfg.Resources {
+    if limit < 0 {
+      return nil, fmt.Errorf("config %s: resource %s: the limit must be a positive number", path, class)
+    }
+  }
+
+  if err := checkDevices(cfg.Devices); err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  profiles := make(map[string]*Profile)
+
+  for _, pc := range cfg.Profiles {
+    p, err := pc.profile()
+
+    if err != nil {
+      return nil, fmt.Errorf("config %s: %s", path, err)
+    }
+
+    if _, exists := profiles[p.Name]; exists {
+      return nil, fmt.Errorf("config %s: profile %q is defined twice", path, p.Name)
+    }
+
+    profiles[p.Name] = p
+  }
+
+  var routes []Route
+
+  for i, rc := range cfg.Routes {
+    if _, err := parseWhen(rc.When); err != nil {
+      return nil, fmt.Errorf("config %s: route %d: %s", path, i+1, err)
+    }
+
+    routes = append(routes, Route{When: rc.When, Profile: rc.Profile})
+  }
+
+  names := make(map[string]bool)
+
+  for i := range cfg.Roots {
+    r := &cfg.Roots[i]
+
+    if r.BaseDir == "" {
+      return nil, fmt.Errorf("config %s: root %d has no base_dir", path, i+1)
+    }
+
+    if r.Name == "" {
+      r.Name = filepath.Base(filepath.Clean(r.BaseDir))
+    }
+
+    if strings.ContainsAny(r.Name, `/\`) {
+      return nil, fmt.Errorf("config %s: root name %q must not contain a slash", path, r.Name)
+    }
+
+    if names[r.Name] {
+      return nil, fmt.Errorf("config %s: root %q is defined twice", path, r.Name)
+    }
+
+    if r.Workers < 0 {
+      return nil, fmt.Errorf("config %s: root %s: workers must be a positive number", path, r.Name)
+    }
+
+    names[r.Name] = true
+  }
+
+  return &ConfigFile{
+    Roots:             cfg.Roots,
+    Profiles:          profiles,
+    Profile:           cfg.Profile,
+    Workers:           cfg.Workers,
+    IncludeExtensions: cfg.IncludeExtensions,
+    ExcludeGlobs:      cfg.ExcludeGlobs,
+    Resources:         cfg.Resources,
+    Devices:           cfg.Devices,
+    Routes:            routes,
+  }, nil
+}
+
+// profile validates the config and converts it to a profile
+func (pc profileConfig) profile() (*Profile, error) {
+  if pc.Name == "" {
+    return nil, fmt.Errorf("every profile needs a name")
+  }
+
+  p := &Profile{
+    Name:             pc.Name,
+    InputFlags:       pc.InputFlags,
+    OutputFlags:      pc.OutputFlags,
+    Extension:        pc.Extension,
+    NameTemplate:     pc.OutputName,
+    RemuxVideoCodecs: pc.RemuxVideoCodecs,
+    RemuxAudioCodecs: pc.RemuxAudioCodecs,
+    Parallel:         pc.Parallel,
+    Packaging:        pc.Package,
+    SegmentDuration:  pc.SegmentDuration,
+    SplitLength:      pc.SplitLength,
+    SplitAbove:       pc.SplitAbove,
+    SplitJobs:        pc.SplitJobs,
+    ResumeSegment:    pc.ResumeSegment,
+    Command:          pc.Command,
+    TwoPass:          pc.TwoPass,
+    AudioOnly:        pc.AudioOnly,
+    AudioDerivative:  pc.AudioDerivative,
+    Deinterlace:      pc.Deinterlace,
+    Deinterlacer:     pc.Deinterlacer,
+    Subtitles:        SubtitleMode(pc.Subtitles),
+    SubtitleStream:   pc.SubtitleStream,
+    Resource:         pc.Resource,
+    MaxJobs:          pc.MaxJobs,
+    Weight:           pc.Weight,
+    Deadline:         pc.Deadline,
+    DeadlineWarning:  pc.DeadlineWarning,
+    FFmpegPath:       pc.FFmpegPath,
+    LogLevel:         pc.LogLevel,
+    MainLogLevel:     pc.MainLogLevel,
+    Env:              pc.Env,
+    Destination:      pc.Destination,
+  }
+
+  if err := checkEnv(p.Env); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  if err := p.checkDestination(); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  if p.MaxJobs < 0 {
+    return nil, fmt.Errorf("profile %q: max_jobs must be a positive number", pc.Name)
+  }
+
+  for _, level := range []string{p.LogLevel, p.MainLogLevel} {
+    if err := checkLogLevel(level); err != nil {
+      return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+    }
+  }
+
+  if p.Weight < 0 {
+    return nil, fmt.Errorf("profile %q: weight must be a positive number", pc.Name)
+  }
+
+  if p.Deadline < 0 || p.DeadlineWarning < 0 {
+    return nil, fmt.Errorf("profile %q: deadline and deadline_warning must not be negative", pc.Name)
+  }
+
+  if wc := pc.Watermark; wc != nil {
+    p.Watermark = &Watermark{
+      Image:    wc.Image,
+      Position: wc.Position,
+      Margin:   wc.Margin,
+      Opacity:  wc.Opacity,
+      Scale:    wc.Scale,
+      Width:    wc.Width,
+    }
+
+    if err := p.Watermark.check(); err != nil {
+      return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+    }
+  }
+
+  if mc := pc.Metadata; mc != nil {
+    p.Metadata = &Metadata{
+      Preserve:    mc.Preserve,
+      Tags:        mc.Tags,
+      EncodeDate:  mc.EncodeDate,
+      EncoderTag:  mc.EncoderTag,
+      JobTag:      mc.JobTag,
+      ProbeReport: mc.ProbeReport,
+    }
+
+    if err := p.Metadata.checkTags(); err != nil {
+      return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+    }
+  }
+
+  if lc := pc.Loudnorm; lc != nil {
+    p.Loudnorm = &Loudnorm{Target: lc.Target, TruePeak: lc.TruePeak, Range: lc.Range, SampleRate: lc.SampleRate}
+
+    if err := p.Loudnorm.check(); err != nil {
+      return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+    }
+  }
+
+  if sc := pc.Salvage; sc != nil {
+    p.Salvage = &Salvage{Errors: sc.Errors, InputFlags: sc.InputFlags, Copy: sc.Copy}
+  }
+
+  if err := p.checkSplit(); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  if err := p.checkResume(); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  for _, hc := range pc.Hardware {
+    if hc.Encoder == "" {
+      return nil, fmt.Errorf("profile %q: hardware entries need an encoder", pc.Name)
+    }
+
+    p.Hardware = append(p.Hardware, HWVariant{
+      Encoder:     hc.Encoder,
+      InputFlags:  hc.InputFlags,
+      OutputFlags: hc.OutputFlags,
+      Resource:    hc.Resource,
+    })
+  }
+
+  if err := checkNameTemplate(p.NameTemplate); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  if p.Packaging != "" && p.Packaging != "hls" && p.Packaging != "dash" {
+    return nil, fmt.Errorf("profile %q: package must be hls or dash", pc.Name)
+  }
+
+  // renditions land in the same directory so their names must differ
+  names := make(map[string]bool)
+
+  for i, rc := range pc.Outputs {
+    r := Rendition{
+      Name:        rc.Name,
+      Suffix:      rc.Suffix,
+      OutputFlags: rc.OutputFlags,
+      Extension:   rc.Extension,
+      Bandwidth:   rc.Bandwidth,
+      Resolution:  rc.Resolution,
+      Codecs:      rc.Codecs,
+      AudioOnly:   rc.AudioOnly,
+    }
+
+    if r.Name == "" {
+      r.Name = fmt.Sprintf("%s-%d", pc.Name, i+1)
+    }
+
+    // packages put each rendition in a folder named after it
+    name := p.outputName("input.ext", p.output(r), nil, time.Time{})
+
+    if p.Packaging != "" {
+      name = r.Name
+    }
+
+    if names[name] {
+      if p.Packaging != "" {
+        return nil, fmt.Errorf("profile %q: outputs need distinct names", pc.Name)
+      }
+
+      return nil, fmt.Errorf("profile %q: outputs need distinct suffixes or extensions, or an output_name using {rendition}", pc.Name)
+    }
+
+    names[name] = true
+    p.Renditions = append(p.Renditions, r)
+  }
+
+  for _, sc := range pc.Steps {
+    p.Steps = append(p.Steps, Step{
+      Name:     sc.Name,
+      Command:  sc.Command,
+      Output:   sc.Output,
+      Keep:     sc.Keep,
+      Capture:  sc.Capture,
+      Validate: sc.Validate,
+    })
+  }
+
+  if err := p.checkSteps(); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  if err := p.checkSubtitles(); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  if err := p.checkAudio(); err != nil {
+    return nil, fmt.Errorf("profile %q: %s", pc.Name, err)
+  }
+
+  return p, nil
+}
@@ -0,0 +1,31 @@
+package watcher
+
+import (
+  "embed"
+  "io/fs"
+  "net/http"
+)
+
+// dashboardFiles is the web UI, a static page that polls the API
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboard serves the web UI under /ui/ and sends / there. The redirect
+// is relative so it works under a root's prefix too
+func dashboard() (ui http.Handler, index http.HandlerFunc) {
+  files, _ := fs.Sub(dashboardFiles, "dashboard")
+  ui = http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+
+  index = func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+      writeError(w, http.StatusNotFound, "not found")
+      return
+    }
+
+    w.Header().Set("Location", "ui/")
+    w.WriteHeader(http.StatusFound)
+  }
+
+  return ui, index
+}
@@ -0,0 +1,315 @@
+// The dashboard polls the API it is served next to, the page is at ui/ so
+// the endpoints are in the parent, under a root's prefix too
+"use strict";
+
+const api = "../";
+const maxWaiting = 20;
+const maxFailures = 10;
+const logLines = 30;
+
+// call sends the API_TOKEN changes need, asking for it the first time one
+// is turned away, and keeps it for the tab
+async function call(method, path) {
+  const headers = {};
+  const token = sessionStorage.getItem("token");
+
+  if (token) {
+    headers.Authorization = "Bearer " + token;
+  }
+
+  const resp = await fetch(api + path, {method, headers});
+
+  if (resp.status === 401) {
+    const entered = prompt("API token");
+
+    if (entered) {
+      sessionStorage.setItem("token", entered);
+      return call(method, path);
+    }
+  }
+
+  const body = resp.headers.get("Content-Type") === "application/json" ? await resp.json() : await resp.text();
+
+  if (!resp.ok) {
+    throw new Error(body.error || resp.statusText);
+  }
+
+  return body;
+}
+
+function showError(err) {
+  document.getElementById("error").textContent = err ? err.message : "";
+}
+
+function name(job) {
+  return job.input.split(/[\\/]/).pop();
+}
+
+function duration(seconds) {
+  seconds = Math.round(seconds);
+
+  if (seconds < 60) {
+    return seconds + "s";
+  }
+
+  if (seconds < 3600) {
+    return Math.floor(seconds / 60) + "m " + (seconds % 60) + "s";
+  }
+
+  return Math.floor(seconds / 3600) + "h " + Math.floor(seconds % 3600 / 60) + "m";
+}
+
+// render keeps one element per job so open logs stay open between polls
+function render(listId, jobs, fill) {
+  const list = document.getElementById(listId);
+  const existing = new Map([...list.children].map((li) => [li.dataset.id, li]));
+
+  document.getElementById(listId + "-empty").hidden = jobs.length > 0;
+
+  jobs.forEach((job, i) => {
+    let li = existing.get(String(job.id));
+
+    if (!li) {
+      li = document.getElementById("job").content.firstElementChild.cloneNode(true);
+      li.dataset.id = job.id;
+      li.querySelector("details").addEventListener("toggle", (ev) => {
+        if (ev.target.open) {
+          loadLog(job.id, li);
+        }
+      });
+    }
+
+    existing.delete(String(job.id));
+    li.querySelector(".name").textContent = name(job);
+    li.querySelector(".name").title = job.input;
+    fill(job, li);
+
+    if (list.children[i] !== li) {
+      list.insertBefore(li, list.children[i] || null);
+    }
+  });
+
+  existing.forEach((li) => li.remove());
+}
+
+async function loadLog(id, li) {
+  const pre = li.querySelector("pre");
+
+  try {
+    const text = await call("GET", "jobs/" + id + "/log");
+    pre.textContent = text.trimEnd().split("\n").slice(-logLines).join("\n") || "No output";
+  } catch (err) {
+    pre.textContent = err.message;
+  }
+}
+
+function action(li, label, path) {
+  const button = li.querySelector(".action");
+  button.textContent = label;
+  button.onclick = async () => {
+    button.disabled = true;
+
+    try {
+      await call("POST", path);
+      showError(null);
+      await refresh();
+    } catch (err) {
+      showError(err);
+    } finally {
+      button.disabled = false;
+    }
+  };
+}
+
+function fillActive(job, li) {
+  const parts = [job.profile];
+
+  if (job.percent !== undefined) {
+    parts.push(job.percent.toFixed(1) + "%");
+  }
+
+  if (job.eta_seconds !== undefined) {
+    parts.push(duration(job.eta_seconds) + " left");
+  }
+
+  li.querySelector(".detail").textContent = parts.join(" · ");
+  li.querySelector(".bar").hidden = false;
+  li.querySelector(".bar div").style.width = (job.percent || 0) + "%";
+  li.querySelector(".reason").hidden = true;
+  li.querySelector("details").hidden = false;
+  action(li, "Cancel", "jobs/" + job.id + "/cancel");
+
+  const details = li.querySelector("details");
+
+  if (details.open) {
+    loadLog(job.id, li);
+  }
+}
+
+function fillWaiting(job, li) {
+  li.querySelector(".detail").textContent = job.profile + " · since " + new Date(job.queued_at).toLocaleTimeString();
+  li.querySelector(".bar").hidden = true;
+  li.querySelector(".reason").hidden = true;
+  li.querySelector("details").hidden = true;
+  action(li, "Cancel", "jobs/" + job.id + "/cancel");
+}
+
+function fillFailure(job, li) {
+  li.querySelector(".detail").textContent = job.finished_at ? new Date(job.finished_at).toLocaleString() : "";
+  li.querySelector(".bar").hidden = true;
+  li.querySelector(".reason").hidden = false;
+  li.querySelector(".reason").textContent = job.error || "";
+  li.querySelector("details").hidden = false;
+  action(li, "Retry", "jobs/" + job.id + "/requeue");
+}
+
+// approvals is null while approval is off
+async function approvals() {
+  try {
+    return await call("GET", "pending");
+  } catch (err) {
+    if (err.message === "approval is off") {
+      return null;
+    }
+
+    throw err;
+  }
+}
+
+function size(bytes) {
+  const units = ["B", "K", "M", "G", "T"];
+  let i = 0;
+
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+
+  return (i ? bytes.toFixed(1) : bytes) + units[i];
+}
+
+async function decide(path, params) {
+  await call("POST", "pending/" + params + (params.includes("?") ? "&" : "?") + "path=" + encodeURIComponent(path));
+}
+
+// renderPending keeps one element per file so a profile being chosen stays
+// chosen between polls
+function renderPending(view) {
+  document.getElementById("approval").hidden = view === null;
+
+  if (view === null) {
+    return;
+  }
+
+  const list = document.getElementById("pending");
+  const existing = new Map([...list.children].map((li) => [li.dataset.path, li]));
+
+  document.getElementById("pending-empty").hidden = view.pending.length > 0;
+
+  view.pending.forEach((file, i) => {
+    let li = existing.get(file.path);
+
+    if (!li) {
+      li = document.getElementById("pending-file").content.firstElementChild.cloneNode(true);
+      li.dataset.path = file.path;
+
+      const select = li.querySelector(".profile");
+
+      for (const profile of file.spec ? [file.profile] : view.profiles) {
+        select.add(new Option(profile, profile, false, profile === file.profile));
+      }
+
+      select.disabled = file.spec;
+
+      const buttons = li.querySelectorAll("button");
+      // params is null when the rejection was called off
+      const click = (params) => async () => {
+        const query = params();
+
+        if (query === null) {
+          return;
+        }
+
+        buttons.forEach((b) => (b.disabled = true));
+
+        try {
+          await decide(file.path, query);
+          showError(null);
+          await refresh();
+        } catch (err) {
+          showError(err);
+        } finally {
+          buttons.forEach((b) => (b.disabled = false));
+        }
+      };
+
+      li.querySelector(".approve").onclick = click(() => "approve?profile=" + encodeURIComponent(select.value));
+      li.querySelector(".reject").onclick = click(() => {
+        const reason = prompt("Why is " + file.name + " rejected?", "");
+        return reason === null ? null : "reject?reason=" + encodeURIComponent(reason);
+      });
+    }
+
+    existing.delete(file.path);
+    li.querySelector(".name").textContent = file.name;
+    li.querySelector(".name").title = file.path;
+    li.querySelector(".detail").textContent = size(file.size) + " · since " + new Date(file.found_at).toLocaleTimeString();
+
+    if (list.children[i] !== li) {
+      list.insertBefore(li, list.children[i] || null);
+    }
+  });
+
+  existing.forEach((li) => li.remove());
+}
+
+async function refresh() {
+  const [status, queued, failed, pending] = await Promise.all([
+    call("GET", "status"),
+    call("GET", "jobs?state=queued"),
+    call("GET", "jobs?state=failed"),
+    approvals(),
+  ]);
+
+  const state = document.getElementById("state");
+  state.textContent = status.paused ? "Paused" : status.outside_schedule ? "Outside schedule" : "Running";
+  state.classList.toggle("paused", status.paused || status.outside_schedule);
+  document.getElementById("pause").disabled = status.paused;
+  document.getElementById("resume").disabled = !status.paused;
+
+  document.getElementById("queued").textContent = status.queued;
+
+  for (const s of ["running", "done", "failed", "cancelled"]) {
+    document.getElementById(s).textContent = status.counts[s] || 0;
+  }
+
+  renderPending(pending);
+  render("active", status.active, fillActive);
+  render("waiting", queued.slice(0, maxWaiting), fillWaiting);
+  render("failures", failed.reverse().slice(0, maxFailures), fillFailure);
+}
+
+for (const id of ["pause", "resume"]) {
+  document.getElementById(id).onclick = async () => {
+    try {
+      await call("POST", id);
+      showError(null);
+      await refresh();
+    } catch (err) {
+      showError(err);
+    }
+  };
+}
+
+async function poll() {
+  try {
+    await refresh();
+    showError(null);
+  } catch (err) {
+    showError(err);
+  }
+
+  setTimeout(poll, 2000);
+}
+
+poll();
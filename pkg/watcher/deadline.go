@@ -0,0 +1,147 @@
+package watcher
+
+import (
+  "fmt"
+  "time"
+)
+
+const (
+  // deadlineCheck is how often the jobs are checked against their deadlines
+  deadlineCheck = 30 * time.Second
+
+  // deadlineHistory is how far back the history is looked at for how long
+  // a profile's jobs take
+  deadlineHistory = 7 * 24 * time.Hour
+)
+
+// deadline is when the job must be done by, zero when its profile has no
+// deadline. It counts from when the job was first queued, a requeue keeps it
+func (j *Job) deadline() time.Time {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.profile.Deadline <= 0 {
+    return time.Time{}
+  }
+
+  return j.arrivedAt.Add(j.profile.Deadline)
+}
+
+// deadlineWarning is how long before the deadline a job is at risk, on top
+// of how long the profile's jobs take
+func (p *Profile) deadlineWarning() time.Duration {
+  if p.DeadlineWarning > 0 {
+    return p.DeadlineWarning
+  }
+
+  return p.Deadline / 4
+}
+
+// watchDeadlines checks the jobs of the profiles with a Deadline until stop
+// is closed. A queued job is at risk once less is left than its profile's
+// jobs took on average in the last week plus the warning: it is logged,
+// the handlers get a "deadline_at_risk" event and it is raised a priority
+// ahead of the jobs waiting with it. A job still not done at its deadline,
+// or done after it, gets a "deadline_missed" event. Each is told once
+func (w *Watcher) watchDeadlines(stop <-chan struct{}) {
+  ticker := time.NewTicker(deadlineCheck)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+
+    w.checkDeadlines(time.Now())
+  }
+}
+
+func (w *Watcher) checkDeadlines(now time.Time) {
+  var took map[string]time.Duration
+
+  for _, j := range w.store.list("") {
+    due := j.deadline()
+
+    if due.IsZero() {
+      continue
+    }
+
+    j.mu.Lock()
+    state, finishedAt, profile := j.state, j.finishedAt, j.profile
+    atRisk, missed := j.atRisk, j.missedDeadline
+    j.mu.Unlock()
+
+    switch {
+    case missed || state == JobCancelled:
+    case state.Finished() && finishedAt.After(due), !state.Finished() && now.After(due):
+      j.mu.Lock()
+      j.missedDeadline = true
+      j.mu.Unlock()
+
+      late := now.Sub(due)
+
+      if state.Finished() {
+        late = finishedAt.Sub(due)
+      }
+
+      j.logger().Error("Job missed its deadline", "deadline", due.Format(time.RFC3339), "state", string(state), "late", late.Round(time.Second).String())
+      w.deadlineEvent(j, "deadline_missed", due, fmt.Sprintf("%s by %s, %s", due.Format(time.RFC3339), late.Round(time.Second), state))
+    case atRisk || state != JobQueued:
+    default:
+      if took == nil {
+        took = w.averageTook()
+      }
+
+      left := due.Sub(now)
+
+      if left > took[profile.Name]+profile.deadlineWarning() {
+        continue
+      }
+
+      j.mu.Lock()
+      j.atRisk = true
+      j.mu.Unlock()
+
+      priority, raised := w.queue.raise(j)
+
+      j.logger().Warn("Job at risk of missing its deadline", "deadline", due.Format(time.RFC3339), "left", left.Round(time.Second).String(), "takes", took[profile.Name].Round(time.Second).String(), "priority", priority, "raised", raised)
+      w.deadlineEvent(j, "deadline_at_risk", due, fmt.Sprintf("%s, %s left, still queued", due.Format(time.RFC3339), left.Round(time.Second)))
+    }
+  }
+}
+
+// averageTook is how long each profile's jobs took from starting to done
+// on average in the last deadlineHistory
+func (w *Watcher) averageTook() map[string]time.Duration {
+  summaries := make(map[string]*StatsSummary)
+
+  for _, s := range w.enc.history.since(time.Now().Add(-deadlineHistory)) {
+    if summaries[s.Profile] == nil {
+      summaries[s.Profile] = &StatsSummary{}
+    }
+
+    summaries[s.Profile].add(s)
+  }
+
+  took := make(map[string]time.Duration, len(summaries))
+
+  for name, s := range summaries {
+    s.finish()
+    took[name] = time.Duration(s.AvgWallSeconds * float64(time.Second))
+  }
+
+  return took
+}
+
+// deadlineEvent tells the handlers about the job's deadline
+func (w *Watcher) deadlineEvent(j *Job, event string, due time.Time, message string) {
+  j.mu.Lock()
+  ev := JobEvent{Event: event, JobID: j.id, JobUID: j.uid, Input: j.input, Deadline: &due, Error: message}
+  j.mu.Unlock()
+
+  for _, h := range w.enc.handlers {
+    h.HandleEvent(ev)
+  }
+}
@@ -0,0 +1,272 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "runtime"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  defaultDeferralInterval = time.Minute
+
+  // powerSupplyDir and thermalDir are where Linux tells about the
+  // batteries and how hot the machine is
+  powerSupplyDir = "/sys/class/power_supply"
+  thermalDir     = "/sys/class/thermal"
+)
+
+// Deferral holds the jobs that are not urgent while encoding would cost too
+// much, power from the grid when it is dear or a battery running down, and
+// starts them once that clears. Jobs of high priority, from the priority
+// folder, with the priority prefix or raised for a deadline at risk, start
+// anyway and running encodes are left alone. Each rule is checked every
+// Interval, default 1m, and any that says so defers
+type Deferral struct {
+  // Command is run to ask whether to defer: exiting 0 lets the jobs start,
+  // exiting 1 defers them, the first line it prints saying why. It can ask
+  // an electricity price API, or a UPS with upsc. A check that fails or
+  // takes longer than Interval leaves the jobs as they were
+  Command  []string
+  Interval time.Duration
+
+  // MinBattery defers while the machine runs on a battery charged less
+  // than this percentage, MaxTemperature while a thermal zone is hotter in
+  // °C. Linux only
+  MinBattery     int
+  MaxTemperature float64
+}
+
+func (d *Deferral) check() error {
+  if len(d.Command) == 0 && d.MinBattery <= 0 && d.MaxTemperature <= 0 {
+    return errors.New("no command, battery or temperature to defer on")
+  }
+
+  if (d.MinBattery > 0 || d.MaxTemperature > 0) && runtime.GOOS != "linux" {
+    return fmt.Errorf("the battery and temperature are only read on Linux, not %s", runtime.GOOS)
+  }
+
+  if d.MinBattery > 100 {
+    return fmt.Errorf("the battery cannot be charged %d%%", d.MinBattery)
+  }
+
+  return nil
+}
+
+// deferReason is why jobs should be deferred, "" when they should not. An
+// error is a rule that could not be checked
+func (d *Deferral) deferReason(ctx context.Context) (string, error) {
+  var errs []error
+
+  if len(d.Command) > 0 {
+    reason, err := d.ask(ctx)
+
+    if err == nil && reason != "" {
+      return reason, nil
+    }
+
+    if err != nil {
+      errs = append(errs, err)
+    }
+  }
+
+  if d.MinBattery > 0 {
+    charge, discharging, err := readBattery()
+
+    switch {
+    case err != nil:
+      errs = append(errs, err)
+    case discharging && charge < d.MinBattery:
+      return fmt.Sprintf("on battery at %d%%, below %d%%", charge, d.MinBattery), nil
+    }
+  }
+
+  if d.MaxTemperature > 0 {
+    zone, temperature, err := readTemperature()
+
+    switch {
+    case err != nil:
+      errs = append(errs, err)
+    case temperature > d.MaxTemperature:
+      return fmt.Sprintf("%s is at %.1f°C, above %g°C", zone, temperature, d.MaxTemperature), nil
+    }
+  }
+
+  return "", errors.Join(errs...)
+}
+
+// ask runs Command, see Deferral
+func (d *Deferral) ask(ctx context.Context) (string, error) {
+  var stdout, stderr bytes.Buffer
+
+  cmd := exec.CommandContext(ctx, d.Command[0], d.Command[1:]...)
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+
+  err := cmd.Run()
+
+  var exitErr *exec.ExitError
+
+  switch {
+  case err == nil:
+    return "", nil
+  case ctx.Err() == context.DeadlineExceeded:
+    return "", errors.New("the deferral command timed out")
+  case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+    reason, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+
+    if reason == "" {
+      reason = "the deferral command says so"
+    }
+
+    return reason, nil
+  }
+
+  if message := strings.TrimSpace(stderr.String()); message != "" {
+    return "", fmt.Errorf("the deferral command: %s: %s", err, lastLine([]byte(message)))
+  }
+
+  return "", fmt.Errorf("the deferral command: %s", err)
+}
+
+// readBattery is the charge of the least charged battery, and whether any
+// is discharging
+func readBattery() (int, bool, error) {
+  entries, err := os.ReadDir(powerSupplyDir)
+
+  if err != nil {
+    return 0, false, err
+  }
+
+  charge, found, discharging := 100, false, false
+
+  for _, entry := range entries {
+    dir := filepath.Join(powerSupplyDir, entry.Name())
+
+    if kind, _ := os.ReadFile(filepath.Join(dir, "type")); strings.TrimSpace(string(kind)) != "Battery" {
+      continue
+    }
+
+    capacity, err := os.ReadFile(filepath.Join(dir, "capacity"))
+
+    if err != nil {
+      continue
+    }
+
+    percent, err := strconv.Atoi(strings.TrimSpace(string(capacity)))
+
+    if err != nil {
+      continue
+    }
+
+    found = true
+    charge = min(charge, percent)
+
+    if status, _ := os.ReadFile(filepath.Join(dir, "status")); strings.TrimSpace(string(status)) == "Discharging" {
+      discharging = true
+    }
+  }
+
+  if !found {
+    return 0, false, fmt.Errorf("no battery in %s", powerSupplyDir)
+  }
+
+  return charge, discharging, nil
+}
+
+// readTemperature is the hottest thermal zone and how hot it is in °C
+func readTemperature() (string, float64, error) {
+  zones, _ := filepath.Glob(filepath.Join(thermalDir, "thermal_zone*"))
+
+  hottest, found := 0.0, ""
+
+  for _, zone := range zones {
+    data, err := os.ReadFile(filepath.Join(zone, "temp"))
+
+    if err != nil {
+      continue
+    }
+
+    // millidegrees
+    milli, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+    if err != nil {
+      continue
+    }
+
+    name := filepath.Base(zone)
+
+    if kind, err := os.ReadFile(filepath.Join(zone, "type")); err == nil {
+      name = strings.TrimSpace(string(kind))
+    }
+
+    if t := float64(milli) / 1000; found == "" || t > hottest {
+      hottest, found = t, name
+    }
+  }
+
+  if found == "" {
+    return "", 0, fmt.Errorf("no thermal zone in %s", thermalDir)
+  }
+
+  return found, hottest, nil
+}
+
+// followDeferral defers the jobs that are not urgent while the Deferral
+// says so, until stop is closed
+func (w *Watcher) followDeferral(stop <-chan struct{}) {
+  d := w.cfg.Deferral
+  interval := d.Interval
+
+  if interval <= 0 {
+    interval = defaultDeferralInterval
+  }
+
+  apply := func() {
+    ctx, cancel := context.WithTimeout(context.Background(), interval)
+    defer cancel()
+
+    reason, err := d.deferReason(ctx)
+
+    // what could not be checked may still defer, it stays as it was
+    if err != nil {
+      slog.Warn("Could not check whether to defer jobs", "error", err)
+
+      if reason == "" {
+        return
+      }
+    }
+
+    if w.queue.setDeferred(reason) {
+      if reason == "" {
+        slog.Info("Starting deferred jobs")
+      } else {
+        slog.Info("Deferring jobs that are not urgent", "reason", reason)
+      }
+    }
+  }
+
+  apply()
+
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        apply()
+      case <-stop:
+        return
+      }
+    }
+  }()
+}
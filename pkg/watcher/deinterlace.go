@@ -0,0 +1,120 @@
+package watcher
+
+import (
+  "fmt"
+  "slices"
+)
+
+// DeinterlaceAuto finds out with idet whether each input is interlaced or
+// telecined, and filters only the ones that are. Progressive inputs are
+// encoded as they are, always-on deinterlacing softens them
+const DeinterlaceAuto = "auto"
+
+// checkDeinterlace rejects a Deinterlace or Deinterlacer gowatcher
+// does not know
+func (p *Profile) checkDeinterlace() error {
+  if p.Deinterlace != "" && p.Deinterlace != DeinterlaceAuto {
+    return fmt.Errorf("deinterlace must be auto")
+  }
+
+  switch p.Deinterlacer {
+  case "", "yadif", "bwdif":
+  default:
+    return fmt.Errorf("deinterlace_filter must be yadif or bwdif")
+  }
+
+  return nil
+}
+
+// deinterlaceFilters are the filters the profile may add, for checkFFmpeg
+func (p *Profile) deinterlaceFilters() []string {
+  if p.Deinterlace == "" {
+    return nil
+  }
+
+  return []string{"idet", p.deinterlaceWith(), "fieldmatch", "decimate"}
+}
+
+// deinterlaceWith is the Deinterlacer, yadif by default
+func (p *Profile) deinterlaceWith() string {
+  if p.Deinterlacer == "" {
+    return "yadif"
+  }
+
+  return p.Deinterlacer
+}
+
+// deinterlaceFilter is the filter chain the probed input needs: fieldmatch
+// and decimate to undo a telecine, with the deinterlacer cleaning up the
+// frames fieldmatch could not match, or the deinterlacer on its own for
+// the field order idet found. "" for a progressive input, or one idet did
+// not look at
+func (p *Profile) deinterlaceFilter(probed *probeResult) string {
+  if p.Deinterlace != DeinterlaceAuto || probed == nil || probed.interlace == nil {
+    return ""
+  }
+
+  idet := probed.interlace
+
+  switch {
+  case idet.Telecined:
+    return fmt.Sprintf("fieldmatch,%s=deint=interlaced,decimate", p.deinterlaceWith())
+  case idet.Interlaced && idet.FieldOrder == "bb":
+    return p.deinterlaceWith() + "=parity=bff"
+  case idet.Interlaced:
+    return p.deinterlaceWith() + "=parity=tff"
+  }
+
+  return ""
+}
+
+// detectScan runs idet for a profile that deinterlaces when it needs to,
+// unless the job's pre-flight already did. An input idet cannot read is
+// encoded as it is
+func (e *encoder) detectScan(j *Job, file string, probed *probeResult) {
+  if j.profile.Deinterlace != DeinterlaceAuto || probed == nil || len(probed.videoStreams()) == 0 {
+    return
+  }
+
+  j.mu.Lock()
+  last := j.probed
+  j.mu.Unlock()
+
+  if last != nil && last.interlace != nil {
+    probed.interlace = last.interlace
+  } else {
+    frames := defaultIdetFrames
+
+    if e.preflight != nil && e.preflight.IdetFrames > 0 {
+      frames = e.preflight.IdetFrames
+    }
+
+    idet, err := e.detectInterlace(j, file, frames)
+
+    if err != nil {
+      j.logger().Warn("Could not detect interlacing, encoding the video as it is", "error", err)
+      return
+    }
+
+    probed.interlace = idet
+  }
+
+  if filter := j.profile.deinterlaceFilter(probed); filter != "" {
+    j.logger().Info("Deinterlacing", "filter", filter, "telecined", probed.interlace.Telecined, "field_order", probed.interlace.FieldOrder)
+  }
+}
+
+// withDeinterlace puts filter ahead of the flags' last video filters, or
+// adds it as -vf
+func withDeinterlace(flags []string, filter string) []string {
+  out := append([]string(nil), flags...)
+
+  for i := len(out) - 2; i >= 0; i-- {
+    if slices.Contains(videoFilterFlags, out[i]) {
+      out[i+1] = filter + "," + out[i+1]
+      return out
+    }
+  }
+
+  return append(out, "-vf", filter)
+}
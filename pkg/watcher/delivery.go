@@ -0,0 +1,336 @@
+package watcher
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "log/slog"
+  "sync"
+  "time"
+)
+
+// Delivery paces and reports the copies that take outputs off the box:
+// moving them into a finished directory on another filesystem, like a
+// network mount, and uploading them to S3 or with rclone
+type Delivery struct {
+  // Bandwidth is the bytes per second all deliveries share, zero is no
+  // limit. rclone gets it as --bwlimit for each upload on its own
+  Bandwidth int64
+
+  // Resume is how long an interrupted delivery keeps picking up where it
+  // stopped, retrying with backoff, before the job fails. The clock starts
+  // over whenever bytes move again. Default 10 minutes
+  Resume time.Duration
+
+  // Progress is how often a delivery logs how far it has got, default a
+  // minute
+  Progress time.Duration
+}
+
+// delivery defaults, and the reads a limited delivery is paced in
+const (
+  defaultDeliveryResume   = 10 * time.Minute
+  defaultDeliveryProgress = time.Minute
+  deliveryChunk           = 64 << 10
+)
+
+// deliverer holds what the deliveries share
+type deliverer struct {
+  limit    *rateLimit
+  resume   time.Duration
+  progress time.Duration
+}
+
+func newDeliverer(cfg Delivery) (*deliverer, error) {
+  if cfg.Bandwidth < 0 || cfg.Resume < 0 || cfg.Progress < 0 {
+    return nil, errors.New("bandwidth, resume and progress must not be negative")
+  }
+
+  d := &deliverer{resume: cfg.Resume, progress: cfg.Progress}
+
+  if d.resume == 0 {
+    d.resume = defaultDeliveryResume
+  }
+
+  if d.progress == 0 {
+    d.progress = defaultDeliveryProgress
+  }
+
+  if cfg.Bandwidth > 0 {
+    d.limit = &rateLimit{rate: float64(cfg.Bandwidth)}
+  }
+
+  return d, nil
+}
+
+// rateLimit paces bytes to a rate. next is when the bytes let through so
+// far are sent at the rate, an idle limit lets a second's worth go at once
+type rateLimit struct {
+  mu   sync.Mutex
+  rate float64
+  next time.Time
+}
+
+// wait blocks until n more bytes may go
+func (l *rateLimit) wait(ctx context.Context, n int) error {
+  if l == nil {
+    return nil
+  }
+
+  l.mu.Lock()
+  now := time.Now()
+
+  if burst := now.Add(-time.Second); l.next.Before(burst) {
+    l.next = burst
+  }
+
+  l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+  delay := l.next.Sub(now)
+  l.mu.Unlock()
+
+  if delay <= 0 {
+    return nil
+  }
+
+  timer := time.NewTimer(delay)
+  defer timer.Stop()
+
+  select {
+  case <-timer.C:
+    return nil
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+}
+
+// transfer is one output on its way. It paces its reads to the shared
+// limit, logs its progress and retries what failed. A nil transfer does
+// none of it
+type transfer struct {
+  ctx    context.Context
+  d      *deliverer
+  logger *slog.Logger
+  output string
+  to     string
+  size   int64
+
+  mu        sync.Mutex
+  startedAt time.Time
+  moved     time.Time
+  logged    time.Time
+
+  // done is the bytes of the files sent in full, at how far into the
+  // current one and sent what actually went for the rate
+  done int64
+  at   int64
+  sent int64
+}
+
+// start begins delivering size bytes of output to to
+func (d *deliverer) start(ctx context.Context, logger *slog.Logger, output string, to string, size int64) *transfer {
+  if d == nil {
+    return nil
+  }
+
+  now := time.Now()
+
+  return &transfer{ctx: ctx, d: d, logger: logger, output: output, to: to, size: size, startedAt: now, moved: now, logged: now}
+}
+
+// advance records n bytes read up to pos in the current file
+func (t *transfer) advance(pos int64, n int) error {
+  if err := t.d.limit.wait(t.ctx, n); err != nil {
+    return err
+  }
+
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  // a retried request reads the same bytes again
+  t.at = max(t.at, pos)
+  t.sent += int64(n)
+  t.moved = time.Now()
+
+  if t.moved.Sub(t.logged) >= t.d.progress {
+    t.logged = t.moved
+    t.log()
+  }
+
+  return nil
+}
+
+func (t *transfer) log() {
+  done := t.done + t.at
+  rate := float64(t.sent) / time.Since(t.startedAt).Seconds()
+  args := []any{"output", t.output, "to", t.to, "sent", FormatSize(done), "rate", FormatSize(int64(rate)) + "/s"}
+
+  if t.size > 0 {
+    args = append(args, "size", FormatSize(t.size), "percent", min(100, done*100/t.size))
+  }
+
+  if rate > 0 && done < t.size {
+    args = append(args, "eta", time.Duration(float64(t.size-done)/rate*float64(time.Second)).Round(time.Second).String())
+  }
+
+  t.logger.Info("Delivering", args...)
+}
+
+// alive records bytes moving without counting them, for a copy another
+// program makes
+func (t *transfer) alive() {
+  t.mu.Lock()
+  t.moved = time.Now()
+  t.mu.Unlock()
+}
+
+// fileDone moves on to the next file of a package
+func (t *transfer) fileDone(size int64) {
+  if t == nil {
+    return
+  }
+
+  t.mu.Lock()
+  t.done += size
+  t.at = 0
+  t.mu.Unlock()
+}
+
+// restart goes back to the first file, for a copy that runs through the
+// files again and skips those already there
+func (t *transfer) restart() {
+  if t == nil {
+    return
+  }
+
+  t.mu.Lock()
+  t.done, t.at = 0, 0
+  t.mu.Unlock()
+}
+
+// reader paces r, which starts offset bytes into the current file
+func (t *transfer) reader(r io.Reader, offset int64) io.Reader {
+  if t == nil {
+    return r
+  }
+
+  return &transferReader{t: t, r: r, pos: offset}
+}
+
+// readerAt paces reads of the current file at any offset
+func (t *transfer) readerAt(r io.ReaderAt) io.ReaderAt {
+  if t == nil {
+    return r
+  }
+
+  return &transferReaderAt{t: t, r: r}
+}
+
+type transferReader struct {
+  t   *transfer
+  r   io.Reader
+  pos int64
+}
+
+func (r *transferReader) Read(p []byte) (int, error) {
+  // small reads keep a limited pace even
+  if r.t.d.limit != nil && len(p) > deliveryChunk {
+    p = p[:deliveryChunk]
+  }
+
+  n, err := r.r.Read(p)
+
+  if n > 0 {
+    r.pos += int64(n)
+
+    if waitErr := r.t.advance(r.pos, n); waitErr != nil {
+      return n, waitErr
+    }
+  }
+
+  return n, err
+}
+
+type transferReaderAt struct {
+  t *transfer
+  r io.ReaderAt
+}
+
+// ReadAt fills p a chunk at a time, a short read must come with an error
+func (r *transferReaderAt) ReadAt(p []byte, off int64) (int, error) {
+  var read int
+
+  for read < len(p) {
+    chunk := p[read:]
+
+    if r.t.d.limit != nil && len(chunk) > deliveryChunk {
+      chunk = chunk[:deliveryChunk]
+    }
+
+    n, err := r.r.ReadAt(chunk, off+int64(read))
+    read += n
+
+    if n > 0 {
+      if waitErr := r.t.advance(off+int64(read), n); waitErr != nil {
+        return read, waitErr
+      }
+    }
+
+    if err != nil {
+      return read, err
+    }
+  }
+
+  return read, nil
+}
+
+// permanentError is a delivery failure retrying cannot fix, like a refused
+// request
+type permanentError struct {
+  error
+}
+
+func (e permanentError) Unwrap() error {
+  return e.error
+}
+
+// retry runs attempt until it succeeds, fails for good, or has not moved a
+// byte for the resume window. attempt picks up where the last one stopped
+func (t *transfer) retry(attempt func() error) error {
+  if t == nil {
+    return attempt()
+  }
+
+  for wait := time.Second; ; wait = min(2*wait, time.Minute) {
+    err := attempt()
+
+    if err == nil || t.ctx.Err() != nil || !resumable(err) {
+      return err
+    }
+
+    t.mu.Lock()
+    stalled := time.Since(t.moved)
+    at := t.done + t.at
+    t.mu.Unlock()
+
+    if stalled+wait > t.d.resume {
+      return fmt.Errorf("%s, gave up resuming after %s", err, stalled.Round(time.Second))
+    }
+
+    t.logger.Warn("Delivery interrupted, resuming", "output", t.output, "to", t.to, "at", FormatSize(at), "error", err, "in", wait.String())
+
+    select {
+    case <-time.After(wait):
+    case <-t.ctx.Done():
+      return t.ctx.Err()
+    }
+  }
+}
+
+// resumable reports whether a delivery might get past err by trying again
+func resumable(err error) bool {
+  var permanent permanentError
+
+  return !errors.As(err, &permanent) && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,143 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "log/slog"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "runtime"
+  "time"
+)
+
+// Desktop configures a DesktopNotifier
+type Desktop struct {
+  // Completions also notifies of every job that finishes, failures and a
+  // stuck or full queue always are
+  Completions bool
+}
+
+// desktopTimeout bounds a notification command that hangs, like
+// notify-send without a notification daemon
+const desktopTimeout = 10 * time.Second
+
+// windowsToast shows a toast with the title and body in GOWATCHER_TITLE and
+// GOWATCHER_BODY, as PowerShell so it needs no app of its own registered
+const windowsToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$toast = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $toast.GetElementsByTagName('text')
+$text.Item(0).AppendChild($toast.CreateTextNode($env:GOWATCHER_TITLE)) > $null
+$text.Item(1).AppendChild($toast.CreateTextNode($env:GOWATCHER_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe').Show([Windows.UI.Notifications.ToastNotification]::new($toast))`
+
+// DesktopNotifier shows job events as notifications on the desktop of the
+// user gowatcher runs as, for a workstation attended while it encodes.
+// macOS uses osascript, Windows a PowerShell toast and anything else
+// notify-send, which needs the desktop session's D-Bus
+type DesktopNotifier struct {
+  cfg     Desktop
+  command string
+}
+
+func NewDesktopNotifier(cfg Desktop) (*DesktopNotifier, error) {
+  command := "notify-send"
+
+  switch runtime.GOOS {
+  case "darwin":
+    command = "osascript"
+  case "windows":
+    command = "powershell"
+  }
+
+  path, err := exec.LookPath(command)
+
+  if err != nil {
+    return nil, fmt.Errorf("desktop notifications need %s: %s", command, err)
+  }
+
+  return &DesktopNotifier{cfg: cfg, command: path}, nil
+}
+
+// HandleEvent shows failures, stuck and full queues, deadlines at risk and
+// missed and, with Completions, finished jobs in the background
+func (n *DesktopNotifier) HandleEvent(ev JobEvent) {
+  if ev.Event == "finished" && !n.cfg.Completions {
+    return
+  }
+
+  title, body := desktopMessage(ev)
+
+  go func() {
+    if err := n.show(title, body, ev.Event != "finished"); err != nil {
+      slog.Error("Desktop notification failed", "event", ev.Event, "job", ev.JobID, "error", err)
+    }
+  }()
+}
+
+// desktopMessage is the event as a title and a line, finished ones name
+// the output so it can be found
+func desktopMessage(ev JobEvent) (string, string) {
+  name := filepath.Base(ev.Input)
+  took := (time.Duration(ev.DurationSeconds) * time.Second).String()
+
+  switch ev.Event {
+  case "finished":
+    if ev.Output == "" {
+      return "Encoded " + name, "in " + took
+    }
+
+    return "Encoded " + name, fmt.Sprintf("%s is ready, took %s", ev.Output, took)
+  case "stuck":
+    return "Queue stuck", fmt.Sprintf("%d waiting, %s", ev.Queued, ev.Error)
+  case "queue_full":
+    return "Queue full", fmt.Sprintf("%d waiting, %s", ev.Queued, ev.Error)
+  case "intake_paused":
+    return "Intake paused", fmt.Sprintf("%d waiting, %s", ev.Queued, ev.Error)
+  case "queue_aging":
+    return "Queue aging", fmt.Sprintf("%d waiting, %s", ev.Queued, ev.Error)
+  case "backlog_growing":
+    return "Backlog growing", fmt.Sprintf("%d waiting, %s", ev.Queued, ev.Error)
+  case "deadline_at_risk":
+    return name + " may miss its deadline", "Due " + ev.Error
+  case "deadline_missed":
+    return name + " missed its deadline", "Due " + ev.Error
+  default:
+    return "Failed to encode " + name, ev.Error
+  }
+}
+
+// show runs the platform's notification command, the texts are passed as
+// arguments or environment so nothing in them is taken as a script
+func (n *DesktopNotifier) show(title string, body string, urgent bool) error {
+  ctx, cancel := context.WithTimeout(context.Background(), desktopTimeout)
+  defer cancel()
+
+  var cmd *exec.Cmd
+
+  switch runtime.GOOS {
+  case "darwin":
+    cmd = exec.CommandContext(ctx, n.command,
+      "-e", "on run argv",
+      "-e", "display notification (item 2 of argv) with title \"gowatcher\" subtitle (item 1 of argv)",
+      "-e", "end run",
+      title, body)
+  case "windows":
+    cmd = exec.CommandContext(ctx, n.command, "-NoProfile", "-NonInteractive", "-Command", windowsToast)
+    cmd.Env = append(os.Environ(), "GOWATCHER_TITLE="+title, "GOWATCHER_BODY="+body)
+  default:
+    urgency := "normal"
+
+    if urgent {
+      urgency = "critical"
+    }
+
+    cmd = exec.CommandContext(ctx, n.command, "--app-name=gowatcher", "--urgency="+urgency, "--", title, body)
+  }
+
+  if out, err := cmd.CombinedOutput(); err != nil {
+    return fmt.Errorf("%s: %s", err, lastLine(out))
+  }
+
+  return nil
+}
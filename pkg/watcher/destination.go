@@ -0,0 +1,91 @@
+package watcher
+
+import (
+  "fmt"
+  "net/url"
+  "path/filepath"
+)
+
+// checkDestination rejects a Destination that is neither an absolute path
+// nor a URL OpenStorage opens
+func (p *Profile) checkDestination() error {
+  if p.Destination == "" || !p.remoteDestination() {
+    if p.Destination != "" && !filepath.IsAbs(p.Destination) {
+      return fmt.Errorf("destination %q must be an absolute path or a URL", p.Destination)
+    }
+
+    return nil
+  }
+
+  u, err := url.Parse(p.Destination)
+
+  if err != nil {
+    return fmt.Errorf("destination: %s", err)
+  }
+
+  switch u.Scheme {
+  case "file", "s3", "ftp", "ftps", "sftp":
+  default:
+    return fmt.Errorf("destination %q: use a path, file://, s3://, sftp://, ftp:// or ftps://", redactedURL(u))
+  }
+
+  if u.Scheme != "file" && u.Host == "" {
+    return fmt.Errorf("destination %q has no host or bucket", redactedURL(u))
+  }
+
+  return nil
+}
+
+// remoteDestination reports whether the Destination is a URL rather than
+// a path, C:\ included
+func (p *Profile) remoteDestination() bool {
+  u, err := url.Parse(p.Destination)
+
+  return err == nil && len(u.Scheme) > 1
+}
+
+// outputDir is where the job's outputs are moved to once encoded: its
+// profile's Destination when that is a local directory, else the finished
+// directory
+func (e *encoder) outputDir(j *Job) string {
+  j.mu.Lock()
+  p := j.profile
+  j.mu.Unlock()
+
+  if p.Destination != "" && !p.remoteDestination() {
+    return p.Destination
+  }
+
+  return e.finishedDir
+}
+
+// destination is where the job's outputs are uploaded from the finished
+// directory and whether they are removed from it then: its profile's
+// remote Destination, which does not keep them, nothing for a local one,
+// else the watcher's upload. Each URL's Storage is opened once
+func (e *encoder) destination(j *Job) (destination, bool, error) {
+  j.mu.Lock()
+  p := j.profile
+  j.mu.Unlock()
+
+  switch {
+  case p.Destination == "":
+    return e.upload, e.deleteLocal, nil
+  case !p.remoteDestination():
+    return nil, false, nil
+  }
+
+  if d, ok := e.destinations.Load(p.Destination); ok {
+    return d.(destination), true, nil
+  }
+
+  storage, err := OpenStorage(p.Destination, e.destinationOpts)
+
+  if err != nil {
+    return nil, false, fmt.Errorf("destination: %s", err)
+  }
+
+  d, _ := e.destinations.LoadOrStore(p.Destination, storageUpload{storage: storage})
+
+  return d.(destination), true, nil
+}
@@ -0,0 +1,151 @@
+package watcher
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// diskCheckInterval is how often a job waiting for disk space checks again
+const diskCheckInterval = 30 * time.Second
+
+// SpaceThreshold is the free space the working and finished volumes need
+// before an encode starts, either a number of bytes or a multiple of the
+// input's size. The zero value disables the check
+type SpaceThreshold struct {
+  Bytes         int64
+  InputMultiple float64
+}
+
+// ParseSpaceThreshold parses a size like 500M, 20G or 1T, or a multiple of
+// the input's size like 3x
+func ParseSpaceThreshold(value string) (SpaceThreshold, error) {
+  value = strings.TrimSpace(value)
+
+  if multiple, found := strings.CutSuffix(strings.ToLower(value), "x"); found {
+    factor, err := strconv.ParseFloat(multiple, 64)
+
+    if err != nil || factor <= 0 {
+      return SpaceThreshold{}, fmt.Errorf("bad input multiple %q", value)
+    }
+
+    return SpaceThreshold{InputMultiple: factor}, nil
+  }
+
+  size, err := ParseSize(value)
+
+  if err != nil {
+    return SpaceThreshold{}, err
+  }
+
+  return SpaceThreshold{Bytes: size}, nil
+}
+
+// ParseSize parses a number of bytes with an optional K, M, G or T suffix
+func ParseSize(value string) (int64, error) {
+  value = strings.TrimSpace(value)
+  unit := int64(1)
+
+  if value != "" {
+    switch strings.ToUpper(value[len(value)-1:]) {
+    case "K":
+      unit = 1 << 10
+    case "M":
+      unit = 1 << 20
+    case "G":
+      unit = 1 << 30
+    case "T":
+      unit = 1 << 40
+    }
+  }
+
+  if unit > 1 {
+    value = value[:len(value)-1]
+  }
+
+  size, err := strconv.ParseFloat(value, 64)
+
+  if err != nil || size < 0 {
+    return 0, fmt.Errorf("bad size %q", value)
+  }
+
+  return int64(size * float64(unit)), nil
+}
+
+// FormatSize is the inverse of ParseSize, with one decimal
+func FormatSize(size int64) string {
+  for i, suffix := range []string{"T", "G", "M", "K"} {
+    if unit := int64(1) << (10 * (4 - i)); size >= unit {
+      return strconv.FormatFloat(float64(size)/float64(unit), 'f', 1, 64) + suffix
+    }
+  }
+
+  return strconv.FormatInt(size, 10)
+}
+
+// needed is the free space an input of inputBytes needs
+func (t SpaceThreshold) needed(inputBytes int64) int64 {
+  if t.InputMultiple > 0 {
+    return int64(float64(inputBytes) * t.InputMultiple)
+  }
+
+  return t.Bytes
+}
+
+// lowSpace returns the first of the working and finished directories with
+// less than need bytes free. Volumes whose free space cannot be read pass
+func (e *encoder) lowSpace(need int64) (dir string, free int64, low bool) {
+  for _, dir := range []string{e.workingDir, e.finishedDir} {
+    free, err := freeSpace(dir)
+
+    if err == nil && free < need {
+      return dir, free, true
+    }
+  }
+
+  return "", 0, false
+}
+
+// waitForSpace holds the job while a volume is short of space for it,
+// checking again every diskCheckInterval. It returns false if the job was
+// cancelled or the program is shutting down in the meantime
+func (e *encoder) waitForSpace(j *Job, inputBytes int64) bool {
+  need := e.minFree.needed(inputBytes)
+
+  if need <= 0 {
+    return true
+  }
+
+  dir, free, low := e.lowSpace(need)
+
+  if !low {
+    return true
+  }
+
+  logger := j.logger()
+  logger.Warn("Not enough free disk space, waiting", "dir", dir, "free", free, "needed", need)
+
+  e.stats.waitingForSpace.Add(1)
+  defer e.stats.waitingForSpace.Add(-1)
+
+  ticker := time.NewTicker(diskCheckInterval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-e.ctx.Done():
+      return false
+    }
+
+    if j.State() != JobQueued {
+      return false
+    }
+
+    if _, _, low = e.lowSpace(need); !low {
+      logger.Info("Disk space available again, starting")
+      return true
+    }
+  }
+}
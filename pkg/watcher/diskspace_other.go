@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package watcher
+
+import (
+  "errors"
+)
+
+// freeSpace is not implemented here, the disk space check always passes
+func freeSpace(dir string) (int64, error) {
+  return 0, errors.New("free space is not supported on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+
+package watcher
+
+import (
+  "syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// volume holding dir
+func freeSpace(dir string) (int64, error) {
+  var stat syscall.Statfs_t
+
+  if err := syscall.Statfs(dir, &stat); err != nil {
+    return 0, err
+  }
+
+  return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,26 @@
+package watcher
+
+import (
+  "syscall"
+  "unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the bytes available to gowatcher's user on the volume
+// holding dir, quotas included
+func freeSpace(dir string) (int64, error) {
+  path, err := syscall.UTF16PtrFromString(dir)
+
+  if err != nil {
+    return 0, err
+  }
+
+  var available uint64
+
+  if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)), 0, 0); ok == 0 {
+    return 0, err
+  }
+
+  return int64(available), nil
+}
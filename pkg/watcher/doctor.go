@@ -0,0 +1,563 @@
+package watcher
+
+import (
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "net"
+  "net/http"
+  "net/url"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "slices"
+  "sort"
+  "strings"
+  "time"
+)
+
+const (
+  // doctorTimeout is how long each check that runs a program or goes over
+  // the network may take
+  doctorTimeout = 20 * time.Second
+
+  // doctorLowSpace is the free space below which a directory is warned
+  // about when there is no MinFreeSpace to go by
+  doctorLowSpace = 5 << 30
+)
+
+// DoctorStatus is how one of Doctor's checks came out
+type DoctorStatus string
+
+const (
+  DoctorOK   DoctorStatus = "ok"
+  DoctorWarn DoctorStatus = "warn"
+  DoctorFail DoctorStatus = "fail"
+)
+
+// DoctorCheck is one thing Doctor looked at, what it found and, unless it
+// is ok, what to do about it
+type DoctorCheck struct {
+  Name   string       `json:"name"`
+  Status DoctorStatus `json:"status"`
+  Detail string       `json:"detail"`
+  Fix    string       `json:"fix,omitempty"`
+}
+
+// Doctor checks the machine cfg would run on without starting a watcher:
+// that ffmpeg and ffprobe run and are the same version, that each
+// profile's ffmpeg has what its flags name and encodes a test clip with
+// them, that the directories are there or can be created, are writable and
+// have space free, the inotify limits the notify watch mode needs, and
+// that the upload, the finished storage, the profiles' destinations and
+// the notifiers answer. Nothing is sent to them or queued, a test file is
+// written to each directory and removed
+func Doctor(ctx context.Context, cfg Config) []DoctorCheck {
+  d := &doctor{ctx: ctx}
+
+  d.tools(cfg)
+  d.profiles(cfg)
+  d.dirs(cfg)
+  d.inotify(cfg)
+  d.destinations(cfg)
+  d.notifiers(cfg)
+
+  return d.checks
+}
+
+// doctor collects Doctor's checks
+type doctor struct {
+  ctx    context.Context
+  checks []DoctorCheck
+}
+
+func (d *doctor) add(name string, status DoctorStatus, detail string, fix string) {
+  d.checks = append(d.checks, DoctorCheck{Name: name, Status: status, Detail: detail, Fix: fix})
+}
+
+// timeout is the context for one check
+func (d *doctor) timeout() (context.Context, context.CancelFunc) {
+  return context.WithTimeout(d.ctx, doctorTimeout)
+}
+
+// doctorProfiles are cfg's profiles, the default first and the others by
+// name
+func doctorProfiles(cfg Config) []*Profile {
+  profiles := make([]*Profile, 0, len(cfg.Profiles)+1)
+
+  if cfg.Profile != nil {
+    profiles = append(profiles, cfg.Profile)
+  }
+
+  names := make([]string, 0, len(cfg.Profiles))
+
+  for name := range cfg.Profiles {
+    if cfg.Profile == nil || name != cfg.Profile.Name {
+      names = append(names, name)
+    }
+  }
+
+  sort.Strings(names)
+
+  for _, name := range names {
+    profiles = append(profiles, cfg.Profiles[name])
+  }
+
+  return profiles
+}
+
+// tools checks ffmpeg and ffprobe
+func (d *doctor) tools(cfg Config) {
+  needsFFmpeg := false
+
+  for _, p := range doctorProfiles(cfg) {
+    needsFFmpeg = needsFFmpeg || p.runsFFmpeg()
+  }
+
+  var ffmpegVersion string
+
+  switch {
+  case cfg.Sandbox != nil && cfg.Sandbox.container():
+    d.add("ffmpeg", DoctorOK, fmt.Sprintf("%s in the sandbox's image %s, not checked", cfg.FFmpegPath, cfg.Sandbox.Image), "")
+  case cfg.FFmpegPath == "" && needsFFmpeg:
+    d.add("ffmpeg", DoctorFail, "not found on the PATH", "install ffmpeg on the system PATH, or point FFMPEG_PATH at one")
+  case cfg.FFmpegPath == "":
+    d.add("ffmpeg", DoctorOK, "not found, no profile needs it", "")
+  default:
+    version, err := d.toolVersion(cfg.FFmpegPath)
+
+    if err != nil {
+      d.add("ffmpeg", DoctorFail, err.Error(), "point FFMPEG_PATH at an ffmpeg built for this machine")
+      break
+    }
+
+    ffmpegVersion = version
+    d.add("ffmpeg", DoctorOK, cfg.FFmpegPath+", version "+version, "")
+  }
+
+  // routes, pre-flight reports and rejecting non-media inputs need ffprobe,
+  // without it progress has no percentage and outputs are not validated
+  needsFFprobe := len(cfg.Routes) > 0 || cfg.Preflight != nil || cfg.RejectNonMedia
+
+  switch {
+  case cfg.FFprobePath == "" && needsFFprobe:
+    d.add("ffprobe", DoctorFail, "not found on the PATH, routes, pre-flight reports and rejecting non-media inputs need it", "install ffprobe, it comes with ffmpeg, on the system PATH")
+  case cfg.FFprobePath == "":
+    d.add("ffprobe", DoctorWarn, "not found on the PATH, progress has no percentage and outputs are not validated", "install ffprobe, it comes with ffmpeg, on the system PATH")
+  default:
+    version, err := d.toolVersion(cfg.FFprobePath)
+
+    switch {
+    case err != nil:
+      d.add("ffprobe", DoctorFail, err.Error(), "install an ffprobe built for this machine")
+    case ffmpegVersion != "" && version != ffmpegVersion:
+      d.add("ffprobe", DoctorWarn, fmt.Sprintf("%s, version %s, but ffmpeg is %s", cfg.FFprobePath, version, ffmpegVersion), "install ffmpeg and ffprobe from the same build")
+    default:
+      d.add("ffprobe", DoctorOK, cfg.FFprobePath+", version "+version, "")
+    }
+  }
+}
+
+// toolVersion is the version ffmpeg or ffprobe at path prints
+func (d *doctor) toolVersion(path string) (string, error) {
+  ctx, cancel := d.timeout()
+  defer cancel()
+
+  return toolVersion(ctx, path)
+}
+
+// firstLine is s up to its first line break
+func firstLine(s string) string {
+  line, _, _ := strings.Cut(s, "\n")
+  return strings.TrimSpace(line)
+}
+
+// profiles runs New's checks of each profile on a copy of it
+func (d *doctor) profiles(cfg Config) {
+  builds := make(ffmpegBuilds)
+  container := cfg.Sandbox != nil && cfg.Sandbox.container()
+
+  for _, profile := range doctorProfiles(cfg) {
+    p := *profile
+    name := "profile " + p.Name
+
+    err := checkNameTemplate(p.NameTemplate)
+
+    if err == nil {
+      err = p.checkFFmpeg(cfg.FFmpegPath, container, builds)
+    }
+
+    if err == nil {
+      err = p.checkRunnable(p.ffmpegPath(cfg.FFmpegPath))
+    }
+
+    switch {
+    case err != nil:
+      d.add(name, DoctorFail, err.Error(), "fix the profile, or the ffmpeg it runs")
+    case !p.runsFFmpeg():
+      d.add(name, DoctorOK, "runs its own command", "")
+    case container:
+      d.add(name, DoctorOK, "runs in the sandbox's image, its flags are not checked", "")
+    case p.ffmpegPath(cfg.FFmpegPath) == "":
+      d.add(name, DoctorFail, "needs ffmpeg, which was not found", "install ffmpeg, or set the profile's ffmpeg_path")
+    default:
+      d.add(name, DoctorOK, p.ffmpegPath(cfg.FFmpegPath)+" has what its flags name and encodes a test clip with them", "")
+    }
+  }
+}
+
+// dirs checks the directories the watcher would use
+func (d *doctor) dirs(cfg Config) {
+  if cfg.BaseDir == "" {
+    d.add("base directory", DoctorFail, "not set", "set BASE_DIR")
+    return
+  }
+
+  base, err := filepath.Abs(cfg.BaseDir)
+
+  if err == nil {
+    var exists bool
+
+    if exists, err = dirExists(base); err == nil && !exists {
+      err = errors.New("does not exist")
+    }
+  }
+
+  if err != nil {
+    d.add("base directory", DoctorFail, fmt.Sprintf("%s: %s", cfg.BaseDir, err), "create it, or point BASE_DIR at a directory that exists")
+    return
+  }
+
+  type dir struct {
+    name  string
+    path  string
+    space bool
+  }
+
+  // working and finished get the encodes, the profiles' destinations
+  // their outputs
+  dirs := []dir{{"base directory", base, false}}
+  add := func(name string, configured string, def string, space bool) {
+    path, err := dirOrDefault(configured, base, def)
+
+    if err == nil {
+      dirs = append(dirs, dir{name, path, space})
+    }
+  }
+
+  add("queue directory", cfg.QueueDir, "queue", false)
+  add("working directory", cfg.WorkingDir, "working", true)
+  add("finished directory", cfg.FinishedDir, "finished", true)
+  add("logs directory", "", "logs", false)
+
+  if cfg.Originals == OriginalsArchive {
+    add("originals directory", cfg.OriginalsDir, "originals", false)
+  }
+
+  if cfg.Originals == OriginalsTrash {
+    add("trash directory", cfg.TrashDir, ".trash", false)
+  }
+
+  if cfg.Holding != nil {
+    add("holding directory", cfg.Holding.Dir, "upload", false)
+  }
+
+  if cfg.Manifests && cfg.ManifestDir != "" {
+    add("manifest directory", cfg.ManifestDir, "", false)
+  }
+
+  if cfg.FailedDir != "" {
+    add("failed directory", cfg.FailedDir, "", false)
+  }
+
+  quarantines := false
+
+  for _, p := range cfg.Failures {
+    quarantines = quarantines || p.Action == failQuarantine
+  }
+
+  if cfg.RejectNonMedia || quarantines {
+    add("rejected directory", cfg.RejectedDir, "rejected", false)
+  }
+
+  for _, p := range doctorProfiles(cfg) {
+    if p.Destination != "" && !p.remoteDestination() {
+      add("profile "+p.Name+"'s destination", p.Destination, "", true)
+    }
+  }
+
+  seen := make(map[string]bool)
+
+  for _, dir := range dirs {
+    if !seen[dir.path] {
+      seen[dir.path] = true
+      d.dir(dir.name, dir.path, dir.space, cfg.MinFreeSpace)
+    }
+  }
+}
+
+// dir checks that the directory at path is there, or that what is there of
+// its parents lets gowatcher create it, that it is writable and, with space,
+// that its volume has space free
+func (d *doctor) dir(name string, path string, space bool, minFree SpaceThreshold) {
+  info, err := os.Stat(path)
+
+  if os.IsNotExist(err) {
+    parent := filepath.Dir(path)
+
+    for parent != filepath.Dir(parent) {
+      if _, err := os.Stat(parent); err == nil {
+        break
+      }
+
+      parent = filepath.Dir(parent)
+    }
+
+    if err := writable(parent); err != nil {
+      d.add(name, DoctorFail, fmt.Sprintf("%s does not exist and cannot be created: %s", path, err), "create it, or give gowatcher's user write access to "+parent)
+      return
+    }
+
+    d.add(name, DoctorOK, path+" does not exist yet, gowatcher creates it", "")
+    return
+  }
+
+  switch {
+  case err != nil:
+    d.add(name, DoctorFail, err.Error(), "check the path and its permissions")
+    return
+  case !info.IsDir():
+    d.add(name, DoctorFail, path+" is not a directory", "move the file out of the way, or configure another directory")
+    return
+  }
+
+  if err := writable(path); err != nil {
+    d.add(name, DoctorFail, fmt.Sprintf("%s is not writable: %s", path, err), "give gowatcher's user, or RUN_AS, write access to it")
+    return
+  }
+
+  free, err := freeSpace(path)
+
+  if !space || err != nil {
+    d.add(name, DoctorOK, path+" is writable", "")
+    return
+  }
+
+  detail := fmt.Sprintf("%s is writable, %s free", path, FormatSize(free))
+
+  switch {
+  case minFree.Bytes > 0 && free < minFree.Bytes:
+    d.add(name, DoctorFail, fmt.Sprintf("%s, jobs wait for %s", detail, FormatSize(minFree.Bytes)), "free up space on the volume, or lower MIN_FREE_SPACE")
+  case free < doctorLowSpace:
+    d.add(name, DoctorWarn, detail, "free up space on the volume, an encode needs room for its outputs")
+  default:
+    d.add(name, DoctorOK, detail, "")
+  }
+}
+
+// writable writes a file to dir and removes it again
+func writable(dir string) error {
+  f, err := os.CreateTemp(dir, ".gowatcher-doctor-")
+
+  if err != nil {
+    return err
+  }
+
+  f.Close()
+
+  return os.Remove(f.Name())
+}
+
+// destinations checks the upload and the storages the outputs go to
+func (d *doctor) destinations(cfg Config) {
+  if cfg.Upload != nil {
+    d.s3(*cfg.Upload)
+  }
+
+  if cfg.Rclone != nil {
+    d.rclone(*cfg.Rclone)
+  }
+
+  if cfg.Finished != nil {
+    storage, err := cfg.Finished.Storage, error(nil)
+
+    if storage == nil {
+      storage, err = OpenStorage(cfg.Finished.URL, cfg.Finished.Options)
+    }
+
+    d.storage("finished storage", storage, err)
+  }
+
+  seen := make(map[string]bool)
+
+  for _, p := range doctorProfiles(cfg) {
+    if p.Destination == "" || !p.remoteDestination() || seen[p.Destination] {
+      continue
+    }
+
+    seen[p.Destination] = true
+    storage, err := OpenStorage(p.Destination, cfg.Destinations)
+    d.storage("profile "+p.Name+"'s destination", storage, err)
+  }
+}
+
+// s3 checks the bucket with a HEAD, which needs the keys to be allowed to
+// list it
+func (d *doctor) s3(cfg S3Upload) {
+  name := "upload to s3://" + cfg.Bucket
+  c, err := newS3Client(cfg)
+
+  if err != nil {
+    d.add(name, DoctorFail, err.Error(), "fix the S3 settings")
+    return
+  }
+
+  ctx, cancel := d.timeout()
+  defer cancel()
+
+  if _, _, err = c.do(ctx, http.MethodHead, "", nil, nil, nil, 0, 0); err != nil {
+    d.add(name, DoctorFail, fmt.Sprintf("%s: %s", c.url("", nil), err), "check the bucket, endpoint, region and keys, and that the network allows the connection")
+    return
+  }
+
+  d.add(name, DoctorOK, c.url("", nil)+" answered", "")
+}
+
+// rclone lists the destination, which is fine not being there yet
+func (d *doctor) rclone(cfg RcloneUpload) {
+  name := "upload to " + cfg.Destination
+  c, err := newRcloneClient(cfg)
+
+  if err != nil {
+    d.add(name, DoctorFail, err.Error(), "install rclone, or point RCLONE_PATH at it")
+    return
+  }
+
+  ctx, cancel := d.timeout()
+  defer cancel()
+
+  args := append([]string{"lsf", "--max-depth", "1", c.cfg.Destination}, c.cfg.Flags...)
+  out, err := exec.CommandContext(ctx, c.cfg.Command, args...).CombinedOutput()
+
+  switch {
+  case err != nil && strings.Contains(string(out), "directory not found"):
+    d.add(name, DoctorOK, "reachable, rclone creates the directory with the first upload", "")
+  case err != nil:
+    d.add(name, DoctorFail, fmt.Sprintf("rclone lsf: %s: %s", err, lastLine(out)), "check the remote with rclone config, and that its credentials have not expired")
+  default:
+    d.add(name, DoctorOK, "reachable", "")
+  }
+}
+
+// storage lists the storage, err is opening it
+func (d *doctor) storage(name string, storage Storage, err error) {
+  if err != nil {
+    d.add(name, DoctorFail, err.Error(), "fix the URL, or where it points")
+    return
+  }
+
+  ctx, cancel := d.timeout()
+  defer cancel()
+
+  if _, err = storage.List(ctx); err != nil {
+    d.add(name, DoctorFail, fmt.Sprintf("%s: %s", storage, err), "check the host, credentials and path, and that the network allows the connection")
+    return
+  }
+
+  d.add(name, DoctorOK, storage.String()+" can be listed", "")
+}
+
+// notifierEndpoint is a notifier that talks to a server, Doctor connects
+// to it
+type notifierEndpoint interface {
+  endpoint() (*url.URL, error)
+}
+
+// notifiers connects to the servers of the handlers and notifiers
+func (d *doctor) notifiers(cfg Config) {
+  var endpoints []notifierEndpoint
+
+  for _, h := range cfg.Handlers {
+    if e, ok := h.(notifierEndpoint); ok {
+      endpoints = append(endpoints, e)
+    }
+  }
+
+  for _, n := range cfg.Notifiers {
+    if wrapped, ok := n.(eventNotifier); ok {
+      if e, ok := wrapped.h.(notifierEndpoint); ok {
+        endpoints = append(endpoints, e)
+      }
+    }
+  }
+
+  var checked []string
+
+  for _, e := range endpoints {
+    u, err := e.endpoint()
+
+    if err != nil {
+      d.add("notifier", DoctorFail, err.Error(), "fix the notifier's URL")
+      continue
+    }
+
+    name := "notifier " + redactURL(u)
+
+    if slices.Contains(checked, name) {
+      continue
+    }
+
+    checked = append(checked, name)
+    d.connect(name, u)
+  }
+}
+
+// connect checks that the server at u answers: an http(s) one a HEAD
+// request, through the proxy there is one, anything else a TCP and, for
+// smtps, TLS connection
+func (d *doctor) connect(name string, u *url.URL) {
+  ctx, cancel := d.timeout()
+  defer cancel()
+
+  fix := "check the URL, DNS and firewall, and the proxy if there is one"
+
+  if u.Scheme == "http" || u.Scheme == "https" {
+    req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+
+    if err != nil {
+      d.add(name, DoctorFail, err.Error(), "fix the notifier's URL")
+      return
+    }
+
+    resp, err := http.DefaultClient.Do(req)
+
+    if err != nil {
+      d.add(name, DoctorFail, err.Error(), fix)
+      return
+    }
+
+    resp.Body.Close()
+
+    // any answer will do, a webhook need not take a HEAD
+    d.add(name, DoctorOK, "answered "+resp.Status, "")
+    return
+  }
+
+  var dialer net.Dialer
+  conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+
+  if err == nil && u.Scheme == "smtps" {
+    tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+    err = tlsConn.HandshakeContext(ctx)
+    conn = tlsConn
+  }
+
+  if err != nil {
+    d.add(name, DoctorFail, err.Error(), fix)
+    return
+  }
+
+  conn.Close()
+  d.add(name, DoctorOK, "connected to "+u.Host, "")
+}
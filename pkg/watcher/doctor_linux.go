@@ -0,0 +1,94 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "syscall"
+)
+
+// inotifyWatches and inotifyInstances are what the notify watch mode takes
+// of the user's inotify limits: a watch, and an instance for it, on the
+// queue directory and on its priority directory
+const (
+  inotifyWatches   = 2
+  inotifyInstances = 2
+)
+
+// inotify checks that the user's inotify limits leave room for the watcher,
+// counting what this user's processes already use. What other programs
+// like IDEs and sync clients take is what usually runs out
+func (d *doctor) inotify(cfg Config) {
+  if cfg.WatchMode == "poll" {
+    return
+  }
+
+  usedWatches, usedInstances := inotifyUsage()
+
+  for _, limit := range []struct {
+    name string
+    used int
+    need int
+  }{
+    {"max_user_watches", usedWatches, inotifyWatches},
+    {"max_user_instances", usedInstances, inotifyInstances},
+  } {
+    name := "fs.inotify." + limit.name
+    data, err := os.ReadFile("/proc/sys/fs/inotify/" + limit.name)
+
+    if err != nil {
+      d.add(name, DoctorWarn, err.Error(), "set WATCH_MODE=poll if the kernel has no inotify")
+      continue
+    }
+
+    allowed, err := strconv.Atoi(strings.TrimSpace(string(data)))
+
+    if err != nil {
+      d.add(name, DoctorWarn, fmt.Sprintf("%q is not a number", data), "")
+      continue
+    }
+
+    detail := fmt.Sprintf("%d of %d in use by this user's processes", limit.used, allowed)
+    fix := fmt.Sprintf("raise it with sysctl %s=%d and in /etc/sysctl.d to keep it, or set WATCH_MODE=poll", name, max(allowed*4, 8192))
+
+    switch {
+    case allowed-limit.used < limit.need:
+      d.add(name, DoctorFail, fmt.Sprintf("%s, gowatcher needs %d", detail, limit.need), fix)
+    case allowed-limit.used < allowed/10:
+      d.add(name, DoctorWarn, detail+", nearly all", fix)
+    default:
+      d.add(name, DoctorOK, detail, "")
+    }
+  }
+}
+
+// inotifyUsage counts the inotify watches and instances of the processes
+// of this user it can see in /proc
+func inotifyUsage() (watches int, instances int) {
+  uid := uint32(os.Getuid())
+  fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+
+  for _, fd := range fds {
+    if link, err := os.Readlink(fd); err != nil || link != "anon_inode:inotify" {
+      continue
+    }
+
+    proc := filepath.Dir(filepath.Dir(fd))
+
+    if info, err := os.Stat(proc); err != nil || info.Sys().(*syscall.Stat_t).Uid != uid {
+      continue
+    }
+
+    instances++
+
+    data, err := os.ReadFile(filepath.Join(proc, "fdinfo", filepath.Base(fd)))
+
+    if err == nil {
+      watches += strings.Count(string(data), "inotify wd:")
+    }
+  }
+
+  return watches, instances
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package watcher
+
+// inotify is Linux's, elsewhere the notify watch mode has no limits to
+// check
+func (d *doctor) inotify(cfg Config) {}
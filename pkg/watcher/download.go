@@ -0,0 +1,440 @@
+package watcher
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/netip"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// downloadAttempts is how many times a download is tried, each retry after
+// the first bytes arrived resumes where the last one stopped
+const downloadAttempts = 5
+
+// defaultDownloads is how many URLs are downloaded at once by default
+const defaultDownloads = 2
+
+// downloadSpaceCheck is how often a download of unknown size checks the
+// free space as it writes
+const downloadSpaceCheck = 64 << 20
+
+// DownloadLimits are what EnqueueURL and the stream consumer download
+type DownloadLimits struct {
+  // MaxBytes fails downloads larger than this, zero for no limit
+  MaxBytes int64
+
+  // Concurrent is how many downloads run at once, the others wait. Zero
+  // is 2
+  Concurrent int
+
+  // AllowNetworks are the loopback, private and link-local networks URLs
+  // may reach, which are refused otherwise so a URL cannot be used to
+  // probe internal services. A proxy on one of them must be listed
+  AllowNetworks []netip.Prefix
+}
+
+// downloader fetches URLs within the limits, the working volume keeping
+// MinFreeSpace
+type downloader struct {
+  client  *http.Client
+  limits  DownloadLimits
+  minFree SpaceThreshold
+  slots   chan struct{}
+}
+
+func newDownloader(limits DownloadLimits, minFree SpaceThreshold) *downloader {
+  if limits.Concurrent <= 0 {
+    limits.Concurrent = defaultDownloads
+  }
+
+  d := &downloader{limits: limits, minFree: minFree, slots: make(chan struct{}, limits.Concurrent)}
+
+  // checked once the name is resolved, which covers redirects and names
+  // pointing inside
+  dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: d.control}
+
+  d.client = &http.Client{
+    // no overall timeout, large files take as long as they take
+    Transport: &http.Transport{
+      Proxy:                 http.ProxyFromEnvironment,
+      DialContext:           dialer.DialContext,
+      ResponseHeaderTimeout: time.Minute,
+    },
+  }
+
+  return d
+}
+
+// allowed reports whether a download may connect to ip
+func (d *downloader) allowed(ip netip.Addr) bool {
+  ip = ip.Unmap()
+
+  if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsUnspecified() {
+    return true
+  }
+
+  for _, network := range d.limits.AllowNetworks {
+    if network.Contains(ip) {
+      return true
+    }
+  }
+
+  return false
+}
+
+func (d *downloader) control(network string, address string, _ syscall.RawConn) error {
+  host, _, err := net.SplitHostPort(address)
+
+  if err != nil {
+    return err
+  }
+
+  ip, err := netip.ParseAddr(host)
+
+  if err != nil {
+    return err
+  }
+
+  if !d.allowed(ip) {
+    return downloadLimitError{fmt.Errorf("%s is a loopback, private or link-local address, not allowed", ip)}
+  }
+
+  return nil
+}
+
+// EnqueueURL queues a job for the file at an http or https URL. The job is
+// queued straight away and waits for a worker once the file is downloaded
+// into the working directory, a failed download fails it. name is what the
+// outputs are named after, empty for the URL's file name. Downloads are
+// within Config.Downloads, which refuses URLs reaching loopback, private or
+// link-local addresses unless their network is allowed
+func (w *Watcher) EnqueueURL(rawURL string, name string) (*Job, error) {
+  return w.enqueueURL(rawURL, name, PriorityNormal, w.profiles.Load().def)
+}
+
+// enqueueURL is EnqueueURL with the job's priority and profile
+func (w *Watcher) enqueueURL(rawURL string, name string, priority int, profile *Profile) (*Job, error) {
+  if w.cfg.DryRun {
+    return nil, errors.New("nothing is downloaded in a dry run")
+  }
+
+  u, err := url.Parse(rawURL)
+
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return nil, fmt.Errorf("not an http or https URL: %q", rawURL)
+  }
+
+  // names are checked as they are resolved
+  if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !w.downloads.allowed(ip) {
+    return nil, fmt.Errorf("%s is a loopback, private or link-local address, not allowed", ip)
+  }
+
+  if name == "" {
+    name = path.Base(u.Path)
+  }
+
+  if name == "" || name == "." || name == "/" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+    return nil, fmt.Errorf("no file name in %q, give one", rawURL)
+  }
+
+  if isSidecar(name) || !w.filter.Load().allowed(name) {
+    return nil, fmt.Errorf("%s is not a file this watcher encodes", name)
+  }
+
+  if err = os.MkdirAll(w.downloadDir, 0755); err != nil {
+    return nil, err
+  }
+
+  // a directory each so two URLs can have the same file name
+  dir, err := os.MkdirTemp(w.downloadDir, "url-")
+
+  if err != nil {
+    return nil, err
+  }
+
+  w.stats.filesQueued.Add(1)
+
+  j := w.store.add(filepath.Join(dir, name), name, priority, profile)
+
+  go w.download(j, u, dir)
+
+  return j, nil
+}
+
+// download fetches the job's input and queues the job, unless it was
+// cancelled meanwhile or the watcher is shutting down
+func (w *Watcher) download(j *Job, u *url.URL, dir string) {
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  go func() {
+    select {
+    case <-w.stopRescan:
+      cancel()
+    case <-ctx.Done():
+    }
+  }()
+
+  logger := j.logger()
+  logger.Info("Downloading", "url", redactURL(u))
+  startedAt := time.Now()
+
+  err := w.downloads.fetch(ctx, u.String(), j.input)
+
+  switch {
+  case j.State() != JobQueued:
+    // cancelled while downloading
+    os.RemoveAll(dir)
+  case ctx.Err() != nil:
+    os.RemoveAll(dir)
+    j.finish(JobCancelled, errShutdown)
+  case err != nil:
+    os.RemoveAll(dir)
+    logger.Error("Download failed", "url", redactURL(u), "error", err)
+    j.finish(JobFailed, fmt.Errorf("download: %s", err))
+  default:
+    logger.Info("Downloaded", "url", redactURL(u), "took", time.Since(startedAt).Round(time.Second).String())
+    w.queue.push(j)
+  }
+}
+
+// fetch GETs rawURL into dest once one of the download slots is free,
+// resuming with a range request when the connection drops partway. Servers
+// that ignore the range send the whole file again
+func (d *downloader) fetch(ctx context.Context, rawURL string, dest string) error {
+  select {
+  case d.slots <- struct{}{}:
+    defer func() { <-d.slots }()
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+
+  f, err := os.Create(dest)
+
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  var written int64
+  var lastErr error
+
+  for attempt := 0; attempt < downloadAttempts; attempt++ {
+    if attempt > 0 {
+      select {
+      case <-time.After(time.Duration(1<<attempt) * time.Second):
+      case <-ctx.Done():
+        return ctx.Err()
+      }
+    }
+
+    var retry bool
+
+    if retry, err = d.fetchRange(ctx, rawURL, f, &written); err == nil {
+      return f.Sync()
+    }
+
+    if !retry || ctx.Err() != nil {
+      return err
+    }
+
+    lastErr = err
+  }
+
+  return lastErr
+}
+
+// fetchRange makes one request for what is missing from f, reporting
+// whether a failure is worth retrying
+func (d *downloader) fetchRange(ctx context.Context, rawURL string, f *os.File, written *int64) (bool, error) {
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+
+  if err != nil {
+    return false, err
+  }
+
+  if *written > 0 {
+    req.Header.Set("Range", "bytes="+strconv.FormatInt(*written, 10)+"-")
+  }
+
+  resp, err := d.client.Do(req)
+
+  if err != nil {
+    var limitErr downloadLimitError
+
+    return !errors.As(err, &limitErr), err
+  }
+
+  defer resp.Body.Close()
+
+  // the size of the whole file, -1 when the server does not say
+  size := resp.ContentLength
+
+  switch {
+  case resp.StatusCode == http.StatusPartialContent && *written > 0:
+    start, total, ok := contentRange(resp.Header.Get("Content-Range"))
+
+    if !ok || start != *written {
+      // start over rather than splice the wrong bytes in
+      *written = 0
+
+      if err = f.Truncate(0); err != nil {
+        return false, err
+      }
+
+      return true, fmt.Errorf("asked to resume at %d, the server sent %q", start, resp.Header.Get("Content-Range"))
+    }
+
+    size = total
+  case resp.StatusCode == http.StatusOK:
+    // a fresh start, or a server without ranges
+    if err = f.Truncate(0); err != nil {
+      return false, err
+    }
+
+    if _, err = f.Seek(0, io.SeekStart); err != nil {
+      return false, err
+    }
+
+    *written = 0
+  case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && *written > 0:
+    // the last attempt got everything but could not tell
+    return false, nil
+  default:
+    return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, errors.New(resp.Status)
+  }
+
+  if d.limits.MaxBytes > 0 && size > d.limits.MaxBytes {
+    return false, fmt.Errorf("the file is %s, more than the %s allowed", FormatSize(size), FormatSize(d.limits.MaxBytes))
+  }
+
+  if size >= 0 {
+    if err = d.checkSpace(f.Name(), size-*written, size); err != nil {
+      return false, err
+    }
+  }
+
+  n, err := io.Copy(&downloadWriter{d: d, f: f, written: *written}, resp.Body)
+  *written += n
+
+  var limitErr downloadLimitError
+
+  if errors.As(err, &limitErr) {
+    return false, err
+  }
+
+  if err != nil {
+    return true, err
+  }
+
+  if resp.ContentLength >= 0 && n < resp.ContentLength {
+    return true, io.ErrUnexpectedEOF
+  }
+
+  return false, nil
+}
+
+// checkSpace fails when writing n more bytes of a file of size would leave
+// the volume with less than MinFreeSpace. A volume whose free space cannot
+// be read passes
+func (d *downloader) checkSpace(path string, n int64, size int64) error {
+  free, err := freeSpace(filepath.Dir(path))
+
+  if err != nil {
+    return nil
+  }
+
+  if need := n + d.minFree.needed(size); free < need {
+    return downloadLimitError{fmt.Errorf("%s free, the download needs %s", FormatSize(free), FormatSize(need))}
+  }
+
+  return nil
+}
+
+// downloadLimitError is a download stopped by its limits, not retried
+type downloadLimitError struct {
+  error
+}
+
+// downloadWriter writes a download to its file within the size limit,
+// checking the free space as it goes for files of unknown size
+type downloadWriter struct {
+  d       *downloader
+  f       *os.File
+  written int64
+  checked int64
+}
+
+func (w *downloadWriter) Write(p []byte) (int, error) {
+  if limit := w.d.limits.MaxBytes; limit > 0 && w.written+int64(len(p)) > limit {
+    return 0, downloadLimitError{fmt.Errorf("the file is more than the %s allowed", FormatSize(limit))}
+  }
+
+  if w.written-w.checked >= downloadSpaceCheck {
+    if err := w.d.checkSpace(w.f.Name(), int64(len(p)), w.written); err != nil {
+      return 0, err
+    }
+
+    w.checked = w.written
+  }
+
+  n, err := w.f.Write(p)
+  w.written += int64(n)
+
+  return n, err
+}
+
+// contentRange parses a Content-Range: bytes start-end/total header, total
+// is -1 when it is *
+func contentRange(value string) (start int64, total int64, ok bool) {
+  spec, found := strings.CutPrefix(value, "bytes ")
+  span, size, found2 := strings.Cut(spec, "/")
+  first, _, found3 := strings.Cut(span, "-")
+
+  if !found || !found2 || !found3 {
+    return 0, 0, false
+  }
+
+  start, err := strconv.ParseInt(first, 10, 64)
+
+  if err != nil {
+    return 0, 0, false
+  }
+
+  if size == "*" {
+    return start, -1, true
+  }
+
+  if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+    return 0, 0, false
+  }
+
+  return start, total, true
+}
+
+// redactURL is the URL without its password or query, which often hold
+// credentials, for logs
+func redactURL(u *url.URL) string {
+  c := *u
+  c.RawQuery = ""
+
+  if c.User != nil && c.User.Username() != "" {
+    c.User = url.User(c.User.Username())
+  } else {
+    c.User = nil
+  }
+
+  return c.String()
+}
@@ -0,0 +1,95 @@
+package watcher
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "net/netip"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestContentRange(t *testing.T) {
+  tests := []struct {
+    value string
+    start int64
+    total int64
+    ok    bool
+  }{
+    {"bytes 100-199/200", 100, 200, true},
+    {"bytes 0-0/*", 0, -1, true},
+    {"bytes */200", 0, 0, false},
+    {"items 0-9/10", 0, 0, false},
+    {"", 0, 0, false},
+  }
+
+  for _, test := range tests {
+    start, total, ok := contentRange(test.value)
+
+    if start != test.start || total != test.total || ok != test.ok {
+      t.Errorf("contentRange(%q) = %d, %d, %v, want %d, %d, %v", test.value, start, total, ok, test.start, test.total, test.ok)
+    }
+  }
+}
+
+func TestDownloadAllowed(t *testing.T) {
+  d := newDownloader(DownloadLimits{AllowNetworks: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}, SpaceThreshold{})
+
+  tests := []struct {
+    ip      string
+    allowed bool
+  }{
+    {"93.184.216.34", true},
+    {"127.0.0.1", false},
+    {"::1", false},
+    {"::ffff:127.0.0.1", false},
+    {"169.254.169.254", false},
+    {"192.168.1.10", false},
+    {"0.0.0.0", false},
+    {"10.1.2.3", true},
+    {"10.2.0.1", false},
+  }
+
+  for _, test := range tests {
+    if allowed := d.allowed(netip.MustParseAddr(test.ip)); allowed != test.allowed {
+      t.Errorf("allowed(%s) = %v, want %v", test.ip, allowed, test.allowed)
+    }
+  }
+}
+
+func TestDownloadLimits(t *testing.T) {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(strings.Repeat("x", 1000)))
+  }))
+  defer server.Close()
+
+  loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+  dest := filepath.Join(t.TempDir(), "input.mov")
+
+  tests := []struct {
+    name   string
+    limits DownloadLimits
+    fails  string
+  }{
+    {"loopback refused", DownloadLimits{}, "not allowed"},
+    {"too large", DownloadLimits{AllowNetworks: loopback, MaxBytes: 999}, "allowed"},
+    {"allowed", DownloadLimits{AllowNetworks: loopback, MaxBytes: 1000}, ""},
+  }
+
+  for _, test := range tests {
+    err := newDownloader(test.limits, SpaceThreshold{}).fetch(context.Background(), server.URL, dest)
+
+    switch {
+    case test.fails == "" && err != nil:
+      t.Errorf("%s: %s", test.name, err)
+    case test.fails != "" && (err == nil || !strings.Contains(err.Error(), test.fails)):
+      t.Errorf("%s: error %v, want one about %q", test.name, err, test.fails)
+    }
+  }
+
+  if info, err := os.Stat(dest); err != nil || info.Size() != 1000 {
+    t.Errorf("downloaded %v, %v, want 1000 bytes", info, err)
+  }
+}
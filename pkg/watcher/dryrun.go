@@ -0,0 +1,99 @@
+package watcher
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// logDryRun logs what encoding the job would do: the ffmpeg commands, where
+// each output would end up and what would happen to the input
+func (e *encoder) logDryRun(j *Job, plan encodePlan) {
+  logger := j.logger()
+  ffmpegPath := e.ffmpeg(j)
+  level, _ := e.logLevels(j)
+
+  defer e.finishing.release(j)
+
+  if s := plan.split; s != nil {
+    logger.Info("Dry run: would split the input", "command", ffmpegPath+" "+strings.Join(s.split.commandArgs(level), " "))
+
+    for i, o := range s.outputs {
+      run := o.pieceRun(i, filepath.Join(s.dir, "piece-%05d.mkv"))
+      logger.Info("Dry run: would encode each piece", "step", o.name, "at_once", s.jobs, "command", ffmpegPath+" "+strings.Join(run.commandArgs(level), " "))
+    }
+  }
+
+  // the measured values are only known once the first pass ran
+  if l := plan.loudnorm; l != nil {
+    run := loudnessRun(j, l)
+    logger.Info("Dry run: would measure loudness", "command", ffmpegPath+" "+strings.Join(run.commandArgs(level), " "))
+
+    unknown := "?"
+    plan = plan.replaceMarker(l.filter(loudnormStats{unknown, unknown, unknown, unknown, unknown}))
+  }
+
+  for _, run := range plan.runs {
+    if run.program != "" {
+      logger.Info("Dry run: would run", "step", run.name, "command", run.program+" "+strings.Join(run.args, " "))
+      continue
+    }
+
+    logger.Info("Dry run: would run ffmpeg", "step", run.name, "command", ffmpegPath+" "+strings.Join(run.commandArgs(level), " "))
+  }
+
+  for _, run := range plan.runs {
+    for _, out := range run.outputs {
+      dest := e.finishedPath(j, out)
+
+      if _, err := os.Lstat(dest); err != nil {
+        logger.Info("Dry run: would write", "output", dest)
+        continue
+      }
+
+      switch e.collisions {
+      case CollisionSkip:
+        logger.Info("Dry run: output exists and would be kept", "output", dest)
+      case CollisionSuffix:
+        logger.Info("Dry run: output exists, would write", "output", e.finishing.free(j, dest))
+      default:
+        logger.Info("Dry run: would overwrite", "output", dest)
+      }
+    }
+  }
+
+  if upload, _, err := e.destination(j); err != nil {
+    logger.Warn("Dry run: could not open the destination", "error", err)
+  } else if upload != nil {
+    for _, run := range plan.runs {
+      for _, out := range run.outputs {
+        rel, _ := filepath.Rel(e.finishedDir, e.finishedPath(j, out))
+        logger.Info("Dry run: would upload", "to", upload.location(upload.key(rel)))
+      }
+    }
+  }
+
+  if t := e.thumbnails; t != nil {
+    logger.Info("Dry run: would make thumbnails", "dir", filepath.Join(e.finishedDir, thumbsDir), "poster", t.Poster, "sprite", t.Sprite, "preview", t.Preview)
+  }
+
+  if e.postHook != nil {
+    logger.Info("Dry run: would run post hook", "command", strings.Join(e.postHook.Command, " "))
+  }
+
+  switch e.originals {
+  case OriginalsKeep:
+    logger.Info("Dry run: would keep the input")
+  case OriginalsArchive:
+    dir := e.originalsDir
+
+    if e.archiveByDate {
+      dir = filepath.Join(dir, time.Now().Format(archiveDateLayout))
+    }
+
+    logger.Info("Dry run: would archive the input", "to", archivePath(dir, j))
+  default:
+    logger.Info("Dry run: would delete the input")
+  }
+}
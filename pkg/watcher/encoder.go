@@ -0,0 +1,1432 @@
+package watcher
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// errCancelled is reported for jobs stopped through the control API
+var errCancelled = errors.New("cancelled")
+
+// CancelAction is what becomes of a job cancelled through the control API
+type CancelAction string
+
+const (
+  // CancelStop leaves it cancelled with its input in the queue directory,
+  // where a requeue or restart picks it up again
+  CancelStop CancelAction = "stop"
+
+  // CancelRequeue puts it back on the queue to start over once it has
+  // stopped
+  CancelRequeue CancelAction = "requeue"
+
+  // CancelFail fails it, the input goes to the failed directory like any
+  // other failure's
+  CancelFail CancelAction = "fail"
+)
+
+// errInputRemoved is reported for jobs whose input was deleted from the
+// queue directory before they finished
+var errInputRemoved = errors.New("input removed")
+
+// errShutdown is reported for jobs aborted because the program is exiting
+var errShutdown = errors.New("aborted by shutdown")
+
+// errJobTimeout and errStalled are reported for jobs killed by the
+// JOB_TIMEOUT and STALL_TIMEOUT watchdogs
+var errJobTimeout = errors.New("killed after exceeding the job timeout")
+var errStalled = errors.New("killed after making no progress")
+
+// encoder runs ffmpeg for a job and moves the result into the finished directory
+type encoder struct {
+  ffmpegPath       string
+  ffprobePath      string
+  workingDir       string
+  working          *workingState
+  telemetry        *telemetry
+  history          *statsHistory
+  encodes          *encodeLog
+  checksums        bool
+  manifests        bool
+  manifestDir      string
+  runAs            *owner
+  sandbox          *Sandbox
+  outputOwner      *owner
+  outputMode       os.FileMode
+  outputTimes      OutputTimes
+  outputXattrs     bool
+  finishedDir      string
+  progressInterval time.Duration
+
+  // logs holds each job's ffmpeg output, at logLevel unless the profile
+  // has its own, mainLogLevel is what of it also goes to the main log
+  logs         *jobLogs
+  logLevel     string
+  mainLogLevel string
+
+  // originals is what happens to inputs after a successful encode, archived
+  // inputs go to originalsDir, in dated subfolders with archiveByDate, and
+  // trashed ones to trash
+  originals     OriginalsPolicy
+  originalsDir  string
+  archiveByDate bool
+  trash         *Trash
+
+  // failedDir receives the inputs of failed jobs when set
+  failedDir string
+
+  // rejectedDir receives the inputs ffprobe does not read as media when set
+  rejectedDir string
+
+  // failures are the policies for each class of failure, quarantined
+  // inputs go to quarantineDir
+  failures      map[FailureClass]FailurePolicy
+  quarantineDir string
+
+  // collisions is what happens when an output is already in finishedDir,
+  // finishing holds the finished names of the running jobs' outputs
+  collisions CollisionPolicy
+  finishing  finishing
+
+  // symlinks is the symlink policy, resolved links may not point into
+  // queueDirs
+  symlinks  SymlinkPolicy
+  queueDirs []string
+
+  // growing follows or waits for inputs still being written, nil takes
+  // every input as complete
+  growing *Growing
+
+  // sequenceFrameRate is the frame rate of image sequences without their
+  // own, empty for defaultSequenceFrameRate
+  sequenceFrameRate string
+
+  // companions finds the inputs' companions, nil when they are not grouped
+  companions *Companions
+
+  // stats are updated as encodes start and finish
+  stats *metrics
+
+  // handlers are told about every finished or failed job, as are the
+  // notifiers
+  handlers  []EventHandler
+  notifiers []Notifier
+
+  // jobTimeout and stallTimeout kill an encode that takes too long overall
+  // or whose progress stops moving, zero disables them
+  jobTimeout   time.Duration
+  stallTimeout time.Duration
+
+  // validate checks outputs before they count as finished, their duration
+  // has to be within tolerance of the input's
+  validate  bool
+  tolerance DurationTolerance
+
+  // preHook decides whether each job is encoded, skipped or delayed, and may
+  // switch it to one of profiles. Delayed jobs go back on queue
+  preHook  *Hook
+  profiles *atomic.Pointer[profileSet]
+  queue    *jobQueue
+
+  // dryRun logs what each job would do instead of doing it
+  dryRun bool
+
+  // ledger skips inputs already encoded and records new ones, nil disables
+  // it
+  ledger *Ledger
+
+  // audit records the encodes, moves, deletes and hooks, nil disables it
+  audit *AuditLog
+
+  // claims share the queue directory with other nodes, nil when this is the
+  // only one
+  claims *claimer
+
+  // agents encode the ffmpeg runs on other machines, nil when this one
+  // encodes them
+  agents *dispatcher
+
+  // upload delivers the outputs to S3 or an rclone remote after they reach
+  // finishedDir, nil disables it. deleteLocal removes them once uploaded
+  upload      destination
+  deleteLocal bool
+
+  // uploaded records the uploaded outputs kept in finishedDir for a while,
+  // nil when they are not pruned
+  uploaded *uploadedLog
+
+  // destinations are the profiles' remote Destinations by URL, opened
+  // with destinationOpts when a job first needs one
+  destinations    sync.Map
+  destinationOpts StorageOptions
+
+  // delivery paces, reports and resumes the outputs' moves and uploads
+  delivery *deliverer
+
+  // postHook runs after a job's outputs are in finished when set
+  postHook *Hook
+
+  // thumbnails are made from the outputs in finished when set
+  thumbnails *Thumbnails
+
+  // preflight reports on every input before it is encoded when set
+  preflight *Preflight
+
+  // limits restrict the ffmpeg processes
+  limits ProcessLimits
+
+  // resources hold the slots of the resource classes jobs count against,
+  // taken by the queue and released once the job is over
+  resources *Resources
+
+  // minFree is the free space the working and finished volumes need before
+  // an encode starts
+  minFree SpaceThreshold
+
+  // ffmpegVersions are the versions of the ffmpeg binaries the manifests
+  // name, by path
+  ffmpegVersions sync.Map
+
+  // ctx is cancelled by stop to abort every running encode
+  ctx  context.Context
+  stop context.CancelCauseFunc
+}
+
+// abort stops every running encode, their partial outputs are removed and
+// their inputs are left in the queue directory
+func (e *encoder) abort() {
+  e.stop(errShutdown)
+}
+
+// encode runs a single job to completion, the job's state is updated as it goes
+func (e *encoder) encode(j *Job) {
+  defer e.resources.releaseJob(j)
+
+  if j.State() != JobQueued {
+    // cancelled while waiting
+    return
+  }
+
+  e.telemetry.startJob(j)
+  defer e.telemetry.endJob(j)
+
+  if _, err := os.Stat(j.input); errors.Is(err, fs.ErrNotExist) {
+    j.logger().Warn("Input is gone, skipping")
+    j.finish(JobCancelled, errInputRemoved)
+    return
+  }
+
+  if err := e.resolveInput(j); err != nil {
+    j.logger().Error("Could not resolve symlink", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  if err := e.resolveSequence(j); err != nil {
+    j.logger().Error("Not an image sequence", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  if e.claims != nil && !e.dryRun {
+    other, err := e.claims.claim(j)
+
+    switch {
+    case errors.Is(err, fs.ErrNotExist):
+      // another node was done with it first
+      j.finish(JobCancelled, errors.New("gone from the queue directory"))
+      return
+    case err != nil:
+      j.logger().Error("Could not claim input", "error", err)
+      e.waitForClaim(j, &claimInfo{node: "unknown"})
+      return
+    case other != nil && other.state != claimRunning:
+      j.finish(JobCancelled, fmt.Errorf("%s by %s", other.state, other.node))
+      return
+    case other != nil:
+      e.waitForClaim(j, other)
+      return
+    }
+
+    defer e.claims.release(j)
+  }
+
+  if err := e.checkLedger(j); err != nil {
+    j.finish(JobCancelled, err)
+    return
+  }
+
+  if !e.checkMedia(j) {
+    return
+  }
+
+  if err := e.applySpec(j); err != nil {
+    j.logger().Error("Invalid job spec", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  e.telemetry.adopt(j)
+  e.preflightJob(j)
+  e.routeJob(j)
+
+  // an input delivered with a checksum is only encoded when it matches
+  j.mu.Lock()
+  j.checksumPath = findChecksum(j.input)
+  j.companions = e.companions.find(j.input)
+  j.mu.Unlock()
+
+  endVerify := e.telemetry.phase(j, "verify")
+  err := verifyInput(j)
+  endVerify(err)
+
+  if err != nil {
+    j.logger().Error("Input verification failed", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  action, delay, err := e.runPreHook(j)
+
+  switch action {
+  case preHookSkip:
+    j.finish(JobCancelled, err)
+    return
+  case preHookDelay:
+    e.delayJob(j, delay)
+    return
+  case preHookFail:
+    j.logger().Error("Pre hook error", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  // the sidecar, a route or the pre hook may have picked a profile that counts against
+  // other resource classes, wait in the queue if they are full
+  if !e.resources.reslot(j) {
+    e.queue.push(j)
+    return
+  }
+
+  file := j.source()
+  logger := j.logger()
+
+  // an input written to within the idle time is followed as it grows, or
+  // waited for when the profile reads it more than once
+  j.growing = false
+
+  if e.growing.growing(file) {
+    if e.growing.Mode != GrowingFollow || !j.profile.followable() {
+      logger.Info("Input is still growing, waiting", "idle", e.growing.Idle.String())
+      e.delayJob(j, e.growing.Idle)
+      return
+    }
+
+    j.growing = true
+    logger.Info("Following growing input")
+  }
+
+  var inputBytes int64
+
+  if info, err := os.Stat(file); err == nil {
+    inputBytes = info.Size()
+  } else if j.sequence != nil {
+    inputBytes = j.sequence.bytes
+  }
+
+  // a full disk truncates outputs, hold the job until there is room
+  if !e.dryRun && !e.waitForSpace(j, inputBytes) {
+    return
+  }
+
+  logger.Info("Work on file")
+
+  var duration time.Duration
+  var probed *probeResult
+
+  if e.ffprobePath != "" {
+    endProbe := e.telemetry.phase(j, "probe")
+    probed, err = probe(e.ffprobePath, file, j.sequenceFlags()...)
+    endProbe(err)
+
+    if err != nil {
+      logger.Warn("Could not probe input", "error", err)
+    } else {
+      duration = probed.duration()
+    }
+  }
+
+  e.detectScan(j, file, probed)
+
+  // the length so far is no use to the progress or validation
+  if j.growing {
+    duration = 0
+  }
+
+  if j.spec != nil {
+    duration = j.spec.trimmed(duration)
+  }
+
+  ctx, cancel := context.WithCancelCause(e.ctx)
+  defer cancel(nil)
+
+  startedAt := time.Now()
+  jobLog := newTailBuffer(256 * 1024)
+
+  j.mu.Lock()
+  if j.state != JobQueued {
+    // cancelled between being popped off the queue and starting
+    j.mu.Unlock()
+    return
+  }
+  j.state = JobRunning
+  j.startedAt = startedAt
+  j.inputBytes = inputBytes
+  j.log = jobLog
+  j.cancel = cancel
+  j.mu.Unlock()
+
+  j.publish("started")
+
+  if e.working != nil {
+    defer e.working.started(j)()
+  }
+
+  stopWatchdog := e.watchdog(j, cancel)
+  defer stopWatchdog()
+
+  plan := e.plan(j, probed)
+
+  if e.dryRun {
+    e.logDryRun(j, plan)
+    j.finish(JobDone, nil)
+    return
+  }
+
+  e.audit.started(j)
+
+  // with the skip policy there is no point encoding what is already there
+  if e.collisions == CollisionSkip {
+    if existing := e.existingOutputs(j, plan); existing != nil {
+      // a same-named output can be another input's, this one is kept then
+      if !e.madeFrom(j, existing) {
+        logger.Warn("Outputs of the same names already in finished, skipping and keeping the input", "outputs", existing)
+        e.complete(j, JobCancelled, fmt.Errorf("outputs of another input already in finished: %s", strings.Join(existing, ", ")))
+        return
+      }
+
+      logger.Info("Outputs already in finished, skipping", "outputs", existing)
+
+      j.mu.Lock()
+      j.outputs = existing
+      j.outputBytes = totalSize(existing)
+      j.mu.Unlock()
+      e.complete(j, JobDone, nil)
+
+      if _, err = e.disposeOriginal(j); err != nil {
+        logger.Error("Could not dispose of original", "policy", e.originals, "error", err)
+      }
+
+      return
+    }
+  }
+
+  // ffmpeg's own output goes to the job's log file, the main log only gets
+  // a summary
+  var output io.Writer = jobLog
+
+  if logFile, err := e.logs.create(j, jobLog); err != nil {
+    logger.Warn("Could not create job log", "error", err)
+  } else {
+    defer logFile.Close()
+    output = io.MultiWriter(logFile, jobLog)
+
+    j.mu.Lock()
+    j.logPath = logFile.Name()
+    j.mu.Unlock()
+  }
+
+  // the job's working files are in a directory named after its ULID, an
+  // input of the same name cannot overwrite them
+  // a destination that cannot be opened fails the job before the encode
+  upload, deleteLocal, err := e.destination(j)
+
+  if err != nil {
+    logger.Error("Could not open the profile's destination", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  if err := e.createJobDir(j); err != nil {
+    logger.Error("Could not create the job's working directory", "error", err)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  defer os.RemoveAll(e.jobDir(j))
+
+  names := e.finishing.reserve(j, plan, func(out string) string { return e.finishedPath(j, out) })
+  defer e.finishing.release(j)
+
+  e.stats.encodesInProgress.Add(1)
+  encodeStarted := time.Now()
+
+  endEncode := e.telemetry.phase(j, "encode", stringAttr("gowatcher.profile", j.profile.Name))
+  working, err := e.runPlan(ctx, j, plan, output, duration)
+  endEncode(err)
+
+  // a failed hardware encode gets one more try with the software flags
+  if err != nil && ctx.Err() == nil && plan.hardware {
+    logger.Warn("Hardware encode failed, retrying with software flags", "error", err, "reason", lastLine(jobLog.Bytes()))
+    j.software = true
+
+    // the software encode counts against the profile's own class
+    if e.resources.reslotWait(ctx, j) {
+      plan = e.plan(j, probed)
+      endEncode = e.telemetry.phase(j, "encode", stringAttr("gowatcher.profile", j.profile.Name), stringAttr("gowatcher.encoder", "software"))
+      working, err = e.runPlan(ctx, j, plan, output, duration)
+      endEncode(err)
+    }
+  }
+
+  // an encode that failed on a corrupt input is tried again more tolerant
+  // of it, see Salvage
+  for err != nil && ctx.Err() == nil {
+    strategy := j.nextSalvage(jobLog.Bytes())
+
+    if strategy == "" {
+      break
+    }
+
+    logger.Warn("Encode failed on a corrupt input, salvaging it", "strategy", strategy, "error", err, "reason", lastLine(jobLog.Bytes()))
+
+    j.mu.Lock()
+    j.degraded = strategy
+    j.mu.Unlock()
+
+    plan = e.plan(j, probed)
+    endEncode = e.telemetry.phase(j, "encode", stringAttr("gowatcher.profile", j.profile.Name), stringAttr("gowatcher.salvage", strategy))
+    working, err = e.runPlan(ctx, j, plan, output, duration)
+    endEncode(err)
+  }
+
+  e.stats.encodesInProgress.Add(-1)
+
+  // a followed input is complete now, its length checks the outputs
+  if err == nil && j.growing {
+    duration, inputBytes = e.grown(j, file)
+  }
+
+  j.mu.Lock()
+  j.encoded = encodeTotals{time: time.Since(encodeStarted), media: duration, frames: j.frames, hardware: plan.hardware}
+  j.mu.Unlock()
+
+  if err != nil && ctx.Err() != nil {
+    if e.stopped(j, ctx) {
+      return
+    }
+
+    // killed by a watchdog, which is a failure
+    err = context.Cause(ctx)
+  }
+
+  // ffmpeg exiting 0 does not guarantee a usable output
+  if err == nil && e.validate {
+    endValidate := e.telemetry.phase(j, "validate")
+    err = e.validateOutputs(plan.checked(working), duration)
+    endValidate(err)
+
+    if err != nil {
+      logger.Error("Output validation failed", "error", err)
+      removeAll(working)
+      e.stats.encodeFinished(time.Since(startedAt), inputBytes, err)
+      e.complete(j, JobFailed, err)
+      return
+    }
+  }
+
+  e.stats.encodeFinished(time.Since(startedAt), inputBytes, err)
+
+  if err != nil {
+    logger.Error("FFMPEG call error", "error", err, "exit_status", exitStatus(err), "reason", lastLine(jobLog.Bytes()), "log", j.logPath)
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  // the watchdog is for ffmpeg, a large move to another filesystem or an
+  // upload can take a while
+  stopWatchdog()
+
+  // move files from workingDirAbs to finsihedDirAbs
+  finished := make([]string, 0, len(working))
+  var moved []string
+  endMove := e.telemetry.phase(j, "move")
+
+  for _, workingFilepath := range working {
+    finishedFilePath, ok, err := e.moveFinished(ctx, j, workingFilepath, names)
+
+    if err != nil {
+      endMove(err)
+      removeAll(working)
+
+      // the outputs moved already would look like the whole job downstream,
+      // those kept for a collision were there before it
+      for _, path := range moved {
+        e.audit.deleting(j, path, "move failed")
+      }
+
+      removeAll(moved)
+
+      // a slow move to another filesystem can be cancelled
+      if ctx.Err() != nil && e.stopped(j, ctx) {
+        return
+      }
+
+      logger.Error("Could not move to finished", "from", workingFilepath, "to", finishedFilePath, "error", err)
+      e.complete(j, JobFailed, err)
+      return
+    }
+
+    finished = append(finished, finishedFilePath)
+
+    if ok {
+      moved = append(moved, finishedFilePath)
+    }
+  }
+
+  endMove(nil)
+
+  j.mu.Lock()
+  j.outputs = finished
+  j.outputBytes = totalSize(finished)
+  j.mu.Unlock()
+
+  var thumbs []string
+
+  if e.thumbnails != nil {
+    endThumbnails := e.telemetry.phase(j, "thumbnails")
+    thumbs = e.makeThumbnails(ctx, j, finished, duration, output)
+    endThumbnails(nil)
+
+    j.mu.Lock()
+    j.thumbnails = thumbs
+    j.mu.Unlock()
+  }
+
+  var probeReports []string
+
+  if m := j.profile.Metadata; m != nil && m.ProbeReport {
+    probeReports = e.writeProbeReports(j, finished)
+  }
+
+  var sums []string
+
+  if e.checksums {
+    sums = writeChecksums(j, finished)
+  }
+
+  reports := concat(probeReports, sums)
+
+  // the companions go with the outputs, a post hook gets the copies
+  companions := e.copyCompanions(j, finished)
+  reports = concat(reports, companions)
+
+  for _, path := range concat(thumbs, reports) {
+    if err := setOwnership(path, e.outputOwner, e.outputMode); err != nil {
+      logger.Warn("Could not set ownership", "file", path, "error", err)
+    }
+  }
+
+  // the manifest lists everything else, so it comes last
+  if e.manifests {
+    manifest := e.writeManifest(j, manifestFiles{outputs: finished, thumbnails: thumbs, reports: probeReports, checksums: sums, companions: companions})
+
+    if manifest != "" && e.manifestDir == "" {
+      reports = append(reports, manifest)
+    }
+  }
+
+  if upload != nil {
+    endUpload := e.telemetry.phase(j, "upload")
+    uploads, err := e.uploadOutputs(ctx, j, upload, concat(concat(finished, thumbs), reports))
+    endUpload(err)
+
+    if err != nil {
+      if ctx.Err() != nil && e.stopped(j, ctx) {
+        return
+      }
+
+      // the outputs stay in finished, requeueing encodes them again
+      logger.Error("Upload failed", "to", upload.location(""), "error", err)
+      e.complete(j, JobFailed, fmt.Errorf("upload: %s", err))
+      return
+    }
+
+    j.mu.Lock()
+    j.uploads = uploads
+    j.mu.Unlock()
+
+    if !deleteLocal && e.uploaded != nil {
+      if err = e.uploaded.record(concat(concat(finished, thumbs), reports)); err != nil {
+        logger.Warn("Could not record the uploaded outputs, they are not pruned", "error", err)
+      }
+    }
+  }
+
+  // a failing post hook leaves the outputs in finished and the input where
+  // it is so the job can be requeued
+  if err = e.runPostHook(ctx, j, finished, companions, time.Since(startedAt), output); err != nil {
+    if ctx.Err() != nil && e.stopped(j, ctx) {
+      return
+    }
+
+    e.complete(j, JobFailed, err)
+    return
+  }
+
+  if upload != nil && deleteLocal {
+    for _, path := range concat(concat(finished, thumbs), reports) {
+      e.audit.deleting(j, path, "uploaded")
+    }
+
+    removeAll(finished)
+    removeAll(thumbs)
+    removeAll(reports)
+  }
+
+  e.complete(j, JobDone, nil)
+
+  if degraded := j.degradedBy(); degraded != "" {
+    logger.Warn("Finished degraded, the input is corrupt", "outputs", finished, "took", time.Since(startedAt).Round(time.Second).String(), "salvage", degraded)
+  } else {
+    logger.Info("Finished", "outputs", finished, "took", time.Since(startedAt).Round(time.Second).String())
+  }
+
+  // delete, keep or archive the queue original file
+  original, err := e.disposeOriginal(j)
+
+  if err != nil {
+    logger.Error("Could not dispose of original", "policy", e.originals, "error", err)
+  }
+
+  e.encodes.record(j, original, e.profiles.Load())
+}
+
+// watchdog cancels the job once it runs past the job timeout, or when its
+// progress has not moved for the stall timeout. The returned func stops it
+func (e *encoder) watchdog(j *Job, cancel context.CancelCauseFunc) func() {
+  stop := make(chan struct{})
+
+  if e.jobTimeout <= 0 && e.stallTimeout <= 0 {
+    return func() {}
+  }
+
+  go func() {
+    var deadline <-chan time.Time
+
+    if e.jobTimeout > 0 {
+      timer := time.NewTimer(e.jobTimeout)
+      defer timer.Stop()
+      deadline = timer.C
+    }
+
+    var check <-chan time.Time
+
+    if e.stallTimeout > 0 {
+      ticker := time.NewTicker(min(e.stallTimeout/4, 10*time.Second))
+      defer ticker.Stop()
+      check = ticker.C
+    }
+
+    for {
+      select {
+      case <-deadline:
+        j.logger().Error("Job timeout exceeded, killing ffmpeg", "timeout", e.jobTimeout.String())
+        cancel(errJobTimeout)
+        return
+      case <-check:
+        j.mu.Lock()
+        prog := j.progress
+        j.mu.Unlock()
+
+        if prog != nil && prog.idle() > e.stallTimeout {
+          j.logger().Error("No progress, killing ffmpeg", "stalled_for", prog.idle().Round(time.Second).String())
+          cancel(errStalled)
+          return
+        }
+      case <-stop:
+        return
+      }
+    }
+  }()
+
+  var once sync.Once
+
+  return func() { once.Do(func() { close(stop) }) }
+}
+
+// runPlan runs every ffmpeg of the plan in turn, returning the working
+// outputs it produced. On failure they are removed again, the artifacts
+// encoded are kept for the next encode, see ArtifactView
+func (e *encoder) runPlan(ctx context.Context, j *Job, plan encodePlan, output io.Writer, duration time.Duration) ([]string, error) {
+  logger := j.logger()
+  working := make([]string, 0)
+  artifacts := plan.artifactRuns()
+  failed := make(map[string]error)
+  done := make(map[string]bool)
+
+  j.mu.Lock()
+  j.artifacts = nil
+  j.mu.Unlock()
+
+  var err error
+
+  // a split input is encoded in pieces first, the runs join them
+  if plan.split != nil {
+    err = e.encodePieces(ctx, j, plan.split, output)
+  }
+
+  if plan.loudnorm != nil {
+    var filter string
+
+    if filter, err = e.measureLoudness(ctx, j, plan.loudnorm, output, duration); err == nil {
+      plan = plan.replaceMarker(filter)
+    }
+  }
+
+  for i, run := range plan.runs {
+    if err != nil {
+      break
+    }
+
+    runs := artifacts[run.artifact]
+
+    if run.artifact != "" && (failed[run.artifact] != nil || done[run.artifact]) {
+      continue
+    }
+
+    // an earlier encode that failed may have finished this artifact
+    if run.artifact != "" && i == runs[0] {
+      if outputs := plan.artifactOutputs(runs); reuseArtifact(e.artifactDir(j, plan.pick(runs)), outputs) {
+        logger.Info("Reusing output of an earlier encode", "artifact", run.artifact, "outputs", outputs)
+        working = append(working, outputs...)
+        done[run.artifact] = true
+        j.setArtifact(run.artifact, artifactReused, nil)
+        continue
+      }
+    }
+
+    working = append(working, run.outputs...)
+
+    var runErr error
+
+    if run.program != "" {
+      logger.Info("Command", "step", run.name, "program", run.program, "args", run.args)
+      runErr = e.runProgram(ctx, j, run, output)
+    } else if run.resume != nil {
+      runErr = e.runResumable(ctx, j, run, output, duration)
+    } else if e.agents.takes(j, run) {
+      runErr = e.runAgent(ctx, j, run, output, run.lasts(duration))
+    } else {
+      logger.Info("Command", "step", run.name, "args", run.args)
+      runErr = e.runFFmpeg(ctx, j, run, output, run.lasts(duration))
+    }
+
+    // an artifact failing leaves the others to finish, a stopped job does
+    // not go on
+    if run.artifact == "" || ctx.Err() != nil {
+      err = runErr
+      continue
+    }
+
+    outputs := plan.artifactOutputs(runs)
+
+    if runErr == nil && i == runs[len(runs)-1] && e.validate {
+      runErr = e.validateOutputs(plan.validated(runs, duration))
+    }
+
+    if runErr != nil {
+      logger.Error("Output failed, encoding the others", "artifact", run.artifact, "error", runErr)
+      failed[run.artifact] = runErr
+      j.setArtifact(run.artifact, artifactFailed, runErr)
+      removeAll(outputs)
+      working = slices.DeleteFunc(working, func(out string) bool { return slices.Contains(outputs, out) })
+    } else if i == runs[len(runs)-1] {
+      done[run.artifact] = true
+      j.setArtifact(run.artifact, artifactEncoded, nil)
+    }
+  }
+
+  if err == nil && len(failed) > 0 {
+    err = artifactsFailed(plan, failed)
+  }
+
+  // what was finished is kept for the next encode of the input
+  if err != nil {
+    for name, runs := range artifacts {
+      if !done[name] {
+        continue
+      }
+
+      outputs := plan.artifactOutputs(runs)
+
+      if keepErr := keepArtifact(e.artifactDir(j, plan.pick(runs)), outputs); keepErr != nil {
+        logger.Warn("Could not keep output for the next encode", "artifact", name, "error", keepErr)
+      }
+    }
+  }
+
+  if err == nil && plan.finalize != nil {
+    if err = plan.finalize(); err != nil {
+      logger.Error("Could not finalize outputs", "error", err)
+    }
+  }
+
+  plan.removeTemp()
+
+  if err != nil {
+    removeAll(working)
+    return nil, err
+  }
+
+  return working, nil
+}
+
+// encodePlan is the work needed to produce every output of a job
+type encodePlan struct {
+  runs []ffmpegRun
+
+  // hardware is set when the runs use the profile's hardware flags
+  hardware bool
+
+  // split is set when the input is encoded in pieces before the runs
+  split *splitPlan
+
+  // loudnorm is set when the runs wait for the input's loudness to be
+  // measured
+  loudnorm *Loudnorm
+
+  // unchecked are outputs validation leaves alone, like a pipeline's
+  // thumbnails
+  unchecked []string
+
+  // finalize runs after the last ffmpeg succeeds, e.g. to write a playlist
+  finalize func() error
+
+  // temp are glob patterns of scratch files, like two-pass logs, removed
+  // once the job is over whatever the outcome
+  temp []string
+}
+
+// checked are the working outputs validation looks at
+func (p encodePlan) checked(working []string) []string {
+  checked := make([]string, 0, len(working))
+
+  for _, out := range working {
+    if !slices.Contains(p.unchecked, out) {
+      checked = append(checked, out)
+    }
+  }
+
+  return checked
+}
+
+// removeTemp removes the plan's scratch files
+func (p encodePlan) removeTemp() {
+  for _, pattern := range p.temp {
+    matches, _ := filepath.Glob(pattern)
+    removeAll(matches)
+  }
+}
+
+// plan works out the ffmpeg invocations that produce every output of the
+// job's profile, then the subtitles' extraction. With loudnorm they wait for the measuring pass, inputs
+// ffprobe finds no audio in get a filter that does nothing instead
+func (e *encoder) plan(j *Job, probed *probeResult) encodePlan {
+  plan := e.planRuns(j, probed)
+
+  if j.profile.Subtitles == SubtitlesExtract {
+    if probed == nil {
+      j.logger().Warn("Extracting subtitles needs ffprobe")
+    } else if run := e.subtitleRun(j, probed); run != nil {
+      run.artifact = "subtitles"
+      plan.runs = append(plan.runs, *run)
+      plan.unchecked = append(plan.unchecked, run.outputs...)
+    }
+  }
+
+  plan.dropLoneArtifact()
+
+  if j.profile.Loudnorm == nil || !plan.hasMarker() {
+    return plan
+  }
+
+  if probed != nil && len(probed.streams("audio")) == 0 {
+    return plan.replaceMarker("anull")
+  }
+
+  plan.loudnorm = j.profile.Loudnorm
+
+  return plan
+}
+
+// planRemux plans copying the compliant input's streams, all of them and
+// its chapters, into the output container. It is not ok when the container
+// cannot take them, the input is encoded then
+func (e *encoder) planRemux(j *Job, probed *probeResult, r Rendition) (encodePlan, bool) {
+  out := filepath.Join(e.jobDir(j), j.profile.outputName(j.name, r, probed, j.startedAt))
+
+  if !j.profile.carries(probed, filepath.Ext(out)) {
+    j.logger().Info("Input codecs already compliant, encoding it as the container cannot take its other streams")
+    return encodePlan{}, false
+  }
+
+  j.logger().Info("Input codecs already compliant, remuxing")
+
+  salvageInput, salvageOutput := j.salvageFlags()
+  copyFlags := []string{"-map", "0", "-map_chapters", "0", "-c", "copy"}
+
+  // extracted subtitles are next to the output instead
+  if j.profile.Subtitles == SubtitlesExtract {
+    copyFlags = append(copyFlags, "-sn")
+  }
+
+  return encodePlan{runs: []ffmpegRun{{
+    name:    "remux",
+    args:    append(append(append(append(append(append(concat(salvageInput, j.sequenceFlags()), e.followFlags(j)...), "-i", j.source()), copyFlags...), e.metadataFlags(j, probed, 0)...), salvageOutput...), out),
+    outputs: []string{out},
+  }}}, true
+}
+
+// planRuns plans the job's runs, with the loudnorm marker in their flags
+func (e *encoder) planRuns(j *Job, probed *probeResult) encodePlan {
+  file := j.source()
+  prof := j.profile
+  renditions := e.renditions(j, probed)
+  inputFlags, outputFlags, hardware := e.flags(j, probed)
+
+  if prof.Packaging != "" {
+    return e.planPackage(j, probed)
+  }
+
+  if len(prof.pipeline()) > 0 {
+    return e.planPipeline(j, probed)
+  }
+
+  if j.spec != nil && len(j.spec.Clips) > 0 {
+    return e.planClips(j, probed)
+  }
+
+  if j.degradedBy() == salvageCopy {
+    return e.planSalvageCopy(j, probed)
+  }
+
+  // inputs that already have the target codecs only need a new container
+  if len(renditions) == 1 && probed != nil && prof.compliant(probed) {
+    if plan, ok := e.planRemux(j, probed, renditions[0]); ok {
+      return plan
+    }
+  }
+
+  // long inputs may be encoded in pieces, but not trimmed ones
+  if probed != nil && !j.growing && prof.splits(probed.duration()) && (j.spec == nil || (j.spec.start == 0 && j.spec.end == 0)) {
+    return e.planSplit(j, probed)
+  }
+
+  // in parallel every rendition is written by a single ffmpeg, which only
+  // decodes the input once. Two-pass renditions are always run in turn
+  if prof.Parallel && !prof.TwoPass && len(renditions) > 1 {
+    run := ffmpegRun{name: "all renditions"}
+    run.args = append(run.args, inputFlags...)
+    run.args = append(run.args, "-i", file)
+
+    for _, r := range renditions {
+      out := filepath.Join(e.jobDir(j), prof.outputName(j.name, r, probed, j.startedAt))
+      run.args = append(run.args, outputFlags...)
+      run.args = append(run.args, r.OutputFlags...)
+      run.args = append(run.args, out)
+      run.outputs = append(run.outputs, out)
+    }
+
+    return encodePlan{runs: []ffmpegRun{run}, hardware: hardware}
+  }
+
+  plan := encodePlan{hardware: hardware}
+  artifacts := make(map[string]bool)
+
+  for i, r := range renditions {
+    out := filepath.Join(e.jobDir(j), prof.outputName(j.name, r, probed, j.startedAt))
+
+    // each rendition encoded in turn can fail and be reused on its own
+    artifact := r.Name
+
+    if artifact == "" || artifacts[artifact] {
+      artifact = fmt.Sprintf("rendition %d", i+1)
+    }
+
+    artifacts[artifact] = true
+
+    // there is no bitrate to spread over an audio-only output's video
+    if prof.TwoPass && !r.AudioOnly {
+      passLog := filepath.Join(e.jobDir(j), fmt.Sprintf("%d-passlog", i))
+
+      for _, run := range twoPassRuns(inputFlags, outputFlags, file, r, out, passLog) {
+        run.artifact = artifact
+        plan.runs = append(plan.runs, run)
+      }
+
+      plan.temp = append(plan.temp, passLog+"*")
+      continue
+    }
+
+    if e.resumes(j) {
+      run := e.resumableRun(j, i, r, probed, inputFlags, outputFlags, out)
+      run.artifact = artifact
+      plan.runs = append(plan.runs, run)
+      continue
+    }
+
+    run := ffmpegRun{name: r.Name, outputs: []string{out}, artifact: artifact}
+    run.args = append(run.args, inputFlags...)
+    run.args = append(run.args, "-i", file)
+    run.args = append(run.args, outputFlags...)
+    run.args = append(run.args, r.OutputFlags...)
+    run.args = append(run.args, out)
+
+    plan.runs = append(plan.runs, run)
+  }
+
+  return plan
+}
+
+// flags are the job's profile flags with the process limits' thread count,
+// the subtitle, watermark and metadata flags and the loudnorm marker
+func (e *encoder) flags(j *Job, probed *probeResult) (input []string, output []string, hardware bool) {
+  input, output, hardware = j.profile.flags(j.software)
+
+  if hasFlagVariables(input) || hasFlagVariables(output) {
+    vars := flagVars(j, probed)
+    input, output = expandFlags(j, input, vars), expandFlags(j, output, vars)
+  }
+
+  salvageInput, salvageOutput := j.salvageFlags()
+  input = concat(concat(salvageInput, j.sequenceFlags()), withDevice(input, j.device()))
+  input, output = e.limits.withThreads(input, output)
+  input = append(input, e.followFlags(j)...)
+
+  output = j.profile.withSubtitles(output, j.input)
+
+  // deinterlacing runs ahead of the profile's own video filters
+  if filter := j.profile.deinterlaceFilter(probed); filter != "" {
+    output = withDeinterlace(output, filter)
+  }
+
+  if w := j.profile.Watermark; w != nil {
+    output = w.apply(output)
+  }
+  output = append(output, e.metadataFlags(j, probed, 0)...)
+  output = append(output, salvageOutput...)
+
+  if j.profile.Loudnorm != nil {
+    output = withFilter(output, loudnormMarker, "-af", "-filter:a")
+  }
+
+  return input, output, hardware
+}
+
+// withDevice passes a device node the job was given to ffmpeg with
+// -hwaccel_device, unless the input flags name a device themselves. A GPU
+// index is set in the environment instead, see Job.env
+func withDevice(input []string, device string) []string {
+  if device == "" || !isDevicePath(device) {
+    return input
+  }
+
+  for _, flag := range input {
+    switch flag {
+    case "-hwaccel_device", "-vaapi_device", "-qsv_device", "-init_hw_device":
+      return input
+    }
+  }
+
+  return append([]string{"-hwaccel_device", device}, input...)
+}
+
+// twoPassRuns analyses the input into passLog with a first pass that
+// discards its output, then encodes out using that analysis
+func twoPassRuns(inputFlags []string, outputFlags []string, file string, r Rendition, out string, passLog string) []ffmpegRun {
+  first := ffmpegRun{name: r.Name + " pass 1"}
+  first.args = append(first.args, inputFlags...)
+  first.args = append(first.args, "-i", file)
+  first.args = append(first.args, outputFlags...)
+  first.args = append(first.args, r.OutputFlags...)
+  first.args = append(first.args, "-pass", "1", "-passlogfile", passLog, "-an", "-f", "null", "-y", os.DevNull)
+
+  second := ffmpegRun{name: r.Name + " pass 2", outputs: []string{out}}
+  second.args = append(second.args, inputFlags...)
+  second.args = append(second.args, "-i", file)
+  second.args = append(second.args, outputFlags...)
+  second.args = append(second.args, r.OutputFlags...)
+  second.args = append(second.args, "-pass", "2", "-passlogfile", passLog, out)
+
+  return []ffmpegRun{first, second}
+}
+
+// removeAll removes files and package directories, ignoring any that do
+// not exist
+func removeAll(files []string) {
+  for _, file := range files {
+    _ = os.RemoveAll(file)
+  }
+}
+
+// complete moves the job into its final state and sends notifications
+func (e *encoder) complete(j *Job, state JobState, err error) {
+  if e.dryRun {
+    j.finish(state, err)
+    return
+  }
+
+  e.audit.completed(j, state, err)
+
+  policy := FailurePolicy{Action: failFail}
+
+  // the outputs of a job its post hook failed are delivered already, a
+  // retry would encode over them and the input must stay to requeue it
+  delivered := errors.Is(err, errPostHook)
+
+  if state == JobFailed && !delivered {
+    var log []byte
+
+    if j.log != nil {
+      log = j.log.Bytes()
+    }
+
+    class := classifyFailure(err, log)
+    policy = e.failurePolicy(class)
+
+    j.mu.Lock()
+    j.failure = class
+    retries := j.retries
+    j.mu.Unlock()
+
+    if policy.Action == failRetry && retries < policy.Attempts {
+      e.retryLater(j, err, class, policy)
+      e.logs.prune()
+      return
+    }
+
+    if policy.Action == failQuarantine {
+      if moveErr := e.quarantine(j, class, err, log); moveErr != nil {
+        j.logger().Error("Could not quarantine failed input", "dir", e.quarantineDir, "error", moveErr)
+      }
+    }
+  }
+
+  if state == JobFailed && e.failedDir != "" && policy.Action != failQuarantine && !delivered {
+    if moveErr := e.moveFailed(j); moveErr != nil {
+      j.logger().Error("Could not move failed input", "dir", e.failedDir, "error", moveErr)
+    }
+  }
+
+  if state == JobDone {
+    e.recordLedger(j)
+  }
+
+  j.finish(state, err)
+  e.logs.prune()
+
+  if stats := newJobStats(j); stats != nil {
+    e.history.record(*stats)
+  }
+
+  if len(e.handlers) > 0 || len(e.notifiers) > 0 {
+    ev := newJobEvent(j, err)
+
+    for _, h := range e.handlers {
+      h.HandleEvent(ev)
+    }
+
+    for _, n := range e.notifiers {
+      if state == JobDone {
+        n.JobFinished(ev)
+      } else {
+        n.JobFailed(ev)
+      }
+    }
+  }
+}
+
+// stopped ends a running job whose context was cancelled by a shutdown or
+// through the control API, and reports whether it was. A watchdog's cancel
+// is a failure for the caller
+func (e *encoder) stopped(j *Job, ctx context.Context) bool {
+  switch cause := context.Cause(ctx); cause {
+  case errShutdown:
+    j.logger().Warn("Aborted by shutdown")
+    j.finish(JobCancelled, errShutdown)
+  case errCancelled, errInputRemoved:
+    j.logger().Warn("Cancelled", "reason", cause)
+    e.cancelled(j, cause)
+  default:
+    return false
+  }
+
+  return true
+}
+
+// cancelled ends a job that stopped for cause as the control API asked
+func (e *encoder) cancelled(j *Job, cause error) {
+  j.mu.Lock()
+  then := j.cancelThen
+  j.cancelThen = ""
+  j.mu.Unlock()
+
+  if cause != errCancelled {
+    then = CancelStop
+  }
+
+  switch then {
+  case CancelFail:
+    e.complete(j, JobFailed, cause)
+  case CancelRequeue:
+    j.finish(JobCancelled, cause)
+
+    if err := requeueJob(e.queue, j); err != nil {
+      j.logger().Error("Could not requeue cancelled job", "error", err)
+      return
+    }
+
+    e.stats.filesQueued.Add(1)
+    j.logger().Info("Requeued cancelled job")
+  default:
+    j.finish(JobCancelled, cause)
+  }
+}
+
+// cancel stops a job whether it is waiting in the queue or running, and
+// then does with it as then says
+func (e *encoder) cancel(j *Job, then CancelAction) error {
+  switch then {
+  case "":
+    then = CancelStop
+  case CancelStop, CancelRequeue, CancelFail:
+  default:
+    return fmt.Errorf("then must be stop, requeue or fail, not %q", then)
+  }
+
+  if then == CancelRequeue && j.State() != JobRunning {
+    return fmt.Errorf("job %d is %s, only a running job can be requeued", j.id, j.State())
+  }
+
+  // a job that has not started ends straight away
+  stop := func() {
+    if then == CancelFail {
+      e.complete(j, JobFailed, errCancelled)
+    } else {
+      j.finish(JobCancelled, errCancelled)
+    }
+  }
+
+  if e.queue.remove(j) {
+    stop()
+    return nil
+  }
+
+  j.mu.Lock()
+
+  switch {
+  case j.state == JobQueued:
+    // popped by a worker but not started yet, the worker will skip it
+    j.state = JobCancelled
+    j.mu.Unlock()
+    stop()
+
+    return nil
+  case j.state != JobRunning || j.cancel == nil:
+    j.mu.Unlock()
+    return fmt.Errorf("job %d is %s", j.id, j.state)
+  }
+
+  j.cancelThen = then
+  j.cancel(errCancelled)
+  j.mu.Unlock()
+
+  return nil
+}
+
+// stopJob cancels a job for cause
+func stopJob(q *jobQueue, j *Job, cause error) error {
+  if q.remove(j) {
+    j.finish(JobCancelled, cause)
+    return nil
+  }
+
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.state == JobQueued {
+    // popped by a worker but not started yet, the worker will skip it
+    j.state = JobCancelled
+    j.err = cause.Error()
+    j.finishedAt = time.Now()
+    return nil
+  }
+
+  if j.state != JobRunning || j.cancel == nil {
+    return fmt.Errorf("job %d is %s", j.id, j.state)
+  }
+
+  j.cancel(cause)
+
+  return nil
+}
+
+// requeueJob puts a failed or cancelled job back on the queue
+func requeueJob(q *jobQueue, j *Job) error {
+  j.mu.Lock()
+
+  if j.state != JobFailed && j.state != JobCancelled {
+    state := j.state
+    j.mu.Unlock()
+    return fmt.Errorf("job %d is %s", j.id, state)
+  }
+
+  if _, err := os.Stat(j.input); err != nil {
+    j.mu.Unlock()
+    return fmt.Errorf("job %d input: %s", j.id, err)
+  }
+
+  j.state = JobQueued
+  j.software = false
+  j.degraded = ""
+  j.failure = ""
+  j.retryAt = time.Time{}
+  j.forced = true
+  j.uploads = nil
+  j.thumbnails = nil
+  j.err = ""
+  j.queuedAt = time.Now()
+  j.startedAt = time.Time{}
+  j.finishedAt = time.Time{}
+  j.progress = nil
+  j.frames = 0
+  j.encoded = encodeTotals{}
+  j.stats = nil
+  j.mu.Unlock()
+
+  j.publish("queued")
+  q.push(j)
+
+  return nil
+}
@@ -0,0 +1,244 @@
+package watcher
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// StreamEvent is one event on GET /events: queued, started, progress, and
+// finished, failed or cancelled when the job ends. Job is the job as it was
+// at the time
+type StreamEvent struct {
+  Event string    `json:"event"`
+  Time  time.Time `json:"time"`
+  Job   JobView   `json:"job"`
+}
+
+// streamBuffer is how many events a subscriber can fall behind by, a
+// client slower than that misses events rather than holding up the jobs
+const streamBuffer = 256
+
+// streamProgress is how often the stream sends the progress of the running
+// jobs, and streamKeepAlive how often an idle one sends a comment so
+// proxies do not close it
+const (
+  streamProgress  = time.Second
+  streamKeepAlive = 15 * time.Second
+)
+
+// jobEvents sends job changes to the API's subscribers
+type jobEvents struct {
+  mu   sync.Mutex
+  subs map[chan StreamEvent]struct{}
+
+  // notifiers hear of jobs being queued and started here, how they end
+  // from the encoder
+  notifiers []Notifier
+}
+
+func newJobEvents() *jobEvents {
+  return &jobEvents{subs: make(map[chan StreamEvent]struct{})}
+}
+
+// subscribe returns a channel of the events from now on, the returned func
+// stops them
+func (e *jobEvents) subscribe() (<-chan StreamEvent, func()) {
+  ch := make(chan StreamEvent, streamBuffer)
+
+  e.mu.Lock()
+  e.subs[ch] = struct{}{}
+  e.mu.Unlock()
+
+  return ch, func() {
+    e.mu.Lock()
+    delete(e.subs, ch)
+    e.mu.Unlock()
+  }
+}
+
+// publish tells every subscriber about the job, it must not be called with
+// the job's lock held
+func (e *jobEvents) publish(event string, j *Job) {
+  if e == nil {
+    return
+  }
+
+  e.notify(event, j)
+
+  e.mu.Lock()
+  defer e.mu.Unlock()
+
+  if len(e.subs) == 0 {
+    return
+  }
+
+  ev := StreamEvent{Event: event, Time: time.Now(), Job: j.View()}
+
+  for ch := range e.subs {
+    select {
+    case ch <- ev:
+    default:
+    }
+  }
+}
+
+// notify tells the notifiers about a job that was queued or started
+func (e *jobEvents) notify(event string, j *Job) {
+  if len(e.notifiers) == 0 || (event != "queued" && event != "started") {
+    return
+  }
+
+  ev := newJobEvent(j, nil)
+  ev.Event, ev.DurationSeconds = event, 0
+
+  for _, n := range e.notifiers {
+    if event == "queued" {
+      n.JobQueued(ev)
+    } else {
+      n.JobStarted(ev)
+    }
+  }
+}
+
+// publish sends the job's event to the API's subscribers
+func (j *Job) publish(event string) {
+  j.events.publish(event, j)
+}
+
+// endEvent is the event for a job that ended in state
+func endEvent(state JobState) string {
+  switch state {
+  case JobDone:
+    return "finished"
+  case JobFailed:
+    return "failed"
+  }
+
+  return "cancelled"
+}
+
+// events streams StreamEvents as server-sent events, each one's name is its
+// event. ?job=id only sends that job's. The running jobs' progress is sent
+// every streamProgress while it moves
+func (a *api) events(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  var only int64
+
+  if id := r.URL.Query().Get("job"); id != "" {
+    var err error
+
+    if only, err = strconv.ParseInt(id, 10, 64); err != nil {
+      writeError(w, http.StatusBadRequest, "invalid job id")
+      return
+    }
+  }
+
+  flusher, ok := w.(http.Flusher)
+
+  if !ok {
+    writeError(w, http.StatusInternalServerError, "streaming is not supported")
+    return
+  }
+
+  // subscribed before the response starts, so the client misses nothing
+  // from then on
+  events, unsubscribe := a.w.store.events.subscribe()
+  defer unsubscribe()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.Header().Set("X-Accel-Buffering", "no")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+
+  send := func(ev StreamEvent) bool {
+    data, err := json.Marshal(ev)
+
+    if err != nil {
+      return true
+    }
+
+    if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, data); err != nil {
+      return false
+    }
+
+    flusher.Flush()
+
+    return true
+  }
+
+  keepAlive := func() bool {
+    if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+      return false
+    }
+
+    flusher.Flush()
+
+    return true
+  }
+
+  a.w.watchEvents(events, r.Context().Done(), only, send, keepAlive)
+}
+
+// watchEvents calls send with the subscription's events of job only, or of
+// every job when it is 0, and the running jobs' progress every
+// streamProgress while it moves, idle every streamKeepAlive. It returns when
+// done is closed, send or idle returns false or the watcher stops, true for
+// the last
+func (w *Watcher) watchEvents(events <-chan StreamEvent, done <-chan struct{}, only int64, send func(StreamEvent) bool, idle func() bool) bool {
+  filtered := func(ev StreamEvent) bool {
+    return (only != 0 && ev.Job.ID != only) || send(ev)
+  }
+
+  progress := time.NewTicker(streamProgress)
+  defer progress.Stop()
+
+  keepAlive := time.NewTicker(streamKeepAlive)
+  defer keepAlive.Stop()
+
+  // the progress last sent for each running job, so a stalled one is quiet
+  sent := make(map[int64]string)
+
+  for {
+    select {
+    case ev := <-events:
+      if !filtered(ev) {
+        return false
+      }
+    case <-progress.C:
+      running := make(map[int64]string)
+
+      for _, j := range w.store.list(JobRunning) {
+        v := j.View()
+
+        if v.Progress == "" {
+          continue
+        }
+
+        running[v.ID] = v.Progress
+
+        if sent[v.ID] != v.Progress && !filtered(StreamEvent{Event: "progress", Time: time.Now(), Job: v}) {
+          return false
+        }
+      }
+
+      sent = running
+    case <-keepAlive.C:
+      if !idle() {
+        return false
+      }
+    case <-w.stopRescan:
+      return true
+    case <-done:
+      return false
+    }
+  }
+}
@@ -0,0 +1,211 @@
+package watcher
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "os"
+  "os/exec"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// FailureClass is what kind of failure ended a job, see classifyFailure
+type FailureClass string
+
+const (
+  // FailureNotFound is an input, or a file the profile names, that is not
+  // there
+  FailureNotFound FailureClass = "not_found"
+
+  // FailureUnsupported is a codec, format or option ffmpeg does not have
+  FailureUnsupported FailureClass = "unsupported"
+
+  // FailureDiskFull is a volume or quota out of space
+  FailureDiskFull FailureClass = "disk_full"
+
+  // FailureKilled is ffmpeg killed by a signal, by the OOM killer or a
+  // watchdog say
+  FailureKilled FailureClass = "killed"
+
+  // FailureError is any other failure
+  FailureError FailureClass = "error"
+)
+
+// FailureClasses are the classes in the order they are told apart
+var FailureClasses = []FailureClass{FailureDiskFull, FailureUnsupported, FailureNotFound, FailureKilled, FailureError}
+
+// failureAction is what a FailurePolicy does with a failed job
+const (
+  failFail       = "fail"
+  failRetry      = "retry"
+  failQuarantine = "quarantine"
+)
+
+const (
+  defaultRetryAttempts = 3
+  defaultRetryDelay    = time.Minute
+)
+
+// failurePatterns are what in ffmpeg's output marks a class
+var failurePatterns = map[FailureClass][]string{
+  FailureDiskFull: {"No space left on device", "Disk quota exceeded", "not enough space on the disk"},
+  FailureUnsupported: {
+    "Unknown encoder", "Unknown decoder", "Encoder not found", "Decoder not found",
+    "Unsupported codec", "not currently supported", "Could not find tag for codec",
+    "Unrecognized option", "Unknown format", "Invalid encoder type", "is not supported",
+  },
+  FailureNotFound: {"No such file or directory", "cannot find the file", "cannot find the path"},
+}
+
+// FailurePolicy is what happens to a job that failed with a class: it
+// fails as it always has, its input going to FailedDir, is retried Attempts
+// times, Delay after the first failure and twice as long after each one
+// after, or is quarantined, its input moved to RejectedDir with a
+// .reason.txt so it is not tried again
+type FailurePolicy struct {
+  Action   string
+  Attempts int
+  Delay    time.Duration
+}
+
+// ParseFailurePolicy parses fail, quarantine, or retry with optional
+// attempts and delay, like retry:5:10m. A retry is 3 attempts a minute
+// apart by default
+func ParseFailurePolicy(value string) (FailurePolicy, error) {
+  parts := strings.Split(strings.TrimSpace(value), ":")
+  p := FailurePolicy{Action: parts[0]}
+
+  switch {
+  case p.Action == failFail || p.Action == failQuarantine:
+    if len(parts) > 1 {
+      return p, fmt.Errorf("%s takes no attempts or delay", p.Action)
+    }
+
+    return p, nil
+  case p.Action != failRetry:
+    return p, fmt.Errorf("%q must be fail, retry or quarantine", value)
+  case len(parts) > 3:
+    return p, fmt.Errorf("%q must be retry:attempts:delay", value)
+  }
+
+  p.Attempts, p.Delay = defaultRetryAttempts, defaultRetryDelay
+
+  if len(parts) > 1 {
+    attempts, err := strconv.Atoi(parts[1])
+
+    if err != nil || attempts <= 0 {
+      return p, fmt.Errorf("%q: attempts must be a positive number", value)
+    }
+
+    p.Attempts = attempts
+  }
+
+  if len(parts) > 2 {
+    delay, err := time.ParseDuration(parts[2])
+
+    if err != nil || delay < 0 {
+      return p, fmt.Errorf("%q: delay is not a valid duration", value)
+    }
+
+    p.Delay = delay
+  }
+
+  return p, nil
+}
+
+// classifyFailure tells what kind of failure err is, with ffmpeg's output
+// in log. ffmpeg's output only counts when it is ffmpeg that failed, an
+// output that ran fine but does not validate keeps its warnings
+func classifyFailure(err error, log []byte) FailureClass {
+  if errors.Is(err, syscall.ENOSPC) {
+    return FailureDiskFull
+  }
+
+  var exitErr *exec.ExitError
+  ran := errors.As(err, &exitErr)
+  text := err.Error()
+
+  for _, class := range []FailureClass{FailureDiskFull, FailureUnsupported, FailureNotFound} {
+    for _, pattern := range failurePatterns[class] {
+      if strings.Contains(text, pattern) || (ran && bytes.Contains(log, []byte(pattern))) {
+        return class
+      }
+    }
+  }
+
+  if errors.Is(err, os.ErrNotExist) {
+    return FailureNotFound
+  }
+
+  // a signal has no exit code, a shell or a container's runtime exits
+  // 128 plus the signal
+  if ran && (exitErr.ExitCode() == -1 || exitErr.ExitCode() == 128+9 || exitErr.ExitCode() == 128+15) {
+    return FailureKilled
+  }
+
+  if errors.Is(err, errStalled) || errors.Is(err, errJobTimeout) {
+    return FailureKilled
+  }
+
+  return FailureError
+}
+
+// failurePolicy is the policy for a class, fail when there is none
+func (e *encoder) failurePolicy(class FailureClass) FailurePolicy {
+  if p, ok := e.failures[class]; ok {
+    return p
+  }
+
+  return FailurePolicy{Action: failFail}
+}
+
+// retryLater fails the job for now and requeues it once the policy's delay
+// is over, doubled for each retry it had. It is not moved to FailedDir and
+// the handlers are not told, the last failure is
+func (e *encoder) retryLater(j *Job, err error, class FailureClass, p FailurePolicy) {
+  j.mu.Lock()
+  attempt := j.retries + 1
+  delay := p.Delay << (attempt - 1)
+  j.retryAt = time.Now().Add(delay)
+  at := j.retryAt
+  j.mu.Unlock()
+
+  j.logger().Warn("Job failed, retrying later", "failure", string(class), "error", err, "attempt", attempt, "of", p.Attempts, "in", delay.String())
+  j.finish(JobFailed, err)
+
+  time.AfterFunc(delay, func() {
+    j.mu.Lock()
+    due := j.retryAt.Equal(at)
+
+    // requeueJob clears retryAt as it queues the job
+    if due {
+      j.retries = attempt
+    }
+
+    j.mu.Unlock()
+
+    // requeued by hand meanwhile
+    if !due || e.ctx.Err() != nil {
+      return
+    }
+
+    if err := requeueJob(e.queue, j); err != nil {
+      j.logger().Error("Could not retry failed job", "error", err)
+      return
+    }
+
+    e.stats.filesQueued.Add(1)
+    j.logger().Info("Retrying failed job", "attempt", attempt)
+  })
+}
+
+// retrying reports whether the failed job is waiting for its retry
+func (j *Job) retrying() bool {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  return !j.retryAt.IsZero()
+}
@@ -0,0 +1,232 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "os"
+  "os/exec"
+  "strings"
+  "time"
+)
+
+// killGrace is how long ffmpeg has to exit after being signalled before it
+// is killed
+const killGrace = 10 * time.Second
+
+// ffmpegRun is one invocation of ffmpeg for a job
+type ffmpegRun struct {
+  // name identifies the run in logs, e.g. the rendition it produces
+  name string
+  args []string
+
+  // outputs are the files the run writes into the working directory,
+  // dirs are created before ffmpeg starts
+  outputs []string
+  dirs    []string
+
+  // program runs instead of ffmpeg for pipeline steps, see pipeline.go.
+  // capture is "stdout" or "stderr" to save that to captureFile
+  program     string
+  capture     string
+  captureFile string
+
+  // progress is set for runs that are part of a larger step, which reports
+  // the job's progress itself. Other runs are the job's progress
+  progress *progress
+
+  // logAtLeast is the quietest log level the run's output still has what
+  // is read from it, like the loudness measurement
+  logAtLeast string
+
+  // resume is set for a rendition encoded in segments that survive a
+  // restart, see resume.go
+  resume *resumeRun
+
+  // artifact names the output the run is part of when it can fail and be
+  // reused on its own, see ArtifactView
+  artifact string
+
+  // clip is set for a run that makes one of the job's clips, see Clip
+  clip *clipRun
+}
+
+// commandArgs are the arguments ffmpeg is run with at a log level. Progress
+// is written as key=value lines to stdout, the periodic stats line on
+// stderr is replaced by our own progress logging
+func (r ffmpegRun) commandArgs(level string) []string {
+  if r.program != "" {
+    return r.args
+  }
+
+  return append(append(r.logFlags(level), "-progress", "pipe:1", "-nostats"), r.args...)
+}
+
+// runFFmpeg runs a single ffmpeg invocation for the job, reporting progress
+// as it goes. ffmpeg's stderr goes to output. Cancelling ctx interrupts
+// ffmpeg, killing it if it does not exit on its own
+func (e *encoder) runFFmpeg(ctx context.Context, j *Job, run ffmpegRun, output io.Writer, duration time.Duration) error {
+  logger := j.logger()
+
+  level, main := e.logLevels(j)
+  args := run.commandArgs(level)
+
+  ffmpegPath := e.ffmpeg(j)
+
+  fmt.Fprintf(output, "%s %s\n\n", ffmpegPath, strings.Join(args, " "))
+
+  for _, dir := range run.dirs {
+    if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+      return err
+    }
+
+    if err := e.runAs.chown(dir); err != nil {
+      return err
+    }
+  }
+
+  prog := run.progress
+
+  if prog == nil {
+    prog = newProgress(duration)
+
+    j.mu.Lock()
+    j.progress = prog
+    j.mu.Unlock()
+  }
+
+  program, programArgs := ffmpegPath, args
+  endSandbox := func(bool) {}
+  env := j.env()
+
+  if e.sandbox != nil {
+    program, programArgs, endSandbox = e.sandbox.wrap(ffmpegPath, args, e.jobMounts(j, run), "gowatcher-"+strings.ToLower(j.uid), e.runAs, env)
+  }
+
+  // ffmpeg's warnings and errors show in the main log too, other programs'
+  // output is only in the job's
+  if run.program == "" && run.capture == "" {
+    output = newFFmpegLog(output, logger, run.name, main)
+  }
+
+  cmd := exec.Command(program, programArgs...)
+  cmd.Stderr = output
+
+  if len(env) > 0 {
+    cmd.Env = append(os.Environ(), env...)
+  }
+
+  if run.captureFile != "" {
+    f, err := os.Create(run.captureFile)
+
+    if err != nil {
+      return err
+    }
+
+    defer f.Close()
+    cmd.Stderr = io.MultiWriter(f, output)
+  }
+
+  prepareInterrupt(cmd)
+  prepareChild(cmd)
+
+  // a container runs as the user itself, its client needs gowatcher's
+  if e.sandbox == nil || !e.sandbox.container() {
+    e.runAs.runAs(cmd)
+  }
+
+  progressPipe, err := cmd.StdoutPipe()
+
+  if err != nil {
+    return err
+  }
+
+  // ffmpeg never runs past the limits, it does not run at all without them
+  cleanup, err := e.limits.start(j, cmd)
+
+  if err != nil {
+    return err
+  }
+
+  defer cleanup()
+  defer e.startedChild(j, cmd.Process, program)()
+
+  exited := make(chan struct{})
+
+  // forward a cancel to ffmpeg as an interrupt, killing it if it does not
+  // exit on its own
+  go func() {
+    select {
+    case <-ctx.Done():
+      if err := interrupt(cmd.Process); err != nil {
+        _ = cmd.Process.Kill()
+        return
+      }
+
+      select {
+      case <-exited:
+      case <-time.After(killGrace):
+        _ = cmd.Process.Kill()
+      }
+    case <-exited:
+    }
+  }()
+
+  progressDone := make(chan struct{})
+
+  go func() {
+    prog.read(progressPipe)
+    close(progressDone)
+  }()
+
+  ticker := time.NewTicker(e.progressInterval)
+
+  go func() {
+    for {
+      select {
+      case <-ticker.C:
+        if run.progress == nil {
+          logger.Info("Progress", "step", run.name, "progress", prog.String())
+        }
+      case <-progressDone:
+        return
+      }
+    }
+  }()
+
+  // the pipe must be drained before Wait closes it
+  <-progressDone
+  err = cmd.Wait()
+  close(exited)
+  ticker.Stop()
+  endSandbox(err != nil)
+
+  if err == nil && ctx.Err() != nil {
+    // ffmpeg exits cleanly on an interrupt, that is still a cancel
+    return ctx.Err()
+  }
+
+  // the job's frames are the ones encoded, not copied or analysed
+  if err == nil && len(run.outputs) > 0 && !run.copiesVideo() {
+    j.mu.Lock()
+    j.frames += prog.frameCount()
+    j.mu.Unlock()
+  }
+
+  return err
+}
+
+// copiesVideo reports whether the run copies the video rather than
+// encoding it, like joining encoded pieces
+func (r ffmpegRun) copiesVideo() bool {
+  for i := 0; i < len(r.args)-1; i++ {
+    switch r.args[i] {
+    case "-c", "-c:v", "-codec", "-codec:v", "-vcodec":
+      if r.args[i+1] == "copy" {
+        return true
+      }
+    }
+  }
+
+  return false
+}
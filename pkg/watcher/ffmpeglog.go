@@ -0,0 +1,155 @@
+package watcher
+
+import (
+  "bytes"
+  "fmt"
+  "io"
+  "log/slog"
+  "strings"
+)
+
+// ffmpegLevels are ffmpeg's -loglevel names, quietest first
+var ffmpegLevels = []string{"quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug", "trace"}
+
+// ffmpeg log level defaults: everything ffmpeg says normally goes to the
+// job's log, its warnings and errors on to the main log
+const (
+  defaultLogLevel     = "info"
+  defaultMainLogLevel = "warning"
+)
+
+// maxMainLines is how many of a run's lines reach the main log, the rest
+// are only in the job's log
+const maxMainLines = 20
+
+// ffmpegLevel is the rank of an ffmpeg log level, higher is more verbose,
+// -1 for a level ffmpeg does not have
+func ffmpegLevel(level string) int {
+  for i, l := range ffmpegLevels {
+    if l == level {
+      return i
+    }
+  }
+
+  return -1
+}
+
+// checkLogLevel rejects a level ffmpeg does not have, empty is the default
+func checkLogLevel(level string) error {
+  if level != "" && ffmpegLevel(level) < 0 {
+    return fmt.Errorf("log level must be one of %s, not %q", strings.Join(ffmpegLevels, ", "), level)
+  }
+
+  return nil
+}
+
+// logLevels are the job's ffmpeg log levels: what goes to its log and what
+// of that on to the main log
+func (e *encoder) logLevels(j *Job) (string, string) {
+  level, main := e.logLevel, e.mainLogLevel
+
+  if j.profile.LogLevel != "" {
+    level = j.profile.LogLevel
+  }
+
+  if j.profile.MainLogLevel != "" {
+    main = j.profile.MainLogLevel
+  }
+
+  return level, main
+}
+
+// logFlags are the flags setting ffmpeg's log level, every line tagged with
+// its level so it can be told apart. A run whose output is parsed logs at
+// least at the level that has what it reads
+func (r ffmpegRun) logFlags(level string) []string {
+  if r.capture != "" {
+    // a pipeline step's captured output is read as ffmpeg prints it
+    return nil
+  }
+
+  if ffmpegLevel(level) < ffmpegLevel(r.logAtLeast) {
+    level = r.logAtLeast
+  }
+
+  return []string{"-hide_banner", "-loglevel", "level+" + level}
+}
+
+// ffmpegLog passes ffmpeg's stderr on to the job's log, and logs its lines
+// at or above a level in the main log as well
+type ffmpegLog struct {
+  out    io.Writer
+  logger *slog.Logger
+  step   string
+  level  int
+  buf    []byte
+  lines  int
+}
+
+func newFFmpegLog(out io.Writer, logger *slog.Logger, step string, main string) io.Writer {
+  if ffmpegLevel(main) <= 0 {
+    return out
+  }
+
+  return &ffmpegLog{out: out, logger: logger, step: step, level: ffmpegLevel(main)}
+}
+
+func (l *ffmpegLog) Write(p []byte) (int, error) {
+  n, err := l.out.Write(p)
+  l.buf = append(l.buf, p...)
+
+  for {
+    i := bytes.IndexAny(l.buf, "\r\n")
+
+    if i < 0 {
+      break
+    }
+
+    l.line(string(l.buf[:i]))
+    l.buf = l.buf[i+1:]
+  }
+
+  // a line this long is not a warning worth keeping
+  if len(l.buf) > 64*1024 {
+    l.buf = l.buf[:0]
+  }
+
+  return n, err
+}
+
+// line logs a line ffmpeg tagged with a level at or above the main log's
+func (l *ffmpegLog) line(line string) {
+  level, msg := lineLevel(line)
+
+  if level <= 0 || level > l.level {
+    return
+  }
+
+  l.lines++
+
+  switch {
+  case l.lines == maxMainLines+1:
+    l.logger.Warn("More ffmpeg messages are only in the job log", "step", l.step)
+  case l.lines > maxMainLines:
+  case level <= ffmpegLevel("error"):
+    l.logger.Error("ffmpeg", "step", l.step, "message", msg)
+  case level <= ffmpegLevel("warning"):
+    l.logger.Warn("ffmpeg", "step", l.step, "message", msg)
+  default:
+    l.logger.Info("ffmpeg", "step", l.step, "message", msg)
+  }
+}
+
+// lineLevel finds the level tag ffmpeg puts after a line's context, like
+// "[h264 @ 0x5581] [warning] ...", and returns the line without it
+func lineLevel(line string) (int, string) {
+  for i, l := range ffmpegLevels[1:] {
+    tag := "[" + l + "] "
+
+    if at := strings.Index(line, tag); at >= 0 {
+      return i + 1, strings.TrimSpace(line[:at] + line[at+len(tag):])
+    }
+  }
+
+  return -1, line
+}
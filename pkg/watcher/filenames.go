@@ -0,0 +1,260 @@
+package watcher
+
+import (
+  "fmt"
+  "io/fs"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  "golang.org/x/text/unicode/norm"
+)
+
+// Filenames cleans up the names of the files found in a queue directory
+// before they are queued, renaming each with its sidecars and companions.
+// Names are always NFC normalized: macOS writes them decomposed, é as e
+// and a combining accent, so the same name from a Mac and from Linux would
+// be two files. The job's manifest has the name the input arrived with. A
+// file whose clean name is taken in the queue directory is left where it is
+type Filenames struct {
+  // Transliterate spells Latin letters with accents and the like in
+  // ASCII, é as e, ß as ss, ø as o, and curly quotes and dashes as
+  // straight ones. Other scripts are kept
+  Transliterate bool
+
+  // Sanitize replaces each run of characters other than letters, digits,
+  // dots, dashes and underscores with Replacement, default _, dropping it
+  // ahead of a dot and at the start. That covers spaces, quotes and what
+  // shells and Windows reserve. With Transliterate the letters that are
+  // left outside ASCII are replaced too
+  Sanitize    bool
+  Replacement string
+}
+
+func (f *Filenames) check() error {
+  for _, r := range f.Replacement {
+    if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("._-", r) {
+      return fmt.Errorf("the replacement %q has more than letters, digits, dots, dashes and underscores", f.Replacement)
+    }
+  }
+
+  return nil
+}
+
+// clean is the name Filenames gives a file named name, name itself when
+// that would leave nothing
+func (f *Filenames) clean(name string) string {
+  clean := norm.NFC.String(name)
+
+  if f.Transliterate {
+    clean = transliterate(clean)
+  }
+
+  if f.Sanitize {
+    clean = f.sanitize(clean)
+  }
+
+  if clean == "" || clean == "." || clean == ".." {
+    return name
+  }
+
+  return clean
+}
+
+// sanitize replaces the runs of characters Sanitize does not keep
+func (f *Filenames) sanitize(name string) string {
+  replacement := f.Replacement
+
+  if replacement == "" {
+    replacement = "_"
+  }
+
+  var b strings.Builder
+  replaced := false
+
+  for _, r := range name {
+    keep := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || strings.ContainsRune("._-", r)
+
+    if f.Transliterate && r >= utf8.RuneSelf {
+      keep = false
+    }
+
+    switch {
+    case keep && r == '.' && replaced:
+      // movie (2020).mkv is movie_2020.mkv
+      s := strings.TrimSuffix(b.String(), replacement)
+      b.Reset()
+      b.WriteString(s)
+    case !keep && !replaced && b.Len() > 0:
+      b.WriteString(replacement)
+    }
+
+    if replaced = !keep; keep {
+      b.WriteRune(r)
+    }
+  }
+
+  return strings.TrimSuffix(b.String(), replacement)
+}
+
+// transliterations spell in ASCII what does not decompose to an ASCII
+// letter and marks
+var transliterations = map[rune]string{
+  'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+  'ø': "o", 'Ø': "O", 'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D",
+  'þ': "th", 'Þ': "Th", 'ł': "l", 'Ł': "L", 'ı': "i", 'ħ': "h",
+  'Ħ': "H", 'ŧ': "t", 'Ŧ': "T", 'ŋ': "n", 'Ŋ': "N", 'ſ': "s",
+  '‘': "'", '’': "'", '‚': "'", '“': "\"", '”': "\"", '„': "\"",
+  '«': "\"", '»': "\"", '–': "-", '—': "-", '…': "...", ' ': " ",
+}
+
+// transliterate spells the Latin letters and punctuation of s in ASCII
+// where it can, see Filenames.Transliterate
+func transliterate(s string) string {
+  var b strings.Builder
+
+  for _, r := range s {
+    if r < utf8.RuneSelf {
+      b.WriteRune(r)
+      continue
+    }
+
+    if ascii, ok := transliterations[r]; ok {
+      b.WriteString(ascii)
+      continue
+    }
+
+    // é is e and an accent, the accent goes
+    if d := norm.NFD.String(string(r)); d[0] < utf8.RuneSelf && len(d) > 1 {
+      b.WriteByte(d[0])
+      continue
+    }
+
+    b.WriteRune(r)
+  }
+
+  return b.String()
+}
+
+// renameFound gives a found file the name Filenames makes of its own, its
+// sidecars and companions with it, and goes on queueing it under that. It
+// reports whether path was renamed, or left for a file of its new name
+func (w *Watcher) renameFound(path string) bool {
+  f := w.cfg.Filenames
+
+  if f == nil {
+    return false
+  }
+
+  name := filepath.Base(path)
+  clean := f.clean(name)
+
+  if clean == name {
+    return false
+  }
+
+  var sidecars []string
+
+  if spec := findSpec(path); spec != "" {
+    sidecars = append(sidecars, spec)
+  }
+
+  if checksum := findChecksum(path); checksum != "" {
+    sidecars = append(sidecars, checksum)
+  }
+
+  sidecars = append(sidecars, w.cfg.Companions.find(path)...)
+
+  // the names are cleaned the same way, movié.en.srt goes with movie.mkv
+  files := append(sidecars, path)
+  moves := map[string]string{}
+  taken := map[string]bool{}
+  dir := filepath.Dir(path)
+
+  for _, from := range files {
+    to := filepath.Join(dir, f.clean(filepath.Base(from)))
+
+    // two of the files cleaning to one name, or one already there that is
+    // not the file itself under another spelling, as on macOS
+    if taken[to] || !sameOrMissing(from, to) {
+      if _, warned := w.badNames.LoadOrStore(path, true); !warned {
+        slog.Warn("Not queueing file, the queue has one of the name it would be given", "input", path, "name", filepath.Base(to))
+      }
+
+      return true
+    }
+
+    moves[from], taken[to] = to, true
+  }
+
+  for i, from := range files {
+    if err := renameNoReplace(from, moves[from]); err != nil {
+      slog.Error("Could not rename file", "file", from, "to", filepath.Base(moves[from]), "error", err)
+
+      // put back the ones renamed already so they stay together
+      for _, done := range files[:i] {
+        if renameNoReplace(moves[done], done) == nil {
+          w.enc.audit.moved(nil, moves[done], done, "rename undone")
+        }
+      }
+
+      return true
+    }
+
+    w.enc.audit.moved(nil, from, moves[from], "renamed")
+  }
+
+  dest := moves[path]
+  w.renamed.Store(dest, name)
+
+  slog.Info("Renamed input", "input", path, "to", filepath.Base(dest))
+
+  // it settled under its old name, the event for the new one finds it
+  // tracked
+  w.enqueueFound(dest)
+
+  return true
+}
+
+// sameOrMissing reports whether nothing is at to, or only from itself
+func sameOrMissing(from string, to string) bool {
+  target, err := os.Lstat(to)
+
+  if err != nil {
+    return os.IsNotExist(err)
+  }
+
+  source, err := os.Lstat(from)
+
+  return err == nil && os.SameFile(source, target)
+}
+
+// renameNoReplace renames from to to, failing when another file is at to
+// rather than replacing it. A hard link claims the name where the volume has
+// them, elsewhere a file that turns up at to between the check and the
+// rename is replaced
+func renameNoReplace(from string, to string) error {
+  if target, err := os.Lstat(to); err == nil {
+    // the same file under another spelling of its name
+    if source, err := os.Lstat(from); err == nil && os.SameFile(source, target) {
+      return os.Rename(from, to)
+    }
+
+    return &os.LinkError{Op: "rename", Old: from, New: to, Err: fs.ErrExist}
+  }
+
+  err := os.Link(from, to)
+
+  switch {
+  case err == nil:
+    return os.Remove(from)
+  case os.IsExist(err):
+    return &os.LinkError{Op: "rename", Old: from, New: to, Err: fs.ErrExist}
+  }
+
+  // directories, and volumes without hard links
+  return os.Rename(from, to)
+}
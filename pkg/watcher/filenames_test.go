@@ -0,0 +1,82 @@
+package watcher
+
+import (
+  "errors"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestFilenamesClean(t *testing.T) {
+  tests := []struct {
+    f    Filenames
+    name string
+    want string
+  }{
+    {Filenames{}, "cafe\u0301.mov", "caf\u00e9.mov"},
+    {Filenames{}, "\u1112\u1161\u11ab.mov", "\ud55c.mov"},
+    {Filenames{}, "a\u0323\u0302.mov", "\u1ead.mov"},
+    {Filenames{}, "\u00ea\u0323.mov", "\u1ec7.mov"},
+    {Filenames{}, "e\u0302\u0323.mov", "\u1ec7.mov"},
+    {Filenames{}, "\u212b.mov", "\u00c5.mov"},
+    {Filenames{}, "\u1ec7.mov", "\u1ec7.mov"},
+    {Filenames{}, "plain.mov", "plain.mov"},
+    {Filenames{Transliterate: true}, "Straße – Øl.mov", "Strasse - Ol.mov"},
+    {Filenames{Transliterate: true}, "café.mov", "cafe.mov"},
+    {Filenames{Transliterate: true}, "\u00ea\u0323 \u212b.mov", "e A.mov"},
+    {Filenames{Sanitize: true}, "movie (2020).mkv", "movie_2020.mkv"},
+    {Filenames{Sanitize: true}, "  lead.mov", "lead.mov"},
+    {Filenames{Sanitize: true, Replacement: "-"}, "a b&c.mov", "a-b-c.mov"},
+    {Filenames{Sanitize: true}, "café.mov", "café.mov"},
+    {Filenames{Sanitize: true, Transliterate: true}, "Déjà vu ✓.mov", "Deja_vu.mov"},
+    {Filenames{Sanitize: true}, "???", "???"},
+  }
+
+  for _, test := range tests {
+    if got := test.f.clean(test.name); got != test.want {
+      t.Errorf("%+v.clean(%q) = %q, want %q", test.f, test.name, got, test.want)
+    }
+  }
+}
+
+func TestRenameNoReplace(t *testing.T) {
+  dir := t.TempDir()
+  write := func(name string, content string) string {
+    path := filepath.Join(dir, name)
+
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+      t.Fatal(err)
+    }
+
+    return path
+  }
+
+  from, to := write("from.mov", "from"), filepath.Join(dir, "to.mov")
+
+  if err := renameNoReplace(from, to); err != nil {
+    t.Fatal(err)
+  }
+
+  if data, _ := os.ReadFile(to); string(data) != "from" {
+    t.Errorf("%s has %q, want the renamed file", to, data)
+  }
+
+  if _, err := os.Lstat(from); !errors.Is(err, fs.ErrNotExist) {
+    t.Errorf("%s is still there", from)
+  }
+
+  other := write("other.mov", "other")
+
+  if err := renameNoReplace(other, to); !errors.Is(err, fs.ErrExist) {
+    t.Errorf("renaming onto another file: %v, want it to exist", err)
+  }
+
+  if data, _ := os.ReadFile(to); string(data) != "from" {
+    t.Errorf("%s was replaced with %q", to, data)
+  }
+
+  if !sameOrMissing(to, to) || !sameOrMissing(other, filepath.Join(dir, "missing.mov")) || sameOrMissing(other, to) {
+    t.Error("sameOrMissing does not tell the file itself from another")
+  }
+}
@@ -0,0 +1,116 @@
+package watcher
+
+import (
+  "fmt"
+  "path/filepath"
+  "strings"
+)
+
+// defaultIgnorePatterns are the names downloaders, browsers, file transfer
+// clients and office suites give files they are still writing. rsync's
+// .name.XXXXXX and .~tmp~ are dotfiles, which are always ignored
+var defaultIgnorePatterns = []string{"*.part", "*.partial", "*.filepart", "*.crdownload", "*.download", "*.tmp", "~$*", ".~tmp~*"}
+
+// fileFilter decides which files in the queue directory are sent to ffmpeg.
+// include is an allow list of extensions, when it is empty every extension
+// is allowed. exclude are shell patterns matched against the file's base name.
+// A directory of frames has no extension, only exclude applies to it.
+// ignore are the patterns of files still being written, which like dotfiles
+// are never looked at. A filter is not changed once made, Reload replaces it
+type fileFilter struct {
+  include map[string]bool
+  exclude []string
+  ignore  []string
+}
+
+// newFileFilter makes a filter, a nil ignore is defaultIgnorePatterns
+func newFileFilter(include []string, exclude []string, ignore []string) (*fileFilter, error) {
+  f := &fileFilter{include: make(map[string]bool)}
+
+  for _, ext := range include {
+    f.include["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+  }
+
+  for _, pattern := range exclude {
+    if _, err := filepath.Match(pattern, ""); err != nil {
+      return nil, fmt.Errorf("bad exclude pattern %q: %s", pattern, err)
+    }
+
+    f.exclude = append(f.exclude, pattern)
+  }
+
+  if ignore == nil {
+    ignore = defaultIgnorePatterns
+  }
+
+  for _, pattern := range ignore {
+    if _, err := filepath.Match(pattern, ""); err != nil {
+      return nil, fmt.Errorf("bad ignore pattern %q: %s", pattern, err)
+    }
+
+    f.ignore = append(f.ignore, pattern)
+  }
+
+  return f, nil
+}
+
+// ignored reports whether the file is a dotfile or named like one still
+// being written, by its base name. Ignored files are not queued, settled
+// or counted, a finished transfer renamed to its real name is
+func (f *fileFilter) ignored(path string) bool {
+  name := filepath.Base(path)
+
+  if hidden(name) {
+    return true
+  }
+
+  for _, pattern := range f.ignore {
+    if matched, _ := filepath.Match(pattern, name); matched {
+      return true
+    }
+  }
+
+  return false
+}
+
+// allowed reports whether the file should be queued
+func (f *fileFilter) allowed(path string) bool {
+  name := filepath.Base(path)
+
+  if len(f.include) > 0 && !f.include[strings.ToLower(filepath.Ext(name))] {
+    return false
+  }
+
+  return f.allowedDir(path)
+}
+
+// allowedDir is allowed without the extension check, for the directory of
+// an image sequence
+func (f *fileFilter) allowedDir(path string) bool {
+  name := filepath.Base(path)
+
+  if f.ignored(name) {
+    return false
+  }
+
+  for _, pattern := range f.exclude {
+    if matched, _ := filepath.Match(pattern, name); matched {
+      return false
+    }
+  }
+
+  return true
+}
+
+// SplitList splits a comma separated setting, dropping empty entries
+func SplitList(value string) []string {
+  items := make([]string, 0)
+
+  for _, item := range strings.Split(value, ",") {
+    if item = strings.TrimSpace(item); item != "" {
+      items = append(items, item)
+    }
+  }
+
+  return items
+}
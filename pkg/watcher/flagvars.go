@@ -0,0 +1,237 @@
+package watcher
+
+import (
+  "math"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// flagVariables are the {variables} a profile's, hardware entry's and
+// output's flags can use, filled in for each input from the job and
+// ffprobe's report:
+//
+//	{input}      the input path
+//	{basename}   the input's file name without its extension
+//	{origext}    the input's extension, without the dot
+//	{profile}    the profile name
+//	{width}      the first video stream's width in pixels
+//	{height}     its height
+//	{fps}        its average frame rate, e.g. 29.97
+//	{duration}   the input's length in seconds
+//	{bitrate}    the input's overall bit rate in bits per second
+//	{vcodec}     the first video stream's codec, e.g. h264
+//	{acodec}     the first audio stream's codec
+//	{slot}       the index of the job's slot in its resource class, from 0
+//	             to the class's limit less one, e.g. -gpu {slot} to pin
+//	             two nvenc jobs to the two GPUs of nvenc: 2
+//	{device}     the ID of the device the job was given in its resource
+//	             class, e.g. -vaapi_device {device}, see ResourceDevice
+//
+// A number can be worked out with one operator and a constant, rounded to a
+// whole number: -vf scale={width/2}:-2, -b:v {bitrate*0.8}, -g {fps*2}.
+// Without ffprobe, or video, the probed variables are empty. Braces that are
+// not one of them, like drawtext's %{pts}, are left alone
+var flagVariables = map[string]bool{
+  "input":    true,
+  "basename": true,
+  "origext":  true,
+  "profile":  true,
+  "width":    true,
+  "height":   true,
+  "fps":      true,
+  "duration": true,
+  "bitrate":  true,
+  "vcodec":   true,
+  "acodec":   true,
+  "slot":     true,
+  "device":   true,
+}
+
+// flagVariable matches {name} and {name op number}
+var flagVariable = regexp.MustCompile(`\{([a-z]+)(?:\s*([-+*/])\s*([0-9]+(?:\.[0-9]+)?))?\}`)
+
+// flagVars are the flag variables' values for the job's input
+func flagVars(j *Job, probed *probeResult) map[string]string {
+  name := filepath.Base(j.input)
+  ext := filepath.Ext(name)
+
+  vars := map[string]string{
+    "input":    j.source(),
+    "basename": strings.TrimSuffix(name, ext),
+    "origext":  strings.TrimPrefix(ext, "."),
+    "profile":  j.profile.Name,
+  }
+
+  if slot := j.slot(); slot != "" {
+    vars["slot"] = slot
+  }
+
+  if device := j.device(); device != "" {
+    vars["device"] = device
+  }
+
+  if probed == nil {
+    return vars
+  }
+
+  if d := probed.duration(); d > 0 {
+    vars["duration"] = formatSeconds(d)
+  }
+
+  if bitrate, err := strconv.ParseInt(probed.Format.BitRate, 10, 64); err == nil && bitrate > 0 {
+    vars["bitrate"] = strconv.FormatInt(bitrate, 10)
+  }
+
+  if video := probed.videoStreams(); len(video) > 0 {
+    v := video[0]
+    vars["vcodec"] = v.CodecName
+
+    if v.Width > 0 && v.Height > 0 {
+      vars["width"] = strconv.Itoa(v.Width)
+      vars["height"] = strconv.Itoa(v.Height)
+    }
+
+    if fps := parseFrameRate(v.AvgFrameRate); fps > 0 {
+      vars["fps"] = strconv.FormatFloat(math.Round(fps*1000)/1000, 'f', -1, 64)
+    }
+  }
+
+  if audio := probed.streams("audio"); len(audio) > 0 {
+    vars["acodec"] = audio[0].CodecName
+  }
+
+  return vars
+}
+
+// parseFrameRate parses ffprobe's 30000/1001, zero when unknown
+func parseFrameRate(rate string) float64 {
+  num, den, found := strings.Cut(rate, "/")
+  n, err := strconv.ParseFloat(num, 64)
+
+  if err != nil {
+    return 0
+  }
+
+  if !found {
+    return n
+  }
+
+  d, err := strconv.ParseFloat(den, 64)
+
+  if err != nil || d == 0 {
+    return 0
+  }
+
+  return n / d
+}
+
+// expandFlags fills in the flag variables in flags. A variable without a
+// value, like {width} of an input without video, is logged and left empty
+func expandFlags(j *Job, flags []string, vars map[string]string) []string {
+  if !hasFlagVariables(flags) {
+    return flags
+  }
+
+  expanded := make([]string, len(flags))
+
+  for i, flag := range flags {
+    expanded[i] = flagVariable.ReplaceAllStringFunc(flag, func(match string) string {
+      m := flagVariable.FindStringSubmatch(match)
+
+      if !flagVariables[m[1]] {
+        return match
+      }
+
+      value, ok := vars[m[1]]
+
+      if !ok {
+        j.logger().Warn("Flag variable has no value for this input", "variable", m[1], "flag", flag)
+        return ""
+      }
+
+      if m[2] == "" {
+        return value
+      }
+
+      return flagArithmetic(j, value, m[2], m[3], match)
+    })
+  }
+
+  return expanded
+}
+
+// flagArithmetic applies op and the constant to a variable's value
+func flagArithmetic(j *Job, value string, op string, constant string, match string) string {
+  n, err := strconv.ParseFloat(value, 64)
+
+  if err != nil {
+    j.logger().Warn("Flag variable is not a number", "variable", match, "value", value)
+    return ""
+  }
+
+  c, _ := strconv.ParseFloat(constant, 64)
+
+  switch op {
+  case "+":
+    n += c
+  case "-":
+    n -= c
+  case "*":
+    n *= c
+  case "/":
+    if c == 0 {
+      j.logger().Warn("Flag variable divides by zero", "variable", match)
+      return ""
+    }
+
+    n /= c
+  }
+
+  return strconv.FormatInt(int64(math.Round(n)), 10)
+}
+
+// hasFlagVariables reports whether any of flags uses a flag variable
+func hasFlagVariables(flags []string) bool {
+  for _, flag := range flags {
+    for _, m := range flagVariable.FindAllStringSubmatch(flag, -1) {
+      if flagVariables[m[1]] {
+        return true
+      }
+    }
+  }
+
+  return false
+}
+
+// renditions are the profile's outputs for the job, their flags' variables
+// filled in
+func (e *encoder) renditions(j *Job, probed *probeResult) []Rendition {
+  renditions := j.profile.outputs()
+  var vars map[string]string
+
+  for i, r := range renditions {
+    if !hasFlagVariables(r.OutputFlags) {
+      continue
+    }
+
+    if vars == nil {
+      vars = flagVars(j, probed)
+    }
+
+    renditions[i].OutputFlags = expandFlags(j, r.OutputFlags, vars)
+  }
+
+  // an output's own video filters replace the profile's, deinterlacing
+  // goes ahead of them too
+  if filter := j.profile.deinterlaceFilter(probed); filter != "" {
+    for i, r := range renditions {
+      if !r.AudioOnly && hasVideoFilter(r.OutputFlags) {
+        renditions[i].OutputFlags = withDeinterlace(r.OutputFlags, filter)
+      }
+    }
+  }
+
+  return renditions
+}
@@ -0,0 +1,60 @@
+package watcher
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestExpandFlags(t *testing.T) {
+  j := &Job{input: "/queue/clip.mov", profile: &Profile{Name: "web"}}
+  vars := map[string]string{"width": "1918", "height": "1080", "fps": "29.97", "bitrate": "5000000", "vcodec": "h264"}
+
+  tests := []struct {
+    flag string
+    want string
+  }{
+    {"scale={width}:{height}", "scale=1918:1080"},
+    {"scale={width/2}:-2", "scale=959:-2"},
+    {"{width/4}", "480"},
+    {"{height / 7}", "154"},
+    {"{fps*2}", "60"},
+    {"{fps+0.4}", "30"},
+    {"{bitrate*0.8}", "4000000"},
+    {"{width-2000}", "-82"},
+    {"{width/0}", ""},
+    {"{acodec}", ""},
+    {"{acodec*2}", ""},
+    {"{vcodec*2}", ""},
+    {"{colour}", "{colour}"},
+    {"{colour*2}", "{colour*2}"},
+    {"drawtext=text='%{pts}':x={width/2}", "drawtext=text='%{pts}':x=959"},
+    {"{width%2}", "{width%2}"},
+  }
+
+  for _, test := range tests {
+    if got := expandFlags(j, []string{test.flag}, vars); !reflect.DeepEqual(got, []string{test.want}) {
+      t.Errorf("expandFlags(%q) = %q, want %q", test.flag, got, test.want)
+    }
+  }
+
+  flags := []string{"-vf", "drawtext=text='%{pts}'"}
+
+  if got := expandFlags(j, flags, vars); &got[0] != &flags[0] {
+    t.Errorf("flags without variables were copied: %q", got)
+  }
+}
+
+func TestParseFrameRate(t *testing.T) {
+  for rate, want := range map[string]float64{
+    "30000/1001": 30000.0 / 1001,
+    "25/1":       25,
+    "24":         24,
+    "0/0":        0,
+    "":           0,
+    "n/a":        0,
+  } {
+    if got := parseFrameRate(rate); got != want {
+      t.Errorf("parseFrameRate(%q) = %v, want %v", rate, got, want)
+    }
+  }
+}
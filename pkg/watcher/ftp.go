@@ -0,0 +1,502 @@
+package watcher
+
+import (
+  "bufio"
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/textproto"
+  "net/url"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// ftpConn is an FTP session, explicit TLS for ftps URLs, in the directory
+// of the URL's path
+type ftpConn struct {
+  ctx  context.Context
+  conn net.Conn
+  text *textproto.Conn
+  host string
+
+  // tls is set for ftps, data connections reuse the control connection's
+  // session as most servers require
+  tls *tls.Config
+
+  // stop undoes closing the connection when ctx is done
+  stop func() bool
+}
+
+const ftpTimeout = 30 * time.Second
+
+func dialFTP(ctx context.Context, u *url.URL) (*ftpConn, error) {
+  host := u.Host
+
+  if u.Port() == "" {
+    host = net.JoinHostPort(u.Hostname(), "21")
+  }
+
+  d := net.Dialer{Timeout: ftpTimeout}
+  conn, err := d.DialContext(ctx, "tcp", host)
+
+  if err != nil {
+    return nil, err
+  }
+
+  c := &ftpConn{ctx: ctx, conn: conn, text: textproto.NewConn(conn), host: u.Hostname()}
+
+  // blocked reads and writes return once ctx is done
+  c.stop = context.AfterFunc(ctx, func() { conn.Close() })
+
+  if err = c.login(u); err != nil {
+    c.stop()
+    c.conn.Close()
+    return nil, err
+  }
+
+  return c, nil
+}
+
+func (c *ftpConn) login(u *url.URL) error {
+  if _, _, err := c.reply("connect", 220); err != nil {
+    return err
+  }
+
+  if u.Scheme == "ftps" {
+    if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+      return err
+    }
+
+    c.tls = &tls.Config{ServerName: u.Hostname(), ClientSessionCache: tls.NewLRUClientSessionCache(1)}
+    c.conn = tls.Client(c.conn, c.tls)
+    c.text = textproto.NewConn(c.conn)
+
+    if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+      return err
+    }
+
+    if _, _, err := c.cmd(200, "PROT P"); err != nil {
+      return err
+    }
+  }
+
+  user, password := "anonymous", "anonymous@"
+
+  if u.User != nil {
+    user = u.User.Username()
+
+    if p, ok := u.User.Password(); ok {
+      password = p
+    }
+  }
+
+  code, _, err := c.cmd(0, "USER %s", user)
+
+  if err == nil && code == 331 {
+    code, _, err = c.cmd(0, "PASS %s", password)
+  }
+
+  if err != nil {
+    return err
+  }
+
+  if code != 230 && code != 202 {
+    return fmt.Errorf("login as %s refused: %d", user, code)
+  }
+
+  if _, _, err = c.cmd(200, "TYPE I"); err != nil {
+    return err
+  }
+
+  // like curl, the path is relative to the login directory unless it
+  // starts with //
+  if dir := strings.TrimPrefix(u.Path, "/"); dir != "" {
+    if _, _, err = c.cmd(250, "CWD %s", dir); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// ftpError is a reply with an unexpected code
+type ftpError struct {
+  cmd  string
+  code int
+  msg  string
+}
+
+func (e *ftpError) Error() string {
+  return fmt.Sprintf("%s: %d %s", e.cmd, e.code, e.msg)
+}
+
+// permanent reports whether err is a 5xx reply, the server will not do it
+func permanent(err error) bool {
+  var fe *ftpError
+
+  return errors.As(err, &fe) && fe.code >= 500
+}
+
+// cmd sends a command and reads the reply, expect is the reply code or its
+// first digits, zero takes any code
+func (c *ftpConn) cmd(expect int, format string, args ...any) (int, string, error) {
+  c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+
+  if err := c.text.PrintfLine(format, args...); err != nil {
+    return 0, "", c.err(err)
+  }
+
+  return c.reply(strings.Fields(format)[0], expect)
+}
+
+// reply reads the reply to cmd
+func (c *ftpConn) reply(cmd string, expect int) (int, string, error) {
+  code, msg, err := c.text.ReadResponse(expect)
+
+  if err != nil {
+    if _, ok := err.(*textproto.Error); ok {
+      return code, msg, &ftpError{cmd: cmd, code: code, msg: msg}
+    }
+
+    return code, msg, c.err(err)
+  }
+
+  return code, msg, nil
+}
+
+// err prefers the context's error to the one from the closed connection
+func (c *ftpConn) err(err error) error {
+  if c.ctx.Err() != nil {
+    return c.ctx.Err()
+  }
+
+  return err
+}
+
+// data opens a passive data connection and sends the command using it
+func (c *ftpConn) data(format string, args ...any) (net.Conn, error) {
+  addr, err := c.passive()
+
+  if err != nil {
+    return nil, err
+  }
+
+  d := net.Dialer{Timeout: ftpTimeout}
+  conn, err := d.DialContext(c.ctx, "tcp", addr)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if _, _, err = c.cmd(1, format, args...); err != nil {
+    conn.Close()
+    return nil, err
+  }
+
+  if c.tls != nil {
+    conn = tls.Client(conn, c.tls)
+  }
+
+  return &ftpData{Conn: conn, stop: context.AfterFunc(c.ctx, func() { conn.Close() })}, nil
+}
+
+// ftpData is a data connection closed when the session's context is done
+type ftpData struct {
+  net.Conn
+  stop func() bool
+}
+
+func (d *ftpData) Close() error {
+  d.stop()
+
+  return d.Conn.Close()
+}
+
+// passive asks for the data port with EPSV, or PASV for older servers.
+// The control connection's host is used either way, a PASV reply's address
+// is often private behind NAT
+func (c *ftpConn) passive() (string, error) {
+  _, msg, err := c.cmd(229, "EPSV")
+
+  if err == nil {
+    // 229 Entering Extended Passive Mode (|||6446|)
+    start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+
+    if start < 0 || end < start+4 {
+      return "", fmt.Errorf("EPSV: bad reply %q", msg)
+    }
+
+    return net.JoinHostPort(c.host, msg[start+4:end]), nil
+  }
+
+  if !permanent(err) {
+    return "", err
+  }
+
+  // 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+  if _, msg, err = c.cmd(227, "PASV"); err != nil {
+    return "", err
+  }
+
+  start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+  var fields []string
+
+  if start >= 0 && end > start {
+    fields = strings.Split(msg[start+1:end], ",")
+  }
+
+  if len(fields) != 6 {
+    return "", fmt.Errorf("PASV: bad reply %q", msg)
+  }
+
+  p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+  p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+
+  if err1 != nil || err2 != nil {
+    return "", fmt.Errorf("PASV: bad reply %q", msg)
+  }
+
+  return net.JoinHostPort(c.host, strconv.Itoa(p1<<8|p2)), nil
+}
+
+// transferDone reads the reply that ends a transfer
+func (c *ftpConn) transferDone(cmd string) error {
+  c.conn.SetDeadline(time.Now().Add(ftpTimeout))
+  _, _, err := c.reply(cmd, 2)
+
+  return err
+}
+
+func (c *ftpConn) list() ([]StorageFile, error) {
+  files, err := c.mlsd()
+
+  if permanent(err) {
+    return c.nlst()
+  }
+
+  return files, err
+}
+
+// mlsd lists the directory with sizes and modification times in one go
+func (c *ftpConn) mlsd() ([]StorageFile, error) {
+  conn, err := c.data("MLSD")
+
+  if err != nil {
+    return nil, err
+  }
+
+  var files []StorageFile
+  scanner := bufio.NewScanner(conn)
+
+  for scanner.Scan() {
+    // type=file;size=1234;modify=20261014045300; name
+    facts, name, ok := strings.Cut(scanner.Text(), " ")
+
+    if !ok {
+      continue
+    }
+
+    f := StorageFile{Name: name}
+    regular := false
+
+    for _, fact := range strings.Split(facts, ";") {
+      key, value, _ := strings.Cut(fact, "=")
+
+      switch strings.ToLower(key) {
+      case "type":
+        regular = strings.EqualFold(value, "file")
+      case "size":
+        f.Size, _ = strconv.ParseInt(value, 10, 64)
+      case "modify":
+        f.ModTime, _ = parseFTPTime(value)
+      }
+    }
+
+    if regular {
+      files = append(files, f)
+    }
+  }
+
+  conn.Close()
+
+  if err = scanner.Err(); err != nil {
+    return nil, c.err(err)
+  }
+
+  return files, c.transferDone("MLSD")
+}
+
+// nlst lists the names, then asks for each one's size and time. Names the
+// server has no size for are directories
+func (c *ftpConn) nlst() ([]StorageFile, error) {
+  conn, err := c.data("NLST")
+
+  if err != nil {
+    // an empty directory can be a 550
+    var fe *ftpError
+
+    if errors.As(err, &fe) && fe.code == 550 {
+      return nil, nil
+    }
+
+    return nil, err
+  }
+
+  var names []string
+  scanner := bufio.NewScanner(conn)
+
+  for scanner.Scan() {
+    if name := path.Base(strings.TrimSpace(scanner.Text())); name != "" {
+      names = append(names, name)
+    }
+  }
+
+  conn.Close()
+
+  if err = scanner.Err(); err != nil {
+    return nil, c.err(err)
+  }
+
+  if err = c.transferDone("NLST"); err != nil {
+    return nil, err
+  }
+
+  var files []StorageFile
+
+  for _, name := range names {
+    _, msg, err := c.cmd(213, "SIZE %s", name)
+
+    if permanent(err) {
+      continue
+    }
+
+    if err != nil {
+      return nil, err
+    }
+
+    f := StorageFile{Name: name}
+    f.Size, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+
+    if _, msg, err = c.cmd(213, "MDTM %s", name); err == nil {
+      f.ModTime, _ = parseFTPTime(strings.TrimSpace(msg))
+    } else if !permanent(err) {
+      return nil, err
+    }
+
+    files = append(files, f)
+  }
+
+  return files, nil
+}
+
+// parseFTPTime parses MLSD and MDTM times, YYYYMMDDHHMMSS[.sss] in UTC
+func parseFTPTime(value string) (time.Time, error) {
+  value, _, _ = strings.Cut(value, ".")
+
+  return time.Parse("20060102150405", value)
+}
+
+func (c *ftpConn) download(name string, dest string) error {
+  conn, err := c.data("RETR %s", name)
+
+  if err != nil {
+    return err
+  }
+
+  f, err := os.Create(dest)
+
+  if err != nil {
+    conn.Close()
+    return err
+  }
+
+  // no deadline while the file comes in, a stalled transfer is only ended
+  // by shutdown
+  c.conn.SetDeadline(time.Time{})
+  _, err = io.Copy(f, conn)
+  conn.Close()
+
+  if closeErr := f.Close(); err == nil {
+    err = closeErr
+  }
+
+  if err != nil {
+    return c.err(err)
+  }
+
+  return c.transferDone("RETR")
+}
+
+// upload stores the local file src as name, making name's directories
+// first, which may exist already
+func (c *ftpConn) upload(src string, name string) error {
+  dir := ""
+
+  for _, part := range strings.Split(path.Dir(name), "/") {
+    if part == "." || part == "" {
+      continue
+    }
+
+    dir = path.Join(dir, part)
+
+    if _, _, err := c.cmd(257, "MKD %s", dir); err != nil && !permanent(err) {
+      return err
+    }
+  }
+
+  f, err := os.Open(src)
+
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  conn, err := c.data("STOR %s", name)
+
+  if err != nil {
+    return err
+  }
+
+  c.conn.SetDeadline(time.Time{})
+  _, err = io.Copy(conn, f)
+
+  if closeErr := conn.Close(); err == nil {
+    err = closeErr
+  }
+
+  if err != nil {
+    return c.err(err)
+  }
+
+  return c.transferDone("STOR")
+}
+
+func (c *ftpConn) remove(name string) error {
+  _, _, err := c.cmd(250, "DELE %s", name)
+
+  return err
+}
+
+func (c *ftpConn) rename(name string, dir string) error {
+  if _, _, err := c.cmd(350, "RNFR %s", name); err != nil {
+    return err
+  }
+
+  _, _, err := c.cmd(250, "RNTO %s", path.Join(dir, name))
+
+  return err
+}
+
+func (c *ftpConn) close() error {
+  c.cmd(0, "QUIT")
+  c.stop()
+
+  return c.conn.Close()
+}
@@ -0,0 +1,145 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "strconv"
+  "time"
+)
+
+// GrowingMode is how inputs still being written, like a live capture, are
+// encoded
+type GrowingMode string
+
+const (
+  // GrowingWait holds a file back until it has stopped growing for Idle,
+  // its size is compared between checks as well as its modification time
+  GrowingWait GrowingMode = "wait"
+
+  // GrowingFollow starts encoding a file while it is written, ffmpeg reads
+  // on at its end until it has not grown for Idle, then the outputs are
+  // finalized. Profiles that read the input more than once, two-pass,
+  // loudnorm, subtitle extraction, pipelines and packaging, wait instead
+  GrowingFollow GrowingMode = "follow"
+)
+
+// defaultGrowingIdle is how long a file must not grow to count as complete
+const defaultGrowingIdle = 30 * time.Second
+
+// Growing handles inputs that are still being written
+type Growing struct {
+  Mode GrowingMode
+
+  // Idle is how long a file has not grown before it counts as complete,
+  // default 30s. Keep any StallTimeout longer, a followed input that
+  // pauses stalls the encode's progress meanwhile
+  Idle time.Duration
+}
+
+// check fills in the defaults and rejects a mode that does not exist
+func (g *Growing) check() error {
+  if g.Mode != GrowingWait && g.Mode != GrowingFollow {
+    return fmt.Errorf("mode must be wait or follow, not %q", g.Mode)
+  }
+
+  if g.Idle < 0 {
+    return fmt.Errorf("idle must not be negative")
+  }
+
+  if g.Idle == 0 {
+    g.Idle = defaultGrowingIdle
+  }
+
+  return nil
+}
+
+// growing reports whether path was written to within the idle time, false
+// for a nil Growing
+func (g *Growing) growing(path string) bool {
+  if g == nil {
+    return false
+  }
+
+  info, err := os.Stat(path)
+
+  return err == nil && time.Since(info.ModTime()) < g.Idle
+}
+
+// followable reports whether the profile reads its input once, from start
+// to end, so it can be encoded while the input grows
+func (p *Profile) followable() bool {
+  return p.Packaging == "" && len(p.pipeline()) == 0 && !p.TwoPass && p.Loudnorm == nil && p.Subtitles != SubtitlesExtract
+}
+
+// followFlags are ffmpeg's input flags for a followed input: the file
+// protocol reads on at the end of the file until it has not grown for idle
+func (e *encoder) followFlags(j *Job) []string {
+  if !j.growing {
+    return nil
+  }
+
+  return []string{"-follow", "1", "-rw_timeout", strconv.FormatInt(e.growing.Idle.Microseconds(), 10)}
+}
+
+// settledGrowth reports whether a found file has stopped growing, else it
+// is checked again once it could have. An empty file is still growing
+func (w *Watcher) settledGrowth(path string) bool {
+  g := w.cfg.Growing
+  info, err := os.Stat(path)
+
+  if err != nil || info.IsDir() {
+    w.sizes.Delete(path)
+    return false
+  }
+
+  if g.Mode == GrowingFollow {
+    // a capture starts out empty, checkMedia would skip it
+    if info.Size() > 0 {
+      return true
+    }
+
+    w.settleLater(path, time.Second)
+    return false
+  }
+
+  last, seen := w.sizes.Swap(path, info.Size())
+
+  if age := time.Since(info.ModTime()); !seen || last != info.Size() || age < g.Idle {
+    slog.Debug("Waiting for file to stop growing", "input", path, "size", info.Size())
+    w.settleLater(path, g.Idle)
+    return false
+  }
+
+  w.sizes.Delete(path)
+
+  return true
+}
+
+// grown is the length and size of a followed input once it stopped growing
+func (e *encoder) grown(j *Job, file string) (time.Duration, int64) {
+  var duration time.Duration
+  var size int64
+
+  if info, err := os.Stat(file); err == nil {
+    size = info.Size()
+  }
+
+  if e.ffprobePath != "" {
+    if probed, err := probe(e.ffprobePath, file); err == nil {
+      duration = probed.duration()
+    } else {
+      j.logger().Warn("Could not probe the grown input", "error", err)
+    }
+  }
+
+  if j.spec != nil {
+    duration = j.spec.trimmed(duration)
+  }
+
+  j.mu.Lock()
+  j.inputBytes = size
+  j.mu.Unlock()
+
+  return duration, size
+}
@@ -0,0 +1,716 @@
+package watcher
+
+import (
+  "crypto/subtle"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "math"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// grpcService is the service in gowatcher.proto, its methods are served at
+// /gowatcher.v1.Gowatcher/<Method>
+const grpcService = "gowatcher.v1.Gowatcher"
+
+// grpcRootHeader is the metadata picking the root when there are several
+const grpcRootHeader = "Gowatcher-Root"
+
+// grpcMaxMessage bounds a message, the requests are a few strings and the
+// pieces of files agents send agentChunk
+const grpcMaxMessage = 4 << 20
+
+// gRPC status codes
+const (
+  grpcOK                 = 0
+  grpcInvalidArgument    = 3
+  grpcNotFound           = 5
+  grpcPermissionDenied   = 7
+  grpcFailedPrecondition = 9
+  grpcUnimplemented      = 12
+  grpcInternal           = 13
+  grpcUnavailable        = 14
+  grpcUnauthenticated    = 16
+)
+
+// grpcError is a call's failure with its gRPC status code
+type grpcError struct {
+  code int
+  msg  string
+}
+
+func (e *grpcError) Error() string {
+  return e.msg
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+  return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcChanging are the methods that change what a watcher does, the others
+// only read or are the agents', which check AGENTS_TOKEN themselves
+var grpcChanging = map[string]bool{"Enqueue": true, "Cancel": true, "Pause": true}
+
+// RequireGRPCToken is RequireToken for the gRPC API: Enqueue, Cancel and
+// Pause need token as a bearer token in the authorization metadata, and
+// are refused when token is empty
+func RequireGRPCToken(token string, h http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    method, _ := strings.CutPrefix(r.URL.Path, "/"+grpcService+"/")
+
+    if !grpcChanging[method] {
+      h.ServeHTTP(w, r)
+      return
+    }
+
+    w.Header().Set("Content-Type", "application/grpc")
+
+    if token == "" {
+      grpcFinish(w, grpcErrorf(grpcPermissionDenied, "the API is read only, set a token to change anything over it"))
+      return
+    }
+
+    given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+    if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+      grpcFinish(w, grpcErrorf(grpcUnauthenticated, "a valid bearer token is required"))
+      return
+    }
+
+    h.ServeHTTP(w, r)
+  })
+}
+
+// grpcServer serves the service in gowatcher.proto for one or more roots.
+// gRPC is HTTP/2, which net/http only speaks over TLS, so it is served with
+// http.Server's ListenAndServeTLS
+type grpcServer []*Watcher
+
+// GRPCHandler serves the gRPC control and ingest API, see gowatcher.proto
+func (w *Watcher) GRPCHandler() http.Handler {
+  return grpcServer{w}
+}
+
+// GroupGRPCHandler serves the gRPC API for several roots, each call's
+// gowatcher-root metadata names its root
+func GroupGRPCHandler(watchers []*Watcher) http.Handler {
+  return grpcServer(watchers)
+}
+
+func (s grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+    http.Error(w, "this is a gRPC server", http.StatusUnsupportedMediaType)
+    return
+  }
+
+  if r.ProtoMajor != 2 {
+    http.Error(w, "gRPC needs HTTP/2", http.StatusHTTPVersionNotSupported)
+    return
+  }
+
+  w.Header().Set("Content-Type", "application/grpc")
+
+  method, ok := strings.CutPrefix(r.URL.Path, "/"+grpcService+"/")
+
+  if !ok {
+    grpcFinish(w, grpcErrorf(grpcUnimplemented, "unknown service %s", strings.TrimPrefix(r.URL.Path, "/")))
+    return
+  }
+
+  watcher, err := s.root(r.Header.Get(grpcRootHeader))
+
+  if err != nil {
+    grpcFinish(w, err)
+    return
+  }
+
+  req, err := grpcRead(r.Body)
+
+  if err != nil {
+    grpcFinish(w, err)
+    return
+  }
+
+  var reply []byte
+
+  switch method {
+  case "Enqueue":
+    reply, err = watcher.grpcEnqueue(req)
+  case "ListJobs":
+    reply, err = watcher.grpcListJobs(req)
+  case "WatchEvents":
+    err = watcher.grpcWatchEvents(w, r, req)
+    grpcFinish(w, err)
+    return
+  case "Cancel":
+    reply, err = watcher.grpcCancel(req)
+  case "Pause":
+    reply, err = watcher.grpcPause(req)
+  case "TakeTask":
+    reply, err = watcher.grpcTakeTask(r, req)
+  case "ReadInput":
+    err = watcher.grpcReadInput(w, r, req)
+    grpcFinish(w, err)
+    return
+  case "ReportTask":
+    reply, err = watcher.grpcReportTask(r, req)
+  case "PutOutput":
+    reply, err = watcher.grpcPutOutput(r, req)
+  case "FinishTask":
+    reply, err = watcher.grpcFinishTask(r, req)
+  default:
+    err = grpcErrorf(grpcUnimplemented, "unknown method %s", method)
+  }
+
+  if err == nil {
+    err = grpcWrite(w, reply)
+  }
+
+  grpcFinish(w, err)
+}
+
+// root is the watcher the gowatcher-root metadata names, which may be left
+// out with one root
+func (s grpcServer) root(name string) (*Watcher, error) {
+  if len(s) == 1 && (name == "" || name == s[0].cfg.Name) {
+    return s[0], nil
+  }
+
+  if name == "" {
+    return nil, grpcErrorf(grpcInvalidArgument, "there are several roots, name one with the gowatcher-root metadata")
+  }
+
+  for _, w := range s {
+    if w.cfg.Name == name {
+      return w, nil
+    }
+  }
+
+  return nil, grpcErrorf(grpcNotFound, "no root %q", name)
+}
+
+func (w *Watcher) grpcEnqueue(req []byte) ([]byte, error) {
+  var path, rawURL, name string
+
+  err := pbFields(req, func(field int, _ uint64, data []byte) {
+    switch field {
+    case 1:
+      path = string(data)
+    case 2:
+      rawURL = string(data)
+    case 3:
+      name = string(data)
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  if (path == "") == (rawURL == "") {
+    return nil, grpcErrorf(grpcInvalidArgument, "one of path or url is required")
+  }
+
+  if rawURL != "" {
+    j, err := w.EnqueueURL(rawURL, name)
+
+    if err != nil {
+      return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+    }
+
+    return pbJob(nil, j.View()), nil
+  }
+
+  if !w.inQueue(path) {
+    return nil, grpcErrorf(grpcPermissionDenied, "%s is not in the queue directory", path)
+  }
+
+  if info, err := os.Stat(path); err != nil {
+    return nil, grpcErrorf(grpcNotFound, "%s", err)
+  } else if !info.Mode().IsRegular() {
+    return nil, grpcErrorf(grpcInvalidArgument, "%s is not a file", path)
+  }
+
+  j := w.Enqueue(path)
+
+  if j == nil {
+    return nil, grpcErrorf(grpcFailedPrecondition, "%s is not encoded, it is a sidecar or the file filter rejects it", path)
+  }
+
+  return pbJob(nil, j.View()), nil
+}
+
+// inQueue reports whether path is a file in the queue directory once links
+// are followed, the only files a client may have encoded and disposed of
+func (w *Watcher) inQueue(path string) bool {
+  resolved, err := filepath.EvalSymlinks(path)
+
+  if err != nil {
+    return false
+  }
+
+  queue, err := filepath.EvalSymlinks(w.queueDir)
+
+  if err != nil {
+    return false
+  }
+
+  rel, err := filepath.Rel(queue, resolved)
+
+  return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (w *Watcher) grpcListJobs(req []byte) ([]byte, error) {
+  var state JobState
+
+  err := pbFields(req, func(field int, _ uint64, data []byte) {
+    if field == 1 {
+      state = JobState(data)
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  var reply []byte
+
+  for _, j := range w.Jobs(state) {
+    reply = pbMessage(reply, 1, pbJob(nil, j.View()))
+  }
+
+  return reply, nil
+}
+
+// grpcWatchEvents streams the events like GET /events, a client that falls
+// behind misses events the same way
+func (w *Watcher) grpcWatchEvents(rw http.ResponseWriter, r *http.Request, req []byte) error {
+  var only int64
+
+  err := pbFields(req, func(field int, v uint64, _ []byte) {
+    if field == 1 {
+      only = int64(v)
+    }
+  })
+
+  if err != nil {
+    return err
+  }
+
+  events, unsubscribe := w.store.events.subscribe()
+  defer unsubscribe()
+
+  // the headers go out now, the client waits for them before it starts
+  // counting on the stream
+  rw.WriteHeader(http.StatusOK)
+  rw.(http.Flusher).Flush()
+
+  var sendErr error
+
+  send := func(ev StreamEvent) bool {
+    var msg []byte
+    msg = pbString(msg, 1, ev.Event)
+    msg = pbTime(msg, 2, ev.Time)
+    msg = pbMessage(msg, 3, pbJob(nil, ev.Job))
+
+    sendErr = grpcWrite(rw, msg)
+
+    return sendErr == nil
+  }
+
+  // HTTP/2 streams need no keep alive of their own, clients ping
+  idle := func() bool { return true }
+
+  if w.watchEvents(events, r.Context().Done(), only, send, idle) {
+    return grpcErrorf(grpcUnavailable, "shutting down")
+  }
+
+  return sendErr
+}
+
+func (w *Watcher) grpcCancel(req []byte) ([]byte, error) {
+  var ref, then string
+
+  err := pbFields(req, func(field int, _ uint64, data []byte) {
+    switch field {
+    case 1:
+      ref = string(data)
+    case 2:
+      then = string(data)
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  j, err := w.lookupJob(ref)
+
+  if err != nil {
+    return nil, grpcErrorf(grpcInvalidArgument, "%s", err)
+  }
+
+  if j == nil {
+    return nil, grpcErrorf(grpcNotFound, "job not found")
+  }
+
+  if err := w.Cancel(j, CancelAction(then)); err != nil {
+    return nil, grpcErrorf(grpcFailedPrecondition, "%s", err)
+  }
+
+  return pbJob(nil, j.View()), nil
+}
+
+func (w *Watcher) grpcPause(req []byte) ([]byte, error) {
+  var resume bool
+
+  err := pbFields(req, func(field int, v uint64, _ []byte) {
+    if field == 1 {
+      resume = v != 0
+    }
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  if resume {
+    w.Resume()
+  } else {
+    w.Pause()
+  }
+
+  return pbBool(nil, 1, w.Paused()), nil
+}
+
+// grpcRead reads the request's one message. Compression is not offered, so
+// clients do not compress
+func grpcRead(r io.Reader) ([]byte, error) {
+  msg, err := grpcReadMessage(r)
+
+  if err == io.EOF {
+    // a client may end the stream without a message for an empty request
+    return nil, nil
+  }
+
+  return msg, err
+}
+
+// grpcReadMessage reads a length-prefixed message, io.EOF when there is none
+func grpcReadMessage(r io.Reader) ([]byte, error) {
+  var prefix [5]byte
+
+  if _, err := io.ReadFull(r, prefix[:]); err != nil {
+    if err == io.EOF {
+      return nil, err
+    }
+
+    return nil, grpcErrorf(grpcInternal, "reading the message: %s", err)
+  }
+
+  if prefix[0] != 0 {
+    return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+  }
+
+  length := binary.BigEndian.Uint32(prefix[1:])
+
+  if length > grpcMaxMessage {
+    return nil, grpcErrorf(grpcInvalidArgument, "message is larger than %d bytes", grpcMaxMessage)
+  }
+
+  msg := make([]byte, length)
+
+  if _, err := io.ReadFull(r, msg); err != nil {
+    return nil, grpcErrorf(grpcInternal, "reading the message: %s", err)
+  }
+
+  return msg, nil
+}
+
+// grpcWrite sends a message with its length prefix
+func grpcWrite(w http.ResponseWriter, msg []byte) error {
+  prefix := make([]byte, 5, 5+len(msg))
+  binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+
+  if _, err := w.Write(append(prefix, msg...)); err != nil {
+    return err
+  }
+
+  w.(http.Flusher).Flush()
+
+  return nil
+}
+
+// grpcFinish ends the call with its status in the trailers
+func grpcFinish(w http.ResponseWriter, err error) {
+  code, msg := grpcOK, ""
+
+  if err != nil {
+    var callErr *grpcError
+
+    if errors.As(err, &callErr) {
+      code, msg = callErr.code, callErr.msg
+    } else {
+      code, msg = grpcUnavailable, err.Error()
+    }
+  }
+
+  w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+
+  if msg != "" {
+    w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(msg))
+  }
+}
+
+// grpcEscape percent-encodes a status message as gRPC wants it in a header
+func grpcEscape(msg string) string {
+  var b strings.Builder
+
+  for i := 0; i < len(msg); i++ {
+    if c := msg[i]; c < 0x20 || c > 0x7e || c == '%' {
+      fmt.Fprintf(&b, "%%%02X", c)
+    } else {
+      b.WriteByte(c)
+    }
+  }
+
+  return b.String()
+}
+
+// pbJob appends a Job message's fields to b
+func pbJob(b []byte, v JobView) []byte {
+  b = pbVarint(b, 1, uint64(v.ID))
+  b = pbString(b, 2, v.UID)
+  b = pbString(b, 3, v.Input)
+  b = pbString(b, 4, v.Profile)
+  b = pbString(b, 5, string(v.State))
+  b = pbString(b, 6, v.Error)
+  b = pbVarint(b, 7, uint64(int64(v.Priority)))
+
+  for _, output := range v.Outputs {
+    b = pbMessage(b, 8, []byte(output))
+  }
+
+  b = pbTime(b, 9, v.QueuedAt)
+
+  if v.StartedAt != nil {
+    b = pbTime(b, 10, *v.StartedAt)
+  }
+
+  if v.FinishedAt != nil {
+    b = pbTime(b, 11, *v.FinishedAt)
+  }
+
+  if v.Percent != nil {
+    b = pbDouble(b, 12, *v.Percent)
+  }
+
+  if v.ETASeconds != nil {
+    b = pbDouble(b, 13, *v.ETASeconds)
+  }
+
+  b = pbString(b, 14, v.Progress)
+  b = pbString(b, 15, v.Target)
+
+  return b
+}
+
+// pbJobView reads a Job message
+func pbJobView(msg []byte) (JobView, error) {
+  var v JobView
+  var err error
+
+  timeField := func(data []byte) *time.Time {
+    t, terr := pbTimeValue(data)
+
+    if terr != nil {
+      err = terr
+    }
+
+    return &t
+  }
+
+  ferr := pbFields(msg, func(field int, n uint64, data []byte) {
+    switch field {
+    case 1:
+      v.ID = int64(n)
+    case 2:
+      v.UID = string(data)
+    case 3:
+      v.Input = string(data)
+    case 4:
+      v.Profile = string(data)
+    case 5:
+      v.State = JobState(data)
+    case 6:
+      v.Error = string(data)
+    case 7:
+      v.Priority = int(int32(n))
+    case 8:
+      v.Outputs = append(v.Outputs, string(data))
+    case 9:
+      v.QueuedAt = *timeField(data)
+    case 10:
+      v.StartedAt = timeField(data)
+    case 11:
+      v.FinishedAt = timeField(data)
+    case 12:
+      percent := math.Float64frombits(n)
+      v.Percent = &percent
+    case 13:
+      eta := math.Float64frombits(n)
+      v.ETASeconds = &eta
+    case 14:
+      v.Progress = string(data)
+    case 15:
+      v.Target = string(data)
+    }
+  })
+
+  if ferr != nil {
+    return v, ferr
+  }
+
+  return v, err
+}
+
+// protobuf wire types
+const (
+  pbWireVarint  = 0
+  pbWireFixed64 = 1
+  pbWireBytes   = 2
+  pbWireFixed32 = 5
+)
+
+func pbTag(b []byte, field int, wire int) []byte {
+  return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+// pbVarint appends an integer field, proto3 leaves out zero
+func pbVarint(b []byte, field int, v uint64) []byte {
+  if v == 0 {
+    return b
+  }
+
+  return binary.AppendUvarint(pbTag(b, field, pbWireVarint), v)
+}
+
+func pbBool(b []byte, field int, v bool) []byte {
+  if !v {
+    return b
+  }
+
+  return pbVarint(b, field, 1)
+}
+
+// pbString appends a string field, proto3 leaves out empty strings
+func pbString(b []byte, field int, s string) []byte {
+  if s == "" {
+    return b
+  }
+
+  return pbMessage(b, field, []byte(s))
+}
+
+// pbMessage appends a length-delimited field, an embedded message or a
+// repeated string
+func pbMessage(b []byte, field int, msg []byte) []byte {
+  b = binary.AppendUvarint(pbTag(b, field, pbWireBytes), uint64(len(msg)))
+
+  return append(b, msg...)
+}
+
+// pbDouble appends a double field, even zero as the fields it is used for
+// are optional
+func pbDouble(b []byte, field int, v float64) []byte {
+  return binary.LittleEndian.AppendUint64(pbTag(b, field, pbWireFixed64), math.Float64bits(v))
+}
+
+// pbTime appends a google.protobuf.Timestamp, nothing for the zero time
+func pbTime(b []byte, field int, t time.Time) []byte {
+  if t.IsZero() {
+    return b
+  }
+
+  var msg []byte
+  msg = pbVarint(msg, 1, uint64(t.Unix()))
+  msg = pbVarint(msg, 2, uint64(t.Nanosecond()))
+
+  return pbMessage(b, field, msg)
+}
+
+// pbTimeValue reads a google.protobuf.Timestamp
+func pbTimeValue(msg []byte) (time.Time, error) {
+  var seconds, nanos int64
+
+  err := pbFields(msg, func(field int, v uint64, _ []byte) {
+    switch field {
+    case 1:
+      seconds = int64(v)
+    case 2:
+      nanos = int64(int32(v))
+    }
+  })
+
+  return time.Unix(seconds, nanos).UTC(), err
+}
+
+// pbFields calls fn with each field of a message in turn. v is the value of
+// a varint or fixed field, data that of a length-delimited one
+func pbFields(msg []byte, fn func(field int, v uint64, data []byte)) error {
+  malformed := grpcErrorf(grpcInvalidArgument, "malformed protobuf message")
+
+  for len(msg) > 0 {
+    tag, n := binary.Uvarint(msg)
+
+    if n <= 0 {
+      return malformed
+    }
+
+    msg = msg[n:]
+
+    var v uint64
+    var data []byte
+
+    switch tag & 7 {
+    case pbWireVarint:
+      if v, n = binary.Uvarint(msg); n <= 0 {
+        return malformed
+      }
+
+      msg = msg[n:]
+    case pbWireFixed64:
+      if len(msg) < 8 {
+        return malformed
+      }
+
+      v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+    case pbWireBytes:
+      length, n := binary.Uvarint(msg)
+
+      if n <= 0 || length > uint64(len(msg)-n) {
+        return malformed
+      }
+
+      data, msg = msg[n:n+int(length)], msg[n+int(length):]
+    case pbWireFixed32:
+      if len(msg) < 4 {
+        return malformed
+      }
+
+      v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+    default:
+      return malformed
+    }
+
+    fn(int(tag>>3), v, data)
+  }
+
+  return nil
+}
@@ -0,0 +1,179 @@
+package watcher
+
+import (
+  "bytes"
+  "encoding/hex"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+)
+
+func TestPBEncoding(t *testing.T) {
+  minusOne := int64(-1)
+
+  tests := []struct {
+    name string
+    got  []byte
+    want string
+  }{
+    // the examples in the protobuf encoding guide
+    {"varint", pbVarint(nil, 1, 150), "089601"},
+    {"string", pbString(nil, 2, "testing"), "120774657374696e67"},
+    {"zero varint", pbVarint(nil, 1, 0), ""},
+    {"empty string", pbString(nil, 2, ""), ""},
+    {"false", pbBool(nil, 3, false), ""},
+    {"true", pbBool(nil, 3, true), "1801"},
+    {"negative", pbVarint(nil, 7, uint64(minusOne)), "38ffffffffffffffffff01"},
+    {"double", pbDouble(nil, 12, 1), "61000000000000f03f"},
+    {"zero double", pbDouble(nil, 12, 0), "610000000000000000"},
+    {"timestamp", pbTime(nil, 9, time.Unix(1, 5)), "4a0408011005"},
+    {"zero time", pbTime(nil, 9, time.Time{}), ""},
+  }
+
+  for _, test := range tests {
+    if got := hex.EncodeToString(test.got); got != test.want {
+      t.Errorf("%s: %s, want %s", test.name, got, test.want)
+    }
+  }
+}
+
+func TestPBJobRoundTrip(t *testing.T) {
+  started := time.Date(2024, time.March, 1, 10, 0, 0, 123, time.UTC)
+  percent, eta := 0.0, 90.5
+
+  want := JobView{
+    ID:         42,
+    UID:        "01HQ7Z8Y9X0W1V2T3S4R5Q6P7N",
+    Input:      "/queue/clip.mov",
+    Profile:    "h264",
+    State:      JobRunning,
+    Priority:   -5,
+    Outputs:    []string{"/finished/clip.mp4", "/finished/clip.webm"},
+    QueuedAt:   started.Add(-time.Minute),
+    StartedAt:  &started,
+    Percent:    &percent,
+    ETASeconds: &eta,
+    Progress:   "00:01:00",
+    Target:     "clip",
+  }
+
+  got, err := pbJobView(pbJob(nil, want))
+
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if !reflect.DeepEqual(got, want) {
+    t.Errorf("round trip gave %+v, want %+v", got, want)
+  }
+}
+
+func TestPBFieldsMalformed(t *testing.T) {
+  for _, msg := range []string{
+    "08",       // a varint cut short
+    "0880",     // a varint without its last byte
+    "120561",   // a string longer than the message
+    "0b",       // a group, not supported
+    "090102",   // a fixed64 cut short
+    "0d0102",   // a fixed32 cut short
+    "12ffffff", // a length cut short
+  } {
+    data, _ := hex.DecodeString(msg)
+
+    if err := pbFields(data, func(int, uint64, []byte) {}); err == nil {
+      t.Errorf("pbFields(%s) did not fail", msg)
+    }
+  }
+}
+
+func TestGRPCMessageFraming(t *testing.T) {
+  var b bytes.Buffer
+  b.Write([]byte{0, 0, 0, 0, 3, 'a', 'b', 'c'})
+
+  if msg, err := grpcReadMessage(&b); err != nil || string(msg) != "abc" {
+    t.Errorf("grpcReadMessage = %q, %v, want abc", msg, err)
+  }
+
+  if _, err := grpcReadMessage(bytes.NewReader([]byte{1, 0, 0, 0, 0})); err == nil {
+    t.Error("a compressed message was read")
+  }
+
+  if _, err := grpcReadMessage(bytes.NewReader([]byte{0, 0, 0, 0, 3, 'a'})); err == nil {
+    t.Error("a message cut short was read")
+  }
+}
+
+func TestRequireGRPCToken(t *testing.T) {
+  next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+  })
+
+  for _, c := range []struct {
+    token, method, auth string
+    status              string
+  }{
+    {"secret", "Enqueue", "Bearer secret", "0"},
+    {"secret", "Enqueue", "", "16"},
+    {"secret", "Cancel", "Bearer wrong", "16"},
+    {"secret", "Pause", "secret", "16"},
+    {"", "Enqueue", "Bearer secret", "7"},
+    {"", "ListJobs", "", "0"},
+    {"secret", "WatchEvents", "", "0"},
+    {"secret", "TakeTask", "", "0"},
+  } {
+    r := httptest.NewRequest(http.MethodPost, "/"+grpcService+"/"+c.method, nil)
+
+    if c.auth != "" {
+      r.Header.Set("Authorization", c.auth)
+    }
+
+    rec := httptest.NewRecorder()
+    RequireGRPCToken(c.token, next).ServeHTTP(rec, r)
+
+    if got := rec.Result().Trailer.Get("Grpc-Status"); got != c.status {
+      t.Errorf("%s with token %q and %q: status %s, want %s", c.method, c.token, c.auth, got, c.status)
+    }
+  }
+}
+
+func TestInQueue(t *testing.T) {
+  dir := t.TempDir()
+  queue := filepath.Join(dir, "queue")
+  other := filepath.Join(dir, "other")
+
+  for _, d := range []string{filepath.Join(queue, "priority"), other} {
+    if err := os.MkdirAll(d, 0o755); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  for _, f := range []string{filepath.Join(queue, "a.mkv"), filepath.Join(queue, "priority", "b.mkv"), filepath.Join(other, "c.mkv")} {
+    if err := os.WriteFile(f, nil, 0o644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  if err := os.Symlink(filepath.Join(other, "c.mkv"), filepath.Join(queue, "link.mkv")); err != nil {
+    t.Fatal(err)
+  }
+
+  w := &Watcher{queueDir: queue}
+
+  for path, want := range map[string]bool{
+    filepath.Join(queue, "a.mkv"):                true,
+    filepath.Join(queue, "priority", "b.mkv"):    true,
+    filepath.Join(other, "c.mkv"):                false,
+    filepath.Join(queue, "..", "other", "c.mkv"): false,
+    filepath.Join(queue, "link.mkv"):             false,
+    filepath.Join(queue, "missing.mkv"):          false,
+    queue:                                        false,
+  } {
+    if got := w.inQueue(path); got != want {
+      t.Errorf("inQueue(%s) = %v, want %v", path, got, want)
+    }
+  }
+}
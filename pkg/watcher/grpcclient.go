@@ -0,0 +1,233 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "crypto/tls"
+  "encoding/binary"
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+)
+
+// GRPCClient calls the gRPC API of gowatcher.proto, for Go programs that
+// would rather not generate it. Other languages generate their stubs from
+// gowatcher.proto
+type GRPCClient struct {
+  // Root names the root with several, see GroupGRPCHandler
+  Root string
+
+  // Token is sent as a bearer token with each call, the server's API_TOKEN
+  // for Enqueue, Cancel and Pause or an agent's AGENTS_TOKEN
+  Token string
+
+  addr string
+  http *http.Client
+}
+
+// GRPCStatusError is a call that failed with a gRPC status other than OK
+type GRPCStatusError struct {
+  Code    int
+  Message string
+}
+
+func (e *GRPCStatusError) Error() string {
+  return fmt.Sprintf("grpc status %d: %s", e.Code, e.Message)
+}
+
+// NewGRPCClient calls the server at host:port over TLS, config nil verifies
+// its certificate with the system's CAs
+func NewGRPCClient(addr string, config *tls.Config) *GRPCClient {
+  transport := &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: true}
+
+  return &GRPCClient{addr: addr, http: &http.Client{Transport: transport}}
+}
+
+// Enqueue queues the file at path for encoding
+func (c *GRPCClient) Enqueue(ctx context.Context, path string) (JobView, error) {
+  return c.callJob(ctx, "Enqueue", pbString(nil, 1, path))
+}
+
+// EnqueueURL downloads the file at rawURL and queues it, see
+// Watcher.EnqueueURL
+func (c *GRPCClient) EnqueueURL(ctx context.Context, rawURL string, name string) (JobView, error) {
+  return c.callJob(ctx, "Enqueue", pbString(pbString(nil, 2, rawURL), 3, name))
+}
+
+// ListJobs lists the jobs, or only those in state when it is not empty
+func (c *GRPCClient) ListJobs(ctx context.Context, state JobState) ([]JobView, error) {
+  var jobs []JobView
+
+  err := c.call(ctx, "ListJobs", pbString(nil, 1, string(state)), func(msg []byte) error {
+    var err error
+
+    ferr := pbFields(msg, func(field int, _ uint64, data []byte) {
+      if field != 1 || err != nil {
+        return
+      }
+
+      var v JobView
+
+      if v, err = pbJobView(data); err == nil {
+        jobs = append(jobs, v)
+      }
+    })
+
+    if ferr != nil {
+      return ferr
+    }
+
+    return err
+  })
+
+  return jobs, err
+}
+
+// WatchEvents calls fn with each event of job only, or of every job when it
+// is 0, until ctx is done, fn returns an error or the server ends the stream
+func (c *GRPCClient) WatchEvents(ctx context.Context, only int64, fn func(StreamEvent) error) error {
+  return c.call(ctx, "WatchEvents", pbVarint(nil, 1, uint64(only)), func(msg []byte) error {
+    var ev StreamEvent
+    var err error
+
+    ferr := pbFields(msg, func(field int, _ uint64, data []byte) {
+      switch field {
+      case 1:
+        ev.Event = string(data)
+      case 2:
+        ev.Time, err = pbTimeValue(data)
+      case 3:
+        ev.Job, err = pbJobView(data)
+      }
+    })
+
+    if ferr != nil {
+      return ferr
+    }
+
+    if err != nil {
+      return err
+    }
+
+    return fn(ev)
+  })
+}
+
+// Cancel cancels the job with the id or ULID, see Watcher.Cancel
+func (c *GRPCClient) Cancel(ctx context.Context, id string, then CancelAction) (JobView, error) {
+  return c.callJob(ctx, "Cancel", pbString(pbString(nil, 1, id), 2, string(then)))
+}
+
+// Pause pauses the queue, or resumes it, and returns whether it is paused
+func (c *GRPCClient) Pause(ctx context.Context, resume bool) (bool, error) {
+  var paused bool
+
+  err := c.call(ctx, "Pause", pbBool(nil, 1, resume), func(msg []byte) error {
+    return pbFields(msg, func(field int, v uint64, _ []byte) {
+      if field == 1 {
+        paused = v != 0
+      }
+    })
+  })
+
+  return paused, err
+}
+
+// callJob makes a call whose reply is a Job
+func (c *GRPCClient) callJob(ctx context.Context, method string, req []byte) (JobView, error) {
+  var v JobView
+
+  err := c.call(ctx, method, req, func(msg []byte) error {
+    var err error
+    v, err = pbJobView(msg)
+
+    return err
+  })
+
+  return v, err
+}
+
+// call sends req to the method and passes each reply to fn, then returns
+// the call's status
+func (c *GRPCClient) call(ctx context.Context, method string, req []byte, fn func([]byte) error) error {
+  body := make([]byte, 5, 5+len(req))
+  binary.BigEndian.PutUint32(body[1:], uint32(len(req)))
+  body = append(body, req...)
+
+  return c.stream(ctx, method, bytes.NewReader(body), fn)
+}
+
+// stream sends the length-prefixed messages read from body to the method,
+// for a call streaming its requests, and passes each reply to fn
+func (c *GRPCClient) stream(ctx context.Context, method string, body io.Reader, fn func([]byte) error) error {
+  endpoint := (&url.URL{Scheme: "https", Host: c.addr, Path: "/" + grpcService + "/" + method}).String()
+  r, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+
+  if err != nil {
+    return err
+  }
+
+  r.Header.Set("Content-Type", "application/grpc")
+  r.Header.Set("Te", "trailers")
+
+  if c.Root != "" {
+    r.Header.Set(grpcRootHeader, c.Root)
+  }
+
+  if c.Token != "" {
+    r.Header.Set("Authorization", "Bearer "+c.Token)
+  }
+
+  resp, err := c.http.Do(r)
+
+  if err != nil {
+    return err
+  }
+
+  defer resp.Body.Close()
+
+  if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc") {
+    return fmt.Errorf("not a gRPC response: %s", resp.Status)
+  }
+
+  for {
+    msg, err := grpcReadMessage(resp.Body)
+
+    if err == io.EOF {
+      break
+    }
+
+    if err != nil {
+      return err
+    }
+
+    if err := fn(msg); err != nil {
+      return err
+    }
+  }
+
+  // a call that failed before replying has its status in the headers
+  status := resp.Trailer.Get("Grpc-Status")
+  message := resp.Trailer.Get("Grpc-Message")
+
+  if status == "" {
+    status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+  }
+
+  code, err := strconv.Atoi(status)
+
+  if err != nil {
+    return fmt.Errorf("no gRPC status in the response")
+  }
+
+  if code != grpcOK {
+    message, _ = url.PathUnescape(message)
+
+    return &GRPCStatusError{Code: code, Message: message}
+  }
+
+  return nil
+}
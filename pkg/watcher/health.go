@@ -0,0 +1,149 @@
+package watcher
+
+import (
+  "fmt"
+  "net/http"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// HealthView is the JSON returned by GET /healthz and /readyz. Live is
+// false when the queue stops answering, a wedged watcher. Ready also needs
+// the watcher started and not shutting down, ffmpeg where it was found and
+// the queue directory there, Problems says what is missing
+type HealthView struct {
+  Name      string     `json:"name,omitempty"`
+  Live      bool       `json:"live"`
+  Ready     bool       `json:"ready"`
+  Problems  []string   `json:"problems,omitempty"`
+  LastEvent *time.Time `json:"last_event,omitempty"`
+  Queued    int        `json:"queued"`
+  Running   int        `json:"running"`
+  Workers   int        `json:"workers"`
+  FFmpeg    bool       `json:"ffmpeg"`
+}
+
+// healthTimeout is how long the queue has to answer before the watcher is
+// not live
+const healthTimeout = 5 * time.Second
+
+// Health checks the watcher, see HealthView
+func (w *Watcher) Health() HealthView {
+  h := HealthView{Name: w.cfg.Name, Running: int(w.stats.encodesInProgress.Load())}
+
+  if at := w.lastEvent.Load(); at != 0 {
+    t := time.Unix(0, at)
+    h.LastEvent = &t
+  }
+
+  // a deadlock would block the check too, so it gets a deadline
+  answered := make(chan [2]int, 1)
+
+  go func() {
+    w.Jobs(JobRunning)
+    answered <- [2]int{w.Queued(), w.pool.size()}
+  }()
+
+  select {
+  case counts := <-answered:
+    h.Live, h.Queued, h.Workers = true, counts[0], counts[1]
+  case <-time.After(healthTimeout):
+    return HealthView{Name: h.Name, LastEvent: h.LastEvent, Problems: []string{"the queue is not answering"}}
+  }
+
+  switch {
+  case w.stopping.Load():
+    h.Problems = append(h.Problems, "shutting down")
+  case !w.started.Load():
+    h.Problems = append(h.Problems, "not started")
+  }
+
+  if w.cfg.FFmpegPath != "" {
+    if err := executable(w.cfg.FFmpegPath); err != nil {
+      h.Problems = append(h.Problems, fmt.Sprintf("ffmpeg: %s", err))
+    } else {
+      h.FFmpeg = true
+    }
+  }
+
+  for _, p := range w.profiles.Load().byName {
+    // a container's is in its image
+    if p.ffmpeg != "" && filepath.IsAbs(p.ffmpeg) {
+      if err := executable(p.ffmpeg); err != nil {
+        h.Problems = append(h.Problems, fmt.Sprintf("profile %s's ffmpeg: %s", p.Name, err))
+      }
+    }
+  }
+
+  if _, err := os.Stat(w.queueDir); err != nil {
+    h.Problems = append(h.Problems, fmt.Sprintf("queue directory: %s", err))
+  }
+
+  h.Ready = len(h.Problems) == 0
+
+  return h
+}
+
+// executable reports why path cannot be run, nil when it can. The mode is
+// not checked on Windows, which goes by the extension
+func executable(path string) error {
+  info, err := os.Stat(path)
+
+  switch {
+  case err != nil:
+    return err
+  case info.IsDir():
+    return fmt.Errorf("%s is a directory", path)
+  case os.PathSeparator == '/' && info.Mode()&0111 == 0:
+    return fmt.Errorf("%s is not executable", path)
+  }
+
+  return nil
+}
+
+// touch records that the watchers or a scan saw a file
+func (w *Watcher) touch() {
+  w.lastEvent.Store(time.Now().UnixNano())
+}
+
+// GroupHealthHandler serves /healthz and /readyz for several watchers, the
+// status is 503 when any of them is not live, or not ready
+func GroupHealthHandler(watchers []*Watcher) http.Handler {
+  mux := http.NewServeMux()
+  mux.HandleFunc("/healthz", groupHealth(watchers, false))
+  mux.HandleFunc("/readyz", groupHealth(watchers, true))
+
+  return mux
+}
+
+func groupHealth(watchers []*Watcher, ready bool) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    views := make([]HealthView, 0, len(watchers))
+    ok := true
+
+    for _, watcher := range watchers {
+      h := watcher.Health()
+      ok = ok && h.Live && (h.Ready || !ready)
+      views = append(views, h)
+    }
+
+    writeHealth(w, ok, views)
+  }
+}
+
+func (a *api) health(ready bool) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    h := a.w.Health()
+    writeHealth(w, h.Live && (h.Ready || !ready), h)
+  }
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, v interface{}) {
+  if !ok {
+    writeJSON(w, http.StatusServiceUnavailable, v)
+    return
+  }
+
+  writeJSON(w, http.StatusOK, v)
+}
@@ -0,0 +1,207 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+const (
+  defaultHoldingSettle = 30 * time.Second
+
+  // holdingCheck is how often the holding directory is looked at
+  holdingCheck = 2 * time.Second
+
+  // doneSuffix marks an upload as complete, movie.mkv.done
+  doneSuffix = ".done"
+)
+
+// Holding watches the holding directory, where uploads go while they are
+// written, and moves each upload into the queue directory once it is
+// complete, its job spec, checksum and companions first. An upload is
+// complete once movie.mkv.done is there, which is then removed, once it
+// matches its movie.mkv.sha256 or .md5, or once its size and modification
+// time have not changed for Settle. An upload named like a file in the
+// queue directory waits for that one to go. Folders, dotfiles and files
+// named like the IgnorePatterns are left where they are
+type Holding struct {
+  // Dir is the holding directory, default BASE_DIR/upload
+  Dir string
+
+  // Settle is how long an upload must not change to be complete, default
+  // 30s
+  Settle time.Duration
+
+  // Markers only takes a .done marker or a matching checksum as complete,
+  // for transfers that can stall for longer than Settle
+  Markers bool
+}
+
+func (h *Holding) check() error {
+  if h.Settle < 0 {
+    return fmt.Errorf("settle must not be negative")
+  }
+
+  if h.Settle == 0 {
+    h.Settle = defaultHoldingSettle
+  }
+
+  return nil
+}
+
+// holdingFile is what the holding directory was last seen to have of an
+// upload: its size and modification time, since when they have been the
+// same, whether its checksum was checked at them and whether it was logged
+// waiting for a name in the queue
+type holdingFile struct {
+  size    int64
+  modTime time.Time
+  since   time.Time
+  checked bool
+  waiting bool
+}
+
+// watchHolding moves the holding directory's complete uploads into the
+// queue directory until stop is closed
+func (w *Watcher) watchHolding(stop <-chan struct{}) {
+  seen := make(map[string]*holdingFile)
+  ticker := time.NewTicker(holdingCheck)
+  defer ticker.Stop()
+
+  slog.Info("Watching for uploads", "dir", w.holdingDir, "settle", w.cfg.Holding.Settle.String(), "markers", w.cfg.Holding.Markers)
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+
+    w.checkHolding(seen, time.Now())
+  }
+}
+
+func (w *Watcher) checkHolding(seen map[string]*holdingFile, now time.Time) {
+  entries, err := os.ReadDir(w.holdingDir)
+
+  if err != nil {
+    slog.Debug("Could not list the holding directory", "dir", w.holdingDir, "error", err)
+    return
+  }
+
+  h := w.cfg.Holding
+  filter := w.filter.Load()
+  present := make(map[string]bool, len(entries))
+
+  for _, entry := range entries {
+    name := entry.Name()
+    path := filepath.Join(w.holdingDir, name)
+
+    // the sidecars and markers go with their upload
+    if !entry.Type().IsRegular() || filter.ignored(path) || isSidecar(path) || w.isCompanion(path) || strings.HasSuffix(name, doneSuffix) {
+      continue
+    }
+
+    info, err := entry.Info()
+
+    if err != nil {
+      continue
+    }
+
+    present[name] = true
+    f := seen[name]
+    changed := f == nil || f.size != info.Size() || !f.modTime.Equal(info.ModTime())
+
+    if changed {
+      f = &holdingFile{size: info.Size(), modTime: info.ModTime(), since: now}
+      seen[name] = f
+    }
+
+    _, err = os.Stat(path + doneSuffix)
+    marked := err == nil
+    by := "marker"
+
+    // a checksum is only worth reading once the upload stopped changing
+    if sidecar := findChecksum(path); !marked && sidecar != "" && !changed && !f.checked {
+      f.checked = true
+
+      if err := matchChecksum(sidecar, path, path); err == nil {
+        marked, by = true, "checksum"
+      } else {
+        slog.Debug("Upload does not match its checksum yet", "file", path, "error", err)
+      }
+    }
+
+    if !marked && (h.Markers || now.Sub(f.since) < h.Settle) {
+      continue
+    }
+
+    if !marked {
+      by = "settled"
+    }
+
+    dest := filepath.Join(w.queueDir, name)
+
+    if _, err := os.Lstat(dest); err == nil {
+      if !f.waiting {
+        f.waiting = true
+        slog.Warn("Upload is complete but the queue has a file of the same name, waiting for it to go", "file", path)
+      }
+
+      continue
+    }
+
+    if err := w.promoteUpload(path); err != nil {
+      slog.Error("Could not move upload into the queue", "file", path, "error", err)
+      continue
+    }
+
+    os.Remove(path + doneSuffix)
+    delete(seen, name)
+
+    slog.Info("Moved completed upload into the queue", "file", path, "to", dest, "by", by, "size", FormatSize(info.Size()))
+  }
+
+  for name := range seen {
+    if !present[name] {
+      delete(seen, name)
+    }
+  }
+}
+
+// promoteUpload moves an upload into the queue directory, its job spec,
+// checksum and companions first so they are there once it is seen
+func (w *Watcher) promoteUpload(path string) error {
+  return w.moveWithSidecars(path, w.queueDir, "uploaded")
+}
+
+// moveWithSidecars moves path into dir after its job spec, checksum and
+// companions, auditing each move with reason
+func (w *Watcher) moveWithSidecars(path string, dir string, reason string) error {
+  var sidecars []string
+
+  if spec := findSpec(path); spec != "" {
+    sidecars = append(sidecars, spec)
+  }
+
+  if checksum := findChecksum(path); checksum != "" {
+    sidecars = append(sidecars, checksum)
+  }
+
+  sidecars = append(sidecars, w.cfg.Companions.find(path)...)
+
+  for _, sidecar := range append(sidecars, path) {
+    to := filepath.Join(dir, filepath.Base(sidecar))
+
+    if err := moveFile(sidecar, to); err != nil {
+      return err
+    }
+
+    w.enc.audit.moved(nil, sidecar, to, reason)
+  }
+
+  return nil
+}
@@ -0,0 +1,291 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "os/exec"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// defaultHookTimeout bounds a hook that does not set its own timeout
+const defaultHookTimeout = 5 * time.Minute
+
+// errPostHook is reported for jobs failed by their post hook with FailJob
+var errPostHook = errors.New("post hook")
+
+// Hook is a command run at a point in a job's life. It gets the job's
+// details in GOWATCHER_* environment variables:
+//
+//	GOWATCHER_JOB_ID     the job id
+//	GOWATCHER_JOB_UID    the job's ULID, unique across restarts
+//	GOWATCHER_INPUT      the input path
+//	GOWATCHER_TARGET     the file a symlinked input ends at, with
+//	                     SymlinksResolve only
+//	GOWATCHER_PROFILE    the profile name
+//	GOWATCHER_OUTPUT     the first output path, post hooks only
+//	GOWATCHER_OUTPUTS    every output path, one per line, post hooks only
+//	GOWATCHER_DURATION   the encode's wall time in seconds, post hooks only
+//	GOWATCHER_UPLOADS    where the outputs were uploaded, s3:// URLs or
+//	                     rclone remote paths, one per line, post hooks with
+//	                     uploads only
+//	GOWATCHER_COMPANIONS the input's companions, one per line, with
+//	                     Companions only. Post hooks get their copies in
+//	                     finished
+//
+// The profile's Env is set too. With telemetry TRACEPARENT is the job's
+// span, so a hook can add its own.
+// Pre hooks get the input path as an extra argument and decide what happens
+// to the job, see PreHookDecision. Post hooks get the output paths. A post
+// hook's output goes to the job log
+type Hook struct {
+  Command []string
+
+  // Timeout kills the hook, default 5m. A shutdown does too, and cancelling
+  // the job kills its post hook
+  Timeout time.Duration
+
+  // FailJob fails the job when the hook fails, otherwise the failure is
+  // only logged. The outputs stay in finished and the input where it is,
+  // neither retried nor moved to the failed directory. A pre hook exiting
+  // non-zero is a veto rather than a failure
+  FailJob bool
+}
+
+// PreHookDecision is what a pre hook can print as JSON on stdout. Printing
+// nothing and exiting 0 encodes the job as usual, exiting non-zero skips it
+//
+//	{"action": "encode", "profile": "web"}   encode, optionally with another profile
+//	{"action": "skip", "reason": "..."}      leave the input in the queue directory
+//	{"action": "delay", "delay": "10m"}      ask the hook again after the delay
+type PreHookDecision struct {
+  Action  string `json:"action"`
+  Profile string `json:"profile,omitempty"`
+  Delay   string `json:"delay,omitempty"`
+  Reason  string `json:"reason,omitempty"`
+}
+
+// errSkipped is reported for jobs a pre hook vetoed
+var errSkipped = errors.New("skipped by pre hook")
+
+// run runs the hook for the job with extra arguments appended to its
+// command, killing it once ctx is done or it times out
+func (h *Hook) run(ctx context.Context, j *Job, env []string, args []string, stdout io.Writer, stderr io.Writer) error {
+  timeout := h.Timeout
+
+  if timeout <= 0 {
+    timeout = defaultHookTimeout
+  }
+
+  parent := ctx
+  ctx, cancel := context.WithTimeout(ctx, timeout)
+  defer cancel()
+
+  j.mu.Lock()
+  input, target := j.input, j.target
+  j.mu.Unlock()
+
+  cmd := exec.CommandContext(ctx, h.Command[0], append(append([]string(nil), h.Command[1:]...), args...)...)
+  cmd.Stdout = stdout
+  cmd.Stderr = stderr
+  // the profile's own variables cannot replace gowatcher's
+  cmd.Env = append(os.Environ(), j.env()...)
+  cmd.Env = append(cmd.Env,
+    "GOWATCHER_JOB_ID="+strconv.FormatInt(j.id, 10),
+    "GOWATCHER_JOB_UID="+j.uid,
+    "GOWATCHER_INPUT="+input,
+    "GOWATCHER_PROFILE="+j.profile.Name,
+  )
+  if target != "" {
+    cmd.Env = append(cmd.Env, "GOWATCHER_TARGET="+target)
+  }
+
+  cmd.Env = append(cmd.Env, env...)
+
+  if traceParent := j.traceParent(); traceParent != "" {
+    cmd.Env = append(cmd.Env, "TRACEPARENT="+traceParent)
+  }
+
+  fmt.Fprintf(stderr, "\n%s\n", strings.Join(cmd.Args, " "))
+
+  err := cmd.Run()
+
+  switch {
+  case parent.Err() != nil:
+    return context.Cause(parent)
+  case ctx.Err() == context.DeadlineExceeded:
+    return fmt.Errorf("hook timed out after %s", timeout)
+  }
+
+  return err
+}
+
+// runPostHook runs the post hook for a job whose outputs are in finished
+// until the job's ctx is done, the returned error is only set when the hook
+// failing should fail the job or ctx is done
+func (e *encoder) runPostHook(ctx context.Context, j *Job, finished []string, companions []string, took time.Duration, output io.Writer) error {
+  if e.postHook == nil {
+    return nil
+  }
+
+  env := []string{
+    "GOWATCHER_OUTPUT=" + finished[0],
+    "GOWATCHER_OUTPUTS=" + strings.Join(finished, "\n"),
+    "GOWATCHER_DURATION=" + strconv.FormatFloat(took.Seconds(), 'f', 0, 64),
+  }
+
+  j.mu.Lock()
+  if len(j.uploads) > 0 {
+    env = append(env, "GOWATCHER_UPLOADS="+strings.Join(j.uploads, "\n"))
+  }
+  j.mu.Unlock()
+
+  if len(companions) > 0 {
+    env = append(env, "GOWATCHER_COMPANIONS="+strings.Join(companions, "\n"))
+  }
+
+  endSpan := e.telemetry.phase(j, "post_hook")
+  err := e.postHook.run(ctx, j, env, finished, output, output)
+  endSpan(err)
+  e.audit.hookRan(j, "post", e.postHook, err)
+
+  if err == nil || ctx.Err() != nil {
+    return err
+  }
+
+  j.logger().Error("Post hook failed", "error", err, "fail_job", e.postHook.FailJob)
+
+  if e.postHook.FailJob {
+    return fmt.Errorf("%w: %s", errPostHook, err)
+  }
+
+  return nil
+}
+
+// preHookAction is what the encoder does with a job after its pre hook
+type preHookAction int
+
+const (
+  preHookEncode preHookAction = iota
+  preHookSkip
+  preHookDelay
+  preHookFail
+)
+
+// runPreHook asks the pre hook what to do with the job. Encoding with
+// another profile switches the job's profile, a delay is returned with
+// preHookDelay and the reason or error with preHookSkip and preHookFail
+func (e *encoder) runPreHook(j *Job) (preHookAction, time.Duration, error) {
+  if e.preHook == nil {
+    return preHookEncode, 0, nil
+  }
+
+  if e.dryRun {
+    j.logger().Info("Dry run: would run pre hook", "command", strings.Join(e.preHook.Command, " "))
+    return preHookEncode, 0, nil
+  }
+
+  logger := j.logger()
+
+  var stdout, stderr bytes.Buffer
+
+  endSpan := e.telemetry.phase(j, "pre_hook")
+  err := e.preHook.run(e.ctx, j, nil, []string{j.input}, &stdout, &stderr)
+  endSpan(err)
+  e.audit.hookRan(j, "pre", e.preHook, err)
+
+  // a shutdown kills the hook, the job is cut off like a running one
+  if e.ctx.Err() != nil {
+    return preHookSkip, 0, errShutdown
+  }
+
+  var exitErr *exec.ExitError
+
+  if errors.As(err, &exitErr) {
+    logger.Info("Pre hook vetoed the job", "exit_status", exitErr.ExitCode(), "reason", lastLine(stderr.Bytes()))
+    return preHookSkip, 0, errSkipped
+  }
+
+  if err != nil {
+    logger.Error("Pre hook failed", "error", err, "fail_job", e.preHook.FailJob)
+
+    if e.preHook.FailJob {
+      return preHookFail, 0, fmt.Errorf("pre hook: %s", err)
+    }
+
+    return preHookEncode, 0, nil
+  }
+
+  out := bytes.TrimSpace(stdout.Bytes())
+
+  if len(out) == 0 {
+    return preHookEncode, 0, nil
+  }
+
+  var decision PreHookDecision
+
+  if err = json.Unmarshal(out, &decision); err != nil {
+    logger.Error("Pre hook printed something other than JSON", "error", err, "output", lastLine(out))
+    return preHookFail, 0, fmt.Errorf("pre hook output: %s", err)
+  }
+
+  switch decision.Action {
+  case "", "encode":
+    if decision.Profile == "" || decision.Profile == j.profile.Name {
+      return preHookEncode, 0, nil
+    }
+
+    p, ok := e.profiles.Load().byName[decision.Profile]
+
+    if !ok {
+      return preHookFail, 0, fmt.Errorf("pre hook asked for unknown profile %q", decision.Profile)
+    }
+
+    logger.Info("Pre hook switched profile", "to", p.Name)
+
+    j.mu.Lock()
+    if j.spec != nil {
+      p = j.spec.apply(p)
+    }
+    j.profile = p
+    j.mu.Unlock()
+
+    return preHookEncode, 0, nil
+  case "skip":
+    logger.Info("Pre hook skipped the job", "reason", decision.Reason)
+
+    if decision.Reason != "" {
+      return preHookSkip, 0, fmt.Errorf("%s: %s", errSkipped, decision.Reason)
+    }
+
+    return preHookSkip, 0, errSkipped
+  case "delay":
+    delay, err := time.ParseDuration(decision.Delay)
+
+    if err != nil || delay <= 0 {
+      return preHookFail, 0, fmt.Errorf("pre hook delay %q is not a valid duration", decision.Delay)
+    }
+
+    logger.Info("Pre hook delayed the job", "delay", delay.String(), "reason", decision.Reason)
+
+    return preHookDelay, delay, nil
+  default:
+    return preHookFail, 0, fmt.Errorf("pre hook action %q is not encode, skip or delay", decision.Action)
+  }
+}
+
+// delayJob puts a job back on the queue once delay has passed, unless it was
+// cancelled meanwhile
+func (e *encoder) delayJob(j *Job, delay time.Duration) {
+  time.AfterFunc(delay, func() {
+    if j.State() == JobQueued {
+      e.queue.push(j)
+    }
+  })
+}
@@ -0,0 +1,98 @@
+package watcher
+
+import (
+  "context"
+  "log/slog"
+  "os/exec"
+  "time"
+)
+
+// HWVariant is a hardware accelerated alternative to a profile's flags. It
+// is used when its encoder works on this machine, e.g. h264_nvenc, h264_vaapi,
+// h264_qsv or h264_videotoolbox
+type HWVariant struct {
+  Encoder     string
+  InputFlags  []string
+  OutputFlags []string
+
+  // Resource is the class encodes with the variant count against instead
+  // of the profile's, e.g. nvenc
+  Resource string
+}
+
+// hwProbeTimeout bounds each test encode, a missing device can make ffmpeg
+// hang while it initialises
+const hwProbeTimeout = 20 * time.Second
+
+// detectEncoders test encodes a few frames with each encoder and returns
+// the ones that work. Being compiled into ffmpeg is not enough, the device
+// and driver have to be present too
+func detectEncoders(ffmpegPath string, encoders []string) map[string]bool {
+  working := make(map[string]bool)
+
+  for _, encoder := range encoders {
+    if _, done := working[encoder]; done {
+      continue
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), hwProbeTimeout)
+
+    cmd := exec.CommandContext(ctx, ffmpegPath,
+      "-hide_banner", "-loglevel", "error",
+      "-f", "lavfi", "-i", "color=size=256x256:duration=0.2",
+      "-c:v", encoder,
+      "-f", "null", "-",
+    )
+
+    err := cmd.Run()
+    cancel()
+
+    working[encoder] = err == nil
+
+    slog.Info("Hardware encoder check", "ffmpeg", ffmpegPath, "encoder", encoder, "available", err == nil)
+  }
+
+  return working
+}
+
+// selectHardware picks each profile's preferred working hardware variant,
+// testing the encoders with the ffmpeg the profile runs
+func selectHardware(ffmpegPath string, profiles map[string]*Profile) {
+  encoders := make(map[string][]string)
+
+  for _, p := range profiles {
+    for _, v := range p.Hardware {
+      path := p.ffmpegPath(ffmpegPath)
+      encoders[path] = append(encoders[path], v.Encoder)
+    }
+  }
+
+  if len(encoders) == 0 {
+    return
+  }
+
+  working := make(map[string]map[string]bool)
+
+  for path, names := range encoders {
+    working[path] = detectEncoders(path, names)
+  }
+
+  for _, p := range profiles {
+    p.hw = nil
+
+    for i := range p.Hardware {
+      if working[p.ffmpegPath(ffmpegPath)][p.Hardware[i].Encoder] {
+        p.hw = &p.Hardware[i]
+        break
+      }
+    }
+
+    if len(p.Hardware) > 0 {
+      if p.hw != nil {
+        slog.Info("Profile uses hardware encoding", "profile", p.Name, "encoder", p.hw.Encoder)
+      } else {
+        slog.Info("Profile uses software encoding, no hardware encoder available", "profile", p.Name)
+      }
+    }
+  }
+}
@@ -0,0 +1,282 @@
+package watcher
+
+import (
+  "fmt"
+  "io/fs"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// ImportMode is how Import puts a library's files into the queue directory
+type ImportMode string
+
+const (
+  // ImportLink symlinks each file into the queue directory, the library is
+  // left as it is and the originals policy only applies to the links. It
+  // needs the follow or resolve symlink policy
+  ImportLink ImportMode = "link"
+
+  // ImportCopy copies each file, keeping its modification time
+  ImportCopy ImportMode = "copy"
+
+  // ImportMove moves each file out of the library
+  ImportMove ImportMode = "move"
+)
+
+// ImportView is the JSON returned by POST /import. Files are the library's
+// files imported, or that would be, Skipped those already in the queue
+// directory
+type ImportView struct {
+  DryRun  bool     `json:"dry_run,omitempty"`
+  Mode    string   `json:"mode"`
+  Files   []string `json:"files"`
+  Skipped int      `json:"skipped,omitempty"`
+}
+
+// Import walks dir, an existing media library, and puts the files the file
+// filter allows into the queue directory, where they are queued as if they
+// had been dropped there, and routed when they are encoded. filters are
+// shell patterns of which one must match a file's name or its path under
+// dir, like *.mkv or Season */*, none lets every file through. Hidden
+// files and directories and gowatcher's own directories are left out. A
+// file's sidecars and companions come with it, a name already taken gets
+// a number, and a file still in the queue directory from an earlier import
+// is skipped
+func (w *Watcher) Import(dir string, mode ImportMode, filters []string, dryRun bool) (ImportView, error) {
+  view := ImportView{DryRun: dryRun, Mode: string(mode), Files: []string{}}
+
+  switch mode {
+  case ImportLink:
+    if w.cfg.Symlinks == SymlinksSkip {
+      return view, fmt.Errorf("linking needs the follow or resolve symlink policy, copy or move instead")
+    }
+  case ImportCopy, ImportMove:
+  default:
+    return view, fmt.Errorf("import mode must be link, copy or move, not %q", mode)
+  }
+
+  for _, pattern := range filters {
+    if _, err := filepath.Match(pattern, ""); err != nil {
+      return view, fmt.Errorf("bad filter %q: %s", pattern, err)
+    }
+  }
+
+  root, err := filepath.Abs(dir)
+
+  if err != nil {
+    return view, err
+  }
+
+  if info, err := os.Stat(root); err != nil {
+    return view, err
+  } else if !info.IsDir() {
+    return view, fmt.Errorf("%s is not a directory", root)
+  }
+
+  own := map[string]bool{}
+
+  for _, d := range []string{w.queueDir, w.priorityDir, w.enc.workingDir, w.enc.finishedDir, w.enc.failedDir, w.enc.originalsDir, w.enc.rejectedDir} {
+    if d != "" {
+      own[d] = true
+    }
+  }
+
+  if own[root] {
+    return view, fmt.Errorf("%s is one of gowatcher's own directories", root)
+  }
+
+  filter := w.filter.Load()
+  queued := w.queuedKeys()
+
+  err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+    if err != nil {
+      slog.Warn("Could not read library", "path", path, "error", err)
+      return nil
+    }
+
+    if path == root {
+      return nil
+    }
+
+    if entry.IsDir() {
+      if hidden(path) || own[path] {
+        return filepath.SkipDir
+      }
+
+      return nil
+    }
+
+    if !entry.Type().IsRegular() || hidden(path) || isSidecar(path) || w.isCompanion(path) || !filter.allowed(path) {
+      return nil
+    }
+
+    rel, _ := filepath.Rel(root, path)
+
+    if !importMatches(filters, filepath.Base(path), filepath.ToSlash(rel)) {
+      return nil
+    }
+
+    info, err := entry.Info()
+
+    if err != nil {
+      return nil
+    }
+
+    if queued[importKey(info)] {
+      view.Skipped++
+      return nil
+    }
+
+    queued[importKey(info)] = true
+
+    if dryRun {
+      view.Files = append(view.Files, path)
+      return nil
+    }
+
+    dest, err := w.importFile(path, mode)
+
+    if err != nil {
+      slog.Error("Could not import file", "file", path, "mode", mode, "error", err)
+      return nil
+    }
+
+    slog.Info("Imported file", "file", path, "mode", mode, "to", dest)
+
+    if mode == ImportMove {
+      w.enc.audit.moved(nil, path, dest, "import")
+    }
+
+    view.Files = append(view.Files, path)
+
+    w.found(dest)
+
+    return nil
+  })
+
+  return view, err
+}
+
+// importMatches reports whether one of filters matches the file's name or
+// its slash separated path relative to the library, true without filters
+func importMatches(filters []string, name string, rel string) bool {
+  if len(filters) == 0 {
+    return true
+  }
+
+  for _, pattern := range filters {
+    if matched, _ := filepath.Match(pattern, name); matched {
+      return true
+    }
+
+    if matched, _ := filepath.Match(filepath.ToSlash(pattern), rel); matched {
+      return true
+    }
+  }
+
+  return false
+}
+
+// importKey tells an imported file from the others in the queue directory
+// whatever it is named there: a link and a copy both have its size,
+// modification time and extension
+func importKey(info os.FileInfo) string {
+  return fmt.Sprintf("%d %d %s", info.Size(), info.ModTime().UnixNano(), strings.ToLower(filepath.Ext(info.Name())))
+}
+
+// queuedKeys are the importKeys of the files in the queue directory
+func (w *Watcher) queuedKeys() map[string]bool {
+  keys := make(map[string]bool)
+  entries, _ := os.ReadDir(w.queueDir)
+
+  for _, entry := range entries {
+    if info, err := os.Stat(filepath.Join(w.queueDir, entry.Name())); err == nil && info.Mode().IsRegular() {
+      keys[importKey(info)] = true
+    }
+  }
+
+  return keys
+}
+
+// importFile puts the file, its sidecars first, into the queue directory,
+// it returns where the file is there
+func (w *Watcher) importFile(path string, mode ImportMode) (string, error) {
+  dest := queuePath(w.queueDir, filepath.Base(path))
+
+  var sidecars [][2]string
+
+  for _, sidecar := range []string{findSpec(path), findChecksum(path)} {
+    if sidecar != "" {
+      sidecars = append(sidecars, [2]string{sidecar, dest + strings.TrimPrefix(sidecar, path)})
+    }
+  }
+
+  for _, companion := range w.cfg.Companions.find(path) {
+    sidecars = append(sidecars, [2]string{companion, companionPath(companion, path, dest)})
+  }
+
+  for _, s := range sidecars {
+    if err := importPlace(s[0], s[1], mode); err != nil {
+      return "", err
+    }
+  }
+
+  return dest, importPlace(path, dest, mode)
+}
+
+// importPlace links, copies or moves src to dest. A copy is written under
+// a hidden name and renamed, the watchers never see half of it
+func importPlace(src string, dest string, mode ImportMode) error {
+  switch mode {
+  case ImportLink:
+    return os.Symlink(src, dest)
+  case ImportMove:
+    return moveFile(src, dest)
+  }
+
+  part := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".part")
+
+  if err := copyLocal(src, part); err != nil {
+    os.Remove(part)
+    return err
+  }
+
+  return os.Rename(part, dest)
+}
+
+// importLibrary serves POST /import?dir=/library[&mode=link|copy|move]
+// [&filter=*.mkv...][&dry_run=true]. mode is link unless set
+func (a *api) importLibrary(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  query := r.URL.Query()
+  dir := query.Get("dir")
+
+  if dir == "" {
+    writeError(w, http.StatusBadRequest, "dir is required")
+    return
+  }
+
+  mode := ImportMode(query.Get("mode"))
+
+  if mode == "" {
+    mode = ImportLink
+  }
+
+  dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+  view, err := a.w.Import(dir, mode, query["filter"], dryRun)
+
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, view)
+}
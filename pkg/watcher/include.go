@@ -0,0 +1,397 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+
+  "gopkg.in/yaml.v3"
+)
+
+// configLists are the top level lists an included file adds to rather than
+// replaces
+var configLists = map[string]bool{"profiles": true, "routes": true, "roots": true}
+
+// readConfigNode reads the config file at path with the files it includes
+// merged in, as a YAML mapping. include names files or globs relative to
+// the file naming them. Their profiles, routes and roots come before the
+// including file's, its other settings win over theirs, and a later include
+// wins over an earlier one. seen holds the files already read, a file is
+// only included once
+func readConfigNode(path string, seen map[string]bool) (*yaml.Node, error) {
+  abs, err := filepath.Abs(path)
+
+  if err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  if seen[abs] {
+    return nil, fmt.Errorf("config %s: included more than once", path)
+  }
+
+  seen[abs] = true
+
+  data, err := os.ReadFile(path)
+
+  if err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  var doc yaml.Node
+
+  if err = yaml.Unmarshal(data, &doc); err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  root := newMapping()
+
+  if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+    root = deref(doc.Content[0])
+  }
+
+  // an empty file sets nothing
+  if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+    root = newMapping()
+  }
+
+  if root.Kind != yaml.MappingNode {
+    return nil, fmt.Errorf("config %s: the file must be a mapping of settings", path)
+  }
+
+  includes, err := includePaths(path, mappingValue(root, "include"))
+
+  if err != nil {
+    return nil, fmt.Errorf("config %s: %s", path, err)
+  }
+
+  removeKey(root, "include")
+
+  merged := newMapping()
+
+  for _, include := range includes {
+    node, err := readConfigNode(include, seen)
+
+    if err != nil {
+      return nil, err
+    }
+
+    mergeConfig(merged, node)
+  }
+
+  mergeConfig(merged, root)
+
+  return merged, nil
+}
+
+// includePaths are the files an include names, a single path or a list,
+// with globs expanded in order. A glob matching nothing includes nothing
+func includePaths(path string, node *yaml.Node) ([]string, error) {
+  if node == nil {
+    return nil, nil
+  }
+
+  var names flagList
+
+  switch node.Kind {
+  case yaml.ScalarNode:
+    names = flagList{node.Value}
+  case yaml.SequenceNode:
+    if err := node.Decode(&names); err != nil {
+      return nil, fmt.Errorf("include: %s", err)
+    }
+  default:
+    return nil, fmt.Errorf("include must be a path or a list of paths")
+  }
+
+  var paths []string
+
+  for _, name := range names {
+    if !filepath.IsAbs(name) {
+      name = filepath.Join(filepath.Dir(path), name)
+    }
+
+    if !strings.ContainsAny(name, "*?[") {
+      paths = append(paths, name)
+      continue
+    }
+
+    matches, err := filepath.Glob(name)
+
+    if err != nil {
+      return nil, fmt.Errorf("include %s: %s", name, err)
+    }
+
+    sort.Strings(matches)
+    paths = append(paths, matches...)
+  }
+
+  return paths, nil
+}
+
+// mergeConfig merges the settings of src into dst: the configLists are
+// appended to, mappings like resources merged and anything else replaced
+func mergeConfig(dst *yaml.Node, src *yaml.Node) {
+  for i := 0; i+1 < len(src.Content); i += 2 {
+    key, value := src.Content[i].Value, deref(src.Content[i+1])
+    existing := mappingValue(dst, key)
+
+    switch {
+    case existing == nil:
+      dst.Content = append(dst.Content, src.Content[i], value)
+    case configLists[key] && existing.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+      existing.Content = append(existing.Content, value.Content...)
+    case existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+      mergeMapping(existing, value)
+    default:
+      setKey(dst, key, value)
+    }
+  }
+}
+
+// resolveProfiles replaces each profile that extends others with the
+// settings it inherits from them merged with its own, and drops the
+// abstract ones, which only exist to be extended.
+//
+// extends names a profile, or a list whose later entries win over earlier
+// ones. The profile's own settings replace inherited ones, mappings like
+// metadata are merged key by key, and a key ending in + appends to the
+// inherited list rather than replacing it: output_flags+ adds flags after
+// the base's and outputs+ adds outputs to its outputs. name, extends and
+// abstract are never inherited
+func resolveProfiles(root *yaml.Node) error {
+  profiles := mappingValue(root, "profiles")
+
+  if profiles == nil || profiles.Kind != yaml.SequenceNode {
+    return nil
+  }
+
+  byName := make(map[string]*yaml.Node)
+
+  for _, node := range profiles.Content {
+    node = deref(node)
+
+    if name := scalarValue(node, "name"); name != "" && byName[name] == nil {
+      byName[name] = node
+    }
+  }
+
+  resolved := make(map[*yaml.Node]*yaml.Node)
+  resolving := make(map[*yaml.Node]bool)
+
+  var resolve func(node *yaml.Node) (*yaml.Node, error)
+
+  resolve = func(node *yaml.Node) (*yaml.Node, error) {
+    if r, ok := resolved[node]; ok {
+      return r, nil
+    }
+
+    name := scalarValue(node, "name")
+
+    if resolving[node] {
+      return nil, fmt.Errorf("profile %q extends itself", name)
+    }
+
+    resolving[node] = true
+    defer delete(resolving, node)
+
+    var parents flagList
+
+    if extends := mappingValue(node, "extends"); extends != nil {
+      if err := extends.Decode(&parents); err != nil {
+        return nil, fmt.Errorf("profile %q: extends must be a profile name or a list of them", name)
+      }
+    }
+
+    out := newMapping()
+
+    for _, parent := range parents {
+      base, ok := byName[parent]
+
+      if !ok {
+        return nil, fmt.Errorf("profile %q extends %q, which is not defined", name, parent)
+      }
+
+      inherited, err := resolve(base)
+
+      if err != nil {
+        return nil, err
+      }
+
+      inherit(out, inherited, true)
+    }
+
+    inherit(out, node, false)
+    removeKey(out, "extends")
+
+    resolved[node] = out
+
+    return out, nil
+  }
+
+  var content []*yaml.Node
+
+  for _, node := range profiles.Content {
+    node = deref(node)
+
+    if node.Kind != yaml.MappingNode {
+      content = append(content, node)
+      continue
+    }
+
+    r, err := resolve(node)
+
+    if err != nil {
+      return err
+    }
+
+    if abstract := mappingValue(r, "abstract"); abstract != nil {
+      var yes bool
+
+      if err = abstract.Decode(&yes); err != nil {
+        return fmt.Errorf("profile %q: abstract must be true or false", scalarValue(r, "name"))
+      }
+
+      if yes {
+        continue
+      }
+
+      removeKey(r, "abstract")
+    }
+
+    content = append(content, r)
+  }
+
+  profiles.Content = content
+
+  return nil
+}
+
+// inherit sets the settings of src on dst, from a base profile when
+// fromBase. A key ending in + appends to the list dst has under the key
+// without it, flags written as a string are split like flagList does
+func inherit(dst *yaml.Node, src *yaml.Node, fromBase bool) {
+  for i := 0; i+1 < len(src.Content); i += 2 {
+    key, value := src.Content[i].Value, deref(src.Content[i+1])
+
+    if fromBase && (key == "name" || key == "extends" || key == "abstract") {
+      continue
+    }
+
+    if base, appends := strings.CutSuffix(key, "+"); appends {
+      if existing := mappingValue(dst, base); existing != nil {
+        value = appendLists(existing, value)
+      }
+
+      setKey(dst, base, value)
+      continue
+    }
+
+    if existing := mappingValue(dst, key); existing != nil && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+      merged := newMapping()
+      mergeMapping(merged, existing)
+      mergeMapping(merged, value)
+      setKey(dst, key, merged)
+      continue
+    }
+
+    setKey(dst, key, value)
+  }
+}
+
+// appendLists is the list b appended to the list a
+func appendLists(a *yaml.Node, b *yaml.Node) *yaml.Node {
+  list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+  list.Content = append(append(list.Content, asList(a)...), asList(b)...)
+
+  return list
+}
+
+// asList is a sequence's items, or a scalar's words like flagList
+func asList(n *yaml.Node) []*yaml.Node {
+  switch n.Kind {
+  case yaml.SequenceNode:
+    return n.Content
+  case yaml.ScalarNode:
+    var words []*yaml.Node
+
+    for _, word := range strings.Fields(n.Value) {
+      words = append(words, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: word})
+    }
+
+    return words
+  }
+
+  return []*yaml.Node{n}
+}
+
+// mergeMapping sets src's keys on dst, merging mappings under the same key
+func mergeMapping(dst *yaml.Node, src *yaml.Node) {
+  for i := 0; i+1 < len(src.Content); i += 2 {
+    key, value := src.Content[i].Value, deref(src.Content[i+1])
+
+    if existing := mappingValue(dst, key); existing != nil && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+      merged := newMapping()
+      mergeMapping(merged, existing)
+      mergeMapping(merged, value)
+      value = merged
+    }
+
+    setKey(dst, key, value)
+  }
+}
+
+func newMapping() *yaml.Node {
+  return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+}
+
+// deref follows an alias to the node it names
+func deref(n *yaml.Node) *yaml.Node {
+  for n.Kind == yaml.AliasNode && n.Alias != nil {
+    n = n.Alias
+  }
+
+  return n
+}
+
+// mappingValue is the value of key in the mapping m, or nil
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+  for i := 0; i+1 < len(m.Content); i += 2 {
+    if m.Content[i].Value == key {
+      return deref(m.Content[i+1])
+    }
+  }
+
+  return nil
+}
+
+// scalarValue is the string under key in the mapping m, or ""
+func scalarValue(m *yaml.Node, key string) string {
+  if v := mappingValue(m, key); v != nil && v.Kind == yaml.ScalarNode {
+    return v.Value
+  }
+
+  return ""
+}
+
+// setKey sets key in the mapping m to value, replacing what it had
+func setKey(m *yaml.Node, key string, value *yaml.Node) {
+  for i := 0; i+1 < len(m.Content); i += 2 {
+    if m.Content[i].Value == key {
+      m.Content[i+1] = value
+      return
+    }
+  }
+
+  m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+func removeKey(m *yaml.Node, key string) {
+  for i := 0; i+1 < len(m.Content); i += 2 {
+    if m.Content[i].Value == key {
+      m.Content = append(m.Content[:i], m.Content[i+2:]...)
+      return
+    }
+  }
+}
@@ -0,0 +1,144 @@
+package watcher
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+
+  "gopkg.in/yaml.v3"
+)
+
+func TestReadConfigIncludes(t *testing.T) {
+  tests := []struct {
+    name  string
+    files map[string]string
+    want  string
+    fails string
+  }{
+    {
+      name: "lists append, settings win",
+      files: map[string]string{
+        "config.yaml": "include: base.yaml\nworkers: 4\nprofiles:\n  - name: local\n",
+        "base.yaml":   "workers: 2\nqueue_dir: /q\nprofiles:\n  - name: shared\n",
+      },
+      want: "workers: 4\nqueue_dir: /q\nprofiles:\n  - name: shared\n  - name: local\n",
+    },
+    {
+      name: "later includes win, globs in order",
+      files: map[string]string{
+        "config.yaml":     "include: [conf.d/*.yaml]\n",
+        "conf.d/10.yaml":  "workers: 1\nresources:\n  gpu: 1\n",
+        "conf.d/20.yaml":  "workers: 3\nresources:\n  cpu: 2\n",
+        "conf.d/note.txt": "workers: 9\n",
+      },
+      want: "workers: 3\nresources:\n  gpu: 1\n  cpu: 2\n",
+    },
+    {
+      name: "a glob matching nothing",
+      files: map[string]string{
+        "config.yaml": "include: conf.d/*.yaml\nworkers: 1\n",
+      },
+      want: "workers: 1\n",
+    },
+    {
+      name: "profiles extend",
+      files: map[string]string{
+        "config.yaml": `profiles:
+  - name: base
+    abstract: true
+    output_flags: [-c:v, libx264]
+    metadata: {a: "1"}
+  - name: web
+    extends: base
+    output_flags+: -crf 23
+    metadata: {b: "2"}
+`,
+      },
+      want: `profiles:
+  - name: web
+    output_flags: [-c:v, libx264, -crf, "23"]
+    metadata: {a: "1", b: "2"}
+`,
+    },
+    {
+      name: "an include cycle",
+      files: map[string]string{
+        "config.yaml": "include: other.yaml\n",
+        "other.yaml":  "include: config.yaml\n",
+      },
+      fails: "included more than once",
+    },
+    {
+      name: "an unknown base",
+      files: map[string]string{
+        "config.yaml": "profiles:\n  - name: web\n    extends: missing\n",
+      },
+      fails: "not defined",
+    },
+    {
+      name: "a profile extending itself",
+      files: map[string]string{
+        "config.yaml": "profiles:\n  - name: a\n    extends: b\n  - name: b\n    extends: a\n",
+      },
+      fails: "extends itself",
+    },
+    {
+      name: "not a mapping",
+      files: map[string]string{
+        "config.yaml": "- workers\n",
+      },
+      fails: "must be a mapping",
+    },
+  }
+
+  for _, test := range tests {
+    dir := t.TempDir()
+
+    for name, content := range test.files {
+      path := filepath.Join(dir, name)
+
+      if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        t.Fatal(err)
+      }
+
+      if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+      }
+    }
+
+    node, err := readConfigNode(filepath.Join(dir, "config.yaml"), make(map[string]bool))
+
+    if err == nil {
+      err = resolveProfiles(node)
+    }
+
+    if test.fails != "" {
+      if err == nil || !strings.Contains(err.Error(), test.fails) {
+        t.Errorf("%s: error %v, want one about %q", test.name, err, test.fails)
+      }
+
+      continue
+    }
+
+    if err != nil {
+      t.Errorf("%s: %s", test.name, err)
+      continue
+    }
+
+    var got, want map[string]interface{}
+
+    if err = node.Decode(&got); err != nil {
+      t.Fatal(err)
+    }
+
+    if err = yaml.Unmarshal([]byte(test.want), &want); err != nil {
+      t.Fatal(err)
+    }
+
+    if !reflect.DeepEqual(got, want) {
+      t.Errorf("%s: %v, want %v", test.name, got, want)
+    }
+  }
+}
@@ -0,0 +1,462 @@
+package watcher
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// SQSIngest takes jobs from S3 object created events on an SQS queue, sent
+// there directly or through SNS, as well as from the queue directory. Each
+// object is downloaded into the working directory, encoded and its outputs
+// uploaded with Config.Upload or Rclone under the object's own folder. The message is
+// deleted once the job is done; a failed job's message comes back after the
+// visibility timeout, so the queue's redrive policy decides how often a file
+// is retried. Outputs uploaded where the notification covers them would be
+// ingested again, give them a prefix or bucket of their own
+type SQSIngest struct {
+  QueueURL string
+
+  // Region defaults to the one in an AWS queue URL, then us-east-1
+  Region string
+
+  // AccessKey and SecretKey sign the SQS and S3 requests, SessionToken is
+  // for temporary credentials
+  AccessKey    string
+  SecretKey    string
+  SessionToken string
+
+  // S3Endpoint downloads from an S3 compatible service instead of AWS, see
+  // S3Upload.Endpoint
+  S3Endpoint string
+
+  // VisibilityTimeout hides a message from other consumers while its job
+  // waits and runs, it is extended for as long as the job lasts. Default 5m
+  VisibilityTimeout time.Duration
+}
+
+const (
+  // sqsWait is how long a receive long polls for
+  sqsWait = 20 * time.Second
+
+  defaultVisibilityTimeout = 5 * time.Minute
+)
+
+// s3Object is an object an event says was created
+type s3Object struct {
+  bucket string
+  key    string
+}
+
+// ingestMessage is a received message and the jobs of its objects,
+// downloadFailed is set when an object could not be fetched. downloading
+// is set until all of them were, the message is kept hidden meanwhile.
+// jobs, downloading and downloadFailed are guarded by the ingester's mu
+type ingestMessage struct {
+  msg            *sqsMessage
+  dir            string
+  jobs           []*Job
+  downloading    bool
+  downloadFailed bool
+  extended       time.Time
+}
+
+// ingester consumes the SQS queue for a Watcher
+type ingester struct {
+  cfg SQSIngest
+  w   *Watcher
+  sqs *sqsClient
+
+  // dir is where objects are downloaded, in the working directory which is
+  // emptied on start
+  dir string
+
+  mu       sync.Mutex
+  buckets  map[string]*s3Client
+  inflight []*ingestMessage
+
+  // started is set by start, done waits for its loops
+  started bool
+  done    sync.WaitGroup
+}
+
+func newIngester(cfg SQSIngest, w *Watcher, workingDir string) (*ingester, error) {
+  if cfg.QueueURL == "" {
+    return nil, fmt.Errorf("no queue URL")
+  }
+
+  if cfg.Region == "" {
+    cfg.Region = sqsRegion(cfg.QueueURL)
+  }
+
+  if cfg.Region == "" {
+    cfg.Region = "us-east-1"
+  }
+
+  if cfg.VisibilityTimeout <= 0 {
+    cfg.VisibilityTimeout = defaultVisibilityTimeout
+  }
+
+  return &ingester{
+    cfg: cfg,
+    w:   w,
+    sqs: &sqsClient{
+      queueURL: cfg.QueueURL,
+      http:     &http.Client{Timeout: sqsWait + 30*time.Second},
+      signer:   awsSigner{service: "sqs", region: cfg.Region, accessKey: cfg.AccessKey, secretKey: cfg.SecretKey, sessionToken: cfg.SessionToken},
+    },
+    dir:     filepath.Join(workingDir, "ingest"),
+    buckets: make(map[string]*s3Client),
+  }, nil
+}
+
+// start receives messages and keeps the received ones hidden until stop is
+// closed
+func (in *ingester) start(stop <-chan struct{}) {
+  ctx, cancel := context.WithCancel(context.Background())
+
+  go func() {
+    <-stop
+    cancel()
+  }()
+
+  in.started = true
+  in.done.Add(2)
+
+  go func() {
+    defer in.done.Done()
+    in.receive(ctx)
+  }()
+
+  go func() {
+    defer in.done.Done()
+
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        in.settle(false)
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+
+  slog.Info("Taking jobs from SQS", "queue", in.cfg.QueueURL)
+}
+
+// stop waits for the loops to end, then deletes the messages of jobs that
+// finished and hands the others back to the queue
+func (in *ingester) stop() {
+  if !in.started {
+    return
+  }
+
+  in.done.Wait()
+  in.settle(true)
+}
+
+func (in *ingester) receive(ctx context.Context) {
+  for ctx.Err() == nil {
+    // leave messages to other consumers while jobs are waiting here
+    if in.w.queue.len() > 0 || in.w.queue.isPaused() || in.w.queue.isHeld() {
+      sleepCtx(ctx, 2*time.Second)
+      continue
+    }
+
+    m, err := in.sqs.receive(ctx, sqsWait, in.cfg.VisibilityTimeout)
+
+    if err != nil {
+      if ctx.Err() == nil {
+        slog.Error("SQS receive failed", "queue", in.cfg.QueueURL, "error", err)
+        sleepCtx(ctx, 10*time.Second)
+      }
+
+      continue
+    }
+
+    if m != nil {
+      in.handle(ctx, m)
+    }
+  }
+}
+
+// handle downloads a message's objects and queues a job for each
+func (in *ingester) handle(ctx context.Context, m *sqsMessage) {
+  objects, err := parseS3Event(m.Body)
+
+  if err != nil || len(objects) == 0 {
+    // test events and anything else that will never be a job
+    if err != nil {
+      slog.Warn("Dropping SQS message that is not an S3 event", "message", m.ID, "error", err)
+    }
+
+    if err = in.sqs.remove(ctx, m); err != nil {
+      slog.Error("Could not delete SQS message", "message", m.ID, "error", err)
+    }
+
+    return
+  }
+
+  im := &ingestMessage{msg: m, dir: filepath.Join(in.dir, m.ID), downloading: true, extended: time.Now()}
+
+  if err = os.MkdirAll(im.dir, 0755); err != nil {
+    slog.Error("Could not create ingest directory", "dir", im.dir, "error", err)
+    return
+  }
+
+  // settle keeps the message hidden while large objects download
+  in.mu.Lock()
+  in.inflight = append(in.inflight, im)
+  in.mu.Unlock()
+
+  seen := make(map[s3Object]bool)
+
+  for i, obj := range objects {
+    name := path.Base(obj.key)
+
+    if seen[obj] {
+      continue
+    }
+
+    seen[obj] = true
+
+    if !in.w.filter.Load().allowed(name) {
+      slog.Info("Ignoring object", "bucket", obj.bucket, "key", obj.key)
+      continue
+    }
+
+    client, err := in.bucket(obj.bucket)
+
+    if err == nil {
+      startedAt := time.Now()
+
+      // a folder of its own, as keys under different prefixes can have
+      // the same name
+      file := filepath.Join(im.dir, strconv.Itoa(i), name)
+
+      if err = os.MkdirAll(filepath.Dir(file), 0755); err == nil {
+        err = client.download(ctx, obj.key, file)
+      }
+
+      if err == nil {
+        slog.Info("Downloaded", "from", client.location(obj.key), "to", file, "took", time.Since(startedAt).Round(time.Second).String())
+
+        // outputs go back next to the object, under the upload's prefix
+        dir := path.Dir(obj.key)
+
+        if dir == "." {
+          dir = ""
+        }
+
+        if j := in.w.enqueue(file, dir, nil); j != nil {
+          in.mu.Lock()
+          im.jobs = append(im.jobs, j)
+          in.mu.Unlock()
+        }
+
+        continue
+      }
+    }
+
+    if ctx.Err() != nil {
+      break
+    }
+
+    // the message comes back after the visibility timeout
+    slog.Error("Could not download object", "bucket", obj.bucket, "key", obj.key, "error", err)
+    in.mu.Lock()
+    im.downloadFailed = true
+    in.mu.Unlock()
+  }
+
+  // interrupted by shutdown, let another consumer have it
+  if ctx.Err() != nil {
+    release, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    if err = in.sqs.setVisibility(release, m, 0); err != nil {
+      slog.Error("SQS message update failed", "message", m.ID, "error", err)
+    }
+
+    in.forget(im)
+
+    return
+  }
+
+  in.mu.Lock()
+  im.downloading = false
+  in.mu.Unlock()
+}
+
+// forget drops a message settled one way or another and its downloads
+func (in *ingester) forget(im *ingestMessage) {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+
+  os.RemoveAll(im.dir)
+
+  for i, other := range in.inflight {
+    if other == im {
+      in.inflight = append(in.inflight[:i], in.inflight[i+1:]...)
+      break
+    }
+  }
+}
+
+// bucket returns a client for downloading from a bucket
+func (in *ingester) bucket(name string) (*s3Client, error) {
+  in.mu.Lock()
+  defer in.mu.Unlock()
+
+  if c, ok := in.buckets[name]; ok {
+    return c, nil
+  }
+
+  c, err := newS3Client(S3Upload{
+    Bucket:       name,
+    Endpoint:     in.cfg.S3Endpoint,
+    Region:       in.cfg.Region,
+    AccessKey:    in.cfg.AccessKey,
+    SecretKey:    in.cfg.SecretKey,
+    SessionToken: in.cfg.SessionToken,
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  in.buckets[name] = c
+
+  return c, nil
+}
+
+// settle deletes the messages whose jobs are over, leaves failed ones to
+// come back and keeps the rest hidden. stopping hands the unfinished back
+func (in *ingester) settle(stopping bool) {
+  ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+  defer cancel()
+
+  in.mu.Lock()
+  messages := append([]*ingestMessage(nil), in.inflight...)
+  in.mu.Unlock()
+
+  var resolved []*ingestMessage
+
+  for _, im := range messages {
+    in.mu.Lock()
+    jobs, finished, failed, interrupted := im.jobs, !im.downloading, im.downloadFailed, false
+    in.mu.Unlock()
+
+    for _, j := range jobs {
+      v := j.View()
+
+      switch {
+      case !v.State.Finished():
+        finished = false
+      case v.State == JobFailed:
+        failed = true
+      case v.State == JobCancelled && v.Error == errShutdown.Error():
+        interrupted = true
+      }
+    }
+
+    var err error
+
+    switch {
+    case !finished && !stopping:
+      if time.Since(im.extended) > in.cfg.VisibilityTimeout/2 {
+        if err = in.sqs.setVisibility(ctx, im.msg, in.cfg.VisibilityTimeout); err == nil {
+          im.extended = time.Now()
+        }
+      }
+    case !finished || interrupted:
+      err = in.sqs.setVisibility(ctx, im.msg, 0)
+      resolved = append(resolved, im)
+    case failed:
+      slog.Warn("Job failed, its SQS message will be delivered again", "message", im.msg.ID)
+      resolved = append(resolved, im)
+    default:
+      err = in.sqs.remove(ctx, im.msg)
+      resolved = append(resolved, im)
+    }
+
+    if err != nil {
+      slog.Error("SQS message update failed", "message", im.msg.ID, "error", err)
+    }
+  }
+
+  for _, im := range resolved {
+    in.forget(im)
+  }
+}
+
+// s3Notification is an S3 event notification, or an SNS notification
+// wrapping one
+type s3Notification struct {
+  Records []struct {
+    EventName string `json:"eventName"`
+    S3        struct {
+      Bucket struct {
+        Name string `json:"name"`
+      } `json:"bucket"`
+      Object struct {
+        Key string `json:"key"`
+      } `json:"object"`
+    } `json:"s3"`
+  } `json:"Records"`
+
+  Type    string `json:"Type"`
+  Message string `json:"Message"`
+}
+
+// parseS3Event returns the objects a message says were created
+func parseS3Event(body string) ([]s3Object, error) {
+  var n s3Notification
+
+  if err := json.Unmarshal([]byte(body), &n); err != nil {
+    return nil, err
+  }
+
+  if n.Type == "Notification" && n.Message != "" {
+    return parseS3Event(n.Message)
+  }
+
+  var objects []s3Object
+
+  for _, r := range n.Records {
+    if !strings.HasPrefix(r.EventName, "ObjectCreated:") {
+      continue
+    }
+
+    // keys are URL encoded, spaces as +
+    key, err := url.QueryUnescape(r.S3.Object.Key)
+
+    if err != nil {
+      return nil, fmt.Errorf("key %q: %s", r.S3.Object.Key, err)
+    }
+
+    objects = append(objects, s3Object{bucket: r.S3.Bucket.Name, key: key})
+  }
+
+  return objects, nil
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+  select {
+  case <-time.After(d):
+  case <-ctx.Done():
+  }
+}
@@ -0,0 +1,143 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "sync"
+  "time"
+)
+
+// intakeUsageCheck is how long the size of the working and finished
+// directories is taken as it was last added up
+const intakeUsageCheck = 10 * time.Second
+
+// Intake limits how fast files found in the queue directories are queued,
+// so a dump of thousands of files does not swamp the steps and storage
+// after the encode. Files held back stay in their queue directory and are
+// queued once the limits allow, as with MaxQueued, see OverflowPolicy. Files
+// queued through the API, uploads and remote sources count towards
+// PerMinute but are not held
+type Intake struct {
+  // PerMinute is how many files are queued in any minute at most, zero has
+  // no limit
+  PerMinute int
+
+  // MaxUsage pauses intake while the working and finished directories hold
+  // more than this many bytes together, until outputs are moved away or
+  // pruned. Zero does not check
+  MaxUsage int64
+}
+
+// intakeLimiter is the state of the Intake limits
+type intakeLimiter struct {
+  cfg Intake
+
+  mu sync.Mutex
+
+  // queued are when files were queued in the last minute, oldest first
+  queued []time.Time
+
+  usage   int64
+  usageAt time.Time
+}
+
+func newIntakeLimiter(cfg Intake) *intakeLimiter {
+  return &intakeLimiter{cfg: cfg}
+}
+
+// add counts a file queued now
+func (l *intakeLimiter) add() {
+  if l == nil || l.cfg.PerMinute <= 0 {
+    return
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  l.queued = append(l.expire(time.Now()), time.Now())
+}
+
+// expire drops the files queued more than a minute before now
+func (l *intakeLimiter) expire(now time.Time) []time.Time {
+  i := 0
+
+  for i < len(l.queued) && now.Sub(l.queued[i]) >= time.Minute {
+    i++
+  }
+
+  return l.queued[i:]
+}
+
+// held is why files found are not queued for now, "" when they can be.
+// usage and over are the working and finished directories' size and
+// whether it is over MaxUsage
+func (l *intakeLimiter) held(dirs []string) (reason string, usage int64, over bool) {
+  if l == nil {
+    return "", 0, false
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  now := time.Now()
+
+  if l.cfg.MaxUsage > 0 {
+    if now.Sub(l.usageAt) >= intakeUsageCheck {
+      l.usage, l.usageAt = totalSize(dirs), now
+    }
+
+    if l.usage > l.cfg.MaxUsage {
+      return fmt.Sprintf("the working and finished directories hold %s, more than %s", FormatSize(l.usage), FormatSize(l.cfg.MaxUsage)), l.usage, true
+    }
+  }
+
+  if l.cfg.PerMinute > 0 {
+    if l.queued = l.expire(now); len(l.queued) >= l.cfg.PerMinute {
+      return fmt.Sprintf("%d files were queued in the last minute", len(l.queued)), 0, false
+    }
+  }
+
+  return "", 0, false
+}
+
+// intakeHeld reports whether files found in the queue directories are
+// left there for now: MaxQueued jobs are waiting, or an Intake limit is
+// reached
+func (w *Watcher) intakeHeld() bool {
+  if w.queueFull() {
+    return true
+  }
+
+  reason, _, _ := w.intake.held([]string{w.enc.workingDir, w.enc.finishedDir})
+
+  return reason != ""
+}
+
+// intakeOverflow tells about the first file an Intake limit leaves in the
+// queue directory. Being over MaxUsage is a warning and with OverflowAlert
+// an "intake_paused" event, the rate only slowing intake down is not
+func (w *Watcher) intakeOverflow(path string, queued int) {
+  reason, usage, over := w.intake.held([]string{w.enc.workingDir, w.enc.finishedDir})
+
+  if !over {
+    slog.Info("Intake rate reached, leaving files in the queue directory for later", "reason", reason, "per_minute", w.intake.cfg.PerMinute)
+    return
+  }
+
+  slog.Warn("Intake paused, leaving files in the queue directory until there is room", "usage", usage, "max", w.intake.cfg.MaxUsage)
+
+  if w.cfg.Overflow != OverflowAlert {
+    return
+  }
+
+  ev := JobEvent{
+    Event:  "intake_paused",
+    Input:  path,
+    Queued: queued,
+    Error:  reason + ", new files stay in the queue directory",
+  }
+
+  for _, h := range w.enc.handlers {
+    h.HandleEvent(ev)
+  }
+}
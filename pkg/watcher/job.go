@@ -0,0 +1,552 @@
+package watcher
+
+import (
+  "log/slog"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// JobState is where a job is in the pipeline
+type JobState string
+
+const (
+  JobQueued    JobState = "queued"
+  JobRunning   JobState = "running"
+  JobDone      JobState = "done"
+  JobFailed    JobState = "failed"
+  JobCancelled JobState = "cancelled"
+)
+
+// Finished reports whether a job in this state is over, it may still be
+// requeued
+func (s JobState) Finished() bool {
+  return s == JobDone || s == JobFailed || s == JobCancelled
+}
+
+// job priorities, higher priority jobs are handed to workers first
+const (
+  PriorityNormal = 0
+  PriorityHigh   = 1
+)
+
+// Job is a single input file making its way through the pipeline
+type Job struct {
+  mu sync.Mutex
+
+  // id numbers the job since startup, uid is a ULID that names it in the
+  // logs, events and records for good
+  id         int64
+  uid        string
+  input      string
+  priority   int
+  profile    *Profile
+  software   bool
+  outputs    []string
+  uploads    []string
+  state      JobState
+  err        string
+  queuedAt   time.Time
+  startedAt  time.Time
+  finishedAt time.Time
+
+  // arrivedAt is when the job was first queued, its deadline counts from
+  // then. atRisk and missedDeadline are set once it was reported, see
+  // watchDeadlines
+  arrivedAt      time.Time
+  atRisk         bool
+  missedDeadline bool
+
+  // degraded is how an encode that failed on a corrupt input was
+  // salvaged, see Salvage
+  degraded string
+
+  // failure is the class of the last failure, retries how often the job
+  // was retried by its policy and retryAt when it is next, see
+  // FailurePolicy
+  failure FailureClass
+  retries int
+  retryAt time.Time
+
+  // preflight is the last report on the input and probed the ffprobe
+  // report it came from, with idet's counts, see Preflight
+  preflight *PreflightReport
+  probed    *probeResult
+
+  // name is the input's file name outputs are named after, without any
+  // priority prefix
+  name string
+
+  // target is the file a symlinked input ends at while the job runs under
+  // SymlinksResolve, empty for any other input
+  target string
+
+  // growing is set while the job follows an input that is still being
+  // written
+  growing bool
+
+  // requested is the profile the job was queued with, each time the job
+  // starts its sidecar and the pre hook derive profile from it again.
+  // specPath is the sidecar's path when there is one, checksumPath the
+  // checksum sidecar's, companions those found with Companions
+  requested    *Profile
+  spec         *jobSpec
+  specPath     string
+  checksumPath string
+  companions   []string
+
+  // forced jobs are encoded even when the ledger has seen their input,
+  // ledgerKey is the input's key recorded once the encode succeeds
+  forced    bool
+  ledgerKey string
+
+  // sequence is the frames of an input that is a directory of them, see
+  // imageSequence
+  sequence *imageSequence
+
+  // inputDigest is the input's SHA-256 the audit log took when the encode
+  // started, recorded again with where the input goes
+  inputDigest string
+
+  // arrivedAs is the name the input arrived with when Filenames renamed
+  // it
+  arrivedAs string
+
+  // uploadDir is the folder of the S3 object the input was ingested from,
+  // its outputs are uploaded under it
+  uploadDir string
+
+  // claimedBy is the node last seen holding the input's claim while the job
+  // waits for it
+  claimedBy string
+
+  // inputBytes and outputBytes are the sizes of the input when the encode
+  // started and of its outputs once in the finished directory
+  inputBytes  int64
+  outputBytes int64
+
+  // frames counts the frames ffmpeg encoded for the job, encoded is what
+  // the encode took once it is over and stats the job's JobStats once it
+  // ended, nil when it never got to ffmpeg
+  frames  int64
+  encoded encodeTotals
+  stats   *JobStats
+
+  // thumbnails are the posters, sprites and previews made from the outputs
+  thumbnails []string
+
+  // artifacts are the states of the outputs encoded on their own in the
+  // last encode
+  artifacts []ArtifactView
+
+  // estimate is how long the input plays for by the queue's reckoning, set
+  // when it is first queued with shortest first scheduling
+  estimate time.Duration
+
+  // slots are the resource classes the job counts against while a worker
+  // has it, taken when it is popped off the queue
+  slots []resourceSlot
+
+  // events is where the job's changes go, its store's
+  events *jobEvents
+
+  // trace is the job's trace until it is sent, nil without telemetry
+  trace *jobTrace
+
+  progress *progress
+  log      *tailBuffer
+  logPath  string
+
+  // cancel aborts the running ffmpeg with a cause, it is nil unless the
+  // job is running. cancelThen is what the control API asked to become of
+  // it once it has stopped
+  cancel     func(cause error)
+  cancelThen CancelAction
+}
+
+// JobView is the JSON representation of a job returned by the API
+type JobView struct {
+  ID         int64      `json:"id"`
+  UID        string     `json:"uid"`
+  Input      string     `json:"input"`
+  Target     string     `json:"target,omitempty"`
+  Growing    bool       `json:"growing,omitempty"`
+  Profile    string     `json:"profile"`
+  Priority   int        `json:"priority,omitempty"`
+  Outputs    []string   `json:"outputs,omitempty"`
+  Uploads    []string   `json:"uploads,omitempty"`
+  Thumbnails []string   `json:"thumbnails,omitempty"`
+  State      JobState   `json:"state"`
+  Error      string     `json:"error,omitempty"`
+  QueuedAt   time.Time  `json:"queued_at"`
+  StartedAt  *time.Time `json:"started_at,omitempty"`
+  FinishedAt *time.Time `json:"finished_at,omitempty"`
+  Percent    *float64   `json:"percent,omitempty"`
+  ETASeconds *float64   `json:"eta_seconds,omitempty"`
+  Progress   string     `json:"progress,omitempty"`
+  Resources  []string   `json:"resources,omitempty"`
+  Stats      *JobStats  `json:"stats,omitempty"`
+
+  // Artifacts are the outputs encoded on their own, see ArtifactView
+  Artifacts []ArtifactView `json:"artifacts,omitempty"`
+
+  // Deadline is when its profile's Deadline wants it done, AtRisk is set
+  // once it was found at risk of missing it, see watchDeadlines
+  Deadline *time.Time `json:"deadline,omitempty"`
+  AtRisk   bool       `json:"at_risk,omitempty"`
+
+  // Degraded is how an encode that failed on a corrupt input was
+  // salvaged, tolerant or copy, see Salvage
+  Degraded string `json:"degraded,omitempty"`
+
+  // Failure is the class of the job's last failure, Retries how often its
+  // FailurePolicy retried it and RetryAt when it is retried next
+  Failure FailureClass `json:"failure,omitempty"`
+  Retries int          `json:"retries,omitempty"`
+  RetryAt *time.Time   `json:"retry_at,omitempty"`
+}
+
+// View returns a snapshot of the job
+func (j *Job) View() JobView {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  v := JobView{
+    ID:         j.id,
+    UID:        j.uid,
+    Input:      j.input,
+    Target:     j.target,
+    Growing:    j.growing,
+    Profile:    j.profile.Name,
+    Priority:   j.priority,
+    Outputs:    j.outputs,
+    Uploads:    j.uploads,
+    Thumbnails: j.thumbnails,
+    State:      j.state,
+    Error:      j.err,
+    QueuedAt:   j.queuedAt,
+  }
+
+  if !j.startedAt.IsZero() {
+    startedAt := j.startedAt
+    v.StartedAt = &startedAt
+  }
+
+  if !j.finishedAt.IsZero() {
+    finishedAt := j.finishedAt
+    v.FinishedAt = &finishedAt
+  }
+
+  if j.profile.Deadline > 0 {
+    deadline := j.arrivedAt.Add(j.profile.Deadline)
+    v.Deadline, v.AtRisk = &deadline, j.atRisk
+  }
+
+  v.Degraded = j.degraded
+  v.Failure, v.Retries = j.failure, j.retries
+
+  if !j.retryAt.IsZero() {
+    retryAt := j.retryAt
+    v.RetryAt = &retryAt
+  }
+
+  if len(j.slots) > 0 {
+    v.Resources = classes(j.slots)
+  }
+
+  v.Stats = j.stats
+  v.Artifacts = append([]ArtifactView(nil), j.artifacts...)
+
+  if j.state == JobRunning && j.progress != nil {
+    v.Progress = j.progress.String()
+
+    if pct := j.progress.percent(); pct >= 0 {
+      v.Percent = &pct
+    }
+
+    if eta := j.progress.eta(); eta >= 0 {
+      seconds := eta.Seconds()
+      v.ETASeconds = &seconds
+    }
+  }
+
+  return v
+}
+
+// logger returns a logger that tags every line with the job's fields
+func (j *Job) logger() *slog.Logger {
+  return slog.With("job", j.id, "uid", j.uid, "input", j.input, "profile", j.profile.Name)
+}
+
+// ID is the job's id, unique since startup
+func (j *Job) ID() int64 {
+  return j.id
+}
+
+// UID is the job's ULID, unique for good
+func (j *Job) UID() string {
+  return j.uid
+}
+
+// Input is the path of the file being encoded
+func (j *Job) Input() string {
+  return j.input
+}
+
+// source is the file the job reads, the target of a resolved symlink or
+// the pattern of an image sequence's frames
+func (j *Job) source() string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.sequence != nil {
+    return j.sequence.pattern
+  }
+
+  if j.target != "" {
+    return j.target
+  }
+
+  return j.input
+}
+
+// slot is the index of the job's slot in the resource class it encodes
+// with, empty without one
+func (j *Job) slot() string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if len(j.slots) == 0 || strings.HasPrefix(j.slots[0].class, "profile:") {
+    return ""
+  }
+
+  return strconv.Itoa(j.slots[0].index)
+}
+
+// device is the ID of the device the job's slots gave it, or ""
+func (j *Job) device() string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  for _, s := range j.slots {
+    if s.device != "" {
+      return s.device
+    }
+  }
+
+  return ""
+}
+
+// isDevicePath reports whether the device ID is a device node like
+// /dev/dri/renderD128 rather than a GPU index or UUID
+func isDevicePath(id string) bool {
+  return strings.HasPrefix(id, "/")
+}
+
+// env is the profile's Env for the job as KEY=value, sorted by key, with
+// CUDA_VISIBLE_DEVICES set to the job's GPU, see ResourceDevice, and last
+// GOWATCHER_COMPANIONS with the job's companions, one per line
+func (j *Job) env() []string {
+  j.mu.Lock()
+  env, companions := j.profile.Env, j.companions
+  j.mu.Unlock()
+
+  device := j.device()
+
+  if len(env) == 0 && device == "" && len(companions) == 0 {
+    return nil
+  }
+
+  vars := flagVars(j, nil)
+  values := make(map[string]string, len(env)+1)
+
+  if device != "" && !isDevicePath(device) {
+    values["CUDA_VISIBLE_DEVICES"] = device
+  }
+
+  for key, value := range env {
+    values[key] = expandFlags(j, []string{value}, vars)[0]
+  }
+
+  keys := make([]string, 0, len(values))
+
+  for key := range values {
+    keys = append(keys, key)
+  }
+
+  sort.Strings(keys)
+
+  list := make([]string, 0, len(keys))
+
+  for _, key := range keys {
+    list = append(list, key+"="+values[key])
+  }
+
+  if len(companions) > 0 {
+    list = append(list, "GOWATCHER_COMPANIONS="+strings.Join(companions, "\n"))
+  }
+
+  return list
+}
+
+func (j *Job) State() JobState {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  return j.state
+}
+
+// finish moves the job into a terminal state
+func (j *Job) finish(state JobState, err error) {
+  j.mu.Lock()
+  j.state = state
+  j.finishedAt = time.Now()
+  j.cancel = nil
+
+  if err != nil {
+    j.err = err.Error()
+  }
+  j.mu.Unlock()
+
+  j.publish(endEvent(state))
+}
+
+// jobStore keeps every job seen since startup so they can be listed by the API
+type jobStore struct {
+  mu     sync.Mutex
+  nextID int64
+  jobs   map[int64]*Job
+
+  // byInput is the latest job for each input path
+  byInput map[string]*Job
+
+  // keepDone counts finished jobs as tracked, their inputs stay in the
+  // queue directory when originals are kept
+  keepDone bool
+
+  events *jobEvents
+}
+
+func newJobStore() *jobStore {
+  return &jobStore{jobs: make(map[int64]*Job), byInput: make(map[string]*Job), events: newJobEvents()}
+}
+
+// add creates a new queued job for the input file, name is what its outputs
+// are named after
+func (s *jobStore) add(input string, name string, priority int, p *Profile) *Job {
+  s.mu.Lock()
+  s.nextID++
+  now := time.Now()
+
+  j := &Job{
+    id:        s.nextID,
+    uid:       newULID(),
+    input:     input,
+    name:      name,
+    priority:  priority,
+    profile:   p,
+    requested: p,
+    state:     JobQueued,
+    queuedAt:  now,
+    arrivedAt: now,
+    events:    s.events,
+  }
+
+  s.jobs[j.id] = j
+  s.byInput[input] = j
+  s.mu.Unlock()
+
+  j.publish("queued")
+
+  return j
+}
+
+// tracked reports whether the input already has a job that has not
+// completed, a file at the same path after a completed job is new work
+// unless finished inputs are being kept
+func (s *jobStore) tracked(input string) bool {
+  s.mu.Lock()
+  j := s.byInput[input]
+  s.mu.Unlock()
+
+  return j != nil && (s.keepDone || j.State() != JobDone)
+}
+
+// byPath is the last job queued for input, or nil
+func (s *jobStore) byPath(input string) *Job {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return s.byInput[input]
+}
+
+func (s *jobStore) get(id int64) *Job {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  return s.jobs[id]
+}
+
+func (s *jobStore) byUID(uid string) *Job {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for _, j := range s.jobs {
+    if j.uid == uid {
+      return j
+    }
+  }
+
+  return nil
+}
+
+// list returns the jobs ordered by id, optionally filtered to one state
+func (s *jobStore) list(state JobState) []*Job {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  jobs := make([]*Job, 0, len(s.jobs))
+
+  for _, j := range s.jobs {
+    if state == "" || j.State() == state {
+      jobs = append(jobs, j)
+    }
+  }
+
+  sort.Slice(jobs, func(a, b int) bool { return jobs[a].id < jobs[b].id })
+
+  return jobs
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes written to it
+type tailBuffer struct {
+  mu   sync.Mutex
+  max  int
+  data []byte
+}
+
+func newTailBuffer(max int) *tailBuffer {
+  return &tailBuffer{max: max}
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  t.data = append(t.data, p...)
+
+  if len(t.data) > t.max {
+    t.data = append([]byte(nil), t.data[len(t.data)-t.max:]...)
+  }
+
+  return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+
+  return append([]byte(nil), t.data...)
+}
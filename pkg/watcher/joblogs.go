@@ -0,0 +1,202 @@
+package watcher
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// jobLogs manages the per-job ffmpeg log files in BASE_DIR/logs, and their
+// pre-flight reports. Files older than maxAge, or beyond the newest maxFiles
+// of their kind, are removed by prune, then the oldest of them until they
+// come to maxBytes. A run writes at most maxSize to a log, and with
+// compress each log is gzipped once its run is done. A zero value disables
+// that limit
+type jobLogs struct {
+  dir      string
+  maxAge   time.Duration
+  maxFiles int
+  maxBytes int64
+  maxSize  int64
+  compress bool
+}
+
+// jobLogFile is a job's log file open for a run. Past the jobLogs' maxSize
+// the run's output is left out of it, and closing it writes the end of
+// what was left out from the job's in-memory tail, the end of ffmpeg's
+// output being what says why it failed
+type jobLogFile struct {
+  *os.File
+  logs    *jobLogs
+  tail    *tailBuffer
+  written int64
+  dropped int64
+}
+
+// create opens the log file for a job, named <ulid>-<basename>.log. A
+// requeued job's runs go on in the same file, or the same .log.gz once
+// compressed. tail is the run's in-memory log
+func (l *jobLogs) create(j *Job, tail *tailBuffer) (*jobLogFile, error) {
+  name := fmt.Sprintf("%s-%s.log", j.uid, filepath.Base(j.input))
+  f, err := os.OpenFile(filepath.Join(l.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err != nil {
+    return nil, err
+  }
+
+  return &jobLogFile{File: f, logs: l, tail: tail}, nil
+}
+
+func (f *jobLogFile) Write(p []byte) (int, error) {
+  if f.logs.maxSize > 0 && f.written >= f.logs.maxSize {
+    f.dropped += int64(len(p))
+    return len(p), nil
+  }
+
+  n, err := f.File.Write(p)
+  f.written += int64(n)
+
+  return n, err
+}
+
+// Close closes the log, then gzips it when the logs are compressed
+func (f *jobLogFile) Close() error {
+  if f.dropped > 0 {
+    end := f.tail.Bytes()
+
+    if int64(len(end)) > f.dropped {
+      end = end[int64(len(end))-f.dropped:]
+    }
+
+    fmt.Fprintf(f.File, "\n[%s of output left out of the log at %s, the last %s of it follows]\n", FormatSize(f.dropped), FormatSize(f.logs.maxSize), FormatSize(int64(len(end))))
+    f.File.Write(end)
+  }
+
+  if err := f.File.Close(); err != nil || !f.logs.compress {
+    return err
+  }
+
+  if err := gzipFile(f.Name()); err != nil {
+    slog.Warn("Could not compress job log", "path", f.Name(), "error", err)
+  }
+
+  return nil
+}
+
+// copyJobLog writes the job log at path to w, its compressed runs first
+// and then the plain one, and reports whether there was any
+func copyJobLog(w io.Writer, path string) bool {
+  found := false
+
+  if file, err := os.Open(path + ".gz"); err == nil {
+    defer file.Close()
+
+    if gz, err := gzip.NewReader(file); err == nil {
+      io.Copy(w, gz)
+      found = true
+    }
+  }
+
+  if file, err := os.Open(path); err == nil {
+    defer file.Close()
+    io.Copy(w, file)
+    found = true
+  }
+
+  return found
+}
+
+// prune removes log files that fall outside the retention settings
+func (l *jobLogs) prune() {
+  entries, err := os.ReadDir(l.dir)
+
+  if err != nil {
+    slog.Warn("Could not read job logs", "dir", l.dir, "error", err)
+    return
+  }
+
+  type logFile struct {
+    path    string
+    size    int64
+    modTime time.Time
+  }
+
+  var kept []logFile
+
+  // the logs, compressed or not, and the pre-flight reports are kept
+  // maxFiles of each
+  for _, suffixes := range [][]string{{".log", ".log.gz"}, {preflightSuffix}} {
+    files := make([]logFile, 0, len(entries))
+
+    for _, entry := range entries {
+      if entry.IsDir() || !hasAnySuffix(entry.Name(), suffixes) {
+        continue
+      }
+
+      info, err := entry.Info()
+
+      if err != nil {
+        continue
+      }
+
+      files = append(files, logFile{filepath.Join(l.dir, entry.Name()), info.Size(), info.ModTime()})
+    }
+
+    // newest first so everything past maxFiles is the oldest
+    sort.Slice(files, func(a, b int) bool { return files[a].modTime.After(files[b].modTime) })
+
+    for i, file := range files {
+      expired := l.maxAge > 0 && time.Since(file.modTime) > l.maxAge
+      overflow := l.maxFiles > 0 && i >= l.maxFiles
+
+      if !expired && !overflow {
+        kept = append(kept, file)
+      } else if err := os.Remove(file.path); err != nil {
+        slog.Warn("Could not remove job log", "path", file.path, "error", err)
+      }
+    }
+  }
+
+  if l.maxBytes <= 0 {
+    return
+  }
+
+  sort.Slice(kept, func(a, b int) bool { return kept[a].modTime.After(kept[b].modTime) })
+
+  var total int64
+
+  for _, file := range kept {
+    if total += file.size; total <= l.maxBytes {
+      continue
+    }
+
+    if err := os.Remove(file.path); err != nil {
+      slog.Warn("Could not remove job log", "path", file.path, "error", err)
+    }
+  }
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+  for _, suffix := range suffixes {
+    if strings.HasSuffix(name, suffix) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// lastLine returns the last non-empty line of ffmpeg output, which is
+// usually the reason it failed
+func lastLine(output []byte) string {
+  lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+  _, line := lineLevel(lines[len(lines)-1])
+
+  return strings.TrimSpace(line)
+}
@@ -0,0 +1,294 @@
+package watcher
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// LedgerMode is how the ledger recognises a file it has already encoded
+type LedgerMode string
+
+const (
+  // LedgerPath matches the file's path, size and modification time, which
+  // costs nothing but misses a copy of the same content under another name
+  LedgerPath LedgerMode = "path"
+
+  // LedgerHash matches an XXH64 of the file's content wherever it is, so
+  // the same master delivered twice under different names is encoded once.
+  // The whole file is read before each encode
+  LedgerHash LedgerMode = "hash"
+)
+
+// ledgerEntry is one line of the ledger file
+type ledgerEntry struct {
+  Key       string    `json:"key"`
+  Input     string    `json:"input"`
+  Outputs   []string  `json:"outputs,omitempty"`
+  EncodedAt time.Time `json:"encoded_at"`
+}
+
+// Ledger is an append-only file of the inputs encoded successfully, one JSON
+// object per line, so that a restart, rescan or re-dropped file does not
+// encode the same thing twice
+type Ledger struct {
+  mu      sync.Mutex
+  path    string
+  mode    LedgerMode
+  entries map[string]ledgerEntry
+}
+
+// OpenLedger reads the ledger at path, a missing file is an empty ledger
+func OpenLedger(path string, mode LedgerMode) (*Ledger, error) {
+  if mode != LedgerPath && mode != LedgerHash {
+    return nil, fmt.Errorf("ledger mode must be path or hash, not %q", mode)
+  }
+
+  l := &Ledger{path: path, mode: mode, entries: make(map[string]ledgerEntry)}
+
+  f, err := os.Open(path)
+
+  if os.IsNotExist(err) {
+    return l, nil
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+  for line := 1; scanner.Scan(); line++ {
+    var entry ledgerEntry
+
+    // a line cut short by a crash loses one entry, not the ledger
+    if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+      slog.Warn("Skipping bad ledger line", "ledger", path, "line", line)
+      continue
+    }
+
+    l.entries[entry.Key] = entry
+  }
+
+  return l, scanner.Err()
+}
+
+// key identifies the file's content for the ledger's mode
+func (l *Ledger) key(file string) (string, error) {
+  info, err := os.Stat(file)
+
+  if err != nil {
+    return "", err
+  }
+
+  if l.mode == LedgerPath {
+    abs, err := filepath.Abs(file)
+
+    if err != nil {
+      return "", err
+    }
+
+    return abs + "|" + strconv.FormatInt(info.Size(), 10) + "|" + strconv.FormatInt(info.ModTime().UnixNano(), 10), nil
+  }
+
+  f, err := os.Open(file)
+
+  if err != nil {
+    return "", err
+  }
+
+  defer f.Close()
+
+  hash := newXXH64()
+
+  if _, err = io.Copy(hash, f); err != nil {
+    return "", err
+  }
+
+  return "xxh64:" + strconv.FormatUint(hash.Sum64(), 16) + "|" + strconv.FormatInt(info.Size(), 10), nil
+}
+
+// lookup returns the file's key and whether it has been encoded before
+func (l *Ledger) lookup(file string) (string, *ledgerEntry, error) {
+  key, err := l.key(file)
+
+  if err != nil {
+    return "", nil, err
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  if entry, ok := l.entries[key]; ok {
+    return key, &entry, nil
+  }
+
+  return key, nil, nil
+}
+
+// made reports whether the entry for key lists every one of outputs
+func (l *Ledger) made(key string, outputs []string) bool {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  entry, ok := l.entries[key]
+
+  return ok && containsAll(entry.Outputs, outputs)
+}
+
+// record appends an encoded input to the ledger
+func (l *Ledger) record(key string, input string, outputs []string) error {
+  entry := ledgerEntry{Key: key, Input: input, Outputs: outputs, EncodedAt: time.Now()}
+
+  line, err := json.Marshal(entry)
+
+  if err != nil {
+    return err
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err != nil {
+    return err
+  }
+
+  if _, err = f.Write(append(line, '\n')); err != nil {
+    f.Close()
+    return err
+  }
+
+  if err = f.Sync(); err != nil {
+    f.Close()
+    return err
+  }
+
+  l.entries[key] = entry
+
+  return f.Close()
+}
+
+// Forget removes the entries for file so it is encoded again, matching both
+// the file's current key, when it still exists, and any entry recorded for
+// its path. It returns how many were removed
+func (l *Ledger) Forget(file string) (int, error) {
+  abs, err := filepath.Abs(file)
+
+  if err != nil {
+    return 0, err
+  }
+
+  key, _ := l.key(abs)
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  removed := 0
+
+  for k, entry := range l.entries {
+    if k == key || entry.Input == abs {
+      delete(l.entries, k)
+      removed++
+    }
+  }
+
+  if removed == 0 {
+    return 0, nil
+  }
+
+  return removed, l.rewrite()
+}
+
+// rewrite replaces the ledger file with the entries in memory, l.mu must be
+// held
+func (l *Ledger) rewrite() error {
+  tmp := l.path + ".tmp"
+  f, err := os.Create(tmp)
+
+  if err != nil {
+    return err
+  }
+
+  enc := json.NewEncoder(f)
+
+  for _, entry := range l.entries {
+    if err = enc.Encode(entry); err != nil {
+      f.Close()
+      os.Remove(tmp)
+      return err
+    }
+  }
+
+  if err = f.Sync(); err != nil {
+    f.Close()
+    os.Remove(tmp)
+    return err
+  }
+
+  if err = f.Close(); err != nil {
+    os.Remove(tmp)
+    return err
+  }
+
+  return os.Rename(tmp, l.path)
+}
+
+// checkLedger returns an error naming the earlier encode when the ledger
+// has seen the job's input, remembering its key to record it once this
+// encode succeeds. Forced jobs, requeued or asked for by name, are always
+// encoded
+func (e *encoder) checkLedger(j *Job) error {
+  // a directory of frames has no one file to fingerprint
+  if e.ledger == nil || j.sequence != nil {
+    return nil
+  }
+
+  key, entry, err := e.ledger.lookup(j.input)
+
+  if err != nil {
+    j.logger().Warn("Could not check the ledger", "error", err)
+    return nil
+  }
+
+  j.mu.Lock()
+  j.ledgerKey = key
+  forced := j.forced
+  j.mu.Unlock()
+
+  if entry == nil || forced {
+    return nil
+  }
+
+  if entry.Input == j.input {
+    j.logger().Info("Already encoded, skipping", "encoded_at", entry.EncodedAt.Format(time.RFC3339), "outputs", entry.Outputs)
+    return fmt.Errorf("already encoded to %s", strings.Join(entry.Outputs, ", "))
+  }
+
+  j.logger().Info("Duplicate of an input already encoded, skipping", "original", entry.Input, "encoded_at", entry.EncodedAt.Format(time.RFC3339), "outputs", entry.Outputs)
+
+  return fmt.Errorf("duplicate of %s, encoded to %s", entry.Input, strings.Join(entry.Outputs, ", "))
+}
+
+// recordLedger adds a successfully encoded job to the ledger
+func (e *encoder) recordLedger(j *Job) {
+  if e.ledger == nil || e.dryRun || j.ledgerKey == "" {
+    return
+  }
+
+  if err := e.ledger.record(j.ledgerKey, j.input, j.outputs); err != nil {
+    j.logger().Error("Could not record in the ledger", "error", err)
+  }
+}
@@ -0,0 +1,52 @@
+package watcher
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestLedgerHashMatchesCopies(t *testing.T) {
+  dir := t.TempDir()
+  input, again := filepath.Join(dir, "master.mov"), filepath.Join(dir, "master again.mov")
+  content := []byte("the same master delivered again")
+
+  for _, path := range []string{input, again} {
+    if err := os.WriteFile(path, content, 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  l, err := OpenLedger(filepath.Join(dir, "ledger.jsonl"), LedgerHash)
+
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  key, entry, err := l.lookup(input)
+
+  if err != nil || entry != nil {
+    t.Fatalf("lookup = %v, %v before anything was recorded", entry, err)
+  }
+
+  if !strings.HasPrefix(key, "xxh64:") {
+    t.Errorf("key = %s, want an xxh64 key", key)
+  }
+
+  if err = l.record(key, input, nil); err != nil {
+    t.Fatal(err)
+  }
+
+  if l, err = OpenLedger(l.path, LedgerHash); err != nil {
+    t.Fatal(err)
+  }
+
+  if _, entry, err = l.lookup(again); err != nil || entry == nil || entry.Input != input {
+    t.Fatalf("lookup of the copy = %v, %v, want the recorded entry", entry, err)
+  }
+
+  if removed, err := l.Forget(again); err != nil || removed != 1 {
+    t.Errorf("Forget = %d, %v, want the entry removed", removed, err)
+  }
+}
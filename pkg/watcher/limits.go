@@ -0,0 +1,101 @@
+package watcher
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+)
+
+// ProcessLimits keep ffmpeg from starving everything else on the host. The
+// zero value runs ffmpeg unrestricted
+type ProcessLimits struct {
+  // Nice is the scheduling niceness, 1 to 19 lowers ffmpeg's priority. On
+  // Windows a positive value selects a below normal or idle priority class
+  Nice int
+
+  // IOClass is the Linux I/O scheduling class: idle, best-effort or
+  // realtime, optionally with a level 0-7 after a colon, e.g. best-effort:7
+  IOClass string
+
+  // Threads adds -threads to ffmpeg's input and output flags, zero leaves
+  // it to ffmpeg
+  Threads int
+
+  // CgroupParent is a delegated cgroup v2 directory with the cpu and memory
+  // controllers enabled for its children. Each encode runs in a child cgroup
+  // limited to CPULimit cores and MemoryLimit bytes. Linux only
+  CgroupParent string
+  CPULimit     float64
+  MemoryLimit  int64
+}
+
+// ioClasses are the ioprio classes of ioprio_set(2)
+var ioClasses = map[string]int{
+  "realtime":    1,
+  "best-effort": 2,
+  "idle":        3,
+}
+
+// ioPriority parses IOClass into the value ioprio_set takes, 0 leaves the
+// priority alone
+func (l ProcessLimits) ioPriority() (int, error) {
+  if l.IOClass == "" {
+    return 0, nil
+  }
+
+  name, level, hasLevel := strings.Cut(strings.ToLower(l.IOClass), ":")
+  class, ok := ioClasses[name]
+
+  if !ok {
+    return 0, fmt.Errorf("io class must be idle, best-effort or realtime, not %q", name)
+  }
+
+  data := 4
+
+  if hasLevel {
+    n, err := strconv.Atoi(level)
+
+    if err != nil || n < 0 || n > 7 {
+      return 0, fmt.Errorf("io level must be 0-7, not %q", level)
+    }
+
+    data = n
+  }
+
+  return class<<13 | data, nil
+}
+
+// check rejects limits that cannot be applied
+func (l ProcessLimits) check() error {
+  if l.Nice < -20 || l.Nice > 19 {
+    return fmt.Errorf("nice must be between -20 and 19, not %d", l.Nice)
+  }
+
+  if l.Threads < 0 {
+    return fmt.Errorf("threads must not be negative")
+  }
+
+  if l.CPULimit < 0 || l.MemoryLimit < 0 {
+    return fmt.Errorf("cpu and memory limits must not be negative")
+  }
+
+  if (l.CPULimit > 0 || l.MemoryLimit > 0) && l.CgroupParent == "" {
+    return fmt.Errorf("cpu and memory limits need a cgroup parent")
+  }
+
+  _, err := l.ioPriority()
+
+  return err
+}
+
+// withThreads adds the thread limit to a job's input and output flags, flags
+// from the profile come after so a profile can still set its own
+func (l ProcessLimits) withThreads(inputFlags []string, outputFlags []string) ([]string, []string) {
+  if l.Threads <= 0 {
+    return inputFlags, outputFlags
+  }
+
+  threads := []string{"-threads", strconv.Itoa(l.Threads)}
+
+  return append(threads, inputFlags...), append(append([]string(nil), threads...), outputFlags...)
+}
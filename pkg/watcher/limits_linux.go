@@ -0,0 +1,146 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "runtime"
+  "strconv"
+  "sync/atomic"
+  "syscall"
+)
+
+// ioprioWhoProcess is IOPRIO_WHO_PROCESS from ioprio_set(2)
+const ioprioWhoProcess = 1
+
+// cpuPeriod is the cgroup cpu.max period in microseconds
+const cpuPeriod = 100000
+
+// cgroups numbers the encodes' cgroups, a job can run several at once
+var cgroups atomic.Int64
+
+// start starts cmd restricted from its first instruction. It is forked
+// straight into its cgroup, and from a thread of its own with the niceness
+// and I/O priority it inherits: on Linux they are per thread, so setting
+// them on a started ffmpeg misses the threads it already has. The thread
+// lives until the returned func is called once cmd has exited, its
+// Pdeathsig goes with the thread. A limit that cannot be applied fails the
+// start
+func (l ProcessLimits) start(j *Job, cmd *exec.Cmd) (func(), error) {
+  cleanup := func() {}
+
+  if l.CgroupParent != "" {
+    dir, fd, err := l.cgroup(j)
+
+    if err != nil {
+      return cleanup, err
+    }
+
+    defer syscall.Close(fd)
+
+    // the kernel refuses to remove a cgroup until its processes are gone,
+    // which they are by the time cleanup runs
+    cleanup = func() { _ = os.Remove(dir) }
+
+    if cmd.SysProcAttr == nil {
+      cmd.SysProcAttr = &syscall.SysProcAttr{}
+    }
+
+    cmd.SysProcAttr.UseCgroupFD = true
+    cmd.SysProcAttr.CgroupFD = fd
+  }
+
+  prio, _ := l.ioPriority()
+
+  if l.Nice == 0 && prio == 0 {
+    if err := cmd.Start(); err != nil {
+      cleanup()
+      return func() {}, err
+    }
+
+    return cleanup, nil
+  }
+
+  started := make(chan error, 1)
+  release := make(chan struct{})
+
+  go func() {
+    // never unlocked, the thread is thrown away with its priorities when
+    // this returns
+    runtime.LockOSThread()
+
+    tid := syscall.Gettid()
+
+    if l.Nice != 0 {
+      if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, l.Nice); err != nil {
+        started <- fmt.Errorf("nice: %s", err)
+        return
+      }
+    }
+
+    if prio != 0 {
+      if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+        started <- fmt.Errorf("ionice: %s", errno)
+        return
+      }
+    }
+
+    if err := cmd.Start(); err != nil {
+      started <- err
+      return
+    }
+
+    started <- nil
+    <-release
+  }()
+
+  if err := <-started; err != nil {
+    cleanup()
+    return func() {}, err
+  }
+
+  removeCgroup := cleanup
+
+  return func() {
+    close(release)
+    removeCgroup()
+  }, nil
+}
+
+// cgroup creates the child cgroup an encode runs in with its limits, and
+// opens it for clone
+func (l ProcessLimits) cgroup(j *Job) (string, int, error) {
+  dir := filepath.Join(l.CgroupParent, fmt.Sprintf("gowatcher-%d-%d", j.id, cgroups.Add(1)))
+
+  if err := os.Mkdir(dir, 0755); err != nil {
+    return "", 0, fmt.Errorf("cgroup: %s", err)
+  }
+
+  fail := func(err error) (string, int, error) {
+    _ = os.Remove(dir)
+    return "", 0, err
+  }
+
+  if l.CPULimit > 0 {
+    quota := strconv.Itoa(int(l.CPULimit*cpuPeriod)) + " " + strconv.Itoa(cpuPeriod)
+
+    if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0644); err != nil {
+      return fail(fmt.Errorf("cgroup cpu.max: %s", err))
+    }
+  }
+
+  if l.MemoryLimit > 0 {
+    if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(l.MemoryLimit, 10)), 0644); err != nil {
+      return fail(fmt.Errorf("cgroup memory.max: %s", err))
+    }
+  }
+
+  fd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+
+  if err != nil {
+    return fail(fmt.Errorf("cgroup: %s", err))
+  }
+
+  return dir, fd, nil
+}
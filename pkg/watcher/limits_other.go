@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package watcher
+
+import "os/exec"
+
+// start starts cmd, there are no process priorities on this platform
+func (l ProcessLimits) start(j *Job, cmd *exec.Cmd) (func(), error) {
+  return func() {}, cmd.Start()
+}
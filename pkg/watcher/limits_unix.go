@@ -0,0 +1,29 @@
+//go:build unix && !linux
+
+package watcher
+
+import (
+  "fmt"
+  "os/exec"
+  "syscall"
+)
+
+// start starts cmd and lowers its priority, which is the whole process's
+// here. I/O classes and cgroups are Linux only and are ignored. A priority
+// that cannot be set stops it again and fails the start
+func (l ProcessLimits) start(j *Job, cmd *exec.Cmd) (func(), error) {
+  if err := cmd.Start(); err != nil {
+    return func() {}, err
+  }
+
+  if l.Nice != 0 {
+    if err := syscall.Setpriority(syscall.PRIO_PROCESS, cmd.Process.Pid, l.Nice); err != nil {
+      _ = cmd.Process.Kill()
+      _ = cmd.Wait()
+
+      return func() {}, fmt.Errorf("nice: %s", err)
+    }
+  }
+
+  return func() {}, nil
+}
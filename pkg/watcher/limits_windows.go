@@ -0,0 +1,33 @@
+package watcher
+
+import (
+  "os/exec"
+  "syscall"
+)
+
+// Windows priority classes for CreateProcess
+const (
+  idlePriorityClass        = 0x00000040
+  belowNormalPriorityClass = 0x00004000
+)
+
+// start starts cmd in a lower priority class for a positive Nice, 10 and
+// above is idle, from its creation. I/O classes and cgroups are Linux only
+// and are ignored here
+func (l ProcessLimits) start(j *Job, cmd *exec.Cmd) (func(), error) {
+  if l.Nice > 0 {
+    if cmd.SysProcAttr == nil {
+      cmd.SysProcAttr = &syscall.SysProcAttr{}
+    }
+
+    class := uint32(belowNormalPriorityClass)
+
+    if l.Nice >= 10 {
+      class = idlePriorityClass
+    }
+
+    cmd.SysProcAttr.CreationFlags |= class
+  }
+
+  return func() {}, cmd.Start()
+}
@@ -0,0 +1,67 @@
+package watcher
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// lockFile is the file in the base directory an instance holds a lock on
+// while it runs, it names the instance holding it
+const lockFile = "gowatcher.lock"
+
+// errLocked is returned by lockExclusive when another process holds the lock
+var errLocked = errors.New("locked")
+
+// instanceLock is this instance's lock on its base directory, the OS drops
+// it when the process exits however it exits
+type instanceLock struct {
+  file *os.File
+}
+
+// lockBaseDir locks dir for this instance. When another instance holds the
+// lock the error says which
+func lockBaseDir(dir string) (*instanceLock, error) {
+  path := filepath.Join(dir, lockFile)
+  f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+
+  if err != nil {
+    return nil, fmt.Errorf("lock file: %s", err)
+  }
+
+  if err = lockExclusive(f); err != nil {
+    holder, _ := os.ReadFile(path)
+    f.Close()
+
+    if errors.Is(err, errLocked) {
+      if holder := strings.TrimSpace(string(holder)); holder != "" {
+        return nil, fmt.Errorf("another gowatcher (%s) is running in %s", holder, dir)
+      }
+
+      return nil, fmt.Errorf("another gowatcher is running in %s", dir)
+    }
+
+    return nil, fmt.Errorf("lock file: %s", err)
+  }
+
+  host, _ := os.Hostname()
+
+  if err = f.Truncate(0); err == nil {
+    _, err = f.WriteAt([]byte(fmt.Sprintf("pid %d on %s\n", os.Getpid(), host)), 0)
+  }
+
+  if err != nil {
+    f.Close()
+    return nil, fmt.Errorf("lock file: %s", err)
+  }
+
+  return &instanceLock{file: f}, nil
+}
+
+// release drops the lock, the file stays for the next instance
+func (l *instanceLock) release() {
+  l.file.Truncate(0)
+  l.file.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package watcher
+
+import (
+  "os"
+)
+
+// lockExclusive is not implemented here, every instance gets the lock
+func lockExclusive(f *os.File) error {
+  return nil
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package watcher
+
+import (
+  "errors"
+  "os"
+  "syscall"
+)
+
+// lockExclusive takes an advisory lock on f without waiting for it
+func lockExclusive(f *os.File) error {
+  err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+
+  if errors.Is(err, syscall.EWOULDBLOCK) {
+    return errLocked
+  }
+
+  return err
+}
@@ -0,0 +1,34 @@
+package watcher
+
+import (
+  "errors"
+  "os"
+  "syscall"
+  "unsafe"
+)
+
+// LockFileEx flags and the error it fails with when the file is locked
+const (
+  lockfileFailImmediately = 0x00000001
+  lockfileExclusiveLock   = 0x00000002
+  errorLockViolation      = syscall.Errno(33)
+)
+
+var lockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// lockExclusive locks the first byte of f without waiting for it
+func lockExclusive(f *os.File) error {
+  var overlapped syscall.Overlapped
+
+  ok, _, err := lockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+
+  if ok != 0 {
+    return nil
+  }
+
+  if errors.Is(err, errorLockViolation) {
+    return errLocked
+  }
+
+  return err
+}
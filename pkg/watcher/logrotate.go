@@ -0,0 +1,245 @@
+package watcher
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+const defaultLogKeep = 5
+
+// LogRotation rotates a log file once it reaches MaxSize, or once it has
+// been written to for MaxAge: the file is renamed to <file>.1, the ones
+// before it move up to .2, .3 and on, and a new file is started. Rotated
+// files past the newest Keep, or older than KeepFor, are removed. With
+// Compress each is gzipped to <file>.1.gz once rotated
+type LogRotation struct {
+  // MaxSize and MaxAge are when the file is rotated, zero does not rotate
+  // by it. MaxAge counts from when the file was opened, or last written
+  // for one that was there already
+  MaxSize int64
+  MaxAge  time.Duration
+
+  // Keep is how many rotated files are kept, default 5, KeepFor how long,
+  // zero keeps them however old they are
+  Keep    int
+  KeepFor time.Duration
+
+  Compress bool
+}
+
+// LogFile is a log that is appended to and rotated as its LogRotation
+// says. It is safe to write to from several goroutines
+type LogFile struct {
+  path string
+  r    LogRotation
+
+  mu     sync.Mutex
+  f      *os.File
+  size   int64
+  opened time.Time
+
+  // compressing is the rotated file still being gzipped, the next
+  // rotation waits for it
+  compressing sync.WaitGroup
+}
+
+// OpenLogFile opens the log at path for appending, rotating it first when
+// it is already due
+func OpenLogFile(path string, r LogRotation) (*LogFile, error) {
+  if r.Keep <= 0 {
+    r.Keep = defaultLogKeep
+  }
+
+  l := &LogFile{path: path, r: r}
+
+  if err := l.open(); err != nil {
+    return nil, err
+  }
+
+  if l.due(0) {
+    if err := l.rotate(); err != nil {
+      fmt.Fprintf(os.Stderr, "Could not rotate %s: %s\n", path, err)
+    }
+  }
+
+  return l, nil
+}
+
+func (l *LogFile) open() error {
+  f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err != nil {
+    return err
+  }
+
+  info, err := f.Stat()
+
+  if err != nil {
+    f.Close()
+    return err
+  }
+
+  l.f, l.size, l.opened = f, info.Size(), time.Now()
+
+  if info.Size() > 0 {
+    l.opened = info.ModTime()
+  }
+
+  return nil
+}
+
+// Write appends p, rotating the file first when p would take it past
+// MaxSize or it is older than MaxAge. A file that cannot be rotated is
+// written to as it is, the log is never lost for it
+func (l *LogFile) Write(p []byte) (int, error) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  if l.f == nil {
+    return 0, os.ErrClosed
+  }
+
+  if l.due(len(p)) {
+    // not the log, which writes here
+    if err := l.rotate(); err != nil {
+      fmt.Fprintf(os.Stderr, "Could not rotate %s: %s\n", l.path, err)
+    }
+  }
+
+  n, err := l.f.Write(p)
+  l.size += int64(n)
+
+  return n, err
+}
+
+// Close closes the file, once a rotated file is done being gzipped
+func (l *LogFile) Close() error {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  l.compressing.Wait()
+
+  if l.f == nil {
+    return nil
+  }
+
+  err := l.f.Close()
+  l.f = nil
+
+  return err
+}
+
+// due reports whether the file is to be rotated before n more bytes
+func (l *LogFile) due(n int) bool {
+  if l.size == 0 {
+    return false
+  }
+
+  return (l.r.MaxSize > 0 && l.size+int64(n) > l.r.MaxSize) || (l.r.MaxAge > 0 && time.Since(l.opened) >= l.r.MaxAge)
+}
+
+// backup is the name of the i-th newest rotated file
+func (l *LogFile) backup(i int) string {
+  return l.path + "." + strconv.Itoa(i)
+}
+
+// rotate moves the rotated files up one, the oldest out, renames the file
+// to .1 and starts a new one
+func (l *LogFile) rotate() error {
+  l.compressing.Wait()
+
+  if err := l.f.Close(); err != nil {
+    return err
+  }
+
+  os.Remove(l.backup(l.r.Keep))
+  os.Remove(l.backup(l.r.Keep) + ".gz")
+
+  for i := l.r.Keep - 1; i >= 1; i-- {
+    for _, suffix := range []string{"", ".gz"} {
+      if _, err := os.Stat(l.backup(i) + suffix); err == nil {
+        os.Rename(l.backup(i)+suffix, l.backup(i+1)+suffix)
+      }
+    }
+  }
+
+  renameErr := os.Rename(l.path, l.backup(1))
+
+  if err := l.open(); err != nil {
+    return err
+  }
+
+  // one that could not be renamed is tried again after as much again
+  l.size, l.opened = 0, time.Now()
+
+  if renameErr != nil {
+    return renameErr
+  }
+
+  if l.r.Compress {
+    l.compressing.Add(1)
+
+    go func() {
+      defer l.compressing.Done()
+
+      if err := gzipFile(l.backup(1)); err != nil {
+        fmt.Fprintf(os.Stderr, "Could not compress %s: %s\n", l.backup(1), err)
+      }
+    }()
+  }
+
+  if l.r.KeepFor > 0 {
+    for i := 2; i <= l.r.Keep; i++ {
+      for _, suffix := range []string{"", ".gz"} {
+        if info, err := os.Stat(l.backup(i) + suffix); err == nil && time.Since(info.ModTime()) > l.r.KeepFor {
+          os.Remove(l.backup(i) + suffix)
+        }
+      }
+    }
+  }
+
+  return nil
+}
+
+// gzipFile compresses file onto the end of file.gz and removes it. gzip
+// reads the members of a file one after the other, so a file.gz that is
+// there already gets file after what it has
+func gzipFile(file string) error {
+  in, err := os.Open(file)
+
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  out, err := os.OpenFile(file+".gz", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err != nil {
+    return err
+  }
+
+  gz := gzip.NewWriter(out)
+  _, err = io.Copy(gz, in)
+
+  if closeErr := gz.Close(); err == nil {
+    err = closeErr
+  }
+
+  if closeErr := out.Close(); err == nil {
+    err = closeErr
+  }
+
+  if err != nil {
+    return err
+  }
+
+  in.Close()
+
+  return os.Remove(file)
+}
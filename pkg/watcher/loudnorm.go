@@ -0,0 +1,208 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Loudnorm normalizes the audio to EBU R128 in two passes: the input's
+// loudness is measured first, then the encode applies ffmpeg's loudnorm
+// filter with the measured values, which keeps it linear instead of
+// compressing the dynamics. The filter is added to the profile's -af, or
+// its first, so the outputs' own flags should not set -af
+type Loudnorm struct {
+  // Target is the integrated loudness in LUFS, default -23. TruePeak is
+  // the maximum true peak in dBTP, default -1, and Range the loudness
+  // range in LU, default 7
+  Target   float64
+  TruePeak float64
+  Range    float64
+
+  // SampleRate is what the audio is resampled to afterwards, loudnorm
+  // works at 192kHz. Default 48000
+  SampleRate int
+}
+
+// loudnormMarker stands in the flags for the filter until the loudness has
+// been measured
+const loudnormMarker = "{loudnorm}"
+
+// loudnormStats is what loudnorm prints with print_format=json
+type loudnormStats struct {
+  InputI       string `json:"input_i"`
+  InputTP      string `json:"input_tp"`
+  InputLRA     string `json:"input_lra"`
+  InputThresh  string `json:"input_thresh"`
+  TargetOffset string `json:"target_offset"`
+}
+
+func (l Loudnorm) withDefaults() Loudnorm {
+  if l.Target == 0 {
+    l.Target = -23
+  }
+
+  if l.TruePeak == 0 {
+    l.TruePeak = -1
+  }
+
+  if l.Range == 0 {
+    l.Range = 7
+  }
+
+  if l.SampleRate <= 0 {
+    l.SampleRate = 48000
+  }
+
+  return l
+}
+
+// check rejects targets loudnorm does not take
+func (l Loudnorm) check() error {
+  l = l.withDefaults()
+
+  switch {
+  case l.Target < -70 || l.Target > -5:
+    return fmt.Errorf("loudnorm target must be between -70 and -5 LUFS")
+  case l.TruePeak < -9 || l.TruePeak > 0:
+    return fmt.Errorf("loudnorm true peak must be between -9 and 0 dBTP")
+  case l.Range < 1 || l.Range > 50:
+    return fmt.Errorf("loudnorm range must be between 1 and 50 LU")
+  }
+
+  return nil
+}
+
+// targets are the filter options shared by both passes
+func (l Loudnorm) targets() string {
+  l = l.withDefaults()
+
+  return fmt.Sprintf("loudnorm=I=%s:TP=%s:LRA=%s", fmtFloat(l.Target), fmtFloat(l.TruePeak), fmtFloat(l.Range))
+}
+
+// filter is the second pass's filter, applying the measured stats
+func (l Loudnorm) filter(stats loudnormStats) string {
+  l = l.withDefaults()
+
+  return fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true:print_format=summary,aresample=%d",
+    l.targets(), stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset, l.SampleRate)
+}
+
+func fmtFloat(f float64) string {
+  return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// hasMarker reports whether any of the plan's runs waits for the loudness
+func (p encodePlan) hasMarker() bool {
+  for _, run := range p.runs {
+    for _, arg := range run.args {
+      if strings.Contains(arg, loudnormMarker) {
+        return true
+      }
+    }
+  }
+
+  return false
+}
+
+// replaceMarker is the plan with the loudnorm marker in its flags replaced
+func (p encodePlan) replaceMarker(filter string) encodePlan {
+  runs := make([]ffmpegRun, len(p.runs))
+
+  for i, run := range p.runs {
+    run.args = append([]string(nil), run.args...)
+
+    for k, arg := range run.args {
+      run.args[k] = strings.ReplaceAll(arg, loudnormMarker, filter)
+    }
+
+    runs[i] = run
+  }
+
+  p.runs = runs
+
+  return p
+}
+
+// loudnessRun is the first pass, measuring the first audio stream of the
+// job's input, or of the part of it a sidecar trims to
+func loudnessRun(j *Job, l *Loudnorm) ffmpegRun {
+  run := ffmpegRun{name: "loudness", logAtLeast: "info"}
+
+  run.args = append(run.args, j.sequenceFlags()...)
+
+  if j.spec != nil {
+    run.args = append(run.args, j.spec.inputFlags()...)
+  }
+
+  run.args = append(run.args, "-i", j.source())
+
+  if j.spec != nil && j.spec.end > 0 {
+    run.args = append(run.args, "-t", formatSeconds(j.spec.end-j.spec.start))
+  }
+
+  run.args = append(run.args, "-map", "0:a:0", "-af", l.targets()+":print_format=json", "-f", "null", os.DevNull)
+
+  return run
+}
+
+// measureLoudness runs the first pass and returns the filter for the encode
+func (e *encoder) measureLoudness(ctx context.Context, j *Job, l *Loudnorm, output io.Writer, duration time.Duration) (string, error) {
+  run := loudnessRun(j, l)
+
+  j.logger().Info("Command", "step", run.name, "args", run.args)
+
+  var stderr bytes.Buffer
+
+  if err := e.runFFmpeg(ctx, j, run, io.MultiWriter(&stderr, output), duration); err != nil {
+    return "", err
+  }
+
+  stats, err := parseLoudnorm(stderr.Bytes())
+
+  if err != nil {
+    return "", err
+  }
+
+  j.logger().Info("Measured loudness", "integrated", stats.InputI+" LUFS", "true_peak", stats.InputTP+" dBTP", "range", stats.InputLRA+" LU")
+
+  return l.filter(stats), nil
+}
+
+// parseLoudnorm finds the JSON loudnorm prints after its [Parsed_loudnorm]
+// line at the end of ffmpeg's output
+func parseLoudnorm(out []byte) (loudnormStats, error) {
+  var stats loudnormStats
+
+  at := bytes.LastIndex(out, []byte("[Parsed_loudnorm"))
+
+  if at < 0 {
+    return stats, fmt.Errorf("ffmpeg printed no loudness measurement")
+  }
+
+  start := bytes.IndexByte(out[at:], '{')
+  end := bytes.IndexByte(out[at:], '}')
+
+  if start < 0 || end < start {
+    return stats, fmt.Errorf("ffmpeg printed no loudness measurement")
+  }
+
+  if err := json.Unmarshal(out[at+start:at+end+1], &stats); err != nil {
+    return stats, fmt.Errorf("loudness measurement: %s", err)
+  }
+
+  // silence measures as -inf, which the second pass does not take
+  for _, v := range []string{stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset} {
+    if _, err := strconv.ParseFloat(v, 64); err != nil || strings.Contains(v, "inf") {
+      return stats, fmt.Errorf("loudness measurement %q is not usable, is the audio silent?", v)
+    }
+  }
+
+  return stats, nil
+}
@@ -0,0 +1,281 @@
+package watcher
+
+import (
+  "context"
+  "crypto/sha256"
+  "encoding/json"
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+const (
+  // manifestSuffix is added to the first output's name for the manifest
+  // next to it, or to the job's log name in ManifestDir
+  manifestSuffix = ".manifest.json"
+
+  // manifestVersion changes when a field of the manifest changes meaning
+  // or goes away, new fields do not change it
+  manifestVersion = 1
+)
+
+// Manifest is the JSON written for each job that finished, see
+// Config.Manifests. It appears once everything it lists is in place, an
+// ingest that waits for it never sees half a job
+type Manifest struct {
+  Version int    `json:"manifest_version"`
+  JobID   int64  `json:"job_id"`
+  JobUID  string `json:"job_uid"`
+
+  Input   ManifestInput   `json:"input"`
+  Profile ManifestProfile `json:"profile"`
+
+  // Files are every file the job left: the outputs, each file of a
+  // package on its own, then the thumbnails, probe reports, checksums and
+  // companions
+  Files []ManifestFile `json:"files"`
+
+  Encode     ManifestEncode     `json:"encode"`
+  Validation ManifestValidation `json:"validation"`
+
+  // Preflight is the input's pre-flight report, see Preflight
+  Preflight *PreflightReport `json:"preflight,omitempty"`
+
+  FinishedAt time.Time `json:"finished_at"`
+}
+
+// ManifestInput is the input as it was encoded. ArrivedAs is the name it
+// arrived with when Filenames renamed it. SHA256 is only known when the
+// audit log took it, see Config.AuditChecksums
+type ManifestInput struct {
+  Path      string    `json:"path"`
+  ArrivedAs string    `json:"arrived_as,omitempty"`
+  Size      int64     `json:"size"`
+  ModTime   time.Time `json:"mod_time"`
+  SHA256    string    `json:"sha256,omitempty"`
+}
+
+// ManifestProfile is what the outputs were made with. Version is the
+// profile's, see Profile.Version, FFmpeg the version ffmpeg prints, empty
+// for one in a container's image
+type ManifestProfile struct {
+  Name        string              `json:"name"`
+  Version     string              `json:"version"`
+  FFmpeg      string              `json:"ffmpeg,omitempty"`
+  InputFlags  []string            `json:"input_flags,omitempty"`
+  OutputFlags []string            `json:"output_flags,omitempty"`
+  Renditions  map[string][]string `json:"renditions,omitempty"`
+}
+
+// ManifestFile is one file the job left, Kind is output, thumbnail,
+// report, checksum or companion. Name is the path from the directory
+// holding it, which for a package file includes the package's directory
+type ManifestFile struct {
+  Path   string `json:"path"`
+  Name   string `json:"name"`
+  Kind   string `json:"kind"`
+  Size   int64  `json:"size"`
+  SHA256 string `json:"sha256"`
+}
+
+// ManifestEncode is what the encode took
+type ManifestEncode struct {
+  StartedAt     time.Time      `json:"started_at"`
+  EncodeSeconds float64        `json:"encode_seconds"`
+  MediaSeconds  float64        `json:"media_seconds,omitempty"`
+  Frames        int64          `json:"frames,omitempty"`
+  Hardware      bool           `json:"hardware,omitempty"`
+  Degraded      string         `json:"degraded,omitempty"`
+  Artifacts     []ArtifactView `json:"artifacts,omitempty"`
+}
+
+// ManifestValidation says how the outputs were checked before they counted
+// as finished: Checked when VALIDATE_OUTPUTS is on, each one not empty, and
+// Probed when ffprobe read its streams and duration too, within Tolerance
+// of the input's
+type ManifestValidation struct {
+  Checked      bool    `json:"checked"`
+  Probed       bool    `json:"probed"`
+  InputSeconds float64 `json:"input_seconds,omitempty"`
+  Tolerance    string  `json:"tolerance,omitempty"`
+}
+
+// manifestFiles are the files of a job that finished, by kind
+type manifestFiles struct {
+  outputs, thumbnails, reports, checksums, companions []string
+}
+
+// writeManifest writes the job's manifest into ManifestDir, or next to its
+// first output, and returns its path. A manifest that cannot be written is
+// logged and "" returned, the job still succeeds
+func (e *encoder) writeManifest(j *Job, files manifestFiles) string {
+  logger := j.logger()
+
+  if len(files.outputs) == 0 {
+    return ""
+  }
+
+  m, err := e.manifest(j, files)
+
+  if err != nil {
+    logger.Warn("Could not write manifest", "error", err)
+    return ""
+  }
+
+  path := files.outputs[0] + manifestSuffix
+
+  if e.manifestDir != "" {
+    path = filepath.Join(e.manifestDir, fmt.Sprintf("%s-%s%s", j.uid, filepath.Base(j.input), manifestSuffix))
+  }
+
+  data, _ := json.MarshalIndent(m, "", "  ")
+  tmp := path + ".tmp"
+
+  err = os.WriteFile(tmp, append(data, '\n'), 0644)
+
+  if err == nil {
+    err = setOwnership(tmp, e.outputOwner, e.outputMode)
+  }
+
+  if err == nil {
+    err = os.Rename(tmp, path)
+  }
+
+  if err != nil {
+    os.Remove(tmp)
+    logger.Warn("Could not write manifest", "file", path, "error", err)
+    return ""
+  }
+
+  return path
+}
+
+// manifest reads what the job's manifest lists, digesting every file
+func (e *encoder) manifest(j *Job, files manifestFiles) (*Manifest, error) {
+  j.mu.Lock()
+  m := &Manifest{
+    Version: manifestVersion,
+    JobID:   j.id,
+    JobUID:  j.uid,
+    Input:   ManifestInput{Path: j.input, ArrivedAs: j.arrivedAs, Size: j.inputBytes, SHA256: j.inputDigest},
+    Encode: ManifestEncode{
+      StartedAt:     j.startedAt,
+      EncodeSeconds: j.encoded.time.Seconds(),
+      MediaSeconds:  j.encoded.media.Seconds(),
+      Frames:        j.encoded.frames,
+      Hardware:      j.encoded.hardware,
+      Degraded:      j.degraded,
+      Artifacts:     j.artifacts,
+    },
+    Preflight: j.preflight,
+  }
+  p := j.profile
+  j.mu.Unlock()
+
+  if info, err := os.Stat(j.source()); err == nil {
+    m.Input.ModTime = info.ModTime()
+  }
+
+  m.Profile = ManifestProfile{Name: p.Name, Version: p.Version(), FFmpeg: e.ffmpegVersion(j), InputFlags: p.InputFlags, OutputFlags: p.OutputFlags}
+
+  for _, r := range p.Renditions {
+    if m.Profile.Renditions == nil {
+      m.Profile.Renditions = make(map[string][]string)
+    }
+
+    m.Profile.Renditions[r.Name] = r.OutputFlags
+  }
+
+  m.Validation = ManifestValidation{Checked: e.validate, Probed: e.validate && e.ffprobePath != ""}
+
+  if m.Validation.Probed && m.Encode.MediaSeconds > 0 {
+    m.Validation.InputSeconds = m.Encode.MediaSeconds
+
+    if t := e.tolerance; t.Absolute > 0 {
+      m.Validation.Tolerance = t.Absolute.String()
+    } else {
+      m.Validation.Tolerance = fmt.Sprintf("%g%%", t.Fraction*100)
+    }
+  }
+
+  kinds := []struct {
+    kind  string
+    paths []string
+  }{
+    {"output", files.outputs},
+    {"thumbnail", files.thumbnails},
+    {"report", files.reports},
+    {"checksum", files.checksums},
+    {"companion", files.companions},
+  }
+
+  for _, k := range kinds {
+    for _, top := range k.paths {
+      err := filepath.WalkDir(top, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+          return err
+        }
+
+        info, err := entry.Info()
+
+        if err != nil {
+          return err
+        }
+
+        digest, err := fileDigest(path, sha256.New)
+
+        if err != nil {
+          return err
+        }
+
+        name, err := filepath.Rel(filepath.Dir(top), path)
+
+        if err != nil {
+          return err
+        }
+
+        m.Files = append(m.Files, ManifestFile{Path: path, Name: filepath.ToSlash(name), Kind: k.kind, Size: info.Size(), SHA256: digest})
+
+        return nil
+      })
+
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  m.FinishedAt = time.Now()
+
+  return m, nil
+}
+
+// ffmpegVersion is the version of the ffmpeg the job ran, asking each
+// binary once. A container's ffmpeg cannot be asked
+func (e *encoder) ffmpegVersion(j *Job) string {
+  path := e.ffmpeg(j)
+
+  if path == "" || (e.sandbox != nil && e.sandbox.container()) {
+    return ""
+  }
+
+  if version, ok := e.ffmpegVersions.Load(path); ok {
+    return version.(string)
+  }
+
+  ctx, cancel := context.WithTimeout(e.ctx, hwProbeTimeout)
+  defer cancel()
+
+  version, err := toolVersion(ctx, path)
+
+  if err != nil {
+    j.logger().Warn("Could not find out ffmpeg's version for the manifest", "error", err)
+    return ""
+  }
+
+  e.ffmpegVersions.Store(path, version)
+
+  return version
+}
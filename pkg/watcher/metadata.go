@@ -0,0 +1,139 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "sort"
+  "strconv"
+  "time"
+)
+
+// Metadata is what a profile writes into its outputs' containers besides
+// the encode, and the catalog report it writes next to them
+type Metadata struct {
+  // Preserve copies the input's container metadata and chapters, which
+  // ffmpeg only does for some containers on its own
+  Preserve bool
+
+  // Tags are set on every output, their values are output name templates,
+  // e.g. title: "{basename}". {rendition} is the profile's name
+  Tags map[string]string
+
+  // EncodeDate sets creation_time to when the encode started, EncoderTag
+  // sets encoded_by to gowatcher and JobTag gowatcher_job to the job's ULID
+  EncodeDate bool
+  EncoderTag bool
+  JobTag     bool
+
+  // ProbeReport writes ffprobe's JSON report of every finished output next
+  // to it, name.mp4.json, and uploads it with it. It needs ffprobe
+  ProbeReport bool
+}
+
+// reportExtension is added to an output's name for its probe report
+const reportExtension = ".json"
+
+// checkTags rejects tags with no name or unknown variables
+func (m *Metadata) checkTags() error {
+  for key, value := range m.Tags {
+    if key == "" {
+      return fmt.Errorf("metadata tags need a name")
+    }
+
+    for _, match := range templateVariable.FindAllStringSubmatch(value, -1) {
+      if !nameVariables[match[1]] {
+        return fmt.Errorf("metadata %s: unknown variable {%s}", key, match[1])
+      }
+    }
+  }
+
+  return nil
+}
+
+// flags are the ffmpeg flags writing the metadata, input is the one to
+// preserve it from and uid the job's
+func (m *Metadata) flags(input int, vars map[string]string, at time.Time, uid string) []string {
+  var flags []string
+
+  if m.Preserve {
+    flags = append(flags, "-map_metadata", strconv.Itoa(input), "-map_chapters", strconv.Itoa(input))
+  }
+
+  keys := make([]string, 0, len(m.Tags))
+
+  for key := range m.Tags {
+    keys = append(keys, key)
+  }
+
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    flags = append(flags, "-metadata", key+"="+expandName(m.Tags[key], vars))
+  }
+
+  if m.EncodeDate {
+    flags = append(flags, "-metadata", "creation_time="+at.UTC().Format(time.RFC3339))
+  }
+
+  if m.EncoderTag {
+    flags = append(flags, "-metadata", "encoded_by=gowatcher")
+  }
+
+  if m.JobTag {
+    flags = append(flags, "-metadata", "gowatcher_job="+uid)
+  }
+
+  return flags
+}
+
+// metadataFlags are the job's metadata flags, none when its profile has no
+// metadata settings
+func (e *encoder) metadataFlags(j *Job, probed *probeResult, input int) []string {
+  m := j.profile.Metadata
+
+  if m == nil {
+    return nil
+  }
+
+  vars := j.profile.nameVars(j.name, Rendition{Name: j.profile.Name}, probed, j.startedAt)
+
+  return m.flags(input, vars, j.startedAt, j.uid)
+}
+
+// writeProbeReports writes the report of every finished output that
+// ffprobe reads and returns their paths. Failures are logged, the job still
+// succeeds
+func (e *encoder) writeProbeReports(j *Job, finished []string) []string {
+  logger := j.logger()
+
+  if e.ffprobePath == "" {
+    logger.Warn("Probe reports need ffprobe")
+    return nil
+  }
+
+  var reports []string
+
+  for _, out := range finished {
+    if info, err := os.Stat(out); err != nil || info.IsDir() {
+      continue
+    }
+
+    report, err := probeJSON(e.ffprobePath, out)
+
+    if err != nil {
+      logger.Warn("Could not probe output for its report", "output", out, "error", err)
+      continue
+    }
+
+    path := out + reportExtension
+
+    if err := os.WriteFile(path, report, 0644); err != nil {
+      logger.Warn("Could not write probe report", "output", out, "error", err)
+      continue
+    }
+
+    reports = append(reports, path)
+  }
+
+  return reports
+}
@@ -0,0 +1,148 @@
+package watcher
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+  "sync/atomic"
+  "time"
+)
+
+// metrics are the counters and gauges exposed on /metrics in the Prometheus
+// text exposition format
+type metrics struct {
+  filesQueued       atomic.Int64
+  encodesInProgress atomic.Int64
+  successes         atomic.Int64
+  failures          atomic.Int64
+  encodeNanos       atomic.Int64
+  bytesProcessed    atomic.Int64
+  waitingForSpace   atomic.Int64
+
+  // queueDepth is computed on every scrape so it reflects what is actually
+  // waiting on disk
+  queueDepth func() int
+
+  // workers is the size of the worker pool, which autoscaling changes
+  workers func() int
+
+  // oldestQueued is how long the job waiting longest has been queued
+  oldestQueued func() time.Duration
+}
+
+// encodeFinished records the outcome of a single encode
+func (m *metrics) encodeFinished(took time.Duration, inputBytes int64, err error) {
+  m.encodeNanos.Add(int64(took))
+
+  if err != nil {
+    m.failures.Add(1)
+    return
+  }
+
+  m.successes.Add(1)
+  m.bytesProcessed.Add(inputBytes)
+}
+
+// metricSample is one metric's current value
+type metricSample struct {
+  name  string
+  kind  string
+  help  string
+  value float64
+}
+
+func (m *metrics) samples() []metricSample {
+  samples := []metricSample{
+    {"gowatcher_files_queued_total", "counter", "Files added to the queue.", float64(m.filesQueued.Load())},
+    {"gowatcher_encodes_in_progress", "gauge", "Encodes currently running.", float64(m.encodesInProgress.Load())},
+    {"gowatcher_encodes_succeeded_total", "counter", "Encodes that finished successfully.", float64(m.successes.Load())},
+    {"gowatcher_encodes_failed_total", "counter", "Encodes that failed.", float64(m.failures.Load())},
+    {"gowatcher_encode_seconds_total", "counter", "Total wall time spent encoding.", time.Duration(m.encodeNanos.Load()).Seconds()},
+    {"gowatcher_bytes_processed_total", "counter", "Input bytes of successfully encoded files.", float64(m.bytesProcessed.Load())},
+    {"gowatcher_jobs_waiting_for_disk_space", "gauge", "Jobs held because a volume is low on free space.", float64(m.waitingForSpace.Load())},
+  }
+
+  if m.queueDepth != nil {
+    samples = append(samples, metricSample{"gowatcher_queue_depth", "gauge", "Files waiting in the queue directory.", float64(m.queueDepth())})
+  }
+
+  if m.oldestQueued != nil {
+    samples = append(samples, metricSample{"gowatcher_queue_oldest_age_seconds", "gauge", "How long the job waiting longest for a worker has been queued.", m.oldestQueued().Seconds()})
+  }
+
+  if m.workers != nil {
+    samples = append(samples, metricSample{"gowatcher_workers", "gauge", "Workers encoding files, changed by autoscaling.", float64(m.workers())})
+  }
+
+  return samples
+}
+
+func (m *metrics) writeTo(w io.Writer) {
+  for _, s := range m.samples() {
+    writeMetric(w, s.name, s.kind, s.help, s.value)
+  }
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value float64) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  m.writeTo(w)
+}
+
+// rootMetrics serves several watchers' metrics, labelled with their names
+type rootMetrics []*Watcher
+
+// GroupMetricsHandler serves the metrics of watchers running in the same
+// process, each sample has a root label with the watcher's Config.Name
+func GroupMetricsHandler(watchers []*Watcher) http.Handler {
+  return rootMetrics(watchers)
+}
+
+func (ws rootMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+  samples := make([][]metricSample, len(ws))
+
+  for i, watcher := range ws {
+    samples[i] = watcher.stats.samples()
+  }
+
+  if len(samples) == 0 {
+    return
+  }
+
+  // every watcher has the same metrics in the same order
+  for i, s := range samples[0] {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+
+    for j, watcher := range ws {
+      fmt.Fprintf(w, "%s{root=%q} %g\n", s.name, watcher.cfg.Name, samples[j][i].value)
+    }
+  }
+}
+
+// countQueued returns the number of files in dirs that would be picked up by
+// the watcher
+func countQueued(filter *fileFilter, dirs ...string) int {
+  count := 0
+
+  for _, dir := range dirs {
+    entries, err := os.ReadDir(dir)
+
+    if err != nil {
+      continue
+    }
+
+    for _, entry := range entries {
+      if !entry.IsDir() && entry.Name()[0] != '.' && !isSidecar(entry.Name()) && filter.allowed(entry.Name()) {
+        count++
+      }
+    }
+  }
+
+  return count
+}
@@ -0,0 +1,170 @@
+package watcher
+
+import (
+  "context"
+  "io"
+  "os"
+  "path/filepath"
+)
+
+// moveFile renames src to dst, falling back to a copy when they are on
+// different filesystems. The copy is written under a temporary dot name next
+// to dst, synced, then renamed into place so dst is never seen half written
+func moveFile(src string, dst string) error {
+  return moveWith(src, dst, nil)
+}
+
+// deliver moves a finished output like moveFile, a copy to another
+// filesystem going at the delivery pace and resuming after an error
+func (e *encoder) deliver(ctx context.Context, j *Job, src string, dst string) error {
+  return moveWith(src, dst, e.delivery.start(ctx, j.logger(), src, dst, totalSize([]string{src})))
+}
+
+// moveWith is moveFile with the copy made as t, a retry carries on with
+// the files copied so far
+func moveWith(src string, dst string, t *transfer) error {
+  err := os.Rename(src, dst)
+
+  if err == nil || !crossDevice(err) {
+    return err
+  }
+
+  tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+
+  if err = os.RemoveAll(tmp); err != nil {
+    return err
+  }
+
+  err = t.retry(func() error {
+    t.restart()
+
+    return copyTree(src, tmp, t)
+  })
+
+  if err != nil {
+    os.RemoveAll(tmp)
+    return err
+  }
+
+  if err = os.Rename(tmp, dst); err != nil {
+    os.RemoveAll(tmp)
+    return err
+  }
+
+  syncDir(filepath.Dir(dst))
+
+  return os.RemoveAll(src)
+}
+
+// copyTree copies a file, or a directory and everything in it, keeping
+// modes and modification times. Every file is synced before returning.
+// What an earlier copy to dst left is kept: files it finished and the
+// start of the one it was copying
+func copyTree(src string, dst string, t *transfer) error {
+  info, err := os.Lstat(src)
+
+  if err != nil {
+    return err
+  }
+
+  switch {
+  case info.Mode()&os.ModeSymlink != 0:
+    if _, err := os.Lstat(dst); err == nil {
+      return nil
+    }
+
+    target, err := os.Readlink(src)
+
+    if err != nil {
+      return err
+    }
+
+    return os.Symlink(target, dst)
+  case info.IsDir():
+    if err = os.Mkdir(dst, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+      return err
+    }
+
+    entries, err := os.ReadDir(src)
+
+    if err != nil {
+      return err
+    }
+
+    for _, entry := range entries {
+      if err = copyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), t); err != nil {
+        return err
+      }
+    }
+
+    syncDir(dst)
+  default:
+    if err = copyFile(src, dst, info, t); err != nil {
+      return err
+    }
+
+    t.fileDone(info.Size())
+  }
+
+  return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyFile copies src to dst, carrying on from the end of a shorter dst.
+// A dst with src's size and time is a finished copy
+func copyFile(src string, dst string, info os.FileInfo, t *transfer) error {
+  if done, err := os.Lstat(dst); err == nil && done.Size() == info.Size() && done.ModTime().Equal(info.ModTime()) {
+    return nil
+  }
+
+  in, err := os.Open(src)
+
+  if err != nil {
+    return err
+  }
+
+  defer in.Close()
+
+  out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, info.Mode().Perm())
+
+  if err != nil {
+    return err
+  }
+
+  offset, err := out.Seek(0, io.SeekEnd)
+
+  // a longer dst is some other file
+  if err == nil && offset > info.Size() {
+    if err = out.Truncate(0); err == nil {
+      offset, err = out.Seek(0, io.SeekStart)
+    }
+  }
+
+  if err == nil {
+    _, err = in.Seek(offset, io.SeekStart)
+  }
+
+  if err == nil {
+    _, err = io.Copy(out, t.reader(in, offset))
+  }
+
+  if err != nil {
+    out.Close()
+    return err
+  }
+
+  if err = out.Sync(); err != nil {
+    out.Close()
+    return err
+  }
+
+  return out.Close()
+}
+
+// syncDir flushes a directory's entries so a rename into it survives a
+// crash, errors are ignored as not every filesystem supports it
+func syncDir(dir string) {
+  if d, err := os.Open(dir); err == nil {
+    d.Sync()
+    d.Close()
+  }
+}
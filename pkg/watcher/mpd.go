@@ -0,0 +1,305 @@
+package watcher
+
+import (
+  "bytes"
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "io"
+  "net/url"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// mpdNode is an element of a DASH manifest, names keep their prefixes as
+// they were written so the manifest is written back the same
+type mpdNode struct {
+  start xml.StartElement
+  text  string
+  nodes []*mpdNode
+}
+
+// attr is the value of the attribute, "" when it has none
+func (n *mpdNode) attr(name string) string {
+  for _, a := range n.start.Attr {
+    if a.Name.Local == name {
+      return a.Value
+    }
+  }
+
+  return ""
+}
+
+// setAttr sets the attribute, or removes it when value is ""
+func (n *mpdNode) setAttr(name string, value string) {
+  attrs := n.start.Attr[:0]
+  found := false
+
+  for _, a := range n.start.Attr {
+    if a.Name.Local == name {
+      if value == "" {
+        continue
+      }
+
+      a.Value, found = value, true
+    }
+
+    attrs = append(attrs, a)
+  }
+
+  if !found && value != "" {
+    attrs = append(attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+  }
+
+  n.start.Attr = attrs
+}
+
+// children are the elements under n with the name
+func (n *mpdNode) children(name string) []*mpdNode {
+  var found []*mpdNode
+
+  for _, c := range n.nodes {
+    if c.start.Name.Local == name {
+      found = append(found, c)
+    }
+  }
+
+  return found
+}
+
+// readMPD parses a DASH manifest
+func readMPD(path string) (*mpdNode, error) {
+  data, err := os.ReadFile(path)
+
+  if err != nil {
+    return nil, err
+  }
+
+  d := xml.NewDecoder(bytes.NewReader(data))
+  var stack []*mpdNode
+  var root *mpdNode
+
+  for {
+    tok, err := d.RawToken()
+
+    if errors.Is(err, io.EOF) {
+      break
+    }
+
+    if err != nil {
+      return nil, fmt.Errorf("%s: %s", path, err)
+    }
+
+    switch t := tok.(type) {
+    case xml.StartElement:
+      n := &mpdNode{start: rawStart(t)}
+
+      if len(stack) > 0 {
+        parent := stack[len(stack)-1]
+        parent.nodes = append(parent.nodes, n)
+      } else if root == nil {
+        root = n
+      }
+
+      stack = append(stack, n)
+    case xml.EndElement:
+      if len(stack) > 0 {
+        stack = stack[:len(stack)-1]
+      }
+    case xml.CharData:
+      if text := strings.TrimSpace(string(t)); text != "" && len(stack) > 0 {
+        stack[len(stack)-1].text += text
+      }
+    }
+  }
+
+  if root == nil || root.start.Name.Local != "MPD" {
+    return nil, fmt.Errorf("%s is not a DASH manifest", path)
+  }
+
+  return root, nil
+}
+
+// rawStart folds the prefixes RawToken splits off into the names, as the
+// encoder would take them for namespaces
+func rawStart(t xml.StartElement) xml.StartElement {
+  start := xml.StartElement{Name: rawName(t.Name)}
+
+  for _, a := range t.Attr {
+    start.Attr = append(start.Attr, xml.Attr{Name: rawName(a.Name), Value: a.Value})
+  }
+
+  return start
+}
+
+func rawName(n xml.Name) xml.Name {
+  if n.Space != "" {
+    return xml.Name{Local: n.Space + ":" + n.Local}
+  }
+
+  return n
+}
+
+// writeMPD writes the manifest to path
+func writeMPD(path string, root *mpdNode) error {
+  var b bytes.Buffer
+
+  b.WriteString(xml.Header)
+
+  enc := xml.NewEncoder(&b)
+  enc.Indent("", "\t")
+
+  var encode func(n *mpdNode) error
+
+  encode = func(n *mpdNode) error {
+    if err := enc.EncodeToken(n.start); err != nil {
+      return err
+    }
+
+    if n.text != "" {
+      if err := enc.EncodeToken(xml.CharData(n.text)); err != nil {
+        return err
+      }
+    }
+
+    for _, c := range n.nodes {
+      if err := encode(c); err != nil {
+        return err
+      }
+    }
+
+    return enc.EncodeToken(n.start.End())
+  }
+
+  if err := encode(root); err != nil {
+    return err
+  }
+
+  if err := enc.Flush(); err != nil {
+    return err
+  }
+
+  b.WriteByte('\n')
+
+  return os.WriteFile(path, b.Bytes(), 0644)
+}
+
+// mpdSegmentAttrs are the attributes naming segment files, relative to the
+// manifest
+var mpdSegmentAttrs = []string{"initialization", "media", "sourceURL"}
+
+// writeDASHManifest combines the manifests ffmpeg wrote for every rendition
+// into the package's manifest.mpd, with an adaptation set for each content
+// type holding a representation of every rendition, so a player switches
+// between them. The segments stay in the renditions' folders
+func writeDASHManifest(packageDir string, renditions []Rendition) error {
+  var combined, period *mpdNode
+  sets := make(map[string]*mpdNode)
+
+  for _, r := range renditions {
+    root, err := readMPD(filepath.Join(packageDir, r.Name, "manifest.mpd"))
+
+    if err != nil {
+      return err
+    }
+
+    periods := root.children("Period")
+
+    if len(periods) == 0 {
+      return fmt.Errorf("the manifest of %s has no period", r.Name)
+    }
+
+    // the first rendition's is the manifest without its adaptation sets
+    if combined == nil {
+      combined = &mpdNode{start: root.start, text: root.text}
+
+      for _, n := range root.nodes {
+        if n != periods[0] {
+          combined.nodes = append(combined.nodes, n)
+          continue
+        }
+
+        period = &mpdNode{start: n.start, text: n.text}
+        combined.nodes = append(combined.nodes, period)
+
+        for _, c := range n.nodes {
+          if c.start.Name.Local != "AdaptationSet" {
+            period.nodes = append(period.nodes, c)
+          }
+        }
+      }
+    }
+
+    for _, as := range periods[0].children("AdaptationSet") {
+      kind := as.attr("contentType")
+
+      if kind == "" {
+        kind, _, _ = strings.Cut(as.attr("mimeType"), "/")
+      }
+
+      set, ok := sets[kind]
+
+      if !ok {
+        set = &mpdNode{start: as.start.Copy()}
+        set.setAttr("id", strconv.Itoa(len(sets)))
+
+        // the sizes and bit streams of the renditions differ
+        for _, name := range []string{"maxWidth", "maxHeight", "maxFrameRate", "bitstreamSwitching"} {
+          set.setAttr(name, "")
+        }
+
+        for _, c := range as.nodes {
+          if c.start.Name.Local != "Representation" {
+            set.nodes = append(set.nodes, c)
+          }
+        }
+
+        sets[kind] = set
+        period.nodes = append(period.nodes, set)
+      }
+
+      for _, rep := range as.children("Representation") {
+        set.nodes = append(set.nodes, relocate(rep, r.Name))
+      }
+    }
+  }
+
+  if combined == nil {
+    return errors.New("no renditions to list")
+  }
+
+  return writeMPD(filepath.Join(packageDir, "manifest.mpd"), combined)
+}
+
+// relocate is a representation of the rendition's manifest as the package's
+// manifest lists it, with an id of its own and its segments in the
+// rendition's folder
+func relocate(rep *mpdNode, rendition string) *mpdNode {
+  id := rep.attr("id")
+
+  var copyNode func(n *mpdNode) *mpdNode
+
+  copyNode = func(n *mpdNode) *mpdNode {
+    c := &mpdNode{start: n.start.Copy(), text: n.text}
+
+    for _, name := range mpdSegmentAttrs {
+      if value := c.attr(name); value != "" {
+        value = strings.ReplaceAll(value, "$RepresentationID$", id)
+        c.setAttr(name, url.PathEscape(rendition)+"/"+value)
+      }
+    }
+
+    for _, child := range n.nodes {
+      c.nodes = append(c.nodes, copyNode(child))
+    }
+
+    return c
+  }
+
+  out := copyNode(rep)
+  out.setAttr("id", rendition+"-"+id)
+
+  return out
+}
@@ -0,0 +1,109 @@
+package watcher
+
+import (
+  "fmt"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// nameVariables are the {variables} an output name template can use:
+//
+//	{basename}    the input's file name without its extension
+//	{origext}     the input's extension, without the dot
+//	{ext}         the output's extension, without the dot
+//	{profile}     the profile name
+//	{rendition}   the rendition name, the profile name without renditions
+//	{suffix}      the rendition's suffix
+//	{resolution}  the input's WxH from ffprobe, empty when not known
+//	{date}        the day the encode started, 2006-01-02
+//	{time}        the time the encode started, 150405
+//	{timestamp}   both, 20060102-150405
+//	{clip}        the clip's name for the job spec's clips, see Clip
+var nameVariables = map[string]bool{
+  "basename":   true,
+  "origext":    true,
+  "ext":        true,
+  "profile":    true,
+  "rendition":  true,
+  "suffix":     true,
+  "resolution": true,
+  "date":       true,
+  "time":       true,
+  "timestamp":  true,
+  "clip":       true,
+}
+
+// templateVariable matches {name}, and {output.step} in pipeline commands
+var templateVariable = regexp.MustCompile(`\{([a-z_]+(?:\.[A-Za-z0-9_-]+)?)\}`)
+
+// checkNameTemplate rejects templates with unknown variables or that would
+// write outside the output directory
+func checkNameTemplate(template string) error {
+  if strings.ContainsAny(template, `/\`) {
+    return fmt.Errorf("output name template %q must not contain a path separator", template)
+  }
+
+  for _, match := range templateVariable.FindAllStringSubmatch(template, -1) {
+    if !nameVariables[match[1]] {
+      return fmt.Errorf("output name template %q: unknown variable {%s}", template, match[1])
+    }
+  }
+
+  return nil
+}
+
+// expandName fills in an output name template
+func expandName(template string, vars map[string]string) string {
+  return templateVariable.ReplaceAllStringFunc(template, func(match string) string {
+    if value, ok := vars[match[1:len(match)-1]]; ok {
+      return value
+    }
+
+    return match
+  })
+}
+
+// resolution returns the WxH of the first video stream, or "" without one
+func (p *probeResult) resolution() string {
+  if p == nil {
+    return ""
+  }
+
+  for _, stream := range p.streams("video") {
+    if stream.Width > 0 && stream.Height > 0 {
+      return strconv.Itoa(stream.Width) + "x" + strconv.Itoa(stream.Height)
+    }
+  }
+
+  return ""
+}
+
+// nameVars are the template values for an input and rendition
+func (p *Profile) nameVars(input string, r Rendition, probed *probeResult, at time.Time) map[string]string {
+  name := filepath.Base(input)
+  origExt := filepath.Ext(name)
+  ext := origExt
+
+  if r.Extension != "" {
+    ext = "." + strings.TrimPrefix(r.Extension, ".")
+  } else if p.Extension != "" {
+    ext = "." + strings.TrimPrefix(p.Extension, ".")
+  }
+
+  return map[string]string{
+    "basename":   strings.TrimSuffix(name, origExt),
+    "origext":    strings.TrimPrefix(origExt, "."),
+    "ext":        strings.TrimPrefix(ext, "."),
+    "profile":    p.Name,
+    "rendition":  r.Name,
+    "suffix":     r.Suffix,
+    "resolution": probed.resolution(),
+    "date":       at.Format("2006-01-02"),
+    "time":       at.Format("150405"),
+    "timestamp":  at.Format("20060102-150405"),
+    "clip":       "",
+  }
+}
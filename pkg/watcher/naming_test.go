@@ -0,0 +1,69 @@
+package watcher
+
+import (
+  "testing"
+  "time"
+)
+
+func TestExpandName(t *testing.T) {
+  vars := map[string]string{"basename": "clip", "ext": "mp4", "suffix": "", "resolution": ""}
+
+  for template, want := range map[string]string{
+    "{basename}.{ext}":              "clip.mp4",
+    "{basename}{suffix}.{ext}":      "clip.mp4",
+    "{basename}_{resolution}.{ext}": "clip_.mp4",
+    "{basename}-{colour}.{ext}":     "clip-{colour}.mp4",
+    "{basename}-{output.step}":      "clip-{output.step}",
+    "{Basename}.{ext}":              "{Basename}.mp4",
+    "{basename.{ext}":               "{basename.mp4",
+    "{}{basename}":                  "{}clip",
+  } {
+    if got := expandName(template, vars); got != want {
+      t.Errorf("expandName(%q) = %q, want %q", template, got, want)
+    }
+  }
+}
+
+func TestOutputName(t *testing.T) {
+  at := time.Date(2024, 3, 9, 14, 5, 6, 0, time.UTC)
+  probed := &probeResult{Streams: []probeStream{{CodecType: "video", Width: 1920, Height: 1080}}}
+  p := &Profile{Name: "web", Extension: "mp4"}
+
+  tests := []struct {
+    template string
+    r        Rendition
+    probed   *probeResult
+    want     string
+  }{
+    {"", Rendition{Name: "web"}, nil, "clip.mp4"},
+    {"", Rendition{Name: "720p", Suffix: "-720p", Extension: ".webm"}, nil, "clip-720p.webm"},
+    {"{basename}_{resolution}.{ext}", Rendition{Name: "web"}, probed, "clip_1920x1080.mp4"},
+    {"{basename}_{resolution}.{ext}", Rendition{Name: "web"}, nil, "clip_.mp4"},
+    {"{basename}{suffix}-{rendition}.{ext}", Rendition{Name: "web"}, nil, "clip-web.mp4"},
+    {"{profile}-{timestamp}.{origext}.{ext}", Rendition{Name: "web"}, nil, "web-20240309-140506.mov.mp4"},
+    {"{basename}{clip}.{ext}", Rendition{Name: "web"}, nil, "clip.mp4"},
+  }
+
+  for _, test := range tests {
+    p.NameTemplate = test.template
+
+    if got := p.outputName("/queue/clip.mov", test.r, test.probed, at); got != test.want {
+      t.Errorf("outputName with %q = %q, want %q", test.template, got, test.want)
+    }
+  }
+}
+
+func TestCheckNameTemplate(t *testing.T) {
+  for template, ok := range map[string]bool{
+    "{basename}_{resolution}.{ext}": true,
+    "{basename}-{date}":             true,
+    "{basename}-{colour}.{ext}":     false,
+    "{output.step}":                 false,
+    "../{basename}":                 false,
+    `{basename}\{ext}`:              false,
+  } {
+    if err := checkNameTemplate(template); (err == nil) != ok {
+      t.Errorf("checkNameTemplate(%q) = %v, want ok %v", template, err, ok)
+    }
+  }
+}
@@ -0,0 +1,563 @@
+package watcher
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "os/exec"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Notifier is told about each job as it is queued, starts, and finishes or
+// fails, where an EventHandler only hears how jobs end. A cancelled job is
+// neither finished nor failed. The methods are called from whatever queued
+// or ran the job, slow notifiers should do their work in the background. A
+// Notifier that is an io.Closer is closed when the Watcher shuts down
+type Notifier interface {
+  JobQueued(ev JobEvent)
+  JobStarted(ev JobEvent)
+  JobFinished(ev JobEvent)
+  JobFailed(ev JobEvent)
+}
+
+// NotifierFactory makes a notifier from the options it was given, see
+// ParseNotifiers
+type NotifierFactory func(options map[string]string) (Notifier, error)
+
+// notifierKinds are the registered factories by kind
+var notifierKinds = struct {
+  sync.Mutex
+  factories map[string]NotifierFactory
+}{factories: make(map[string]NotifierFactory)}
+
+// RegisterNotifier makes a kind of notifier available to NewNotifier and
+// ParseNotifiers, from an init func usually. Registering a kind twice
+// panics
+func RegisterNotifier(kind string, factory NotifierFactory) {
+  notifierKinds.Lock()
+  defer notifierKinds.Unlock()
+
+  if _, ok := notifierKinds.factories[kind]; ok {
+    panic("watcher: notifier " + kind + " is registered twice")
+  }
+
+  notifierKinds.factories[kind] = factory
+}
+
+// NotifierKinds lists the registered kinds of notifier
+func NotifierKinds() []string {
+  notifierKinds.Lock()
+  defer notifierKinds.Unlock()
+
+  kinds := make([]string, 0, len(notifierKinds.factories))
+
+  for kind := range notifierKinds.factories {
+    kinds = append(kinds, kind)
+  }
+
+  sort.Strings(kinds)
+
+  return kinds
+}
+
+// NewNotifier makes a notifier of a registered kind
+func NewNotifier(kind string, options map[string]string) (Notifier, error) {
+  notifierKinds.Lock()
+  factory, ok := notifierKinds.factories[kind]
+  notifierKinds.Unlock()
+
+  if !ok {
+    return nil, fmt.Errorf("unknown notifier %q, one of %s", kind, strings.Join(NotifierKinds(), ", "))
+  }
+
+  n, err := factory(options)
+
+  if err != nil {
+    return nil, fmt.Errorf("notifier %s: %s", kind, err)
+  }
+
+  return n, nil
+}
+
+// ParseNotifiers makes the notifiers of a spec like
+//
+//	log; webhook url=https://example.com/hook; exec command="/bin/notify --all"
+//
+// each one its kind followed by its options, separated by semicolons.
+// Values with spaces are double quoted
+func ParseNotifiers(spec string) ([]Notifier, error) {
+  var notifiers []Notifier
+
+  for _, entry := range strings.Split(spec, ";") {
+    fields, err := SplitQuoted(entry)
+
+    if err != nil {
+      return nil, err
+    }
+
+    if len(fields) == 0 {
+      continue
+    }
+
+    options := make(map[string]string)
+
+    for _, field := range fields[1:] {
+      key, value, ok := strings.Cut(field, "=")
+
+      if !ok {
+        return nil, fmt.Errorf("notifier %s: option %q is not key=value", fields[0], field)
+      }
+
+      options[key] = value
+    }
+
+    n, err := NewNotifier(fields[0], options)
+
+    if err != nil {
+      return nil, err
+    }
+
+    notifiers = append(notifiers, n)
+  }
+
+  return notifiers, nil
+}
+
+// SplitQuoted splits s at spaces outside double quotes, dropping the quotes,
+// so a command can be "/path/with spaces/hook" --flag
+func SplitQuoted(s string) ([]string, error) {
+  var fields []string
+  var field strings.Builder
+  quoted, started := false, false
+
+  for _, r := range s {
+    switch {
+    case r == '"':
+      quoted, started = !quoted, true
+    case (r == ' ' || r == '\t') && !quoted:
+      if started {
+        fields = append(fields, field.String())
+        field.Reset()
+        started = false
+      }
+    default:
+      field.WriteRune(r)
+      started = true
+    }
+  }
+
+  if quoted {
+    return nil, fmt.Errorf("unterminated quote in %q", strings.TrimSpace(s))
+  }
+
+  if started {
+    fields = append(fields, field.String())
+  }
+
+  return fields, nil
+}
+
+// unknownOptions rejects options a notifier does not take
+func unknownOptions(options map[string]string, known ...string) error {
+  for key := range options {
+    found := false
+
+    for _, k := range known {
+      found = found || k == key
+    }
+
+    if !found {
+      return fmt.Errorf("unknown option %q", key)
+    }
+  }
+
+  return nil
+}
+
+func init() {
+  RegisterNotifier("log", newLogNotifier)
+  RegisterNotifier("webhook", newWebhookKind)
+  RegisterNotifier("exec", newExecNotifier)
+  RegisterNotifier("plugin", newPluginNotifier)
+}
+
+// EventNotifier makes a Notifier of an EventHandler, it gets every event
+func EventNotifier(h EventHandler) Notifier {
+  return eventNotifier{h}
+}
+
+type eventNotifier struct {
+  h EventHandler
+}
+
+func (n eventNotifier) JobQueued(ev JobEvent)   { n.h.HandleEvent(ev) }
+func (n eventNotifier) JobStarted(ev JobEvent)  { n.h.HandleEvent(ev) }
+func (n eventNotifier) JobFinished(ev JobEvent) { n.h.HandleEvent(ev) }
+func (n eventNotifier) JobFailed(ev JobEvent)   { n.h.HandleEvent(ev) }
+
+// webhook url=... POSTs every event, queued and started ones too
+func newWebhookKind(options map[string]string) (Notifier, error) {
+  if err := unknownOptions(options, "url"); err != nil {
+    return nil, err
+  }
+
+  if options["url"] == "" {
+    return nil, fmt.Errorf("url is required")
+  }
+
+  return EventNotifier(NewWebhookNotifier(options["url"])), nil
+}
+
+// logNotifier logs each event in the main log at level, default info,
+// failures as errors
+type logNotifier struct {
+  level slog.Level
+}
+
+// log [level=info]
+func newLogNotifier(options map[string]string) (Notifier, error) {
+  if err := unknownOptions(options, "level"); err != nil {
+    return nil, err
+  }
+
+  n := &logNotifier{level: slog.LevelInfo}
+
+  if level, ok := options["level"]; ok {
+    if err := n.level.UnmarshalText([]byte(level)); err != nil {
+      return nil, fmt.Errorf("level must be debug, info, warn or error, not %q", level)
+    }
+  }
+
+  return n, nil
+}
+
+func (n *logNotifier) log(level slog.Level, ev JobEvent) {
+  attrs := []any{"event", ev.Event, "job", ev.JobID, "input", ev.Input}
+
+  if ev.Output != "" {
+    attrs = append(attrs, "output", ev.Output)
+  }
+
+  if ev.Error != "" {
+    attrs = append(attrs, "error", ev.Error)
+  }
+
+  slog.Log(context.Background(), level, "Job "+ev.Event, attrs...)
+}
+
+func (n *logNotifier) JobQueued(ev JobEvent)   { n.log(n.level, ev) }
+func (n *logNotifier) JobStarted(ev JobEvent)  { n.log(n.level, ev) }
+func (n *logNotifier) JobFinished(ev JobEvent) { n.log(n.level, ev) }
+func (n *logNotifier) JobFailed(ev JobEvent)   { n.log(max(n.level, slog.LevelError), ev) }
+
+// execTimeout bounds a script run for an event
+const execTimeout = time.Minute
+
+// execNotifier runs a script for each event in the background, with the
+// event as JSON on stdin and GOWATCHER_EVENT, GOWATCHER_JOB_ID,
+// GOWATCHER_JOB_UID, GOWATCHER_INPUT, GOWATCHER_OUTPUT and GOWATCHER_ERROR
+// set. events limits it to some of queued, started, finished and failed
+type execNotifier struct {
+  command []string
+  events  map[string]bool
+}
+
+// exec command="script args" [events=finished,failed]
+func newExecNotifier(options map[string]string) (Notifier, error) {
+  if err := unknownOptions(options, "command", "events"); err != nil {
+    return nil, err
+  }
+
+  command := strings.Fields(options["command"])
+
+  if len(command) == 0 {
+    return nil, fmt.Errorf("command is required")
+  }
+
+  events, err := notifierEvents(options["events"])
+
+  if err != nil {
+    return nil, err
+  }
+
+  return &execNotifier{command: command, events: events}, nil
+}
+
+// notifierEvents parses an events option, empty is every event
+func notifierEvents(value string) (map[string]bool, error) {
+  events := map[string]bool{"queued": true, "started": true, "finished": true, "failed": true}
+
+  if value == "" {
+    return events, nil
+  }
+
+  chosen := make(map[string]bool)
+
+  for _, event := range strings.Split(value, ",") {
+    if !events[event] {
+      return nil, fmt.Errorf("events are queued, started, finished and failed, not %q", event)
+    }
+
+    chosen[event] = true
+  }
+
+  return chosen, nil
+}
+
+func (n *execNotifier) run(ev JobEvent) {
+  if !n.events[ev.Event] {
+    return
+  }
+
+  body, err := json.Marshal(ev)
+
+  if err != nil {
+    return
+  }
+
+  go func() {
+    ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, n.command[0], n.command[1:]...)
+    cmd.Stdin = strings.NewReader(string(body))
+    cmd.Env = append(os.Environ(),
+      "GOWATCHER_EVENT="+ev.Event,
+      "GOWATCHER_JOB_ID="+strconv.FormatInt(ev.JobID, 10),
+      "GOWATCHER_JOB_UID="+ev.JobUID,
+      "GOWATCHER_INPUT="+ev.Input,
+      "GOWATCHER_OUTPUT="+ev.Output,
+      "GOWATCHER_ERROR="+ev.Error)
+
+    if out, err := cmd.CombinedOutput(); err != nil {
+      slog.Error("Notifier script failed", "command", n.command[0], "event", ev.Event, "job", ev.JobID, "error", err, "output", lastLine(out))
+    }
+  }()
+}
+
+func (n *execNotifier) JobQueued(ev JobEvent)   { n.run(ev) }
+func (n *execNotifier) JobStarted(ev JobEvent)  { n.run(ev) }
+func (n *execNotifier) JobFinished(ev JobEvent) { n.run(ev) }
+func (n *execNotifier) JobFailed(ev JobEvent)   { n.run(ev) }
+
+// plugin timings: how soon a plugin that exited is started again, and how
+// long it has to exit once its stdin is closed on shutdown
+const (
+  pluginRestart = 10 * time.Second
+  pluginClose   = 5 * time.Second
+)
+
+// pluginNotifier runs an external notifier as a long lived subprocess
+// speaking JSON lines over stdio. gowatcher writes
+//
+//	{"type": "init", "options": {...}}                 once it starts
+//	{"type": "job_queued", "event": {...}}             and job_started,
+//	                                                   job_finished, job_failed
+//
+// to its stdin, the event a JobEvent. It may write
+//
+//	{"level": "info", "message": "..."}
+//
+// lines to stdout, which go to the main log like its stderr. A plugin that
+// exits is started again for a later event, events are dropped meanwhile
+// and while it falls behind by more than streamBuffer
+type pluginNotifier struct {
+  command []string
+  options map[string]string
+  events  chan pluginMessage
+
+  once sync.Once
+  done chan struct{}
+}
+
+// pluginMessage is a line written to a plugin
+type pluginMessage struct {
+  Type    string            `json:"type"`
+  Options map[string]string `json:"options,omitempty"`
+  Event   *JobEvent         `json:"event,omitempty"`
+}
+
+// plugin command="notifier args" [other options passed on to it]
+func newPluginNotifier(options map[string]string) (Notifier, error) {
+  command := strings.Fields(options["command"])
+
+  if len(command) == 0 {
+    return nil, fmt.Errorf("command is required")
+  }
+
+  if _, err := exec.LookPath(command[0]); err != nil {
+    return nil, err
+  }
+
+  passed := make(map[string]string)
+
+  for key, value := range options {
+    if key != "command" {
+      passed[key] = value
+    }
+  }
+
+  n := &pluginNotifier{command: command, options: passed, events: make(chan pluginMessage, streamBuffer), done: make(chan struct{})}
+
+  go n.run()
+
+  return n, nil
+}
+
+func (n *pluginNotifier) send(kind string, ev JobEvent) {
+  select {
+  case n.events <- pluginMessage{Type: kind, Event: &ev}:
+  default:
+    slog.Warn("Notifier plugin is behind, dropping event", "plugin", n.command[0], "event", ev.Event, "job", ev.JobID)
+  }
+}
+
+func (n *pluginNotifier) JobQueued(ev JobEvent)   { n.send("job_queued", ev) }
+func (n *pluginNotifier) JobStarted(ev JobEvent)  { n.send("job_started", ev) }
+func (n *pluginNotifier) JobFinished(ev JobEvent) { n.send("job_finished", ev) }
+func (n *pluginNotifier) JobFailed(ev JobEvent)   { n.send("job_failed", ev) }
+
+// Close ends the plugin once it has been sent what is queued for it
+func (n *pluginNotifier) Close() error {
+  n.once.Do(func() { close(n.events) })
+  <-n.done
+
+  return nil
+}
+
+// run keeps the plugin running and feeds it the events
+func (n *pluginNotifier) run() {
+  defer close(n.done)
+
+  var last time.Time
+
+  for {
+    msg, ok := <-n.events
+
+    if !ok {
+      return
+    }
+
+    if wait := pluginRestart - time.Since(last); !last.IsZero() && wait > 0 {
+      slog.Warn("Notifier plugin exited, dropping event until it restarts", "plugin", n.command[0], "event", msg.Event.Event, "restart_in", wait.Round(time.Second).String())
+      continue
+    }
+
+    last = time.Now()
+
+    if !n.serve(msg) {
+      return
+    }
+  }
+}
+
+// serve starts the plugin and writes it events, the first one msg, until it
+// exits or the events end. It reports whether the events go on
+func (n *pluginNotifier) serve(msg pluginMessage) bool {
+  cmd := exec.Command(n.command[0], n.command[1:]...)
+  stdin, err := cmd.StdinPipe()
+
+  if err != nil {
+    slog.Error("Could not start notifier plugin", "plugin", n.command[0], "error", err)
+    return true
+  }
+
+  stdout, _ := cmd.StdoutPipe()
+  stderr, _ := cmd.StderrPipe()
+
+  if err = cmd.Start(); err != nil {
+    slog.Error("Could not start notifier plugin", "plugin", n.command[0], "error", err)
+    return true
+  }
+
+  slog.Info("Started notifier plugin", "plugin", n.command[0], "pid", cmd.Process.Pid)
+
+  var output sync.WaitGroup
+  output.Add(2)
+
+  go func() {
+    defer output.Done()
+    n.logOutput(stdout, slog.LevelInfo)
+  }()
+
+  go func() {
+    defer output.Done()
+    n.logOutput(stderr, slog.LevelWarn)
+  }()
+
+  exited := make(chan error, 1)
+
+  go func() {
+    output.Wait()
+    exited <- cmd.Wait()
+  }()
+
+  enc := json.NewEncoder(stdin)
+  more := true
+  err = enc.Encode(pluginMessage{Type: "init", Options: n.options})
+
+  for err == nil {
+    if err = enc.Encode(msg); err != nil {
+      break
+    }
+
+    select {
+    case msg, more = <-n.events:
+    case err = <-exited:
+      slog.Error("Notifier plugin exited", "plugin", n.command[0], "error", err)
+      return true
+    }
+
+    if !more {
+      break
+    }
+  }
+
+  stdin.Close()
+
+  if more {
+    slog.Error("Notifier plugin stopped reading", "plugin", n.command[0], "error", err)
+    cmd.Process.Kill()
+    <-exited
+
+    return true
+  }
+
+  select {
+  case <-exited:
+  case <-time.After(pluginClose):
+    cmd.Process.Kill()
+    <-exited
+  }
+
+  return false
+}
+
+// logOutput logs the plugin's lines, JSON ones at their level
+func (n *pluginNotifier) logOutput(r io.Reader, level slog.Level) {
+  scanner := bufio.NewScanner(r)
+
+  for scanner.Scan() {
+    var line struct {
+      Level   string `json:"level"`
+      Message string `json:"message"`
+    }
+
+    msgLevel, msg := level, scanner.Text()
+
+    if json.Unmarshal(scanner.Bytes(), &line) == nil && line.Message != "" {
+      msg = line.Message
+      msgLevel.UnmarshalText([]byte(line.Level))
+    }
+
+    slog.Log(context.Background(), msgLevel, msg, "plugin", n.command[0])
+  }
+}
@@ -0,0 +1,195 @@
+package watcher
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "net/url"
+  "os/exec"
+  "time"
+)
+
+// JobEvent describes a job that finished or failed, it is passed to every
+// EventHandler and is the payload the webhook POSTs. InputBytes and
+// OutputBytes are the sizes before and after the encode.
+//
+// A "stuck" event has no job, Queued jobs have been waiting for
+// DurationSeconds without any job starting, finishing or making progress.
+// Nor has a "queue_full" one, Queued jobs are waiting and Input, the first
+// file left in the queue directory, and those after it wait for room, as
+// with an "intake_paused" one, whose Error says how full the working and
+// finished directories are.
+// "deadline_at_risk" and "deadline_missed" are a job's, Error says when
+// its Deadline is and how it stands.
+// "queue_aging" and "backlog_growing" are the oldest job waiting's, Queued
+// jobs are waiting and it has been for DurationSeconds, Error says how far
+// behind the queue is
+type JobEvent struct {
+  Event           string   `json:"event"`
+  JobID           int64    `json:"job_id"`
+  JobUID          string   `json:"job_uid,omitempty"`
+  Input           string   `json:"input"`
+  Output          string   `json:"output,omitempty"`
+  Outputs         []string `json:"outputs,omitempty"`
+  Uploads         []string `json:"uploads,omitempty"`
+  Thumbnails      []string `json:"thumbnails,omitempty"`
+  InputBytes      int64    `json:"input_bytes,omitempty"`
+  OutputBytes     int64    `json:"output_bytes,omitempty"`
+  Queued          int      `json:"queued,omitempty"`
+  DurationSeconds float64  `json:"duration_seconds"`
+  ExitStatus      int      `json:"exit_status"`
+  Error           string   `json:"error,omitempty"`
+  LogTail         string   `json:"log_tail,omitempty"`
+
+  // Deadline is the job's in "deadline_at_risk" and "deadline_missed"
+  // events, see watchDeadlines
+  Deadline *time.Time `json:"deadline,omitempty"`
+
+  // Degraded is set on a "finished" event when the input was corrupt and
+  // salvaged, tolerant or copy, see Salvage
+  Degraded string `json:"degraded,omitempty"`
+
+  // Failure is the class of a "failed" event's failure, Retries how often
+  // it was retried first, see FailurePolicy
+  Failure FailureClass `json:"failure,omitempty"`
+  Retries int          `json:"retries,omitempty"`
+}
+
+// EventHandler is told about every job that finishes or fails, and when the
+// queue gets stuck. It is called from the worker that ran the job, so
+// handlers that do slow work like network calls should do it in the
+// background
+type EventHandler interface {
+  HandleEvent(ev JobEvent)
+}
+
+// EventHandlerFunc adapts a func to an EventHandler
+type EventHandlerFunc func(ev JobEvent)
+
+func (f EventHandlerFunc) HandleEvent(ev JobEvent) {
+  f(ev)
+}
+
+// logTailBytes is how much of the end of the ffmpeg output is sent with an event
+const logTailBytes = 4096
+
+func newJobEvent(j *Job, err error) JobEvent {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  ev := JobEvent{
+    Event:       "failed",
+    JobID:       j.id,
+    JobUID:      j.uid,
+    Input:       j.input,
+    Outputs:     j.outputs,
+    Uploads:     j.uploads,
+    Thumbnails:  j.thumbnails,
+    InputBytes:  j.inputBytes,
+    OutputBytes: j.outputBytes,
+    ExitStatus:  exitStatus(err),
+    Error:       j.err,
+    Degraded:    j.degraded,
+    Failure:     j.failure,
+    Retries:     j.retries,
+  }
+
+  if j.state == JobDone {
+    ev.Event = "finished"
+  }
+
+  // output is the first output, outputs lists them all for profiles with
+  // several renditions
+  if len(j.outputs) > 0 {
+    ev.Output = j.outputs[0]
+  }
+
+  if !j.startedAt.IsZero() {
+    ev.DurationSeconds = j.finishedAt.Sub(j.startedAt).Seconds()
+  }
+
+  if j.log != nil {
+    tail := j.log.Bytes()
+
+    if len(tail) > logTailBytes {
+      tail = tail[len(tail)-logTailBytes:]
+    }
+
+    ev.LogTail = string(tail)
+  }
+
+  return ev
+}
+
+// exitStatus returns ffmpeg's exit code for err, -1 if it never ran or
+// was killed
+func exitStatus(err error) int {
+  if err == nil {
+    return 0
+  }
+
+  var exitErr *exec.ExitError
+
+  if errors.As(err, &exitErr) {
+    return exitErr.ExitCode()
+  }
+
+  return -1
+}
+
+// WebhookNotifier POSTs job events as JSON to a URL
+type WebhookNotifier struct {
+  url    string
+  client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+  return &WebhookNotifier{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// HandleEvent sends the event in the background, retrying a few times before
+// giving up and logging the failure
+func (n *WebhookNotifier) HandleEvent(ev JobEvent) {
+  body, err := json.Marshal(ev)
+
+  if err != nil {
+    slog.Error("Webhook encode error", "error", err)
+    return
+  }
+
+  go func() {
+    for attempt := 1; attempt <= 3; attempt++ {
+      if err = n.post(body); err == nil {
+        return
+      }
+
+      time.Sleep(time.Duration(attempt) * 5 * time.Second)
+    }
+
+    slog.Error("Webhook failed", "event", ev.Event, "job", ev.JobID, "error", err)
+  }()
+}
+
+// endpoint is where the events are posted, for Doctor
+func (n *WebhookNotifier) endpoint() (*url.URL, error) {
+  return url.Parse(n.url)
+}
+
+func (n *WebhookNotifier) post(body []byte) error {
+  resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+
+  if err != nil {
+    return err
+  }
+
+  resp.Body.Close()
+
+  if resp.StatusCode >= 300 {
+    return fmt.Errorf("status %s", resp.Status)
+  }
+
+  return nil
+}
@@ -0,0 +1,164 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+// OriginalsPolicy is what happens to an input once it has been encoded
+type OriginalsPolicy string
+
+const (
+  // OriginalsDelete removes the input from the queue directory
+  OriginalsDelete OriginalsPolicy = "delete"
+
+  // OriginalsKeep leaves the input in the queue directory. It is not
+  // encoded again while the program runs, but is after a restart unless
+  // the ledger is on
+  OriginalsKeep OriginalsPolicy = "keep"
+
+  // OriginalsArchive moves the input into the originals directory
+  OriginalsArchive OriginalsPolicy = "archive"
+
+  // OriginalsTrash moves the input into the trash, where it can be
+  // restored until TrashRetention deletes it, see Trash
+  OriginalsTrash OriginalsPolicy = "trash"
+)
+
+// archiveDateLayout names the dated subfolders of the originals directory
+const archiveDateLayout = "2006-01-02"
+
+// disposeOriginal applies the originals policy to a successfully encoded
+// input, it returns where the input is now, empty once deleted
+func (e *encoder) disposeOriginal(j *Job) (string, error) {
+  policy := e.originals
+
+  // a resolved link's target is someone else's, only the link goes
+  if j.target != "" && (policy == OriginalsArchive || policy == OriginalsTrash) {
+    policy = OriginalsDelete
+  }
+
+  switch policy {
+  case OriginalsKeep:
+    return j.input, nil
+  case OriginalsArchive:
+    dir := e.originalsDir
+
+    if e.archiveByDate {
+      dir = filepath.Join(dir, time.Now().Format(archiveDateLayout))
+
+      if err := createDir(dir); err != nil {
+        return j.input, err
+      }
+    }
+
+    dest := archivePath(dir, j)
+
+    if err := moveFile(j.input, dest); err != nil {
+      return j.input, err
+    }
+
+    j.logger().Info("Archived original", "to", dest)
+    e.audit.moved(j, j.input, dest, "originals archive")
+
+    if err := moveSpec(j.specPath, dest); err != nil {
+      return dest, err
+    }
+
+    if err := moveChecksum(j.checksumPath, dest); err != nil {
+      return dest, err
+    }
+
+    return dest, moveCompanions(j, j.input, dest)
+  case OriginalsTrash:
+    dest, err := e.trash.put(j)
+
+    if err != nil {
+      return j.input, err
+    }
+
+    j.logger().Info("Moved original to the trash", "to", dest)
+    e.audit.moved(j, j.input, dest, "originals trash")
+
+    return dest, nil
+  default:
+    for _, sidecar := range concat([]string{j.specPath, j.checksumPath}, j.companions) {
+      if sidecar == "" {
+        continue
+      }
+
+      if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+        return j.input, err
+      }
+    }
+
+    e.audit.deleting(j, j.input, "originals delete")
+
+    remove := os.Remove
+
+    // an image sequence goes with its frames
+    if j.sequence != nil && j.target == "" {
+      remove = os.RemoveAll
+    }
+
+    if err := remove(j.input); err != nil {
+      return j.input, err
+    }
+
+    if j.target != "" {
+      j.logger().Info("Removed symlink, its target is kept", "target", j.target)
+    }
+
+    return "", nil
+  }
+}
+
+// moveFailed moves a failed job's input into the failed directory, the job
+// follows it there so it can still be requeued
+func (e *encoder) moveFailed(j *Job) error {
+  // a requeued job failing again is already there
+  if filepath.Dir(j.input) == e.failedDir {
+    return nil
+  }
+
+  input, dest := j.input, archivePath(e.failedDir, j)
+
+  if err := moveInput(j, dest); err != nil {
+    return err
+  }
+
+  j.logger().Info("Moved failed input", "to", dest)
+  e.audit.moved(j, j.input, dest, "failed")
+
+  j.mu.Lock()
+  j.input = dest
+  j.mu.Unlock()
+
+  if err := moveSpec(j.specPath, dest); err != nil {
+    return err
+  }
+
+  if err := moveChecksum(j.checksumPath, dest); err != nil {
+    return err
+  }
+
+  return moveCompanions(j, input, dest)
+}
+
+// archivePath is where the input is archived to in dir, an earlier file of
+// the same name is never overwritten
+func archivePath(dir string, j *Job) string {
+  name := filepath.Base(j.input)
+  dest := filepath.Join(dir, name)
+
+  if _, err := os.Lstat(dest); os.IsNotExist(err) {
+    return dest
+  }
+
+  ext := filepath.Ext(name)
+
+  return filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), j.id, ext))
+}
@@ -0,0 +1,96 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "time"
+)
+
+// OverflowPolicy is what happens to a file found in a queue directory
+// while MaxQueued jobs are already waiting, or an Intake limit is reached.
+// Either way the file stays where it is and is queued by a scan once there
+// is room
+type OverflowPolicy string
+
+const (
+  // OverflowDefer only logs that the queue is full
+  OverflowDefer OverflowPolicy = "defer"
+
+  // OverflowAlert also sends the handlers a "queue_full" event, or an
+  // "intake_paused" one over Intake's MaxUsage, once until the files left
+  // behind have all been queued
+  OverflowAlert OverflowPolicy = "alert"
+)
+
+// overflowCheck is how often a full queue is checked for room
+const overflowCheck = time.Second
+
+// queueFull reports whether MaxQueued jobs are waiting
+func (w *Watcher) queueFull() bool {
+  return w.cfg.MaxQueued > 0 && w.queue.len() >= w.cfg.MaxQueued
+}
+
+// overflow leaves a file in its queue directory for later, telling about
+// it the first time since the last backlog was queued
+func (w *Watcher) overflow(path string) {
+  w.overflowing.Store(true)
+
+  if w.overflowAlerted.Swap(true) {
+    slog.Debug("Queue full, leaving file for later", "input", path)
+    return
+  }
+
+  queued := w.queue.len()
+
+  if !w.queueFull() {
+    w.intakeOverflow(path, queued)
+    return
+  }
+
+  slog.Warn("Queue full, leaving files in the queue directory until there is room", "queued", queued, "max", w.cfg.MaxQueued)
+
+  if w.cfg.Overflow != OverflowAlert {
+    return
+  }
+
+  ev := JobEvent{
+    Event:  "queue_full",
+    Input:  path,
+    Queued: queued,
+    Error:  fmt.Sprintf("%d jobs are waiting, the most allowed, new files stay in the queue directory", queued),
+  }
+
+  for _, h := range w.enc.handlers {
+    h.HandleEvent(ev)
+  }
+}
+
+// drainOverflow scans the queue directories again for the files left there
+// whenever the queue has room and the Intake limits allow, until stop is
+// closed
+func (w *Watcher) drainOverflow(stop <-chan struct{}) {
+  ticker := time.NewTicker(overflowCheck)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+
+    if !w.overflowing.Load() || w.intakeHeld() {
+      continue
+    }
+
+    w.overflowing.Store(false)
+
+    if err := w.scan(); err != nil {
+      slog.Error("Rescan error", "dir", w.queueDir, "error", err)
+    }
+
+    if !w.overflowing.Load() && w.overflowAlerted.Swap(false) {
+      slog.Info("Queued every file left for later")
+    }
+  }
+}
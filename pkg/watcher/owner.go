@@ -0,0 +1,127 @@
+package watcher
+
+import (
+  "fmt"
+  "io/fs"
+  "os"
+  "os/user"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// owner is a user and group looked up from a "user", "user:group" or
+// ":group", an id of -1 is left as it is
+type owner struct {
+  uid    int
+  gid    int
+  groups []uint32
+}
+
+// lookupOwner resolves names or numeric ids. A user without a group gets
+// its login group, and groups are the user's supplementary groups for
+// running ffmpeg as it
+func lookupOwner(spec string) (*owner, error) {
+  name, group, hasGroup := strings.Cut(spec, ":")
+  o := &owner{uid: -1, gid: -1}
+
+  if name != "" {
+    u, err := lookupUser(name)
+
+    if err != nil {
+      return nil, err
+    }
+
+    if o.uid, err = strconv.Atoi(u.Uid); err != nil {
+      return nil, fmt.Errorf("user %s has no numeric id", name)
+    }
+
+    if !hasGroup {
+      o.gid, _ = strconv.Atoi(u.Gid)
+    }
+
+    ids, _ := u.GroupIds()
+
+    for _, id := range ids {
+      if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+        o.groups = append(o.groups, uint32(gid))
+      }
+    }
+  }
+
+  if group != "" {
+    g, err := lookupGroup(group)
+
+    if err != nil {
+      return nil, err
+    }
+
+    if o.gid, err = strconv.Atoi(g.Gid); err != nil {
+      return nil, fmt.Errorf("group %s has no numeric id", group)
+    }
+  }
+
+  if o.uid < 0 && o.gid < 0 {
+    return nil, fmt.Errorf("%q names no user or group", spec)
+  }
+
+  return o, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+  if _, err := strconv.Atoi(name); err == nil {
+    if u, err := user.LookupId(name); err == nil {
+      return u, nil
+    }
+
+    // an id with no passwd entry, as in many containers
+    return &user.User{Uid: name, Gid: "-1"}, nil
+  }
+
+  return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+  if _, err := strconv.Atoi(name); err == nil {
+    return &user.Group{Gid: name}, nil
+  }
+
+  return user.LookupGroup(name)
+}
+
+// chown gives path to the owner, nil leaves it alone
+func (o *owner) chown(path string) error {
+  if o == nil {
+    return nil
+  }
+
+  return os.Lchown(path, o.uid, o.gid)
+}
+
+// setOwnership gives an output, and everything in it when it is a
+// directory, to the owner with mode. A directory gets mode with execute
+// wherever it has read so it can still be listed. Either may be unset
+func setOwnership(path string, o *owner, mode os.FileMode) error {
+  if o == nil && mode == 0 {
+    return nil
+  }
+
+  return filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+    if err != nil {
+      return err
+    }
+
+    if err = o.chown(path); err != nil {
+      return err
+    }
+
+    switch {
+    case mode == 0 || entry.Type()&fs.ModeSymlink != 0:
+      return nil
+    case entry.IsDir():
+      return os.Chmod(path, mode|(mode&0444)>>2)
+    default:
+      return os.Chmod(path, mode)
+    }
+  })
+}
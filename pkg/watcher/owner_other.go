@@ -0,0 +1,16 @@
+//go:build !unix
+
+package watcher
+
+import (
+  "errors"
+  "os/exec"
+)
+
+// canRunAs always fails, running ffmpeg as another user needs Unix
+func (o *owner) canRunAs() error {
+  return errors.New("not supported on this platform")
+}
+
+// runAs does nothing here, see canRunAs
+func (o *owner) runAs(cmd *exec.Cmd) {}
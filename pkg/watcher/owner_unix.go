@@ -0,0 +1,37 @@
+//go:build unix
+
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "os/exec"
+  "syscall"
+)
+
+// canRunAs reports why ffmpeg cannot be started as o, it needs a user and
+// group and only root can start it as another user
+func (o *owner) canRunAs() error {
+  if o.uid < 0 || o.gid < 0 {
+    return fmt.Errorf("needs a user and a group")
+  }
+
+  if euid := os.Geteuid(); euid != 0 && euid != o.uid {
+    return fmt.Errorf("gowatcher is not running as root")
+  }
+
+  return nil
+}
+
+// runAs starts cmd as the owner, nil leaves it as gowatcher's user
+func (o *owner) runAs(cmd *exec.Cmd) {
+  if o == nil {
+    return
+  }
+
+  if cmd.SysProcAttr == nil {
+    cmd.SysProcAttr = &syscall.SysProcAttr{}
+  }
+
+  cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(o.uid), Gid: uint32(o.gid), Groups: o.groups}
+}
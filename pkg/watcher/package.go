@@ -0,0 +1,251 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// defaultSegmentDuration is the HLS/DASH segment length in seconds when a
+// profile does not set one
+const defaultSegmentDuration = 6
+
+// planPackage encodes every rendition of a packaging profile into a folder
+// named after the input, one subfolder per rendition:
+//
+//	finished/<title>/master.m3u8            hls, lists the renditions
+//	finished/<title>/<rendition>/index.m3u8 and seg_00000.ts...
+//	finished/<title>/manifest.mpd           dash, switches between them
+//	finished/<title>/<rendition>/manifest.mpd and its segments
+//
+// The whole folder is built in working and moved to finished once complete
+func (e *encoder) planPackage(j *Job, probed *probeResult) encodePlan {
+  file := j.source()
+  prof := j.profile
+  base := j.name
+  title := strings.TrimSuffix(base, filepath.Ext(base))
+  packageDir := filepath.Join(e.jobDir(j), title)
+
+  segment := prof.SegmentDuration
+
+  if segment <= 0 {
+    segment = defaultSegmentDuration
+  }
+
+  renditions := e.renditions(j, probed)
+  inputFlags, outputFlags, hardware := e.flags(j, probed)
+  runs := make([]ffmpegRun, 0, len(renditions))
+
+  for i, r := range renditions {
+    dir := filepath.Join(packageDir, r.Name)
+
+    run := ffmpegRun{name: r.Name, dirs: []string{dir}}
+
+    // the package folder is moved as one output
+    if i == 0 {
+      run.outputs = []string{packageDir}
+    }
+
+    run.args = append(run.args, inputFlags...)
+    run.args = append(run.args, "-i", file)
+    run.args = append(run.args, outputFlags...)
+    run.args = append(run.args, r.OutputFlags...)
+
+    switch prof.Packaging {
+    case "dash":
+      run.args = append(run.args,
+        "-f", "dash",
+        "-seg_duration", strconv.Itoa(segment),
+        filepath.Join(dir, "manifest.mpd"),
+      )
+    default:
+      run.args = append(run.args,
+        "-f", "hls",
+        "-hls_time", strconv.Itoa(segment),
+        "-hls_playlist_type", "vod",
+        "-hls_segment_filename", filepath.Join(dir, "seg_%05d.ts"),
+        filepath.Join(dir, "index.m3u8"),
+      )
+    }
+
+    runs = append(runs, run)
+  }
+
+  plan := encodePlan{runs: runs, hardware: hardware}
+
+  switch prof.Packaging {
+  case "hls":
+    var seconds float64
+
+    if probed != nil {
+      seconds = probed.duration().Seconds()
+    }
+
+    plan.finalize = func() error {
+      return writeMasterPlaylist(e.ffprobePath, packageDir, renditions, seconds)
+    }
+  case "dash":
+    plan.finalize = func() error {
+      return writeDASHManifest(packageDir, renditions)
+    }
+  }
+
+  return plan
+}
+
+// writeMasterPlaylist lists every rendition's playlist in master.m3u8. A
+// rendition without a configured bandwidth gets its average bitrate from
+// the size of its segments, its resolution and codecs are read from its
+// first segment with ffprobe
+func writeMasterPlaylist(ffprobePath string, packageDir string, renditions []Rendition, seconds float64) error {
+  var b strings.Builder
+
+  b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+
+  for _, r := range renditions {
+    dir := filepath.Join(packageDir, r.Name)
+    bandwidth := r.Bandwidth
+
+    if bandwidth <= 0 {
+      bandwidth = averageBitrate(dir, seconds)
+    }
+
+    resolution, codecs := r.Resolution, r.Codecs
+
+    if (resolution == "" || codecs == "") && ffprobePath != "" {
+      if probed, err := probe(ffprobePath, filepath.Join(dir, "seg_00000.ts")); err == nil {
+        found, foundCodecs := probed.playlistStreams()
+
+        if resolution == "" {
+          resolution = found
+        }
+
+        if codecs == "" {
+          codecs = foundCodecs
+        }
+      }
+    }
+
+    fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+
+    if resolution != "" {
+      fmt.Fprintf(&b, ",RESOLUTION=%s", resolution)
+    }
+
+    if codecs != "" {
+      fmt.Fprintf(&b, ",CODECS=\"%s\"", codecs)
+    }
+
+    fmt.Fprintf(&b, "\n%s/index.m3u8\n", r.Name)
+  }
+
+  return os.WriteFile(filepath.Join(packageDir, "master.m3u8"), []byte(b.String()), 0644)
+}
+
+// averageBitrate is the bits per second of the files in dir over seconds,
+// HLS requires a bandwidth so 1 is returned when it cannot be worked out
+func averageBitrate(dir string, seconds float64) int64 {
+  entries, err := os.ReadDir(dir)
+
+  if err != nil || seconds <= 0 {
+    return 1
+  }
+
+  var size int64
+
+  for _, entry := range entries {
+    if info, err := entry.Info(); err == nil && !entry.IsDir() {
+      size += info.Size()
+    }
+  }
+
+  if bitrate := int64(float64(size*8) / seconds); bitrate > 0 {
+    return bitrate
+  }
+
+  return 1
+}
+
+// playlistStreams are the resolution of the probed segment's video and its
+// codecs as RFC 6381 has them for the CODECS attribute. The codecs are ""
+// when one of them has no such name here, rather than a wrong list
+func (p *probeResult) playlistStreams() (string, string) {
+  resolution := ""
+  var codecs []string
+
+  for _, s := range p.Streams {
+    if s.CodecType == "video" && s.Disposition.AttachedPic == 0 && resolution == "" && s.Width > 0 {
+      resolution = fmt.Sprintf("%dx%d", s.Width, s.Height)
+    }
+
+    if s.CodecType != "video" && s.CodecType != "audio" {
+      continue
+    }
+
+    codec := s.rfc6381()
+
+    if codec == "" {
+      return resolution, ""
+    }
+
+    codecs = append(codecs, codec)
+  }
+
+  return resolution, strings.Join(codecs, ",")
+}
+
+// avcProfiles are the profile_idc and constraint flags of the H.264
+// profiles ffprobe names
+var avcProfiles = map[string]string{
+  "Constrained Baseline":  "42E0",
+  "Baseline":              "4200",
+  "Main":                  "4D40",
+  "Extended":              "5800",
+  "High":                  "6400",
+  "High 10":               "6E00",
+  "High 4:2:2":            "7A00",
+  "High 4:4:4 Predictive": "F400",
+}
+
+// rfc6381 is the stream's codec as the CODECS attribute names it, "" for
+// one it does not know
+func (s probeStream) rfc6381() string {
+  switch s.CodecName {
+  case "h264":
+    if flags, ok := avcProfiles[s.Profile]; ok && s.Level > 0 {
+      return fmt.Sprintf("avc1.%s%02X", flags, s.Level)
+    }
+  case "hevc":
+    // ffprobe's level is 30 times the level
+    switch {
+    case s.Level <= 0:
+    case s.Profile == "Main":
+      return fmt.Sprintf("hvc1.1.6.L%d.B0", s.Level)
+    case s.Profile == "Main 10":
+      return fmt.Sprintf("hvc1.2.4.L%d.B0", s.Level)
+    }
+  case "aac":
+    switch s.Profile {
+    case "LC":
+      return "mp4a.40.2"
+    case "HE-AAC":
+      return "mp4a.40.5"
+    case "HE-AACv2":
+      return "mp4a.40.29"
+    }
+  case "mp3":
+    return "mp4a.40.34"
+  case "ac3":
+    return "ac-3"
+  case "eac3":
+    return "ec-3"
+  case "opus":
+    return "Opus"
+  case "flac":
+    return "fLaC"
+  }
+
+  return ""
+}
@@ -0,0 +1,398 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "time"
+)
+
+// Step is one command of a profile's pipeline, or the profile's Command. The steps of a job run in
+// order, each after the last succeeded, and the whole chain is the job: one
+// failing fails it and their working files are removed at the end.
+//
+// Command is templated with the output name variables and:
+//
+//	{input}          the job's input
+//	{output}         this step's output in the working directory
+//	{previous}       the previous step's output
+//	{output.NAME}    the output of the earlier step called NAME
+//	{companion.EXT}  the input's companion with the extension EXT, like
+//	                 {companion.srt}, empty without one, see Companions
+//	{working}        the job's own directory in the working directory
+//	{ffmpeg}         the ffmpeg binary, as the first word it runs with
+//	                 progress reporting and the process limits
+//	{ffprobe}        the ffprobe binary
+//	{input_flags}    the profile's input flags, or its hardware variant's
+//	{output_flags}   the profile's output flags, both as separate arguments
+type Step struct {
+  Name    string
+  Command []string
+
+  // Output names the step's output file like an output name template.
+  // Kept outputs are moved to finished as the job's outputs, the others are
+  // scratch files
+  Output string
+  Keep   bool
+
+  // Capture saves the command's "stdout" or "stderr" as its output, e.g.
+  // an analysis pass's report. ffmpeg steps only capture stderr
+  Capture string
+
+  // Validate checks a kept output like an encode's when outputs are
+  // validated, leave it off for thumbnails and checksums
+  Validate bool
+}
+
+// stepVariables are the variables a step command can use besides the output
+// name ones and {output.NAME}
+var stepVariables = map[string]bool{
+  "input":        true,
+  "output":       true,
+  "previous":     true,
+  "working":      true,
+  "ffmpeg":       true,
+  "ffprobe":      true,
+  "input_flags":  true,
+  "output_flags": true,
+}
+
+// stepName is what {output.NAME} can refer to
+var stepName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ffmpegStep reports whether the step runs ffmpeg
+func (s Step) ffmpegStep() bool {
+  return len(s.Command) > 0 && s.Command[0] == "{ffmpeg}"
+}
+
+// pipeline is the profile's steps, or its Command as a single step whose
+// output is named like the profile's output
+func (p *Profile) pipeline() []Step {
+  if len(p.Command) == 0 {
+    return p.Steps
+  }
+
+  output := p.NameTemplate
+
+  if output == "" {
+    output = "{basename}.{ext}"
+  }
+
+  return []Step{{Name: "command", Command: p.Command, Output: output, Keep: true}}
+}
+
+// runsFFmpeg reports whether encoding with the profile needs ffmpeg
+func (p *Profile) runsFFmpeg() bool {
+  steps := p.pipeline()
+
+  if len(steps) == 0 {
+    return true
+  }
+
+  for _, s := range steps {
+    if s.ffmpegStep() {
+      return true
+    }
+  }
+
+  return false
+}
+
+// checkRunnable rejects a profile whose steps could not run, or that needs
+// ffmpeg when there is none
+func (p *Profile) checkRunnable(ffmpegPath string) error {
+  if err := p.checkSteps(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if err := p.checkSplit(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if err := p.checkResume(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if err := p.checkSubtitles(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if err := p.checkDeinterlace(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if err := p.checkAudio(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if err := p.checkDestination(); err != nil {
+    return fmt.Errorf("profile %q: %s", p.Name, err)
+  }
+
+  if p.Watermark != nil {
+    if err := p.Watermark.check(); err != nil {
+      return fmt.Errorf("profile %q: %s", p.Name, err)
+    }
+  }
+
+  if p.Metadata != nil {
+    if err := p.Metadata.checkTags(); err != nil {
+      return fmt.Errorf("profile %q: %s", p.Name, err)
+    }
+  }
+
+  if p.Loudnorm != nil {
+    if err := p.Loudnorm.check(); err != nil {
+      return fmt.Errorf("profile %q: %s", p.Name, err)
+    }
+  }
+
+  if ffmpegPath == "" && p.runsFFmpeg() {
+    return fmt.Errorf("profile %q runs ffmpeg, which was not found", p.Name)
+  }
+
+  return nil
+}
+
+// checkSteps rejects pipelines that could not run
+func (p *Profile) checkSteps() error {
+  steps := p.pipeline()
+
+  if len(steps) == 0 {
+    return nil
+  }
+
+  if len(p.Command) > 0 && len(p.Steps) > 0 {
+    return fmt.Errorf("a profile has either a command or steps")
+  }
+
+  if len(p.Renditions) > 0 || p.Packaging != "" || p.TwoPass || p.SplitLength > 0 || p.hasAudioOutputs() {
+    return fmt.Errorf("steps and commands replace outputs, package, two_pass, split_length and audio outputs")
+  }
+
+  names := make(map[string]bool)
+  kept := false
+
+  for i, s := range steps {
+    if !stepName.MatchString(s.Name) {
+      return fmt.Errorf("step %d needs a name of letters, digits, - and _", i+1)
+    }
+
+    if names[s.Name] {
+      return fmt.Errorf("step names must differ, %q is used twice", s.Name)
+    }
+
+    if len(s.Command) == 0 {
+      return fmt.Errorf("step %q needs a command", s.Name)
+    }
+
+    if err := checkNameTemplate(s.Output); err != nil {
+      return fmt.Errorf("step %q: %s", s.Name, err)
+    }
+
+    switch {
+    case s.Capture != "" && s.Capture != "stdout" && s.Capture != "stderr":
+      return fmt.Errorf("step %q: capture must be stdout or stderr", s.Name)
+    case s.Capture == "stdout" && s.ffmpegStep():
+      return fmt.Errorf("step %q: ffmpeg steps can only capture stderr", s.Name)
+    case (s.Capture != "" || s.Keep) && s.Output == "":
+      return fmt.Errorf("step %q needs an output to capture or keep", s.Name)
+    }
+
+    for _, arg := range s.Command {
+      for _, match := range templateVariable.FindAllStringSubmatch(arg, -1) {
+        name := match[1]
+
+        if step, ok := strings.CutPrefix(name, "output."); ok {
+          if !names[step] {
+            return fmt.Errorf("step %q: {%s} is not an earlier step", s.Name, name)
+          }
+
+          continue
+        }
+
+        if _, ok := strings.CutPrefix(name, "companion."); ok {
+          continue
+        }
+
+        if !nameVariables[name] && !stepVariables[name] {
+          return fmt.Errorf("step %q: unknown variable {%s}", s.Name, name)
+        }
+      }
+    }
+
+    names[s.Name] = true
+    kept = kept || s.Keep
+  }
+
+  if !kept {
+    return fmt.Errorf("at least one step must keep its output")
+  }
+
+  return nil
+}
+
+// planPipeline plans the profile's steps, one run each
+func (e *encoder) planPipeline(j *Job, probed *probeResult) encodePlan {
+  prof := j.profile
+  inputFlags, outputFlags, hardware := e.flags(j, probed)
+
+  vars := prof.nameVars(j.name, Rendition{Name: prof.Name}, probed, j.startedAt)
+  vars["input"] = j.source()
+  vars["working"] = e.jobDir(j)
+  vars["ffmpeg"] = e.ffmpeg(j)
+  vars["ffprobe"] = e.ffprobePath
+
+  if e.companions != nil {
+    for _, ext := range e.companions.Extensions {
+      vars["companion."+ext] = ""
+    }
+  }
+
+  j.mu.Lock()
+  companions := j.companions
+  j.mu.Unlock()
+
+  // movie.srt is picked over movie.en.srt
+  for _, c := range companions {
+    key := "companion." + strings.ToLower(strings.TrimPrefix(filepath.Ext(c), "."))
+
+    if vars[key] == "" || len(c) < len(vars[key]) {
+      vars[key] = c
+    }
+  }
+
+  plan := encodePlan{hardware: hardware}
+
+  for _, s := range prof.pipeline() {
+    out := ""
+
+    if s.Output != "" {
+      out = filepath.Join(e.jobDir(j), expandName(s.Output, vars))
+    }
+
+    vars["output"] = out
+
+    var args []string
+
+    for _, arg := range s.Command {
+      switch arg {
+      case "{input_flags}":
+        args = append(args, inputFlags...)
+      case "{output_flags}":
+        args = append(args, outputFlags...)
+      default:
+        args = append(args, expandName(arg, vars))
+      }
+    }
+
+    run := ffmpegRun{name: s.Name, args: args[1:], capture: s.Capture}
+
+    if !s.ffmpegStep() {
+      run.program = args[0]
+    }
+
+    if s.Capture != "" {
+      run.captureFile = out
+    }
+
+    switch {
+    case s.Keep:
+      run.outputs = []string{out}
+
+      if !s.Validate {
+        plan.unchecked = append(plan.unchecked, out)
+      }
+    case out != "":
+      plan.temp = append(plan.temp, out)
+    }
+
+    plan.runs = append(plan.runs, run)
+
+    vars["previous"] = out
+    vars["output."+s.Name] = out
+  }
+
+  return plan
+}
+
+// runProgram runs a pipeline step that is not ffmpeg, with its output in
+// the job log unless it is captured. Cancelling ctx interrupts it, killing
+// it if it does not exit on its own
+func (e *encoder) runProgram(ctx context.Context, j *Job, run ffmpegRun, output io.Writer) error {
+  fmt.Fprintf(output, "%s %s\n\n", run.program, strings.Join(run.args, " "))
+
+  // a checksum or upload makes no ffmpeg progress for the stall watchdog
+  j.mu.Lock()
+  j.progress = nil
+  j.mu.Unlock()
+
+  cmd := exec.Command(run.program, run.args...)
+  cmd.Stdout = output
+  cmd.Stderr = output
+
+  if env := j.env(); len(env) > 0 {
+    cmd.Env = append(os.Environ(), env...)
+  }
+
+  if run.captureFile != "" {
+    f, err := os.Create(run.captureFile)
+
+    if err != nil {
+      return err
+    }
+
+    defer f.Close()
+
+    if run.capture == "stdout" {
+      cmd.Stdout = f
+    } else {
+      cmd.Stderr = io.MultiWriter(f, output)
+    }
+  }
+
+  prepareInterrupt(cmd)
+  prepareChild(cmd)
+
+  cleanup, err := e.limits.start(j, cmd)
+
+  if err != nil {
+    return err
+  }
+
+  defer cleanup()
+  defer e.startedChild(j, cmd.Process, run.program)()
+
+  exited := make(chan struct{})
+
+  go func() {
+    select {
+    case <-ctx.Done():
+      if err := interrupt(cmd.Process); err != nil {
+        _ = cmd.Process.Kill()
+        return
+      }
+
+      select {
+      case <-exited:
+      case <-time.After(killGrace):
+        _ = cmd.Process.Kill()
+      }
+    case <-exited:
+    }
+  }()
+
+  err = cmd.Wait()
+  close(exited)
+
+  if err == nil && ctx.Err() != nil {
+    return ctx.Err()
+  }
+
+  return err
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package watcher
+
+import (
+  "errors"
+  "os"
+  "os/exec"
+  "syscall"
+)
+
+// prepareInterrupt readies a command for interrupt before it starts,
+// nothing is needed outside Windows
+func prepareInterrupt(cmd *exec.Cmd) {}
+
+// interrupt asks a process to stop, ffmpeg finishes the file it is writing
+// and exits
+func interrupt(p *os.Process) error {
+  return p.Signal(os.Interrupt)
+}
+
+// crossDevice reports whether a rename failed because the paths are on
+// different filesystems
+func crossDevice(err error) bool {
+  return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,45 @@
+package watcher
+
+import (
+  "errors"
+  "os"
+  "os/exec"
+  "syscall"
+)
+
+// ctrlBreakEvent is the console event a process group can be sent, and
+// errorNotSameDevice what a rename across volumes fails with
+const (
+  ctrlBreakEvent     = 1
+  errorNotSameDevice = syscall.Errno(17)
+)
+
+var generateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// prepareInterrupt starts the command in a process group of its own, so
+// interrupt can reach it alone and a Ctrl+C in gowatcher's console is left
+// to gowatcher's shutdown rather than stopping every encode at once
+func prepareInterrupt(cmd *exec.Cmd) {
+  if cmd.SysProcAttr == nil {
+    cmd.SysProcAttr = &syscall.SysProcAttr{}
+  }
+
+  cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// interrupt sends the process's group a Ctrl+Break, which ffmpeg handles
+// like Ctrl+C. There is no console to send it on when running as a service,
+// then it fails and the caller kills the process
+func interrupt(p *os.Process) error {
+  if ok, _, err := generateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(p.Pid)); ok == 0 {
+    return err
+  }
+
+  return nil
+}
+
+// crossDevice reports whether a rename failed because the paths are on
+// different volumes
+func crossDevice(err error) bool {
+  return errors.Is(err, errorNotSameDevice) || errors.Is(err, syscall.EXDEV)
+}
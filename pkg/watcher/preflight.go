@@ -0,0 +1,318 @@
+package watcher
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  defaultIdetFrames = 500
+
+  // idetTimeout is how long idet may take over its frames
+  idetTimeout = 2 * time.Minute
+
+  // preflightSuffix is added to the job's log name for its report
+  preflightSuffix = ".preflight.json"
+)
+
+// Preflight reports on every input before it is encoded: its container,
+// duration and bit rate, each stream's codec, resolution, frame rate and
+// channel layout, and whether ffmpeg's idet filter finds the video
+// interlaced. The report is written next to the job's log as
+// <ulid>-<name>.preflight.json, pruned with it, and served at
+// /jobs/{id}/preflight. Routes go by its interlace facts, see Route. It
+// needs ffprobe
+type Preflight struct {
+  // IdetFrames is how many frames idet looks at, default 500, a negative
+  // number leaves idet out
+  IdetFrames int
+}
+
+// PreflightReport is what a pre-flight found out about an input
+type PreflightReport struct {
+  Input           string    `json:"input"`
+  Size            int64     `json:"size"`
+  ModTime         time.Time `json:"mod_time"`
+  Container       string    `json:"container"`
+  DurationSeconds float64   `json:"duration_seconds"`
+  Bitrate         int64     `json:"bitrate,omitempty"`
+
+  Video     []PreflightVideo `json:"video,omitempty"`
+  Audio     []PreflightAudio `json:"audio,omitempty"`
+  Subtitles int              `json:"subtitles,omitempty"`
+
+  // Interlace is idet's count of the first video stream's frames, nil
+  // when it did not run
+  Interlace *Interlace `json:"interlace,omitempty"`
+
+  At time.Time `json:"at"`
+}
+
+// PreflightVideo is a video stream of the input, FieldOrder is ffprobe's:
+// progressive, tt, bb, tb, bt or unknown
+type PreflightVideo struct {
+  Codec      string  `json:"codec"`
+  Width      int     `json:"width,omitempty"`
+  Height     int     `json:"height,omitempty"`
+  FrameRate  float64 `json:"frame_rate,omitempty"`
+  PixFmt     string  `json:"pix_fmt,omitempty"`
+  FieldOrder string  `json:"field_order,omitempty"`
+  Bitrate    int64   `json:"bitrate,omitempty"`
+}
+
+// PreflightAudio is an audio stream of the input
+type PreflightAudio struct {
+  Codec         string `json:"codec"`
+  Channels      int    `json:"channels,omitempty"`
+  ChannelLayout string `json:"channel_layout,omitempty"`
+  SampleRate    int    `json:"sample_rate,omitempty"`
+  Language      string `json:"language,omitempty"`
+  Bitrate       int64  `json:"bitrate,omitempty"`
+}
+
+// Interlace is idet's multi frame detection: how many frames it found top
+// or bottom field first, progressive and undetermined, and in how many a
+// field repeated the one before. Interlaced is set when more were
+// interlaced than progressive, FieldOrder is then tt or bb, else
+// progressive. Telecined is set when at least a fifth of the frames
+// repeated a field, as 3:2 pulldown does in two frames out of five
+type Interlace struct {
+  TFF          int    `json:"tff"`
+  BFF          int    `json:"bff"`
+  Progressive  int    `json:"progressive"`
+  Undetermined int    `json:"undetermined"`
+  Repeated     int    `json:"repeated"`
+  Interlaced   bool   `json:"interlaced"`
+  Telecined    bool   `json:"telecined"`
+  FieldOrder   string `json:"field_order"`
+}
+
+// idetSummary and idetRepeated match the counts idet prints when ffmpeg is
+// done
+var (
+  idetSummary  = regexp.MustCompile(`Multi frame detection:\s*TFF:\s*(\d+)\s*BFF:\s*(\d+)\s*Progressive:\s*(\d+)\s*Undetermined:\s*(\d+)`)
+  idetRepeated = regexp.MustCompile(`Repeated Fields:\s*Neither:\s*(\d+)\s*Top:\s*(\d+)\s*Bottom:\s*(\d+)`)
+)
+
+// preflightJob reports on the job's input, unless it has not changed since
+// the job's last report. A report that cannot be made is logged, the job
+// goes on without
+func (e *encoder) preflightJob(j *Job) {
+  if e.preflight == nil || e.ffprobePath == "" {
+    return
+  }
+
+  file := j.source()
+  logger := j.logger()
+
+  var size int64
+  var modTime time.Time
+
+  if info, err := os.Stat(file); err == nil {
+    size, modTime = info.Size(), info.ModTime()
+  }
+
+  j.mu.Lock()
+  last := j.preflight
+  j.mu.Unlock()
+
+  if last != nil && last.Size == size && last.ModTime.Equal(modTime) {
+    return
+  }
+
+  probed, err := probe(e.ffprobePath, file, j.sequenceFlags()...)
+
+  if err != nil {
+    logger.Warn("Could not probe input for its pre-flight report", "error", err)
+    return
+  }
+
+  report := newPreflightReport(j.input, probed)
+  report.Size, report.ModTime = size, modTime
+
+  frames := e.preflight.IdetFrames
+
+  if frames == 0 {
+    frames = defaultIdetFrames
+  }
+
+  if frames > 0 && len(probed.videoStreams()) > 0 {
+    if probed.interlace, err = e.detectInterlace(j, file, frames); err != nil {
+      logger.Warn("Could not detect interlacing", "error", err)
+    }
+
+    report.Interlace = probed.interlace
+  }
+
+  j.mu.Lock()
+  j.preflight = &report
+  j.probed = probed
+  j.mu.Unlock()
+
+  logger.Info("Pre-flight", preflightAttrs(report)...)
+
+  data, _ := json.MarshalIndent(report, "", "  ")
+  path := filepath.Join(e.logs.dir, fmt.Sprintf("%s-%s%s", j.uid, filepath.Base(j.input), preflightSuffix))
+
+  if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+    logger.Warn("Could not write pre-flight report", "error", err)
+  }
+}
+
+// newPreflightReport is the report of an input from ffprobe's
+func newPreflightReport(input string, probed *probeResult) PreflightReport {
+  report := PreflightReport{
+    Input:           input,
+    Container:       probed.Format.FormatName,
+    DurationSeconds: probed.duration().Seconds(),
+    Subtitles:       len(probed.streams("subtitle")),
+    At:              time.Now(),
+  }
+
+  report.Bitrate, _ = strconv.ParseInt(probed.Format.BitRate, 10, 64)
+
+  for _, s := range probed.videoStreams() {
+    v := PreflightVideo{Codec: s.CodecName, Width: s.Width, Height: s.Height, FrameRate: parseFrameRate(s.AvgFrameRate), PixFmt: s.PixFmt, FieldOrder: s.FieldOrder}
+    v.Bitrate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+    report.Video = append(report.Video, v)
+  }
+
+  for _, s := range probed.streams("audio") {
+    a := PreflightAudio{Codec: s.CodecName, Channels: s.Channels, ChannelLayout: s.ChannelLayout, Language: s.Tags["language"]}
+    a.SampleRate, _ = strconv.Atoi(s.SampleRate)
+    a.Bitrate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+    report.Audio = append(report.Audio, a)
+  }
+
+  return report
+}
+
+// detectInterlace runs idet over the first frames of the input's first
+// video stream
+func (e *encoder) detectInterlace(j *Job, file string, frames int) (*Interlace, error) {
+  ctx, cancel := context.WithTimeout(e.ctx, idetTimeout)
+  defer cancel()
+
+  args := append([]string{"-hide_banner", "-nostats"}, j.sequenceFlags()...)
+  args = append(args, "-i", file, "-map", "0:v:0", "-vf", "idet", "-frames:v", strconv.Itoa(frames), "-an", "-sn", "-dn", "-f", "null", "-")
+
+  out, err := exec.CommandContext(ctx, e.ffmpeg(j), args...).CombinedOutput()
+
+  if err != nil {
+    return nil, fmt.Errorf("idet: %s: %s", err, lastLine(out))
+  }
+
+  found := idetSummary.FindAllSubmatch(out, -1)
+
+  if len(found) == 0 {
+    return nil, fmt.Errorf("idet printed no frame counts")
+  }
+
+  counts := make([]int, 4)
+
+  for i := range counts {
+    counts[i], _ = strconv.Atoi(string(found[len(found)-1][i+1]))
+  }
+
+  idet := &Interlace{TFF: counts[0], BFF: counts[1], Progressive: counts[2], Undetermined: counts[3], FieldOrder: "progressive"}
+
+  if idet.TFF+idet.BFF > idet.Progressive {
+    idet.Interlaced = true
+    idet.FieldOrder = "tt"
+
+    if idet.BFF > idet.TFF {
+      idet.FieldOrder = "bb"
+    }
+  }
+
+  if found := idetRepeated.FindAllSubmatch(out, -1); len(found) > 0 {
+    repeated := make([]int, 3)
+
+    for i := range repeated {
+      repeated[i], _ = strconv.Atoi(string(found[len(found)-1][i+1]))
+    }
+
+    idet.Repeated = repeated[1] + repeated[2]
+    idet.Telecined = idet.Repeated > 0 && idet.Repeated*5 >= repeated[0]+idet.Repeated
+  }
+
+  return idet, nil
+}
+
+// preflightAttrs sums the report up for the log
+func preflightAttrs(r PreflightReport) []any {
+  attrs := []any{"container", r.Container, "duration", (time.Duration(r.DurationSeconds) * time.Second).String()}
+
+  if r.Bitrate > 0 {
+    attrs = append(attrs, "bitrate", r.Bitrate)
+  }
+
+  if len(r.Video) > 0 {
+    v := r.Video[0]
+    attrs = append(attrs, "video", fmt.Sprintf("%s %dx%d", v.Codec, v.Width, v.Height))
+  }
+
+  if r.Interlace != nil {
+    attrs = append(attrs, "interlaced", r.Interlace.Interlaced, "telecined", r.Interlace.Telecined)
+  }
+
+  layouts := make([]string, 0, len(r.Audio))
+
+  for _, a := range r.Audio {
+    layout := a.ChannelLayout
+
+    if layout == "" {
+      layout = strconv.Itoa(a.Channels) + "ch"
+    }
+
+    layouts = append(layouts, a.Codec+" "+layout)
+  }
+
+  if len(layouts) > 0 {
+    attrs = append(attrs, "audio", strings.Join(layouts, ", "))
+  }
+
+  return attrs
+}
+
+// interlaced reports whether the first video stream is interlaced, by idet
+// when a pre-flight ran it, else by the field order in the container
+func (p *probeResult) interlaced() bool {
+  switch p.fieldOrder() {
+  case "tt", "bb", "tb", "bt":
+    return true
+  }
+
+  return false
+}
+
+// fieldOrder is the first video stream's field order, idet's when a
+// pre-flight ran it, else ffprobe's
+func (p *probeResult) fieldOrder() string {
+  if p.interlace != nil {
+    return p.interlace.FieldOrder
+  }
+
+  if video := p.videoStreams(); len(video) > 0 {
+    return video[0].FieldOrder
+  }
+
+  return ""
+}
+
+// preflightReport is the job's last pre-flight report, nil when there is
+// none
+func (j *Job) preflightReport() *PreflightReport {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  return j.preflight
+}
@@ -0,0 +1,156 @@
+package watcher
+
+import (
+  "encoding/json"
+  "fmt"
+  "os/exec"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// probeResult is the part of ffprobe's JSON report that gowatcher uses
+type probeResult struct {
+  Format  probeFormat   `json:"format"`
+  Streams []probeStream `json:"streams"`
+
+  // interlace is what idet made of the video, when a pre-flight ran it
+  interlace *Interlace
+}
+
+type probeFormat struct {
+  FormatName string `json:"format_name"`
+  Duration   string `json:"duration"`
+  Size       string `json:"size"`
+  BitRate    string `json:"bit_rate"`
+}
+
+type probeStream struct {
+  Index     int    `json:"index"`
+  CodecType string `json:"codec_type"`
+  CodecName string `json:"codec_name"`
+  Width     int    `json:"width,omitempty"`
+  Height    int    `json:"height,omitempty"`
+
+  // AvgFrameRate is a fraction like 30000/1001
+  AvgFrameRate string `json:"avg_frame_rate,omitempty"`
+
+  // Profile and Level are the codec's, like High and 41 for H.264
+  Profile string `json:"profile,omitempty"`
+  Level   int    `json:"level,omitempty"`
+
+  PixFmt        string `json:"pix_fmt,omitempty"`
+  FieldOrder    string `json:"field_order,omitempty"`
+  BitRate       string `json:"bit_rate,omitempty"`
+  Channels      int    `json:"channels,omitempty"`
+  ChannelLayout string `json:"channel_layout,omitempty"`
+  SampleRate    string `json:"sample_rate,omitempty"`
+
+  Tags map[string]string `json:"tags,omitempty"`
+
+  Disposition struct {
+    AttachedPic int `json:"attached_pic"`
+  } `json:"disposition"`
+}
+
+// probe runs ffprobe on a file and parses its report
+func probe(ffprobePath string, file string, inputFlags ...string) (*probeResult, error) {
+  out, err := probeJSON(ffprobePath, file, inputFlags...)
+
+  if err != nil {
+    return nil, err
+  }
+
+  result := &probeResult{}
+
+  if err := json.Unmarshal(out, result); err != nil {
+    return nil, fmt.Errorf("ffprobe %s: could not parse report: %s", file, err)
+  }
+
+  return result, nil
+}
+
+// probeJSON is ffprobe's JSON report of a file's format and streams,
+// inputFlags say how to read it, like an image sequence's
+func probeJSON(ffprobePath string, file string, inputFlags ...string) ([]byte, error) {
+  args := []string{"-v", "error", "-print_format", "json", "-show_format", "-show_streams"}
+  args = append(append(args, inputFlags...), file)
+
+  cmd := exec.Command(ffprobePath, args...)
+
+  out, err := cmd.Output()
+
+  // ffprobe says why on stderr, e.g. Invalid data found when processing input
+  if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+    return nil, fmt.Errorf("ffprobe %s: %s", file, lastLine(exitErr.Stderr))
+  }
+
+  if err != nil {
+    return nil, fmt.Errorf("ffprobe %s: %s", file, err)
+  }
+
+  return out, nil
+}
+
+// duration is the container duration, zero if ffprobe did not report one
+func (p *probeResult) duration() time.Duration {
+  seconds, err := strconv.ParseFloat(strings.TrimSpace(p.Format.Duration), 64)
+
+  if err != nil {
+    return 0
+  }
+
+  return time.Duration(seconds * float64(time.Second))
+}
+
+// streams returns the streams of one codec_type, e.g. "video" or "audio"
+func (p *probeResult) streams(codecType string) []probeStream {
+  streams := make([]probeStream, 0)
+
+  for _, stream := range p.Streams {
+    if stream.CodecType == codecType {
+      streams = append(streams, stream)
+    }
+  }
+
+  return streams
+}
+
+// videoStreams are the video streams that are not cover art
+func (p *probeResult) videoStreams() []probeStream {
+  streams := make([]probeStream, 0)
+
+  for _, stream := range p.streams("video") {
+    if stream.Disposition.AttachedPic == 0 {
+      streams = append(streams, stream)
+    }
+  }
+
+  return streams
+}
+
+// codecsIn reports whether every stream of codecType uses one of the codecs.
+// An empty codec list accepts anything
+func (p *probeResult) codecsIn(codecType string, codecs []string) bool {
+  if len(codecs) == 0 {
+    return true
+  }
+
+  for _, stream := range p.streams(codecType) {
+    if !containsFold(codecs, stream.CodecName) {
+      return false
+    }
+  }
+
+  return true
+}
+
+func containsFold(list []string, value string) bool {
+  for _, item := range list {
+    if strings.EqualFold(item, value) {
+      return true
+    }
+  }
+
+  return false
+}
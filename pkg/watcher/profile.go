@@ -0,0 +1,289 @@
+package watcher
+
+import (
+  "encoding/json"
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Profile is a named set of ffmpeg flags used to encode a job
+type Profile struct {
+  Name        string
+  InputFlags  []string
+  OutputFlags []string
+
+  // Extension replaces the input's extension on the output, which picks the
+  // container ffmpeg writes. Empty keeps the input's extension
+  Extension string
+
+  // NameTemplate names the outputs, e.g. {basename}-{profile}-{date}.{ext},
+  // see naming.go for the variables. Empty names them after the input with
+  // the rendition's suffix and the new extension
+  NameTemplate string
+
+  // With remux codecs set, inputs whose streams already use these codecs
+  // are stream copied into the output container instead of re-encoded
+  RemuxVideoCodecs []string
+  RemuxAudioCodecs []string
+
+  // Renditions are the outputs produced from each input, when there are
+  // none the profile produces a single output from OutputFlags. With
+  // Parallel set they are all written by one ffmpeg, otherwise one after
+  // the other
+  Renditions []Rendition
+  Parallel   bool
+
+  // Packaging is "hls" or "dash" to produce a segmented package per input
+  // instead of single files, see package.go
+  Packaging       string
+  SegmentDuration int
+
+  // SplitLength encodes inputs longer than it and SplitAbove in pieces of
+  // about this length, SplitJobs pieces at a time (default 2), then joins
+  // them and encodes the input's audio in. See split.go
+  SplitLength time.Duration
+  SplitAbove  time.Duration
+  SplitJobs   int
+
+  // ResumeSegment encodes every rendition in segments of this length that
+  // are kept when the encode is cut short, so encoding the input again
+  // carries on after the last one. See resume.go
+  ResumeSegment time.Duration
+
+  // Steps replace the profile's encode with a chain of commands, Command
+  // with a single one, e.g. to run HandBrake or ImageMagick instead of
+  // ffmpeg. See pipeline.go for their variables
+  Steps   []Step
+  Command []string
+
+  // TwoPass runs every rendition as an analysis pass followed by the
+  // encode, for bitrate targeted encodes
+  TwoPass bool
+
+  // AudioOnly leaves the video out of every output, which is named for its
+  // audio codec unless Extension is set. AudioDerivative adds an audio-only
+  // output with these flags next to the others, e.g. a podcast's mp3. See
+  // audio.go
+  AudioOnly       bool
+  AudioDerivative []string
+
+  // Deinterlace is "auto" to deinterlace the inputs idet finds interlaced
+  // with Deinterlacer, yadif by default or bwdif, and inverse telecine the
+  // telecined ones. See deinterlace.go
+  Deinterlace  string
+  Deinterlacer string
+
+  // Watermark overlays an image on the video, see watermark.go
+  Watermark *Watermark
+
+  // Metadata preserves the input's metadata and chapters and sets tags on
+  // the outputs, see metadata.go
+  Metadata *Metadata
+
+  // Subtitles is what happens to the input's subtitles, SubtitleStream
+  // picks the one burnt in, counting from 0. See subtitles.go
+  Subtitles      SubtitleMode
+  SubtitleStream int
+
+  // Loudnorm measures the input's loudness before encoding and normalizes
+  // the audio to its target, see loudnorm.go
+  Loudnorm *Loudnorm
+
+  // Salvage tries a failed encode again when ffmpeg says the input is
+  // corrupt, see salvage.go
+  Salvage *Salvage
+
+  // Hardware lists hardware variants in order of preference, hw is the
+  // first whose encoder works on this machine, see hwaccel.go
+  Hardware []HWVariant
+  hw       *HWVariant
+
+  // Resource is the class the profile's software encodes count against,
+  // e.g. cpu, see Resources. MaxJobs caps the jobs encoding with the
+  // profile at once, zero does not
+  Resource string
+  MaxJobs  int
+
+  // Weight is the profile's share of the workers while jobs of several
+  // profiles wait at the same priority, relative to the others' weights,
+  // default 1. See jobQueue.next
+  Weight int
+
+  // Deadline is how long after being queued a job must be done, e.g. 4h,
+  // zero has none. DeadlineWarning is how long before it, on top of what
+  // the profile's jobs take, a queued job is at risk, default a quarter of
+  // the deadline. See watchDeadlines
+  Deadline        time.Duration
+  DeadlineWarning time.Duration
+
+  // FFmpegPath runs the profile's ffmpeg with another build than the
+  // default, e.g. a nonfree one with libfdk_aac or a nightly with a new
+  // filter, by path or name on PATH. ffmpeg is where it was found, see
+  // checkFFmpeg
+  FFmpegPath string
+  ffmpeg     string
+
+  // LogLevel is the ffmpeg -loglevel of the job's log, MainLogLevel how
+  // much of that also goes to the main log, by default the encoder's
+  LogLevel     string
+  MainLogLevel string
+
+  // Env is set for the profile's ffmpeg, pipeline commands and hooks on
+  // top of gowatcher's own environment, e.g. CUDA_VISIBLE_DEVICES. Values
+  // can use the job's flag variables that need no probe, {slot} pins a job
+  // to the GPU of its resource slot, see flagvars.go
+  Env map[string]string
+
+  // Destination is where the profile's outputs go instead of the finished
+  // directory and the watcher's upload: an absolute path they are moved to,
+  // like a share on another filesystem, or a URL OpenStorage opens they are
+  // written to from the finished directory and then removed from it. The
+  // finished retention and KeepLocal do not apply to a local one
+  Destination string
+}
+
+// checkEnv rejects environment variable names that cannot be set
+func checkEnv(env map[string]string) error {
+  for key := range env {
+    if key == "" || strings.ContainsAny(key, "= \t\n") {
+      return fmt.Errorf("env: %q is not a variable name", key)
+    }
+  }
+
+  return nil
+}
+
+// Rendition is one of several outputs a profile produces from an input
+type Rendition struct {
+  Name        string
+  Suffix      string
+  OutputFlags []string
+  Extension   string
+
+  // Bandwidth (bits/s), resolution (WxH) and codecs, like
+  // "avc1.640028,mp4a.40.2", are advertised in the HLS master playlist.
+  // The resolution and codecs are read from the segments when not set
+  Bandwidth  int64
+  Resolution string
+  Codecs     string
+
+  // AudioOnly leaves the video out, see audio.go
+  AudioOnly bool
+}
+
+// Version is a hash of the settings that change what the profile makes,
+// it changes when they do. How many jobs run at once, where ffmpeg is and
+// what it logs are not among them
+func (p *Profile) Version() string {
+  settings := *p
+  settings.Parallel, settings.SplitJobs, settings.Resource, settings.MaxJobs, settings.Weight = false, 0, "", 0, 0
+  settings.Deadline, settings.DeadlineWarning, settings.Salvage = 0, 0, nil
+  settings.FFmpegPath, settings.LogLevel, settings.MainLogLevel, settings.Env = "", "", "", nil
+
+  data, err := json.Marshal(settings)
+
+  if err != nil {
+    return ""
+  }
+
+  hash := newXXH64()
+  hash.Write(data)
+
+  return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// outputs returns the renditions the profile produces
+func (p *Profile) outputs() []Rendition {
+  renditions := p.Renditions
+
+  if len(renditions) == 0 {
+    renditions = []Rendition{{Name: p.Name}}
+  }
+
+  outputs := make([]Rendition, 0, len(renditions)+1)
+
+  for _, r := range renditions {
+    outputs = append(outputs, p.output(r))
+  }
+
+  if p.AudioDerivative != nil {
+    outputs = append(outputs, p.derivative(outputs))
+  }
+
+  return outputs
+}
+
+// flags returns the input flags and the output flags shared by every
+// rendition, using the hardware variant unless software is set. hardware
+// reports which were chosen
+func (p *Profile) flags(software bool) (input []string, output []string, hardware bool) {
+  if p.hw != nil && !software {
+    return p.hw.InputFlags, p.hw.OutputFlags, true
+  }
+
+  return p.InputFlags, p.OutputFlags, false
+}
+
+// outputName is the file name the profile produces for an input and
+// rendition, at is when the encode started
+func (p *Profile) outputName(input string, r Rendition, probed *probeResult, at time.Time) string {
+  vars := p.nameVars(input, r, probed, at)
+
+  if p.NameTemplate != "" {
+    return expandName(p.NameTemplate, vars)
+  }
+
+  name := vars["basename"] + r.Suffix
+
+  if vars["ext"] != "" {
+    name += "." + vars["ext"]
+  }
+
+  return name
+}
+
+// remuxes reports whether the profile has a remux target configured
+func (p *Profile) remuxes() bool {
+  return len(p.RemuxVideoCodecs) > 0 || len(p.RemuxAudioCodecs) > 0
+}
+
+// compliant reports whether a probed input already matches the remux target
+func (p *Profile) compliant(probed *probeResult) bool {
+  if !p.remuxes() || p.Loudnorm != nil || p.Watermark != nil || p.deinterlaceFilter(probed) != "" || p.hasAudioOutputs() || (p.Subtitles != "" && p.Subtitles != SubtitlesExtract) || len(probed.streams("video"))+len(probed.streams("audio")) == 0 {
+    return false
+  }
+
+  return probed.codecsIn("video", p.RemuxVideoCodecs) && probed.codecsIn("audio", p.RemuxAudioCodecs)
+}
+
+// remuxSubtitles are the subtitle codecs the containers that do not take
+// every one can have copied in, by extension. ffmpeg fails on the others
+var remuxSubtitles = map[string][]string{
+  ".mp4":  {"mov_text"},
+  ".m4v":  {"mov_text"},
+  ".mov":  {"mov_text"},
+  ".webm": {"webvtt"},
+}
+
+// carries reports whether a remux into a container with the extension can
+// copy every stream of the input, its subtitles and attachments like fonts
+// too, with Matroska taking all of them
+func (p *Profile) carries(probed *probeResult, ext string) bool {
+  ext = strings.ToLower(ext)
+
+  if ext != ".mkv" && ext != ".mka" && len(probed.streams("attachment")) > 0 {
+    return false
+  }
+
+  if codecs, ok := remuxSubtitles[ext]; ok && p.Subtitles != SubtitlesExtract {
+    for _, s := range probed.streams("subtitle") {
+      if !containsFold(codecs, s.CodecName) {
+        return false
+      }
+    }
+  }
+
+  return true
+}
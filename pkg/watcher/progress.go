@@ -0,0 +1,144 @@
+package watcher
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// progress holds the state of a single ffmpeg encode as reported on its
+// -progress pipe
+type progress struct {
+  mu        sync.Mutex
+  startedAt time.Time
+  updatedAt time.Time
+  outTime   time.Duration
+  total     time.Duration
+  speed     string
+  frames    int64
+  done      bool
+}
+
+func newProgress(total time.Duration) *progress {
+  now := time.Now()
+
+  return &progress{startedAt: now, updatedAt: now, total: total}
+}
+
+// idle is how long it has been since out_time last moved forward
+func (p *progress) idle() time.Duration {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  return time.Since(p.updatedAt)
+}
+
+// frameCount is how many frames ffmpeg has written
+func (p *progress) frameCount() int64 {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  return p.frames
+}
+
+// percent returns how far along the encode is, or -1 if the total duration
+// of the input is not known
+func (p *progress) percent() float64 {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.total <= 0 {
+    return -1
+  }
+
+  pct := float64(p.outTime) / float64(p.total) * 100
+
+  if pct > 100 {
+    pct = 100
+  }
+
+  return pct
+}
+
+// eta estimates the time remaining based on the wall clock time spent so far
+func (p *progress) eta() time.Duration {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.total <= 0 || p.outTime <= 0 {
+    return -1
+  }
+
+  fraction := float64(p.outTime) / float64(p.total)
+
+  if fraction >= 1 {
+    return 0
+  }
+
+  elapsed := time.Since(p.startedAt)
+
+  return time.Duration(float64(elapsed) * (1 - fraction) / fraction).Round(time.Second)
+}
+
+// String formats the progress for log lines
+func (p *progress) String() string {
+  pct := p.percent()
+  eta := p.eta()
+
+  p.mu.Lock()
+  outTime := p.outTime.Round(time.Second)
+  speed := p.speed
+  p.mu.Unlock()
+
+  if pct < 0 {
+    return fmt.Sprintf("%s encoded (speed %s)", outTime, speed)
+  }
+
+  if eta < 0 {
+    return fmt.Sprintf("%.1f%% (speed %s)", pct, speed)
+  }
+
+  return fmt.Sprintf("%.1f%% (speed %s, ETA %s)", pct, speed, eta)
+}
+
+// read consumes the key=value lines ffmpeg writes with -progress and updates
+// the progress until the reader is closed
+func (p *progress) read(r io.Reader) {
+  scanner := bufio.NewScanner(r)
+
+  for scanner.Scan() {
+    key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+
+    if !found {
+      continue
+    }
+
+    p.mu.Lock()
+    switch key {
+    // out_time_ms is actually microseconds in ffmpeg's output, same as out_time_us
+    case "out_time_us", "out_time_ms":
+      if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+        outTime := time.Duration(us) * time.Microsecond
+
+        if outTime > p.outTime {
+          p.updatedAt = time.Now()
+        }
+
+        p.outTime = outTime
+      }
+    case "frame":
+      if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+        p.frames = n
+      }
+    case "speed":
+      p.speed = strings.TrimSpace(value)
+    case "progress":
+      p.done = value == "end"
+    }
+    p.mu.Unlock()
+  }
+}
@@ -0,0 +1,133 @@
+package watcher
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "os"
+  "strings"
+)
+
+// errEmpty ends the jobs of zero-byte inputs
+var errEmpty = errors.New("empty file")
+
+// reasonSuffix is added to a rejected input's name for the file saying why
+const reasonSuffix = ".reason.txt"
+
+// notMedia returns why ffprobe's report is not of something ffmpeg can
+// encode, or empty when it is. Still images and text probe fine but have no
+// timeline, ffprobe reads them with the image2, *_pipe and tty formats
+func notMedia(probed *probeResult) string {
+  if len(probed.videoStreams()) == 0 && len(probed.streams("audio")) == 0 {
+    return "no audio or video streams"
+  }
+
+  for _, format := range strings.Split(probed.Format.FormatName, ",") {
+    if format == "image2" || format == "tty" || strings.HasSuffix(format, "_pipe") {
+      return fmt.Sprintf("not a video or audio file, ffprobe reads it as %s", format)
+    }
+  }
+
+  return ""
+}
+
+// checkMedia ends jobs whose input is empty, and with a rejected directory
+// moves inputs ffprobe cannot read as media there, next to a file with the
+// reason. It reports whether the job goes on
+func (e *encoder) checkMedia(j *Job) bool {
+  logger := j.logger()
+
+  if info, err := os.Stat(j.source()); err == nil && info.Size() == 0 && !info.IsDir() {
+    logger.Warn("Skipping empty file")
+    j.finish(JobCancelled, errEmpty)
+    return false
+  }
+
+  if e.rejectedDir == "" || e.ffprobePath == "" {
+    return true
+  }
+
+  var reason string
+
+  if probed, err := probe(e.ffprobePath, j.source(), j.sequenceFlags()...); err != nil {
+    reason = err.Error()
+  } else {
+    reason = notMedia(probed)
+  }
+
+  if reason == "" {
+    return true
+  }
+
+  if e.dryRun {
+    logger.Info("Dry run: would reject input", "reason", reason, "dir", e.rejectedDir)
+    j.finish(JobCancelled, fmt.Errorf("rejected: %s", reason))
+    return false
+  }
+
+  dest := archivePath(e.rejectedDir, j)
+  spec := findSpec(j.input)
+
+  if err := moveInput(j, dest); err != nil {
+    logger.Error("Could not move rejected input", "dir", e.rejectedDir, "error", err)
+    j.finish(JobCancelled, fmt.Errorf("rejected: %s", reason))
+    return false
+  }
+
+  if err := os.WriteFile(dest+reasonSuffix, []byte(reason+"\n"), 0644); err != nil {
+    logger.Warn("Could not write rejection reason", "error", err)
+  }
+
+  logger.Warn("Rejected input, it is not media", "reason", reason, "to", dest)
+  e.audit.moved(j, j.input, dest, "rejected")
+
+  j.mu.Lock()
+  j.input = dest
+  j.mu.Unlock()
+
+  if err := moveSpec(spec, dest); err != nil {
+    logger.Warn("Could not move job spec", "error", err)
+  }
+
+  j.finish(JobCancelled, fmt.Errorf("rejected: %s", reason))
+
+  return false
+}
+
+// quarantine moves a failed job's input to the rejected directory with a
+// .reason.txt, next to anything it came with. log is ffmpeg's output, its
+// last line says why
+func (e *encoder) quarantine(j *Job, class FailureClass, cause error, log []byte) error {
+  input, dest := j.input, archivePath(e.quarantineDir, j)
+
+  if err := moveInput(j, dest); err != nil {
+    return err
+  }
+
+  reason := fmt.Sprintf("%s: %s\n", class, cause)
+
+  if len(bytes.TrimSpace(log)) > 0 {
+    reason += lastLine(log) + "\n"
+  }
+
+  if err := os.WriteFile(dest+reasonSuffix, []byte(reason), 0644); err != nil {
+    j.logger().Warn("Could not write quarantine reason", "error", err)
+  }
+
+  j.logger().Warn("Quarantined failed input", "failure", string(class), "to", dest)
+  e.audit.moved(j, input, dest, "quarantined")
+
+  j.mu.Lock()
+  j.input = dest
+  j.mu.Unlock()
+
+  if err := moveSpec(j.specPath, dest); err != nil {
+    return err
+  }
+
+  if err := moveChecksum(j.checksumPath, dest); err != nil {
+    return err
+  }
+
+  return moveCompanions(j, input, dest)
+}
@@ -0,0 +1,348 @@
+package watcher
+
+import (
+  "sort"
+  "sync"
+  "time"
+)
+
+// jobQueue holds the jobs waiting for a worker, highest priority first and
+// in arrival order within a priority. Workers block in pop while the queue
+// is empty or paused
+type jobQueue struct {
+  mu     sync.Mutex
+  cond   *sync.Cond
+  items  []*Job
+  paused bool
+  closed bool
+
+  // held is set outside the encoding schedule, separately from paused so a
+  // manual pause outlasts the schedule
+  held bool
+
+  // deferred is why only urgent jobs start, see Deferral, "" when all do
+  deferred string
+
+  // resources limits which jobs can start, a job whose classes are full is
+  // passed over for the ones behind it
+  resources *Resources
+
+  // served is each profile's jobs started over its weight, the profile
+  // least served goes first
+  served map[string]float64
+
+  // estimate is how long a job plays for when the shortest waiting jobs go
+  // first, nil in arrival order
+  estimate func(j *Job) time.Duration
+}
+
+func newJobQueue() *jobQueue {
+  q := &jobQueue{served: make(map[string]float64)}
+  q.cond = sync.NewCond(&q.mu)
+
+  return q
+}
+
+func (q *jobQueue) push(j *Job) {
+  // before the lock, ffprobe takes a while. A requeued job keeps its
+  // estimate
+  if q.estimate != nil && j.estimate == 0 {
+    j.estimate = q.estimate(j)
+  }
+
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  if q.closed {
+    return
+  }
+
+  q.catchUp(j)
+
+  // insert after the last job of the same or a higher priority
+  at := len(q.items)
+
+  for at > 0 && q.items[at-1].priority < j.priority {
+    at--
+  }
+
+  q.items = append(q.items, nil)
+  copy(q.items[at+1:], q.items[at:])
+  q.items[at] = j
+  q.cond.Signal()
+}
+
+// pop blocks until a job whose resource slots are free is available and
+// the queue is not paused, the job holds the slots. It returns false once
+// the queue has been closed or when retire, checked whenever the worker
+// wakes, tells it to stop. long, checked along with it, has the worker take
+// the longest job rather than the shortest
+func (q *jobQueue) pop(retire func() bool, long func() bool) (*Job, bool) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  for {
+    if q.closed || retire() {
+      return nil, false
+    }
+
+    if !q.paused && !q.held {
+      if at := q.next(long()); at >= 0 {
+        j := q.items[at]
+        q.items = append(q.items[:at], q.items[at+1:]...)
+
+        return j, true
+      }
+    }
+
+    q.cond.Wait()
+  }
+}
+
+// next is the index of the job to start, whose slots it takes, or -1 when
+// none can. Higher priorities go first. Within a priority it is weighted
+// fair queueing by profile: the first job of the profile that has started
+// the fewest jobs for its weight, so with weights 3 and 1 and jobs of both
+// waiting three of every four that start are the first profile's, and
+// of those the shortest when there is an estimate, or the longest for long.
+// A job whose slots are taken is passed over for the next best
+func (q *jobQueue) next(long bool) int {
+  order := make([]int, len(q.items))
+  served := make([]float64, len(q.items))
+
+  for i, j := range q.items {
+    order[i] = i
+    served[i] = q.served[queueProfile(j).Name]
+  }
+
+  // the items are by priority then arrival already
+  sort.SliceStable(order, func(a, b int) bool {
+    ja, jb := q.items[order[a]], q.items[order[b]]
+
+    if ja.priority != jb.priority {
+      return ja.priority > jb.priority
+    }
+
+    if served[order[a]] != served[order[b]] || q.estimate == nil {
+      return served[order[a]] < served[order[b]]
+    }
+
+    if long {
+      return ja.estimate > jb.estimate
+    }
+
+    return ja.estimate < jb.estimate
+  })
+
+  for _, i := range order {
+    j := q.items[i]
+
+    if q.deferred != "" && j.priority <= PriorityNormal {
+      continue
+    }
+
+    if q.resources != nil {
+      j.mu.Lock()
+      slots := j.profile.slots(!j.software)
+      ok := q.resources.tryAcquire(slots)
+
+      if ok {
+        j.slots = slots
+      }
+
+      j.mu.Unlock()
+
+      if !ok {
+        continue
+      }
+    }
+
+    p := queueProfile(j)
+    q.served[p.Name] += 1 / float64(max(p.Weight, 1))
+
+    return i
+  }
+
+  return -1
+}
+
+// catchUp brings a profile that had no jobs waiting up to the least served
+// of those that have, an idle profile does not bank a share to spend later
+func (q *jobQueue) catchUp(j *Job) {
+  name := queueProfile(j).Name
+  least, waiting := 0.0, false
+
+  for _, item := range q.items {
+    other := queueProfile(item).Name
+
+    if other == name {
+      return
+    }
+
+    if served := q.served[other]; !waiting || served < least {
+      least, waiting = served, true
+    }
+  }
+
+  // with nothing waiting every profile starts even
+  if !waiting {
+    clear(q.served)
+    return
+  }
+
+  q.served[name] = max(q.served[name], least)
+}
+
+// queueProfile is the profile a waiting job is scheduled by
+func queueProfile(j *Job) *Profile {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  return j.profile
+}
+
+// raise moves a waiting job a priority up, ahead of the jobs it waited
+// with, it returns the job's priority and whether it was still waiting
+func (q *jobQueue) raise(j *Job) (int, bool) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  at := -1
+
+  for i, item := range q.items {
+    if item == j {
+      at = i
+      break
+    }
+  }
+
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if at < 0 {
+    return j.priority, false
+  }
+
+  j.priority++
+  q.items = append(q.items[:at], q.items[at+1:]...)
+
+  // after the last job of the same or a higher priority, like push
+  at = len(q.items)
+
+  for at > 0 && q.items[at-1].priority < j.priority {
+    at--
+  }
+
+  q.items = append(q.items, nil)
+  copy(q.items[at+1:], q.items[at:])
+  q.items[at] = j
+  q.cond.Signal()
+
+  return j.priority, true
+}
+
+// close stops the queue from handing out any more jobs, the files waiting
+// stay in the queue directory for the next run
+func (q *jobQueue) close() {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  q.closed = true
+  q.cond.Broadcast()
+}
+
+// remove takes a job out of the queue before a worker gets to it, it
+// returns false if the job was not waiting
+func (q *jobQueue) remove(j *Job) bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  for i, item := range q.items {
+    if item == j {
+      q.items = append(q.items[:i], q.items[i+1:]...)
+      return true
+    }
+  }
+
+  return false
+}
+
+// each calls fn for every waiting job, workers cannot take one meanwhile
+func (q *jobQueue) each(fn func(*Job)) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  for _, j := range q.items {
+    fn(j)
+  }
+}
+
+// wake has every waiting worker check whether it should retire
+func (q *jobQueue) wake() {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  q.cond.Broadcast()
+}
+
+func (q *jobQueue) setPaused(paused bool) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  q.paused = paused
+  q.cond.Broadcast()
+}
+
+// setHeld holds or releases the queue, it reports whether that changed
+func (q *jobQueue) setHeld(held bool) bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  changed := q.held != held
+  q.held = held
+  q.cond.Broadcast()
+
+  return changed
+}
+
+// setDeferred defers the jobs that are not urgent for reason, or starts
+// them with "", it reports whether they were deferred before and are not
+// now or the other way round
+func (q *jobQueue) setDeferred(reason string) bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  changed := (q.deferred == "") != (reason == "")
+  q.deferred = reason
+  q.cond.Broadcast()
+
+  return changed
+}
+
+func (q *jobQueue) deferredFor() string {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  return q.deferred
+}
+
+func (q *jobQueue) isHeld() bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  return q.held
+}
+
+func (q *jobQueue) isPaused() bool {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  return q.paused
+}
+
+func (q *jobQueue) len() int {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+
+  return len(q.items)
+}
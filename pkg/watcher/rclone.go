@@ -0,0 +1,170 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "os/exec"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// RcloneUpload delivers each job's outputs with rclone to any remote it can
+// write to, like Google Drive, B2, WebDAV or Dropbox, once they are in the
+// finished directory. The remotes are set up in rclone's own config. As
+// with S3Upload a job is only done once every output is uploaded
+type RcloneUpload struct {
+  // Destination is remote:path, outputs keep their path relative to the
+  // finished directory under it
+  Destination string
+
+  // Command is the rclone binary, default rclone from PATH. Flags are
+  // added to every call, like --config or --bwlimit
+  Command string
+  Flags   []string
+
+  // DeleteLocal and KeepLocal are as in S3Upload
+  DeleteLocal bool
+  KeepLocal   time.Duration
+}
+
+// rcloneClient copies outputs with rclone copyto, packages with rclone copy
+type rcloneClient struct {
+  cfg RcloneUpload
+
+  // delivery flags, set by New
+  bandwidth int64
+  progress  time.Duration
+}
+
+func newRcloneClient(cfg RcloneUpload) (*rcloneClient, error) {
+  if cfg.Destination == "" {
+    return nil, errors.New("no destination")
+  }
+
+  if cfg.Command == "" {
+    cfg.Command = "rclone"
+  }
+
+  if _, err := exec.LookPath(cfg.Command); err != nil {
+    return nil, err
+  }
+
+  if cfg.DeleteLocal && cfg.KeepLocal > 0 {
+    return nil, errors.New("local outputs cannot be both deleted and kept")
+  }
+
+  return &rcloneClient{cfg: cfg}, nil
+}
+
+func (c *rcloneClient) key(rel string) string {
+  return path.Clean(filepath.ToSlash(rel))
+}
+
+// location is the key under the destination, remote: has no separator
+func (c *rcloneClient) location(key string) string {
+  dest := strings.TrimSuffix(c.cfg.Destination, "/")
+
+  if key == "" || strings.HasSuffix(dest, ":") {
+    return dest + key
+  }
+
+  return dest + "/" + key
+}
+
+func (c *rcloneClient) upload(ctx context.Context, file string, key string, t *transfer) error {
+  return t.retry(func() error { return c.run(ctx, "copyto", file, c.location(key), t) })
+}
+
+// uploadTree resumes with the files not yet copied, rclone skips the rest
+func (c *rcloneClient) uploadTree(ctx context.Context, dir string, key string, t *transfer) error {
+  return t.retry(func() error { return c.run(ctx, "copy", dir, c.location(key), t) })
+}
+
+func (c *rcloneClient) run(ctx context.Context, command string, src string, dst string, t *transfer) error {
+  args := append([]string{command, src, dst}, c.flags()...)
+
+  cmd := exec.CommandContext(ctx, c.cfg.Command, args...)
+  stderr := newTailBuffer(4096)
+  cmd.Stderr = stderr
+
+  if t != nil {
+    cmd.Stderr = io.MultiWriter(stderr, &rcloneStats{t: t})
+  }
+
+  if err := cmd.Run(); err != nil {
+    if ctx.Err() != nil {
+      return ctx.Err()
+    }
+
+    // the last line says why, the ones before are retries of it
+    lines := strings.Split(string(bytes.TrimSpace(stderr.Bytes())), "\n")
+
+    if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+      return fmt.Errorf("rclone %s: %s: %s", command, err, last)
+    }
+
+    return fmt.Errorf("rclone %s: %s", command, err)
+  }
+
+  return nil
+}
+
+// flags are the configured flags with the delivery's bandwidth limit and
+// one line stats, unless the configured ones set them
+func (c *rcloneClient) flags() []string {
+  var flags []string
+  set := strings.Join(c.cfg.Flags, " ")
+
+  if c.bandwidth > 0 && !strings.Contains(set, "--bwlimit") {
+    flags = append(flags, "--bwlimit", strconv.FormatInt(c.bandwidth, 10)+"B")
+  }
+
+  if c.progress > 0 && !strings.Contains(set, "--stats") {
+    flags = append(flags, "--stats", c.progress.String(), "--stats-one-line", "--stats-log-level", "NOTICE")
+  }
+
+  return append(flags, c.cfg.Flags...)
+}
+
+// rcloneStats logs the stats lines rclone writes to stderr, like
+// "NOTICE: 1.2 GiB / 10 GiB, 12%, 10 MiB/s, ETA 15m"
+type rcloneStats struct {
+  t       *transfer
+  partial []byte
+  last    string
+}
+
+func (s *rcloneStats) Write(p []byte) (int, error) {
+  s.partial = append(s.partial, p...)
+
+  for {
+    i := bytes.IndexByte(s.partial, '\n')
+
+    if i < 0 {
+      break
+    }
+
+    line := string(s.partial[:i])
+    s.partial = s.partial[i+1:]
+
+    if _, stats, ok := strings.Cut(line, "NOTICE: "); ok && strings.Contains(stats, "ETA") {
+      stats = strings.TrimSpace(stats)
+
+      // the same stats again is a stalled copy
+      if stats != s.last {
+        s.last = stats
+        s.t.alive()
+      }
+
+      s.t.logger.Info("Delivering", "output", s.t.output, "to", s.t.to, "rclone", stats)
+    }
+  }
+
+  return len(p), nil
+}
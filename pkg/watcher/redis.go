@@ -0,0 +1,280 @@
+package watcher
+
+import (
+  "bufio"
+  "context"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "net/url"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+  return string(e)
+}
+
+// redisConn is a connection to Redis speaking RESP2, one command at a time.
+// It reconnects on the next command after a network error
+type redisConn struct {
+  url *url.URL
+
+  mu   sync.Mutex
+  conn net.Conn
+  r    *bufio.Reader
+}
+
+// redisTimeout bounds every command, blocking ones get their block added
+const redisTimeout = 30 * time.Second
+
+func newRedisConn(rawURL string) (*redisConn, error) {
+  u, err := url.Parse(rawURL)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if u.Scheme != "redis" && u.Scheme != "rediss" {
+    return nil, fmt.Errorf("unsupported URL %q, use redis:// or rediss://", rawURL)
+  }
+
+  if u.Hostname() == "" {
+    return nil, fmt.Errorf("no host in %q", rawURL)
+  }
+
+  if db := strings.Trim(u.Path, "/"); db != "" {
+    if _, err = strconv.Atoi(db); err != nil {
+      return nil, fmt.Errorf("database %q is not a number", db)
+    }
+  }
+
+  return &redisConn{url: u}, nil
+}
+
+// location is the server without its password, for logs
+func (c *redisConn) location() string {
+  return redactURL(c.url)
+}
+
+// connect dials, authenticates and selects the database
+func (c *redisConn) connect(ctx context.Context) error {
+  host := c.url.Host
+
+  if c.url.Port() == "" {
+    host = net.JoinHostPort(c.url.Hostname(), "6379")
+  }
+
+  dialer := &net.Dialer{Timeout: redisTimeout}
+  var conn net.Conn
+  var err error
+
+  if c.url.Scheme == "rediss" {
+    conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: c.url.Hostname()}}).DialContext(ctx, "tcp", host)
+  } else {
+    conn, err = dialer.DialContext(ctx, "tcp", host)
+  }
+
+  if err != nil {
+    return err
+  }
+
+  c.conn, c.r = conn, bufio.NewReader(conn)
+
+  if password, ok := c.url.User.Password(); ok {
+    args := []string{"AUTH", password}
+
+    if user := c.url.User.Username(); user != "" {
+      args = []string{"AUTH", user, password}
+    }
+
+    if _, err = c.roundTrip(0, args); err != nil {
+      c.reset()
+      return fmt.Errorf("auth: %s", err)
+    }
+  }
+
+  if db := strings.Trim(c.url.Path, "/"); db != "" && db != "0" {
+    if _, err = c.roundTrip(0, []string{"SELECT", db}); err != nil {
+      c.reset()
+      return fmt.Errorf("select %s: %s", db, err)
+    }
+  }
+
+  return nil
+}
+
+func (c *redisConn) reset() {
+  if c.conn != nil {
+    c.conn.Close()
+  }
+
+  c.conn, c.r = nil, nil
+}
+
+// do runs a command and returns its reply: a string, an int64, a []any,
+// or nil. block is how long the command may wait on the server. Closing
+// ctx interrupts it
+func (c *redisConn) do(ctx context.Context, block time.Duration, args ...string) (any, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  if c.conn == nil {
+    if err := c.connect(ctx); err != nil {
+      return nil, err
+    }
+  }
+
+  conn := c.conn
+  stop := context.AfterFunc(ctx, func() {
+    conn.SetDeadline(time.Now())
+  })
+
+  reply, err := c.roundTrip(block, args)
+
+  if !stop() && err != nil {
+    err = ctx.Err()
+  }
+
+  var redisErr redisError
+
+  if err != nil && !errors.As(err, &redisErr) {
+    c.reset()
+  }
+
+  return reply, err
+}
+
+func (c *redisConn) roundTrip(block time.Duration, args []string) (any, error) {
+  c.conn.SetDeadline(time.Now().Add(redisTimeout + block))
+
+  var b strings.Builder
+
+  fmt.Fprintf(&b, "*%d\r\n", len(args))
+
+  for _, arg := range args {
+    fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+  }
+
+  if _, err := io.WriteString(c.conn, b.String()); err != nil {
+    return nil, err
+  }
+
+  return c.readReply()
+}
+
+func (c *redisConn) readReply() (any, error) {
+  line, err := c.r.ReadString('\n')
+
+  if err != nil {
+    return nil, err
+  }
+
+  line = strings.TrimSuffix(line, "\r\n")
+
+  if line == "" {
+    return nil, errors.New("empty reply")
+  }
+
+  switch line[0] {
+  case '+':
+    return line[1:], nil
+  case '-':
+    return nil, redisError(line[1:])
+  case ':':
+    return strconv.ParseInt(line[1:], 10, 64)
+  case '$':
+    n, err := strconv.Atoi(line[1:])
+
+    if err != nil || n < 0 {
+      return nil, err
+    }
+
+    buf := make([]byte, n+2)
+
+    if _, err = io.ReadFull(c.r, buf); err != nil {
+      return nil, err
+    }
+
+    return string(buf[:n]), nil
+  case '*':
+    n, err := strconv.Atoi(line[1:])
+
+    if err != nil || n < 0 {
+      return nil, err
+    }
+
+    items := make([]any, n)
+
+    // an error inside an array is part of the reply
+    for i := range items {
+      if items[i], err = c.readReply(); err != nil {
+        var redisErr redisError
+
+        if !errors.As(err, &redisErr) {
+          return nil, err
+        }
+
+        items[i] = redisErr
+      }
+    }
+
+    return items, nil
+  }
+
+  return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func (c *redisConn) close() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  c.reset()
+}
+
+// redisEntry is a stream entry
+type redisEntry struct {
+  id     string
+  fields map[string]string
+}
+
+// parseEntries reads the [id, [field, value, ...]] pairs of XREADGROUP and
+// XCLAIM replies. Entries deleted from the stream have no fields
+func parseEntries(reply any) ([]redisEntry, error) {
+  items, ok := reply.([]any)
+
+  if !ok && reply != nil {
+    return nil, fmt.Errorf("unexpected reply %v", reply)
+  }
+
+  var entries []redisEntry
+
+  for _, item := range items {
+    pair, ok := item.([]any)
+
+    if !ok || len(pair) != 2 {
+      return nil, fmt.Errorf("unexpected entry %v", item)
+    }
+
+    id, _ := pair[0].(string)
+    e := redisEntry{id: id, fields: make(map[string]string)}
+    values, _ := pair[1].([]any)
+
+    for i := 0; i+1 < len(values); i += 2 {
+      field, _ := values[i].(string)
+      value, _ := values[i+1].(string)
+      e.fields[field] = value
+    }
+
+    entries = append(entries, e)
+  }
+
+  return entries, nil
+}
@@ -0,0 +1,328 @@
+package watcher
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// encodesFile is the file in BaseDir recording what made each encode's
+// outputs, one JSON line per job
+const encodesFile = "encodes.jsonl"
+
+// encodeRecord is one line of the encodes file. Original is where the input
+// went afterwards, the originals directory when archived, empty when deleted
+type encodeRecord struct {
+  JobID     int64     `json:"job_id"`
+  JobUID    string    `json:"job_uid,omitempty"`
+  Input     string    `json:"input"`
+  Original  string    `json:"original,omitempty"`
+  Profile   string    `json:"profile"`
+  Version   string    `json:"version"`
+  Outputs   []string  `json:"outputs"`
+  EncodedAt time.Time `json:"encoded_at"`
+}
+
+// encodeLog appends the encodes file
+type encodeLog struct {
+  mu   sync.Mutex
+  path string
+}
+
+// record appends the job's outputs with the version of its profile as
+// configured, a job spec's changes to it are not a version of their own
+func (l *encodeLog) record(j *Job, original string, profiles *profileSet) {
+  if l == nil {
+    return
+  }
+
+  j.mu.Lock()
+  r := encodeRecord{
+    JobID:     j.id,
+    JobUID:    j.uid,
+    Input:     j.input,
+    Original:  original,
+    Profile:   j.profile.Name,
+    Outputs:   j.outputs,
+    EncodedAt: time.Now(),
+  }
+
+  if p, ok := profiles.byName[r.Profile]; ok {
+    r.Version = p.Version()
+  } else {
+    r.Version = j.profile.Version()
+  }
+  j.mu.Unlock()
+
+  line, err := json.Marshal(r)
+
+  if err != nil {
+    return
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err == nil {
+    _, err = f.Write(append(line, '\n'))
+
+    if closeErr := f.Close(); err == nil {
+      err = closeErr
+    }
+  }
+
+  if err != nil {
+    j.logger().Error("Could not record the encode", "file", l.path, "error", err)
+  }
+}
+
+// made reports whether a record of input encoded after modTime lists every
+// one of outputs
+func (l *encodeLog) made(input string, modTime time.Time, outputs []string) bool {
+  if l == nil {
+    return false
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  f, err := os.Open(l.path)
+
+  if err != nil {
+    return false
+  }
+
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+  for scanner.Scan() {
+    var r encodeRecord
+
+    if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Input != input {
+      continue
+    }
+
+    if r.EncodedAt.After(modTime) && containsAll(r.Outputs, outputs) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// latest returns the last record of each original still on disk
+func (l *encodeLog) latest() ([]encodeRecord, error) {
+  if l == nil {
+    return nil, nil
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  f, err := os.Open(l.path)
+
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  defer f.Close()
+
+  byOriginal := make(map[string]int)
+  var records []encodeRecord
+
+  scanner := bufio.NewScanner(f)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+  for scanner.Scan() {
+    var r encodeRecord
+
+    if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Original == "" {
+      continue
+    }
+
+    if i, ok := byOriginal[r.Original]; ok {
+      records[i] = r
+      continue
+    }
+
+    byOriginal[r.Original] = len(records)
+    records = append(records, r)
+  }
+
+  if err = scanner.Err(); err != nil {
+    return nil, err
+  }
+
+  current := records[:0]
+
+  for _, r := range records {
+    if _, err := os.Stat(r.Original); err == nil {
+      current = append(current, r)
+    }
+  }
+
+  return current, nil
+}
+
+// Reencode queues the originals encoded with the profile since a time, or
+// ever when since is zero, whose outputs were made by an earlier version
+// of it. The originals are moved back into the queue directory and encoded
+// with the profile even if the ledger has seen them. With dryRun nothing is
+// moved. It returns the originals
+func (w *Watcher) Reencode(profile string, since time.Time, dryRun bool) ([]string, error) {
+  p, ok := w.profiles.Load().byName[profile]
+
+  if !ok {
+    return nil, fmt.Errorf("unknown profile %q", profile)
+  }
+
+  records, err := w.enc.encodes.latest()
+
+  if err != nil {
+    return nil, err
+  }
+
+  version := p.Version()
+  originals := make([]string, 0)
+
+  // the watchers must not pick up a moved original before its job exists
+  w.foundMu.Lock()
+  defer w.foundMu.Unlock()
+
+  for _, r := range records {
+    if r.Profile != profile || r.Version == version || r.EncodedAt.Before(since) {
+      continue
+    }
+
+    if j := w.store.byPath(r.Original); j != nil && !j.State().Finished() {
+      continue
+    }
+
+    if dryRun {
+      originals = append(originals, r.Original)
+      continue
+    }
+
+    // kept originals are still in a queue directory
+    input := r.Original
+
+    if dir := filepath.Dir(input); dir != w.queueDir && dir != w.priorityDir {
+      input = queuePath(w.queueDir, filepath.Base(r.Original))
+
+      if err := moveFile(r.Original, input); err != nil {
+        slog.Error("Could not move original back into the queue directory", "original", r.Original, "error", err)
+        continue
+      }
+
+      w.enc.audit.moved(nil, r.Original, input, "reencode")
+
+      if err := moveSpec(findSpec(r.Original), input); err != nil {
+        slog.Warn("Could not move job spec with its original", "original", r.Original, "error", err)
+      }
+
+      if err := moveChecksum(findChecksum(r.Original), input); err != nil {
+        slog.Warn("Could not move checksum with its original", "original", r.Original, "error", err)
+      }
+    }
+
+    slog.Info("Re-encoding with the new profile version", "original", r.Original, "profile", profile, "was", r.Version, "now", version)
+
+    w.stats.filesQueued.Add(1)
+
+    j := w.store.add(input, filepath.Base(input), PriorityNormal, p)
+    j.forced = true
+    w.queue.push(j)
+
+    originals = append(originals, r.Original)
+  }
+
+  return originals, nil
+}
+
+// queuePath is a path for name in dir that is not taken
+func queuePath(dir string, name string) string {
+  path := filepath.Join(dir, name)
+
+  for i := 1; ; i++ {
+    if _, err := os.Lstat(path); os.IsNotExist(err) {
+      return path
+    }
+
+    ext := filepath.Ext(name)
+    path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", name[:len(name)-len(ext)], i, ext))
+  }
+}
+
+// ReencodeView is the JSON returned by POST /reencode
+type ReencodeView struct {
+  DryRun    bool     `json:"dry_run,omitempty"`
+  Originals []string `json:"originals"`
+}
+
+// reencode serves POST /reencode?profile=X[&since=2024-01-31][&dry_run=true]
+func (a *api) reencode(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  query := r.URL.Query()
+  profile := query.Get("profile")
+
+  if profile == "" {
+    writeError(w, http.StatusBadRequest, "profile is required")
+    return
+  }
+
+  var since time.Time
+
+  if value := query.Get("since"); value != "" {
+    var err error
+
+    if since, err = ParseSince(value); err != nil {
+      writeError(w, http.StatusBadRequest, err.Error())
+      return
+    }
+  }
+
+  dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+  originals, err := a.w.Reencode(profile, since, dryRun)
+
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, ReencodeView{DryRun: dryRun, Originals: originals})
+}
+
+// ParseSince reads a date like 2024-01-31, midnight local time, or an
+// RFC 3339 time
+func ParseSince(value string) (time.Time, error) {
+  if t, err := time.ParseInLocation(archiveDateLayout, value, time.Local); err == nil {
+    return t, nil
+  }
+
+  t, err := time.Parse(time.RFC3339, value)
+
+  if err != nil {
+    return time.Time{}, fmt.Errorf("since must be a date like 2024-01-31 or an RFC 3339 time, not %q", value)
+  }
+
+  return t, nil
+}
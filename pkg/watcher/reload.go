@@ -0,0 +1,107 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+)
+
+// profileSet is the profiles jobs can be encoded with, def is the one new
+// jobs get. Reload replaces it as a whole
+type profileSet struct {
+  def    *Profile
+  byName map[string]*Profile
+  routes []route
+}
+
+// Reload applies the settings of cfg that can change while running:
+// Profile, Profiles, Routes, IncludeExtensions, ExcludeGlobs, IgnorePatterns
+// and Workers, zero
+// Workers keeps the current number. Queued jobs switch to the new profile
+// of the same name, running jobs finish with the one they started with.
+// Nothing changes when cfg is not valid. The other fields are ignored, they
+// need a restart
+func (w *Watcher) Reload(cfg Config) error {
+  w.reloadMu.Lock()
+  defer w.reloadMu.Unlock()
+
+  if cfg.Profile == nil {
+    return fmt.Errorf("no profile")
+  }
+
+  if cfg.Workers < 0 {
+    return fmt.Errorf("workers must be a positive number")
+  }
+
+  profiles := map[string]*Profile{cfg.Profile.Name: cfg.Profile}
+
+  for name, p := range cfg.Profiles {
+    if _, exists := profiles[name]; !exists {
+      profiles[name] = p
+    }
+  }
+
+  builds := make(ffmpegBuilds)
+  container := w.cfg.Sandbox != nil && w.cfg.Sandbox.container()
+
+  for _, p := range profiles {
+    if err := checkNameTemplate(p.NameTemplate); err != nil {
+      return err
+    }
+
+    if err := p.checkFFmpeg(w.cfg.FFmpegPath, container, builds); err != nil {
+      return err
+    }
+
+    if err := p.checkRunnable(p.ffmpegPath(w.cfg.FFmpegPath)); err != nil {
+      return err
+    }
+  }
+
+  routes, err := compileRoutes(cfg.Routes, profiles)
+
+  if err != nil {
+    return err
+  }
+
+  filter, err := newFileFilter(cfg.IncludeExtensions, cfg.ExcludeGlobs, cfg.IgnorePatterns)
+
+  if err != nil {
+    return err
+  }
+
+  selectHardware(w.cfg.FFmpegPath, profiles)
+
+  old := w.profiles.Load()
+  w.profiles.Store(&profileSet{def: cfg.Profile, byName: profiles, routes: routes})
+  w.filter.Store(filter)
+
+  // jobs waiting for a worker pick up the new flags, the default profile is
+  // followed even when it has a new name
+  w.queue.each(func(j *Job) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+
+    if j.requested == old.def {
+      j.requested = cfg.Profile
+    } else if p, ok := profiles[j.requested.Name]; ok {
+      j.requested = p
+    }
+
+    j.profile = j.requested
+  })
+
+  if cfg.Workers > 0 && int64(cfg.Workers) != w.workers.Load() {
+    w.workers.Store(int64(cfg.Workers))
+    w.pool.resize(cfg.Workers)
+  }
+
+  slog.Info("Config reloaded", "profile", cfg.Profile.Name, "profiles", len(profiles), "workers", w.workers.Load())
+
+  return nil
+}
+
+// SetReloader sets what POST /reload on the API runs, typically reading the
+// config again and passing it to Reload. Without one the endpoint fails
+func (w *Watcher) SetReloader(reload func() error) {
+  w.reloader = reload
+}
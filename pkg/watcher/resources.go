@@ -0,0 +1,465 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "slices"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// Resources caps how many jobs use each resource class at once, e.g. two on
+// the NVENC chip and four on the CPU. A profile names the class of its
+// software encodes in Resource and each hardware variant the class of its
+// own, classes without a limit are not capped. Watchers sharing one
+// Resources share its limits, so roots in one process do not oversubscribe
+// the same GPU. A class can be spread over devices, see ResourceDevice
+type Resources struct {
+  mu     sync.Mutex
+  limits map[string]int
+  used   map[string]int
+
+  // devices are the classes spread over several devices, onDevice how many
+  // jobs each device has
+  devices  map[string][]ResourceDevice
+  onDevice map[string]map[string]int
+
+  // taken are the indexes of each class's slots in use, a job gets the
+  // lowest free one, see resourceSlot
+  taken map[string]map[int]bool
+
+  // caps are the per-profile limits last seen, for Usage
+  caps map[string]int
+
+  // changed is closed and replaced whenever a slot is released, queues
+  // waiting for one are woken
+  changed chan struct{}
+  queues  []*jobQueue
+}
+
+// ResourceUse is how many jobs are using a resource class and its limit,
+// zero for none
+type ResourceUse struct {
+  Used  int `json:"used"`
+  Limit int `json:"limit,omitempty"`
+
+  // Devices is the use of each of the class's devices, by ID
+  Devices map[string]ResourceUse `json:"devices,omitempty"`
+}
+
+// ResourceDevice is one of the devices, e.g. GPUs, the jobs of a resource
+// class are spread over: each job goes to the device with the fewest jobs
+// that has room, MaxJobs caps it, zero for no cap. A class whose devices
+// are all capped and which has no limit of its own is limited to the sum.
+//
+// The job's ffmpeg, pipeline commands and hooks get the device: an ID that
+// is a path, like /dev/dri/renderD129, is passed with -hwaccel_device unless
+// the input flags already name a device with -hwaccel_device,
+// -vaapi_device, -qsv_device or -init_hw_device, which can use {device}.
+// Any other ID, an NVIDIA GPU's index or UUID, is set as
+// CUDA_VISIBLE_DEVICES unless the profile's env sets it, so the job sees
+// only that GPU as GPU 0, for decoding and for nvenc
+type ResourceDevice struct {
+  ID      string `yaml:"id" json:"id"`
+  MaxJobs int    `yaml:"max_jobs" json:"max_jobs,omitempty"`
+}
+
+// resourceSlot is a job's use of a class, limit overrides the class's limit
+// for the per-profile caps. index numbers the slots of a class in use from
+// 0, below its limit, so a job can be pinned to the GPU of its slot, and
+// device is the ID of the class's device the job was given
+type resourceSlot struct {
+  class  string
+  limit  int
+  index  int
+  device string
+}
+
+// NewResources caps each class at its limit and spreads the jobs of the
+// classes in devices over their devices, either may be nil
+func NewResources(limits map[string]int, devices map[string][]ResourceDevice) *Resources {
+  return &Resources{
+    limits:   limits,
+    used:     make(map[string]int),
+    devices:  devices,
+    onDevice: make(map[string]map[string]int),
+    taken:    make(map[string]map[int]bool),
+    caps:     make(map[string]int),
+    changed:  make(chan struct{}),
+  }
+}
+
+// sameSlots reports whether a and b are the same classes and limits
+func sameSlots(a []resourceSlot, b []resourceSlot) bool {
+  return slices.EqualFunc(a, b, func(x resourceSlot, y resourceSlot) bool { return x.class == y.class && x.limit == y.limit })
+}
+
+// ParseResourceLimits parses class=limit pairs like nvenc=2,cpu=4
+func ParseResourceLimits(value string) (map[string]int, error) {
+  limits := make(map[string]int)
+
+  for _, item := range SplitList(value) {
+    class, limit, ok := strings.Cut(item, "=")
+    n, err := strconv.Atoi(strings.TrimSpace(limit))
+
+    if class = strings.TrimSpace(class); !ok || class == "" || err != nil || n < 0 {
+      return nil, fmt.Errorf("bad resource limit %q, want class=number", item)
+    }
+
+    limits[class] = n
+  }
+
+  return limits, nil
+}
+
+// ParseResourceDevices parses class=id pairs like nvenc=0,nvenc=1, one per
+// device, an id can end in :jobs to cap the device, e.g. nvenc=0:2
+func ParseResourceDevices(value string) (map[string][]ResourceDevice, error) {
+  devices := make(map[string][]ResourceDevice)
+
+  for _, item := range SplitList(value) {
+    class, id, ok := strings.Cut(item, "=")
+    class, id = strings.TrimSpace(class), strings.TrimSpace(id)
+
+    if !ok || class == "" || id == "" {
+      return nil, fmt.Errorf("bad resource device %q, want class=id or class=id:jobs", item)
+    }
+
+    device := ResourceDevice{ID: id}
+
+    if i := strings.LastIndex(id, ":"); i >= 0 {
+      n, err := strconv.Atoi(id[i+1:])
+
+      if err != nil || n < 0 || i == 0 {
+        return nil, fmt.Errorf("bad resource device %q, want class=id or class=id:jobs", item)
+      }
+
+      device = ResourceDevice{ID: id[:i], MaxJobs: n}
+    }
+
+    devices[class] = append(devices[class], device)
+  }
+
+  if err := checkDevices(devices); err != nil {
+    return nil, err
+  }
+
+  return devices, nil
+}
+
+// checkDevices rejects devices without an ID, named twice in a class or
+// with a negative cap
+func checkDevices(devices map[string][]ResourceDevice) error {
+  for class, list := range devices {
+    seen := make(map[string]bool)
+
+    for _, d := range list {
+      switch {
+      case d.ID == "":
+        return fmt.Errorf("resource %s: a device needs an id", class)
+      case seen[d.ID]:
+        return fmt.Errorf("resource %s: device %s is listed twice", class, d.ID)
+      case d.MaxJobs < 0:
+        return fmt.Errorf("resource %s: device %s: max_jobs must be a positive number", class, d.ID)
+      }
+
+      seen[d.ID] = true
+    }
+  }
+
+  return nil
+}
+
+// limit is the class's limit, from its devices when it has none of its own
+func (r *Resources) limit(class string) int {
+  if limit := r.limits[class]; limit > 0 || len(r.devices[class]) == 0 {
+    return limit
+  }
+
+  sum := 0
+
+  for _, d := range r.devices[class] {
+    if d.MaxJobs == 0 {
+      return 0
+    }
+
+    sum += d.MaxJobs
+  }
+
+  return sum
+}
+
+// freeDevice is the ID of the class's device with the fewest jobs that has
+// room, the first listed of those with as few. It reports false when every
+// device is full, a class without devices always gets ""
+func (r *Resources) freeDevice(class string) (string, bool) {
+  devices := r.devices[class]
+
+  if len(devices) == 0 {
+    return "", true
+  }
+
+  best, found := "", false
+
+  for _, d := range devices {
+    jobs := r.onDevice[class][d.ID]
+
+    if d.MaxJobs > 0 && jobs >= d.MaxJobs {
+      continue
+    }
+
+    if !found || jobs < r.onDevice[class][best] {
+      best, found = d.ID, true
+    }
+  }
+
+  return best, found
+}
+
+// slots are the classes a job encoded with p counts against, the hardware
+// variant's when hardware is set
+func (p *Profile) slots(hardware bool) []resourceSlot {
+  var slots []resourceSlot
+
+  class := p.Resource
+
+  if hardware && p.hw != nil {
+    class = p.hw.Resource
+  }
+
+  if class != "" {
+    slots = append(slots, resourceSlot{class: class})
+  }
+
+  if p.MaxJobs > 0 {
+    slots = append(slots, resourceSlot{class: "profile:" + p.Name, limit: p.MaxJobs})
+  }
+
+  return slots
+}
+
+// tryAcquire takes every slot or none of them, it reports whether it did.
+// The slots' indexes and devices are set to the ones taken
+func (r *Resources) tryAcquire(slots []resourceSlot) bool {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  for _, s := range slots {
+    limit := s.limit
+
+    if limit == 0 {
+      limit = r.limit(s.class)
+    }
+
+    if limit > 0 && r.used[s.class] >= limit {
+      return false
+    }
+
+    if _, ok := r.freeDevice(s.class); !ok {
+      return false
+    }
+  }
+
+  for i, s := range slots {
+    r.used[s.class]++
+
+    if s.limit > 0 {
+      r.caps[s.class] = s.limit
+    }
+
+    if r.taken[s.class] == nil {
+      r.taken[s.class] = make(map[int]bool)
+    }
+
+    index := 0
+
+    for r.taken[s.class][index] {
+      index++
+    }
+
+    r.taken[s.class][index] = true
+    slots[i].index = index
+
+    if device, _ := r.freeDevice(s.class); device != "" {
+      if r.onDevice[s.class] == nil {
+        r.onDevice[s.class] = make(map[string]int)
+      }
+
+      r.onDevice[s.class][device]++
+      slots[i].device = device
+    }
+  }
+
+  return true
+}
+
+// acquire waits until every slot is free and takes them, it returns false
+// if ctx is done first
+func (r *Resources) acquire(ctx context.Context, slots []resourceSlot) bool {
+  for {
+    r.mu.Lock()
+    changed := r.changed
+    r.mu.Unlock()
+
+    if r.tryAcquire(slots) {
+      return true
+    }
+
+    select {
+    case <-changed:
+    case <-ctx.Done():
+      return false
+    }
+  }
+}
+
+func (r *Resources) release(slots []resourceSlot) {
+  if len(slots) == 0 {
+    return
+  }
+
+  r.mu.Lock()
+
+  for _, s := range slots {
+    if r.used[s.class]--; r.used[s.class] <= 0 {
+      delete(r.used, s.class)
+    }
+
+    if delete(r.taken[s.class], s.index); len(r.taken[s.class]) == 0 {
+      delete(r.taken, s.class)
+    }
+
+    if s.device != "" {
+      if r.onDevice[s.class][s.device]--; r.onDevice[s.class][s.device] <= 0 {
+        delete(r.onDevice[s.class], s.device)
+      }
+    }
+  }
+
+  close(r.changed)
+  r.changed = make(chan struct{})
+  queues := r.queues
+  r.mu.Unlock()
+
+  for _, q := range queues {
+    q.wake()
+  }
+}
+
+// watch has q's workers look for a job they can start whenever a slot is
+// released
+func (r *Resources) watch(q *jobQueue) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  r.queues = append(r.queues, q)
+}
+
+// Usage is how busy each limited or used class is
+func (r *Resources) Usage() map[string]ResourceUse {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+
+  usage := make(map[string]ResourceUse)
+
+  for class := range r.limits {
+    usage[class] = ResourceUse{Limit: r.limit(class)}
+  }
+
+  for class, devices := range r.devices {
+    use := ResourceUse{Limit: r.limit(class), Devices: make(map[string]ResourceUse)}
+
+    for _, d := range devices {
+      use.Devices[d.ID] = ResourceUse{Used: r.onDevice[class][d.ID], Limit: d.MaxJobs}
+    }
+
+    usage[class] = use
+  }
+
+  for class, used := range r.used {
+    use := usage[class]
+    use.Used = used
+
+    if use.Limit == 0 {
+      use.Limit = r.caps[class]
+    }
+
+    usage[class] = use
+  }
+
+  return usage
+}
+
+// reslot swaps the job's slots for those of the profile it ended up with
+// after its sidecar and pre hook, it reports false and holds none when they
+// are not free
+func (r *Resources) reslot(j *Job) bool {
+  j.mu.Lock()
+  held, want := j.slots, j.profile.slots(!j.software)
+  j.mu.Unlock()
+
+  if sameSlots(want, held) {
+    return true
+  }
+
+  // releasing wakes the queue, which locks jobs, so not under the job's lock
+  r.release(held)
+  ok := r.tryAcquire(want)
+
+  j.mu.Lock()
+  j.slots = nil
+
+  if ok {
+    j.slots = want
+  }
+
+  j.mu.Unlock()
+
+  return ok
+}
+
+// reslotWait swaps the job's slots like reslot, waiting for the new ones.
+// It returns false if ctx is done first
+func (r *Resources) reslotWait(ctx context.Context, j *Job) bool {
+  j.mu.Lock()
+  held, want := j.slots, j.profile.slots(!j.software)
+  j.slots = nil
+  j.mu.Unlock()
+
+  r.release(held)
+
+  if !r.acquire(ctx, want) {
+    return false
+  }
+
+  j.mu.Lock()
+  j.slots = want
+  j.mu.Unlock()
+
+  return true
+}
+
+// releaseJob frees the slots the job holds
+func (r *Resources) releaseJob(j *Job) {
+  j.mu.Lock()
+  held := j.slots
+  j.slots = nil
+  j.mu.Unlock()
+
+  r.release(held)
+}
+
+// classes is the sorted names of the classes in slots
+func classes(slots []resourceSlot) []string {
+  names := make([]string, 0, len(slots))
+
+  for _, s := range slots {
+    names = append(names, s.class)
+  }
+
+  sort.Strings(names)
+
+  return names
+}
@@ -0,0 +1,271 @@
+package watcher
+
+import (
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// resumeMaxAge is how long the segments of an encode that was cut short
+// wait for their input to be queued again
+const resumeMaxAge = 7 * 24 * time.Hour
+
+// resumeRun encodes a rendition in segments of the profile's ResumeSegment
+// into a directory of the working directory's stateDir, which outlives the
+// job. An encode cut short by a crash or a shutdown leaves the segments it
+// finished there, and the next encode of the same input starts from the
+// end of the last one, seeking the input, instead of from the start. Once
+// the input is encoded the segments are joined into the output
+type resumeRun struct {
+  dir     string
+  file    string
+  segment time.Duration
+
+  // inputFlags and outputFlags encode the segments, muxerFlags and
+  // joinFlags are for the output they are joined into
+  inputFlags  []string
+  outputFlags []string
+  muxerFlags  []string
+  joinFlags   []string
+}
+
+// resumeSegment is a segment an earlier encode finished
+type resumeSegment struct {
+  path   string
+  length time.Duration
+}
+
+// checkResume rejects resume settings that cannot work
+func (p *Profile) checkResume() error {
+  switch {
+  case p.ResumeSegment < 0:
+    return fmt.Errorf("resume_segment must not be negative")
+  case p.ResumeSegment > 0 && p.ResumeSegment < time.Second:
+    return fmt.Errorf("resume_segment must be at least a second")
+  case p.ResumeSegment > 0 && (p.TwoPass || p.Parallel || p.Packaging != "" || len(p.pipeline()) > 0):
+    return fmt.Errorf("resume_segment does not apply to two_pass, parallel, packaging or steps profiles")
+  case p.ResumeSegment > 0 && p.Loudnorm != nil:
+    return fmt.Errorf("resume_segment cannot be combined with loudnorm, which measures the whole input")
+  case p.ResumeSegment > 0 && p.Subtitles == SubtitlesBurn:
+    return fmt.Errorf("resume_segment cannot burn in subtitles, a resumed encode's timestamps start over")
+  }
+
+  return nil
+}
+
+// resumes reports whether the job's renditions are encoded in resumable
+// segments, not for inputs still growing or trimmed ones
+func (e *encoder) resumes(j *Job) bool {
+  return j.profile.ResumeSegment > 0 && !j.growing && (j.spec == nil || (j.spec.start == 0 && j.spec.end == 0))
+}
+
+// resumableRun is the run encoding rendition i of the job into out in
+// resumable segments
+func (e *encoder) resumableRun(j *Job, i int, r Rendition, probed *probeResult, inputFlags []string, outputFlags []string, out string) ffmpegRun {
+  file := j.source()
+  encode, muxer := muxerFlags(append(append([]string(nil), outputFlags...), r.OutputFlags...))
+
+  // the segments of the same input, profile and rendition, as long as the
+  // input has not changed since
+  key := fmt.Sprintf("%s\x00%s\x00%d", j.input, j.profile.Name, i)
+
+  if info, err := os.Stat(file); err == nil {
+    key += fmt.Sprintf("\x00%d\x00%d", info.Size(), info.ModTime().UnixNano())
+  }
+
+  sum := sha256.Sum256([]byte(key))
+  dir := filepath.Join(e.workingDir, stateDir, "resume", hex.EncodeToString(sum[:8]))
+
+  return ffmpegRun{
+    name:    r.Name,
+    outputs: []string{out},
+    dirs:    []string{dir},
+    resume: &resumeRun{
+      dir:         dir,
+      file:        file,
+      segment:     j.profile.ResumeSegment,
+      inputFlags:  inputFlags,
+      outputFlags: encode,
+      muxerFlags:  muxer,
+      joinFlags:   e.metadataFlags(j, probed, 1),
+    },
+  }
+}
+
+// muxerFlags takes the flags for the output's container out of flags, the
+// segments are matroska
+func muxerFlags(flags []string) (encode []string, muxer []string) {
+  for i := 0; i < len(flags); i++ {
+    if (flags[i] == "-f" || flags[i] == "-movflags") && i+1 < len(flags) {
+      muxer = append(muxer, flags[i], flags[i+1])
+      i++
+      continue
+    }
+
+    encode = append(encode, flags[i])
+  }
+
+  return encode, muxer
+}
+
+// finished returns the segments earlier encodes finished in order, and
+// removes the one that was being written when they stopped. ffmpeg lists
+// each segment in the attempt's list once it is complete
+func (r *resumeRun) finished() []resumeSegment {
+  lists, _ := filepath.Glob(filepath.Join(r.dir, "list-*.csv"))
+  sort.Strings(lists)
+
+  var segments []resumeSegment
+  kept := make(map[string]bool)
+
+  for _, list := range lists {
+    data, err := os.ReadFile(list)
+
+    if err != nil {
+      continue
+    }
+
+    for _, line := range strings.Split(string(data), "\n") {
+      fields := strings.Split(strings.TrimSpace(line), ",")
+
+      if len(fields) != 3 {
+        continue
+      }
+
+      start, err1 := strconv.ParseFloat(fields[1], 64)
+      end, err2 := strconv.ParseFloat(fields[2], 64)
+      path := filepath.Join(r.dir, filepath.Base(fields[0]))
+
+      if err1 != nil || err2 != nil || end <= start {
+        continue
+      }
+
+      if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+        continue
+      }
+
+      segments = append(segments, resumeSegment{path: path, length: time.Duration((end - start) * float64(time.Second))})
+      kept[path] = true
+    }
+  }
+
+  written, _ := filepath.Glob(filepath.Join(r.dir, "segment-*.mkv"))
+
+  for _, path := range written {
+    if !kept[path] {
+      os.Remove(path)
+    }
+  }
+
+  return segments
+}
+
+// runResumable encodes what is left of the input after the segments
+// earlier encodes finished, then joins them all into the run's output. The
+// segments are kept when the encode is aborted by a shutdown, otherwise
+// removed once it is over
+func (e *encoder) runResumable(ctx context.Context, j *Job, run ffmpegRun, output io.Writer, duration time.Duration) (err error) {
+  r := run.resume
+  logger := j.logger()
+
+  defer func() {
+    if err == nil || context.Cause(ctx) != errShutdown {
+      os.RemoveAll(r.dir)
+    }
+  }()
+
+  if err = os.MkdirAll(r.dir, os.ModePerm); err != nil {
+    return err
+  }
+
+  done := r.finished()
+
+  var offset time.Duration
+
+  for _, s := range done {
+    offset += s.length
+  }
+
+  if len(done) > 0 {
+    logger.Info("Resuming encode", "step", run.name, "segments", len(done), "at", offset.Round(time.Second).String())
+  }
+
+  // a second or less left is what the last segment rounded off
+  if duration == 0 || offset < duration-time.Second {
+    encode := ffmpegRun{name: run.name, dirs: run.dirs}
+    encode.args = append(encode.args, r.inputFlags...)
+
+    if offset > 0 {
+      encode.args = append(encode.args, "-ss", formatSeconds(offset))
+    }
+
+    encode.args = append(encode.args, "-i", r.file)
+    encode.args = append(encode.args, r.outputFlags...)
+    encode.args = append(encode.args,
+      "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%s)", formatSeconds(r.segment)),
+      "-f", "segment", "-segment_time", formatSeconds(r.segment), "-segment_format", "matroska",
+      "-reset_timestamps", "1", "-segment_start_number", strconv.Itoa(len(done)),
+      "-segment_list", filepath.Join(r.dir, fmt.Sprintf("list-%05d.csv", len(done))), "-segment_list_type", "csv",
+      "-y", filepath.Join(r.dir, "segment-%05d.mkv"))
+
+    logger.Info("Command", "step", encode.name, "args", encode.args)
+
+    if err = e.runFFmpeg(ctx, j, encode, output, max(duration-offset, 0)); err != nil {
+      return err
+    }
+
+    done = r.finished()
+  }
+
+  if len(done) == 0 {
+    return fmt.Errorf("%s: the encode produced no segments", run.name)
+  }
+
+  var list strings.Builder
+
+  for _, s := range done {
+    fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(s.path, "'", `'\''`))
+  }
+
+  joinList := filepath.Join(r.dir, "join.txt")
+
+  if err = os.WriteFile(joinList, []byte(list.String()), 0644); err != nil {
+    return err
+  }
+
+  join := ffmpegRun{
+    name:    run.name + " join",
+    outputs: run.outputs,
+    args:    []string{"-f", "concat", "-safe", "0", "-i", joinList, "-i", r.file, "-map", "0", "-c", "copy"},
+  }
+
+  join.args = append(join.args, r.joinFlags...)
+  join.args = append(join.args, r.muxerFlags...)
+  join.args = append(join.args, run.outputs[0])
+
+  logger.Info("Command", "step", join.name, "args", join.args)
+
+  return e.runFFmpeg(ctx, j, join, output, duration)
+}
+
+// pruneResumes removes the segments of encodes whose input has not been
+// queued again within resumeMaxAge
+func pruneResumes(dir string) {
+  entries, _ := os.ReadDir(dir)
+
+  for _, entry := range entries {
+    path := filepath.Join(dir, entry.Name())
+
+    if time.Since(lastModified(path)) > resumeMaxAge {
+      os.RemoveAll(path)
+    }
+  }
+}
@@ -0,0 +1,387 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// RetentionAction is what retention does with the entries it takes out of
+// a directory
+type RetentionAction string
+
+const (
+  // RetentionDelete removes them, the default
+  RetentionDelete RetentionAction = "delete"
+
+  // RetentionArchive moves them into ArchiveDir under the same names
+  RetentionArchive RetentionAction = "archive"
+)
+
+// Retention keeps the finished or originals directory from growing forever.
+// Entries older than MaxAge go, then the oldest until what is left is no
+// more than MaxSize bytes. Zero turns either off. An entry is an output or
+// original with its sidecars, the thumbnails and date directories are gone
+// through one by one
+type Retention struct {
+  MaxAge     time.Duration
+  MaxSize    int64
+  Action     RetentionAction
+  ArchiveDir string
+}
+
+// retentionCheck is how often the retentions are applied
+const retentionCheck = time.Hour
+
+// check rejects a retention that cannot be applied
+func (r *Retention) check() error {
+  if r.MaxAge < 0 || r.MaxSize < 0 {
+    return fmt.Errorf("max age and size must not be negative")
+  }
+
+  if r.MaxAge == 0 && r.MaxSize == 0 {
+    return fmt.Errorf("needs a max age or size")
+  }
+
+  switch r.Action {
+  case "":
+    r.Action = RetentionDelete
+  case RetentionDelete:
+  case RetentionArchive:
+    if r.ArchiveDir == "" {
+      return fmt.Errorf("archive needs an archive directory")
+    }
+
+    dir, err := filepath.Abs(r.ArchiveDir)
+
+    if err != nil {
+      return err
+    }
+
+    r.ArchiveDir = dir
+  default:
+    return fmt.Errorf("action must be delete or archive, not %q", r.Action)
+  }
+
+  return nil
+}
+
+// PrunedView is an entry retention took, or would take, out of a directory.
+// Reason is age or size, To where an archived entry went
+type PrunedView struct {
+  Dir     string    `json:"dir"`
+  Path    string    `json:"path"`
+  Files   []string  `json:"files"`
+  Bytes   int64     `json:"bytes"`
+  ModTime time.Time `json:"mod_time"`
+  Reason  string    `json:"reason"`
+  Action  string    `json:"action"`
+  To      string    `json:"to,omitempty"`
+}
+
+// retentionEntry is an output or original and its sidecars, the newest
+// file's time is the entry's
+type retentionEntry struct {
+  path    string
+  files   []string
+  bytes   int64
+  modTime time.Time
+}
+
+// retentionEntries lists dir's entries. The thumbnails directory and the
+// archive's date directories hold entries rather than being one, and a file
+// named after another plus an extension, like movie.mp4.sha256, goes with it
+func retentionEntries(dir string) ([]*retentionEntry, error) {
+  names, err := os.ReadDir(dir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var paths []string
+
+  for _, entry := range names {
+    // dotfiles are another program's work in progress
+    if hidden(entry.Name()) {
+      continue
+    }
+
+    path := filepath.Join(dir, entry.Name())
+
+    if _, err := time.Parse(archiveDateLayout, entry.Name()); entry.IsDir() && (entry.Name() == thumbsDir || err == nil) {
+      inner, err := os.ReadDir(path)
+
+      if err != nil {
+        return nil, err
+      }
+
+      for _, e := range inner {
+        if !hidden(e.Name()) {
+          paths = append(paths, filepath.Join(path, e.Name()))
+        }
+      }
+
+      continue
+    }
+
+    paths = append(paths, path)
+  }
+
+  // shortest first, so an entry is there before its sidecars
+  sort.Slice(paths, func(a, b int) bool { return len(paths[a]) < len(paths[b]) })
+
+  var entries []*retentionEntry
+  byPath := make(map[string]*retentionEntry)
+
+  for _, path := range paths {
+    e := sidecarOf(byPath, path)
+
+    if e == nil {
+      e = &retentionEntry{path: path}
+      entries = append(entries, e)
+      byPath[path] = e
+    }
+
+    e.files = append(e.files, path)
+    e.bytes += totalSize([]string{path})
+
+    if info, err := os.Lstat(path); err == nil && info.ModTime().After(e.modTime) {
+      e.modTime = info.ModTime()
+    }
+  }
+
+  return entries, nil
+}
+
+// sidecarOf is the entry path is a sidecar of, one of its names with
+// extensions taken off, or nil
+func sidecarOf(entries map[string]*retentionEntry, path string) *retentionEntry {
+  for name := path; filepath.Ext(name) != ""; {
+    name = strings.TrimSuffix(name, filepath.Ext(name))
+
+    if e, ok := entries[name]; ok {
+      return e
+    }
+  }
+
+  return nil
+}
+
+// apply takes the entries past the retention out of dir, or only lists
+// them with dryRun
+func (r *Retention) apply(dir string, dryRun bool) ([]PrunedView, error) {
+  entries, err := retentionEntries(dir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  sort.Slice(entries, func(a, b int) bool { return entries[a].modTime.Before(entries[b].modTime) })
+
+  var total int64
+
+  for _, e := range entries {
+    total += e.bytes
+  }
+
+  pruned := make([]PrunedView, 0)
+
+  for _, e := range entries {
+    reason := ""
+
+    switch {
+    case r.MaxAge > 0 && time.Since(e.modTime) > r.MaxAge:
+      reason = "age"
+    case r.MaxSize > 0 && total > r.MaxSize:
+      reason = "size"
+    default:
+      // the rest are newer and fit
+      continue
+    }
+
+    view := PrunedView{Dir: dir, Path: e.path, Files: e.files, Bytes: e.bytes, ModTime: e.modTime, Reason: reason, Action: string(r.Action)}
+
+    if !dryRun {
+      if view.To, err = r.remove(dir, e); err != nil {
+        slog.Error("Could not prune", "path", e.path, "action", r.Action, "error", err)
+        continue
+      }
+
+      removeEmptyParent(dir, e)
+    }
+
+    total -= e.bytes
+    pruned = append(pruned, view)
+  }
+
+  return pruned, nil
+}
+
+// remove deletes or archives an entry's files, returning where they went
+func (r *Retention) remove(dir string, e *retentionEntry) (string, error) {
+  if r.Action != RetentionArchive {
+    for _, file := range e.files {
+      if err := os.RemoveAll(file); err != nil {
+        return "", err
+      }
+    }
+
+    return "", nil
+  }
+
+  var to string
+
+  for _, file := range e.files {
+    rel, err := filepath.Rel(dir, file)
+
+    if err != nil {
+      return "", err
+    }
+
+    dest := filepath.Join(r.ArchiveDir, rel)
+
+    if err = createDir(filepath.Dir(dest)); err != nil {
+      return "", err
+    }
+
+    if err = moveFile(file, dest); err != nil {
+      return "", err
+    }
+
+    if to == "" {
+      to = dest
+    }
+  }
+
+  return to, nil
+}
+
+// removeEmptyParent removes an emptied date directory, the thumbnails
+// directory is left for the next thumbnails
+func removeEmptyParent(dir string, e *retentionEntry) {
+  if parent := filepath.Dir(e.path); parent != dir && filepath.Base(parent) != thumbsDir {
+    // fails unless empty
+    os.Remove(parent)
+  }
+}
+
+// Prune applies the finished and originals retentions now, with dryRun it
+// only reports what they would take
+func (w *Watcher) Prune(dryRun bool) ([]PrunedView, error) {
+  pruned := make([]PrunedView, 0)
+
+  for _, d := range w.retentionDirs() {
+    views, err := d.retention.apply(d.dir, dryRun || w.cfg.DryRun)
+
+    if err != nil {
+      return nil, err
+    }
+
+    if !dryRun && !w.cfg.DryRun {
+      w.enc.audit.pruned(views)
+    }
+
+    pruned = append(pruned, views...)
+  }
+
+  return pruned, nil
+}
+
+type retentionDir struct {
+  dir       string
+  retention *Retention
+}
+
+func (w *Watcher) retentionDirs() []retentionDir {
+  var dirs []retentionDir
+
+  if w.cfg.FinishedRetention != nil {
+    dirs = append(dirs, retentionDir{w.enc.finishedDir, w.cfg.FinishedRetention})
+  }
+
+  if w.cfg.OriginalsRetention != nil {
+    dirs = append(dirs, retentionDir{w.enc.originalsDir, w.cfg.OriginalsRetention})
+  }
+
+  // trashed originals are kept for their grace period, from when they were
+  // trashed as that is when their record was written
+  if w.enc.trash != nil {
+    dirs = append(dirs, retentionDir{w.enc.trash.dir, &Retention{MaxAge: w.cfg.TrashRetention, Action: RetentionDelete}})
+  }
+
+  return dirs
+}
+
+// retain applies the retentions every retentionCheck until stop is closed
+func (w *Watcher) retain(stop <-chan struct{}) {
+  ticker := time.NewTicker(retentionCheck)
+  defer ticker.Stop()
+
+  for {
+    pruned, err := w.Prune(false)
+
+    if err != nil {
+      slog.Error("Retention error", "error", err)
+    }
+
+    for _, p := range pruned {
+      slog.Info("Pruned", "path", p.Path, "reason", p.Reason, "action", p.Action, "bytes", p.Bytes, "to", p.To)
+    }
+
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+  }
+}
+
+// prune serves POST /prune[?dry_run=true]
+func (a *api) prune(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  if len(a.w.retentionDirs()) == 0 {
+    writeError(w, http.StatusConflict, "no retention is configured")
+    return
+  }
+
+  dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+  pruned, err := a.w.Prune(dryRun)
+
+  if err != nil {
+    writeError(w, http.StatusInternalServerError, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, pruned)
+}
+
+// ParseAge reads a retention age like 30d, or a Go duration like 12h
+func ParseAge(value string) (time.Duration, error) {
+  if days, ok := strings.CutSuffix(value, "d"); ok {
+    n, err := strconv.Atoi(days)
+
+    if err != nil || n <= 0 {
+      return 0, fmt.Errorf("invalid age %q", value)
+    }
+
+    return time.Duration(n) * 24 * time.Hour, nil
+  }
+
+  d, err := time.ParseDuration(value)
+
+  if err != nil || d <= 0 {
+    return 0, fmt.Errorf("invalid age %q, it must be like 12h or 30d", value)
+  }
+
+  return d, nil
+}
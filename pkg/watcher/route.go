@@ -0,0 +1,329 @@
+package watcher
+
+import (
+  "fmt"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Route sends inputs whose ffprobe report matches When to Profile instead
+// of the one they were queued with. When is conditions joined by &&, each a
+// field on its own, which must be true or non-zero, or compared to a value:
+//
+//	height > 1080
+//	vcodec == hevc && container == mp4
+//	audio_only
+//	duration >= 2h && bitrate < 2000000
+//
+// The fields are width, height, duration (seconds or a duration like 90m),
+// bitrate (bits/s), size (bytes or like 4G), the stream counts video,
+// audio and subtitles, audio_only, vcodec and acodec (the first stream's
+// codec), container (any of ffprobe's format names) and ext, the input's
+// extension. interlaced and field_order (progressive, tt, bb, tb or bt) are
+// the first video stream's, by idet when there is a Preflight, else as the
+// container has them, telecined only by idet. channels and channel_layout
+// (like stereo or 5.1) are the first audio stream's, so interlaced inputs
+// can go to a profile with yadif and 5.1 ones to one that downmixes:
+//
+//	interlaced
+//	channels > 2
+//	channel_layout == 5.1(side)
+//
+// Numbers take == != < <= > >=, names == and !=, ignoring case. The first
+// matching route wins, a sidecar naming a profile and the pre hook still
+// have the last word
+type Route struct {
+  When    string
+  Profile string
+}
+
+// route is a Route ready to be matched
+type route struct {
+  Route
+  conds []routeCond
+}
+
+type routeCond struct {
+  field  string
+  op     string
+  value  string
+  number float64
+}
+
+// routeOps are the comparisons, longest first so <= is not read as <
+var routeOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// numericFields are the route fields compared as numbers
+var numericFields = map[string]bool{
+  "width":      true,
+  "height":     true,
+  "duration":   true,
+  "bitrate":    true,
+  "size":       true,
+  "video":      true,
+  "audio":      true,
+  "subtitles":  true,
+  "audio_only": true,
+  "interlaced": true,
+  "telecined":  true,
+  "channels":   true,
+}
+
+// nameFields are the route fields compared as names
+var nameFields = map[string]bool{
+  "vcodec":         true,
+  "acodec":         true,
+  "container":      true,
+  "ext":            true,
+  "field_order":    true,
+  "channel_layout": true,
+}
+
+// compileRoutes checks the routes and that their profiles exist
+func compileRoutes(routes []Route, profiles map[string]*Profile) ([]route, error) {
+  compiled := make([]route, 0, len(routes))
+
+  for i, r := range routes {
+    if _, ok := profiles[r.Profile]; !ok {
+      return nil, fmt.Errorf("route %d: unknown profile %q", i+1, r.Profile)
+    }
+
+    conds, err := parseWhen(r.When)
+
+    if err != nil {
+      return nil, fmt.Errorf("route %d: %s", i+1, err)
+    }
+
+    compiled = append(compiled, route{Route: r, conds: conds})
+  }
+
+  return compiled, nil
+}
+
+// parseWhen parses a route's conditions
+func parseWhen(when string) ([]routeCond, error) {
+  if strings.TrimSpace(when) == "" {
+    return nil, fmt.Errorf("a route needs a condition")
+  }
+
+  var conds []routeCond
+
+  for _, part := range strings.Split(when, "&&") {
+    c := routeCond{field: strings.TrimSpace(part)}
+
+    for _, op := range routeOps {
+      if field, value, found := strings.Cut(part, op); found {
+        c = routeCond{field: strings.TrimSpace(field), op: op, value: strings.TrimSpace(value)}
+        break
+      }
+    }
+
+    switch {
+    case numericFields[c.field]:
+      if c.op == "" {
+        c.op, c.value = "!=", "0"
+      }
+
+      var err error
+
+      if c.number, err = parseRouteNumber(c.field, c.value); err != nil {
+        return nil, err
+      }
+    case nameFields[c.field]:
+      if c.op != "==" && c.op != "!=" {
+        return nil, fmt.Errorf("%s can only be compared with == or !=", c.field)
+      }
+
+      c.value = strings.TrimPrefix(strings.ToLower(c.value), ".")
+    default:
+      return nil, fmt.Errorf("unknown field %q", c.field)
+    }
+
+    conds = append(conds, c)
+  }
+
+  return conds, nil
+}
+
+// parseRouteNumber reads a value for a numeric field, durations and sizes
+// may have units
+func parseRouteNumber(field string, value string) (float64, error) {
+  if n, err := strconv.ParseFloat(value, 64); err == nil {
+    return n, nil
+  }
+
+  switch field {
+  case "duration":
+    if d, err := time.ParseDuration(value); err == nil {
+      return d.Seconds(), nil
+    }
+  case "size":
+    if n, err := ParseSize(value); err == nil {
+      return float64(n), nil
+    }
+  }
+
+  return 0, fmt.Errorf("%s: %q is not a number", field, value)
+}
+
+// matches reports whether every condition holds for the input
+func (r route) matches(probed *probeResult, input string) bool {
+  for _, c := range r.conds {
+    if !c.matches(probed, input) {
+      return false
+    }
+  }
+
+  return true
+}
+
+func (c routeCond) matches(probed *probeResult, input string) bool {
+  if !numericFields[c.field] {
+    var names []string
+
+    switch c.field {
+    case "vcodec":
+      names = firstCodec(probed.videoStreams())
+    case "acodec":
+      names = firstCodec(probed.streams("audio"))
+    case "container":
+      names = strings.Split(probed.Format.FormatName, ",")
+    case "ext":
+      names = []string{strings.TrimPrefix(filepath.Ext(input), ".")}
+    case "field_order":
+      names = []string{probed.fieldOrder()}
+    case "channel_layout":
+      if audio := probed.streams("audio"); len(audio) > 0 {
+        names = []string{audio[0].ChannelLayout}
+      }
+    }
+
+    return containsFold(names, c.value) == (c.op == "==")
+  }
+
+  n := c.fieldValue(probed)
+
+  switch c.op {
+  case "==":
+    return n == c.number
+  case "!=":
+    return n != c.number
+  case "<":
+    return n < c.number
+  case "<=":
+    return n <= c.number
+  case ">":
+    return n > c.number
+  default:
+    return n >= c.number
+  }
+}
+
+// fieldValue is a numeric field of the report
+func (c routeCond) fieldValue(probed *probeResult) float64 {
+  video := probed.videoStreams()
+
+  switch c.field {
+  case "width", "height":
+    if len(video) == 0 {
+      return 0
+    }
+
+    if c.field == "width" {
+      return float64(video[0].Width)
+    }
+
+    return float64(video[0].Height)
+  case "duration":
+    return probed.duration().Seconds()
+  case "bitrate":
+    n, _ := strconv.ParseFloat(probed.Format.BitRate, 64)
+    return n
+  case "size":
+    n, _ := strconv.ParseFloat(probed.Format.Size, 64)
+    return n
+  case "video":
+    return float64(len(video))
+  case "audio":
+    return float64(len(probed.streams("audio")))
+  case "subtitles":
+    return float64(len(probed.streams("subtitle")))
+  case "audio_only":
+    if len(video) == 0 && len(probed.streams("audio")) > 0 {
+      return 1
+    }
+  case "interlaced":
+    if probed.interlaced() {
+      return 1
+    }
+  case "telecined":
+    if probed.interlace != nil && probed.interlace.Telecined {
+      return 1
+    }
+  case "channels":
+    if audio := probed.streams("audio"); len(audio) > 0 {
+      return float64(audio[0].Channels)
+    }
+  }
+
+  return 0
+}
+
+func firstCodec(streams []probeStream) []string {
+  if len(streams) == 0 {
+    return nil
+  }
+
+  return []string{streams[0].CodecName}
+}
+
+// routeJob switches the job to the profile of the first route its input
+// matches. A sidecar naming a profile, or a job queued with one other than
+// the default, wins over the routes
+func (e *encoder) routeJob(j *Job) {
+  profiles := e.profiles.Load()
+  routes := profiles.routes
+
+  if len(routes) == 0 || e.ffprobePath == "" || (j.spec != nil && j.spec.Profile != "") || j.requested != profiles.def {
+    return
+  }
+
+  // the pre-flight has probed the input already
+  j.mu.Lock()
+  probed := j.probed
+  j.mu.Unlock()
+
+  if probed == nil {
+    var err error
+
+    if probed, err = probe(e.ffprobePath, j.source(), j.sequenceFlags()...); err != nil {
+      j.logger().Warn("Could not probe input for routing", "error", err)
+      return
+    }
+  }
+
+  for _, r := range routes {
+    if !r.matches(probed, j.input) {
+      continue
+    }
+
+    p, ok := profiles.byName[r.Profile]
+
+    if !ok || p == j.requested {
+      return
+    }
+
+    j.logger().Info("Routed", "when", r.When, "to", p.Name)
+
+    j.mu.Lock()
+    if j.spec != nil {
+      p = j.spec.apply(p)
+    }
+    j.profile = p
+    j.mu.Unlock()
+
+    return
+  }
+}
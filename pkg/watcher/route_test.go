@@ -0,0 +1,111 @@
+package watcher
+
+import "testing"
+
+func TestParseWhen(t *testing.T) {
+  tests := []struct {
+    when  string
+    conds []routeCond
+  }{
+    {"height <= 1080", []routeCond{{field: "height", op: "<=", value: "1080", number: 1080}}},
+    {"height>=1080", []routeCond{{field: "height", op: ">=", value: "1080", number: 1080}}},
+    {"height < 720", []routeCond{{field: "height", op: "<", value: "720", number: 720}}},
+    {"width != 0", []routeCond{{field: "width", op: "!=", value: "0", number: 0}}},
+    {"interlaced", []routeCond{{field: "interlaced", op: "!=", value: "0", number: 0}}},
+    {"duration >= 90m", []routeCond{{field: "duration", op: ">=", value: "90m", number: 5400}}},
+    {"duration < 30.5", []routeCond{{field: "duration", op: "<", value: "30.5", number: 30.5}}},
+    {"size > 4G", []routeCond{{field: "size", op: ">", value: "4G", number: 4 << 30}}},
+    {"ext == .MOV", []routeCond{{field: "ext", op: "==", value: "mov"}}},
+    {"vcodec == hevc && channels > 2", []routeCond{
+      {field: "vcodec", op: "==", value: "hevc"},
+      {field: "channels", op: ">", value: "2", number: 2},
+    }},
+  }
+
+  for _, test := range tests {
+    conds, err := parseWhen(test.when)
+
+    if err != nil {
+      t.Errorf("parseWhen(%q): %s", test.when, err)
+      continue
+    }
+
+    if len(conds) != len(test.conds) {
+      t.Errorf("parseWhen(%q) = %+v, want %+v", test.when, conds, test.conds)
+      continue
+    }
+
+    for i := range conds {
+      if conds[i] != test.conds[i] {
+        t.Errorf("parseWhen(%q)[%d] = %+v, want %+v", test.when, i, conds[i], test.conds[i])
+      }
+    }
+  }
+
+  for _, when := range []string{
+    "",
+    "  ",
+    "depth > 8",
+    "height > tall",
+    "bitrate > 2M",
+    "duration > 2 hours",
+    "vcodec > hevc",
+    "vcodec",
+    "height > 720 && colour == red",
+  } {
+    if conds, err := parseWhen(when); err == nil {
+      t.Errorf("parseWhen(%q) = %+v, want an error", when, conds)
+    }
+  }
+}
+
+func TestRouteMatches(t *testing.T) {
+  // cover art is not the video stream
+  cover := probeStream{CodecType: "video", CodecName: "mjpeg", Width: 600, Height: 600}
+  cover.Disposition.AttachedPic = 1
+
+  probed := &probeResult{
+    Format: probeFormat{FormatName: "mov,mp4,m4a", Duration: "7200.5", Size: "5000000000", BitRate: "1500000"},
+    Streams: []probeStream{
+      cover,
+      {CodecType: "video", CodecName: "hevc", Width: 3840, Height: 2160, FieldOrder: "progressive"},
+      {CodecType: "audio", CodecName: "aac", Channels: 6, ChannelLayout: "5.1(side)"},
+    },
+  }
+
+  for when, want := range map[string]bool{
+    "height > 1080":                     true,
+    "height <= 2160":                    true,
+    "height < 2160":                     false,
+    "width == 3840 && height == 2160":   true,
+    "vcodec == HEVC":                    true,
+    "vcodec != hevc":                    false,
+    "container == mp4":                  true,
+    "container == mkv":                  false,
+    "ext == mov":                        true,
+    "ext != .mov":                       false,
+    "acodec == aac && channels > 2":     true,
+    "channel_layout == 5.1(side)":       true,
+    "duration >= 2h":                    true,
+    "duration > 2h1m":                   false,
+    "size > 4G":                         true,
+    "bitrate < 2000000":                 true,
+    "video == 1":                        true,
+    "audio_only":                        false,
+    "interlaced":                        false,
+    "field_order == progressive":        true,
+    "subtitles":                         false,
+    "height > 1080 && container == mkv": false,
+  } {
+    conds, err := parseWhen(when)
+
+    if err != nil {
+      t.Errorf("parseWhen(%q): %s", when, err)
+      continue
+    }
+
+    if got := (route{conds: conds}).matches(probed, "/queue/clip.MOV"); got != want {
+      t.Errorf("%q matches = %v, want %v", when, got, want)
+    }
+  }
+}
@@ -0,0 +1,664 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "crypto/md5"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "io"
+  "mime"
+  "net/http"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// S3 upload defaults, S3 does not take parts under 5M apart from the last
+const (
+  defaultMultipartThreshold = 64 << 20
+  defaultPartSize           = 16 << 20
+  minPartSize               = 5 << 20
+  maxParts                  = 10000
+  s3Attempts                = 4
+)
+
+// S3Upload delivers each job's outputs to an S3 bucket, or an S3 compatible
+// store like MinIO, once they are in the finished directory. The job is only
+// done once every output is uploaded, a failed upload fails it
+type S3Upload struct {
+  Bucket string
+
+  // Prefix goes in front of each output's path relative to the finished
+  // directory: videos gives videos/movie.mp4, packages keep their files
+  // under videos/movie/
+  Prefix string
+
+  // Endpoint is an S3 compatible service, http(s)://host:port, addressed
+  // with path style URLs. Empty is AWS in Region, default us-east-1
+  Endpoint string
+  Region   string
+
+  // StorageClass like STANDARD_IA or GLACIER_IR, empty for the bucket's
+  // default
+  StorageClass string
+
+  // AccessKey and SecretKey sign the requests, SessionToken is for
+  // temporary credentials. Without keys requests are anonymous
+  AccessKey    string
+  SecretKey    string
+  SessionToken string
+
+  // files of at least MultipartThreshold bytes, default 64M, are uploaded
+  // in parts of PartSize, default 16M
+  MultipartThreshold int64
+  PartSize           int64
+
+  // DeleteLocal removes the outputs from the finished directory once they
+  // are uploaded, otherwise KeepLocal prunes them that long afterwards,
+  // nothing else in the directory is touched. Zero for both keeps them
+  DeleteLocal bool
+  KeepLocal   time.Duration
+}
+
+// s3Client makes the few S3 calls an upload needs, signed with SigV4
+type s3Client struct {
+  cfg      S3Upload
+  http     *http.Client
+  endpoint *url.URL
+  signer   awsSigner
+
+  // pathStyle puts the bucket in the path rather than the host name
+  pathStyle bool
+}
+
+func newS3Client(cfg S3Upload) (*s3Client, error) {
+  if cfg.Bucket == "" {
+    return nil, errors.New("no bucket")
+  }
+
+  if cfg.Region == "" {
+    cfg.Region = "us-east-1"
+  }
+
+  if cfg.MultipartThreshold <= 0 {
+    cfg.MultipartThreshold = defaultMultipartThreshold
+  }
+
+  if cfg.PartSize <= 0 {
+    cfg.PartSize = defaultPartSize
+  }
+
+  if cfg.PartSize < minPartSize {
+    return nil, fmt.Errorf("part size must be at least 5M")
+  }
+
+  if cfg.DeleteLocal && cfg.KeepLocal > 0 {
+    return nil, errors.New("local outputs cannot be both deleted and kept")
+  }
+
+  c := &s3Client{
+    cfg: cfg,
+    // no overall timeout, large objects take as long as they take
+    http: &http.Client{Transport: &http.Transport{
+      Proxy:                 http.ProxyFromEnvironment,
+      ResponseHeaderTimeout: 2 * time.Minute,
+    }},
+    signer: awsSigner{service: "s3", region: cfg.Region, accessKey: cfg.AccessKey, secretKey: cfg.SecretKey, sessionToken: cfg.SessionToken},
+  }
+
+  endpoint := "https://" + cfg.Bucket + ".s3." + cfg.Region + ".amazonaws.com"
+
+  if cfg.Endpoint != "" {
+    endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+    c.pathStyle = true
+  }
+
+  var err error
+
+  if c.endpoint, err = url.Parse(endpoint); err != nil || c.endpoint.Host == "" {
+    return nil, fmt.Errorf("bad endpoint %q", cfg.Endpoint)
+  }
+
+  return c, nil
+}
+
+// key is the object key for a path relative to the finished directory
+func (c *s3Client) key(rel string) string {
+  return strings.TrimPrefix(path.Join(c.cfg.Prefix, filepath.ToSlash(rel)), "/")
+}
+
+// location is how an uploaded key is shown in logs and job views
+func (c *s3Client) location(key string) string {
+  return "s3://" + c.cfg.Bucket + "/" + key
+}
+
+// upload copies a file to key, in parts when it is large. A large file
+// resumes with the part that failed
+func (c *s3Client) upload(ctx context.Context, file string, key string, t *transfer) error {
+  f, err := os.Open(file)
+
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  info, err := f.Stat()
+
+  if err != nil {
+    return err
+  }
+
+  body := t.readerAt(f)
+
+  if info.Size() < c.cfg.MultipartThreshold {
+    header, err := payloadHeaders(c.objectHeaders(key), f, 0, info.Size())
+
+    if err != nil {
+      return err
+    }
+
+    return t.retry(func() error {
+      _, _, err := c.do(ctx, http.MethodPut, key, nil, header, body, 0, info.Size())
+      return err
+    })
+  }
+
+  return c.multipart(ctx, info.Size(), c.cfg.PartSize, key, t, func(query url.Values, offset int64, n int64) (string, error) {
+    header, err := payloadHeaders(nil, f, offset, n)
+
+    if err != nil {
+      return "", err
+    }
+
+    _, header, err = c.do(ctx, http.MethodPut, key, query, header, body, offset, n)
+
+    return header.Get("ETag"), err
+  })
+}
+
+// payloadHeaders adds the SHA-256 the request is signed with and the
+// Content-MD5 of n bytes of r from offset to header, so S3 rejects a body
+// that did not arrive as it was read. They are read from the file itself,
+// outside the delivery's pacing
+func payloadHeaders(header http.Header, r io.ReaderAt, offset int64, n int64) (http.Header, error) {
+  sum, md := sha256.New(), md5.New()
+
+  if _, err := io.Copy(io.MultiWriter(sum, md), io.NewSectionReader(r, offset, n)); err != nil {
+    return nil, err
+  }
+
+  if header == nil {
+    header = make(http.Header)
+  }
+
+  header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum.Sum(nil)))
+  header.Set("Content-Md5", base64.StdEncoding.EncodeToString(md.Sum(nil)))
+
+  return header, nil
+}
+
+// objectHeaders are set on the request creating an object
+func (c *s3Client) objectHeaders(key string) http.Header {
+  header := make(http.Header)
+
+  if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+    header.Set("Content-Type", contentType)
+  }
+
+  if c.cfg.StorageClass != "" {
+    header.Set("X-Amz-Storage-Class", c.cfg.StorageClass)
+  }
+
+  return header
+}
+
+type completedPart struct {
+  PartNumber int    `xml:"PartNumber"`
+  ETag       string `xml:"ETag"`
+}
+
+// multipart creates key from parts of partSize, each sent by part with its
+// query and retried with t, which returns the part's ETag. An upload that
+// fails is aborted so the parts are not billed
+func (c *s3Client) multipart(ctx context.Context, size int64, partSize int64, key string, t *transfer, part func(query url.Values, offset int64, n int64) (string, error)) error {
+  // S3 allows at most 10000 parts
+  if parts := (size + partSize - 1) / partSize; parts > maxParts {
+    partSize = (size + maxParts - 1) / maxParts
+  }
+
+  var body []byte
+
+  err := t.retry(func() (err error) {
+    body, _, err = c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, c.objectHeaders(key), nil, 0, 0)
+    return err
+  })
+
+  if err != nil {
+    return err
+  }
+
+  var created struct {
+    UploadID string `xml:"UploadId"`
+  }
+
+  if err = xml.Unmarshal(body, &created); err != nil || created.UploadID == "" {
+    return fmt.Errorf("starting multipart upload: no upload id")
+  }
+
+  uploadID := created.UploadID
+  var parts []completedPart
+
+  for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+    n := min(partSize, size-offset)
+    query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+
+    var etag string
+
+    err := t.retry(func() (err error) {
+      etag, err = part(query, offset, n)
+      return err
+    })
+
+    if err != nil {
+      c.abort(key, uploadID)
+      return fmt.Errorf("part %d: %s", number, err)
+    }
+
+    parts = append(parts, completedPart{PartNumber: number, ETag: etag})
+  }
+
+  complete, err := xml.Marshal(struct {
+    XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+    Parts   []completedPart `xml:"Part"`
+  }{Parts: parts})
+
+  if err != nil {
+    c.abort(key, uploadID)
+    return err
+  }
+
+  // completing can fail with a 200 and an error document
+  err = t.retry(func() (err error) {
+    body, _, err = c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(complete), 0, int64(len(complete)))
+
+    if err == nil {
+      err = s3ErrorBody(body)
+    }
+
+    return err
+  })
+
+  if err != nil {
+    c.abort(key, uploadID)
+    return fmt.Errorf("completing multipart upload: %s", err)
+  }
+
+  return nil
+}
+
+// abort gives up on a multipart upload, with a context of its own as the
+// job's may be what was cancelled
+func (c *s3Client) abort(key string, uploadID string) {
+  ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+  defer cancel()
+
+  c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, 0)
+}
+
+// do sends a signed request with n bytes of body from offset, retrying
+// network errors and 5xx responses, and returns the response body
+func (c *s3Client) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.ReaderAt, offset int64, n int64) ([]byte, http.Header, error) {
+  var lastErr error
+
+  for attempt := 0; attempt < s3Attempts; attempt++ {
+    if attempt > 0 {
+      select {
+      case <-time.After(time.Duration(1<<attempt) * time.Second):
+      case <-ctx.Done():
+        return nil, nil, ctx.Err()
+      }
+    }
+
+    var reader io.Reader
+
+    if body != nil {
+      reader = io.NewSectionReader(body, offset, n)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, method, c.url(key, query), reader)
+
+    if err != nil {
+      return nil, nil, err
+    }
+
+    req.ContentLength = n
+
+    for name, values := range header {
+      req.Header[name] = values
+    }
+
+    // bodies hashed by payloadHeaders are signed, others are not
+    payload := "UNSIGNED-PAYLOAD"
+
+    if sum := header.Get("X-Amz-Content-Sha256"); sum != "" {
+      payload = sum
+    }
+
+    c.signer.sign(req, payload, time.Now())
+
+    resp, err := c.http.Do(req)
+
+    if err != nil {
+      if ctx.Err() != nil {
+        return nil, nil, ctx.Err()
+      }
+
+      lastErr = err
+      continue
+    }
+
+    data, err := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    switch {
+    case err != nil:
+      lastErr = err
+    case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || bodyDamaged(data):
+      lastErr = s3Error(resp.Status, data)
+    case resp.StatusCode >= 300:
+      return nil, nil, permanentError{s3Error(resp.Status, data)}
+    default:
+      return data, resp.Header, nil
+    }
+  }
+
+  return nil, nil, lastErr
+}
+
+// url is the object's URL with query
+func (c *s3Client) url(key string, query url.Values) string {
+  u := *c.endpoint
+  escaped := "/" + awsEscape(key, false)
+
+  if c.pathStyle {
+    escaped = u.EscapedPath() + "/" + awsEscape(c.cfg.Bucket, false) + escaped
+  }
+
+  u.RawPath = escaped
+  u.Path, _ = url.PathUnescape(escaped)
+  u.RawQuery = canonicalQuery(query)
+
+  return u.String()
+}
+
+// s3Error is the message of an S3 error document, or the status without one
+func s3Error(status string, body []byte) error {
+  if err := s3ErrorBody(body); err != nil {
+    return fmt.Errorf("%s: %s", status, err)
+  }
+
+  return errors.New(status)
+}
+
+// bodyDamaged reports whether S3 rejected a body that did not match its
+// hashes, which sending it again can fix
+func bodyDamaged(body []byte) bool {
+  err := s3ErrorBody(body)
+
+  return err != nil && (strings.HasPrefix(err.Error(), "BadDigest ") || strings.HasPrefix(err.Error(), "XAmzContentSHA256Mismatch "))
+}
+
+func s3ErrorBody(body []byte) error {
+  var doc struct {
+    XMLName xml.Name
+    Code    string `xml:"Code"`
+    Message string `xml:"Message"`
+  }
+
+  if xml.Unmarshal(body, &doc) != nil || doc.XMLName.Local != "Error" {
+    return nil
+  }
+
+  return fmt.Errorf("%s %s", doc.Code, doc.Message)
+}
+
+// download copies the object at key to dest, retrying like do. A partial
+// download is removed
+func (c *s3Client) download(ctx context.Context, key string, dest string) error {
+  var err error
+
+  for attempt := 0; attempt < s3Attempts; attempt++ {
+    if attempt > 0 {
+      select {
+      case <-time.After(time.Duration(1<<attempt) * time.Second):
+      case <-ctx.Done():
+        return ctx.Err()
+      }
+    }
+
+    var retry bool
+
+    if retry, err = c.get(ctx, key, dest); err == nil || !retry || ctx.Err() != nil {
+      break
+    }
+  }
+
+  if err != nil {
+    os.Remove(dest)
+  }
+
+  return err
+}
+
+// get downloads the object once, reporting whether a failure is worth
+// retrying
+func (c *s3Client) get(ctx context.Context, key string, dest string) (bool, error) {
+  req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(key, nil), nil)
+
+  if err != nil {
+    return false, err
+  }
+
+  c.signer.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+
+  resp, err := c.http.Do(req)
+
+  if err != nil {
+    return true, err
+  }
+
+  defer resp.Body.Close()
+
+  if resp.StatusCode >= 300 {
+    data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+    return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, s3Error(resp.Status, data)
+  }
+
+  f, err := os.Create(dest)
+
+  if err != nil {
+    return false, err
+  }
+
+  if _, err = io.Copy(f, resp.Body); err != nil {
+    f.Close()
+    return true, err
+  }
+
+  return false, f.Close()
+}
+
+// s3CopyPartSize is the part size objects are copied in once they are too
+// large for a single copy, S3 copies at most 5G at once
+const (
+  s3MaxCopy      = 5 << 30
+  s3CopyPartSize = 512 << 20
+)
+
+// s3Storage is a bucket's prefix as a Storage, its files are the objects
+// straight under the prefix
+type s3Storage struct {
+  client *s3Client
+}
+
+func newS3Storage(u *url.URL, cfg S3Upload) (*s3Storage, error) {
+  cfg.Bucket = u.Host
+  cfg.Prefix = strings.Trim(u.Path, "/")
+
+  client, err := newS3Client(cfg)
+
+  if err != nil {
+    return nil, err
+  }
+
+  return &s3Storage{client: client}, nil
+}
+
+func (s *s3Storage) List(ctx context.Context) ([]StorageFile, error) {
+  prefix := s.client.key("")
+
+  if prefix != "" {
+    prefix += "/"
+  }
+
+  query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+  var files []StorageFile
+
+  for {
+    body, _, err := s.client.do(ctx, http.MethodGet, "", query, nil, nil, 0, 0)
+
+    if err != nil {
+      return nil, err
+    }
+
+    var result struct {
+      Contents []struct {
+        Key          string    `xml:"Key"`
+        Size         int64     `xml:"Size"`
+        LastModified time.Time `xml:"LastModified"`
+      } `xml:"Contents"`
+      IsTruncated           bool   `xml:"IsTruncated"`
+      NextContinuationToken string `xml:"NextContinuationToken"`
+    }
+
+    if err = xml.Unmarshal(body, &result); err != nil {
+      return nil, fmt.Errorf("listing %s: %s", s, err)
+    }
+
+    for _, object := range result.Contents {
+      // a folder's placeholder object
+      if name := strings.TrimPrefix(object.Key, prefix); name != "" && !strings.HasSuffix(name, "/") {
+        files = append(files, StorageFile{Name: name, Size: object.Size, ModTime: object.LastModified})
+      }
+    }
+
+    if !result.IsTruncated || result.NextContinuationToken == "" {
+      return files, nil
+    }
+
+    query.Set("continuation-token", result.NextContinuationToken)
+  }
+}
+
+func (s *s3Storage) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+  return pollStorage(ctx, interval), nil
+}
+
+func (s *s3Storage) Read(ctx context.Context, name string, dest string) error {
+  return s.client.download(ctx, s.client.key(name), dest)
+}
+
+func (s *s3Storage) Write(ctx context.Context, src string, name string) error {
+  return s.client.upload(ctx, src, s.client.key(name), nil)
+}
+
+// Move copies the object to the key in dir, relative to the prefix unless
+// absolute, then deletes it. S3 has no rename
+func (s *s3Storage) Move(ctx context.Context, name string, dir string) error {
+  from := s.client.key(name)
+  to := strings.TrimPrefix(path.Join(dir, path.Base(name)), "/")
+
+  if !path.IsAbs(dir) {
+    to = s.client.key(path.Join(dir, path.Base(name)))
+  }
+
+  if err := s.client.copy(ctx, from, to); err != nil {
+    return err
+  }
+
+  return s.Delete(ctx, name)
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+  _, _, err := s.client.do(ctx, http.MethodDelete, s.client.key(name), nil, nil, nil, 0, 0)
+
+  return err
+}
+
+func (s *s3Storage) String() string {
+  return s.client.location(s.client.key(""))
+}
+
+// copy copies the object at from to to in the same bucket, in parts when it
+// is too large for one copy
+func (c *s3Client) copy(ctx context.Context, from string, to string) error {
+  _, header, err := c.do(ctx, http.MethodHead, from, nil, nil, nil, 0, 0)
+
+  if err != nil {
+    return err
+  }
+
+  size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+  source := make(http.Header)
+  source.Set("X-Amz-Copy-Source", "/"+awsEscape(c.cfg.Bucket, false)+"/"+awsEscape(from, false))
+
+  // a copy can fail with a 200 and an error document, its parts too
+  copied := func(query url.Values, header http.Header) (string, error) {
+    body, _, err := c.do(ctx, http.MethodPut, to, query, header, nil, 0, 0)
+
+    if err == nil {
+      err = s3ErrorBody(body)
+    }
+
+    if err != nil {
+      return "", err
+    }
+
+    var result struct {
+      ETag string `xml:"ETag"`
+    }
+
+    xml.Unmarshal(body, &result)
+
+    return result.ETag, nil
+  }
+
+  if size <= s3MaxCopy {
+    header := c.objectHeaders(to)
+
+    for name, values := range source {
+      header[name] = values
+    }
+
+    _, err = copied(nil, header)
+
+    return err
+  }
+
+  return c.multipart(ctx, size, s3CopyPartSize, to, nil, func(query url.Values, offset int64, n int64) (string, error) {
+    header := source.Clone()
+    header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+
+    return copied(query, header)
+  })
+}
@@ -0,0 +1,140 @@
+package watcher
+
+import (
+  "bytes"
+  "path/filepath"
+)
+
+// salvageTolerant and salvageCopy are how a job was salvaged, see
+// Salvage. The output is tagged degraded with it
+const (
+  salvageTolerant = "tolerant"
+  salvageCopy     = "copy"
+)
+
+// defaultSalvageErrors are what ffmpeg prints about a corrupt input, like a
+// field recording cut short or with a damaged stretch
+var defaultSalvageErrors = []string{
+  "Invalid data found when processing input",
+  "error while decoding",
+  "corrupt decoded frame",
+  "Packet corrupt",
+  "Invalid NAL unit",
+  "Error splitting the input into NAL units",
+  "decode_slice_header error",
+  "non-existing PPS",
+  "Header missing",
+  "moov atom not found",
+}
+
+// defaultSalvageFlags have the decoders carry on past corrupt data and
+// drop the packets it is in
+var defaultSalvageFlags = []string{"-err_detect", "ignore_err", "-fflags", "+discardcorrupt+genpts"}
+
+// Salvage retries an encode that failed on a corrupt input with the
+// decoders told to carry on past what they cannot read, and with Copy, when
+// that fails too, stream copies the input's video and audio into the first
+// output instead. A salvaged job is done but degraded: the outputs get a
+// degraded metadata tag (kept in mp4 only with -movflags +use_metadata_tags)
+// and the job, its events and the chats say so. It does not apply to steps
+// or command profiles, Copy not to packaging ones or image sequences
+type Salvage struct {
+  // Errors are what in ffmpeg's output marks the input as corrupt, a
+  // failure without any of them is not salvaged. Default
+  // defaultSalvageErrors
+  Errors []string
+
+  // InputFlags go ahead of the profile's input flags for the retry,
+  // default -err_detect ignore_err -fflags +discardcorrupt+genpts
+  InputFlags []string
+
+  Copy bool
+}
+
+// corrupt reports whether ffmpeg's output says the input is corrupt
+func (s *Salvage) corrupt(log []byte) bool {
+  errors := s.Errors
+
+  if len(errors) == 0 {
+    errors = defaultSalvageErrors
+  }
+
+  for _, e := range errors {
+    if bytes.Contains(log, []byte(e)) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// nextSalvage is how a job whose encode failed with log is tried again, ""
+// when it is not
+func (j *Job) nextSalvage(log []byte) string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  s := j.profile.Salvage
+
+  if s == nil || len(j.profile.pipeline()) > 0 {
+    return ""
+  }
+
+  switch j.degraded {
+  case "":
+    if s.corrupt(log) {
+      return salvageTolerant
+    }
+  case salvageTolerant:
+    if s.Copy && j.profile.Packaging == "" && j.sequence == nil {
+      return salvageCopy
+    }
+  }
+
+  return ""
+}
+
+// degradedBy is how the job was salvaged, "" when it was not
+func (j *Job) degradedBy() string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  return j.degraded
+}
+
+// salvageFlags are the input flags and output flags a salvaged job's runs
+// get on top of their own
+func (j *Job) salvageFlags() (input []string, output []string) {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.degraded == "" {
+    return nil, nil
+  }
+
+  input = j.profile.Salvage.InputFlags
+
+  if len(input) == 0 {
+    input = defaultSalvageFlags
+  }
+
+  return input, []string{"-metadata", "degraded=" + j.degraded}
+}
+
+// planSalvageCopy stream copies the input's video and audio into the first
+// rendition's output, what is left to keep of an input that cannot be
+// encoded
+func (e *encoder) planSalvageCopy(j *Job, probed *probeResult) encodePlan {
+  r := e.renditions(j, probed)[0]
+  out := filepath.Join(e.jobDir(j), j.profile.outputName(j.name, r, probed, j.startedAt))
+  input, output := j.salvageFlags()
+
+  args := concat(input, []string{"-i", j.source(), "-map", "0:v?", "-map", "0:a?", "-c", "copy"})
+  args = concat(concat(args, e.metadataFlags(j, probed, 0)), output)
+
+  return encodePlan{runs: []ffmpegRun{{
+    name:    "salvage copy",
+    args:    append(args, out),
+    outputs: []string{out},
+  }}}
+}
@@ -0,0 +1,241 @@
+package watcher
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "runtime"
+  "strings"
+  "sync/atomic"
+)
+
+// SandboxMode is what contains each ffmpeg
+type SandboxMode string
+
+const (
+  // SandboxBwrap runs ffmpeg with bubblewrap in new Linux namespaces: no
+  // network, its own processes, and a filesystem of the system directories
+  // read-only, the files it reads and the directories it writes
+  SandboxBwrap SandboxMode = "bwrap"
+
+  // SandboxDocker and SandboxPodman run every ffmpeg in a throwaway
+  // container of Image, read-only but for the same files, without network
+  // or capabilities
+  SandboxDocker SandboxMode = "docker"
+  SandboxPodman SandboxMode = "podman"
+)
+
+// Sandbox contains the ffmpeg runs so that a decoder exploited by a hostile
+// input reaches little. ffprobe, which only reads the headers, and
+// pipeline programs other than ffmpeg still run directly
+type Sandbox struct {
+  Mode SandboxMode
+
+  // Command is the bwrap, docker or podman binary, by default Mode on PATH
+  Command string
+
+  // Image is the container image, which must have Program on its PATH,
+  // ffmpeg by default, and any profile's FFmpegPath
+  Image   string
+  Program string
+
+  // Network keeps the host's network, for outputs streamed somewhere
+  Network bool
+
+  // Devices are passed through, like /dev/dri for hardware encoding
+  Devices []string
+
+  // Args are more flags for bwrap or docker/podman run, before the
+  // program, like --memory=4g
+  Args []string
+}
+
+// sandboxRuns numbers the containers so runs of one job do not clash
+var sandboxRuns atomic.Int64
+
+// check fills in the defaults and rejects a sandbox that cannot work here
+func (s *Sandbox) check() error {
+  switch s.Mode {
+  case SandboxBwrap:
+    if runtime.GOOS != "linux" {
+      return errors.New("bwrap needs Linux")
+    }
+  case SandboxDocker, SandboxPodman:
+    if s.Image == "" {
+      return fmt.Errorf("%s needs an image", s.Mode)
+    }
+
+    if s.Program == "" {
+      s.Program = "ffmpeg"
+    }
+  default:
+    return fmt.Errorf("mode must be bwrap, docker or podman, not %q", s.Mode)
+  }
+
+  if s.Command == "" {
+    s.Command = string(s.Mode)
+  }
+
+  if _, err := exec.LookPath(s.Command); err != nil {
+    return err
+  }
+
+  return nil
+}
+
+// container reports whether ffmpeg runs in a container, not on the host
+func (s *Sandbox) container() bool {
+  return s.Mode == SandboxDocker || s.Mode == SandboxPodman
+}
+
+// sandboxMounts are the paths a sandboxed ffmpeg sees besides the system:
+// reads read-only and writes read-write, at the same paths as on the host
+type sandboxMounts struct {
+  reads  []string
+  writes []string
+}
+
+// jobMounts are the mounts of a run: it writes the working directory and
+// the run's own directories, and reads the input, the watermark and every
+// argument that is a file or directory outside of those
+func (e *encoder) jobMounts(j *Job, run ffmpegRun) sandboxMounts {
+  m := sandboxMounts{writes: append([]string{e.workingDir}, run.dirs...)}
+  reads := []string{j.source()}
+
+  if j.sequence != nil {
+    reads = []string{j.sequence.dir}
+  }
+
+  if w := j.profile.Watermark; w != nil && w.Image != "" {
+    reads = append(reads, w.Image)
+  }
+
+  for _, arg := range run.args {
+    if filepath.IsAbs(arg) {
+      reads = append(reads, arg)
+    }
+  }
+
+  seen := make(map[string]bool)
+
+  for _, path := range reads {
+    path = filepath.Clean(path)
+
+    if seen[path] || m.writable(path) {
+      continue
+    }
+
+    seen[path] = true
+
+    if _, err := os.Stat(path); err == nil {
+      m.reads = append(m.reads, path)
+    }
+  }
+
+  return m
+}
+
+// writable reports whether path is in one of the writable directories
+func (m sandboxMounts) writable(path string) bool {
+  for _, dir := range m.writes {
+    if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// wrap returns the command running ffmpeg with args in the sandbox, and
+// what to run once it has exited. In a container ffmpegPath is the program
+// in the image. name is unique to the run, runAs the user ffmpeg runs as in
+// a container, gowatcher's own without it. env is passed into a container,
+// bwrap keeps the environment it is run with
+func (s *Sandbox) wrap(ffmpegPath string, args []string, m sandboxMounts, name string, runAs *owner, env []string) (string, []string, func(failed bool)) {
+  if !s.container() {
+    return s.Command, s.bwrapArgs(ffmpegPath, args, m), func(bool) {}
+  }
+
+  container := fmt.Sprintf("%s-%d", name, sandboxRuns.Add(1))
+  uid, gid := os.Geteuid(), os.Getegid()
+
+  if runAs != nil {
+    uid, gid = runAs.uid, runAs.gid
+  }
+
+  flags := []string{
+    "run", "--rm", "--name", container,
+    "--read-only", "--tmpfs", "/tmp",
+    "--cap-drop", "ALL", "--security-opt", "no-new-privileges",
+    "--pids-limit", "256",
+    "--user", fmt.Sprintf("%d:%d", uid, gid),
+    "--workdir", m.writes[0],
+    "--entrypoint", ffmpegPath,
+  }
+
+  if !s.Network {
+    flags = append(flags, "--network", "none")
+  }
+
+  for _, path := range m.reads {
+    flags = append(flags, "--volume", path+":"+path+":ro")
+  }
+
+  for _, dir := range m.writes {
+    flags = append(flags, "--volume", dir+":"+dir)
+  }
+
+  for _, device := range s.Devices {
+    flags = append(flags, "--device", device)
+  }
+
+  for _, v := range env {
+    flags = append(flags, "--env", v)
+  }
+
+  flags = append(append(append(flags, s.Args...), s.Image), args...)
+
+  // killing the client leaves the container running
+  return s.Command, flags, func(failed bool) {
+    if failed {
+      _ = exec.Command(s.Command, "rm", "--force", container).Run()
+    }
+  }
+}
+
+// bwrapSystem are the host directories a bwrap sandbox sees read-only, for
+// ffmpeg's libraries, fonts and config
+var bwrapSystem = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/etc", "/opt"}
+
+func (s *Sandbox) bwrapArgs(ffmpegPath string, args []string, m sandboxMounts) []string {
+  flags := []string{"--unshare-all", "--die-with-parent", "--new-session"}
+
+  if s.Network {
+    flags = append(flags, "--share-net")
+  }
+
+  // mounts go on in order, the binds after /tmp so they can be in it
+  flags = append(flags, "--proc", "/proc", "--dev", "/dev", "--tmpfs", "/tmp")
+
+  for _, dir := range append(bwrapSystem, filepath.Dir(ffmpegPath)) {
+    flags = append(flags, "--ro-bind-try", dir, dir)
+  }
+
+  for _, path := range m.reads {
+    flags = append(flags, "--ro-bind", path, path)
+  }
+
+  for _, dir := range m.writes {
+    flags = append(flags, "--bind", dir, dir)
+  }
+
+  for _, device := range s.Devices {
+    flags = append(flags, "--dev-bind-try", device, device)
+  }
+
+  flags = append(append(flags, "--chdir", m.writes[0]), s.Args...)
+
+  return append(append(flags, "--", ffmpegPath), args...)
+}
@@ -0,0 +1,201 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "strings"
+  "time"
+)
+
+// scheduleCheckInterval is how often the schedule is checked for changes
+const scheduleCheckInterval = 30 * time.Second
+
+// Schedule is when new encodes may start, files are queued at any time.
+// It is a list of windows separated by ";", each with optional days and an
+// optional time range in local time:
+//
+//	22:00-07:00             every night, the range may cross midnight
+//	mon-fri 22:00-07:00     weeknights, starting on the listed days
+//	sat,sun                 all day at weekends
+//	22:00-07:00; sat,sun    both
+type Schedule struct {
+  windows []scheduleWindow
+}
+
+// scheduleWindow allows encodes from start to end, minutes since midnight,
+// starting on the days set
+type scheduleWindow struct {
+  days  [7]bool
+  start int
+  end   int
+}
+
+var weekdays = map[string]time.Weekday{
+  "sun": time.Sunday,
+  "mon": time.Monday,
+  "tue": time.Tuesday,
+  "wed": time.Wednesday,
+  "thu": time.Thursday,
+  "fri": time.Friday,
+  "sat": time.Saturday,
+}
+
+// ParseSchedule parses a schedule such as "22:00-07:00; sat,sun"
+func ParseSchedule(value string) (*Schedule, error) {
+  s := &Schedule{}
+
+  for _, entry := range strings.Split(value, ";") {
+    if entry = strings.TrimSpace(entry); entry == "" {
+      continue
+    }
+
+    w, err := parseWindow(entry)
+
+    if err != nil {
+      return nil, fmt.Errorf("schedule %q: %s", entry, err)
+    }
+
+    s.windows = append(s.windows, w)
+  }
+
+  if len(s.windows) == 0 {
+    return nil, fmt.Errorf("schedule %q has no windows", value)
+  }
+
+  return s, nil
+}
+
+func parseWindow(entry string) (scheduleWindow, error) {
+  w := scheduleWindow{start: 0, end: 24 * 60}
+  days := false
+  times := false
+
+  for _, field := range strings.Fields(entry) {
+    if strings.Contains(field, ":") {
+      if times {
+        return w, fmt.Errorf("more than one time range")
+      }
+
+      from, to, found := strings.Cut(field, "-")
+
+      if !found {
+        return w, fmt.Errorf("time range %q needs a start and end", field)
+      }
+
+      var err error
+
+      if w.start, err = parseClock(from); err != nil {
+        return w, err
+      }
+
+      if w.end, err = parseClock(to); err != nil {
+        return w, err
+      }
+
+      times = true
+      continue
+    }
+
+    for _, part := range strings.Split(strings.ToLower(field), ",") {
+      from, to, isRange := strings.Cut(part, "-")
+      first, ok := weekdays[from]
+
+      if !ok {
+        return w, fmt.Errorf("unknown day %q", from)
+      }
+
+      last := first
+
+      if isRange {
+        if last, ok = weekdays[to]; !ok {
+          return w, fmt.Errorf("unknown day %q", to)
+        }
+      }
+
+      for d := first; ; d = (d + 1) % 7 {
+        w.days[d] = true
+
+        if d == last {
+          break
+        }
+      }
+    }
+
+    days = true
+  }
+
+  if !days {
+    for d := range w.days {
+      w.days[d] = true
+    }
+  }
+
+  return w, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight, 24:00 is the end of
+// the day
+func parseClock(value string) (int, error) {
+  var hour, minute int
+
+  if _, err := fmt.Sscanf(value, "%d:%d", &hour, &minute); err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+    return 0, fmt.Errorf("bad time %q", value)
+  }
+
+  return hour*60 + minute, nil
+}
+
+// Allows reports whether encodes may start at t
+func (s *Schedule) Allows(t time.Time) bool {
+  minute := t.Hour()*60 + t.Minute()
+  today := t.Weekday()
+  yesterday := (today + 6) % 7
+
+  for _, w := range s.windows {
+    if w.start <= w.end {
+      if w.days[today] && minute >= w.start && minute < w.end {
+        return true
+      }
+
+      continue
+    }
+
+    // the window crosses midnight, its second half belongs to the day before
+    if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// followSchedule holds the queue outside the schedule until stop is closed
+func (w *Watcher) followSchedule(stop <-chan struct{}) {
+  apply := func() {
+    allowed := w.cfg.Schedule.Allows(time.Now())
+
+    if w.queue.setHeld(!allowed) {
+      if allowed {
+        slog.Info("Inside the encoding schedule, starting queued jobs")
+      } else {
+        slog.Info("Outside the encoding schedule, holding queued jobs")
+      }
+    }
+  }
+
+  apply()
+
+  go func() {
+    ticker := time.NewTicker(scheduleCheckInterval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        apply()
+      case <-stop:
+        return
+      }
+    }
+  }()
+}
@@ -0,0 +1,68 @@
+package watcher
+
+import (
+  "testing"
+  "time"
+)
+
+func TestScheduleAllows(t *testing.T) {
+  // 1 January 2024 was a Monday
+  at := func(day int, hour int, minute int) time.Time {
+    return time.Date(2024, time.January, day, hour, minute, 0, 0, time.Local)
+  }
+
+  tests := []struct {
+    schedule string
+    at       time.Time
+    allows   bool
+  }{
+    {"22:00-07:00", at(1, 23, 0), true},
+    {"22:00-07:00", at(2, 6, 59), true},
+    {"22:00-07:00", at(2, 7, 0), false},
+    {"22:00-07:00", at(1, 21, 59), false},
+    {"09:00-17:00", at(1, 9, 0), true},
+    {"09:00-17:00", at(1, 17, 0), false},
+    {"00:00-24:00", at(1, 23, 59), true},
+    {"sat,sun", at(6, 12, 0), true},
+    {"sat,sun", at(5, 12, 0), false},
+    // a night belongs to the day it starts on
+    {"mon-fri 22:00-07:00", at(6, 6, 0), true},
+    {"mon-fri 22:00-07:00", at(7, 6, 0), false},
+    {"mon-fri 22:00-07:00", at(6, 23, 0), false},
+    // ranges of days wrap around the week
+    {"fri-mon", at(1, 12, 0), true},
+    {"fri-mon", at(3, 12, 0), false},
+    {"22:00-07:00; sat,sun", at(3, 12, 0), false},
+    {"22:00-07:00; sat,sun", at(7, 12, 0), true},
+    {"22:00-07:00; sat,sun", at(3, 3, 0), true},
+  }
+
+  for _, test := range tests {
+    s, err := ParseSchedule(test.schedule)
+
+    if err != nil {
+      t.Fatalf("ParseSchedule(%q): %s", test.schedule, err)
+    }
+
+    if allows := s.Allows(test.at); allows != test.allows {
+      t.Errorf("%q allows %s: %v, want %v", test.schedule, test.at.Format("Mon 15:04"), allows, test.allows)
+    }
+  }
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+  for _, schedule := range []string{
+    "",
+    " ; ",
+    "22:00",
+    "22:00-25:00",
+    "22:60-23:00",
+    "22:00-23:00 01:00-02:00",
+    "someday",
+    "mon-funday",
+  } {
+    if _, err := ParseSchedule(schedule); err == nil {
+      t.Errorf("ParseSchedule(%q) did not fail", schedule)
+    }
+  }
+}
@@ -0,0 +1,356 @@
+package watcher
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// defaultSequenceFrameRate is the frame rate of image sequences when
+// SequenceFrameRate and their sidecar leave it out
+const defaultSequenceFrameRate = "24"
+
+// sequenceSettle is how long nothing in a directory of frames must change
+// before it is queued, a vendor's upload writes frame after frame
+const sequenceSettle = 5 * time.Second
+
+// sequenceContainer is the extension of an image sequence's outputs when
+// the profile sets none, a directory has no extension to keep
+const sequenceContainer = "mov"
+
+// sequenceExtensions are the image formats ffmpeg's image2 demuxer reads a
+// sequence of
+var sequenceExtensions = map[string]bool{
+  ".exr":  true,
+  ".dpx":  true,
+  ".tif":  true,
+  ".tiff": true,
+  ".png":  true,
+  ".jpg":  true,
+  ".jpeg": true,
+  ".tga":  true,
+  ".bmp":  true,
+  ".cin":  true,
+  ".sgi":  true,
+  ".jp2":  true,
+  ".webp": true,
+}
+
+// errNoFrames is findSequence's error for a directory without frames
+var errNoFrames = errors.New("no image frames")
+
+// sequenceFrame splits a frame's name into what comes before its number,
+// the number and the extension: shot_010.1001.exr
+var sequenceFrame = regexp.MustCompile(`^(.*?)([0-9]+)(\.[A-Za-z0-9]+)$`)
+
+// imageSequence is a directory of numbered frames dropped into a queue
+// directory, rendered into video with the image2 demuxer. pattern is the
+// frames' path with the number replaced by a %d verb, like
+// /queue/shot_010/shot_010.%04d.exr, the frames run from start to end
+type imageSequence struct {
+  dir       string
+  pattern   string
+  start     int
+  end       int
+  frames    int
+  bytes     int64
+  frameRate string
+}
+
+// findSequence finds the frames in dir, those matching pattern, e.g.
+// shot.%04d.exr, when it is set, else the largest set of frames sharing a
+// name and extension. Every frame from the first to the last must be there
+func findSequence(dir string, pattern string) (*imageSequence, error) {
+  entries, err := os.ReadDir(dir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  type group struct {
+    prefix  string
+    ext     string
+    numbers map[int]string
+    bytes   int64
+  }
+
+  groups := make(map[string]*group)
+
+  for _, entry := range entries {
+    if !entry.Type().IsRegular() || hidden(entry.Name()) {
+      continue
+    }
+
+    m := sequenceFrame.FindStringSubmatch(entry.Name())
+
+    if m == nil || !sequenceExtensions[strings.ToLower(m[3])] {
+      continue
+    }
+
+    n, err := strconv.Atoi(m[2])
+
+    if err != nil {
+      continue
+    }
+
+    key := m[1] + "\x00" + m[3]
+    g := groups[key]
+
+    if g == nil {
+      g = &group{prefix: m[1], ext: m[3], numbers: make(map[int]string)}
+      groups[key] = g
+    }
+
+    g.numbers[n] = m[2]
+
+    if info, err := entry.Info(); err == nil {
+      g.bytes += info.Size()
+    }
+  }
+
+  var best *group
+  var bestPattern string
+
+  keys := make([]string, 0, len(groups))
+
+  for key := range groups {
+    keys = append(keys, key)
+  }
+
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    g := groups[key]
+    verb, err := frameVerb(g.numbers)
+
+    if err != nil {
+      return nil, fmt.Errorf("frames %s*%s: %s", g.prefix, g.ext, err)
+    }
+
+    name := g.prefix + verb + g.ext
+
+    if pattern != "" {
+      if name == pattern {
+        best, bestPattern = g, name
+      }
+
+      continue
+    }
+
+    if best == nil || len(g.numbers) > len(best.numbers) {
+      best, bestPattern = g, name
+    }
+  }
+
+  if best == nil && pattern != "" {
+    return nil, fmt.Errorf("no frames match %s", pattern)
+  }
+
+  if best == nil {
+    return nil, errNoFrames
+  }
+
+  s := &imageSequence{dir: dir, pattern: filepath.Join(dir, bestPattern), frames: len(best.numbers), bytes: best.bytes, frameRate: defaultSequenceFrameRate}
+  first := true
+
+  for n := range best.numbers {
+    if first || n < s.start {
+      s.start = n
+    }
+
+    if first || n > s.end {
+      s.end = n
+    }
+
+    first = false
+  }
+
+  // image2 stops at the first frame missing, it would render half the shot
+  if missing := s.end - s.start + 1 - s.frames; missing > 0 {
+    for n := s.start; n <= s.end; n++ {
+      if _, ok := best.numbers[n]; !ok {
+        return nil, fmt.Errorf("%s: %d of frames %d-%d are missing, the first is %d", bestPattern, missing, s.start, s.end, n)
+      }
+    }
+  }
+
+  return s, nil
+}
+
+// frameVerb is the printf verb the frames' numbers are written with: %04d
+// for numbers padded to four digits, %d when they are not padded
+func frameVerb(numbers map[int]string) (string, error) {
+  width, padded, same := 0, false, true
+
+  for _, digits := range numbers {
+    if width == 0 {
+      width = len(digits)
+    } else if len(digits) != width {
+      same = false
+    }
+
+    if len(digits) > 1 && digits[0] == '0' {
+      padded = true
+    }
+  }
+
+  switch {
+  case same && width > 1:
+    return fmt.Sprintf("%%0%dd", width), nil
+  case same:
+    return "%d", nil
+  case padded:
+    return "", fmt.Errorf("the frame numbers are not all padded to the same width")
+  default:
+    return "%d", nil
+  }
+}
+
+// inputFlags are ffmpeg's input flags reading the frames at the frame rate
+func (s *imageSequence) inputFlags() []string {
+  return []string{"-f", "image2", "-framerate", s.frameRate, "-start_number", strconv.Itoa(s.start)}
+}
+
+// checkFrameRate rejects a frame rate that is not a positive number or
+// fraction
+func checkFrameRate(rate string) error {
+  if parseFrameRate(rate) <= 0 {
+    return fmt.Errorf("frame rate %q must be a positive number or fraction like 24000/1001", rate)
+  }
+
+  return nil
+}
+
+// sequenceFlags are the input flags reading the job's image sequence, nil
+// for any other input
+func (j *Job) sequenceFlags() []string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.sequence == nil {
+    return nil
+  }
+
+  return j.sequence.inputFlags()
+}
+
+// resolveSequence finds the frames of a job whose input is a directory. The
+// input's sidecar can pick the frames with sequence if there is more than
+// one set and set their frame_rate, a bad sidecar is reported once it is
+// applied
+func (e *encoder) resolveSequence(j *Job) error {
+  j.mu.Lock()
+  dir := j.input
+
+  if j.target != "" {
+    dir = j.target
+  }
+  j.mu.Unlock()
+
+  info, err := os.Stat(dir)
+
+  if err != nil || !info.IsDir() {
+    return nil
+  }
+
+  pattern, rate := "", e.sequenceFrameRate
+
+  if path := findSpec(j.input); path != "" {
+    if s, err := loadSpec(path); err == nil {
+      pattern = s.Sequence
+
+      if s.FrameRate != "" {
+        rate = s.FrameRate
+      }
+    }
+  }
+
+  s, err := findSequence(dir, pattern)
+
+  if err != nil {
+    return err
+  }
+
+  if rate != "" {
+    s.frameRate = rate
+  }
+
+  j.logger().Info("Image sequence", "frames", filepath.Base(s.pattern), "first", s.start, "last", s.end, "frame_rate", s.frameRate)
+
+  j.mu.Lock()
+
+  // the outputs are named after the directory, in a container the profile
+  // can replace like any input's
+  if j.sequence == nil {
+    j.name += "." + sequenceContainer
+  }
+
+  j.sequence = s
+  j.mu.Unlock()
+
+  return nil
+}
+
+// lastChange is when the directory or a file in it was last modified,
+// adding a frame changes both
+func lastChange(dir string) (time.Time, error) {
+  info, err := os.Stat(dir)
+
+  if err != nil {
+    return time.Time{}, err
+  }
+
+  latest := info.ModTime()
+
+  entries, err := os.ReadDir(dir)
+
+  if err != nil {
+    return latest, err
+  }
+
+  for _, entry := range entries {
+    if info, err := entry.Info(); err == nil && info.ModTime().After(latest) {
+      latest = info.ModTime()
+    }
+  }
+
+  return latest, nil
+}
+
+// settledSequence reports whether a directory found in a queue directory
+// holds frames and nothing in it has changed for sequenceSettle, or
+// MinFileAge if longer, else it is checked again once it could have. A
+// directory without frames is ignored, one whose frames are not a
+// sequence is queued to fail with the reason
+func (w *Watcher) settledSequence(dir string) bool {
+  if dir == w.priorityDir {
+    return false
+  }
+
+  changed, err := lastChange(dir)
+
+  if err != nil {
+    return false
+  }
+
+  wait := max(sequenceSettle, w.cfg.MinFileAge)
+
+  if age := time.Since(changed); age < wait {
+    w.settleLater(dir, wait-age)
+    return false
+  }
+
+  if _, err := findSequence(dir, ""); errors.Is(err, errNoFrames) {
+    slog.Debug("Ignoring directory without image frames", "input", dir)
+    return false
+  }
+
+  return true
+}
@@ -0,0 +1,155 @@
+package watcher
+
+import (
+  "log/slog"
+  "os"
+  "time"
+)
+
+// found queues a file the watchers or a scan saw in a queue directory, once
+// however often it is seen, when it is at least MinFileSize bytes and has
+// not been modified for MinFileAge, or with Growing once it is done growing
+// or can be followed. Files still being written are checked again when they
+// would be old enough, files that are too small are left until they change.
+// A directory is queued as an image sequence once it has settled
+func (w *Watcher) found(path string) {
+  // the events of a transfer still writing do not count as activity either
+  if w.filter.Load().ignored(path) {
+    slog.Debug("Ignoring file still being written", "file", path)
+    return
+  }
+
+  w.touch()
+
+  w.foundMu.Lock()
+  defer w.foundMu.Unlock()
+
+  if isSidecar(path) || w.isCompanion(path) || w.store.tracked(path) || !w.linkQueueable(path) {
+    return
+  }
+
+  if w.intakeHeld() {
+    w.overflow(path)
+    return
+  }
+
+  if info, err := os.Stat(path); err == nil && info.IsDir() {
+    if w.settledSequence(path) {
+      w.enqueueFound(path)
+    }
+
+    return
+  }
+
+  if w.cfg.Growing != nil && !w.settledGrowth(path) {
+    return
+  }
+
+  minAge := w.cfg.MinFileAge
+
+  // a followed capture is encoded while it grows
+  if w.cfg.Growing != nil && w.cfg.Growing.Mode == GrowingFollow {
+    minAge = 0
+  }
+
+  if w.cfg.MinFileSize <= 0 && minAge <= 0 {
+    w.enqueueFound(path)
+    return
+  }
+
+  info, err := os.Stat(path)
+
+  if err != nil || info.IsDir() {
+    return
+  }
+
+  // a copy starts out empty, so the size is only checked once it settled
+  if age := time.Since(info.ModTime()); age < minAge {
+    w.settleLater(path, minAge-age)
+    return
+  }
+
+  if info.Size() < w.cfg.MinFileSize {
+    slog.Info("Ignoring small file", "input", path, "size", info.Size(), "min", w.cfg.MinFileSize)
+    return
+  }
+
+  w.enqueueFound(path)
+}
+
+// enqueueFound queues a found file that settled once its companions are
+// there and it has the name Filenames gives it, or holds it for approval,
+// or with Archives unpacks an archive to queue what is in it
+func (w *Watcher) enqueueFound(path string) {
+  if w.cfg.Archives != nil && isArchive(path) {
+    w.unpackFound(path)
+    return
+  }
+
+  if !w.companionsReady(path) || w.renameFound(path) {
+    return
+  }
+
+  if w.cfg.Approval {
+    w.holdForApproval(path)
+    return
+  }
+
+  w.Enqueue(path)
+}
+
+// settleLater checks path again after wait, once however often it is seen
+// in the meantime
+func (w *Watcher) settleLater(path string, wait time.Duration) {
+  if _, pending := w.settling.LoadOrStore(path, true); pending {
+    return
+  }
+
+  slog.Debug("Waiting for file to settle", "input", path, "wait", wait.Round(time.Second).String())
+
+  time.AfterFunc(wait, func() {
+    w.settling.Delete(path)
+
+    select {
+    case <-w.stopRescan:
+    default:
+      w.found(path)
+    }
+  })
+}
+
+// gone cancels the job of a file removed from a queue directory, whether it
+// is still queued or running. Jobs whose input gowatcher moved have its new
+// path and are left alone
+func (w *Watcher) gone(path string) {
+  w.touch()
+  w.badLinks.Delete(path)
+  w.sizes.Delete(path)
+  w.awaiting.Delete(path)
+  w.pending.Delete(path)
+  w.badNames.Delete(path)
+
+  j := w.store.byPath(path)
+
+  if j == nil {
+    return
+  }
+
+  j.mu.Lock()
+  input, state := j.input, j.state
+  j.mu.Unlock()
+
+  if input != path || (state != JobQueued && state != JobRunning) {
+    return
+  }
+
+  if _, err := os.Stat(path); !os.IsNotExist(err) {
+    return
+  }
+
+  j.logger().Warn("Input removed from the queue, cancelling")
+
+  if err := stopJob(w.queue, j, errInputRemoved); err != nil {
+    j.logger().Warn("Could not cancel job", "error", err)
+  }
+}
@@ -0,0 +1,201 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "net/url"
+  "os/exec"
+  "path"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// sftpConn runs the OpenSSH sftp client in batch mode, one process per
+// operation. It authenticates with keys only, the identity file or the key
+// ssh would use, and the host must be in known_hosts
+type sftpConn struct {
+  ctx     context.Context
+  command string
+  args    []string
+
+  // dir is the watched directory, sftp://host/path is absolute and
+  // sftp://host/~/path relative to the home directory
+  dir string
+}
+
+func dialSFTP(ctx context.Context, u *url.URL, command string, identity string) (*sftpConn, error) {
+  if _, ok := u.User.Password(); ok {
+    return nil, fmt.Errorf("sftp only authenticates with keys, remove the password from the URL")
+  }
+
+  if command == "" {
+    command = "sftp"
+  }
+
+  args := []string{"-b", "-", "-q", "-o", "BatchMode=yes", "-o", "ConnectTimeout=30"}
+
+  if u.Port() != "" {
+    args = append(args, "-P", u.Port())
+  }
+
+  if identity != "" {
+    args = append(args, "-i", identity)
+  }
+
+  target := u.Hostname()
+
+  if u.User != nil {
+    target = u.User.Username() + "@" + target
+  }
+
+  dir := u.Path
+
+  if strings.HasPrefix(dir, "/~/") || dir == "/~" {
+    dir = strings.TrimPrefix(strings.TrimPrefix(dir, "/~"), "/")
+  }
+
+  if dir == "" {
+    dir = "."
+  }
+
+  return &sftpConn{ctx: ctx, command: command, args: append(args, target), dir: dir}, nil
+}
+
+// run runs the commands in the watched directory and returns what they
+// printed
+func (c *sftpConn) run(commands ...string) ([]byte, error) {
+  var script strings.Builder
+
+  fmt.Fprintf(&script, "cd %s\n", sftpQuote(c.dir))
+
+  for _, command := range commands {
+    script.WriteString(command + "\n")
+  }
+
+  cmd := exec.CommandContext(c.ctx, c.command, c.args...)
+  cmd.Stdin = strings.NewReader(script.String())
+
+  var stdout, stderr bytes.Buffer
+  cmd.Stdout = &stdout
+  cmd.Stderr = &stderr
+
+  if err := cmd.Run(); err != nil {
+    if c.ctx.Err() != nil {
+      return nil, c.ctx.Err()
+    }
+
+    if msg := strings.TrimSpace(stderr.String()); msg != "" {
+      return nil, fmt.Errorf("%s: %s", err, msg)
+    }
+
+    return nil, err
+  }
+
+  return stdout.Bytes(), nil
+}
+
+// sftpLongLine is a line of ls -ln: mode, links, uid, gid, size, date, name
+var sftpLongLine = regexp.MustCompile(`^(\S)\S*\s+\d+\s+\S+\s+\S+\s+(\d+)\s+(\w{3}\s+\d{1,2}\s+(?:\d{1,2}:\d{2}|\d{4})) (.+)$`)
+
+func (c *sftpConn) list() ([]StorageFile, error) {
+  out, err := c.run("ls -ln")
+
+  if err != nil {
+    return nil, err
+  }
+
+  var files []StorageFile
+
+  for _, line := range strings.Split(string(out), "\n") {
+    // batch mode echoes each command after a prompt
+    if strings.HasPrefix(line, "sftp> ") {
+      continue
+    }
+
+    m := sftpLongLine.FindStringSubmatch(strings.TrimRight(line, "\r"))
+
+    if m == nil || m[1] != "-" {
+      continue
+    }
+
+    size, _ := strconv.ParseInt(m[2], 10, 64)
+    files = append(files, StorageFile{Name: m[4], Size: size, ModTime: parseLsTime(m[3], time.Now())})
+  }
+
+  return files, nil
+}
+
+// parseLsTime parses ls dates, Jan 02 15:04 within the last six months and
+// Jan 02 2006 before. The zero time when it cannot
+func parseLsTime(value string, now time.Time) time.Time {
+  value = strings.Join(strings.Fields(value), " ")
+
+  if t, err := time.ParseInLocation("Jan 2 2006", value, time.Local); err == nil {
+    return t
+  }
+
+  t, err := time.ParseInLocation("Jan 2 15:04", value, time.Local)
+
+  if err != nil {
+    return time.Time{}
+  }
+
+  t = t.AddDate(now.Year(), 0, 0)
+
+  // December's files seen in January
+  if t.After(now.Add(24 * time.Hour)) {
+    t = t.AddDate(-1, 0, 0)
+  }
+
+  return t
+}
+
+func (c *sftpConn) download(name string, dest string) error {
+  _, err := c.run(fmt.Sprintf("get %s %s", sftpQuote(name), sftpQuote(dest)))
+
+  return err
+}
+
+// upload puts the local file src at name, making name's directories first,
+// a leading - keeps sftp going when one exists already
+func (c *sftpConn) upload(src string, name string) error {
+  var commands []string
+  dir := ""
+
+  for _, part := range strings.Split(path.Dir(name), "/") {
+    if part == "." || part == "" {
+      continue
+    }
+
+    dir = path.Join(dir, part)
+    commands = append(commands, "-mkdir "+sftpQuote(dir))
+  }
+
+  _, err := c.run(append(commands, fmt.Sprintf("put %s %s", sftpQuote(src), sftpQuote(name)))...)
+
+  return err
+}
+
+func (c *sftpConn) remove(name string) error {
+  _, err := c.run("rm " + sftpQuote(name))
+
+  return err
+}
+
+func (c *sftpConn) rename(name string, dir string) error {
+  _, err := c.run(fmt.Sprintf("rename %s %s", sftpQuote(name), sftpQuote(strings.TrimSuffix(dir, "/")+"/"+name)))
+
+  return err
+}
+
+func (c *sftpConn) close() error {
+  return nil
+}
+
+// sftpQuote quotes an argument for an sftp batch file
+func sftpQuote(s string) string {
+  return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
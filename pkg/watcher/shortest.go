@@ -0,0 +1,48 @@
+package watcher
+
+import (
+  "os"
+  "time"
+)
+
+// Scheduling is the order jobs of the same priority start in, unlike a
+// Schedule, which is when they may
+type Scheduling string
+
+const (
+  // SchedulingFIFO starts them in the order they were queued
+  SchedulingFIFO Scheduling = "fifo"
+
+  // SchedulingShortest starts the shortest first so a long master does not
+  // hold up the clips queued behind it. How long a job is comes from
+  // ffprobe when it is queued, or its size without a duration
+  SchedulingShortest Scheduling = "shortest"
+)
+
+// estimateBitrate is the bytes per second an input without a duration is
+// taken to play at, 8 Mb/s
+const estimateBitrate = 1 << 20
+
+// estimator returns how long a job's input plays for, what the shortest
+// first schedule orders waiting jobs by
+func estimator(ffprobePath string) func(j *Job) time.Duration {
+  return func(j *Job) time.Duration {
+    j.mu.Lock()
+    input := j.input
+    j.mu.Unlock()
+
+    if ffprobePath != "" {
+      if probed, err := probe(ffprobePath, input); err == nil && probed.duration() > 0 {
+        return probed.duration()
+      }
+    }
+
+    info, err := os.Stat(input)
+
+    if err != nil {
+      return 0
+    }
+
+    return time.Duration(info.Size()) * time.Second / estimateBitrate
+  }
+}
@@ -0,0 +1,343 @@
+package watcher
+
+import (
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // snapshotVersion is the version of the Snapshot format, an import
+  // refuses a later one
+  snapshotVersion = 1
+
+  // snapshotMaxBytes caps the snapshot POST /snapshot reads
+  snapshotMaxBytes = 64 << 20
+)
+
+// Snapshot is the queue and job state of a daemon as GET /snapshot exports
+// it, for ImportSnapshot to requeue on another machine or after
+// maintenance. Host and At are where and when it was taken
+type Snapshot struct {
+  Version int           `json:"version"`
+  Host    string        `json:"host,omitempty"`
+  At      time.Time     `json:"at"`
+  Jobs    []SnapshotJob `json:"jobs"`
+}
+
+// SnapshotJob is a job of a Snapshot. ArrivedAt is when it was first
+// queued, its deadline goes on counting from then, Size and ModTime are
+// its input's when the snapshot was taken
+type SnapshotJob struct {
+  UID       string       `json:"uid"`
+  Input     string       `json:"input"`
+  Name      string       `json:"name"`
+  Profile   string       `json:"profile"`
+  Priority  int          `json:"priority,omitempty"`
+  State     JobState     `json:"state"`
+  Error     string       `json:"error,omitempty"`
+  Failure   FailureClass `json:"failure,omitempty"`
+  Retries   int          `json:"retries,omitempty"`
+  ArrivedAt time.Time    `json:"arrived_at"`
+  Size      int64        `json:"size,omitempty"`
+  ModTime   *time.Time   `json:"mod_time,omitempty"`
+}
+
+// SnapshotImport is how ImportSnapshot requeues a snapshot's jobs
+type SnapshotImport struct {
+  // Map rewrites the start of the inputs' paths, from the other machine's
+  // directories to this one's, the longest prefix that matches wins
+  Map map[string]string
+
+  // Mode is how an input outside the queue directory is put into it,
+  // default ImportMove
+  Mode ImportMode
+
+  // Failed requeues the failed jobs too, not only the queued and running
+  Failed bool
+
+  DryRun bool
+}
+
+// SnapshotImportView is the JSON returned by POST /snapshot. Queued are the
+// inputs requeued, or that would be, Restored those already queued here
+// that got the snapshot's profile and priority back, Missing those whose
+// file was not found and Skipped the jobs that were done, cancelled or
+// failed, or that are running or were processed here
+type SnapshotImportView struct {
+  DryRun   bool     `json:"dry_run,omitempty"`
+  Queued   []string `json:"queued"`
+  Restored []string `json:"restored,omitempty"`
+  Missing  []string `json:"missing,omitempty"`
+  Skipped  int      `json:"skipped,omitempty"`
+}
+
+// Snapshot exports every job and the state it is in. Its jobs' inputs are
+// where they are now: the queue directory for the queued and running ones,
+// the failed directory for the failed
+func (w *Watcher) Snapshot() Snapshot {
+  host, _ := os.Hostname()
+  s := Snapshot{Version: snapshotVersion, Host: host, At: time.Now(), Jobs: []SnapshotJob{}}
+
+  for _, j := range w.store.list("") {
+    j.mu.Lock()
+    sj := SnapshotJob{
+      UID:       j.uid,
+      Input:     j.input,
+      Name:      j.name,
+      Profile:   j.profile.Name,
+      Priority:  j.priority,
+      State:     j.state,
+      Error:     j.err,
+      Failure:   j.failure,
+      Retries:   j.retries,
+      ArrivedAt: j.arrivedAt,
+    }
+    j.mu.Unlock()
+
+    if info, err := os.Stat(sj.Input); err == nil {
+      modTime := info.ModTime()
+      sj.Size, sj.ModTime = info.Size(), &modTime
+    }
+
+    s.Jobs = append(s.Jobs, sj)
+  }
+
+  return s
+}
+
+// ImportSnapshot requeues the jobs of a snapshot that were not processed
+// yet, the queued and the running ones, and the failed ones with Failed,
+// with the profile, priority, retries and arrival time they had. An input
+// is looked for at its path with Map applied, then by its name in the queue
+// directory. One outside the queue directory is put into it by Mode with
+// its sidecars and companions, one already queued here, as after a restart,
+// gets its state back. A profile this daemon does not have is replaced by
+// the default one
+func (w *Watcher) ImportSnapshot(s Snapshot, opts SnapshotImport) (SnapshotImportView, error) {
+  view := SnapshotImportView{DryRun: opts.DryRun, Queued: []string{}}
+
+  if s.Version > snapshotVersion {
+    return view, fmt.Errorf("snapshot version %d is newer than this gowatcher's %d", s.Version, snapshotVersion)
+  }
+
+  mode := opts.Mode
+
+  switch mode {
+  case "":
+    mode = ImportMove
+  case ImportLink:
+    if w.cfg.Symlinks == SymlinksSkip {
+      return view, fmt.Errorf("linking needs the follow or resolve symlink policy, copy or move instead")
+    }
+  case ImportCopy, ImportMove:
+  default:
+    return view, fmt.Errorf("import mode must be link, copy or move, not %q", mode)
+  }
+
+  profiles := w.profiles.Load()
+
+  // the watchers must not pick up a moved input before its job exists
+  w.foundMu.Lock()
+  defer w.foundMu.Unlock()
+
+  for _, sj := range s.Jobs {
+    switch sj.State {
+    case JobQueued, JobRunning:
+    case JobFailed:
+      if opts.Failed {
+        break
+      }
+
+      fallthrough
+    default:
+      view.Skipped++
+      continue
+    }
+
+    input := w.snapshotInput(sj, opts.Map)
+
+    if input == "" {
+      slog.Warn("Could not find snapshot job's input", "input", sj.Input, "uid", sj.UID)
+      view.Missing = append(view.Missing, sj.Input)
+      continue
+    }
+
+    p := profiles.byName[sj.Profile]
+
+    if p == nil {
+      slog.Warn("Snapshot job's profile is unknown, queueing it with the default", "input", sj.Input, "profile", sj.Profile)
+      p = profiles.def
+    }
+
+    if j := w.store.byPath(input); j != nil {
+      // one running or already processed here is left as it is
+      if j.State() != JobQueued || (!opts.DryRun && !w.restoreJob(j, sj, p)) {
+        view.Skipped++
+        continue
+      }
+
+      view.Restored = append(view.Restored, input)
+      continue
+    }
+
+    if opts.DryRun {
+      view.Queued = append(view.Queued, input)
+      continue
+    }
+
+    view.Queued = append(view.Queued, input)
+
+    if dir := filepath.Dir(input); dir != w.queueDir && dir != w.priorityDir {
+      dest, err := w.importFile(input, mode)
+
+      if err != nil {
+        slog.Error("Could not put snapshot job's input into the queue directory", "input", input, "mode", mode, "error", err)
+        view.Queued = view.Queued[:len(view.Queued)-1]
+        continue
+      }
+
+      if mode == ImportMove {
+        w.enc.audit.moved(nil, input, dest, "snapshot")
+      }
+
+      input = dest
+    }
+
+    w.stats.filesQueued.Add(1)
+    w.intake.add()
+
+    j := w.store.add(input, sj.Name, sj.Priority, p)
+
+    j.mu.Lock()
+    j.retries = sj.Retries
+
+    if !sj.ArrivedAt.IsZero() {
+      j.arrivedAt = sj.ArrivedAt
+    }
+
+    j.mu.Unlock()
+
+    w.queue.push(j)
+    j.logger().Info("Queued job from snapshot", "snapshot_uid", sj.UID, "priority", sj.Priority, "state", string(sj.State))
+  }
+
+  return view, nil
+}
+
+// restoreJob gives a job still waiting in the queue the snapshot job's
+// profile, priority, retries and arrival time, it returns false once a
+// worker took it
+func (w *Watcher) restoreJob(j *Job, sj SnapshotJob, p *Profile) bool {
+  if !w.queue.remove(j) {
+    return false
+  }
+
+  j.mu.Lock()
+  j.profile, j.requested, j.priority, j.retries = p, p, sj.Priority, sj.Retries
+
+  if !sj.ArrivedAt.IsZero() {
+    j.arrivedAt = sj.ArrivedAt
+  }
+
+  j.mu.Unlock()
+
+  w.queue.push(j)
+  j.logger().Info("Restored job from snapshot", "snapshot_uid", sj.UID, "priority", sj.Priority, "retries", sj.Retries)
+
+  return true
+}
+
+// snapshotInput is where a snapshot job's input is on this machine, "" when
+// it is not found
+func (w *Watcher) snapshotInput(sj SnapshotJob, remap map[string]string) string {
+  candidates := []string{mapPath(sj.Input, remap)}
+
+  for _, dir := range []string{w.queueDir, w.priorityDir} {
+    if dir != "" {
+      candidates = append(candidates, filepath.Join(dir, filepath.Base(sj.Input)))
+    }
+  }
+
+  for _, path := range candidates {
+    if info, err := os.Stat(path); err == nil && (info.Mode().IsRegular() || info.IsDir()) {
+      return path
+    }
+  }
+
+  return ""
+}
+
+// mapPath rewrites the longest prefix of path that is a key of remap, on a
+// path separator, to its value
+func mapPath(path string, remap map[string]string) string {
+  from, to := "", ""
+
+  for prefix, dest := range remap {
+    prefix = strings.TrimRight(prefix, `/\`)
+
+    if len(prefix) > len(from) && (path == prefix || strings.HasPrefix(path, prefix+"/") || strings.HasPrefix(path, prefix+`\`)) {
+      from, to = prefix, dest
+    }
+  }
+
+  if from == "" {
+    return path
+  }
+
+  return filepath.Join(to, filepath.FromSlash(strings.ReplaceAll(path[len(from):], `\`, "/")))
+}
+
+// snapshot serves GET /snapshot, and POST /snapshot[?map=from=to...]
+// [&mode=move|copy|link][&failed=true][&dry_run=true] with a Snapshot as
+// the body
+func (a *api) snapshot(w http.ResponseWriter, r *http.Request) {
+  switch r.Method {
+  case http.MethodGet:
+    writeJSON(w, http.StatusOK, a.w.Snapshot())
+    return
+  case http.MethodPost:
+  default:
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  var s Snapshot
+
+  if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, snapshotMaxBytes)).Decode(&s); err != nil {
+    writeError(w, http.StatusBadRequest, "bad snapshot: "+err.Error())
+    return
+  }
+
+  query := r.URL.Query()
+  opts := SnapshotImport{Map: map[string]string{}, Mode: ImportMode(query.Get("mode"))}
+
+  for _, m := range query["map"] {
+    from, to, ok := strings.Cut(m, "=")
+
+    if !ok || from == "" || to == "" {
+      writeError(w, http.StatusBadRequest, fmt.Sprintf("map must be from=to, not %q", m))
+      return
+    }
+
+    opts.Map[from] = to
+  }
+
+  opts.Failed, _ = strconv.ParseBool(query.Get("failed"))
+  opts.DryRun, _ = strconv.ParseBool(query.Get("dry_run"))
+
+  view, err := a.w.ImportSnapshot(s, opts)
+
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, view)
+}
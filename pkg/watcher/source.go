@@ -0,0 +1,243 @@
+package watcher
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "sync"
+  "time"
+)
+
+// ErrSourceDone is what a JobSource's Next returns once it has no more
+// jobs, it is not asked again
+var ErrSourceDone = errors.New("no more jobs")
+
+// JobSource feeds a Watcher jobs from a source of your own, a database
+// table, a message queue or a feed, alongside its queue directories. They
+// are encoded, retried, validated and delivered like any other. Next is
+// only asked while no job is waiting for a worker and the queue is neither
+// paused nor held, so what a source has not handed over yet stays there for
+// other consumers
+type JobSource interface {
+  // Next blocks until there is a job or ctx is done. An error other than
+  // ErrSourceDone is logged and Next asked again a little later
+  Next(ctx context.Context) (SourceJob, error)
+}
+
+// JobSourceFunc adapts a func to a JobSource
+type JobSourceFunc func(ctx context.Context) (SourceJob, error)
+
+func (f JobSourceFunc) Next(ctx context.Context) (SourceJob, error) {
+  return f(ctx)
+}
+
+// SourceJob is a job a JobSource hands over, the local file at Path or the
+// one at an http or https URL downloaded into the working directory first,
+// see EnqueueURL. A local file is treated like one in the queue directory,
+// Originals decides what becomes of it
+type SourceJob struct {
+  Path string
+  URL  string
+
+  // Name is what a URL's outputs are named after, default its file name
+  Name string
+
+  // Profile is the name of the profile to encode with, empty for the one
+  // the job spec names or the default. Priority starts it ahead of the
+  // jobs of normal priority
+  Profile  string
+  Priority bool
+
+  // Done is called once the job is over, done, failed after its retries
+  // or cancelled, e.g. to acknowledge a message or mark a row, and with
+  // the error when it could not be queued. It is not called for a job
+  // interrupted by shutdown
+  Done func(v JobView, err error)
+}
+
+// sourcePollInterval is how often the jobs a source handed over are looked
+// at, and how long it waits while jobs are waiting for a worker
+const sourcePollInterval = 2 * time.Second
+
+// sourceErrorWait is how long a source that failed is left before it is
+// asked again
+const sourceErrorWait = 10 * time.Second
+
+// sourcedJob is a job a source handed over whose Done is still to be told
+type sourcedJob struct {
+  job  *Job
+  done func(v JobView, err error)
+}
+
+// jobSource takes a JobSource's jobs for a Watcher
+type jobSource struct {
+  src JobSource
+  w   *Watcher
+
+  mu       sync.Mutex
+  inflight []sourcedJob
+
+  done sync.WaitGroup
+}
+
+// start asks the source for jobs and tells it about those done until stop
+// is closed
+func (s *jobSource) start(stop <-chan struct{}) {
+  ctx, cancel := context.WithCancel(context.Background())
+
+  go func() {
+    <-stop
+    cancel()
+  }()
+
+  s.done.Add(2)
+
+  go func() {
+    defer s.done.Done()
+    s.receive(ctx)
+  }()
+
+  go func() {
+    defer s.done.Done()
+
+    ticker := time.NewTicker(sourcePollInterval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        s.settle()
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+}
+
+// stop waits for the loops, then tells the source about the jobs that
+// finished meanwhile
+func (s *jobSource) stop() {
+  s.done.Wait()
+  s.settle()
+}
+
+func (s *jobSource) receive(ctx context.Context) {
+  for ctx.Err() == nil {
+    if s.w.queue.len() > 0 || s.w.queue.isPaused() || s.w.queue.isHeld() {
+      sleepCtx(ctx, sourcePollInterval)
+      continue
+    }
+
+    sj, err := s.src.Next(ctx)
+
+    switch {
+    case ctx.Err() != nil:
+      return
+    case errors.Is(err, ErrSourceDone):
+      slog.Info("Job source has no more jobs", "source", fmt.Sprintf("%T", s.src))
+      return
+    case err != nil:
+      slog.Error("Job source failed", "source", fmt.Sprintf("%T", s.src), "error", err)
+      sleepCtx(ctx, sourceErrorWait)
+      continue
+    }
+
+    j, err := s.w.enqueueSourced(sj)
+
+    if err != nil {
+      slog.Warn("Could not queue job from source", "source", fmt.Sprintf("%T", s.src), "path", sj.Path, "url", sj.URL, "error", err)
+
+      if sj.Done != nil {
+        sj.Done(JobView{}, err)
+      }
+
+      continue
+    }
+
+    if sj.Done != nil {
+      s.mu.Lock()
+      s.inflight = append(s.inflight, sourcedJob{job: j, done: sj.Done})
+      s.mu.Unlock()
+    }
+  }
+}
+
+// enqueueSourced queues a job a source handed over
+func (w *Watcher) enqueueSourced(sj SourceJob) (*Job, error) {
+  p := w.profiles.Load().def
+
+  if sj.Profile != "" {
+    if p = w.profiles.Load().byName[sj.Profile]; p == nil {
+      return nil, fmt.Errorf("unknown profile %q", sj.Profile)
+    }
+  }
+
+  priority := PriorityNormal
+
+  if sj.Priority {
+    priority = PriorityHigh
+  }
+
+  switch {
+  case sj.URL != "" && sj.Path != "":
+    return nil, errors.New("a path and a URL")
+  case sj.URL != "":
+    return w.enqueueURL(sj.URL, sj.Name, priority, p)
+  case sj.Path == "":
+    return nil, errors.New("no path or URL")
+  }
+
+  if info, err := os.Stat(sj.Path); err != nil {
+    return nil, err
+  } else if info.IsDir() {
+    return nil, fmt.Errorf("%s is a directory", sj.Path)
+  }
+
+  if w.store.tracked(sj.Path) {
+    return nil, fmt.Errorf("%s is queued already", sj.Path)
+  }
+
+  j := w.enqueue(sj.Path, "", p)
+
+  if j == nil {
+    return nil, fmt.Errorf("%s is not a file this watcher encodes", sj.Path)
+  }
+
+  if sj.Priority && j.View().Priority < PriorityHigh {
+    w.queue.raise(j)
+  }
+
+  return j, nil
+}
+
+// settle tells the source about the jobs that are over. A failed job
+// waiting for its retry is not over yet
+func (s *jobSource) settle() {
+  s.mu.Lock()
+  var over, left []sourcedJob
+
+  for _, sj := range s.inflight {
+    v := sj.job.View()
+
+    if v.State.Finished() && !sj.job.retrying() {
+      over = append(over, sj)
+    } else {
+      left = append(left, sj)
+    }
+  }
+
+  s.inflight = left
+  s.mu.Unlock()
+
+  for _, sj := range over {
+    v := sj.job.View()
+
+    if v.State == JobCancelled && v.Error == errShutdown.Error() {
+      continue
+    }
+
+    sj.done(v, nil)
+  }
+}
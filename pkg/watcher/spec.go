@@ -0,0 +1,343 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "gopkg.in/yaml.v3"
+)
+
+// specSuffixes name the sidecar files that override a job's settings, they
+// sit next to the input: movie.mkv.job.yml
+var specSuffixes = []string{".job.yml", ".job.yaml", ".job.json"}
+
+// jobSpec is a sidecar file, YAML or JSON, overriding the profile for one
+// input. Every field is optional:
+//
+//	profile: web                       another profile to encode with
+//	output_flags: -crf 18              added after the profile's flags
+//	output_name: "{basename}-cut.{ext}"
+//	start: 00:01:30                    trim, seconds or [hh:]mm:ss[.ms]
+//	end: 1:02:00
+//	metadata:
+//	  title: The Movie
+//	traceparent: 00-<trace id>-<span id>-01  the job's trace continues this one
+//	env:                               added to the profile's env
+//	  CUDA_VISIBLE_DEVICES: "1"
+//	frame_rate: 24000/1001             an image sequence's, see imageSequence
+//	sequence: shot_010.%04d.exr        its frames, if the directory has others
+//	clips:                             outputs of their own, see Clip
+//	  - name: intro
+//	    start: 1:30
+//	    end: 2:45
+//
+// A job with flags, a trim or metadata is always re-encoded, never remuxed.
+// The sidecar follows its input when it is archived, deleted or moved to the
+// failed directory
+type jobSpec struct {
+  Profile     string            `yaml:"profile"`
+  OutputFlags flagList          `yaml:"output_flags"`
+  OutputName  string            `yaml:"output_name"`
+  Start       string            `yaml:"start"`
+  End         string            `yaml:"end"`
+  Metadata    map[string]string `yaml:"metadata"`
+  TraceParent string            `yaml:"traceparent"`
+  Env         map[string]string `yaml:"env"`
+  FrameRate   string            `yaml:"frame_rate"`
+  Sequence    string            `yaml:"sequence"`
+  Clips       []Clip            `yaml:"clips"`
+
+  start time.Duration
+  end   time.Duration
+}
+
+// isSpec reports whether path is a sidecar rather than an input
+func isSpec(path string) bool {
+  for _, suffix := range specSuffixes {
+    if strings.HasSuffix(path, suffix) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// findSpec returns the path of the input's sidecar, or "" without one
+func findSpec(input string) string {
+  for _, suffix := range specSuffixes {
+    if _, err := os.Stat(input + suffix); err == nil {
+      return input + suffix
+    }
+  }
+
+  return ""
+}
+
+// loadSpec reads and checks a sidecar
+func loadSpec(path string) (*jobSpec, error) {
+  data, err := os.ReadFile(path)
+
+  if err != nil {
+    return nil, err
+  }
+
+  // JSON is valid YAML
+  var s jobSpec
+
+  if err = yaml.Unmarshal(data, &s); err != nil {
+    return nil, err
+  }
+
+  if err = checkNameTemplate(s.OutputName); err != nil {
+    return nil, err
+  }
+
+  if err = checkEnv(s.Env); err != nil {
+    return nil, err
+  }
+
+  if s.FrameRate != "" {
+    if err = checkFrameRate(s.FrameRate); err != nil {
+      return nil, err
+    }
+  }
+
+  if s.start, err = parseTimestamp(s.Start); err != nil {
+    return nil, fmt.Errorf("start: %s", err)
+  }
+
+  if s.end, err = parseTimestamp(s.End); err != nil {
+    return nil, fmt.Errorf("end: %s", err)
+  }
+
+  if s.end > 0 && s.end <= s.start {
+    return nil, fmt.Errorf("end %s is not after start %s", s.End, s.Start)
+  }
+
+  if len(s.Clips) > 0 && (s.start > 0 || s.end > 0) {
+    return nil, fmt.Errorf("start and end do not go with clips, give each clip its own")
+  }
+
+  if err = checkClips(s.Clips); err != nil {
+    return nil, err
+  }
+
+  return &s, nil
+}
+
+// parseTimestamp reads seconds (90.5), [hh:]mm:ss[.ms] (1:30) or a Go
+// duration (1m30s), empty is zero
+func parseTimestamp(value string) (time.Duration, error) {
+  value = strings.TrimSpace(value)
+
+  if value == "" {
+    return 0, nil
+  }
+
+  if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+    return d, nil
+  }
+
+  parts := strings.Split(value, ":")
+
+  if len(parts) > 3 {
+    return 0, fmt.Errorf("%q is not a timestamp", value)
+  }
+
+  var seconds float64
+
+  for _, part := range parts {
+    n, err := strconv.ParseFloat(part, 64)
+
+    if err != nil || n < 0 {
+      return 0, fmt.Errorf("%q is not a timestamp", value)
+    }
+
+    seconds = seconds*60 + n
+  }
+
+  return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// modifies reports whether the spec changes what ffmpeg produces, which
+// rules out a stream copy
+func (s *jobSpec) modifies() bool {
+  return len(s.OutputFlags) > 0 || s.start > 0 || s.end > 0 || len(s.Metadata) > 0 || len(s.Clips) > 0
+}
+
+// trimmed is how long the output of an input lasting total will be, or
+// the clips together
+func (s *jobSpec) trimmed(total time.Duration) time.Duration {
+  if len(s.Clips) > 0 {
+    return s.clipsLength(total)
+  }
+
+  if total <= 0 {
+    return total
+  }
+
+  if s.end > 0 && s.end < total {
+    total = s.end
+  }
+
+  return total - s.start
+}
+
+// inputFlags seek to the start point
+func (s *jobSpec) inputFlags() []string {
+  if s.start <= 0 {
+    return nil
+  }
+
+  return []string{"-ss", formatSeconds(s.start)}
+}
+
+// outputFlags are the spec's own flags, the trim length and the metadata
+func (s *jobSpec) outputFlags() []string {
+  flags := append([]string(nil), s.OutputFlags...)
+
+  if s.end > 0 {
+    flags = append(flags, "-t", formatSeconds(s.end-s.start))
+  }
+
+  keys := make([]string, 0, len(s.Metadata))
+
+  for key := range s.Metadata {
+    keys = append(keys, key)
+  }
+
+  sort.Strings(keys)
+
+  for _, key := range keys {
+    flags = append(flags, "-metadata", key+"="+s.Metadata[key])
+  }
+
+  return flags
+}
+
+// apply returns a copy of p with the spec's changes, p is left alone. The
+// spec's output flags go last so they win over the profile's and renditions'
+func (s *jobSpec) apply(p *Profile) *Profile {
+  out := *p
+
+  if s.OutputName != "" {
+    out.NameTemplate = s.OutputName
+  }
+
+  if len(s.Env) > 0 {
+    out.Env = make(map[string]string, len(p.Env)+len(s.Env))
+
+    for key, value := range p.Env {
+      out.Env[key] = value
+    }
+
+    for key, value := range s.Env {
+      out.Env[key] = value
+    }
+  }
+
+  if !s.modifies() {
+    return &out
+  }
+
+  out.RemuxVideoCodecs = nil
+  out.RemuxAudioCodecs = nil
+
+  input := s.inputFlags()
+  output := s.outputFlags()
+
+  out.InputFlags = concat(p.InputFlags, input)
+
+  if len(p.Renditions) > 0 {
+    out.Renditions = make([]Rendition, len(p.Renditions))
+
+    for i, r := range p.Renditions {
+      r.OutputFlags = concat(r.OutputFlags, output)
+      out.Renditions[i] = r
+    }
+  } else {
+    out.OutputFlags = concat(p.OutputFlags, output)
+  }
+
+  if p.hw != nil {
+    hw := *p.hw
+    hw.InputFlags = concat(hw.InputFlags, input)
+
+    if len(p.Renditions) == 0 {
+      hw.OutputFlags = concat(hw.OutputFlags, output)
+    }
+
+    out.hw = &hw
+  }
+
+  return &out
+}
+
+// concat joins flag lists into a new slice
+func concat(a []string, b []string) []string {
+  return append(append([]string(nil), a...), b...)
+}
+
+func formatSeconds(d time.Duration) string {
+  return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// moveSpec moves a sidecar, if there is one, next to its input's new path
+func moveSpec(spec string, input string) error {
+  for _, suffix := range specSuffixes {
+    if spec != "" && strings.HasSuffix(spec, suffix) {
+      return moveFile(spec, input+suffix)
+    }
+  }
+
+  return nil
+}
+
+// applySpec reads the job's sidecar and derives the profile it is encoded
+// with from the one it was queued with
+func (e *encoder) applySpec(j *Job) error {
+  path := findSpec(j.input)
+
+  j.mu.Lock()
+  j.profile = j.requested
+  j.spec = nil
+  j.specPath = path
+  j.mu.Unlock()
+
+  if path == "" {
+    return nil
+  }
+
+  s, err := loadSpec(path)
+
+  if err != nil {
+    return fmt.Errorf("job spec %s: %s", path, err)
+  }
+
+  p := j.requested
+
+  if s.Profile != "" {
+    var ok bool
+
+    if p, ok = e.profiles.Load().byName[s.Profile]; !ok {
+      return fmt.Errorf("job spec %s: unknown profile %q", path, s.Profile)
+    }
+  }
+
+  if len(s.Clips) > 0 && (p.Packaging != "" || len(p.pipeline()) > 0) {
+    return fmt.Errorf("job spec %s: clips do not apply to packaging or pipeline profiles", path)
+  }
+
+  j.mu.Lock()
+  j.spec = s
+  j.profile = s.apply(p)
+  j.mu.Unlock()
+
+  j.logger().Info("Using job spec", "spec", path)
+
+  return nil
+}
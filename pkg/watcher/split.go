@@ -0,0 +1,319 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "sync"
+  "time"
+)
+
+// defaultSplitJobs is how many pieces of a split input are encoded at once
+// when the profile does not say
+const defaultSplitJobs = 2
+
+// splitPlan encodes a long input in pieces: its video is cut at keyframes
+// into pieces of about the profile's SplitLength, which are encoded several
+// at a time for every output. The plan's runs then join each output's
+// pieces and encode the input's audio alongside with the profile's audio
+// flags
+type splitPlan struct {
+  dir   string
+  split ffmpegRun
+  jobs  int
+
+  // duration is the input's, for the job's progress
+  duration time.Duration
+
+  outputs []splitOutput
+}
+
+// splitOutput is how one output's pieces are encoded, list is the concat
+// demuxer's list of the encoded pieces
+type splitOutput struct {
+  name        string
+  inputFlags  []string
+  outputFlags []string
+  list        string
+}
+
+// splits reports whether the profile encodes an input lasting duration in
+// pieces
+func (p *Profile) splits(duration time.Duration) bool {
+  return p.SplitLength > 0 && duration > p.SplitLength && duration >= p.SplitAbove && !p.TwoPass && p.Packaging == ""
+}
+
+// checkSplit rejects split settings that cannot work
+func (p *Profile) checkSplit() error {
+  switch {
+  case p.SplitLength < 0 || p.SplitAbove < 0 || p.SplitJobs < 0:
+    return fmt.Errorf("split settings must not be negative")
+  case p.SplitLength > 0 && p.SplitLength < time.Second:
+    return fmt.Errorf("split_length must be at least a second")
+  case p.SplitLength > 0 && (p.TwoPass || p.Packaging != ""):
+    return fmt.Errorf("split_length does not apply to two_pass or packaging profiles")
+  case p.SplitLength > 0 && p.Loudnorm != nil:
+    return fmt.Errorf("split_length encodes the audio as the pieces are joined, it cannot be normalized with loudnorm")
+  }
+
+  return nil
+}
+
+// planSplit plans encoding every output of the job from pieces of its input
+func (e *encoder) planSplit(j *Job, probed *probeResult) encodePlan {
+  file := j.source()
+  prof := j.profile
+  inputFlags, outputFlags, hardware := e.flags(j, probed)
+  dir := filepath.Join(e.jobDir(j), "split")
+
+  jobs := prof.SplitJobs
+
+  if jobs <= 0 {
+    jobs = defaultSplitJobs
+  }
+
+  s := &splitPlan{dir: dir, jobs: jobs, duration: probed.duration()}
+
+  // stream copying cuts at the first keyframe after each split point, so
+  // every piece starts with one
+  s.split = ffmpegRun{
+    name: "split",
+    dirs: []string{dir},
+    args: []string{
+      "-i", file,
+      "-map", "0:v:0", "-c", "copy",
+      "-f", "segment", "-segment_time", formatSeconds(prof.SplitLength), "-reset_timestamps", "1",
+      filepath.Join(dir, "piece-%05d.mkv"),
+    },
+  }
+
+  plan := encodePlan{split: s, hardware: hardware, temp: []string{dir}}
+
+  for i, r := range e.renditions(j, probed) {
+    out := filepath.Join(e.jobDir(j), prof.outputName(j.name, r, probed, j.startedAt))
+    list := filepath.Join(dir, fmt.Sprintf("%d.txt", i))
+
+    flags := append(append([]string(nil), outputFlags...), r.OutputFlags...)
+
+    s.outputs = append(s.outputs, splitOutput{
+      name:        r.Name,
+      inputFlags:  inputFlags,
+      outputFlags: flags,
+      list:        list,
+    })
+
+    join := ffmpegRun{
+      name:    r.Name + " join",
+      outputs: []string{out},
+      args: []string{
+        "-f", "concat", "-safe", "0", "-i", list,
+        "-i", file,
+        "-map", "0:v", "-map", "1:a?", "-c:v", "copy",
+      },
+    }
+
+    // the pieces have none of the input's metadata, and the audio is
+    // encoded here like it is in one pass
+    join.args = append(join.args, audioFlags(flags)...)
+    join.args = append(join.args, "-map_metadata", "1", "-map_chapters", "1")
+    join.args = append(join.args, e.metadataFlags(j, probed, 1)...)
+    join.args = append(join.args, out)
+
+    plan.runs = append(plan.runs, join)
+  }
+
+  return plan
+}
+
+// audioOptions are the output options without a stream specifier that
+// only apply to the audio
+var audioOptions = []string{"-acodec", "-ab", "-ar", "-ac", "-aq", "-af", "-channel_layout"}
+
+// audioFlags are the options in flags for the audio, and their values,
+// those like -c:a or -b:a:0 with an audio stream specifier too
+func audioFlags(flags []string) []string {
+  var audio []string
+
+  for i := 0; i < len(flags)-1; i++ {
+    name, spec, _ := strings.Cut(flags[i], ":")
+
+    if strings.HasPrefix(name, "-") && (spec == "a" || strings.HasPrefix(spec, "a:") || slices.Contains(audioOptions, flags[i])) {
+      audio = append(audio, flags[i], flags[i+1])
+      i++
+    }
+  }
+
+  return audio
+}
+
+// pieceRun is the ffmpeg for one piece of one output
+func (o splitOutput) pieceRun(output int, piece string) ffmpegRun {
+  encoded := filepath.Join(filepath.Dir(piece), fmt.Sprintf("%d-%s", output, filepath.Base(piece)))
+
+  run := ffmpegRun{
+    name:     o.name + " " + strings.TrimSuffix(filepath.Base(piece), ".mkv"),
+    outputs:  []string{encoded},
+    progress: newProgress(0),
+  }
+
+  // the audio is copied from the input when the pieces are joined
+  run.args = append(run.args, o.inputFlags...)
+  run.args = append(run.args, "-i", piece)
+  run.args = append(run.args, o.outputFlags...)
+  run.args = append(run.args, "-an", "-sn", "-dn", "-f", "matroska", "-y", encoded)
+
+  return run
+}
+
+// encodePieces splits the input and encodes the pieces for every output,
+// s.jobs at a time. Each piece's ffmpeg output is written to output once it
+// exits so the job log is not interleaved. The first failure stops the rest
+func (e *encoder) encodePieces(ctx context.Context, j *Job, s *splitPlan, output io.Writer) error {
+  logger := j.logger()
+  logger.Info("Command", "step", s.split.name, "args", s.split.args)
+
+  if err := e.runFFmpeg(ctx, j, s.split, output, s.duration); err != nil {
+    return err
+  }
+
+  pieces, _ := filepath.Glob(filepath.Join(s.dir, "piece-*.mkv"))
+
+  if len(pieces) == 0 {
+    return fmt.Errorf("splitting the input produced no pieces")
+  }
+
+  var runs []ffmpegRun
+
+  for i, o := range s.outputs {
+    var list strings.Builder
+
+    for _, piece := range pieces {
+      run := o.pieceRun(i, piece)
+      runs = append(runs, run)
+
+      fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(run.outputs[0], "'", `'\''`))
+    }
+
+    if err := os.WriteFile(o.list, []byte(list.String()), 0644); err != nil {
+      return err
+    }
+  }
+
+  logger.Info("Encoding pieces", "pieces", len(pieces), "outputs", len(s.outputs), "at_once", s.jobs)
+
+  // the job's progress is the sum of the pieces'
+  prog := newProgress(s.duration * time.Duration(len(s.outputs)))
+
+  j.mu.Lock()
+  j.progress = prog
+  j.mu.Unlock()
+
+  stopProgress := e.sumProgress(j, prog, runs)
+  defer stopProgress()
+
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+
+  var mu sync.Mutex
+  var firstErr error
+  var wg sync.WaitGroup
+
+  next := make(chan ffmpegRun)
+
+  for i := 0; i < s.jobs; i++ {
+    wg.Add(1)
+
+    go func() {
+      defer wg.Done()
+
+      for run := range next {
+        var log bytes.Buffer
+
+        err := e.runFFmpeg(ctx, j, run, &log, 0)
+
+        mu.Lock()
+        output.Write(log.Bytes())
+
+        if err != nil && firstErr == nil {
+          firstErr = fmt.Errorf("%s: %w", run.name, err)
+          cancel()
+        }
+
+        mu.Unlock()
+      }
+    }()
+  }
+
+feed:
+  for _, run := range runs {
+    select {
+    case next <- run:
+    case <-ctx.Done():
+      break feed
+    }
+  }
+
+  close(next)
+  wg.Wait()
+
+  if firstErr == nil && ctx.Err() != nil {
+    return ctx.Err()
+  }
+
+  return firstErr
+}
+
+// sumProgress keeps prog at the total encoded by runs and logs it every
+// progress interval. The returned func stops it
+func (e *encoder) sumProgress(j *Job, prog *progress, runs []ffmpegRun) func() {
+  stop := make(chan struct{})
+  ticker := time.NewTicker(time.Second)
+  lastLog := time.Now()
+
+  go func() {
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+      case <-stop:
+        return
+      }
+
+      var total time.Duration
+
+      for _, run := range runs {
+        run.progress.mu.Lock()
+        total += run.progress.outTime
+        run.progress.mu.Unlock()
+      }
+
+      prog.mu.Lock()
+
+      if total > prog.outTime {
+        prog.outTime = total
+        prog.updatedAt = time.Now()
+      }
+
+      if elapsed := time.Since(prog.startedAt).Seconds(); elapsed > 0 {
+        prog.speed = fmt.Sprintf("%.3gx", prog.outTime.Seconds()/elapsed)
+      }
+
+      prog.mu.Unlock()
+
+      if time.Since(lastLog) >= e.progressInterval {
+        lastLog = time.Now()
+        j.logger().Info("Progress", "step", "pieces", "progress", prog.String())
+      }
+    }
+  }()
+
+  var once sync.Once
+
+  return func() { once.Do(func() { close(stop) }) }
+}
@@ -0,0 +1,134 @@
+package watcher
+
+import (
+  "context"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// sqsClient makes the SQS calls ingest needs, with the query protocol
+type sqsClient struct {
+  queueURL string
+  http     *http.Client
+  signer   awsSigner
+}
+
+type sqsMessage struct {
+  ID            string `xml:"MessageId"`
+  ReceiptHandle string `xml:"ReceiptHandle"`
+  Body          string `xml:"Body"`
+}
+
+// sqsRegion is the region in an AWS queue URL, https://sqs.eu-west-1.amazonaws.com/...
+func sqsRegion(queueURL string) string {
+  u, err := url.Parse(queueURL)
+
+  if err != nil {
+    return ""
+  }
+
+  parts := strings.Split(u.Hostname(), ".")
+
+  if len(parts) >= 4 && parts[0] == "sqs" && parts[len(parts)-2] == "amazonaws" {
+    return parts[1]
+  }
+
+  return ""
+}
+
+// receive long polls for up to one message, nil when none arrived
+func (c *sqsClient) receive(ctx context.Context, wait time.Duration, visibility time.Duration) (*sqsMessage, error) {
+  body, err := c.call(ctx, url.Values{
+    "Action":              {"ReceiveMessage"},
+    "MaxNumberOfMessages": {"1"},
+    "WaitTimeSeconds":     {strconv.Itoa(int(wait.Seconds()))},
+    "VisibilityTimeout":   {strconv.Itoa(int(visibility.Seconds()))},
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  var resp struct {
+    Messages []sqsMessage `xml:"ReceiveMessageResult>Message"`
+  }
+
+  if err = xml.Unmarshal(body, &resp); err != nil {
+    return nil, fmt.Errorf("ReceiveMessage: %s", err)
+  }
+
+  if len(resp.Messages) == 0 {
+    return nil, nil
+  }
+
+  return &resp.Messages[0], nil
+}
+
+// remove deletes a handled message from the queue
+func (c *sqsClient) remove(ctx context.Context, m *sqsMessage) error {
+  _, err := c.call(ctx, url.Values{"Action": {"DeleteMessage"}, "ReceiptHandle": {m.ReceiptHandle}})
+
+  return err
+}
+
+// setVisibility hides the message from other consumers for d more, zero
+// hands it back straight away
+func (c *sqsClient) setVisibility(ctx context.Context, m *sqsMessage, d time.Duration) error {
+  _, err := c.call(ctx, url.Values{
+    "Action":            {"ChangeMessageVisibility"},
+    "ReceiptHandle":     {m.ReceiptHandle},
+    "VisibilityTimeout": {strconv.Itoa(int(d.Seconds()))},
+  })
+
+  return err
+}
+
+// call POSTs an action to the queue and returns the response document
+func (c *sqsClient) call(ctx context.Context, params url.Values) ([]byte, error) {
+  params.Set("Version", "2012-11-05")
+  form := canonicalQuery(params)
+
+  req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.queueURL, strings.NewReader(form))
+
+  if err != nil {
+    return nil, err
+  }
+
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  c.signer.sign(req, sha256Hex([]byte(form)), time.Now())
+
+  resp, err := c.http.Do(req)
+
+  if err != nil {
+    return nil, err
+  }
+
+  defer resp.Body.Close()
+
+  body, err := io.ReadAll(resp.Body)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if resp.StatusCode >= 300 {
+    var doc struct {
+      Code    string `xml:"Error>Code"`
+      Message string `xml:"Error>Message"`
+    }
+
+    if xml.Unmarshal(body, &doc) == nil && doc.Code != "" {
+      return nil, fmt.Errorf("%s: %s: %s %s", params.Get("Action"), resp.Status, doc.Code, doc.Message)
+    }
+
+    return nil, fmt.Errorf("%s: %s", params.Get("Action"), resp.Status)
+  }
+
+  return body, nil
+}
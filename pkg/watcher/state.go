@@ -0,0 +1,398 @@
+package watcher
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+const (
+  // stateVersionFile is the file in the base directory saying which
+  // version the state kept there is
+  stateVersionFile = "state.json"
+
+  // stateVersion is the version of the state this gowatcher keeps, that
+  // of the last of stateMigrations
+  stateVersion = 1
+)
+
+// StateVersion is what state.json in the base directory says about the
+// state kept there, the ledger, the stats history and the encodes log.
+// Version is the last migration applied to it, Compatible the oldest
+// version that can still use the files as they are, so during a rolling
+// upgrade an instance not upgraded yet goes on next to one that migrated.
+// Every gowatcher reads the state of the versions before its own, a
+// migration only tidies it up unless it says otherwise. Manifests and
+// snapshots have versions of their own
+type StateVersion struct {
+  Version    int       `json:"state_version"`
+  Compatible int       `json:"compatible_with"`
+  MigratedAt time.Time `json:"migrated_at"`
+  Host       string    `json:"host,omitempty"`
+}
+
+// stateMigration brings the state from version-1 to version and returns
+// the files it rewrote, or would. One that is not compatible leaves files
+// an older gowatcher cannot read and is only applied by MigrateState,
+// once the instances sharing the state were all upgraded
+type stateMigration struct {
+  version    int
+  what       string
+  compatible bool
+  run        func(files stateFiles, dryRun bool) ([]string, error)
+}
+
+var stateMigrations = []stateMigration{
+  {
+    version:    1,
+    what:       "drop the lines of the ledger, stats history and encodes log cut short by a crash, and the ledger entries a later one for the same input replaced",
+    compatible: true,
+    run:        compactStateFiles,
+  },
+}
+
+// stateFiles are where a watcher keeps its state, "" for what it does not
+// keep
+type stateFiles struct {
+  dir     string
+  ledger  string
+  history string
+  encodes string
+}
+
+// statePaths are the state files of cfg with its base directory at dir
+func statePaths(cfg Config, dir string) stateFiles {
+  files := stateFiles{dir: dir, history: cfg.HistoryFile, encodes: filepath.Join(dir, encodesFile)}
+
+  if files.ledger = cfg.LedgerFile; files.ledger == "" {
+    files.ledger = filepath.Join(dir, "ledger.jsonl")
+  }
+
+  return files
+}
+
+// exist reports whether any of the files is there, a base directory with
+// none is a new one
+func (f stateFiles) exist() bool {
+  for _, path := range []string{f.ledger, f.history, f.encodes} {
+    if _, err := os.Stat(path); path != "" && err == nil {
+      return true
+    }
+  }
+
+  return false
+}
+
+// stateCompatible is the oldest version that can use the state once every
+// migration was applied
+func stateCompatible() int {
+  compatible := 0
+
+  for _, m := range stateMigrations {
+    if !m.compatible {
+      compatible = m.version
+    }
+  }
+
+  return compatible
+}
+
+// readState is the state's version, version 0 for state from before it was
+// versioned and this gowatcher's for a new base directory. An error is a
+// state a newer gowatcher left that this one cannot use
+func readState(files stateFiles) (StateVersion, error) {
+  var v StateVersion
+
+  data, err := os.ReadFile(filepath.Join(files.dir, stateVersionFile))
+
+  switch {
+  case os.IsNotExist(err) && files.exist():
+    return v, nil
+  case os.IsNotExist(err):
+    return StateVersion{Version: stateVersion, Compatible: stateCompatible()}, nil
+  case err != nil:
+    return v, err
+  }
+
+  if err = json.Unmarshal(data, &v); err != nil {
+    return v, fmt.Errorf("%s: %s", stateVersionFile, err)
+  }
+
+  if v.Version > stateVersion && v.Compatible > stateVersion {
+    return v, fmt.Errorf("the state in %s is version %d, which only a gowatcher of state version %d or later can use, this one's is %d: upgrade it", files.dir, v.Version, v.Compatible, stateVersion)
+  }
+
+  return v, nil
+}
+
+// writeState records the state's version in the base directory
+func writeState(dir string, v StateVersion) error {
+  data, _ := json.MarshalIndent(v, "", "  ")
+  path := filepath.Join(dir, stateVersionFile)
+  tmp := path + ".tmp"
+
+  if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+    return err
+  }
+
+  return os.Rename(tmp, path)
+}
+
+// StateMigrationView is a migration MigrateState applied, or would, and the
+// files it rewrote. The files as they were are kept next to them with a
+// .v<version before>.bak suffix
+type StateMigrationView struct {
+  Version int      `json:"version"`
+  What    string   `json:"what"`
+  Files   []string `json:"files,omitempty"`
+}
+
+// StateReport is what MigrateState found in a base directory and did: From
+// is the version the state was, To this gowatcher's. Newer is set when a
+// newer gowatcher migrated the state, in a way this one can still use
+type StateReport struct {
+  Dir        string               `json:"dir"`
+  From       int                  `json:"from"`
+  To         int                  `json:"to"`
+  Newer      bool                 `json:"newer,omitempty"`
+  DryRun     bool                 `json:"dry_run,omitempty"`
+  Migrations []StateMigrationView `json:"migrations"`
+}
+
+// migrateState applies the migrations the state does not have yet, only
+// the compatible ones unless all
+func migrateState(files stateFiles, all bool, dryRun bool) (StateReport, error) {
+  report := StateReport{Dir: files.dir, To: stateVersion, DryRun: dryRun, Migrations: []StateMigrationView{}}
+
+  v, err := readState(files)
+
+  if err != nil {
+    return report, err
+  }
+
+  _, statErr := os.Stat(filepath.Join(files.dir, stateVersionFile))
+  report.From, report.Newer = v.Version, v.Version > stateVersion
+
+  // a new base directory, or one that was versioned already
+  if os.IsNotExist(statErr) && v.Version == stateVersion {
+    if dryRun {
+      return report, nil
+    }
+
+    host, _ := os.Hostname()
+    v.MigratedAt, v.Host = time.Now(), host
+
+    return report, writeState(files.dir, v)
+  }
+
+  for _, m := range stateMigrations {
+    if m.version <= v.Version {
+      continue
+    }
+
+    if !m.compatible && !all {
+      return report, fmt.Errorf("the state in %s is version %d, run gowatcher migrate to bring it to %d (%s), older instances sharing it cannot read it afterwards", files.dir, v.Version, m.version, m.what)
+    }
+
+    changed, err := m.run(files, dryRun)
+
+    if err != nil {
+      return report, fmt.Errorf("migration to version %d: %s", m.version, err)
+    }
+
+    report.Migrations = append(report.Migrations, StateMigrationView{Version: m.version, What: m.what, Files: changed})
+
+    if dryRun {
+      continue
+    }
+
+    host, _ := os.Hostname()
+    v.Version, v.MigratedAt, v.Host = m.version, time.Now(), host
+
+    if !m.compatible {
+      v.Compatible = m.version
+    }
+
+    if err = writeState(files.dir, v); err != nil {
+      return report, err
+    }
+  }
+
+  return report, nil
+}
+
+// MigrateState brings the state in cfg's base directory up to this
+// gowatcher's version, every migration it is missing, and reports what it
+// did. New applies the migrations an older instance still reads the state
+// after by itself, these need no daemon running. The base directory is
+// locked meanwhile, so the daemon must be stopped first
+func MigrateState(cfg Config, dryRun bool) (StateReport, error) {
+  dir, err := filepath.Abs(cfg.BaseDir)
+
+  if err != nil {
+    return StateReport{}, err
+  }
+
+  if !dryRun {
+    lock, err := lockBaseDir(dir)
+
+    if err != nil {
+      return StateReport{Dir: dir}, fmt.Errorf("%s, stop it first", err)
+    }
+
+    defer lock.release()
+  }
+
+  return migrateState(statePaths(cfg, dir), true, dryRun)
+}
+
+// compactStateFiles is migration 1, see stateMigrations
+func compactStateFiles(files stateFiles, dryRun bool) ([]string, error) {
+  ledgerKey := func(line []byte) (string, bool) {
+    var entry ledgerEntry
+
+    if err := json.Unmarshal(line, &entry); err != nil || entry.Key == "" {
+      return "", false
+    }
+
+    return entry.Key, true
+  }
+
+  valid := func(line []byte) (string, bool) {
+    return "", json.Valid(line)
+  }
+
+  var changed []string
+
+  for _, file := range []struct {
+    path string
+    key  func(line []byte) (string, bool)
+  }{
+    {files.ledger, ledgerKey},
+    {files.history, valid},
+    {files.encodes, valid},
+  } {
+    if file.path == "" {
+      continue
+    }
+
+    rewritten, err := compactLines(file.path, file.key, ".v0.bak", dryRun)
+
+    if err != nil {
+      return changed, err
+    }
+
+    if rewritten {
+      changed = append(changed, file.path)
+    }
+  }
+
+  return changed, nil
+}
+
+// compactLines rewrites a file of JSON lines without those key rejects,
+// and of the lines with the same key only the last, keeping the file as it
+// was with the backup suffix. It reports whether there was anything to
+// drop, a missing file has nothing
+func compactLines(path string, key func(line []byte) (string, bool), backup string, dryRun bool) (bool, error) {
+  f, err := os.Open(path)
+
+  if os.IsNotExist(err) {
+    return false, nil
+  }
+
+  if err != nil {
+    return false, err
+  }
+
+  defer f.Close()
+
+  var lines [][]byte
+  var keys []string
+  last := make(map[string]int)
+  dropped := false
+
+  // a bufio.Reader has no limit on how long a line can be
+  r := bufio.NewReader(f)
+
+  for {
+    line, err := r.ReadBytes('\n')
+
+    if err != nil && !errors.Is(err, io.EOF) {
+      return false, err
+    }
+
+    if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+      if k, ok := key(trimmed); ok {
+        if k != "" {
+          if _, seen := last[k]; seen {
+            dropped = true
+          }
+
+          last[k] = len(lines)
+        }
+
+        lines, keys = append(lines, trimmed), append(keys, k)
+      } else {
+        dropped = true
+      }
+    } else if len(line) > 0 {
+      dropped = true
+    }
+
+    if err != nil {
+      break
+    }
+  }
+
+  if !dropped || dryRun {
+    return dropped, nil
+  }
+
+  tmp := path + ".tmp"
+  out, err := os.Create(tmp)
+
+  if err != nil {
+    return false, err
+  }
+
+  w := bufio.NewWriter(out)
+
+  for i, line := range lines {
+    if keys[i] != "" && last[keys[i]] != i {
+      continue
+    }
+
+    w.Write(line)
+    w.WriteByte('\n')
+  }
+
+  if err = w.Flush(); err == nil {
+    err = out.Sync()
+  }
+
+  if closeErr := out.Close(); err == nil {
+    err = closeErr
+  }
+
+  if err == nil {
+    err = os.Rename(path, path+backup)
+  }
+
+  if err == nil {
+    err = os.Rename(tmp, path)
+  }
+
+  if err != nil {
+    os.Remove(tmp)
+    return false, err
+  }
+
+  return true, nil
+}
@@ -0,0 +1,350 @@
+package watcher
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "sort"
+  "sync"
+  "time"
+)
+
+// JobStats is what an encode took and gave, recorded for every job that
+// ran ffmpeg and then finished or failed. Ratio is the outputs' size over
+// the input's, FPS the frames encoded per second of encoding and Speed the
+// seconds of media encoded per second, 2 is twice realtime
+type JobStats struct {
+  JobID         int64     `json:"job_id"`
+  JobUID        string    `json:"job_uid,omitempty"`
+  Input         string    `json:"input"`
+  Profile       string    `json:"profile"`
+  State         JobState  `json:"state"`
+  Hardware      bool      `json:"hardware,omitempty"`
+  FinishedAt    time.Time `json:"finished_at"`
+  WallSeconds   float64   `json:"wall_seconds"`
+  EncodeSeconds float64   `json:"encode_seconds"`
+  MediaSeconds  float64   `json:"media_seconds,omitempty"`
+  InputBytes    int64     `json:"input_bytes"`
+  OutputBytes   int64     `json:"output_bytes,omitempty"`
+  Ratio         float64   `json:"ratio,omitempty"`
+  Frames        int64     `json:"frames,omitempty"`
+  FPS           float64   `json:"fps,omitempty"`
+  Speed         float64   `json:"speed,omitempty"`
+}
+
+// encodeTotals is what a job's encode took: the time in ffmpeg, the length
+// of the media, the frames encoded and whether it used hardware flags
+type encodeTotals struct {
+  time     time.Duration
+  media    time.Duration
+  frames   int64
+  hardware bool
+}
+
+// newJobStats sets the stats of a job that ended, nil when it never got to
+// ffmpeg
+func newJobStats(j *Job) *JobStats {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.encoded.time <= 0 {
+    return nil
+  }
+
+  s := &JobStats{
+    JobID:         j.id,
+    JobUID:        j.uid,
+    Input:         j.input,
+    Profile:       j.profile.Name,
+    State:         j.state,
+    Hardware:      j.encoded.hardware,
+    FinishedAt:    j.finishedAt,
+    WallSeconds:   j.finishedAt.Sub(j.startedAt).Seconds(),
+    EncodeSeconds: j.encoded.time.Seconds(),
+    MediaSeconds:  j.encoded.media.Seconds(),
+    InputBytes:    j.inputBytes,
+    OutputBytes:   j.outputBytes,
+    Frames:        j.encoded.frames,
+  }
+
+  if s.InputBytes > 0 && s.OutputBytes > 0 {
+    s.Ratio = float64(s.OutputBytes) / float64(s.InputBytes)
+  }
+
+  if s.Frames > 0 {
+    s.FPS = float64(s.Frames) / s.EncodeSeconds
+  }
+
+  if j.state == JobDone && s.MediaSeconds > 0 {
+    s.Speed = s.MediaSeconds / s.EncodeSeconds
+  }
+
+  j.stats = s
+
+  return s
+}
+
+// statsHistory keeps the stats of the jobs, appended to a file when there
+// is one so they outlive restarts
+type statsHistory struct {
+  mu      sync.Mutex
+  path    string
+  entries []JobStats
+}
+
+// openStatsHistory reads the history at path, a missing file is an empty
+// history and no path keeps it in memory
+func openStatsHistory(path string) (*statsHistory, error) {
+  h := &statsHistory{path: path}
+
+  if path == "" {
+    return h, nil
+  }
+
+  f, err := os.Open(path)
+
+  if os.IsNotExist(err) {
+    return h, nil
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  defer f.Close()
+
+  scanner := bufio.NewScanner(f)
+  scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+  for line := 1; scanner.Scan(); line++ {
+    var entry JobStats
+
+    if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.FinishedAt.IsZero() {
+      slog.Warn("Skipping bad history line", "history", path, "line", line)
+      continue
+    }
+
+    h.entries = append(h.entries, entry)
+  }
+
+  return h, scanner.Err()
+}
+
+// record adds a job's stats, a failed write only loses them after a restart
+func (h *statsHistory) record(s JobStats) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  h.entries = append(h.entries, s)
+
+  if h.path == "" {
+    return
+  }
+
+  line, err := json.Marshal(s)
+
+  if err != nil {
+    return
+  }
+
+  f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err == nil {
+    _, err = f.Write(append(line, '\n'))
+
+    if closeErr := f.Close(); err == nil {
+      err = closeErr
+    }
+  }
+
+  if err != nil {
+    slog.Error("Could not write job stats to the history", "history", h.path, "error", err)
+  }
+}
+
+// since returns the stats of the jobs that ended after t
+func (h *statsHistory) since(t time.Time) []JobStats {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  // entries are in the order the jobs ended, apart from a clock change
+  i := sort.Search(len(h.entries), func(i int) bool { return h.entries[i].FinishedAt.After(t) })
+
+  return append([]JobStats(nil), h.entries[i:]...)
+}
+
+// StatsSummary adds up the stats of some jobs. Ratio, FPS and Speed are
+// over the finished jobs, weighed by their size and time
+type StatsSummary struct {
+  Jobs          int     `json:"jobs"`
+  Done          int     `json:"done"`
+  Failed        int     `json:"failed"`
+  InputBytes    int64   `json:"input_bytes"`
+  OutputBytes   int64   `json:"output_bytes"`
+  Ratio         float64 `json:"ratio,omitempty"`
+  WallSeconds   float64 `json:"wall_seconds"`
+  EncodeSeconds float64 `json:"encode_seconds"`
+  MediaSeconds  float64 `json:"media_seconds"`
+  Frames        int64   `json:"frames"`
+  FPS           float64 `json:"fps,omitempty"`
+  Speed         float64 `json:"speed,omitempty"`
+
+  // AvgWallSeconds is a finished job's average time from starting to done
+  AvgWallSeconds float64 `json:"avg_wall_seconds,omitempty"`
+
+  // finished holds the finished jobs' totals the rates are worked out from
+  finished struct {
+    input, output int64
+    encode, media float64
+    frameSeconds  float64
+    frames        int64
+    wall          float64
+  }
+}
+
+func (s *StatsSummary) add(j JobStats) {
+  s.Jobs++
+  s.InputBytes += j.InputBytes
+  s.OutputBytes += j.OutputBytes
+  s.WallSeconds += j.WallSeconds
+  s.EncodeSeconds += j.EncodeSeconds
+  s.MediaSeconds += j.MediaSeconds
+  s.Frames += j.Frames
+
+  if j.State != JobDone {
+    s.Failed++
+    return
+  }
+
+  s.Done++
+  f := &s.finished
+  f.input += j.InputBytes
+  f.output += j.OutputBytes
+  f.encode += j.EncodeSeconds
+  f.media += j.MediaSeconds
+  f.wall += j.WallSeconds
+
+  if j.Frames > 0 {
+    f.frames += j.Frames
+    f.frameSeconds += j.EncodeSeconds
+  }
+}
+
+func (s *StatsSummary) finish() {
+  f := s.finished
+
+  if f.input > 0 && f.output > 0 {
+    s.Ratio = float64(f.output) / float64(f.input)
+  }
+
+  if f.frameSeconds > 0 {
+    s.FPS = float64(f.frames) / f.frameSeconds
+  }
+
+  if f.encode > 0 && f.media > 0 {
+    s.Speed = f.media / f.encode
+  }
+
+  if s.Done > 0 {
+    s.AvgWallSeconds = f.wall / float64(s.Done)
+  }
+}
+
+// StatsWindow is the summary of the jobs that ended in a window, like the
+// last 24h, in total and by profile. Window "all" covers the whole history
+type StatsWindow struct {
+  Window string     `json:"window"`
+  Since  *time.Time `json:"since,omitempty"`
+  StatsSummary
+  Profiles map[string]*StatsSummary `json:"profiles,omitempty"`
+}
+
+// defaultStatsWindows are the windows GET /stats returns without ?window
+var defaultStatsWindows = []string{"1h", "24h", "7d", "30d", "all"}
+
+// parseStatsWindow is how far back a window like 90m, 24h or 7d goes, zero
+// for all
+func parseStatsWindow(window string) (time.Duration, error) {
+  if window == "all" {
+    return 0, nil
+  }
+
+  d, err := ParseAge(window)
+
+  if err != nil {
+    return 0, fmt.Errorf("invalid window %q, it must be like 90m, 24h, 7d or all", window)
+  }
+
+  return d, nil
+}
+
+// Stats sums up the history over each window, see parseStatsWindow
+func (w *Watcher) Stats(windows []string) ([]StatsWindow, error) {
+  now := time.Now()
+  views := make([]StatsWindow, 0, len(windows))
+
+  for _, window := range windows {
+    back, err := parseStatsWindow(window)
+
+    if err != nil {
+      return nil, err
+    }
+
+    view := StatsWindow{Window: window, Profiles: make(map[string]*StatsSummary)}
+    var since time.Time
+
+    if back > 0 {
+      since = now.Add(-back)
+      view.Since = &since
+    }
+
+    for _, j := range w.enc.history.since(since) {
+      view.add(j)
+
+      p := view.Profiles[j.Profile]
+
+      if p == nil {
+        p = &StatsSummary{}
+        view.Profiles[j.Profile] = p
+      }
+
+      p.add(j)
+    }
+
+    view.finish()
+
+    for _, p := range view.Profiles {
+      p.finish()
+    }
+
+    views = append(views, view)
+  }
+
+  return views, nil
+}
+
+// stats serves GET /stats[?window=24h,7d]
+func (a *api) stats(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+    return
+  }
+
+  windows := defaultStatsWindows
+
+  if window := r.URL.Query().Get("window"); window != "" {
+    windows = SplitList(window)
+  }
+
+  views, err := a.w.Stats(windows)
+
+  if err != nil {
+    writeError(w, http.StatusBadRequest, err.Error())
+    return
+  }
+
+  writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,454 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "github.com/fsnotify/fsnotify"
+)
+
+// Storage is a directory files are kept in: a local one, an S3 bucket's
+// prefix, or one on an SFTP or FTP server, see OpenStorage, or one of your
+// own. Names are relative to it. ffmpeg only works on local files, so a
+// queue on a Storage is read into the working directory, which is always
+// local, and finished outputs are written from it
+type Storage interface {
+  // List returns the regular files directly in the directory
+  List(ctx context.Context) ([]StorageFile, error)
+
+  // Watch returns a channel that receives when the directory may have
+  // changed, at least every interval, until ctx is done
+  Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error)
+
+  // Read copies the file name to the local file dest
+  Read(ctx context.Context, name string, dest string) error
+
+  // Write copies the local file src to name, which may be in a
+  // subdirectory. Directories are made as needed
+  Write(ctx context.Context, src string, name string) error
+
+  // Move moves the file name into dir, relative to the directory unless
+  // absolute. dir must exist
+  Move(ctx context.Context, name string, dir string) error
+
+  Delete(ctx context.Context, name string) error
+
+  // String is how the directory is shown in logs, without a password
+  String() string
+}
+
+// StorageFile is a file in a Storage, ModTime is zero when the backend does
+// not say
+type StorageFile struct {
+  Name    string
+  Size    int64
+  ModTime time.Time
+}
+
+// StorageOptions are what OpenStorage needs to reach a backend besides its
+// URL
+type StorageOptions struct {
+  // S3 has the endpoint, region, credentials and upload settings for s3://
+  // URLs, whose bucket and prefix replace its own
+  S3 S3Upload
+
+  // SFTPCommand is the OpenSSH sftp client, default sftp from PATH, and
+  // SFTPIdentity the private key it uses instead of ssh's default ones
+  SFTPCommand  string
+  SFTPIdentity string
+}
+
+// OpenStorage opens the Storage at rawURL: a local directory as a path or
+// file:// URL, s3://bucket/prefix, sftp://user@host/dir, or ftp:// and
+// ftps:// for FTP. SFTP paths are absolute unless they start with /~/, FTP
+// ones relative to the login directory unless they start with //
+func OpenStorage(rawURL string, opts StorageOptions) (Storage, error) {
+  u, err := url.Parse(rawURL)
+
+  if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+    // a plain path, C:\ included
+    return newLocalStorage(rawURL)
+  }
+
+  switch u.Scheme {
+  case "file":
+    return newLocalStorage(u.Path)
+  case "s3":
+    return newS3Storage(u, opts.S3)
+  case "ftp", "ftps", "sftp":
+    if u.Hostname() == "" {
+      return nil, fmt.Errorf("no host in %q", rawURL)
+    }
+
+    if u.Scheme == "sftp" {
+      if _, ok := u.User.Password(); ok {
+        return nil, fmt.Errorf("sftp only authenticates with keys, remove the password from the URL")
+      }
+
+      return &sftpStorage{url: u, command: opts.SFTPCommand, identity: opts.SFTPIdentity}, nil
+    }
+
+    return &ftpStorage{url: u}, nil
+  }
+
+  return nil, fmt.Errorf("unsupported URL %q, use a path, file://, s3://, sftp://, ftp:// or ftps://", rawURL)
+}
+
+// redactedURL is u without its password
+func redactedURL(u *url.URL) string {
+  shown := *u
+
+  if shown.User != nil {
+    shown.User = url.User(shown.User.Username())
+  }
+
+  return shown.String()
+}
+
+// pollStorage is Watch for backends that cannot tell when they change
+func pollStorage(ctx context.Context, interval time.Duration) <-chan struct{} {
+  ch := make(chan struct{}, 1)
+
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        select {
+        case ch <- struct{}{}:
+        default:
+        }
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+
+  return ch
+}
+
+// localStorage is a directory on a local or mounted file system
+type localStorage struct {
+  dir string
+}
+
+func newLocalStorage(dir string) (*localStorage, error) {
+  abs, err := filepath.Abs(dir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  info, err := os.Stat(abs)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if !info.IsDir() {
+    return nil, fmt.Errorf("%s is not a directory", abs)
+  }
+
+  return &localStorage{dir: abs}, nil
+}
+
+func (s *localStorage) path(name string) string {
+  return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *localStorage) List(ctx context.Context) ([]StorageFile, error) {
+  entries, err := os.ReadDir(s.dir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  var files []StorageFile
+
+  for _, entry := range entries {
+    info, err := entry.Info()
+
+    if err != nil || !info.Mode().IsRegular() {
+      continue
+    }
+
+    files = append(files, StorageFile{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+  }
+
+  return files, nil
+}
+
+// Watch sends a second after the directory's files stop changing, as well
+// as every interval, in case the file system, like NFS, sends no events
+func (s *localStorage) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+  notifier, err := fsnotify.NewWatcher()
+
+  if err != nil {
+    return nil, err
+  }
+
+  if err = notifier.Add(s.dir); err != nil {
+    notifier.Close()
+    return nil, err
+  }
+
+  ch := make(chan struct{}, 1)
+
+  go func() {
+    defer notifier.Close()
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    quiet := time.NewTimer(time.Hour)
+    quiet.Stop()
+
+    for {
+      select {
+      case <-notifier.Events:
+        quiet.Reset(time.Second)
+        continue
+      case <-notifier.Errors:
+        continue
+      case <-quiet.C:
+      case <-ticker.C:
+      case <-ctx.Done():
+        return
+      }
+
+      select {
+      case ch <- struct{}{}:
+      default:
+      }
+    }
+  }()
+
+  return ch, nil
+}
+
+func (s *localStorage) Read(ctx context.Context, name string, dest string) error {
+  return copyLocal(s.path(name), dest)
+}
+
+func (s *localStorage) Write(ctx context.Context, src string, name string) error {
+  dest := s.path(name)
+
+  if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+    return err
+  }
+
+  // written next to the file, then renamed, so a watcher of the directory
+  // never sees half of it
+  part := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".part")
+
+  if err := copyLocal(src, part); err != nil {
+    os.Remove(part)
+    return err
+  }
+
+  return os.Rename(part, dest)
+}
+
+func (s *localStorage) Move(ctx context.Context, name string, dir string) error {
+  if !filepath.IsAbs(dir) {
+    dir = filepath.Join(s.dir, dir)
+  }
+
+  return moveFile(s.path(name), filepath.Join(dir, filepath.Base(name)))
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+  return os.Remove(s.path(name))
+}
+
+func (s *localStorage) String() string {
+  return s.dir
+}
+
+// copyLocal copies src to a new file at dest, keeping its modification
+// time
+func copyLocal(src string, dest string) error {
+  info, err := os.Stat(src)
+
+  if err != nil {
+    return err
+  }
+
+  os.Remove(dest)
+
+  if err = copyFile(src, dest, info, nil); err != nil {
+    os.Remove(dest)
+    return err
+  }
+
+  return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// sftpStorage is a directory on an SFTP server, every call runs the sftp
+// client again, see sftpConn
+type sftpStorage struct {
+  url      *url.URL
+  command  string
+  identity string
+}
+
+func (s *sftpStorage) conn(ctx context.Context) (*sftpConn, error) {
+  return dialSFTP(ctx, s.url, s.command, s.identity)
+}
+
+func (s *sftpStorage) List(ctx context.Context) ([]StorageFile, error) {
+  c, err := s.conn(ctx)
+
+  if err != nil {
+    return nil, err
+  }
+
+  return c.list()
+}
+
+func (s *sftpStorage) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+  return pollStorage(ctx, interval), nil
+}
+
+func (s *sftpStorage) Read(ctx context.Context, name string, dest string) error {
+  c, err := s.conn(ctx)
+
+  if err != nil {
+    return err
+  }
+
+  return c.download(name, dest)
+}
+
+func (s *sftpStorage) Write(ctx context.Context, src string, name string) error {
+  c, err := s.conn(ctx)
+
+  if err != nil {
+    return err
+  }
+
+  return c.upload(src, name)
+}
+
+func (s *sftpStorage) Move(ctx context.Context, name string, dir string) error {
+  c, err := s.conn(ctx)
+
+  if err != nil {
+    return err
+  }
+
+  return c.rename(name, dir)
+}
+
+func (s *sftpStorage) Delete(ctx context.Context, name string) error {
+  c, err := s.conn(ctx)
+
+  if err != nil {
+    return err
+  }
+
+  return c.remove(name)
+}
+
+func (s *sftpStorage) String() string {
+  return redactedURL(s.url)
+}
+
+// ftpStorage is a directory on an FTP server, every call logs in again as
+// FTP sessions do not outlive a context
+type ftpStorage struct {
+  url *url.URL
+}
+
+// session runs fn on a logged in connection
+func (s *ftpStorage) session(ctx context.Context, fn func(c *ftpConn) error) error {
+  c, err := dialFTP(ctx, s.url)
+
+  if err != nil {
+    return err
+  }
+
+  // a QUIT that fails does not undo what was done
+  defer c.close()
+
+  return fn(c)
+}
+
+func (s *ftpStorage) List(ctx context.Context) ([]StorageFile, error) {
+  var files []StorageFile
+
+  err := s.session(ctx, func(c *ftpConn) error {
+    var err error
+    files, err = c.list()
+
+    return err
+  })
+
+  return files, err
+}
+
+func (s *ftpStorage) Watch(ctx context.Context, interval time.Duration) (<-chan struct{}, error) {
+  return pollStorage(ctx, interval), nil
+}
+
+func (s *ftpStorage) Read(ctx context.Context, name string, dest string) error {
+  return s.session(ctx, func(c *ftpConn) error { return c.download(name, dest) })
+}
+
+func (s *ftpStorage) Write(ctx context.Context, src string, name string) error {
+  return s.session(ctx, func(c *ftpConn) error { return c.upload(src, name) })
+}
+
+func (s *ftpStorage) Move(ctx context.Context, name string, dir string) error {
+  return s.session(ctx, func(c *ftpConn) error { return c.rename(name, dir) })
+}
+
+func (s *ftpStorage) Delete(ctx context.Context, name string) error {
+  return s.session(ctx, func(c *ftpConn) error { return c.remove(name) })
+}
+
+func (s *ftpStorage) String() string {
+  return redactedURL(s.url)
+}
+
+// FinishedStorage writes each job's outputs to a Storage once they are in
+// the finished directory, under their path there. The job is only done once
+// every output is written, a failed write fails it
+type FinishedStorage struct {
+  // URL is the Storage, see OpenStorage, Storage one of your own instead
+  URL     string
+  Storage Storage
+  Options StorageOptions
+
+  // DeleteLocal removes the outputs from the finished directory once they
+  // are written, otherwise KeepLocal prunes them that long afterwards,
+  // nothing else in the directory is touched. Zero for both keeps them
+  DeleteLocal bool
+  KeepLocal   time.Duration
+}
+
+// storageUpload is a destination writing outputs to a Storage, under
+// their path relative to the finished directory
+type storageUpload struct {
+  storage Storage
+}
+
+func (u storageUpload) key(rel string) string {
+  return path.Clean(filepath.ToSlash(rel))
+}
+
+func (u storageUpload) upload(ctx context.Context, file string, key string, t *transfer) error {
+  return t.retry(func() error { return u.storage.Write(ctx, file, key) })
+}
+
+func (u storageUpload) location(key string) string {
+  return strings.TrimSuffix(u.storage.String(), "/") + "/" + key
+}
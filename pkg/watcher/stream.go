@@ -0,0 +1,526 @@
+package watcher
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// RedisStream takes jobs from a Redis stream as well as from the queue
+// directory, so workers need no shared storage. Each entry has a url field,
+// an http or https URL the input is downloaded from into the working
+// directory, and optionally a name field for the outputs as in EnqueueURL.
+// The workers read through one consumer group: an entry is acknowledged
+// once its job is done, a failed or interrupted job's entry stays pending
+// and is claimed again after ClaimIdle, by any worker, until it has been
+// delivered MaxDeliveries times and moves to the dead letter stream
+type RedisStream struct {
+  // URL is redis://[user:password@]host[:port][/db], rediss:// for TLS
+  URL string
+
+  // Stream defaults to gowatcher:jobs and DeadStream to the stream's name
+  // with :dead added
+  Stream     string
+  DeadStream string
+
+  // Group is the consumer group the workers share, created at the start
+  // of the stream when missing, default gowatcher. Consumer names this
+  // worker in it and must be unique, default the host name
+  Group    string
+  Consumer string
+
+  // ClaimIdle is how long an entry pending on a worker that stopped
+  // refreshing it, one that died, waits before another takes it, default
+  // 5m. Running jobs' entries are refreshed well within it
+  ClaimIdle time.Duration
+
+  // MaxDeliveries is how many times an entry is tried, default 5
+  MaxDeliveries int
+}
+
+const (
+  defaultStream        = "gowatcher:jobs"
+  defaultStreamGroup   = "gowatcher"
+  defaultClaimIdle     = 5 * time.Minute
+  defaultMaxDeliveries = 5
+
+  // streamBlock is how long a read waits for new entries
+  streamBlock = 5 * time.Second
+)
+
+// streamEntry is an entry being worked on and its job, claimed is when it
+// was last claimed or refreshed
+type streamEntry struct {
+  id      string
+  dir     string
+  job     *Job
+  claimed time.Time
+}
+
+// streamConsumer consumes a RedisStream for a Watcher, with a connection
+// of its own for acknowledgements so they do not wait for blocking reads
+type streamConsumer struct {
+  cfg  RedisStream
+  w    *Watcher
+  read *redisConn
+  ctrl *redisConn
+
+  // dir is where inputs are downloaded, in the working directory which is
+  // emptied on start
+  dir string
+
+  mu       sync.Mutex
+  inflight []*streamEntry
+
+  // grouped is set once the group is known to exist
+  grouped bool
+
+  started bool
+  done    sync.WaitGroup
+}
+
+// withDefaults fills in the defaults and checks the config
+func (cfg RedisStream) withDefaults() (RedisStream, error) {
+  if cfg.URL == "" {
+    return cfg, errors.New("no URL")
+  }
+
+  if cfg.Stream == "" {
+    cfg.Stream = defaultStream
+  }
+
+  if cfg.DeadStream == "" {
+    cfg.DeadStream = cfg.Stream + ":dead"
+  }
+
+  if cfg.Group == "" {
+    cfg.Group = defaultStreamGroup
+  }
+
+  if cfg.Consumer == "" {
+    host, err := os.Hostname()
+
+    if err != nil {
+      return cfg, fmt.Errorf("no consumer name: %s", err)
+    }
+
+    cfg.Consumer = host
+  }
+
+  if cfg.ClaimIdle <= 0 {
+    cfg.ClaimIdle = defaultClaimIdle
+  }
+
+  if cfg.MaxDeliveries <= 0 {
+    cfg.MaxDeliveries = defaultMaxDeliveries
+  }
+
+  return cfg, nil
+}
+
+func newStreamConsumer(cfg RedisStream, w *Watcher, workingDir string) (*streamConsumer, error) {
+  cfg, err := cfg.withDefaults()
+
+  if err != nil {
+    return nil, err
+  }
+
+  read, err := newRedisConn(cfg.URL)
+
+  if err != nil {
+    return nil, err
+  }
+
+  ctrl, _ := newRedisConn(cfg.URL)
+
+  return &streamConsumer{cfg: cfg, w: w, read: read, ctrl: ctrl, dir: filepath.Join(workingDir, "stream")}, nil
+}
+
+// PublishURL adds an entry for the file at an http or https URL to the
+// stream and returns its id. name is as in EnqueueURL
+func PublishURL(ctx context.Context, cfg RedisStream, rawURL string, name string) (string, error) {
+  cfg, err := cfg.withDefaults()
+
+  if err != nil {
+    return "", err
+  }
+
+  if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return "", fmt.Errorf("not an http or https URL: %q", rawURL)
+  }
+
+  conn, err := newRedisConn(cfg.URL)
+
+  if err != nil {
+    return "", err
+  }
+
+  defer conn.close()
+
+  args := []string{"XADD", cfg.Stream, "*", "url", rawURL}
+
+  if name != "" {
+    args = append(args, "name", name)
+  }
+
+  reply, err := conn.do(ctx, 0, args...)
+
+  if err != nil {
+    return "", err
+  }
+
+  id, _ := reply.(string)
+
+  return id, nil
+}
+
+// start creates the group and reads entries until stop is closed
+func (s *streamConsumer) start(stop <-chan struct{}) {
+  ctx, cancel := context.WithCancel(context.Background())
+
+  go func() {
+    <-stop
+    cancel()
+  }()
+
+  s.started = true
+  s.done.Add(2)
+
+  go func() {
+    defer s.done.Done()
+    s.receive(ctx)
+  }()
+
+  go func() {
+    defer s.done.Done()
+
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        s.settle(ctx)
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+
+  slog.Info("Taking jobs from Redis stream", "url", s.read.location(), "stream", s.cfg.Stream, "group", s.cfg.Group, "consumer", s.cfg.Consumer)
+}
+
+// stop waits for the loops to end and acknowledges the entries of the jobs
+// that finished since, the others stay pending for whoever claims them
+func (s *streamConsumer) stop() {
+  if !s.started {
+    return
+  }
+
+  s.done.Wait()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+  defer cancel()
+
+  s.settle(ctx)
+
+  for _, e := range s.inflight {
+    os.RemoveAll(e.dir)
+  }
+
+  s.read.close()
+  s.ctrl.close()
+}
+
+func (s *streamConsumer) receive(ctx context.Context) {
+  // this consumer's own pending entries first, from before a restart
+  pendingStart := "0"
+
+  for ctx.Err() == nil {
+    // leave entries to other workers while jobs are waiting here
+    if s.w.queue.len() > 0 || s.w.queue.isPaused() || s.w.queue.isHeld() {
+      sleepCtx(ctx, 2*time.Second)
+      continue
+    }
+
+    entries, err := s.next(ctx, &pendingStart)
+
+    if err != nil {
+      // the stream or group was deleted
+      if strings.HasPrefix(err.Error(), "NOGROUP") {
+        s.grouped = false
+      }
+
+      if ctx.Err() == nil {
+        slog.Error("Redis stream read failed", "url", s.read.location(), "stream", s.cfg.Stream, "error", err)
+        sleepCtx(ctx, 10*time.Second)
+      }
+
+      continue
+    }
+
+    for _, e := range entries {
+      s.handle(ctx, e)
+    }
+  }
+}
+
+// next returns the entries to work on: this consumer's pending ones once
+// after a restart, then those stuck on other consumers, then new ones
+func (s *streamConsumer) next(ctx context.Context, pendingStart *string) ([]redisEntry, error) {
+  if !s.grouped {
+    if _, err := s.read.do(ctx, 0, "XGROUP", "CREATE", s.cfg.Stream, s.cfg.Group, "0", "MKSTREAM"); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+      return nil, err
+    }
+
+    s.grouped = true
+  }
+
+  if *pendingStart != "" {
+    reply, err := s.read.do(ctx, 0, "XREADGROUP", "GROUP", s.cfg.Group, s.cfg.Consumer, "COUNT", "1", "STREAMS", s.cfg.Stream, *pendingStart)
+
+    if err != nil {
+      return nil, err
+    }
+
+    entries, err := parseStreamReply(reply)
+
+    if err != nil {
+      return nil, err
+    }
+
+    if len(entries) > 0 {
+      *pendingStart = entries[len(entries)-1].id
+      return entries, nil
+    }
+
+    *pendingStart = ""
+  }
+
+  if entries, err := s.claimIdle(ctx); err != nil || len(entries) > 0 {
+    return entries, err
+  }
+
+  reply, err := s.read.do(ctx, streamBlock, "XREADGROUP", "GROUP", s.cfg.Group, s.cfg.Consumer, "COUNT", "1", "BLOCK", strconv.FormatInt(streamBlock.Milliseconds(), 10), "STREAMS", s.cfg.Stream, ">")
+
+  if err != nil {
+    return nil, err
+  }
+
+  return parseStreamReply(reply)
+}
+
+// claimIdle claims an entry left pending longer than ClaimIdle, one that
+// has been delivered too often goes to the dead letter stream instead
+func (s *streamConsumer) claimIdle(ctx context.Context) ([]redisEntry, error) {
+  idle := strconv.FormatInt(s.cfg.ClaimIdle.Milliseconds(), 10)
+  reply, err := s.read.do(ctx, 0, "XPENDING", s.cfg.Stream, s.cfg.Group, "IDLE", idle, "-", "+", "1")
+
+  if err != nil {
+    return nil, err
+  }
+
+  pending, _ := reply.([]any)
+
+  if len(pending) == 0 {
+    return nil, nil
+  }
+
+  // id, consumer, idle milliseconds, deliveries
+  fields, _ := pending[0].([]any)
+
+  if len(fields) != 4 {
+    return nil, fmt.Errorf("unexpected pending entry %v", pending[0])
+  }
+
+  id, _ := fields[0].(string)
+  owner, _ := fields[1].(string)
+  deliveries, _ := fields[3].(int64)
+
+  if reply, err = s.read.do(ctx, 0, "XCLAIM", s.cfg.Stream, s.cfg.Group, s.cfg.Consumer, idle, id); err != nil {
+    return nil, err
+  }
+
+  entries, err := parseEntries(reply)
+
+  if err != nil || len(entries) == 0 {
+    // someone else claimed it first
+    return nil, err
+  }
+
+  if len(entries[0].fields) == 0 {
+    // deleted from the stream, nothing to do
+    _, err = s.read.do(ctx, 0, "XACK", s.cfg.Stream, s.cfg.Group, id)
+    return nil, err
+  }
+
+  if deliveries >= int64(s.cfg.MaxDeliveries) {
+    slog.Warn("Moving stream entry to the dead letter stream", "entry", id, "deliveries", deliveries, "stream", s.cfg.DeadStream)
+
+    args := []string{"XADD", s.cfg.DeadStream, "*", "entry", id, "deliveries", strconv.FormatInt(deliveries, 10)}
+
+    for field, value := range entries[0].fields {
+      args = append(args, field, value)
+    }
+
+    if _, err = s.read.do(ctx, 0, args...); err != nil {
+      return nil, err
+    }
+
+    _, err = s.read.do(ctx, 0, "XACK", s.cfg.Stream, s.cfg.Group, id)
+
+    return nil, err
+  }
+
+  if owner != s.cfg.Consumer {
+    slog.Info("Claimed idle stream entry", "entry", id, "from", owner, "deliveries", deliveries)
+  }
+
+  return entries, nil
+}
+
+// parseStreamReply reads the entries of an XREADGROUP reply for one stream,
+// nil when the read timed out
+func parseStreamReply(reply any) ([]redisEntry, error) {
+  streams, ok := reply.([]any)
+
+  if !ok || len(streams) == 0 {
+    return nil, nil
+  }
+
+  stream, ok := streams[0].([]any)
+
+  if !ok || len(stream) != 2 {
+    return nil, fmt.Errorf("unexpected reply %v", reply)
+  }
+
+  return parseEntries(stream[1])
+}
+
+// handle downloads an entry's input and queues a job for it. Entries that
+// can never be a job are acknowledged and dropped
+func (s *streamConsumer) handle(ctx context.Context, e redisEntry) {
+  if len(e.fields) == 0 {
+    // deleted from the stream while pending
+    s.ack(ctx, e.id)
+    return
+  }
+
+  u, err := url.Parse(e.fields["url"])
+
+  if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    slog.Warn("Dropping stream entry without an http or https url", "entry", e.id)
+    s.ack(ctx, e.id)
+    return
+  }
+
+  name := e.fields["name"]
+
+  if name == "" {
+    name = path.Base(u.Path)
+  }
+
+  if name == "" || name == "." || name == "/" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") || isSidecar(name) || !s.w.filter.Load().allowed(name) {
+    slog.Warn("Dropping stream entry, not a file this watcher encodes", "entry", e.id, "name", name)
+    s.ack(ctx, e.id)
+    return
+  }
+
+  se := &streamEntry{id: e.id, dir: filepath.Join(s.dir, strings.ReplaceAll(e.id, "-", "_")), claimed: time.Now()}
+  file := filepath.Join(se.dir, name)
+
+  if err = os.MkdirAll(se.dir, 0755); err != nil {
+    slog.Error("Could not create stream directory", "dir", se.dir, "error", err)
+    return
+  }
+
+  // the entry is tracked while it downloads so it is refreshed
+  s.mu.Lock()
+  s.inflight = append(s.inflight, se)
+  s.mu.Unlock()
+
+  startedAt := time.Now()
+
+  if err = s.w.downloads.fetch(ctx, u.String(), file); err == nil {
+    slog.Info("Downloaded", "url", redactURL(u), "to", file, "took", time.Since(startedAt).Round(time.Second).String())
+
+    s.mu.Lock()
+    se.job = s.w.enqueue(file, "", nil)
+    s.mu.Unlock()
+
+    return
+  }
+
+  // left pending, it is claimed again after ClaimIdle
+  if ctx.Err() == nil {
+    slog.Error("Download failed", "entry", e.id, "url", redactURL(u), "error", err)
+  }
+
+  os.RemoveAll(se.dir)
+  s.forget(se)
+}
+
+// settle acknowledges the entries whose jobs are done or were cancelled
+// and refreshes those still going, failed and interrupted jobs' entries are
+// left pending
+func (s *streamConsumer) settle(ctx context.Context) {
+  s.mu.Lock()
+  entries := append([]*streamEntry(nil), s.inflight...)
+  s.mu.Unlock()
+
+  for _, se := range entries {
+    s.mu.Lock()
+    j := se.job
+    s.mu.Unlock()
+
+    if j == nil || !j.State().Finished() {
+      if time.Since(se.claimed) > s.cfg.ClaimIdle/3 {
+        // claiming an entry it already has resets its idle time
+        if _, err := s.ctrl.do(ctx, 0, "XCLAIM", s.cfg.Stream, s.cfg.Group, s.cfg.Consumer, "0", se.id, "JUSTID"); err != nil {
+          slog.Error("Could not refresh stream entry", "entry", se.id, "error", err)
+        } else {
+          se.claimed = time.Now()
+        }
+      }
+
+      continue
+    }
+
+    switch v := j.View(); {
+    case v.State == JobDone, v.State == JobCancelled && v.Error != errShutdown.Error():
+      s.ack(ctx, se.id)
+    case v.State == JobFailed:
+      slog.Warn("Job failed, its stream entry will be claimed again", "entry", se.id, "after", s.cfg.ClaimIdle.String())
+    }
+
+    os.RemoveAll(se.dir)
+    s.forget(se)
+  }
+}
+
+func (s *streamConsumer) ack(ctx context.Context, id string) {
+  if _, err := s.ctrl.do(ctx, 0, "XACK", s.cfg.Stream, s.cfg.Group, id); err != nil {
+    slog.Error("Could not acknowledge stream entry", "entry", id, "error", err)
+  }
+}
+
+func (s *streamConsumer) forget(se *streamEntry) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  for i, other := range s.inflight {
+    if other == se {
+      s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+      break
+    }
+  }
+}
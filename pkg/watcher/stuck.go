@@ -0,0 +1,87 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "time"
+)
+
+// watchStuck tells the handlers once jobs have been waiting for after with
+// no job starting, finishing or making progress, a full disk or a hung
+// encode with every worker busy. Time spent paused, outside the schedule
+// or deferred does not count. It tells them again the next time the queue gets stuck,
+// until stop is closed
+func (w *Watcher) watchStuck(after time.Duration, stop <-chan struct{}) {
+  ticker := time.NewTicker(min(after/4, time.Minute))
+  defer ticker.Stop()
+
+  waitingSince := time.Now()
+  var reported time.Time
+
+  for {
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+
+    queued := w.queue.len()
+
+    if queued == 0 || w.queue.isPaused() || w.queue.isHeld() || w.queue.deferredFor() != "" {
+      waitingSince = time.Now()
+      continue
+    }
+
+    since := w.lastActivity()
+
+    if since.Before(waitingSince) {
+      since = waitingSince
+    }
+
+    if time.Since(since) < after || since.Equal(reported) {
+      continue
+    }
+
+    reported = since
+    stuckFor := time.Since(since)
+
+    slog.Warn("Queue stuck", "queued", queued, "for", stuckFor.Round(time.Second).String())
+
+    ev := JobEvent{
+      Event:           "stuck",
+      Queued:          queued,
+      DurationSeconds: stuckFor.Seconds(),
+      Error:           fmt.Sprintf("No job has started, finished or made progress for %s", stuckFor.Round(time.Second)),
+    }
+
+    for _, h := range w.enc.handlers {
+      h.HandleEvent(ev)
+    }
+  }
+}
+
+// lastActivity is when a job last started, finished or made progress
+func (w *Watcher) lastActivity() time.Time {
+  var last time.Time
+
+  for _, j := range w.store.list("") {
+    j.mu.Lock()
+    times := []time.Time{j.startedAt, j.finishedAt}
+
+    if j.progress != nil {
+      j.progress.mu.Lock()
+      times = append(times, j.progress.updatedAt)
+      j.progress.mu.Unlock()
+    }
+
+    j.mu.Unlock()
+
+    for _, t := range times {
+      if t.After(last) {
+        last = t
+      }
+    }
+  }
+
+  return last
+}
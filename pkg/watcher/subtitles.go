@@ -0,0 +1,167 @@
+package watcher
+
+import (
+  "fmt"
+  "path/filepath"
+  "slices"
+  "strings"
+)
+
+// SubtitleMode is what a profile does with the input's subtitle streams.
+// Empty leaves it to ffmpeg, which keeps at most one if the container takes
+// it
+type SubtitleMode string
+
+const (
+  // SubtitlesCopy keeps every video, audio and subtitle stream of the input,
+  // with the subtitles copied. Containers that cannot take the codec need
+  // e.g. -c:s mov_text in the output flags, which wins
+  SubtitlesCopy SubtitleMode = "copy"
+
+  // SubtitlesExtract writes every text subtitle stream to a .srt next to
+  // the outputs, e.g. name.eng.srt. Picture subtitles like PGS are skipped
+  SubtitlesExtract SubtitleMode = "extract"
+
+  // SubtitlesBurn draws the profile's SubtitleStream into the video, for
+  // players without subtitle support. It only takes text subtitles
+  SubtitlesBurn SubtitleMode = "burn"
+
+  // SubtitlesDrop leaves every subtitle stream out
+  SubtitlesDrop SubtitleMode = "drop"
+)
+
+// pictureSubtitles are the subtitle codecs that cannot be written as text
+var pictureSubtitles = []string{"hdmv_pgs_subtitle", "dvd_subtitle", "dvb_subtitle", "xsub"}
+
+// checkSubtitles rejects subtitle settings the profile cannot honour
+func (p *Profile) checkSubtitles() error {
+  switch p.Subtitles {
+  case "", SubtitlesCopy, SubtitlesExtract, SubtitlesBurn, SubtitlesDrop:
+  default:
+    return fmt.Errorf("subtitles must be copy, extract, burn or drop")
+  }
+
+  switch {
+  case p.SubtitleStream < 0:
+    return fmt.Errorf("subtitle_stream must not be negative")
+  case p.SplitLength > 0 && (p.Subtitles == SubtitlesCopy || p.Subtitles == SubtitlesBurn):
+    return fmt.Errorf("split_length only keeps the input's video and audio, subtitles cannot be copied or burnt in")
+  case p.Packaging != "" && p.Subtitles == SubtitlesCopy:
+    return fmt.Errorf("packages cannot take copied subtitles, extract or burn them")
+  case len(p.pipeline()) > 0 && p.Subtitles == SubtitlesExtract:
+    return fmt.Errorf("steps and commands extract subtitles themselves")
+  }
+
+  return nil
+}
+
+// withSubtitles adds the output flags for the profile's subtitle mode. The
+// maps and codec go first so the profile's own flags win
+func (p *Profile) withSubtitles(output []string, input string) []string {
+  switch p.Subtitles {
+  case SubtitlesCopy:
+    return append([]string{"-map", "0:v?", "-map", "0:a?", "-map", "0:s?", "-c:s", "copy"}, output...)
+  case SubtitlesBurn:
+    filter := fmt.Sprintf("subtitles=f=%s:si=%d", escapeFilterValue(input), p.SubtitleStream)
+    return append(withFilter(output, filter, videoFilterFlags...), "-sn")
+  case SubtitlesDrop:
+    return append(append([]string(nil), output...), "-sn")
+  }
+
+  return output
+}
+
+// withFilter adds filter to the last of the filter flags in flags, the
+// first of which is added when there is none
+func withFilter(flags []string, filter string, names ...string) []string {
+  out := append([]string(nil), flags...)
+
+  for i := len(out) - 2; i >= 0; i-- {
+    if slices.Contains(names, out[i]) {
+      out[i+1] += "," + filter
+      return out
+    }
+  }
+
+  return append(out, names[0], filter)
+}
+
+// escapeFilterValue escapes a filter option's value and then the filter for
+// the filtergraph, so paths with colons, quotes or commas survive both
+func escapeFilterValue(value string) string {
+  option := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(value)
+
+  return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(option)
+}
+
+// subtitleRun is the ffmpeg extracting the input's text subtitles next to
+// the job's first output, or nil when it has none
+func (e *encoder) subtitleRun(j *Job, probed *probeResult) *ffmpegRun {
+  prof := j.profile
+  name := prof.outputName(j.name, prof.outputs()[0], probed, j.startedAt)
+  base := filepath.Join(e.jobDir(j), strings.TrimSuffix(name, filepath.Ext(name)))
+
+  run := &ffmpegRun{name: "subtitles"}
+
+  run.args = append(run.args, j.sequenceFlags()...)
+
+  if j.spec != nil {
+    run.args = append(run.args, j.spec.inputFlags()...)
+  }
+
+  run.args = append(run.args, "-i", j.source())
+
+  streams := probed.streams("subtitle")
+  languages := make(map[string]int)
+
+  for _, s := range streams {
+    if !containsFold(pictureSubtitles, s.CodecName) {
+      languages[s.language()]++
+    }
+  }
+
+  for i, s := range streams {
+    if containsFold(pictureSubtitles, s.CodecName) {
+      j.logger().Info("Not extracting picture subtitles", "stream", i, "codec", s.CodecName)
+      continue
+    }
+
+    // name.eng.srt if it is the only English one, name.2.eng.srt if not
+    tag := s.language()
+
+    switch {
+    case tag == "":
+      tag = fmt.Sprint(i)
+    case languages[tag] > 1:
+      tag = fmt.Sprintf("%d.%s", i, tag)
+    }
+
+    out := base + "." + tag + ".srt"
+
+    run.args = append(run.args, "-map", fmt.Sprintf("0:s:%d", i), "-c:s", "srt")
+
+    if j.spec != nil && j.spec.end > 0 {
+      run.args = append(run.args, "-t", formatSeconds(j.spec.end-j.spec.start))
+    }
+
+    run.args = append(run.args, "-y", out)
+    run.outputs = append(run.outputs, out)
+  }
+
+  if len(run.outputs) == 0 {
+    return nil
+  }
+
+  return run
+}
+
+// language is the stream's language tag, empty when it has none
+func (s probeStream) language() string {
+  lang := strings.ToLower(s.Tags["language"])
+
+  if lang == "und" {
+    return ""
+  }
+
+  return lang
+}
@@ -0,0 +1,141 @@
+package watcher
+
+import (
+  "errors"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+)
+
+// SymlinkPolicy is what becomes of a symlink dropped into a queue directory
+type SymlinkPolicy string
+
+const (
+  // SymlinksFollow encodes a link like the file it points to, reading
+  // through the link. The originals policy and failed moves apply to the
+  // link, never to its target
+  SymlinksFollow SymlinkPolicy = "follow"
+
+  // SymlinksResolve encodes the file the link ends at, read in place. Once
+  // the encode succeeds only the link is removed, it is never archived,
+  // and a failed job's link moves into the failed directory still pointing
+  // at the target
+  SymlinksResolve SymlinkPolicy = "resolve"
+
+  // SymlinksSkip leaves links in the queue directories alone
+  SymlinksSkip SymlinkPolicy = "skip"
+)
+
+// isSymlink reports whether path is a symlink itself
+func isSymlink(path string) bool {
+  info, err := os.Lstat(path)
+
+  return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// resolveLink is the file the link at path ends at. A loop, a dangling link,
+// a directory and a file straight in one of the queue dirs, which is queued
+// on its own already, are errors
+func resolveLink(path string, queueDirs []string) (string, error) {
+  target, err := filepath.EvalSymlinks(path)
+
+  if err != nil {
+    var pathErr *os.PathError
+
+    if errors.As(err, &pathErr) && errors.Is(pathErr.Err, os.ErrNotExist) {
+      return "", fmt.Errorf("symlink is dangling")
+    }
+
+    // EvalSymlinks gives up on a loop after 255 links
+    return "", fmt.Errorf("symlink cannot be resolved: %s", err)
+  }
+
+  info, err := os.Stat(target)
+
+  if err != nil {
+    return "", err
+  }
+
+  if info.IsDir() {
+    return "", fmt.Errorf("symlink points at directory %s", target)
+  }
+
+  for _, dir := range queueDirs {
+    if real, err := filepath.EvalSymlinks(dir); err == nil && filepath.Dir(target) == real {
+      return "", fmt.Errorf("symlink points into queue directory %s", dir)
+    }
+  }
+
+  return target, nil
+}
+
+// linkQueueable reports whether path may be queued under the symlink
+// policy, a link that may not is logged once until it changes
+func (w *Watcher) linkQueueable(path string) bool {
+  if !isSymlink(path) {
+    return true
+  }
+
+  var err error
+
+  if w.cfg.Symlinks == SymlinksSkip {
+    err = errors.New("symlinks are skipped")
+  } else {
+    _, err = resolveLink(path, []string{w.queueDir, w.priorityDir})
+  }
+
+  if err == nil {
+    w.badLinks.Delete(path)
+    return true
+  }
+
+  if reason, seen := w.badLinks.Swap(path, err.Error()); !seen || reason != err.Error() {
+    slog.Warn("Skipping symlink", "input", path, "reason", err)
+  }
+
+  return false
+}
+
+// resolveInput points a job whose input is a symlink at the link's target
+// under SymlinksResolve, the target is resolved again every time the job
+// starts
+func (e *encoder) resolveInput(j *Job) error {
+  j.mu.Lock()
+  input := j.input
+  j.target = ""
+  j.mu.Unlock()
+
+  if e.symlinks != SymlinksResolve || !isSymlink(input) {
+    return nil
+  }
+
+  target, err := resolveLink(input, e.queueDirs)
+
+  if err != nil {
+    return err
+  }
+
+  j.mu.Lock()
+  j.target = target
+  j.mu.Unlock()
+
+  j.logger().Info("Encoding symlink target", "target", target)
+
+  return nil
+}
+
+// moveInput moves the job's input to dest. A resolved link is made again at
+// dest pointing at the absolute target, a relative link moved as it is
+// would point somewhere else
+func moveInput(j *Job, dest string) error {
+  if j.target == "" {
+    return moveFile(j.input, dest)
+  }
+
+  if err := os.Symlink(j.target, dest); err != nil {
+    return err
+  }
+
+  return os.Remove(j.input)
+}
@@ -0,0 +1,82 @@
+package watcher
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+)
+
+// readSystemLoad reads the CPU counters, load average and available memory
+// from /proc
+func readSystemLoad() (systemLoad, error) {
+  var load systemLoad
+
+  stat, err := os.ReadFile("/proc/stat")
+
+  if err != nil {
+    return load, err
+  }
+
+  // cpu  user nice system idle iowait irq softirq steal guest guest_nice
+  line, _, _ := strings.Cut(string(stat), "\n")
+  fields := strings.Fields(line)
+
+  if len(fields) < 5 || fields[0] != "cpu" {
+    return load, fmt.Errorf("unexpected /proc/stat line %q", line)
+  }
+
+  // guest time is already counted in user
+  for i, field := range fields[1:min(len(fields), 9)] {
+    ticks, err := strconv.ParseUint(field, 10, 64)
+
+    if err != nil {
+      return load, fmt.Errorf("unexpected /proc/stat line %q", line)
+    }
+
+    load.cpuTotal += ticks
+
+    // idle and iowait
+    if i == 3 || i == 4 {
+      load.cpuIdle += ticks
+    }
+  }
+
+  loadavg, err := os.ReadFile("/proc/loadavg")
+
+  if err != nil {
+    return load, err
+  }
+
+  if load.loadAverage, err = strconv.ParseFloat(strings.Fields(string(loadavg))[0], 64); err != nil {
+    return load, fmt.Errorf("unexpected /proc/loadavg %q", loadavg)
+  }
+
+  meminfo, err := os.Open("/proc/meminfo")
+
+  if err != nil {
+    return load, err
+  }
+
+  defer meminfo.Close()
+
+  scanner := bufio.NewScanner(meminfo)
+
+  for scanner.Scan() {
+    // MemAvailable:    5535132 kB
+    if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "MemAvailable:" {
+      kb, err := strconv.ParseInt(fields[1], 10, 64)
+
+      if err != nil {
+        return load, fmt.Errorf("unexpected /proc/meminfo line %q", scanner.Text())
+      }
+
+      load.freeMemory = kb << 10
+
+      return load, nil
+    }
+  }
+
+  return load, fmt.Errorf("no MemAvailable in /proc/meminfo")
+}
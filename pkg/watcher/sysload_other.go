@@ -0,0 +1,13 @@
+//go:build !linux
+
+package watcher
+
+import (
+  "errors"
+)
+
+// readSystemLoad is not implemented here, autoscaling keeps the workers
+// it starts with
+func readSystemLoad() (systemLoad, error) {
+  return systemLoad{}, errors.New("reading the system load is not supported on this platform")
+}
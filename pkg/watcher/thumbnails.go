@@ -0,0 +1,232 @@
+package watcher
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "math"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// thumbsDir is where thumbnails go, under the finished directory
+const thumbsDir = "thumbs"
+
+// Thumbnails configures the pictures and clips made from every video output
+// once it is in the finished directory, into finished/thumbs named after
+// the output. They are uploaded with it. A thumbnail that cannot be made is
+// logged, the job still succeeds
+type Thumbnails struct {
+  // Poster is a single frame at PosterAt, name.jpg
+  Poster      bool
+  PosterAt    ThumbnailTime
+  PosterWidth int
+
+  // Sprite is a sheet of frames every SpriteInterval, SpriteColumns to a
+  // row and SpriteWidth pixels wide each, name-sprite.jpg
+  Sprite         bool
+  SpriteInterval time.Duration
+  SpriteColumns  int
+  SpriteWidth    int
+
+  // Preview is a silent clip of PreviewLength from PreviewAt,
+  // name-preview.mp4
+  Preview       bool
+  PreviewAt     ThumbnailTime
+  PreviewLength time.Duration
+  PreviewWidth  int
+}
+
+// ThumbnailTime is a point in a video, a fraction of its duration or a
+// fixed offset
+type ThumbnailTime struct {
+  Fraction float64
+  Offset   time.Duration
+}
+
+// ParseThumbnailTime parses a percentage like 10% or a duration like 30s
+func ParseThumbnailTime(value string) (ThumbnailTime, error) {
+  value = strings.TrimSpace(value)
+
+  if percent, found := strings.CutSuffix(value, "%"); found {
+    pct, err := strconv.ParseFloat(percent, 64)
+
+    if err != nil || pct < 0 || pct > 100 {
+      return ThumbnailTime{}, fmt.Errorf("bad percentage %q", value)
+    }
+
+    return ThumbnailTime{Fraction: pct / 100}, nil
+  }
+
+  d, err := time.ParseDuration(value)
+
+  if err != nil || d < 0 {
+    return ThumbnailTime{}, fmt.Errorf("bad time %q", value)
+  }
+
+  return ThumbnailTime{Offset: d}, nil
+}
+
+// at is the time in a video lasting duration, offsets past the end fall
+// back to the middle
+func (t ThumbnailTime) at(duration time.Duration) time.Duration {
+  if t.Fraction > 0 {
+    return time.Duration(float64(duration) * t.Fraction)
+  }
+
+  if duration > 0 && t.Offset >= duration {
+    return duration / 2
+  }
+
+  return t.Offset
+}
+
+// withDefaults fills in what is left zero: the poster and preview from 10%
+// in, a 10 second clip 640 wide, and a sprite frame every 10s 160 wide in
+// rows of 10
+func (t Thumbnails) withDefaults() Thumbnails {
+  if t.PosterAt == (ThumbnailTime{}) {
+    t.PosterAt = ThumbnailTime{Fraction: 0.1}
+  }
+
+  if t.SpriteInterval <= 0 {
+    t.SpriteInterval = 10 * time.Second
+  }
+
+  if t.SpriteColumns <= 0 {
+    t.SpriteColumns = 10
+  }
+
+  if t.SpriteWidth <= 0 {
+    t.SpriteWidth = 160
+  }
+
+  if t.PreviewAt == (ThumbnailTime{}) {
+    t.PreviewAt = ThumbnailTime{Fraction: 0.1}
+  }
+
+  if t.PreviewLength <= 0 {
+    t.PreviewLength = 10 * time.Second
+  }
+
+  if t.PreviewWidth <= 0 {
+    t.PreviewWidth = 640
+  }
+
+  return t
+}
+
+// scale is the filter resizing to width with the aspect ratio kept, none
+// for zero
+func scale(width int) string {
+  if width <= 0 {
+    return "null"
+  }
+
+  return fmt.Sprintf("scale=%d:-2", width)
+}
+
+// thumbnailRuns are the ffmpegs making the thumbnails of an output lasting
+// duration
+func (t *Thumbnails) thumbnailRuns(output string, duration time.Duration) []ffmpegRun {
+  dir := filepath.Join(filepath.Dir(output), thumbsDir)
+  name := strings.TrimSuffix(filepath.Base(output), filepath.Ext(output))
+
+  var runs []ffmpegRun
+
+  if t.Poster {
+    out := filepath.Join(dir, name+".jpg")
+
+    runs = append(runs, ffmpegRun{
+      name:    "poster",
+      dirs:    []string{dir},
+      outputs: []string{out},
+      args:    []string{"-ss", formatSeconds(t.PosterAt.at(duration)), "-i", output, "-frames:v", "1", "-vf", scale(t.PosterWidth), "-y", out},
+    })
+  }
+
+  if t.Sprite && duration > 0 {
+    out := filepath.Join(dir, name+"-sprite.jpg")
+    frames := int(math.Ceil(duration.Seconds() / t.SpriteInterval.Seconds()))
+    rows := (frames + t.SpriteColumns - 1) / t.SpriteColumns
+    filter := fmt.Sprintf("fps=1/%s,%s,tile=%dx%d", formatSeconds(t.SpriteInterval), scale(t.SpriteWidth), t.SpriteColumns, rows)
+
+    runs = append(runs, ffmpegRun{
+      name:    "sprite",
+      dirs:    []string{dir},
+      outputs: []string{out},
+      args:    []string{"-i", output, "-an", "-vf", filter, "-frames:v", "1", "-y", out},
+    })
+  }
+
+  if t.Preview {
+    out := filepath.Join(dir, name+"-preview.mp4")
+
+    runs = append(runs, ffmpegRun{
+      name:    "preview",
+      dirs:    []string{dir},
+      outputs: []string{out},
+      args: []string{
+        "-ss", formatSeconds(t.PreviewAt.at(duration)), "-i", output, "-t", formatSeconds(t.PreviewLength),
+        "-an", "-vf", scale(t.PreviewWidth), "-c:v", "libx264", "-pix_fmt", "yuv420p", "-movflags", "+faststart", "-y", out,
+      },
+    })
+  }
+
+  return runs
+}
+
+// makeThumbnails makes the thumbnails of every finished video output and
+// returns their paths. Outputs ffprobe finds no video in, like packages,
+// checksums or audio, are skipped. The sprite needs the duration from
+// ffprobe or the input's
+func (e *encoder) makeThumbnails(ctx context.Context, j *Job, finished []string, duration time.Duration, output io.Writer) []string {
+  var thumbs []string
+
+  logger := j.logger()
+
+  j.mu.Lock()
+  jobLog := j.log
+  j.mu.Unlock()
+
+  for _, out := range finished {
+    if ctx.Err() != nil {
+      break
+    }
+
+    if info, err := os.Stat(out); err != nil || info.IsDir() {
+      continue
+    }
+
+    length := duration
+
+    if e.ffprobePath != "" {
+      probed, err := probe(e.ffprobePath, out)
+
+      if err != nil || len(probed.streams("video")) == 0 {
+        continue
+      }
+
+      if d := probed.duration(); d > 0 {
+        length = d
+      }
+    }
+
+    for _, run := range e.thumbnails.thumbnailRuns(out, length) {
+      logger.Info("Command", "step", run.name, "args", run.args)
+
+      if err := e.runFFmpeg(ctx, j, run, output, 0); err != nil {
+        logger.Error("Could not make thumbnail", "kind", run.name, "output", out, "error", err, "reason", lastLine(jobLog.Bytes()))
+        removeAll(run.outputs)
+        continue
+      }
+
+      thumbs = append(thumbs, run.outputs...)
+    }
+  }
+
+  return thumbs
+}
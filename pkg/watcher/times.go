@@ -0,0 +1,57 @@
+package watcher
+
+import (
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+// OutputTimes is the modification time the outputs are given before they
+// land in the finished directory, see Config.OutputTimes
+type OutputTimes string
+
+const (
+  OutputTimesFFmpeg   OutputTimes = ""
+  OutputTimesSource   OutputTimes = "source"
+  OutputTimesFinished OutputTimes = "finished"
+)
+
+func (t OutputTimes) check() error {
+  switch t {
+  case OutputTimesFFmpeg, OutputTimesSource, OutputTimesFinished:
+    return nil
+  }
+
+  return fmt.Errorf("output times must be source or finished, not %q", t)
+}
+
+// setOutputTimes gives the output at path, and every file of a package,
+// the modification time OutputTimes asks for: the input's, or now
+func (e *encoder) setOutputTimes(j *Job, path string) error {
+  var t time.Time
+
+  switch e.outputTimes {
+  case OutputTimesSource:
+    info, err := os.Stat(j.input)
+
+    if err != nil {
+      return err
+    }
+
+    t = info.ModTime()
+  case OutputTimesFinished:
+    t = time.Now()
+  default:
+    return nil
+  }
+
+  return filepath.WalkDir(path, func(path string, entry fs.DirEntry, err error) error {
+    if err != nil || entry.Type()&fs.ModeSymlink != 0 {
+      return err
+    }
+
+    return os.Chtimes(path, t, t)
+  })
+}
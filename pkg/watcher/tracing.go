@@ -0,0 +1,453 @@
+package watcher
+
+import (
+  "bytes"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Telemetry exports OpenTelemetry traces and metrics to a collector over
+// OTLP/HTTP with JSON bodies. Every job is a trace, its span has one child
+// per phase: pre hook, probe, encode, validate, move, thumbnails, upload
+// and post hook. A job spec's traceparent makes the job's span a child of
+// the caller's, and hooks get theirs in TRACEPARENT
+type Telemetry struct {
+  // Endpoint is the collector's base URL, like http://collector:4318,
+  // /v1/traces and /v1/metrics are added to it
+  Endpoint string
+  Headers  map[string]string
+
+  // ServiceName is service.name on everything sent, default gowatcher
+  ServiceName string
+
+  // MetricsInterval is how often the metrics on /metrics are sent too,
+  // zero sends none
+  MetricsInterval time.Duration
+}
+
+// telemetryFlush is how often finished traces are sent, maxPendingSpans
+// how many are kept while the collector cannot be reached
+const (
+  telemetryFlush  = 5 * time.Second
+  maxPendingSpans = 4096
+)
+
+// telemetry sends the traces and metrics of one watcher
+type telemetry struct {
+  cfg      Telemetry
+  client   *http.Client
+  resource []otlpAttr
+  stats    *metrics
+  started  time.Time
+
+  mu      sync.Mutex
+  pending []otlpSpan
+  dropped int
+
+  stop chan struct{}
+  done chan struct{}
+}
+
+// span is a span that has not been sent, ids are hex
+type span struct {
+  id     string
+  parent string
+  name   string
+  start  time.Time
+  end    time.Time
+  attrs  []otlpAttr
+  err    string
+}
+
+// jobTrace is a job's trace until the job finishes: its span, and its
+// phases' spans as they end
+type jobTrace struct {
+  traceID string
+  root    span
+  spans   []span
+}
+
+func newTelemetry(cfg Telemetry, name string, stats *metrics) (*telemetry, error) {
+  if !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+    return nil, fmt.Errorf("telemetry endpoint must be an http(s) URL, not %q", cfg.Endpoint)
+  }
+
+  if cfg.ServiceName == "" {
+    cfg.ServiceName = "gowatcher"
+  }
+
+  cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+
+  t := &telemetry{
+    cfg:      cfg,
+    client:   &http.Client{Timeout: 30 * time.Second},
+    resource: []otlpAttr{stringAttr("service.name", cfg.ServiceName)},
+    stats:    stats,
+    started:  time.Now(),
+    stop:     make(chan struct{}),
+    done:     make(chan struct{}),
+  }
+
+  if name != "" {
+    t.resource = append(t.resource, stringAttr("gowatcher.root", name))
+  }
+
+  go t.run()
+
+  return t, nil
+}
+
+func (t *telemetry) run() {
+  defer close(t.done)
+
+  flush := time.NewTicker(telemetryFlush)
+  defer flush.Stop()
+
+  var metricsTick <-chan time.Time
+
+  if t.cfg.MetricsInterval > 0 {
+    ticker := time.NewTicker(t.cfg.MetricsInterval)
+    defer ticker.Stop()
+    metricsTick = ticker.C
+  }
+
+  for {
+    select {
+    case <-flush.C:
+      t.flush()
+    case <-metricsTick:
+      t.sendMetrics()
+    case <-t.stop:
+      t.flush()
+
+      if t.cfg.MetricsInterval > 0 {
+        t.sendMetrics()
+      }
+
+      return
+    }
+  }
+}
+
+// close sends what is left
+func (t *telemetry) close() {
+  if t == nil {
+    return
+  }
+
+  close(t.stop)
+  <-t.done
+}
+
+// startJob starts the job's span, a job that was put back on the queue
+// keeps the one it has
+func (t *telemetry) startJob(j *Job) {
+  if t == nil {
+    return
+  }
+
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.trace == nil {
+    j.trace = &jobTrace{traceID: randomHex(16), root: span{id: randomHex(8), name: "job", start: time.Now()}}
+  }
+}
+
+// adopt makes the job's trace part of the one in its spec's traceparent
+func (t *telemetry) adopt(j *Job) {
+  if t == nil || j.spec == nil || j.spec.TraceParent == "" {
+    return
+  }
+
+  traceID, parent, ok := parseTraceParent(j.spec.TraceParent)
+
+  if !ok {
+    j.logger().Warn("Ignoring bad traceparent", "traceparent", j.spec.TraceParent)
+    return
+  }
+
+  j.mu.Lock()
+  if j.trace != nil {
+    j.trace.traceID, j.trace.root.parent = traceID, parent
+  }
+  j.mu.Unlock()
+}
+
+// phase starts a child span of the job's, the returned func ends it
+func (t *telemetry) phase(j *Job, name string, attrs ...otlpAttr) func(err error) {
+  if t == nil {
+    return func(error) {}
+  }
+
+  s := span{id: randomHex(8), name: name, start: time.Now(), attrs: attrs}
+
+  return func(err error) {
+    s.end = time.Now()
+
+    if err != nil {
+      s.err = err.Error()
+    }
+
+    j.mu.Lock()
+    if j.trace != nil {
+      s.parent = j.trace.root.id
+      j.trace.spans = append(j.trace.spans, s)
+    }
+    j.mu.Unlock()
+  }
+}
+
+// endJob queues the job's trace to be sent once it has finished, jobs
+// waiting again keep theirs
+func (t *telemetry) endJob(j *Job) {
+  if t == nil {
+    return
+  }
+
+  j.mu.Lock()
+  trace := j.trace
+
+  if trace == nil || !j.state.Finished() {
+    j.mu.Unlock()
+    return
+  }
+
+  j.trace = nil
+  state := j.state
+  root := trace.root
+  root.end = time.Now()
+  root.err = j.err
+  root.attrs = []otlpAttr{
+    intAttr("gowatcher.job.id", j.id),
+    stringAttr("gowatcher.job.uid", j.uid),
+    stringAttr("gowatcher.job.state", string(state)),
+    stringAttr("gowatcher.input", j.input),
+    stringAttr("gowatcher.profile", j.profile.Name),
+    intAttr("gowatcher.input.bytes", j.inputBytes),
+    intAttr("gowatcher.output.bytes", j.outputBytes),
+    intAttr("gowatcher.outputs", int64(len(j.outputs))),
+  }
+  j.mu.Unlock()
+
+  // only failures are errors, a cancelled job did what it was told
+  if root.err != "" && state != JobFailed {
+    root.attrs = append(root.attrs, stringAttr("gowatcher.job.reason", root.err))
+    root.err = ""
+  }
+
+  spans := make([]otlpSpan, 0, len(trace.spans)+1)
+  spans = append(spans, root.otlp(trace.traceID))
+
+  for _, s := range trace.spans {
+    spans = append(spans, s.otlp(trace.traceID))
+  }
+
+  t.mu.Lock()
+  t.pending = append(t.pending, spans...)
+
+  if over := len(t.pending) - maxPendingSpans; over > 0 {
+    t.pending = t.pending[over:]
+    t.dropped += over
+  }
+  t.mu.Unlock()
+}
+
+// traceParent is the W3C traceparent of the job's span, empty outside a
+// trace
+func (j *Job) traceParent() string {
+  j.mu.Lock()
+  defer j.mu.Unlock()
+
+  if j.trace == nil {
+    return ""
+  }
+
+  return "00-" + j.trace.traceID + "-" + j.trace.root.id + "-01"
+}
+
+// parseTraceParent reads a W3C traceparent, 00-<trace id>-<span id>-<flags>
+func parseTraceParent(value string) (string, string, bool) {
+  parts := strings.Split(strings.TrimSpace(value), "-")
+
+  if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+    return "", "", false
+  }
+
+  for _, id := range parts[1:3] {
+    if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+      return "", "", false
+    }
+  }
+
+  return strings.ToLower(parts[1]), strings.ToLower(parts[2]), true
+}
+
+func randomHex(n int) string {
+  b := make([]byte, n)
+  rand.Read(b)
+
+  return hex.EncodeToString(b)
+}
+
+// flush sends the finished traces, they are kept for the next flush when
+// the collector cannot be reached
+func (t *telemetry) flush() {
+  t.mu.Lock()
+  spans, dropped := t.pending, t.dropped
+  t.pending, t.dropped = nil, 0
+  t.mu.Unlock()
+
+  if dropped > 0 {
+    slog.Warn("Dropped trace spans, the collector is not keeping up", "spans", dropped)
+  }
+
+  if len(spans) == 0 {
+    return
+  }
+
+  body := map[string]interface{}{
+    "resourceSpans": []interface{}{map[string]interface{}{
+      "resource":   map[string]interface{}{"attributes": t.resource},
+      "scopeSpans": []interface{}{map[string]interface{}{"scope": otlpScope, "spans": spans}},
+    }},
+  }
+
+  if err := t.post("/v1/traces", body); err != nil {
+    slog.Warn("Could not send traces", "endpoint", t.cfg.Endpoint, "error", err)
+
+    t.mu.Lock()
+    t.pending = append(spans, t.pending...)
+    t.mu.Unlock()
+  }
+}
+
+// sendMetrics sends the metrics, counters as cumulative sums
+func (t *telemetry) sendMetrics() {
+  now := strconv.FormatInt(time.Now().UnixNano(), 10)
+  start := strconv.FormatInt(t.started.UnixNano(), 10)
+
+  var list []interface{}
+
+  for _, s := range t.stats.samples() {
+    point := []interface{}{map[string]interface{}{"asDouble": s.value, "timeUnixNano": now, "startTimeUnixNano": start}}
+    metric := map[string]interface{}{"name": s.name, "description": s.help}
+
+    if s.kind == "counter" {
+      metric["sum"] = map[string]interface{}{"dataPoints": point, "aggregationTemporality": 2, "isMonotonic": true}
+    } else {
+      metric["gauge"] = map[string]interface{}{"dataPoints": point}
+    }
+
+    list = append(list, metric)
+  }
+
+  body := map[string]interface{}{
+    "resourceMetrics": []interface{}{map[string]interface{}{
+      "resource":     map[string]interface{}{"attributes": t.resource},
+      "scopeMetrics": []interface{}{map[string]interface{}{"scope": otlpScope, "metrics": list}},
+    }},
+  }
+
+  if err := t.post("/v1/metrics", body); err != nil {
+    slog.Warn("Could not send metrics", "endpoint", t.cfg.Endpoint, "error", err)
+  }
+}
+
+func (t *telemetry) post(path string, body interface{}) error {
+  data, err := json.Marshal(body)
+
+  if err != nil {
+    return err
+  }
+
+  req, err := http.NewRequest(http.MethodPost, t.cfg.Endpoint+path, bytes.NewReader(data))
+
+  if err != nil {
+    return err
+  }
+
+  req.Header.Set("Content-Type", "application/json")
+
+  for k, v := range t.cfg.Headers {
+    req.Header.Set(k, v)
+  }
+
+  resp, err := t.client.Do(req)
+
+  if err != nil {
+    return err
+  }
+
+  resp.Body.Close()
+
+  if resp.StatusCode >= 300 {
+    return fmt.Errorf("%s", resp.Status)
+  }
+
+  return nil
+}
+
+// otlpScope names gowatcher as the instrumentation scope
+var otlpScope = map[string]string{"name": "gowatcher"}
+
+// otlpAttr is an attribute in OTLP's JSON encoding, 64 bit ints are
+// strings there
+type otlpAttr struct {
+  Key   string            `json:"key"`
+  Value map[string]string `json:"value"`
+}
+
+func stringAttr(key string, value string) otlpAttr {
+  return otlpAttr{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+func intAttr(key string, value int64) otlpAttr {
+  return otlpAttr{Key: key, Value: map[string]string{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+// otlpSpan is a span in OTLP's JSON encoding
+type otlpSpan struct {
+  TraceID      string     `json:"traceId"`
+  SpanID       string     `json:"spanId"`
+  ParentSpanID string     `json:"parentSpanId,omitempty"`
+  Name         string     `json:"name"`
+  Kind         int        `json:"kind"`
+  Start        string     `json:"startTimeUnixNano"`
+  End          string     `json:"endTimeUnixNano"`
+  Attributes   []otlpAttr `json:"attributes,omitempty"`
+  Status       otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+  Code    int    `json:"code"`
+  Message string `json:"message,omitempty"`
+}
+
+func (s span) otlp(traceID string) otlpSpan {
+  status := otlpStatus{Code: 1}
+
+  if s.err != "" {
+    status = otlpStatus{Code: 2, Message: s.err}
+  }
+
+  return otlpSpan{
+    TraceID:      traceID,
+    SpanID:       s.id,
+    ParentSpanID: s.parent,
+    Name:         s.name,
+    Kind:         1,
+    Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+    End:          strconv.FormatInt(s.end.UnixNano(), 10),
+    Attributes:   s.attrs,
+    Status:       status,
+  }
+}
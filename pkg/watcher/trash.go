@@ -0,0 +1,216 @@
+package watcher
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// defaultTrashRetention is how long the trash keeps an original when
+// TrashRetention is not set
+const defaultTrashRetention = 7 * 24 * time.Hour
+
+// trashRecordSuffix names the record of where a trashed original came from,
+// next to it
+const trashRecordSuffix = ".trashed.json"
+
+// Trash is the directory the trash originals policy moves inputs into
+// instead of deleting them. Each one keeps its sidecars next to it and a
+// record of where it came from, and can be restored until the retention
+// deletes it. It is a plain directory, the restore command works on it
+// when the daemon is not running
+type Trash struct {
+  dir string
+}
+
+// TrashedView is an original in the trash. Name is its name there, Input
+// where it was queued
+type TrashedView struct {
+  Name      string    `json:"name"`
+  Path      string    `json:"path"`
+  Files     []string  `json:"files"`
+  Bytes     int64     `json:"bytes"`
+  Input     string    `json:"input"`
+  JobID     int64     `json:"job_id,omitempty"`
+  JobUID    string    `json:"job_uid,omitempty"`
+  TrashedAt time.Time `json:"trashed_at"`
+}
+
+// trashRecord is what is written next to a trashed original
+type trashRecord struct {
+  Input     string    `json:"input"`
+  JobID     int64     `json:"job_id"`
+  JobUID    string    `json:"job_uid"`
+  TrashedAt time.Time `json:"trashed_at"`
+}
+
+// OpenTrash opens the trash at dir, it is created once something is put
+// in it
+func OpenTrash(dir string) (*Trash, error) {
+  abs, err := filepath.Abs(dir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  return &Trash{dir: abs}, nil
+}
+
+// put moves the job's input and its sidecars into the trash, it returns
+// where the input is now
+func (t *Trash) put(j *Job) (string, error) {
+  if err := createDir(t.dir); err != nil {
+    return "", err
+  }
+
+  name := filepath.Base(j.input)
+  dest := filepath.Join(t.dir, name)
+
+  if _, err := os.Lstat(dest); err == nil {
+    ext := filepath.Ext(name)
+    dest = filepath.Join(t.dir, fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), strings.ToLower(j.uid), ext))
+  }
+
+  // the record goes first, an original in the trash always says where it
+  // came from
+  record, err := json.MarshalIndent(trashRecord{Input: j.input, JobID: j.id, JobUID: j.uid, TrashedAt: time.Now()}, "", "  ")
+
+  if err != nil {
+    return "", err
+  }
+
+  if err = os.WriteFile(dest+trashRecordSuffix, record, 0644); err != nil {
+    return "", err
+  }
+
+  if err = moveFile(j.input, dest); err != nil {
+    os.Remove(dest + trashRecordSuffix)
+    return "", err
+  }
+
+  if err = moveSpec(j.specPath, dest); err != nil {
+    return dest, err
+  }
+
+  if err = moveChecksum(j.checksumPath, dest); err != nil {
+    return dest, err
+  }
+
+  return dest, moveCompanions(j, j.input, dest)
+}
+
+// List returns what is in the trash, the most recently trashed first
+func (t *Trash) List() ([]TrashedView, error) {
+  entries, err := retentionEntries(t.dir)
+
+  if errors.Is(err, fs.ErrNotExist) {
+    return []TrashedView{}, nil
+  }
+
+  if err != nil {
+    return nil, err
+  }
+
+  views := make([]TrashedView, 0, len(entries))
+
+  for _, e := range entries {
+    // a record whose original is gone is not an entry of its own
+    if strings.HasSuffix(e.path, trashRecordSuffix) {
+      continue
+    }
+
+    view := TrashedView{Name: filepath.Base(e.path), Path: e.path, Files: e.files, Bytes: e.bytes, TrashedAt: e.modTime}
+
+    if data, err := os.ReadFile(e.path + trashRecordSuffix); err == nil {
+      var record trashRecord
+
+      if json.Unmarshal(data, &record) == nil {
+        view.Input, view.JobID, view.JobUID, view.TrashedAt = record.Input, record.JobID, record.JobUID, record.TrashedAt
+      }
+    }
+
+    views = append(views, view)
+  }
+
+  sort.Slice(views, func(a, b int) bool { return views[a].TrashedAt.After(views[b].TrashedAt) })
+
+  return views, nil
+}
+
+// Restore moves the trashed original ref, its name in the trash, the name
+// it was queued under or its job's ULID, back to where it was queued, or
+// into the directory to. Its sidecars go with it. It returns where the
+// original is now, back in a queue directory it is encoded again
+func (t *Trash) Restore(ref string, to string) (string, error) {
+  views, err := t.List()
+
+  if err != nil {
+    return "", err
+  }
+
+  var found []TrashedView
+
+  for _, v := range views {
+    if v.Name == ref || (v.Input != "" && filepath.Base(v.Input) == ref) || strings.EqualFold(v.JobUID, ref) {
+      found = append(found, v)
+    }
+  }
+
+  switch {
+  case len(found) == 0:
+    return "", fmt.Errorf("%s is not in the trash", ref)
+  case len(found) > 1:
+    return "", fmt.Errorf("%d originals in the trash match %s, name one by its name there or its job's ULID", len(found), ref)
+  }
+
+  return t.restore(found[0], to)
+}
+
+func (t *Trash) restore(v TrashedView, to string) (string, error) {
+  dest := v.Input
+
+  if to != "" {
+    name := v.Name
+
+    if v.Input != "" {
+      name = filepath.Base(v.Input)
+    }
+
+    dest = filepath.Join(to, name)
+  }
+
+  if dest == "" {
+    return "", fmt.Errorf("%s has no record of where it came from, restore it to a directory", v.Name)
+  }
+
+  if _, err := os.Lstat(dest); err == nil {
+    return "", fmt.Errorf("%s already exists", dest)
+  }
+
+  if err := createDir(filepath.Dir(dest)); err != nil {
+    return "", err
+  }
+
+  // the sidecars are named after the original, the record goes last
+  for _, file := range v.Files {
+    suffix := strings.TrimPrefix(file, v.Path)
+
+    if suffix == trashRecordSuffix {
+      continue
+    }
+
+    if err := moveFile(file, dest+suffix); err != nil {
+      return "", err
+    }
+  }
+
+  os.Remove(v.Path + trashRecordSuffix)
+
+  return dest, nil
+}
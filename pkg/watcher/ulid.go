@@ -0,0 +1,85 @@
+package watcher
+
+import (
+  "crypto/rand"
+  "sync"
+  "time"
+)
+
+// crockford is the base32 alphabet ULIDs are written in, without I, L, O
+// and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidSource makes ULIDs: 48 bits of Unix milliseconds then 80 random
+// bits, 26 characters that sort in the order they were made. Within a
+// millisecond the random part counts up from the first one's
+type ulidSource struct {
+  mu     sync.Mutex
+  ms     uint64
+  random [10]byte
+}
+
+var ulids ulidSource
+
+// newULID returns a ULID unique to the job, across restarts and hosts
+func newULID() string {
+  return ulids.next(time.Now())
+}
+
+func (s *ulidSource) next(now time.Time) string {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+
+  ms := uint64(now.UnixMilli())
+
+  if ms > s.ms {
+    s.ms = ms
+
+    if _, err := rand.Read(s.random[:]); err != nil {
+      // never on the platforms Go supports, the counter still keeps them
+      // apart within this process
+      s.random = [10]byte{}
+    }
+  } else {
+    // the same millisecond, or the clock went back
+    for i := len(s.random) - 1; i >= 0; i-- {
+      if s.random[i]++; s.random[i] != 0 {
+        break
+      }
+    }
+  }
+
+  var id [16]byte
+
+  for i := 0; i < 6; i++ {
+    id[i] = byte(s.ms >> (40 - 8*i))
+  }
+
+  copy(id[6:], s.random[:])
+
+  return encodeULID(id)
+}
+
+// encodeULID writes the 128 bits as 26 characters of 5 bits, the first
+// holding the top 3
+func encodeULID(id [16]byte) string {
+  out := make([]byte, 26)
+
+  for i := range out {
+    // bit offsets into the 128, the first character starting 2 bits early
+    start := 5*i - 2
+    var v int
+
+    for b := start; b < start+5; b++ {
+      v <<= 1
+
+      if b >= 0 && id[b/8]&(0x80>>(b%8)) != 0 {
+        v |= 1
+      }
+    }
+
+    out[i] = crockford[v]
+  }
+
+  return string(out)
+}
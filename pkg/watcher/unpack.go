@@ -0,0 +1,399 @@
+package watcher
+
+import (
+  "archive/tar"
+  "archive/zip"
+  "compress/gzip"
+  "errors"
+  "fmt"
+  "io"
+  "log/slog"
+  "os"
+  "path"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+const (
+  defaultArchiveMaxBytes = 100 << 30
+  defaultArchiveMaxFiles = 1000
+)
+
+// archiveSuffixes are the archives Archives unpacks, by how they are read
+var archiveSuffixes = []struct {
+  suffix string
+  gzip   bool
+  zip    bool
+}{
+  {suffix: ".zip", zip: true},
+  {suffix: ".tar.gz", gzip: true},
+  {suffix: ".tgz", gzip: true},
+  {suffix: ".tar"},
+}
+
+// Archives unpacks zip, tar, tar.gz and tgz files dropped into a queue
+// directory: the files in them the filter allows, their sidecars and
+// companions are moved into the directory and queued, and the archive is
+// deleted. Folders in the archive are flattened, hidden files and __MACOSX
+// are left out, as are links and anything else that is not a regular
+// file. An entry whose path is absolute or leaves the archive with .. fails
+// it, as does one named like a file already in the queue. A failed archive
+// is moved to RejectedDir with a .reason.txt when there is one, else it is
+// left until it changes
+type Archives struct {
+  // MaxBytes caps what an archive unpacks to, default 100G, and MaxFiles
+  // the files it has, default 1000, so an archive bomb fails rather than
+  // filling the disk
+  MaxBytes int64
+  MaxFiles int
+}
+
+// isArchive reports whether path is named like an archive Archives unpacks
+func isArchive(path string) bool {
+  name := strings.ToLower(path)
+
+  for _, a := range archiveSuffixes {
+    if strings.HasSuffix(name, a.suffix) {
+      return true
+    }
+  }
+
+  return false
+}
+
+// archiveEntry is a file in an archive, open returns its content
+type archiveEntry struct {
+  name    string
+  regular bool
+  modTime time.Time
+  open    func() (io.ReadCloser, error)
+}
+
+// readArchive calls fn with each entry of the archive at file, in order
+func readArchive(file string, fn func(e archiveEntry) error) error {
+  name := strings.ToLower(file)
+
+  for _, a := range archiveSuffixes {
+    if !strings.HasSuffix(name, a.suffix) {
+      continue
+    }
+
+    if a.zip {
+      return readZip(file, fn)
+    }
+
+    return readTar(file, a.gzip, fn)
+  }
+
+  return fmt.Errorf("%s is not an archive", file)
+}
+
+func readZip(file string, fn func(e archiveEntry) error) error {
+  r, err := zip.OpenReader(file)
+
+  if err != nil {
+    return err
+  }
+
+  defer r.Close()
+
+  for _, f := range r.File {
+    e := archiveEntry{name: f.Name, regular: f.Mode().IsRegular(), modTime: f.Modified, open: f.Open}
+
+    if err = fn(e); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func readTar(file string, gzipped bool, fn func(e archiveEntry) error) error {
+  f, err := os.Open(file)
+
+  if err != nil {
+    return err
+  }
+
+  defer f.Close()
+
+  var r io.Reader = f
+
+  if gzipped {
+    gz, err := gzip.NewReader(f)
+
+    if err != nil {
+      return err
+    }
+
+    defer gz.Close()
+    r = gz
+  }
+
+  tr := tar.NewReader(r)
+
+  for {
+    h, err := tr.Next()
+
+    if err == io.EOF {
+      return nil
+    }
+
+    if err != nil {
+      return err
+    }
+
+    e := archiveEntry{
+      name:    h.Name,
+      regular: h.FileInfo().Mode().IsRegular(),
+      modTime: h.ModTime,
+      open:    func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+    }
+
+    if err = fn(e); err != nil {
+      return err
+    }
+  }
+}
+
+// unpackName is the name an entry is unpacked under, "" for one that is
+// left out. A path that leaves the archive is an error
+func unpackName(entry string) (string, error) {
+  name := strings.ReplaceAll(entry, `\`, "/")
+
+  if path.IsAbs(name) || filepath.IsAbs(entry) || filepath.VolumeName(entry) != "" {
+    return "", fmt.Errorf("%s has an absolute path", entry)
+  }
+
+  for _, part := range strings.Split(name, "/") {
+    if part == ".." {
+      return "", fmt.Errorf("%s leaves the archive", entry)
+    }
+
+    if part == "__MACOSX" || (part != "" && part != "." && hidden(part)) {
+      return "", nil
+    }
+  }
+
+  if base := path.Base(name); base != "." && base != "/" {
+    return base, nil
+  }
+
+  return "", nil
+}
+
+// unpack unpacks the archive at file into a hidden directory next to it,
+// then moves what it unpacked into the queue directory, the sidecars first
+// so each input's is there once it is seen. It returns the paths moved
+func (w *Watcher) unpack(file string) ([]string, error) {
+  a := w.cfg.Archives
+  maxBytes, maxFiles := a.MaxBytes, a.MaxFiles
+
+  if maxBytes <= 0 {
+    maxBytes = defaultArchiveMaxBytes
+  }
+
+  if maxFiles <= 0 {
+    maxFiles = defaultArchiveMaxFiles
+  }
+
+  dir := filepath.Dir(file)
+  tmp := filepath.Join(dir, "."+filepath.Base(file)+".unpacking")
+
+  if err := os.RemoveAll(tmp); err != nil {
+    return nil, err
+  }
+
+  if err := os.Mkdir(tmp, 0755); err != nil {
+    return nil, err
+  }
+
+  defer os.RemoveAll(tmp)
+
+  filter := w.filter.Load()
+  var names []string
+
+  // companions come along like sidecars
+  sidecar := func(name string) bool { return isSidecar(name) || w.isCompanion(name) }
+
+  var total int64
+
+  err := readArchive(file, func(e archiveEntry) error {
+    name, err := unpackName(e.name)
+
+    if err != nil || name == "" || !e.regular {
+      return err
+    }
+
+    if !sidecar(name) && !filter.allowed(name) {
+      slog.Debug("Leaving file in archive", "archive", file, "file", e.name)
+      return nil
+    }
+
+    if len(names) == maxFiles {
+      return fmt.Errorf("more than %d files", maxFiles)
+    }
+
+    dest := filepath.Join(tmp, name)
+
+    if _, err := os.Lstat(dest); err == nil {
+      return fmt.Errorf("more than one file is named %s", name)
+    }
+
+    r, err := e.open()
+
+    if err != nil {
+      return fmt.Errorf("%s: %s", e.name, err)
+    }
+
+    defer r.Close()
+
+    out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+    if err != nil {
+      return err
+    }
+
+    // the sizes an archive claims are not trusted, what it unpacks to is
+    // counted as it is written
+    n, err := io.Copy(out, io.LimitReader(r, maxBytes-total+1))
+
+    if closeErr := out.Close(); err == nil {
+      err = closeErr
+    }
+
+    if err != nil {
+      return fmt.Errorf("%s: %s", e.name, err)
+    }
+
+    if total += n; total > maxBytes {
+      return fmt.Errorf("unpacks to more than %s", FormatSize(maxBytes))
+    }
+
+    if !e.modTime.IsZero() {
+      os.Chtimes(dest, e.modTime, e.modTime)
+    }
+
+    names = append(names, name)
+
+    return nil
+  })
+
+  if err != nil {
+    return nil, err
+  }
+
+  media := 0
+
+  for _, name := range names {
+    if !sidecar(name) {
+      media++
+    }
+
+    if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+      return nil, fmt.Errorf("%s is already in the queue", name)
+    }
+  }
+
+  if media == 0 {
+    return nil, errors.New("no files to encode in the archive")
+  }
+
+  var moved []string
+
+  for _, sidecars := range []bool{true, false} {
+    for _, name := range names {
+      if sidecar(name) != sidecars {
+        continue
+      }
+
+      dest := filepath.Join(dir, name)
+
+      if err := os.Rename(filepath.Join(tmp, name), dest); err != nil {
+        return moved, err
+      }
+
+      moved = append(moved, dest)
+    }
+  }
+
+  return moved, nil
+}
+
+// unpackFound unpacks an archive found in a queue directory in the
+// background, once however often it is seen meanwhile, and queues its
+// files. An archive that failed is not tried again until it changes
+func (w *Watcher) unpackFound(file string) {
+  info, err := os.Stat(file)
+
+  if err != nil {
+    return
+  }
+
+  version := fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+
+  if last, failed := w.badArchives.Load(file); failed && last == version {
+    return
+  }
+
+  if _, running := w.unpacking.LoadOrStore(file, true); running {
+    return
+  }
+
+  w.unpackWait.Add(1)
+
+  go func() {
+    defer w.unpackWait.Done()
+    defer w.unpacking.Delete(file)
+
+    started := time.Now()
+    moved, err := w.unpack(file)
+
+    if err != nil {
+      w.rejectArchive(file, version, err)
+      return
+    }
+
+    w.badArchives.Delete(file)
+    w.enc.audit.deleting(nil, file, "unpacked")
+
+    if err = os.Remove(file); err != nil {
+      slog.Warn("Could not remove unpacked archive", "archive", file, "error", err)
+    }
+
+    slog.Info("Unpacked archive", "archive", file, "files", len(moved), "took", time.Since(started).Round(time.Millisecond).String())
+
+    for _, path := range moved {
+      w.found(path)
+    }
+  }()
+}
+
+// rejectArchive moves an archive that could not be unpacked to the
+// rejected directory, or remembers it is bad until it changes
+func (w *Watcher) rejectArchive(file string, version string, err error) {
+  dir := w.enc.rejectedDir
+
+  if dir == "" {
+    w.badArchives.Store(file, version)
+    slog.Error("Could not unpack archive, leaving it until it changes", "archive", file, "error", err)
+    return
+  }
+
+  dest := filepath.Join(dir, filepath.Base(file))
+
+  if moveErr := moveFile(file, dest); moveErr != nil {
+    w.badArchives.Store(file, version)
+    slog.Error("Could not unpack archive", "archive", file, "error", err)
+    slog.Error("Could not move rejected archive", "dir", dir, "error", moveErr)
+    return
+  }
+
+  if writeErr := os.WriteFile(dest+reasonSuffix, []byte(err.Error()+"\n"), 0644); writeErr != nil {
+    slog.Warn("Could not write rejection reason", "error", writeErr)
+  }
+
+  slog.Error("Could not unpack archive, rejected it", "archive", file, "error", err, "to", dest)
+  w.enc.audit.moved(nil, file, dest, "rejected")
+}
@@ -0,0 +1,246 @@
+package watcher
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "io/fs"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+// destination is where outputs are uploaded, an S3 bucket or an rclone
+// remote
+type destination interface {
+  // key is where a path relative to the finished directory goes
+  key(rel string) string
+
+  // upload copies file to key as t, retrying what failed with t.retry
+  upload(ctx context.Context, file string, key string, t *transfer) error
+
+  // location is how a key is shown in logs and job views
+  location(key string) string
+}
+
+// treeUploader is a destination that copies a package directory in one go
+type treeUploader interface {
+  uploadTree(ctx context.Context, dir string, key string, t *transfer) error
+}
+
+// uploadOutputs copies the job's outputs from the finished directory to the
+// destination and returns where they went, packages are uploaded file by file.
+// Ingested jobs' outputs go under their object's folder
+func (e *encoder) uploadOutputs(ctx context.Context, j *Job, upload destination, finished []string) ([]string, error) {
+  uploads := make([]string, 0, len(finished))
+  dir := filepath.FromSlash(j.uploadDir)
+
+  for _, output := range finished {
+    rel, err := filepath.Rel(e.finishedDir, output)
+
+    if err != nil {
+      return nil, err
+    }
+
+    info, err := os.Stat(output)
+
+    if err != nil {
+      return nil, err
+    }
+
+    startedAt := time.Now()
+
+    key := upload.key(filepath.Join(dir, rel))
+
+    if !info.IsDir() {
+      t := e.delivery.start(ctx, j.logger(), output, upload.location(key), info.Size())
+
+      if err = upload.upload(ctx, output, key, t); err != nil {
+        return nil, err
+      }
+
+      uploads = append(uploads, upload.location(key))
+      j.logger().Info("Uploaded", "output", output, "to", upload.location(key), "took", time.Since(startedAt).Round(time.Second).String())
+
+      continue
+    }
+
+    t := e.delivery.start(ctx, j.logger(), output, upload.location(key+"/"), totalSize([]string{output}))
+
+    if tree, ok := upload.(treeUploader); ok {
+      err = tree.uploadTree(ctx, output, key, t)
+    } else {
+      err = filepath.WalkDir(output, func(path string, d fs.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+          return err
+        }
+
+        fileRel, err := filepath.Rel(e.finishedDir, path)
+
+        if err != nil {
+          return err
+        }
+
+        if err = upload.upload(ctx, path, upload.key(filepath.Join(dir, fileRel)), t); err != nil {
+          return err
+        }
+
+        t.fileDone(totalSize([]string{path}))
+
+        return nil
+      })
+    }
+
+    if err != nil {
+      return nil, err
+    }
+
+    location := upload.location(key + "/")
+    uploads = append(uploads, location)
+    j.logger().Info("Uploaded", "output", output, "to", location, "took", time.Since(startedAt).Round(time.Second).String())
+  }
+
+  return uploads, nil
+}
+
+// uploadedFile is the file in BaseDir listing the outputs uploaded while
+// they are kept in the finished directory, one JSON line each, so pruning
+// only ever removes what gowatcher uploaded
+const uploadedFile = "uploaded.jsonl"
+
+type uploadedEntry struct {
+  Path       string    `json:"path"`
+  UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// uploadedLog records the uploaded outputs the finished directory keeps
+type uploadedLog struct {
+  mu   sync.Mutex
+  path string
+}
+
+// record appends the uploaded outputs
+func (l *uploadedLog) record(paths []string) error {
+  var b []byte
+
+  for _, path := range paths {
+    line, err := json.Marshal(uploadedEntry{Path: path, UploadedAt: time.Now()})
+
+    if err != nil {
+      return err
+    }
+
+    b = append(append(b, line...), '\n')
+  }
+
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+  if err != nil {
+    return err
+  }
+
+  if _, err = f.Write(b); err != nil {
+    f.Close()
+    return err
+  }
+
+  return f.Close()
+}
+
+// prune removes the recorded outputs uploaded longer than keep ago and the
+// entries of those gone, what is in dir without an entry is left alone
+func (l *uploadedLog) prune(dir string, keep time.Duration) {
+  l.mu.Lock()
+  defer l.mu.Unlock()
+
+  data, err := os.ReadFile(l.path)
+
+  if err != nil {
+    if !errors.Is(err, fs.ErrNotExist) {
+      slog.Error("Could not read the uploaded outputs", "file", l.path, "error", err)
+    }
+
+    return
+  }
+
+  // an output uploaded again counts from its last upload
+  latest := make(map[string]time.Time)
+  var order []string
+
+  for _, line := range bytes.Split(data, []byte("\n")) {
+    var entry uploadedEntry
+
+    if json.Unmarshal(line, &entry) != nil || entry.Path == "" {
+      continue
+    }
+
+    if _, ok := latest[entry.Path]; !ok {
+      order = append(order, entry.Path)
+    }
+
+    if entry.UploadedAt.After(latest[entry.Path]) {
+      latest[entry.Path] = entry.UploadedAt
+    }
+  }
+
+  var kept []byte
+
+  for _, path := range order {
+    uploadedAt := latest[path]
+
+    if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+      continue
+    }
+
+    rel, err := filepath.Rel(dir, path)
+    inside := err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+
+    if inside && time.Since(uploadedAt) >= keep {
+      if err = os.RemoveAll(path); err == nil {
+        slog.Info("Pruned uploaded output", "output", path, "age", time.Since(uploadedAt).Round(time.Minute).String())
+        continue
+      }
+
+      slog.Error("Could not prune uploaded output", "output", path, "error", err)
+    }
+
+    line, _ := json.Marshal(uploadedEntry{Path: path, UploadedAt: uploadedAt})
+    kept = append(append(kept, line...), '\n')
+  }
+
+  tmp := l.path + ".tmp"
+
+  if err = os.WriteFile(tmp, kept, 0644); err == nil {
+    err = os.Rename(tmp, l.path)
+  }
+
+  if err != nil {
+    os.Remove(tmp)
+    slog.Error("Could not rewrite the uploaded outputs", "file", l.path, "error", err)
+  }
+}
+
+// pruneFinished removes the outputs uploaded longer than keep ago from the
+// finished directory, thumbnails and reports with them. It checks every hour,
+// or more often for shorter retentions, until stop is closed
+func (w *Watcher) pruneFinished(keep time.Duration, stop <-chan struct{}) {
+  ticker := time.NewTicker(min(keep/4, time.Hour))
+  defer ticker.Stop()
+
+  for {
+    w.enc.uploaded.prune(w.enc.finishedDir, keep)
+
+    select {
+    case <-ticker.C:
+    case <-stop:
+      return
+    }
+  }
+}
@@ -0,0 +1,46 @@
+package watcher
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestPruneOnlyUploaded(t *testing.T) {
+  base, finished := t.TempDir(), t.TempDir()
+  uploaded := filepath.Join(finished, "clip.mp4")
+  foreign := filepath.Join(finished, "someone-elses.mp4")
+  outside := filepath.Join(base, "outside.mp4")
+
+  for _, path := range []string{uploaded, foreign, outside} {
+    if err := os.WriteFile(path, nil, 0644); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  l := &uploadedLog{path: filepath.Join(base, uploadedFile)}
+
+  if err := l.record([]string{uploaded, outside}); err != nil {
+    t.Fatal(err)
+  }
+
+  l.prune(finished, 0)
+
+  if _, err := os.Stat(uploaded); !os.IsNotExist(err) {
+    t.Errorf("%s was not pruned", uploaded)
+  }
+
+  for _, path := range []string{foreign, outside} {
+    if _, err := os.Stat(path); err != nil {
+      t.Errorf("%s was pruned", path)
+    }
+  }
+
+  // the entry of what stays is kept for the next prune
+  l.prune(finished, time.Hour)
+
+  if data, _ := os.ReadFile(l.path); len(data) == 0 {
+    t.Error("the entry of the output left outside was dropped")
+  }
+}
@@ -0,0 +1,60 @@
+package watcher
+
+import (
+  "fmt"
+  "io/fs"
+  "os"
+  "path/filepath"
+)
+
+func dirExists(dirName string) (bool, error) {
+  info, err := os.Stat(dirName)
+
+  if err != nil && !os.IsNotExist(err) {
+    return false, err
+  }
+
+  if os.IsNotExist(err) || !info.IsDir() {
+    return false, nil
+  }
+
+  return true, nil
+}
+
+func createDir(dirName string) error {
+  exists, err := dirExists(dirName)
+
+  if err != nil {
+    return err
+  }
+
+  if exists {
+    return nil
+  }
+
+  if err := os.Mkdir(dirName, os.ModePerm); err != nil {
+    return fmt.Errorf("Could not create dir: %s\n", err)
+  }
+
+  return nil
+}
+
+// totalSize is the size of the files at paths, counting everything under
+// those that are directories
+func totalSize(paths []string) int64 {
+  var size int64
+
+  for _, path := range paths {
+    filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+      if err == nil && !d.IsDir() {
+        if info, err := d.Info(); err == nil {
+          size += info.Size()
+        }
+      }
+
+      return nil
+    })
+  }
+
+  return size
+}
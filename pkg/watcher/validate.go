@@ -0,0 +1,107 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// defaultDurationTolerance is how far an output's duration may be from the
+// input's when no tolerance is configured
+var defaultDurationTolerance = DurationTolerance{Fraction: 0.05}
+
+// DurationTolerance is how far an output's duration may be from its input's,
+// either a fraction of the input's duration or a fixed amount
+type DurationTolerance struct {
+  Fraction float64
+  Absolute time.Duration
+}
+
+// ParseDurationTolerance parses a percentage like 5% or a duration like 2s
+func ParseDurationTolerance(value string) (DurationTolerance, error) {
+  value = strings.TrimSpace(value)
+
+  if percent, found := strings.CutSuffix(value, "%"); found {
+    pct, err := strconv.ParseFloat(percent, 64)
+
+    if err != nil || pct < 0 {
+      return DurationTolerance{}, fmt.Errorf("bad percentage %q", value)
+    }
+
+    return DurationTolerance{Fraction: pct / 100}, nil
+  }
+
+  d, err := time.ParseDuration(value)
+
+  if err != nil || d < 0 {
+    return DurationTolerance{}, fmt.Errorf("bad duration %q", value)
+  }
+
+  return DurationTolerance{Absolute: d}, nil
+}
+
+// accepts reports whether got is close enough to want
+func (t DurationTolerance) accepts(want time.Duration, got time.Duration) bool {
+  allowed := t.Absolute
+
+  if t.Fraction > 0 {
+    allowed = time.Duration(float64(want) * t.Fraction)
+  }
+
+  diff := got - want
+
+  if diff < 0 {
+    diff = -diff
+  }
+
+  return diff <= allowed
+}
+
+// validateOutputs checks that every output of a successful ffmpeg is a
+// usable file: not empty and, with ffprobe, with streams and about as long
+// as the input. Package directories are not checked
+func (e *encoder) validateOutputs(working []string, inputDuration time.Duration) error {
+  for _, out := range working {
+    name := filepath.Base(out)
+    info, err := os.Stat(out)
+
+    if err != nil {
+      return fmt.Errorf("output %s: %s", name, err)
+    }
+
+    if info.IsDir() {
+      continue
+    }
+
+    if info.Size() == 0 {
+      return fmt.Errorf("output %s is empty", name)
+    }
+
+    if e.ffprobePath == "" {
+      continue
+    }
+
+    probed, err := probe(e.ffprobePath, out)
+
+    if err != nil {
+      return fmt.Errorf("output %s does not probe: %s", name, err)
+    }
+
+    if len(probed.Streams) == 0 {
+      return fmt.Errorf("output %s has no streams", name)
+    }
+
+    if inputDuration <= 0 {
+      continue
+    }
+
+    if got := probed.duration(); !e.tolerance.accepts(inputDuration, got) {
+      return fmt.Errorf("output %s is %s long, the input is %s", name, got.Round(time.Millisecond), inputDuration.Round(time.Millisecond))
+    }
+  }
+
+  return nil
+}
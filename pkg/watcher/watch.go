@@ -0,0 +1,431 @@
+package watcher
+
+import (
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/fsnotify/fsnotify"
+)
+
+// dirWatcher reports new files in the queue directory until it is closed
+type dirWatcher interface {
+  close() error
+}
+
+// notifyWatcher uses fsnotify events. Files arrive as a create, a rename on
+// some platforms when moved in, or a create and writes when copied. A file
+// is reported once its events stop for quiet, so a copy is reported when it
+// is done, and found drops the files that already have a job. Events for a
+// file within coalesce of it being reported are part of the same arrival,
+// like the chmod or touch some copy tools finish with, and are dropped
+// rather than reporting it again. Files that are gone by then, removed or
+// moved out, are reported to gone.
+//
+// The watch heals itself: after an error, like the kernel's queue
+// overflowing, it is set up again, and when the directory is deleted or
+// unmounted it is watched again once it is back. Either way rescan is
+// called for the files whose events were lost
+type notifyWatcher struct {
+  dir      string
+  quiet    time.Duration
+  coalesce time.Duration
+  found    func(path string)
+  gone     func(path string)
+  rescan   func()
+
+  // watcher is nil while the directory is missing, info is the directory
+  // it watches. broken wakes the supervisor to set the watch up again
+  mu      sync.Mutex
+  watcher *fsnotify.Watcher
+  info    os.FileInfo
+  pending map[string]*time.Timer
+  broken  chan struct{}
+
+  // reported is when each file was last reported, until coalesce is over
+  // or it is gone
+  reported map[string]time.Time
+  stop     chan struct{}
+  closed   bool
+}
+
+// notifyQuiet is how long a file has no events before it is reported by
+// default, which also keeps gowatcher's own moves of inputs from being
+// reported as gone before their job knows where they went. notifyCoalesce
+// is how long events after a file is reported are dropped by default.
+// notifyCheck is how often the directory is checked for still being the one
+// watched, an unmount sends no event
+const (
+  notifyQuiet    = time.Second
+  notifyCoalesce = 5 * time.Second
+  notifyCheck    = 10 * time.Second
+)
+
+func startNotifyWatcher(dir string, quiet time.Duration, coalesce time.Duration, found func(path string), gone func(path string), rescan func()) (*notifyWatcher, error) {
+  w := &notifyWatcher{
+    dir:      dir,
+    quiet:    quiet,
+    coalesce: coalesce,
+    found:    found,
+    gone:     gone,
+    rescan:   rescan,
+    pending:  make(map[string]*time.Timer),
+    reported: make(map[string]time.Time),
+    broken:   make(chan struct{}, 1),
+    stop:     make(chan struct{}),
+  }
+
+  if err := w.arm(); err != nil {
+    return nil, err
+  }
+
+  go w.supervise()
+
+  return w, nil
+}
+
+// arm watches the directory with a new fsnotify watcher
+func (w *notifyWatcher) arm() error {
+  info, err := os.Stat(w.dir)
+
+  if err != nil {
+    return err
+  }
+
+  watcher, err := fsnotify.NewWatcher()
+
+  if err != nil {
+    return fmt.Errorf("watcher: %s", err)
+  }
+
+  if err = watcher.Add(w.dir); err != nil {
+    watcher.Close()
+    return fmt.Errorf("watcher.Add(): %s", err)
+  }
+
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  // closed while setting up
+  if w.closed {
+    return watcher.Close()
+  }
+
+  w.watcher, w.info = watcher, info
+
+  go w.listen(watcher)
+
+  return nil
+}
+
+// listen handles one fsnotify watcher's events until it is closed
+func (w *notifyWatcher) listen(watcher *fsnotify.Watcher) {
+  for {
+    select {
+    case event, ok := <-watcher.Events:
+      if !ok {
+        return
+      }
+
+      // the directory itself went, the watch goes with it
+      if filepath.Clean(event.Name) == w.dir && (event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename)) {
+        slog.Warn("Watched directory was removed", "dir", w.dir)
+        w.breaks()
+        continue
+      }
+
+      // a rename is sent for the old name, which will be gone when the
+      // file is reported
+      if event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Write) || event.Has(fsnotify.Remove) {
+        w.settle(event.Name, w.found, w.gone)
+      }
+    case err, ok := <-watcher.Errors:
+      if !ok {
+        return
+      }
+
+      slog.Error("Watcher error, watching the directory again and rescanning it", "dir", w.dir, "error", err)
+      w.breaks()
+    }
+  }
+}
+
+// breaks has the supervisor set the watch up again
+func (w *notifyWatcher) breaks() {
+  select {
+  case w.broken <- struct{}{}:
+  default:
+  }
+}
+
+// supervise sets the watch up again when it broke or the directory is no
+// longer the one watched, and rescans once it is back
+func (w *notifyWatcher) supervise() {
+  ticker := time.NewTicker(notifyCheck)
+  defer ticker.Stop()
+
+  waiting := false
+
+  for {
+    select {
+    case <-w.stop:
+      return
+    case <-w.broken:
+      w.disarm()
+    case <-ticker.C:
+      w.mu.Lock()
+      armed, info := w.watcher != nil, w.info
+
+      for path, at := range w.reported {
+        if time.Since(at) >= w.coalesce {
+          delete(w.reported, path)
+        }
+      }
+      w.mu.Unlock()
+
+      if armed {
+        if now, err := os.Stat(w.dir); err == nil && os.SameFile(info, now) {
+          continue
+        }
+
+        slog.Warn("Watched directory is gone or was replaced", "dir", w.dir)
+        w.disarm()
+      }
+    }
+
+    if err := w.arm(); err != nil {
+      if !waiting {
+        slog.Warn("Watched directory is missing, waiting for it", "dir", w.dir, "error", err, "retry", notifyCheck.String())
+        waiting = true
+      }
+
+      continue
+    }
+
+    waiting = false
+    slog.Info("Watching again", "dir", w.dir)
+    w.rescan()
+  }
+}
+
+// disarm closes the current fsnotify watcher
+func (w *notifyWatcher) disarm() {
+  w.mu.Lock()
+  watcher := w.watcher
+  w.watcher = nil
+  w.mu.Unlock()
+
+  if watcher != nil {
+    watcher.Close()
+  }
+}
+
+// settle reports path once it had no events for quiet, but only if it is
+// not a directory and not a .DotFile, and was not reported within coalesce
+func (w *notifyWatcher) settle(path string, found func(path string), gone func(path string)) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+
+  if t, ok := w.pending[path]; ok {
+    t.Reset(w.quiet)
+    return
+  }
+
+  w.pending[path] = time.AfterFunc(w.quiet, func() {
+    w.mu.Lock()
+    _, ok := w.pending[path]
+    delete(w.pending, path)
+    w.mu.Unlock()
+
+    if !ok {
+      return
+    }
+
+    _, err := os.Stat(path)
+
+    switch {
+    // exists and is not .DotFile, a directory may be an image sequence
+    case err == nil && !hidden(path):
+      w.mu.Lock()
+      at, recent := w.reported[path]
+      recent = recent && time.Since(at) < w.coalesce
+
+      if !recent {
+        w.reported[path] = time.Now()
+      }
+      w.mu.Unlock()
+
+      if recent {
+        slog.Debug("Coalescing events for a file just reported", "input", path, "window", w.coalesce.String())
+        return
+      }
+
+      found(path)
+    case os.IsNotExist(err):
+      // dropped in again later it is a new file
+      w.mu.Lock()
+      delete(w.reported, path)
+      w.mu.Unlock()
+
+      gone(path)
+    }
+  })
+}
+
+// hidden reports whether path is a dotfile, which is never queued. It looks
+// at the name alone, the first character of an absolute path is the root
+func hidden(path string) bool {
+  return strings.HasPrefix(filepath.Base(path), ".")
+}
+
+func (w *notifyWatcher) close() error {
+  w.mu.Lock()
+  if w.closed {
+    w.mu.Unlock()
+    return nil
+  }
+
+  w.closed = true
+  close(w.stop)
+
+  for path, t := range w.pending {
+    t.Stop()
+    delete(w.pending, path)
+  }
+
+  watcher := w.watcher
+  w.watcher = nil
+  w.mu.Unlock()
+
+  if watcher == nil {
+    return nil
+  }
+
+  return watcher.Close()
+}
+
+// pollWatcher lists the directory every interval instead of relying on
+// inotify, which network filesystems often do not deliver. A file is only
+// reported once its size and mtime are unchanged between two polls, and to
+// gone once it is no longer listed
+type pollWatcher struct {
+  dir      string
+  interval time.Duration
+  found    func(path string)
+  gone     func(path string)
+  stop     chan struct{}
+  stopOnce sync.Once
+
+  // last is what each file looked like on the previous poll, reported are
+  // the files already handed to found. failing is set while the directory
+  // cannot be listed, so that is logged once
+  last     map[string]fileStat
+  reported map[string]fileStat
+  failing  bool
+}
+
+type fileStat struct {
+  size    int64
+  modTime time.Time
+}
+
+func startPollWatcher(dir string, interval time.Duration, found func(path string), gone func(path string)) *pollWatcher {
+  w := &pollWatcher{
+    dir:      dir,
+    interval: interval,
+    found:    found,
+    gone:     gone,
+    stop:     make(chan struct{}),
+    last:     make(map[string]fileStat),
+    reported: make(map[string]fileStat),
+  }
+
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+      select {
+      case <-ticker.C:
+        w.poll()
+      case <-w.stop:
+        return
+      }
+    }
+  }()
+
+  return w
+}
+
+func (w *pollWatcher) poll() {
+  entries, err := os.ReadDir(w.dir)
+
+  if err != nil {
+    if !w.failing {
+      slog.Error("Poll error, retrying every poll", "dir", w.dir, "error", err)
+      w.failing = true
+    }
+
+    return
+  }
+
+  if w.failing {
+    slog.Info("Polling again", "dir", w.dir)
+    w.failing = false
+  }
+
+  current := make(map[string]fileStat, len(entries))
+
+  for _, entry := range entries {
+    // a directory is reported like a file, found waits for its frames
+    if hidden(entry.Name()) {
+      continue
+    }
+
+    info, err := entry.Info()
+
+    if err != nil {
+      continue
+    }
+
+    path := filepath.Join(w.dir, entry.Name())
+    stat := fileStat{size: info.Size(), modTime: info.ModTime()}
+    current[path] = stat
+
+    // still being written, or already handed off in this state
+    if prev, ok := w.last[path]; !ok || prev != stat {
+      continue
+    }
+
+    if reported, ok := w.reported[path]; ok && reported == stat {
+      continue
+    }
+
+    w.reported[path] = stat
+    w.found(path)
+  }
+
+  // forget files that are gone so the same name can be reported again
+  for path := range w.reported {
+    if _, ok := current[path]; !ok {
+      delete(w.reported, path)
+    }
+  }
+
+  for path := range w.last {
+    if _, ok := current[path]; !ok {
+      w.gone(path)
+    }
+  }
+
+  w.last = current
+}
+
+func (w *pollWatcher) close() error {
+  w.stopOnce.Do(func() { close(w.stop) })
+  return nil
+}
@@ -0,0 +1,1938 @@
+// Package watcher is a transcode queue: files dropped into a queue directory
+// are encoded with ffmpeg by a pool of workers and the results are moved into
+// a finished directory. The gowatcher command is a thin wrapper that builds a
+// Config from environment variables, other programs can embed a Watcher
+package watcher
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "slices"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Config configures a Watcher. BaseDir and Profile are required, and
+// FFmpegPath unless every profile runs its own command. The other fields
+// fall back to the gowatcher command's defaults when zero
+type Config struct {
+  // Name tells watchers apart when a process runs several, it labels their
+  // metrics
+  Name string
+
+  // BaseDir holds the queue, upload, working, finished and logs
+  // directories. They are created when missing and working is cleaned up
+  BaseDir string
+
+  // QueueDir, WorkingDir, FinishedDir and OriginalsDir replace the
+  // directories of the same name under BaseDir, they can be anywhere
+  // including other filesystems. What gowatcher left in WorkingDir is
+  // deleted on start following WorkingCleanup, other files are kept
+  QueueDir     string
+  WorkingDir   string
+  FinishedDir  string
+  OriginalsDir string
+
+  // FailedDir is where the inputs of failed jobs are moved, when empty they
+  // stay in the queue directory. Requeued jobs encode from there
+  FailedDir string
+
+  // WorkingCleanup limits what is deleted from WorkingDir on start, by
+  // default everything when no other instance is using it
+  WorkingCleanup WorkingCleanup
+
+  // RejectNonMedia probes every input and moves the ones that are not audio
+  // or video, like text files, images or archives, to RejectedDir (default
+  // ./rejected) with a .reason.txt instead of encoding them. It needs
+  // ffprobe. Empty inputs are always skipped
+  RejectNonMedia bool
+  RejectedDir    string
+
+  // Failures are what happens to a job that fails with each class of
+  // failure, a class without a policy fails as always. Quarantined inputs
+  // go to RejectedDir
+  Failures map[FailureClass]FailurePolicy
+
+  // Archives unpacks zip and tar archives dropped into a queue directory
+  // and queues their files, nil queues an archive like any other file.
+  // Failed archives go to RejectedDir with RejectNonMedia
+  Archives *Archives
+
+  // Holding moves complete uploads from the holding directory into the
+  // queue directory, nil leaves moving them to whoever uploads
+  Holding *Holding
+
+  // Approval holds each file that settles in a queue directory, put there
+  // by /import and /clips too, as pending until an operator approves it,
+  // with a profile of their choosing, or rejects it to RejectedDir with a
+  // .reason.txt. GET /pending, the dashboard and the TUI list them. Files
+  // given to Enqueue or /enqueue, interrupted jobs and RunOnce's batch are
+  // not held, nor are pending files remembered, a restart holds them again
+  Approval bool
+
+  // Filenames cleans up the names of found files before they are queued,
+  // nil leaves them as they arrived
+  Filenames *Filenames
+
+  // Companions groups each input with its subtitles, metadata and artwork
+  // delivered next to it, nil queues them like any other file
+  Companions *Companions
+
+  // FFmpegPath is the ffmpeg of the profiles without one of their own, see
+  // Profile.FFmpegPath
+  FFmpegPath string
+
+  // FFmpegLogLevel is ffmpeg's -loglevel for the jobs' logs, default info,
+  // and FFmpegMainLogLevel the level from which its lines also go to the
+  // main log, default warning, quiet for none. Profiles may set their own
+  FFmpegLogLevel     string
+  FFmpegMainLogLevel string
+
+  // FFprobePath is optional, without it progress has no percentage and
+  // inputs are never remuxed
+  FFprobePath string
+
+  // Profile is what every job is encoded with unless the pre hook picks one
+  // of Profiles instead
+  Profile  *Profile
+  Profiles map[string]*Profile
+
+  // Routes pick one of Profiles from what ffprobe finds in the input, see
+  // Route
+  Routes []Route
+
+  // Workers is the number of files encoded at the same time, default 1
+  Workers int
+
+  // Scheduling is the order jobs of the same priority start in, default
+  // SchedulingFIFO. ReserveLongWorker keeps a worker, with two or more, for
+  // the longest jobs under SchedulingShortest so they are not starved
+  Scheduling        Scheduling
+  ReserveLongWorker bool
+
+  // Autoscale changes the number of workers with the system load, nil
+  // keeps Workers
+  Autoscale *Autoscale
+
+  // WatchMode is "notify" (the default) to use fsnotify, or "poll" to list
+  // the queue directory every PollInterval (default 5s)
+  WatchMode    string
+  PollInterval time.Duration
+
+  // WatchDebounce is how long a file has no events before notify mode
+  // queues it, default 1s, so a copy sending a create and many writes is
+  // one job once it is done. WatchCoalesce is how long events for a file
+  // after that are dropped as part of the same arrival, default 5s, like
+  // the rename, chmod or touch some copy tools finish with. A file removed
+  // in the meantime is new when it comes back. Poll mode queues a file once
+  // it is unchanged between two polls instead
+  WatchDebounce time.Duration
+  WatchCoalesce time.Duration
+
+  // RescanInterval also lists the queue directory this often to pick up
+  // files fsnotify missed, zero disables it
+  RescanInterval time.Duration
+
+  // ScanOrder is the order files already in a queue directory are queued
+  // in at startup and by rescans, default ScanByName
+  ScanOrder ScanOrder
+
+  // ProgressInterval is how often encode progress is logged, default 30s
+  ProgressInterval time.Duration
+
+  // Originals is what happens to an input after a successful encode, the
+  // default deletes it. ArchiveByDate puts archived inputs in a folder per
+  // day under the originals directory
+  Originals     OriginalsPolicy
+  ArchiveByDate bool
+
+  // TrashDir is where OriginalsTrash moves inputs, default BaseDir/.trash,
+  // and TrashRetention how long they are kept there, default a week
+  TrashDir       string
+  TrashRetention time.Duration
+
+  // Collisions is what happens when an output already exists in the
+  // finished directory, the default overwrites it
+  Collisions CollisionPolicy
+
+  // PriorityPrefix marks files in the queue directory whose name starts
+  // with it as high priority, like files in its priority subfolder. The
+  // prefix is left off the output names
+  PriorityPrefix string
+
+  // Symlinks is what becomes of symlinks in the queue directories, the
+  // default follows them. Links that loop, dangle, point at a directory or
+  // into a queue directory are skipped whatever the policy
+  Symlinks SymlinkPolicy
+
+  // Schedule limits when new encodes start, files are still queued at any
+  // time. Nil encodes whenever there is work
+  Schedule *Schedule
+
+  // Deferral holds the jobs that are not urgent while a signal says
+  // encoding costs too much, nil starts them whenever there is work
+  Deferral *Deferral
+
+  // IncludeExtensions is an allow list of extensions, empty allows all.
+  // ExcludeGlobs are shell patterns matched against the file name
+  IncludeExtensions []string
+  ExcludeGlobs      []string
+
+  // IgnorePatterns are shell patterns matched against the file name of
+  // files still being written, like *.part, which are not queued, waited
+  // for or counted until they are renamed. Nil is defaultIgnorePatterns,
+  // empty ignores only dotfiles, which are always ignored
+  IgnorePatterns []string
+
+  // MinFileSize and MinFileAge hold back files in the queue directories
+  // smaller than the size in bytes, or modified within the age, so partial
+  // copies and junk are not encoded. Zero takes any file
+  MinFileSize int64
+  MinFileAge  time.Duration
+
+  // Growing encodes inputs still being written, like live captures, once
+  // they stop growing or while they grow. Nil takes a file as complete once
+  // MinFileAge and MinFileSize let it through
+  Growing *Growing
+
+  // SequenceFrameRate is the frame rate of image sequences, directories of
+  // numbered frames dropped into a queue directory, whose sidecar sets
+  // none, e.g. 24000/1001. Default 24, see imageSequence
+  SequenceFrameRate string
+
+  // SkipValidation moves outputs to finished without checking them. By
+  // default an output must not be empty and, with ffprobe, must have streams
+  // and a duration within DurationTolerance of the input's, nil for the
+  // default of 5%. A zero one wants the duration exactly
+  SkipValidation    bool
+  DurationTolerance *DurationTolerance
+
+  // PreHook runs before each encode and can skip or delay the job, or
+  // switch it to another profile
+  PreHook *Hook
+
+  // PostHook runs after each successful encode, once the outputs are in the
+  // finished directory
+  PostHook *Hook
+
+  // Thumbnails makes posters, sprite sheets and preview clips of the
+  // outputs in finished/thumbs, nil makes none
+  Thumbnails *Thumbnails
+
+  // Preflight reports on every input before it is encoded, nil makes no
+  // reports
+  Preflight *Preflight
+
+  // Upload delivers the outputs to S3 before a job counts as done, Rclone
+  // to an rclone remote instead. Nil for both keeps them in the finished
+  // directory only
+  Upload *S3Upload
+  Rclone *RcloneUpload
+
+  // Finished writes the outputs to a Storage instead, like an SFTP server,
+  // once they are in the finished directory
+  Finished *FinishedStorage
+
+  // Destinations are the options the profiles' remote Destinations are
+  // opened with, see Profile.Destination
+  Destinations StorageOptions
+
+  // Delivery paces, reports and resumes the outputs' moves to a finished
+  // directory on another filesystem and their uploads
+  Delivery Delivery
+
+  // Ingest also takes jobs from S3 events on an SQS queue, it needs Upload
+  // for the outputs
+  Ingest *SQSIngest
+
+  // Sources feed jobs from elsewhere too, see JobSource
+  Sources []JobSource
+
+  // Stream also takes jobs from a Redis stream
+  Stream *RedisStream
+
+  // Remote copies new files from a queue directory on a Storage, like an
+  // FTP or SFTP server or an S3 bucket, into the queue directory
+  Remote *RemoteSource
+
+  // MQTT publishes the jobs' events to a broker, nil publishes nothing
+  MQTT *MQTT
+
+  // Claims let other instances share the queue directory, nil when this
+  // is the only one watching it
+  Claims *Claims
+
+  // Agents encode the jobs on other machines, nil encodes them all here
+  Agents *Agents
+
+  // Telemetry sends traces of the jobs and the metrics to an OpenTelemetry
+  // collector, nil sends nothing
+  Telemetry *Telemetry
+
+  // SkipLock starts without locking BaseDir. The lock refuses to start a
+  // second instance on the same tree, with Claims the second one joins as
+  // another worker
+  SkipLock bool
+
+  // Limits restrict the ffmpeg processes' CPU, I/O and memory use from the
+  // start, a run they cannot be applied to fails
+  Limits ProcessLimits
+
+  // FinishedRetention and OriginalsRetention prune the finished and
+  // originals directories every hour, nil keeps everything
+  FinishedRetention  *Retention
+  OriginalsRetention *Retention
+
+  // Checksums writes a .sha256 next to every output in the finished
+  // directory. An input with a .sha256 or .md5 sidecar is always checked
+  // against it before it is encoded
+  Checksums bool
+
+  // Manifests writes a JSON manifest for each job that finished, see
+  // Manifest, listing its input, every file it left with their sizes and
+  // SHA-256, its profile's version and flags, what the encode took and how
+  // the outputs were validated. It goes next to the first output as
+  // <output>.manifest.json, uploaded with the outputs, or into ManifestDir
+  // when set as <ulid>-<input>.manifest.json
+  Manifests   bool
+  ManifestDir string
+
+  // Sandbox contains every ffmpeg, nil runs it directly
+  Sandbox *Sandbox
+
+  // RunAs is the "user" or "user:group" ffmpeg runs as, with the user's
+  // groups. gowatcher must start as root, the working directory is given to
+  // the user so ffmpeg can write there. Unix only
+  RunAs string
+
+  // OutputOwner is the "user", "user:group" or ":group" given the outputs,
+  // thumbnails and reports before they land in the finished directory, and
+  // OutputMode their permissions. Directories also get execute wherever
+  // OutputMode has read. Unset leaves them as ffmpeg wrote them
+  OutputOwner string
+  OutputMode  os.FileMode
+
+  // OutputTimes is the modification time the outputs get before they land:
+  // OutputTimesSource the input's, for archives sorting by when it was
+  // shot, OutputTimesFinished when the job finished. Empty leaves ffmpeg's.
+  // OutputXattrs copies the input's extended attributes, like Finder tags
+  // and user.* metadata, to each output once it is in place, on Linux and
+  // macOS only
+  OutputTimes  OutputTimes
+  OutputXattrs bool
+
+  // Resources caps the jobs running at once per resource class, pass the
+  // same one to every Watcher in a process so they share the GPU. Nil only
+  // applies the profiles' MaxJobs
+  Resources *Resources
+
+  // MinFreeSpace holds jobs until the working and finished volumes have at
+  // least this much space free, the zero value does not check
+  MinFreeSpace SpaceThreshold
+
+  // Downloads limits what EnqueueURL and Stream download
+  Downloads DownloadLimits
+
+  // JobLogMaxAge and JobLogMaxFiles prune the job logs, JobLogMaxBytes
+  // their total size, zero keeps them
+  JobLogMaxAge   time.Duration
+  JobLogMaxFiles int
+  JobLogMaxBytes int64
+
+  // JobLogMaxSize caps what a run writes to its job log, the end of the
+  // output left out is added once it is done. Zero does not cap it
+  JobLogMaxSize int64
+
+  // JobLogCompress gzips each job log to .log.gz once its run is done
+  JobLogCompress bool
+
+  // DryRun logs the ffmpeg commands each file would be encoded with and
+  // where its outputs would go, without running anything or moving,
+  // deleting or writing files. Files are still probed, and the working
+  // directory is not emptied on start
+  DryRun bool
+
+  // Ledger remembers the inputs encoded successfully in LedgerFile,
+  // BaseDir/ledger.jsonl by default, and skips them when they turn up
+  // again, after a restart with kept originals or dropped in twice. Empty
+  // disables it
+  Ledger     LedgerMode
+  LedgerFile string
+
+  // AuditLog appends every encode started, finished or failed, every file
+  // moved or deleted and every hook run to this file, one JSON line each,
+  // see AuditLog. AuditChecksums adds each file's SHA-256, which reads the
+  // inputs once more. Empty disables it
+  AuditLog       string
+  AuditChecksums bool
+
+  // HistoryFile keeps the JobStats of every encode, one JSON line each, so
+  // Stats covers more than the jobs since startup. Empty keeps them in
+  // memory
+  HistoryFile string
+
+  // JobTimeout and StallTimeout kill an encode that runs too long or stops
+  // making progress, zero disables them
+  JobTimeout   time.Duration
+  StallTimeout time.Duration
+
+  // Handlers are told about every job that finishes or fails, Notifiers
+  // also about every job queued and started, see ParseNotifiers. Those
+  // that are io.Closers are closed by Shutdown
+  Handlers  []EventHandler
+  Notifiers []Notifier
+
+  // StuckAfter warns and sends the handlers a "stuck" event once jobs have
+  // been waiting this long without any job starting, finishing or making
+  // progress, zero disables it
+  StuckAfter time.Duration
+
+  // MaxQueueAge sends the handlers a "queue_aging" event once a job has
+  // been waiting longer, BacklogGrowing a "backlog_growing" one once more
+  // jobs were queued than finished over that long while the oldest waited
+  // ever longer, see watchQueueAge. Zero disables each
+  MaxQueueAge    time.Duration
+  BacklogGrowing time.Duration
+
+  // MaxQueued is how many jobs can wait for a worker, files found in the
+  // queue directories beyond that stay there until there is room, see
+  // OverflowPolicy. Zero has no limit
+  MaxQueued int
+  Overflow  OverflowPolicy
+
+  // Intake limits how fast found files are queued, nil has no limit
+  Intake *Intake
+}
+
+// Watcher watches the queue directory and encodes what turns up in it
+type Watcher struct {
+  cfg      Config
+  queueDir string
+
+  // priorityDir is the queue directory's priority subfolder, its files jump
+  // ahead of the others. holdingDir is where uploads go while they are
+  // written, see Holding
+  priorityDir string
+  holdingDir  string
+  store       *jobStore
+  queue       *jobQueue
+  enc         *encoder
+  pool        *workerPool
+  stats       *metrics
+
+  // filter and profiles are replaced by Reload, reloader is what POST
+  // /reload calls
+  filter   atomic.Pointer[fileFilter]
+  profiles atomic.Pointer[profileSet]
+  reloader func() error
+  reloadMu sync.Mutex
+
+  // workers is the configured number of workers, Reload changes it while
+  // the pool runs
+  workers atomic.Int64
+
+  watchers []dirWatcher
+  ingest   *ingester
+  stream   *streamConsumer
+  remote   *remoteSource
+  mqtt     *mqttPublisher
+  sources  []*jobSource
+
+  // downloadDir is where EnqueueURL downloads to, with downloads
+  downloadDir string
+  downloads   *downloader
+
+  // keepLocal is how long uploaded outputs stay in the finished directory,
+  // zero for as long as they like
+  keepLocal time.Duration
+  // stopRescan is closed on shutdown to stop the rescan and schedule loops
+  stopRescan chan struct{}
+
+  // started and stopping are set when Start or RunOnce is done and when
+  // Shutdown begins, lastEvent is when a file was last found, in unix nanos
+  started   atomic.Bool
+  stopping  atomic.Bool
+  lastEvent atomic.Int64
+
+  // overflowing is set while files are left in the queue directories for a
+  // full queue, overflowAlerted once that was told until they are queued
+  overflowing     atomic.Bool
+  overflowAlerted atomic.Bool
+
+  // intake is nil without Config.Intake
+  intake *intakeLimiter
+
+  // lock is held on the base directory until shutdown, nil without one
+  lock *instanceLock
+
+  // working marks the working directory as in use, interrupted are the
+  // inputs of earlier runs' jobs queued again on start
+  working     *workingState
+  interrupted []string
+
+  // foundMu makes checking and queueing a found file one step, settling
+  // are the files waiting to be MinFileAge old, badLinks the symlinks
+  // skipped and why, sizes the found files' sizes while Growing waits
+  foundMu  sync.Mutex
+  settling sync.Map
+  badLinks sync.Map
+  sizes    sync.Map
+
+  // unpacking are the archives being unpacked, unpackWait waits for them
+  // and badArchives are those that failed, by size and modification time
+  unpacking   sync.Map
+  unpackWait  sync.WaitGroup
+  badArchives sync.Map
+
+  // awaiting are the inputs waiting for their companions, by when they
+  // were first seen
+  awaiting sync.Map
+
+  // pending are the files waiting for approval, by when they were held,
+  // see Config.Approval
+  pending sync.Map
+
+  // renamed are the names the files Filenames renamed arrived with, by
+  // their new path until they are queued, badNames those it could not
+  // rename
+  renamed  sync.Map
+  badNames sync.Map
+}
+
+// New checks the config and prepares the directories under BaseDir, nothing
+// is encoded until Start is called
+func New(cfg Config) (*Watcher, error) {
+  if cfg.Profile == nil {
+    return nil, fmt.Errorf("no profile")
+  }
+
+  if cfg.Workers == 0 {
+    cfg.Workers = 1
+  }
+
+  if cfg.Workers < 0 {
+    return nil, fmt.Errorf("workers must be a positive number")
+  }
+
+  if cfg.Autoscale != nil {
+    autoscale, err := cfg.Autoscale.withDefaults()
+
+    if err != nil {
+      return nil, fmt.Errorf("autoscale: %s", err)
+    }
+
+    cfg.Autoscale = &autoscale
+    cfg.Workers = max(autoscale.Min, min(autoscale.Max, cfg.Workers))
+  }
+
+  if cfg.WatchMode == "" {
+    cfg.WatchMode = "notify"
+  }
+
+  if cfg.WatchMode != "notify" && cfg.WatchMode != "poll" {
+    return nil, fmt.Errorf("watch mode must be notify or poll, not %q", cfg.WatchMode)
+  }
+
+  if cfg.PollInterval <= 0 {
+    cfg.PollInterval = 5 * time.Second
+  }
+
+  if cfg.WatchDebounce < 0 || cfg.WatchCoalesce < 0 {
+    return nil, fmt.Errorf("watch debounce and coalesce must not be negative")
+  }
+
+  if cfg.WatchDebounce == 0 {
+    cfg.WatchDebounce = notifyQuiet
+  }
+
+  if cfg.WatchCoalesce == 0 {
+    cfg.WatchCoalesce = notifyCoalesce
+  }
+
+  if cfg.MinFileSize < 0 || cfg.MinFileAge < 0 {
+    return nil, fmt.Errorf("minimum file size and age must not be negative")
+  }
+
+  if cfg.MaxQueued < 0 {
+    return nil, fmt.Errorf("the queue limit must not be negative")
+  }
+
+  if cfg.Overflow == "" {
+    cfg.Overflow = OverflowDefer
+  }
+
+  if cfg.Intake != nil && (cfg.Intake.PerMinute < 0 || cfg.Intake.MaxUsage < 0) {
+    return nil, fmt.Errorf("the intake limits must not be negative")
+  }
+
+  if cfg.Overflow != OverflowDefer && cfg.Overflow != OverflowAlert {
+    return nil, fmt.Errorf("overflow policy must be defer or alert, not %q", cfg.Overflow)
+  }
+
+  if cfg.Scheduling == "" {
+    cfg.Scheduling = SchedulingFIFO
+  }
+
+  if cfg.Scheduling != SchedulingFIFO && cfg.Scheduling != SchedulingShortest {
+    return nil, fmt.Errorf("scheduling must be fifo or shortest, not %q", cfg.Scheduling)
+  }
+
+  if cfg.ReserveLongWorker && cfg.Scheduling != SchedulingShortest {
+    return nil, fmt.Errorf("a worker is only reserved for long jobs with shortest first scheduling")
+  }
+
+  if cfg.ScanOrder == "" {
+    cfg.ScanOrder = ScanByName
+  }
+
+  if cfg.ScanOrder != ScanByName && cfg.ScanOrder != ScanByModTime && cfg.ScanOrder != ScanBySize {
+    return nil, fmt.Errorf("scan order must be name, mtime or size, not %q", cfg.ScanOrder)
+  }
+
+  if cfg.Originals == "" {
+    cfg.Originals = OriginalsDelete
+  }
+
+  if cfg.Originals != OriginalsDelete && cfg.Originals != OriginalsKeep && cfg.Originals != OriginalsArchive && cfg.Originals != OriginalsTrash {
+    return nil, fmt.Errorf("originals policy must be delete, keep, archive or trash, not %q", cfg.Originals)
+  }
+
+  if cfg.TrashRetention == 0 {
+    cfg.TrashRetention = defaultTrashRetention
+  }
+
+  if cfg.TrashRetention < 0 {
+    return nil, fmt.Errorf("trash retention must not be negative")
+  }
+
+  if cfg.Collisions == "" {
+    cfg.Collisions = CollisionOverwrite
+  }
+
+  if cfg.Collisions != CollisionOverwrite && cfg.Collisions != CollisionSkip && cfg.Collisions != CollisionSuffix {
+    return nil, fmt.Errorf("collision policy must be overwrite, skip or suffix, not %q", cfg.Collisions)
+  }
+
+  if cfg.SequenceFrameRate != "" {
+    if err := checkFrameRate(cfg.SequenceFrameRate); err != nil {
+      return nil, fmt.Errorf("image sequences: %s", err)
+    }
+  }
+
+  if cfg.Companions != nil {
+    companions := *cfg.Companions
+
+    if err := companions.check(); err != nil {
+      return nil, fmt.Errorf("companions: %s", err)
+    }
+
+    cfg.Companions = &companions
+  }
+
+  var agents *dispatcher
+
+  if cfg.Agents != nil {
+    a := *cfg.Agents
+
+    if err := a.check(); err != nil {
+      return nil, fmt.Errorf("agents: %s", err)
+    }
+
+    agents = newDispatcher(a)
+  }
+
+  if cfg.Growing != nil {
+    growing := *cfg.Growing
+
+    if err := growing.check(); err != nil {
+      return nil, fmt.Errorf("growing files: %s", err)
+    }
+
+    cfg.Growing = &growing
+  }
+
+  for _, level := range []string{cfg.FFmpegLogLevel, cfg.FFmpegMainLogLevel} {
+    if err := checkLogLevel(level); err != nil {
+      return nil, fmt.Errorf("ffmpeg %s", err)
+    }
+  }
+
+  if cfg.FFmpegLogLevel == "" {
+    cfg.FFmpegLogLevel = defaultLogLevel
+  }
+
+  if cfg.FFmpegMainLogLevel == "" {
+    cfg.FFmpegMainLogLevel = defaultMainLogLevel
+  }
+
+  if cfg.Symlinks == "" {
+    cfg.Symlinks = SymlinksFollow
+  }
+
+  if cfg.Symlinks != SymlinksFollow && cfg.Symlinks != SymlinksResolve && cfg.Symlinks != SymlinksSkip {
+    return nil, fmt.Errorf("symlink policy must be follow, resolve or skip, not %q", cfg.Symlinks)
+  }
+
+  if cfg.PreHook != nil && len(cfg.PreHook.Command) == 0 {
+    return nil, fmt.Errorf("pre hook has no command")
+  }
+
+  if cfg.PostHook != nil && len(cfg.PostHook.Command) == 0 {
+    return nil, fmt.Errorf("post hook has no command")
+  }
+
+  for name, r := range map[string]**Retention{"finished": &cfg.FinishedRetention, "originals": &cfg.OriginalsRetention} {
+    if *r == nil {
+      continue
+    }
+
+    retention := **r
+
+    if err := retention.check(); err != nil {
+      return nil, fmt.Errorf("%s retention: %s", name, err)
+    }
+
+    *r = &retention
+  }
+
+  if cfg.Sandbox != nil {
+    sandbox := *cfg.Sandbox
+
+    if err := sandbox.check(); err != nil {
+      return nil, fmt.Errorf("sandbox: %s", err)
+    }
+
+    // the image has its own ffmpeg
+    if sandbox.container() && cfg.FFmpegPath == "" {
+      cfg.FFmpegPath = sandbox.Program
+    }
+
+    cfg.Sandbox = &sandbox
+  }
+
+  if cfg.Thumbnails != nil {
+    if cfg.FFmpegPath == "" {
+      return nil, fmt.Errorf("thumbnails need ffmpeg, which was not found")
+    }
+
+    thumbnails := cfg.Thumbnails.withDefaults()
+    cfg.Thumbnails = &thumbnails
+  }
+
+  if cfg.Preflight != nil && cfg.FFprobePath == "" {
+    return nil, fmt.Errorf("pre-flight reports need ffprobe, which was not found")
+  }
+
+  if err := cfg.Limits.check(); err != nil {
+    return nil, err
+  }
+
+  var runAs, outputOwner *owner
+
+  if cfg.RunAs != "" {
+    var err error
+
+    if runAs, err = lookupOwner(cfg.RunAs); err == nil {
+      err = runAs.canRunAs()
+    }
+
+    if err != nil {
+      return nil, fmt.Errorf("run as %s: %s", cfg.RunAs, err)
+    }
+  }
+
+  if cfg.OutputOwner != "" {
+    var err error
+
+    if outputOwner, err = lookupOwner(cfg.OutputOwner); err != nil {
+      return nil, fmt.Errorf("output owner %s: %s", cfg.OutputOwner, err)
+    }
+  }
+
+  if cfg.OutputMode&^os.ModePerm != 0 {
+    return nil, fmt.Errorf("output mode %o has more than permission bits", cfg.OutputMode)
+  }
+
+  if err := cfg.OutputTimes.check(); err != nil {
+    return nil, err
+  }
+
+  if cfg.OutputXattrs && !xattrsSupported {
+    return nil, fmt.Errorf("extended attributes are only copied on Linux and macOS")
+  }
+
+  tolerance := defaultDurationTolerance
+
+  if cfg.DurationTolerance != nil {
+    tolerance = *cfg.DurationTolerance
+  }
+
+  if cfg.ProgressInterval <= 0 {
+    cfg.ProgressInterval = 30 * time.Second
+  }
+
+  profiles := map[string]*Profile{cfg.Profile.Name: cfg.Profile}
+
+  for name, p := range cfg.Profiles {
+    if _, exists := profiles[name]; !exists {
+      profiles[name] = p
+    }
+  }
+
+  builds := make(ffmpegBuilds)
+  container := cfg.Sandbox != nil && cfg.Sandbox.container()
+
+  for _, p := range profiles {
+    if err := checkNameTemplate(p.NameTemplate); err != nil {
+      return nil, err
+    }
+
+    if err := p.checkFFmpeg(cfg.FFmpegPath, container, builds); err != nil {
+      return nil, err
+    }
+
+    if err := p.checkRunnable(p.ffmpegPath(cfg.FFmpegPath)); err != nil {
+      return nil, err
+    }
+  }
+
+  routes, err := compileRoutes(cfg.Routes, profiles)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if len(routes) > 0 && cfg.FFprobePath == "" {
+    return nil, fmt.Errorf("routes need ffprobe")
+  }
+
+  filter, err := newFileFilter(cfg.IncludeExtensions, cfg.ExcludeGlobs, cfg.IgnorePatterns)
+
+  if err != nil {
+    return nil, err
+  }
+
+  exists, err := dirExists(cfg.BaseDir)
+
+  if err != nil {
+    return nil, fmt.Errorf("base directory %s: %s", cfg.BaseDir, err)
+  }
+
+  if !exists {
+    return nil, fmt.Errorf("base directory %s does not exist", cfg.BaseDir)
+  }
+
+  baseDirAbs, err := filepath.Abs(cfg.BaseDir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  queueDirAbs, err := dirOrDefault(cfg.QueueDir, baseDirAbs, "queue")
+
+  if err != nil {
+    return nil, err
+  }
+
+  workingDirAbs, err := dirOrDefault(cfg.WorkingDir, baseDirAbs, "working")
+
+  if err != nil {
+    return nil, err
+  }
+
+  finishedDirAbs, err := dirOrDefault(cfg.FinishedDir, baseDirAbs, "finished")
+
+  if err != nil {
+    return nil, err
+  }
+
+  logsDirAbs := filepath.Join(baseDirAbs, "logs")
+  originalsDirAbs, err := dirOrDefault(cfg.OriginalsDir, baseDirAbs, "originals")
+
+  if err != nil {
+    return nil, err
+  }
+
+  var failedDirAbs string
+
+  if cfg.FailedDir != "" {
+    if failedDirAbs, err = filepath.Abs(cfg.FailedDir); err != nil {
+      return nil, err
+    }
+
+    if err = createDir(failedDirAbs); err != nil {
+      return nil, err
+    }
+  }
+
+  var trash *Trash
+
+  if cfg.Originals == OriginalsTrash {
+    trashDirAbs, err := dirOrDefault(cfg.TrashDir, baseDirAbs, ".trash")
+
+    if err != nil {
+      return nil, err
+    }
+
+    if err = createDir(trashDirAbs); err != nil {
+      return nil, err
+    }
+
+    if trash, err = OpenTrash(trashDirAbs); err != nil {
+      return nil, err
+    }
+  }
+
+  var rejectedDirAbs string
+
+  if cfg.RejectNonMedia && cfg.FFprobePath == "" {
+    return nil, fmt.Errorf("rejecting non-media inputs needs ffprobe")
+  }
+
+  quarantines := false
+
+  for class, p := range cfg.Failures {
+    if !slices.Contains(FailureClasses, class) {
+      return nil, fmt.Errorf("%q is not a failure class", class)
+    }
+
+    switch p.Action {
+    case failQuarantine:
+      quarantines = true
+    case failFail:
+    case failRetry:
+      if p.Attempts <= 0 || p.Delay < 0 {
+        return nil, fmt.Errorf("retrying %s failures needs attempts and a delay that is not negative", class)
+      }
+    default:
+      return nil, fmt.Errorf("%s failures: %q must be fail, retry or quarantine", class, p.Action)
+    }
+  }
+
+  // quarantined inputs and those an operator rejects share the rejected
+  // directory
+  var quarantineDirAbs string
+
+  if cfg.RejectNonMedia || quarantines || cfg.Approval {
+    if quarantineDirAbs, err = dirOrDefault(cfg.RejectedDir, baseDirAbs, "rejected"); err != nil {
+      return nil, err
+    }
+
+    if err = createDir(quarantineDirAbs); err != nil {
+      return nil, err
+    }
+  }
+
+  if cfg.RejectNonMedia {
+    rejectedDirAbs = quarantineDirAbs
+  }
+
+  priorityDirAbs := filepath.Join(queueDirAbs, "priority")
+
+  var manifestDirAbs string
+
+  if cfg.Manifests && cfg.ManifestDir != "" {
+    if manifestDirAbs, err = filepath.Abs(cfg.ManifestDir); err != nil {
+      return nil, err
+    }
+
+    if err = createDir(manifestDirAbs); err != nil {
+      return nil, err
+    }
+  }
+
+  holdingDirAbs := filepath.Join(baseDirAbs, "upload")
+
+  if cfg.Deferral != nil {
+    if err = cfg.Deferral.check(); err != nil {
+      return nil, fmt.Errorf("deferral: %s", err)
+    }
+  }
+
+  if cfg.Filenames != nil {
+    if err = cfg.Filenames.check(); err != nil {
+      return nil, fmt.Errorf("filenames: %s", err)
+    }
+  }
+
+  if cfg.Holding != nil {
+    holding := *cfg.Holding
+
+    if err = holding.check(); err != nil {
+      return nil, fmt.Errorf("holding: %s", err)
+    }
+
+    if holding.Dir != "" {
+      if holdingDirAbs, err = filepath.Abs(holding.Dir); err != nil {
+        return nil, err
+      }
+    }
+
+    // the queue's watchers would take the uploads as they are written
+    if holdingDirAbs == queueDirAbs || holdingDirAbs == priorityDirAbs {
+      return nil, fmt.Errorf("the holding directory must not be a queue directory")
+    }
+
+    cfg.Holding = &holding
+  }
+
+  for _, dir := range []string{queueDirAbs, priorityDirAbs, holdingDirAbs, workingDirAbs, finishedDirAbs, logsDirAbs} {
+    if err = createDir(dir); err != nil {
+      return nil, err
+    }
+  }
+
+  if !cfg.DryRun {
+    if err = runAs.chown(workingDirAbs); err != nil {
+      return nil, fmt.Errorf("run as %s: %s", cfg.RunAs, err)
+    }
+  }
+
+  var lock *instanceLock
+
+  if !cfg.DryRun && !cfg.SkipLock {
+    if lock, err = lockBaseDir(baseDirAbs); err != nil && cfg.Claims == nil {
+      return nil, err
+    } else if err != nil {
+      slog.Warn("Sharing the base directory with another instance, joining it as a worker", "reason", err)
+    }
+  }
+
+  // the instance holding the lock migrates the state, the others only
+  // check they can use it
+  if !cfg.DryRun {
+    files := statePaths(cfg, baseDirAbs)
+
+    if lock != nil {
+      report, err := migrateState(files, false, false)
+
+      if err != nil {
+        return nil, fmt.Errorf("state: %s", err)
+      }
+
+      for _, m := range report.Migrations {
+        slog.Info("Migrated state", "dir", baseDirAbs, "version", m.Version, "files", m.Files)
+      }
+
+      if report.Newer {
+        slog.Warn("A newer gowatcher migrated the state, it can still be used as it is", "dir", baseDirAbs, "version", report.From, "ours", stateVersion)
+      }
+    } else if _, err := readState(files); err != nil {
+      return nil, fmt.Errorf("state: %s", err)
+    }
+  }
+
+  // anything left in workingDir is from an earlier run, unless another
+  // instance is using it too
+  var working *workingState
+  var interrupted []string
+
+  if !cfg.DryRun {
+    if working, err = newWorkingState(workingDirAbs); err != nil {
+      return nil, err
+    }
+
+    // whatever else is running, an instance of this host that crashed may
+    // have left its ffmpegs encoding
+    working.reapChildren()
+
+    if others := working.others(); len(others) > 0 {
+      slog.Warn("Another instance is using the working directory, not cleaning it", "dir", workingDirAbs, "instances", others)
+    } else if interrupted, err = working.clean(workingDirAbs, cfg.WorkingCleanup); err != nil {
+      return nil, fmt.Errorf("removing working files: %s", err)
+    }
+
+    if err = working.touch(); err != nil {
+      return nil, fmt.Errorf("working directory lock: %s", err)
+    }
+  }
+
+  if cfg.Originals == OriginalsArchive {
+    if err = createDir(originalsDirAbs); err != nil {
+      return nil, err
+    }
+  }
+
+  logs := &jobLogs{
+    dir:      logsDirAbs,
+    maxAge:   cfg.JobLogMaxAge,
+    maxFiles: cfg.JobLogMaxFiles,
+    maxBytes: cfg.JobLogMaxBytes,
+    maxSize:  cfg.JobLogMaxSize,
+    compress: cfg.JobLogCompress,
+  }
+  if !cfg.DryRun {
+    logs.prune()
+  }
+
+  var ledger *Ledger
+
+  if cfg.Ledger != "" {
+    ledgerFile := cfg.LedgerFile
+
+    if ledgerFile == "" {
+      ledgerFile = filepath.Join(baseDirAbs, "ledger.jsonl")
+    }
+
+    if ledger, err = OpenLedger(ledgerFile, cfg.Ledger); err != nil {
+      return nil, fmt.Errorf("ledger: %s", err)
+    }
+  }
+
+  var audit *AuditLog
+
+  if cfg.AuditLog != "" && !cfg.DryRun {
+    if audit, err = OpenAuditLog(cfg.AuditLog, cfg.AuditChecksums); err != nil {
+      return nil, fmt.Errorf("audit log: %s", err)
+    }
+  }
+
+  history, err := openStatsHistory(cfg.HistoryFile)
+
+  if err != nil {
+    return nil, fmt.Errorf("history: %s", err)
+  }
+
+  var encodes *encodeLog
+
+  if !cfg.DryRun {
+    encodes = &encodeLog{path: filepath.Join(baseDirAbs, encodesFile)}
+  }
+
+  var upload destination
+  var deleteLocal bool
+  var keepLocal time.Duration
+
+  switch {
+  case (cfg.Upload != nil && cfg.Rclone != nil) || (cfg.Finished != nil && (cfg.Upload != nil || cfg.Rclone != nil)):
+    return nil, fmt.Errorf("outputs can be uploaded to S3, with rclone or to a finished storage, only one of them")
+  case cfg.Upload != nil:
+    s3, err := newS3Client(*cfg.Upload)
+
+    if err != nil {
+      return nil, fmt.Errorf("upload: %s", err)
+    }
+
+    upload, deleteLocal, keepLocal = s3, cfg.Upload.DeleteLocal, cfg.Upload.KeepLocal
+  case cfg.Rclone != nil:
+    rclone, err := newRcloneClient(*cfg.Rclone)
+
+    if err != nil {
+      return nil, fmt.Errorf("rclone: %s", err)
+    }
+
+    upload, deleteLocal, keepLocal = rclone, cfg.Rclone.DeleteLocal, cfg.Rclone.KeepLocal
+  case cfg.Finished != nil:
+    if cfg.Finished.DeleteLocal && cfg.Finished.KeepLocal > 0 {
+      return nil, fmt.Errorf("finished storage: local outputs cannot be both deleted and kept")
+    }
+
+    storage := cfg.Finished.Storage
+
+    if storage == nil {
+      if storage, err = OpenStorage(cfg.Finished.URL, cfg.Finished.Options); err != nil {
+        return nil, fmt.Errorf("finished storage: %s", err)
+      }
+    }
+
+    upload, deleteLocal, keepLocal = storageUpload{storage: storage}, cfg.Finished.DeleteLocal, cfg.Finished.KeepLocal
+  }
+
+  var uploaded *uploadedLog
+
+  if upload != nil && keepLocal > 0 && !cfg.DryRun {
+    uploaded = &uploadedLog{path: filepath.Join(baseDirAbs, uploadedFile)}
+  }
+
+  delivery, err := newDeliverer(cfg.Delivery)
+
+  if err != nil {
+    return nil, fmt.Errorf("delivery: %s", err)
+  }
+
+  if rclone, ok := upload.(*rcloneClient); ok {
+    rclone.bandwidth, rclone.progress = cfg.Delivery.Bandwidth, delivery.progress
+  }
+
+  var claims *claimer
+
+  if cfg.Claims != nil && !cfg.DryRun {
+    if claims, err = newClaimer(*cfg.Claims, queueDirAbs); err != nil {
+      return nil, fmt.Errorf("claims: %s", err)
+    }
+  }
+
+  if cfg.Ingest != nil && upload == nil {
+    return nil, fmt.Errorf("ingest needs an upload for the outputs")
+  }
+
+  selectHardware(cfg.FFmpegPath, profiles)
+
+  if cfg.Profile.remuxes() && cfg.FFprobePath == "" {
+    slog.Warn("Remux codecs need ffprobe, every input will be re-encoded", "profile", cfg.Profile.Name)
+  }
+
+  w := &Watcher{
+    cfg:         cfg,
+    queueDir:    queueDirAbs,
+    priorityDir: priorityDirAbs,
+    holdingDir:  holdingDirAbs,
+    store:       newJobStore(),
+    queue:       newJobQueue(),
+    stats:       &metrics{},
+    stopRescan:  make(chan struct{}),
+    keepLocal:   keepLocal,
+    downloadDir: filepath.Join(workingDirAbs, "downloads"),
+    downloads:   newDownloader(cfg.Downloads, cfg.MinFreeSpace),
+    working:     working,
+    interrupted: interrupted,
+    lock:        lock,
+  }
+
+  w.store.events.notifiers = cfg.Notifiers
+
+  if cfg.Intake != nil {
+    w.intake = newIntakeLimiter(*cfg.Intake)
+  }
+
+  if cfg.Ingest != nil {
+    if cfg.DryRun {
+      slog.Warn("Dry run, not taking jobs from SQS", "queue", cfg.Ingest.QueueURL)
+    } else if w.ingest, err = newIngester(*cfg.Ingest, w, workingDirAbs); err != nil {
+      return nil, fmt.Errorf("ingest: %s", err)
+    }
+  }
+
+  for _, src := range cfg.Sources {
+    if cfg.DryRun {
+      slog.Warn("Dry run, not taking jobs from source", "source", fmt.Sprintf("%T", src))
+      break
+    }
+
+    w.sources = append(w.sources, &jobSource{src: src, w: w})
+  }
+
+  if cfg.Stream != nil {
+    if cfg.DryRun {
+      slog.Warn("Dry run, not taking jobs from the Redis stream")
+    } else if w.stream, err = newStreamConsumer(*cfg.Stream, w, workingDirAbs); err != nil {
+      return nil, fmt.Errorf("stream: %s", err)
+    }
+  }
+
+  if cfg.MQTT != nil {
+    if w.mqtt, err = newMQTTPublisher(*cfg.MQTT); err != nil {
+      return nil, fmt.Errorf("mqtt: %s", err)
+    }
+  }
+
+  if cfg.Remote != nil {
+    if cfg.DryRun {
+      slog.Warn("Dry run, not polling the remote directory", "url", cfg.Remote.URL)
+    } else if w.remote, err = newRemoteSource(*cfg.Remote, queueDirAbs, workingDirAbs, w.filter.Load, w.intakeHeld); err != nil {
+      return nil, fmt.Errorf("remote: %s", err)
+    }
+  }
+
+  w.filter.Store(filter)
+  w.profiles.Store(&profileSet{def: cfg.Profile, byName: profiles, routes: routes})
+  w.workers.Store(int64(cfg.Workers))
+
+  // dry run inputs stay where they are, like kept originals
+  w.store.keepDone = cfg.Originals == OriginalsKeep || cfg.DryRun
+
+  // files still in the queue dir that are not being encoded are what is
+  // waiting
+  w.stats.queueDepth = func() int {
+    depth := countQueued(w.filter.Load(), queueDirAbs, priorityDirAbs) - int(w.stats.encodesInProgress.Load())
+
+    if depth < 0 {
+      return 0
+    }
+
+    return depth
+  }
+
+  w.stats.oldestQueued = func() time.Duration {
+    _, age, _ := w.queueAge(time.Now(), 0)
+    return age
+  }
+
+  // the remote source hears about its files' jobs like any handler
+  handlers := cfg.Handlers
+
+  if w.remote != nil {
+    handlers = append(handlers[:len(handlers):len(handlers)], w.remote)
+  }
+
+  resources := cfg.Resources
+
+  if resources == nil {
+    resources = NewResources(nil, nil)
+  }
+
+  var tel *telemetry
+
+  if cfg.Telemetry != nil {
+    if tel, err = newTelemetry(*cfg.Telemetry, cfg.Name, w.stats); err != nil {
+      return nil, err
+    }
+  }
+
+  encodeCtx, abortEncodes := context.WithCancelCause(context.Background())
+
+  w.enc = &encoder{
+    ffmpegPath:        cfg.FFmpegPath,
+    ffprobePath:       cfg.FFprobePath,
+    workingDir:        workingDirAbs,
+    working:           working,
+    finishedDir:       finishedDirAbs,
+    progressInterval:  cfg.ProgressInterval,
+    logs:              logs,
+    originals:         cfg.Originals,
+    originalsDir:      originalsDirAbs,
+    trash:             trash,
+    failedDir:         failedDirAbs,
+    rejectedDir:       rejectedDirAbs,
+    failures:          cfg.Failures,
+    quarantineDir:     quarantineDirAbs,
+    archiveByDate:     cfg.ArchiveByDate,
+    collisions:        cfg.Collisions,
+    symlinks:          cfg.Symlinks,
+    growing:           cfg.Growing,
+    sequenceFrameRate: cfg.SequenceFrameRate,
+    companions:        cfg.Companions,
+    logLevel:          cfg.FFmpegLogLevel,
+    mainLogLevel:      cfg.FFmpegMainLogLevel,
+    queueDirs:         []string{queueDirAbs, priorityDirAbs},
+    stats:             w.stats,
+    handlers:          handlers,
+    notifiers:         cfg.Notifiers,
+    validate:          !cfg.SkipValidation,
+    tolerance:         tolerance,
+    preHook:           cfg.PreHook,
+    profiles:          &w.profiles,
+    queue:             w.queue,
+    dryRun:            cfg.DryRun,
+    ledger:            ledger,
+    audit:             audit,
+    claims:            claims,
+    agents:            agents,
+    upload:            upload,
+    deleteLocal:       deleteLocal,
+    uploaded:          uploaded,
+    destinationOpts:   cfg.Destinations,
+    delivery:          delivery,
+    postHook:          cfg.PostHook,
+    thumbnails:        cfg.Thumbnails,
+    preflight:         cfg.Preflight,
+    limits:            cfg.Limits,
+    resources:         resources,
+    minFree:           cfg.MinFreeSpace,
+    telemetry:         tel,
+    history:           history,
+    encodes:           encodes,
+    runAs:             runAs,
+    sandbox:           cfg.Sandbox,
+    checksums:         cfg.Checksums,
+    manifests:         cfg.Manifests,
+    manifestDir:       manifestDirAbs,
+    outputOwner:       outputOwner,
+    outputMode:        cfg.OutputMode,
+    outputTimes:       cfg.OutputTimes,
+    outputXattrs:      cfg.OutputXattrs,
+    jobTimeout:        cfg.JobTimeout,
+    stallTimeout:      cfg.StallTimeout,
+    ctx:               encodeCtx,
+    stop:              abortEncodes,
+  }
+
+  w.queue.resources = w.enc.resources
+  w.enc.resources.watch(w.queue)
+  if cfg.Scheduling == SchedulingShortest {
+    w.queue.estimate = estimator(cfg.FFprobePath)
+  }
+
+  w.pool = newWorkerPool(w.queue, w.enc)
+  w.pool.reserveLong = cfg.ReserveLongWorker
+  w.stats.workers = w.pool.size
+
+  return w, nil
+}
+
+// dirOrDefault returns the absolute path of a configured directory, or of
+// name under the base directory when none is configured
+func dirOrDefault(configured string, baseDir string, name string) (string, error) {
+  if configured == "" {
+    return filepath.Join(baseDir, name), nil
+  }
+
+  return filepath.Abs(configured)
+}
+
+// Start launches the workers, starts watching the queue directory and
+// queues the files that are already in it
+func (w *Watcher) Start() error {
+  w.pool.start(int(w.workers.Load()))
+
+  if w.cfg.Autoscale != nil {
+    go w.autoscale(*w.cfg.Autoscale, w.stopRescan)
+  }
+
+  for _, dir := range []string{w.queueDir, w.priorityDir} {
+    slog.Info("Watching", "dir", dir, "mode", w.cfg.WatchMode)
+
+    switch w.cfg.WatchMode {
+    case "poll":
+      // the poller only reports a file once it has stopped changing, files
+      // that were there at startup are already tracked by the scan below
+      w.watchers = append(w.watchers, startPollWatcher(dir, w.cfg.PollInterval, func(path string) {
+        if !w.store.tracked(path) {
+          w.found(path)
+        }
+      }, w.gone))
+    default:
+      dir := dir
+
+      watcher, err := startNotifyWatcher(dir, w.cfg.WatchDebounce, w.cfg.WatchCoalesce, w.found, w.gone, func() {
+        if err := w.scanDir(dir); err != nil {
+          slog.Error("Rescan error", "dir", dir, "error", err)
+        }
+      })
+
+      if err != nil {
+        return err
+      }
+
+      w.watchers = append(w.watchers, watcher)
+    }
+  }
+
+  if w.cfg.Schedule != nil {
+    w.followSchedule(w.stopRescan)
+  }
+
+  if w.cfg.Deferral != nil {
+    w.followDeferral(w.stopRescan)
+  }
+
+  if w.working != nil {
+    go w.working.heartbeat(w.stopRescan)
+  }
+
+  // the files already in the queue directories are queued in the
+  // background, a large backlog does not hold up the API and the watchers
+  go func() {
+    // jobs an earlier run did not finish go first, the scan skips their inputs
+    for _, input := range w.interrupted {
+      if !w.store.tracked(input) {
+        slog.Info("Requeueing interrupted job", "input", input)
+        w.Enqueue(input)
+      }
+    }
+
+    if err := w.scan(); err != nil {
+      slog.Error("Scan error", "dir", w.queueDir, "error", err)
+    }
+  }()
+
+  if w.cfg.MaxQueued > 0 || w.intake != nil {
+    go w.drainOverflow(w.stopRescan)
+  }
+
+  if w.enc.uploaded != nil {
+    go w.pruneFinished(w.keepLocal, w.stopRescan)
+  }
+
+  if w.cfg.StuckAfter > 0 {
+    go w.watchStuck(w.cfg.StuckAfter, w.stopRescan)
+  }
+
+  if w.cfg.MaxQueueAge > 0 || w.cfg.BacklogGrowing > 0 {
+    go w.watchQueueAge(w.cfg.MaxQueueAge, w.cfg.BacklogGrowing, w.stopRescan)
+  }
+
+  // profiles may get a deadline on a reload
+  go w.watchDeadlines(w.stopRescan)
+
+  if w.cfg.Holding != nil && !w.cfg.DryRun {
+    go w.watchHolding(w.stopRescan)
+  }
+
+  if len(w.retentionDirs()) > 0 && !w.cfg.DryRun {
+    go w.retain(w.stopRescan)
+  }
+
+  if w.ingest != nil {
+    w.ingest.start(w.stopRescan)
+  }
+
+  for _, s := range w.sources {
+    s.start(w.stopRescan)
+  }
+
+  if w.mqtt != nil {
+    w.mqtt.start(w.store.events)
+  }
+
+  if w.stream != nil {
+    w.stream.start(w.stopRescan)
+  }
+
+  if w.remote != nil {
+    w.remote.start(w.stopRescan)
+  }
+
+  if w.cfg.RescanInterval > 0 {
+    go func() {
+      ticker := time.NewTicker(w.cfg.RescanInterval)
+      defer ticker.Stop()
+
+      for {
+        select {
+        case <-ticker.C:
+          if err := w.scan(); err != nil {
+            slog.Error("Rescan error", "dir", w.queueDir, "error", err)
+          }
+        case <-w.stopRescan:
+          return
+        }
+      }
+    }()
+  }
+
+  w.started.Store(true)
+
+  return nil
+}
+
+// RunOnce encodes the files already in the queue directories instead of
+// watching them, returning their jobs once every one has finished. When ctx
+// is done first the running encodes are aborted as by Shutdown, and the
+// jobs that had not finished are returned as they were
+func (w *Watcher) RunOnce(ctx context.Context) ([]*Job, error) {
+  w.pool.start(int(w.workers.Load()))
+
+  if w.mqtt != nil {
+    w.mqtt.start(w.store.events)
+  }
+
+  if w.cfg.Autoscale != nil {
+    go w.autoscale(*w.cfg.Autoscale, w.stopRescan)
+  }
+
+  if w.cfg.Schedule != nil {
+    w.followSchedule(w.stopRescan)
+  }
+
+  if w.cfg.Deferral != nil {
+    w.followDeferral(w.stopRescan)
+  }
+
+  // a batch can run past its jobs' deadlines too
+  go w.watchDeadlines(w.stopRescan)
+
+  // running a batch is the operator's approval
+  w.cfg.Approval = false
+
+  if err := w.scan(); err != nil {
+    aborted, abort := context.WithCancel(context.Background())
+    abort()
+    w.Shutdown(aborted)
+
+    return nil, err
+  }
+
+  // the files in archives are queued once they are unpacked
+  w.unpackWait.Wait()
+
+  w.started.Store(true)
+
+  // with a queue limit the files left behind are queued as others finish
+  if w.overflowing.Load() {
+    ticker := time.NewTicker(overflowCheck)
+    defer ticker.Stop()
+
+    for w.overflowing.Load() {
+      select {
+      case <-ticker.C:
+      case <-ctx.Done():
+        w.Shutdown(ctx)
+        return w.Jobs(""), nil
+      }
+
+      if !w.intakeHeld() {
+        w.overflowing.Store(false)
+
+        if err := w.scan(); err != nil {
+          slog.Error("Rescan error", "dir", w.queueDir, "error", err)
+        }
+      }
+    }
+  }
+
+  jobs := w.Jobs("")
+  w.finish(ctx, jobs)
+
+  return jobs, nil
+}
+
+// EncodeFile runs one file through the pipeline straight away, ignoring the
+// file filter and schedule, and returns its job once it has finished. The
+// file can be anywhere, ctx being done aborts the encode as by Shutdown
+func (w *Watcher) EncodeFile(ctx context.Context, path string) (*Job, error) {
+  input, err := filepath.Abs(path)
+
+  if err != nil {
+    return nil, err
+  }
+
+  info, err := os.Stat(input)
+
+  if err != nil {
+    return nil, err
+  }
+
+  if info.IsDir() {
+    if _, err := findSequence(input, ""); err != nil {
+      return nil, fmt.Errorf("%s is a directory and not an image sequence: %s", input, err)
+    }
+  }
+
+  w.pool.start(1)
+  w.stats.filesQueued.Add(1)
+
+  // asked for by name, so encoded even when the ledger has seen it
+  j := w.store.add(input, filepath.Base(input), PriorityNormal, w.profiles.Load().def)
+  j.forced = true
+  w.queue.push(j)
+  w.finish(ctx, []*Job{j})
+
+  return j, nil
+}
+
+// finish waits for the jobs to finish, or for ctx to be done, then shuts
+// down
+func (w *Watcher) finish(ctx context.Context, jobs []*Job) {
+  ticker := time.NewTicker(250 * time.Millisecond)
+  defer ticker.Stop()
+
+  for !allFinished(jobs) {
+    select {
+    case <-ticker.C:
+    case <-ctx.Done():
+      w.Shutdown(ctx)
+      return
+    }
+  }
+
+  w.Shutdown(ctx)
+}
+
+// allFinished reports whether the jobs are all over, a batch waits for the
+// failed ones due a retry
+func allFinished(jobs []*Job) bool {
+  for _, j := range jobs {
+    if !j.State().Finished() || j.retrying() {
+      return false
+    }
+  }
+
+  return true
+}
+
+// ScanOrder is the order a scan queues the files it finds in, ties go by
+// name
+type ScanOrder string
+
+const (
+  ScanByName ScanOrder = "name"
+
+  // ScanByModTime queues the oldest files first, to drain a backlog in the
+  // order it arrived
+  ScanByModTime ScanOrder = "mtime"
+
+  // ScanBySize queues the smallest files first
+  ScanBySize ScanOrder = "size"
+)
+
+// scan enqueues every file in the queue directories that is not already
+// tracked, it picks up files that fsnotify did not report. The priority
+// directory goes first so its files are not the ones left for a full queue
+func (w *Watcher) scan() error {
+  for _, dir := range []string{w.priorityDir, w.queueDir} {
+    if err := w.scanDir(dir); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+// scanDir enqueues the files in one queue directory that are not tracked
+func (w *Watcher) scanDir(dir string) error {
+  // sorted by name
+  files, err := ioutil.ReadDir(dir)
+
+  if err != nil {
+    return err
+  }
+
+  switch w.cfg.ScanOrder {
+  case ScanByModTime:
+    sort.SliceStable(files, func(i, k int) bool { return files[i].ModTime().Before(files[k].ModTime()) })
+  case ScanBySize:
+    sort.SliceStable(files, func(i, k int) bool { return files[i].Size() < files[k].Size() })
+  }
+
+  filter := w.filter.Load()
+
+  for _, file := range files {
+    path := filepath.Join(dir, file.Name())
+
+    // a directory may be an image sequence, not the priority directory
+    if (!file.IsDir() || path != w.priorityDir) && !filter.ignored(path) && !w.store.tracked(path) {
+      w.found(path)
+    }
+  }
+
+  return nil
+}
+
+// Shutdown stops watching and stops new jobs from starting, then waits for
+// the running encodes. Once ctx is done the encodes still running are
+// aborted, their partial outputs removed and their inputs left in the queue
+// directory. Pass a done context to abort straight away
+func (w *Watcher) Shutdown(ctx context.Context) {
+  w.stopping.Store(true)
+
+  for _, watcher := range w.watchers {
+    watcher.close()
+  }
+
+  close(w.stopRescan)
+  w.pool.drain(ctx)
+
+  if w.ingest != nil {
+    w.ingest.stop()
+  }
+
+  for _, s := range w.sources {
+    s.stop()
+  }
+
+  if w.stream != nil {
+    w.stream.stop()
+  }
+
+  if w.remote != nil {
+    w.remote.stop()
+  }
+
+  if w.mqtt != nil {
+    w.mqtt.close()
+  }
+
+  w.enc.telemetry.close()
+
+  for _, n := range w.cfg.Notifiers {
+    if c, ok := n.(io.Closer); ok {
+      c.Close()
+    }
+  }
+
+  w.enc.audit.Close()
+
+  if w.lock != nil {
+    w.lock.release()
+  }
+}
+
+// Enqueue queues a file for encoding, it returns nil for job spec and
+// checksum sidecars and if the file filter rejects it
+func (w *Watcher) Enqueue(path string) *Job {
+  return w.enqueue(path, "", nil)
+}
+
+// enqueue queues a file whose outputs are uploaded under uploadDir, with
+// profile unless it is nil
+func (w *Watcher) enqueue(path string, uploadDir string, profile *Profile) *Job {
+  // sidecars and companions are read when their input's job starts
+  if isSidecar(path) || w.isCompanion(path) {
+    return nil
+  }
+
+  if !w.allowed(path) {
+    slog.Info("Ignoring file", "input", path)
+    return nil
+  }
+
+  w.stats.filesQueued.Add(1)
+  w.intake.add()
+
+  name := filepath.Base(path)
+  priority := PriorityNormal
+
+  if filepath.Dir(path) == w.priorityDir {
+    priority = PriorityHigh
+  } else if prefix := w.cfg.PriorityPrefix; prefix != "" && strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+    priority = PriorityHigh
+    name = strings.TrimPrefix(name, prefix)
+  }
+
+  if profile == nil {
+    profile = w.profiles.Load().def
+  }
+
+  j := w.store.add(path, name, priority, profile)
+  j.uploadDir = uploadDir
+
+  if original, ok := w.renamed.LoadAndDelete(path); ok {
+    j.arrivedAs = original.(string)
+  }
+
+  // scheduled by the profile its job spec names, applied for good once the
+  // job starts
+  if p := w.specProfile(path); p != nil {
+    j.profile = p
+  }
+
+  w.queue.push(j)
+
+  return j
+}
+
+// allowed reports whether the file filter lets path be queued, a
+// directory as an image sequence
+func (w *Watcher) allowed(path string) bool {
+  filter := w.filter.Load()
+
+  if info, err := os.Stat(path); err == nil && info.IsDir() {
+    return filter.allowedDir(path)
+  }
+
+  return filter.allowed(path)
+}
+
+// specProfile is the profile a file's job spec names, or nil. A bad spec
+// is reported when the job starts
+func (w *Watcher) specProfile(path string) *Profile {
+  spec := findSpec(path)
+
+  if spec == "" {
+    return nil
+  }
+
+  s, err := loadSpec(spec)
+
+  if err != nil || s.Profile == "" {
+    return nil
+  }
+
+  return w.profiles.Load().byName[s.Profile]
+}
+
+// Job returns the job with the id, or nil
+func (w *Watcher) Job(id int64) *Job {
+  return w.store.get(id)
+}
+
+// JobByUID returns the job with the ULID, or nil
+func (w *Watcher) JobByUID(uid string) *Job {
+  return w.store.byUID(strings.ToUpper(uid))
+}
+
+// Jobs returns every job seen since startup ordered by id, or only those in
+// state when it is not empty
+func (w *Watcher) Jobs(state JobState) []*Job {
+  return w.store.list(state)
+}
+
+// Cancel stops a job whether it is waiting in the queue or running, killing
+// its ffmpeg and removing its partial outputs. then is what becomes of it,
+// see CancelAction, empty is CancelStop
+func (w *Watcher) Cancel(j *Job, then CancelAction) error {
+  return w.enc.cancel(j, then)
+}
+
+// Requeue puts a failed or cancelled job back on the queue, its
+// FailurePolicy starts over
+func (w *Watcher) Requeue(j *Job) error {
+  if err := requeueJob(w.queue, j); err != nil {
+    return err
+  }
+
+  j.mu.Lock()
+  j.retries = 0
+  j.mu.Unlock()
+
+  w.stats.filesQueued.Add(1)
+
+  return nil
+}
+
+// Forget removes path from the ledger so it is encoded again when it is next
+// queued, it returns how many entries were removed
+func (w *Watcher) Forget(path string) (int, error) {
+  if w.enc.ledger == nil {
+    return 0, errors.New("the ledger is off")
+  }
+
+  return w.enc.ledger.Forget(path)
+}
+
+// Pause stops workers from starting new jobs, running jobs carry on
+func (w *Watcher) Pause() {
+  w.queue.setPaused(true)
+  slog.Info("Queue paused, running encodes will finish")
+}
+
+// Resume lets workers start new jobs again
+func (w *Watcher) Resume() {
+  w.queue.setPaused(false)
+  slog.Info("Queue resumed")
+}
+
+// Paused reports whether the queue is paused
+func (w *Watcher) Paused() bool {
+  return w.queue.isPaused()
+}
+
+// OutsideSchedule reports whether jobs are being held because it is outside
+// the encoding schedule
+func (w *Watcher) OutsideSchedule() bool {
+  return w.queue.isHeld()
+}
+
+// Deferred is why the jobs that are not urgent are being held, see
+// Deferral, "" when they are not
+func (w *Watcher) Deferred() string {
+  return w.queue.deferredFor()
+}
+
+// Queued is the number of jobs waiting for a worker
+func (w *Watcher) Queued() int {
+  return w.queue.len()
+}
+
+// APIHandler serves the status and control API, see api.go for the
+// endpoints. It does not authenticate, wrap it with RequireToken to serve it
+// anywhere but a private socket
+func (w *Watcher) APIHandler() http.Handler {
+  return (&api{w: w}).handler()
+}
+
+// MetricsHandler serves Prometheus metrics
+func (w *Watcher) MetricsHandler() http.Handler {
+  return w.stats
+}
@@ -0,0 +1,143 @@
+package watcher
+
+import (
+  "fmt"
+  "os"
+  "slices"
+  "strings"
+)
+
+// Watermark overlays an image, like a logo, on a profile's video. It is
+// merged with the flags' own -vf into one filtergraph, so the two can be
+// used together
+type Watermark struct {
+  Image string
+
+  // Position is top-left, top-right, bottom-left, bottom-right (the
+  // default) or center, Margin the pixels from the edges, default 10
+  Position string
+  Margin   int
+
+  // Opacity is from 0 to 1, default 1
+  Opacity float64
+
+  // Scale sizes the image to a fraction of the video's width, Width to a
+  // number of pixels. Neither keeps its size
+  Scale float64
+  Width int
+}
+
+// watermarkPositions are the overlay's x and y for each position, with the
+// margin for the edges
+var watermarkPositions = map[string]string{
+  "top-left":     "x=%[1]d:y=%[1]d",
+  "top-right":    "x=main_w-overlay_w-%[1]d:y=%[1]d",
+  "bottom-left":  "x=%[1]d:y=main_h-overlay_h-%[1]d",
+  "bottom-right": "x=main_w-overlay_w-%[1]d:y=main_h-overlay_h-%[1]d",
+  "center":       "x=(main_w-overlay_w)/2:y=(main_h-overlay_h)/2",
+}
+
+// videoFilterFlags are the flags holding a video filter chain
+var videoFilterFlags = []string{"-vf", "-filter:v"}
+
+func (w Watermark) withDefaults() Watermark {
+  if w.Position == "" {
+    w.Position = "bottom-right"
+  }
+
+  if w.Margin == 0 {
+    w.Margin = 10
+  }
+
+  if w.Opacity == 0 {
+    w.Opacity = 1
+  }
+
+  return w
+}
+
+// check rejects watermarks that could not be drawn
+func (w *Watermark) check() error {
+  d := w.withDefaults()
+
+  switch {
+  case w.Image == "":
+    return fmt.Errorf("a watermark needs an image")
+  case watermarkPositions[d.Position] == "":
+    return fmt.Errorf("watermark position must be top-left, top-right, bottom-left, bottom-right or center")
+  case d.Opacity < 0 || d.Opacity > 1:
+    return fmt.Errorf("watermark opacity must be between 0 and 1")
+  case d.Scale < 0 || d.Scale > 1 || d.Width < 0 || d.Margin < 0:
+    return fmt.Errorf("watermark scale must be between 0 and 1, width and margin not negative")
+  case d.Scale > 0 && d.Width > 0:
+    return fmt.Errorf("a watermark has either a scale or a width")
+  }
+
+  if _, err := os.Stat(w.Image); err != nil {
+    return fmt.Errorf("watermark image: %s", err)
+  }
+
+  return nil
+}
+
+// graph is the filtergraph running chain, the flags' own video filters,
+// then overlaying the image. The image comes from the movie source so the
+// graph stays a simple one that -vf takes, with no extra input or maps
+func (w *Watermark) graph(chain string) string {
+  d := w.withDefaults()
+
+  if chain == "" {
+    chain = "null"
+  }
+
+  logo := fmt.Sprintf("movie=f=%s,format=rgba", escapeFilterValue(d.Image))
+
+  if d.Opacity < 1 {
+    logo += fmt.Sprintf(",colorchannelmixer=aa=%s", fmtFloat(d.Opacity))
+  }
+
+  steps := []string{"[in]" + chain + "[base]"}
+  base := "[base]"
+
+  switch {
+  case d.Scale > 0:
+    steps = append(steps, logo+"[logo]", fmt.Sprintf("[logo][base]scale2ref=w=main_w*%s:h=ow/a[wm][scaled]", fmtFloat(d.Scale)))
+    base = "[scaled]"
+  case d.Width > 0:
+    steps = append(steps, logo+fmt.Sprintf(",scale=%d:-1[wm]", d.Width))
+  default:
+    steps = append(steps, logo+"[wm]")
+  }
+
+  position := watermarkPositions[d.Position]
+
+  if strings.Contains(position, "%") {
+    position = fmt.Sprintf(position, d.Margin)
+  }
+
+  steps = append(steps, base+"[wm]overlay="+position+"[out]")
+
+  return strings.Join(steps, ";")
+}
+
+// apply puts the watermark into flags, in place of their last video
+// filters, which run first, or as a new -vf
+func (w *Watermark) apply(flags []string) []string {
+  out := append([]string(nil), flags...)
+
+  for i := len(out) - 2; i >= 0; i-- {
+    if slices.Contains(videoFilterFlags, out[i]) {
+      out[i+1] = w.graph(out[i+1])
+      return out
+    }
+  }
+
+  return append(out, "-vf", w.graph(""))
+}
+
+// hasVideoFilter reports whether flags set a video filter chain
+func hasVideoFilter(flags []string) bool {
+  return slices.ContainsFunc(flags[:max(len(flags)-1, 0)], func(flag string) bool {
+    return slices.Contains(videoFilterFlags, flag)
+  })
+}
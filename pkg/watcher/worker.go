@@ -0,0 +1,147 @@
+package watcher
+
+import (
+  "context"
+  "sync"
+)
+
+// workerPool runs workers encoding jobs off the queue, their number can be
+// changed while it runs
+type workerPool struct {
+  queue *jobQueue
+  enc   *encoder
+  wg    sync.WaitGroup
+
+  // target is how many workers there should be and running how many there
+  // are, extra workers retire once they are between jobs
+  mu      sync.Mutex
+  target  int
+  running int
+
+  // reserveLong keeps a worker for the longest jobs when there are at
+  // least two, longTaken is set while one is
+  reserveLong bool
+  longTaken   bool
+}
+
+func newWorkerPool(queue *jobQueue, enc *encoder) *workerPool {
+  return &workerPool{queue: queue, enc: enc}
+}
+
+// start launches n workers that run until the queue is closed
+func (p *workerPool) start(n int) {
+  p.resize(n)
+}
+
+// resize starts or retires workers until there are n, a retiring worker
+// finishes the job it is encoding first
+func (p *workerPool) resize(n int) {
+  p.mu.Lock()
+  p.target = n
+
+  for p.running < p.target {
+    p.running++
+    p.wg.Add(1)
+
+    go p.work()
+  }
+
+  p.mu.Unlock()
+
+  p.queue.wake()
+}
+
+func (p *workerPool) work() {
+  defer p.wg.Done()
+
+  mine := false
+
+  defer func() {
+    if mine {
+      p.mu.Lock()
+      p.longTaken = false
+      p.mu.Unlock()
+    }
+  }()
+
+  long := func() bool { return p.reserved(&mine) }
+
+  for {
+    j, ok := p.queue.pop(p.retire, long)
+
+    if !ok {
+      return
+    }
+
+    p.enc.encode(j)
+  }
+}
+
+// retire reports whether the calling worker is surplus, counting it out
+// when it is
+func (p *workerPool) retire() bool {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if p.running > p.target {
+    p.running--
+    return true
+  }
+
+  return false
+}
+
+// reserved reports whether the calling worker, which holds the long jobs'
+// worker's place when mine is set, is the one for them. A worker takes the
+// place when it is free
+func (p *workerPool) reserved(mine *bool) bool {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if !p.reserveLong || p.target < 2 {
+    return false
+  }
+
+  if !p.longTaken {
+    p.longTaken, *mine = true, true
+  }
+
+  return *mine
+}
+
+// size is the number of workers there should be
+func (p *workerPool) size() int {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  return p.target
+}
+
+// done returns a channel that is closed once every worker has returned
+func (p *workerPool) done() <-chan struct{} {
+  done := make(chan struct{})
+
+  go func() {
+    p.wg.Wait()
+    close(done)
+  }()
+
+  return done
+}
+
+// drain stops new jobs from starting and waits for the running encodes
+// until ctx is done, then aborts the ones still running
+func (p *workerPool) drain(ctx context.Context) {
+  p.queue.close()
+
+  done := p.done()
+
+  select {
+  case <-done:
+    return
+  case <-ctx.Done():
+  }
+
+  p.enc.abort()
+  <-done
+}
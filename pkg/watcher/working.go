@@ -0,0 +1,255 @@
+package watcher
+
+import (
+  "fmt"
+  "io/fs"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "time"
+)
+
+// WorkingCleanup is what happens on start to the files an earlier run left
+// in the working directory. Nothing is deleted while another instance
+// using the same working directory is alive
+type WorkingCleanup struct {
+  // OlderThan only deletes entries not modified for that long, pass logs
+  // and outputs still being uploaded by a run that just stopped are kept.
+  // Zero deletes everything
+  OlderThan time.Duration
+
+  // Requeue queues the inputs of the jobs whose partial outputs were
+  // deleted again, also those that were not in the queue directory, like
+  // requeued failed inputs
+  Requeue bool
+}
+
+// stateDir is the working directory's folder for the instances using it
+// and the jobs they run, it is never cleaned up
+const stateDir = ".gowatcher"
+
+// workingDirs are the working directory's folders gowatcher fetches inputs
+// into, the jobs' own are named after their ULIDs
+var workingDirs = []string{"downloads", "ingest", "remote", "stream"}
+
+// ownWorkingEntry reports whether gowatcher put an entry of the working
+// directory there. The others are never deleted, it may be shared
+func ownWorkingEntry(name string) bool {
+  return slices.Contains(workingDirs, name) || isULID(name) || strings.HasPrefix(name, ".gowatcher-")
+}
+
+// instanceHeartbeat is how often an instance touches its file in
+// stateDir/instances, one not touched for instanceStaleAfter is dead
+const (
+  instanceHeartbeat  = 30 * time.Second
+  instanceStaleAfter = 4 * instanceHeartbeat
+)
+
+// workingState is this instance's files in the working directory's
+// stateDir: the one saying it is alive, one per running job naming its
+// input and one per child process it has running
+type workingState struct {
+  dir      string
+  instance string
+}
+
+func newWorkingState(workingDir string) (*workingState, error) {
+  host, err := os.Hostname()
+
+  if err != nil {
+    host = "unknown"
+  }
+
+  s := &workingState{
+    dir:      filepath.Join(workingDir, stateDir),
+    instance: fmt.Sprintf("%s-%d", strings.ReplaceAll(host, string(filepath.Separator), "_"), os.Getpid()),
+  }
+
+  for _, dir := range []string{s.dir, s.instancesDir(), s.jobsDir(), s.processesDir()} {
+    if err := createDir(dir); err != nil {
+      return nil, err
+    }
+  }
+
+  return s, nil
+}
+
+func (s *workingState) instancesDir() string {
+  return filepath.Join(s.dir, "instances")
+}
+
+func (s *workingState) jobsDir() string {
+  return filepath.Join(s.dir, "jobs")
+}
+
+// others returns the other instances still alive, and deletes the files of
+// the dead ones
+func (s *workingState) others() []string {
+  entries, _ := os.ReadDir(s.instancesDir())
+
+  var alive []string
+
+  for _, entry := range entries {
+    info, err := entry.Info()
+
+    if err != nil || entry.Name() == s.instance {
+      continue
+    }
+
+    if time.Since(info.ModTime()) < instanceStaleAfter {
+      alive = append(alive, entry.Name())
+    } else {
+      os.Remove(filepath.Join(s.instancesDir(), entry.Name()))
+    }
+  }
+
+  return alive
+}
+
+// touch marks this instance alive
+func (s *workingState) touch() error {
+  path := filepath.Join(s.instancesDir(), s.instance)
+  now := time.Now()
+
+  if err := os.Chtimes(path, now, now); err == nil {
+    return nil
+  }
+
+  return os.WriteFile(path, nil, 0644)
+}
+
+// heartbeat touches the instance's file until stop is closed, then removes
+// it
+func (s *workingState) heartbeat(stop chan struct{}) {
+  ticker := time.NewTicker(instanceHeartbeat)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ticker.C:
+      if err := s.touch(); err != nil {
+        slog.Warn("Could not refresh the working directory lock", "error", err)
+      }
+    case <-stop:
+      os.Remove(filepath.Join(s.instancesDir(), s.instance))
+      return
+    }
+  }
+}
+
+// started records the job's input until the returned func is called
+func (s *workingState) started(j *Job) func() {
+  path := filepath.Join(s.jobsDir(), fmt.Sprintf("%s-%d", s.instance, j.id))
+
+  if err := os.WriteFile(path, []byte(j.input+"\n"), 0644); err != nil {
+    j.logger().Warn("Could not record job in the working directory", "error", err)
+    return func() {}
+  }
+
+  return func() { os.Remove(path) }
+}
+
+// clean deletes what earlier runs left in the working directory, only what
+// gowatcher creates there, and
+// returns the inputs of their jobs that were cut short, when cleanup
+// requeues them. It assumes this instance is the only one alive
+func (s *workingState) clean(workingDir string, cleanup WorkingCleanup) ([]string, error) {
+  entries, err := os.ReadDir(workingDir)
+
+  if err != nil {
+    return nil, err
+  }
+
+  for _, entry := range entries {
+    path := filepath.Join(workingDir, entry.Name())
+
+    if entry.Name() == stateDir {
+      continue
+    }
+
+    if !ownWorkingEntry(entry.Name()) {
+      slog.Info("Leaving working file gowatcher did not create", "path", path)
+      continue
+    }
+
+    if cleanup.OlderThan > 0 && time.Since(lastModified(path)) < cleanup.OlderThan {
+      slog.Info("Keeping recent working file", "path", path)
+      continue
+    }
+
+    if err = os.RemoveAll(path); err != nil {
+      return nil, err
+    }
+  }
+
+  // resumable encodes' segments wait a while for their input
+  pruneResumes(filepath.Join(s.dir, "resume"))
+
+  jobs, _ := os.ReadDir(s.jobsDir())
+
+  var interrupted []string
+
+  for _, entry := range jobs {
+    path := filepath.Join(s.jobsDir(), entry.Name())
+
+    // a job recorded within OlderThan kept its working files, it is
+    // picked up again when its input is still in the queue
+    if cleanup.OlderThan > 0 && time.Since(lastModified(path)) < cleanup.OlderThan {
+      continue
+    }
+
+    data, err := os.ReadFile(path)
+    os.Remove(path)
+
+    if err != nil {
+      continue
+    }
+
+    if input := strings.TrimSpace(string(data)); cleanup.Requeue && input != "" {
+      if _, err := os.Stat(input); err == nil {
+        interrupted = append(interrupted, input)
+      }
+    }
+  }
+
+  return interrupted, nil
+}
+
+// lastModified is the newest modification time in the tree at path
+func lastModified(path string) time.Time {
+  var newest time.Time
+
+  filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+    if err != nil {
+      return nil
+    }
+
+    if info, err := d.Info(); err == nil && info.ModTime().After(newest) {
+      newest = info.ModTime()
+    }
+
+    return nil
+  })
+
+  return newest
+}
+
+// jobDir is the job's own directory in the working directory, named after
+// its ULID. Its outputs are written there until they are moved to finished
+func (e *encoder) jobDir(j *Job) string {
+  return filepath.Join(e.workingDir, j.uid)
+}
+
+// createJobDir creates the job's directory, owned by the user ffmpeg runs
+// as
+func (e *encoder) createJobDir(j *Job) error {
+  dir := e.jobDir(j)
+
+  if err := createDir(dir); err != nil {
+    return err
+  }
+
+  return e.runAs.chown(dir)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package watcher
+
+import "errors"
+
+// xattrsSupported is set where copyXattrs copies
+const xattrsSupported = false
+
+// copyXattrs is Linux's and macOS's, New does not take OutputXattrs here
+func copyXattrs(src string, dst string) error {
+  return errors.New("extended attributes are only copied on Linux and macOS")
+}
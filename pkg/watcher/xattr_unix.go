@@ -0,0 +1,82 @@
+//go:build linux || darwin
+
+package watcher
+
+import (
+  "errors"
+  "strings"
+
+  "golang.org/x/sys/unix"
+)
+
+// xattrsSupported is set where copyXattrs copies
+const xattrsSupported = true
+
+// copyXattrs gives dst the extended attributes of src. The ones dst's
+// filesystem or gowatcher's user cannot set, like security.* for anyone but
+// root, are left out and returned in the error
+func copyXattrs(src string, dst string) error {
+  names, err := listXattrs(src)
+
+  if err != nil {
+    return err
+  }
+
+  var failed []error
+
+  for _, name := range names {
+    value, err := getXattr(src, name)
+
+    if err == nil {
+      err = unix.Setxattr(dst, name, value, 0)
+    }
+
+    if err != nil {
+      failed = append(failed, errors.New(name+": "+err.Error()))
+    }
+  }
+
+  return errors.Join(failed...)
+}
+
+// listXattrs are the names of path's extended attributes
+func listXattrs(path string) ([]string, error) {
+  size, err := unix.Listxattr(path, nil)
+
+  if err != nil || size == 0 {
+    return nil, err
+  }
+
+  buf := make([]byte, size)
+
+  if size, err = unix.Listxattr(path, buf); err != nil {
+    return nil, err
+  }
+
+  var names []string
+
+  for _, name := range strings.Split(string(buf[:size]), "\x00") {
+    if name != "" {
+      names = append(names, name)
+    }
+  }
+
+  return names, nil
+}
+
+// getXattr is the value of path's extended attribute name
+func getXattr(path string, name string) ([]byte, error) {
+  size, err := unix.Getxattr(path, name, nil)
+
+  if err != nil || size == 0 {
+    return nil, err
+  }
+
+  buf := make([]byte, size)
+
+  if size, err = unix.Getxattr(path, name, buf); err != nil {
+    return nil, err
+  }
+
+  return buf[:size], nil
+}
@@ -0,0 +1,124 @@
+package watcher
+
+import (
+  "encoding/binary"
+  "math/bits"
+)
+
+// xxh64 is a streaming XXH64 with a zero seed, see
+// https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md. It reads
+// at memory speed, several times faster than SHA-256, which matters when
+// every input is hashed before it is encoded
+type xxh64 struct {
+  v     [4]uint64
+  total uint64
+  buf   [32]byte
+  n     int
+}
+
+const (
+  xxPrime1 uint64 = 11400714785074694791
+  xxPrime2 uint64 = 14029467366897019727
+  xxPrime3 uint64 = 1609587929392839161
+  xxPrime4 uint64 = 9650029242287828579
+  xxPrime5 uint64 = 2870177450012600261
+)
+
+func newXXH64() *xxh64 {
+  // the seed's lanes wrap around, which constants cannot
+  p1, p2 := xxPrime1, xxPrime2
+
+  h := &xxh64{}
+  h.v = [4]uint64{p1 + p2, p2, 0, -p1}
+
+  return h
+}
+
+func xxRound(acc uint64, lane uint64) uint64 {
+  acc += lane * xxPrime2
+  acc = bits.RotateLeft64(acc, 31)
+
+  return acc * xxPrime1
+}
+
+func xxMerge(acc uint64, v uint64) uint64 {
+  acc ^= xxRound(0, v)
+
+  return acc*xxPrime1 + xxPrime4
+}
+
+// stripes consumes whole 32 byte stripes of b
+func (h *xxh64) stripes(b []byte) {
+  for ; len(b) >= 32; b = b[32:] {
+    h.v[0] = xxRound(h.v[0], binary.LittleEndian.Uint64(b[0:]))
+    h.v[1] = xxRound(h.v[1], binary.LittleEndian.Uint64(b[8:]))
+    h.v[2] = xxRound(h.v[2], binary.LittleEndian.Uint64(b[16:]))
+    h.v[3] = xxRound(h.v[3], binary.LittleEndian.Uint64(b[24:]))
+  }
+}
+
+func (h *xxh64) Write(b []byte) (int, error) {
+  written := len(b)
+  h.total += uint64(written)
+
+  if h.n > 0 {
+    copied := copy(h.buf[h.n:], b)
+    h.n += copied
+    b = b[copied:]
+
+    if h.n < 32 {
+      return written, nil
+    }
+
+    h.stripes(h.buf[:])
+    h.n = 0
+  }
+
+  whole := len(b) &^ 31
+  h.stripes(b[:whole])
+  h.n = copy(h.buf[:], b[whole:])
+
+  return written, nil
+}
+
+func (h *xxh64) Sum64() uint64 {
+  var acc uint64
+
+  if h.total >= 32 {
+    acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+
+    for _, v := range h.v {
+      acc = xxMerge(acc, v)
+    }
+  } else {
+    acc = xxPrime5
+  }
+
+  acc += h.total
+
+  b := h.buf[:h.n]
+
+  for ; len(b) >= 8; b = b[8:] {
+    acc ^= xxRound(0, binary.LittleEndian.Uint64(b))
+    acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+  }
+
+  if len(b) >= 4 {
+    acc ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+    acc = bits.RotateLeft64(acc, 23)*xxPrime2 + xxPrime3
+    b = b[4:]
+  }
+
+  for _, c := range b {
+    acc ^= uint64(c) * xxPrime5
+    acc = bits.RotateLeft64(acc, 11) * xxPrime1
+  }
+
+  acc ^= acc >> 33
+  acc *= xxPrime2
+  acc ^= acc >> 29
+  acc *= xxPrime3
+  acc ^= acc >> 32
+
+  return acc
+}
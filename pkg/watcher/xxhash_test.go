@@ -0,0 +1,50 @@
+package watcher
+
+import (
+  "bytes"
+  "strconv"
+  "testing"
+)
+
+func TestXXH64(t *testing.T) {
+  tests := []struct {
+    input string
+    want  string
+  }{
+    {"", "ef46db3751d8e999"},
+    {"a", "d24ec4f1a98c6e5b"},
+    {"abc", "44bc2cf5ad770999"},
+  }
+
+  for _, test := range tests {
+    h := newXXH64()
+    h.Write([]byte(test.input))
+
+    if got := strconv.FormatUint(h.Sum64(), 16); got != test.want {
+      t.Errorf("xxh64(%q) = %s, want %s", test.input, got, test.want)
+    }
+  }
+}
+
+func TestXXH64Chunked(t *testing.T) {
+  input := bytes.Repeat([]byte("gowatcher hashes the whole input "), 40)
+
+  whole := newXXH64()
+  whole.Write(input)
+  want := whole.Sum64()
+
+  // sizes that leave the buffer partly filled across stripes
+  for _, size := range []int{1, 3, 7, 31, 32, 33, 100} {
+    h := newXXH64()
+
+    for b := input; len(b) > 0; {
+      n := min(size, len(b))
+      h.Write(b[:n])
+      b = b[n:]
+    }
+
+    if got := h.Sum64(); got != want {
+      t.Errorf("writing %d bytes at a time: %x, want %x", size, got, want)
+    }
+  }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log/slog"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "sync"
+
+  "gowatcher/pkg/watcher"
+)
+
+// root is one watched tree, the only one unless CONFIG_FILE lists roots
+type root struct {
+  name string
+
+  // socket serves the control API for the commands, empty when off
+  socket string
+  w      *watcher.Watcher
+}
+
+// newRoots creates a watcher for each of the config file's roots, or one for
+// cfg without any
+func newRoots(cfg watcher.Config, fileRoots []watcher.Root) []root {
+  if len(fileRoots) == 0 {
+    socket := controlSocket()
+
+    if socket == "off" {
+      socket = ""
+    }
+
+    w, err := watcher.New(cfg)
+
+    if err != nil {
+      fatal("Watcher error", "error", err)
+    }
+
+    return []root{{socket: socket, w: w}}
+  }
+
+  // each root's commands find it through its own BASE_DIR
+  sockets := os.Getenv("CONTROL_SOCKET")
+
+  if sockets != "" && sockets != "off" {
+    fatal("CONTROL_SOCKET can only be off with roots, each root's socket is in its base directory")
+  }
+
+  roots := make([]root, 0, len(fileRoots))
+
+  for _, fr := range fileRoots {
+    rootCfg, err := fr.Apply(cfg)
+
+    if err != nil {
+      fatal("Config error", "error", err)
+    }
+
+    w, err := watcher.New(rootCfg)
+
+    if err != nil {
+      fatal("Watcher error", "root", fr.Name, "error", err)
+    }
+
+    r := root{name: fr.Name, w: w}
+
+    if sockets != "off" {
+      r.socket = filepath.Join(fr.BaseDir, "gowatcher.sock")
+    }
+
+    roots = append(roots, r)
+  }
+
+  return roots
+}
+
+// watchers returns the roots' watchers
+func watchers(roots []root) []*watcher.Watcher {
+  ws := make([]*watcher.Watcher, len(roots))
+
+  for i, r := range roots {
+    ws[i] = r.w
+  }
+
+  return ws
+}
+
+// apiHandler serves a single root's API at /, several roots' under /<name>/
+func apiHandler(roots []root) http.Handler {
+  if len(roots) == 1 && roots[0].name == "" {
+    return roots[0].w.APIHandler()
+  }
+
+  mux := http.NewServeMux()
+
+  for _, r := range roots {
+    mux.Handle("/"+r.name+"/", http.StripPrefix("/"+r.name, r.w.APIHandler()))
+  }
+
+  // the probes check every root
+  health := watcher.GroupHealthHandler(watchers(roots))
+  mux.Handle("/healthz", health)
+  mux.Handle("/readyz", health)
+
+  return mux
+}
+
+// grpcHandler serves every root's gRPC API, several roots' picked by the
+// gowatcher-root metadata
+func grpcHandler(roots []root) http.Handler {
+  if len(roots) == 1 && roots[0].name == "" {
+    return roots[0].w.GRPCHandler()
+  }
+
+  return watcher.GroupGRPCHandler(watchers(roots))
+}
+
+// metricsHandler labels the samples with the root when there are several
+func metricsHandler(roots []root) http.Handler {
+  if len(roots) == 1 && roots[0].name == "" {
+    return roots[0].w.MetricsHandler()
+  }
+
+  return watcher.GroupMetricsHandler(watchers(roots))
+}
+
+// serveSockets serves each root's control socket and returns a function
+// closing them all
+func serveSockets(roots []root) func() {
+  var closers []func()
+
+  for _, r := range roots {
+    if r.socket != "" {
+      closers = append(closers, serveSocket("control", r.socket, r.w.APIHandler()))
+    }
+  }
+
+  return func() {
+    for _, closeSocket := range closers {
+      closeSocket()
+    }
+  }
+}
+
+// reloadRoots reads CONFIG_FILE again and reloads every root. Roots added to
+// or removed from the file, and changed directories, need a restart
+func reloadRoots(roots []root) error {
+  cfg := watcher.Config{
+    IncludeExtensions: watcher.SplitList(os.Getenv("INCLUDE_EXTENSIONS")),
+    ExcludeGlobs:      watcher.SplitList(os.Getenv("EXCLUDE_GLOBS")),
+    IgnorePatterns:    ignorePatternsFromEnv(),
+  }
+
+  // checked at startup
+  cfg.Workers, _ = strconv.Atoi(os.Getenv("WORKERS"))
+
+  fileRoots, err := loadProfiles(&cfg)
+
+  if err != nil {
+    return err
+  }
+
+  if len(roots) == 1 && roots[0].name == "" {
+    if len(fileRoots) > 0 {
+      slog.Warn("CONFIG_FILE now lists roots, restart to watch them")
+    }
+
+    return roots[0].w.Reload(cfg)
+  }
+
+  byName := make(map[string]watcher.Root)
+
+  for _, fr := range fileRoots {
+    byName[fr.Name] = fr
+  }
+
+  var errs []error
+
+  for _, r := range roots {
+    fr, ok := byName[r.name]
+
+    if !ok {
+      slog.Warn("Root is no longer in CONFIG_FILE, restart to stop watching it", "root", r.name)
+      continue
+    }
+
+    delete(byName, r.name)
+
+    rootCfg, err := fr.Apply(cfg)
+
+    if err == nil {
+      err = r.w.Reload(rootCfg)
+    }
+
+    if err != nil {
+      errs = append(errs, fmt.Errorf("root %s: %w", r.name, err))
+    }
+  }
+
+  for name := range byName {
+    slog.Warn("Root is new in CONFIG_FILE, restart to watch it", "root", name)
+  }
+
+  return errors.Join(errs...)
+}
+
+// shutdownRoots shuts every root down at the same time
+func shutdownRoots(ctx context.Context, roots []root) {
+  var wg sync.WaitGroup
+
+  for _, r := range roots {
+    wg.Add(1)
+
+    go func(w *watcher.Watcher) {
+      defer wg.Done()
+      w.Shutdown(ctx)
+    }(r.w)
+  }
+
+  wg.Wait()
+}
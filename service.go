@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+  "os"
+)
+
+// runningAsService is only true for the Windows service
+func runningAsService() bool {
+  return false
+}
+
+// handleServiceStop does nothing outside Windows, where SIGTERM stops the
+// daemon
+func handleServiceStop(interrupt chan<- os.Signal) {}
+
+// runService is only reached on Windows
+func runService(run func()) {
+  run()
+}
+
+// serviceCommand is only supported on Windows, elsewhere run gowatcher
+// under systemd, see systemd.go, or Docker
+func serviceCommand(args []string) {
+  fatal("gowatcher service is only supported on Windows, use systemd or Docker")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+  "flag"
+  "fmt"
+  "log/slog"
+  "os"
+  "path/filepath"
+  "strings"
+  "time"
+
+  "golang.org/x/sys/windows/registry"
+  "golang.org/x/sys/windows/svc"
+  "golang.org/x/sys/windows/svc/mgr"
+)
+
+// defaultServiceName is the Windows service's name without --name
+const defaultServiceName = "gowatcher"
+
+// serviceStops carries the service manager's stop and shutdown requests to
+// run, which treats them like SIGTERM
+var serviceStops = make(chan os.Signal, 1)
+
+// runningAsService reports whether the service manager started gowatcher
+func runningAsService() bool {
+  service, err := svc.IsWindowsService()
+
+  return err == nil && service
+}
+
+// handleServiceStop sends the service's stop requests to interrupt
+func handleServiceStop(interrupt chan<- os.Signal) {
+  go func() {
+    for sig := range serviceStops {
+      interrupt <- sig
+    }
+  }()
+}
+
+// windowsService runs the daemon for the service manager
+type windowsService struct {
+  run func()
+}
+
+// Execute runs the daemon until it shuts down, telling the service manager
+// it is still stopping while SHUTDOWN_MODE=wait lets the encodes finish
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+  status <- svc.Status{State: svc.StartPending}
+
+  done := make(chan struct{})
+
+  go func() {
+    s.run()
+    close(done)
+  }()
+
+  running := svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+  status <- running
+
+  var stopping *time.Ticker
+  var stopped <-chan time.Time
+  var checkPoint uint32
+
+  for {
+    select {
+    case r := <-requests:
+      switch r.Cmd {
+      case svc.Interrogate:
+        status <- r.CurrentStatus
+      case svc.Stop, svc.Shutdown:
+        if stopping != nil {
+          continue
+        }
+
+        slog.Info("Service stop requested")
+        status <- svc.Status{State: svc.StopPending, WaitHint: 30000}
+        serviceStops <- os.Interrupt
+
+        stopping = time.NewTicker(10 * time.Second)
+        defer stopping.Stop()
+        stopped = stopping.C
+      }
+    case <-stopped:
+      checkPoint++
+      status <- svc.Status{State: svc.StopPending, CheckPoint: checkPoint, WaitHint: 30000}
+    case <-done:
+      return false, 0
+    }
+  }
+}
+
+// runService runs run as the Windows service
+func runService(run func()) {
+  if err := svc.Run(defaultServiceName, &windowsService{run: run}); err != nil {
+    fatal("Service error", "error", err)
+  }
+}
+
+// serviceCommand installs, removes, starts or stops the Windows service
+func serviceCommand(args []string) {
+  if len(args) == 0 {
+    fatal("usage: gowatcher service install|uninstall|start|stop [--name gowatcher]")
+  }
+
+  var err error
+
+  switch args[0] {
+  case "install":
+    err = installService(args[1:])
+  case "uninstall", "start", "stop":
+    flags := flag.NewFlagSet("service "+args[0], flag.ExitOnError)
+    name := flags.String("name", defaultServiceName, "the service's name")
+    flags.Parse(args[1:])
+
+    err = controlService(args[0], *name)
+  default:
+    err = fmt.Errorf("unknown service command %q", args[0])
+  }
+
+  if err != nil {
+    fatal("Service error", "command", args[0], "error", err)
+  }
+}
+
+// envFlags collects the repeated --env flags
+type envFlags []string
+
+func (e *envFlags) String() string {
+  return strings.Join(*e, " ")
+}
+
+func (e *envFlags) Set(value string) error {
+  *e = append(*e, value)
+  return nil
+}
+
+// installService creates the service, started automatically and restarted
+// when it dies. Its environment is each --env KEY=VALUE, or KEY for the
+// current value, by default BASE_DIR and CONFIG_FILE as they are now. The
+// arguments after the flags are run's, like --dry-run
+func installService(args []string) error {
+  flags := flag.NewFlagSet("service install", flag.ExitOnError)
+  name := flags.String("name", defaultServiceName, "the service's name")
+  display := flags.String("display", "gowatcher", "the name shown in Services")
+  var env envFlags
+  flags.Var(&env, "env", "KEY=VALUE to set in the service's environment, or KEY to copy it from this one, repeatable")
+  flags.Parse(args)
+
+  if len(env) == 0 {
+    env = envFlags{"BASE_DIR", "CONFIG_FILE"}
+  }
+
+  environment := make([]string, 0, len(env))
+
+  for _, e := range env {
+    if !strings.Contains(e, "=") {
+      value, ok := os.LookupEnv(e)
+
+      if !ok {
+        continue
+      }
+
+      e += "=" + value
+    }
+
+    environment = append(environment, e)
+  }
+
+  exe, err := os.Executable()
+
+  if err != nil {
+    return err
+  }
+
+  if exe, err = filepath.Abs(exe); err != nil {
+    return err
+  }
+
+  m, err := mgr.Connect()
+
+  if err != nil {
+    return err
+  }
+
+  defer m.Disconnect()
+
+  if s, err := m.OpenService(*name); err == nil {
+    s.Close()
+    return fmt.Errorf("service %s already exists", *name)
+  }
+
+  s, err := m.CreateService(*name, exe, mgr.Config{
+    DisplayName: *display,
+    Description: "Encodes the files put in BASE_DIR's queue directory with ffmpeg",
+    StartType:   mgr.StartAutomatic,
+  }, append([]string{"run"}, flags.Args()...)...)
+
+  if err != nil {
+    return err
+  }
+
+  defer s.Close()
+
+  restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: time.Minute}
+
+  if err = s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+    slog.Warn("Could not set the service to restart when it fails", "error", err)
+  }
+
+  if len(environment) > 0 {
+    key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+*name, registry.SET_VALUE)
+
+    if err != nil {
+      s.Delete()
+      return err
+    }
+
+    defer key.Close()
+
+    if err = key.SetStringsValue("Environment", environment); err != nil {
+      s.Delete()
+      return err
+    }
+  }
+
+  fmt.Printf("Installed service %s running %s, start it with \"gowatcher service start\"\n", *name, exe)
+
+  for _, e := range environment {
+    fmt.Printf("  %s\n", e)
+  }
+
+  return nil
+}
+
+// controlService removes, starts or stops the service
+func controlService(command string, name string) error {
+  m, err := mgr.Connect()
+
+  if err != nil {
+    return err
+  }
+
+  defer m.Disconnect()
+
+  s, err := m.OpenService(name)
+
+  if err != nil {
+    return fmt.Errorf("service %s: %w", name, err)
+  }
+
+  defer s.Close()
+
+  switch command {
+  case "uninstall":
+    err = s.Delete()
+  case "start":
+    err = s.Start()
+  case "stop":
+    _, err = s.Control(svc.Stop)
+  }
+
+  if err != nil {
+    return err
+  }
+
+  fmt.Printf("Service %s: %s\n", name, command)
+
+  return nil
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+  "os"
+  "os/signal"
+  "syscall"
+
+  "gowatcher/pkg/watcher"
+)
+
+// handleReloadSignal calls reload on SIGHUP
+func handleReloadSignal(reload func()) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGHUP)
+
+  go func() {
+    for range signals {
+      reload()
+    }
+  }()
+}
+
+// handlePauseSignals pauses the queues on SIGUSR1 and resumes them on
+// SIGUSR2, running encodes are not affected
+func handlePauseSignals(ws []*watcher.Watcher) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+  go func() {
+    for sig := range signals {
+      for _, w := range ws {
+        if sig == syscall.SIGUSR1 {
+          w.Pause()
+        } else {
+          w.Resume()
+        }
+      }
+    }
+  }()
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+  "gowatcher/pkg/watcher"
+)
+
+// handlePauseSignals does nothing on Windows, which has no SIGUSR1/SIGUSR2.
+// Use the control API to pause and resume
+func handlePauseSignals(ws []*watcher.Watcher) {}
+
+// handleReloadSignal does nothing on Windows, which has no SIGHUP. Use the
+// control API or the reload command to reload
+func handleReloadSignal(reload func()) {}
@@ -0,0 +1,127 @@
+package main
+
+import (
+  "log/slog"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// sdNotify sends a state like READY=1 to systemd when it runs gowatcher as
+// a Type=notify service, and does nothing otherwise
+func sdNotify(state string) {
+  socket := os.Getenv("NOTIFY_SOCKET")
+
+  if socket == "" {
+    return
+  }
+
+  // an abstract socket
+  if strings.HasPrefix(socket, "@") {
+    socket = "\x00" + socket[1:]
+  }
+
+  conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+
+  if err != nil {
+    slog.Warn("Could not notify systemd", "state", state, "error", err)
+    return
+  }
+
+  defer conn.Close()
+
+  if _, err = conn.Write([]byte(state)); err != nil {
+    slog.Warn("Could not notify systemd", "state", state, "error", err)
+  }
+}
+
+// sdWatchdog pings systemd's watchdog at half its WatchdogSec for as long
+// as every root is live, so a stuck watcher is restarted rather than only a
+// dead process. Without a watchdog it does nothing
+func sdWatchdog(roots []root) {
+  usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+
+  if err != nil || usec <= 0 {
+    return
+  }
+
+  if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+    return
+  }
+
+  interval := time.Duration(usec) * time.Microsecond / 2
+
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+      if live(roots) {
+        sdNotify("WATCHDOG=1")
+      } else {
+        slog.Error("Watcher is not responding, skipping the systemd watchdog ping")
+      }
+    }
+  }()
+}
+
+// live reports whether every root's queue answers
+func live(roots []root) bool {
+  for _, r := range roots {
+    if !r.w.Health().Live {
+      return false
+    }
+  }
+
+  return true
+}
+
+// sdListeners are the sockets systemd passed for socket activation by their
+// FileDescriptorName, api and metrics. An unnamed socket is the API's
+func sdListeners() map[string]net.Listener {
+  listeners := make(map[string]net.Listener)
+
+  if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+    return listeners
+  }
+
+  count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+  if err != nil || count <= 0 {
+    return listeners
+  }
+
+  names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+  // the sockets are not for ffmpeg or hooks
+  os.Unsetenv("LISTEN_PID")
+  os.Unsetenv("LISTEN_FDS")
+  os.Unsetenv("LISTEN_FDNAMES")
+
+  for i := 0; i < count; i++ {
+    name := "api"
+
+    if i < len(names) && names[i] != "" && names[i] != "unknown" {
+      name = names[i]
+    }
+
+    // the first passed descriptor is 3, after stdin, stdout and stderr
+    listener, err := net.FileListener(os.NewFile(uintptr(3+i), name))
+
+    if err != nil {
+      fatal("Socket activation error", "name", name, "error", err)
+    }
+
+    if name != "api" && name != "metrics" {
+      slog.Warn("Ignoring activated socket, it must be named api or metrics", "name", name)
+      listener.Close()
+      continue
+    }
+
+    listeners[name] = listener
+  }
+
+  return listeners
+}
@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+  ioctlReadTermios  = unix.TCGETS
+  ioctlWriteTermios = unix.TCSETS
+)
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly && !windows
+
+package main
+
+import (
+  "errors"
+  "os"
+)
+
+// makeRaw is not supported here, the tui command needs it
+func makeRaw(f *os.File) (func(), error) {
+  return nil, errors.New("raw terminal mode is not supported on this system")
+}
+
+func termSize(f *os.File) (int, int) {
+  return 80, 24
+}
@@ -0,0 +1,48 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+  "os"
+
+  "golang.org/x/sys/unix"
+)
+
+// makeRaw switches the terminal to reading single key presses without
+// echoing them and returns a function switching it back
+func makeRaw(f *os.File) (func(), error) {
+  fd := int(f.Fd())
+  saved, err := unix.IoctlGetTermios(fd, ioctlReadTermios)
+
+  if err != nil {
+    return nil, err
+  }
+
+  raw := *saved
+  raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+  raw.Oflag &^= unix.OPOST
+  raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+  raw.Cflag &^= unix.CSIZE | unix.PARENB
+  raw.Cflag |= unix.CS8
+  raw.Cc[unix.VMIN] = 1
+  raw.Cc[unix.VTIME] = 0
+
+  if err = unix.IoctlSetTermios(fd, ioctlWriteTermios, &raw); err != nil {
+    return nil, err
+  }
+
+  return func() {
+    unix.IoctlSetTermios(fd, ioctlWriteTermios, saved)
+  }, nil
+}
+
+// termSize is the terminal's width and height, 80x24 when it cannot tell
+func termSize(f *os.File) (int, int) {
+  ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+
+  if err != nil || ws.Col == 0 || ws.Row == 0 {
+    return 80, 24
+  }
+
+  return int(ws.Col), int(ws.Row)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "os"
+
+  "golang.org/x/sys/windows"
+)
+
+// makeRaw switches the console to reading single key presses without
+// echoing them, with VT sequences in and out, and returns a function
+// switching it back
+func makeRaw(f *os.File) (func(), error) {
+  in := windows.Handle(f.Fd())
+  out := windows.Handle(os.Stdout.Fd())
+
+  var inMode, outMode uint32
+
+  if err := windows.GetConsoleMode(in, &inMode); err != nil {
+    return nil, err
+  }
+
+  if err := windows.GetConsoleMode(out, &outMode); err != nil {
+    return nil, err
+  }
+
+  raw := inMode&^(windows.ENABLE_ECHO_INPUT|windows.ENABLE_LINE_INPUT|windows.ENABLE_PROCESSED_INPUT) | windows.ENABLE_VIRTUAL_TERMINAL_INPUT
+
+  if err := windows.SetConsoleMode(in, raw); err != nil {
+    return nil, err
+  }
+
+  if err := windows.SetConsoleMode(out, outMode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+    windows.SetConsoleMode(in, inMode)
+    return nil, err
+  }
+
+  return func() {
+    windows.SetConsoleMode(in, inMode)
+    windows.SetConsoleMode(out, outMode)
+  }, nil
+}
+
+// termSize is the console window's width and height, 80x24 when it cannot
+// tell
+func termSize(f *os.File) (int, int) {
+  var info windows.ConsoleScreenBufferInfo
+
+  if err := windows.GetConsoleScreenBufferInfo(windows.Handle(f.Fd()), &info); err != nil {
+    return 80, 24
+  }
+
+  return int(info.Window.Right-info.Window.Left) + 1, int(info.Window.Bottom-info.Window.Top) + 1
+}
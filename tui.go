@@ -0,0 +1,461 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "net/url"
+  "os"
+  "path/filepath"
+  "slices"
+  "strings"
+  "time"
+  "unicode/utf8"
+
+  "gowatcher/pkg/watcher"
+)
+
+// tuiRefresh is how often the screen is redrawn with fresh data
+const tuiRefresh = time.Second
+
+// tuiKeys is the help line at the bottom of the screen
+const tuiKeys = "↑/↓ select  p pause/resume  s skip  r retry  a approve  c profile  x reject  q quit"
+
+// tuiState is what the screen shows, rows are the jobs and pending files
+// that can be selected in the order they are drawn. pending is nil while
+// approval is off, chosen the profile picked for each pending file
+type tuiState struct {
+  status   watcher.StatusView
+  jobs     []watcher.JobView
+  pending  *watcher.ApprovalsView
+  chosen   map[string]string
+  rows     []tuiRow
+  selected string
+  message  string
+  err      error
+}
+
+// tuiRow is a job or a file pending approval, key tells them apart
+type tuiRow struct {
+  key     string
+  job     *watcher.JobView
+  pending *watcher.PendingView
+}
+
+// tui shows the daemon's queue, progress, throughput and recent failures
+// full screen until q, redrawn every second and after each key
+func (c *client) tui() error {
+  restore, err := makeRaw(os.Stdin)
+
+  if err != nil {
+    return fmt.Errorf("not a terminal: %s", err)
+  }
+
+  defer restore()
+
+  // the alternate screen, without a cursor
+  fmt.Print("\x1b[?1049h\x1b[?25l")
+  defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+  keys := make(chan string)
+  go readKeys(keys)
+
+  ticker := time.NewTicker(tuiRefresh)
+  defer ticker.Stop()
+
+  var st tuiState
+
+  for {
+    st.load(c)
+    st.draw()
+
+    select {
+    case <-ticker.C:
+    case key, ok := <-keys:
+      if !ok || key == "q" || key == "\x03" {
+        return nil
+      }
+
+      st.handle(c, key)
+    }
+  }
+}
+
+// readKeys sends each key pressed, arrows as up and down
+func readKeys(keys chan<- string) {
+  defer close(keys)
+
+  buf := make([]byte, 16)
+
+  for {
+    n, err := os.Stdin.Read(buf)
+
+    if err != nil {
+      return
+    }
+
+    switch in := string(buf[:n]); in {
+    case "\x1b[A", "\x1bOA":
+      keys <- "up"
+    case "\x1b[B", "\x1bOB":
+      keys <- "down"
+    default:
+      for _, r := range in {
+        keys <- string(r)
+      }
+    }
+  }
+}
+
+func (st *tuiState) load(c *client) {
+  var status watcher.StatusView
+  var jobs []watcher.JobView
+
+  if st.err = c.get("/status", &status); st.err == nil {
+    st.err = c.get("/jobs", &jobs)
+  }
+
+  if st.err != nil {
+    return
+  }
+
+  // the daemon says so when approval is off
+  var pending watcher.ApprovalsView
+
+  st.pending = nil
+
+  if c.get("/pending", &pending) == nil {
+    st.pending = &pending
+  }
+
+  st.status, st.jobs = status, jobs
+  st.rows = st.rows[:0]
+
+  if st.pending != nil {
+    for i := range st.pending.Pending {
+      p := &st.pending.Pending[i]
+      st.rows = append(st.rows, tuiRow{key: "pending:" + p.Path, pending: p})
+    }
+  }
+
+  for _, jobs := range [][]watcher.JobView{status.Active, st.waiting(), st.failures()} {
+    for i := range jobs {
+      st.rows = append(st.rows, tuiRow{key: jobKey(jobs[i]), job: &jobs[i]})
+    }
+  }
+
+  // keep the selection on its row, or the first row once it is gone
+  for _, row := range st.rows {
+    if row.key == st.selected {
+      return
+    }
+  }
+
+  st.selected = ""
+
+  if len(st.rows) > 0 {
+    st.selected = st.rows[0].key
+  }
+}
+
+// jobKey is the job's tuiRow key
+func jobKey(j watcher.JobView) string {
+  return fmt.Sprintf("job:%d", j.ID)
+}
+
+// profile is the profile the pending file is approved with, the one chosen
+// for it or else its own
+func (st *tuiState) profile(p watcher.PendingView) string {
+  if chosen, ok := st.chosen[p.Path]; ok && !p.Spec {
+    return chosen
+  }
+
+  return p.Profile
+}
+
+// waiting is the queued jobs, next first
+func (st *tuiState) waiting() []watcher.JobView {
+  var jobs []watcher.JobView
+
+  for _, j := range st.jobs {
+    if j.State == watcher.JobQueued {
+      jobs = append(jobs, j)
+    }
+  }
+
+  return jobs
+}
+
+// failures is the failed jobs, latest first
+func (st *tuiState) failures() []watcher.JobView {
+  var jobs []watcher.JobView
+
+  for i := len(st.jobs) - 1; i >= 0 && len(jobs) < 10; i-- {
+    if st.jobs[i].State == watcher.JobFailed {
+      jobs = append(jobs, st.jobs[i])
+    }
+  }
+
+  return jobs
+}
+
+func (st *tuiState) handle(c *client, key string) {
+  var current *watcher.JobView
+  var pending *watcher.PendingView
+  index := 0
+
+  for i := range st.rows {
+    if st.rows[i].key == st.selected {
+      current, pending, index = st.rows[i].job, st.rows[i].pending, i
+    }
+  }
+
+  var path, done string
+
+  switch key {
+  case "up", "k":
+    if index > 0 {
+      st.selected = st.rows[index-1].key
+    }
+
+    return
+  case "down", "j":
+    if index+1 < len(st.rows) {
+      st.selected = st.rows[index+1].key
+    }
+
+    return
+  case "p":
+    path, done = "/pause", "Paused, running encodes will finish"
+
+    if st.status.Paused {
+      path, done = "/resume", "Resumed"
+    }
+  case "s":
+    if current == nil || current.State.Finished() {
+      st.message = "Select a waiting or running job to skip"
+      return
+    }
+
+    path, done = fmt.Sprintf("/jobs/%d/cancel", current.ID), fmt.Sprintf("Skipped job %d", current.ID)
+  case "r":
+    if current == nil || current.State != watcher.JobFailed {
+      st.message = "Select a failed job to retry"
+      return
+    }
+
+    path, done = fmt.Sprintf("/jobs/%d/requeue", current.ID), fmt.Sprintf("Retrying job %d", current.ID)
+  case "c":
+    if pending == nil || pending.Spec {
+      st.message = "Select a pending file without a job spec to choose its profile"
+      return
+    }
+
+    // the next profile, round to the first after the last
+    profiles := st.pending.Profiles
+    next := profiles[(slices.Index(profiles, st.profile(*pending))+1)%len(profiles)]
+
+    if st.chosen == nil {
+      st.chosen = make(map[string]string)
+    }
+
+    st.chosen[pending.Path] = next
+    st.message = fmt.Sprintf("%s will be encoded with %s", pending.Name, next)
+
+    return
+  case "a":
+    if pending == nil {
+      st.message = "Select a pending file to approve"
+      return
+    }
+
+    profile := st.profile(*pending)
+    query := url.Values{"path": {pending.Path}, "profile": {profile}}
+    path, done = "/pending/approve?"+query.Encode(), fmt.Sprintf("Approved %s with %s", pending.Name, profile)
+  case "x":
+    if pending == nil {
+      st.message = "Select a pending file to reject"
+      return
+    }
+
+    query := url.Values{"path": {pending.Path}, "reason": {"rejected in the TUI"}}
+    path, done = "/pending/reject?"+query.Encode(), fmt.Sprintf("Rejected %s", pending.Name)
+  default:
+    return
+  }
+
+  if _, err := c.do(http.MethodPost, path); err != nil {
+    st.message = err.Error()
+    return
+  }
+
+  st.message = done
+}
+
+// draw writes the whole screen, line by line so it does not flicker
+func (st *tuiState) draw() {
+  width, height := termSize(os.Stdout)
+
+  var lines []string
+  add := func(format string, args ...any) {
+    lines = append(lines, fit(fmt.Sprintf(format, args...), width))
+  }
+
+  state := "running"
+
+  switch {
+  case st.status.Paused:
+    state = "paused"
+  case st.status.Held:
+    state = "outside the schedule"
+  case st.status.Deferred != "":
+    state = "deferring, " + st.status.Deferred
+  }
+
+  add("gowatcher  %s  waiting %d  encoding %d  done %d  failed %d  %s", state, st.status.Queued, len(st.status.Active),
+    st.status.Counts[watcher.JobDone], st.status.Counts[watcher.JobFailed], time.Now().Format("15:04:05"))
+  add("%s", st.throughput())
+
+  if st.err != nil {
+    add("")
+    add("Cannot reach the daemon: %s", st.err)
+  }
+
+  marker := func(key string) string {
+    if key == st.selected {
+      return ">"
+    }
+
+    return " "
+  }
+
+  if st.pending != nil {
+    add("")
+    add("PENDING APPROVAL")
+
+    if len(st.pending.Pending) == 0 {
+      add("  none")
+    }
+
+    for _, p := range st.pending.Pending {
+      profile := st.profile(p)
+
+      if p.Spec {
+        profile += " (job spec)"
+      }
+
+      add("%s       %-30s  %s  %s  since %s", marker("pending:"+p.Path), fit(p.Name, 30), watcher.FormatSize(p.Size), profile, p.FoundAt.Local().Format("15:04:05"))
+    }
+  }
+
+  section := func(title string, jobs []watcher.JobView, detail func(watcher.JobView) string) {
+    add("")
+    add("%s", title)
+
+    if len(jobs) == 0 {
+      add("  none")
+    }
+
+    for _, j := range jobs {
+      add("%s %4d  %-30s  %s", marker(jobKey(j)), j.ID, fit(filepath.Base(j.Input), 30), detail(j))
+    }
+  }
+
+  section("ENCODING", st.status.Active, func(j watcher.JobView) string {
+    if j.Percent == nil {
+      return j.Profile + "  " + j.Progress
+    }
+
+    eta := ""
+
+    if j.ETASeconds != nil {
+      eta = " eta " + (time.Duration(*j.ETASeconds) * time.Second).String()
+    }
+
+    return fmt.Sprintf("%s  %s %5.1f%%%s", j.Profile, progressBar(*j.Percent, 20), *j.Percent, eta)
+  })
+
+  waiting := st.waiting()
+  section("WAITING", waiting, func(j watcher.JobView) string {
+    return j.Profile + "  since " + j.QueuedAt.Local().Format("15:04:05")
+  })
+
+  section("RECENT ERRORS", st.failures(), func(j watcher.JobView) string {
+    return j.Error
+  })
+
+  // the help and last message stay at the bottom, the rest is cut to fit
+  footer := []string{"", fit(tuiKeys+"   "+st.message, width)}
+
+  if height > len(footer) && len(lines) > height-len(footer) {
+    lines = lines[:height-len(footer)]
+  }
+
+  for len(lines)+len(footer) < height {
+    lines = append(lines, "")
+  }
+
+  var b strings.Builder
+
+  b.WriteString("\x1b[H")
+
+  for i, line := range append(lines, footer...) {
+    if i > 0 {
+      b.WriteString("\r\n")
+    }
+
+    b.WriteString(line + "\x1b[K")
+  }
+
+  b.WriteString("\x1b[J")
+  os.Stdout.WriteString(b.String())
+}
+
+// throughput sums up the jobs done in the last hour
+func (st *tuiState) throughput() string {
+  var done int
+  var took time.Duration
+
+  for _, j := range st.jobs {
+    if j.State == watcher.JobDone && j.FinishedAt != nil && j.StartedAt != nil && time.Since(*j.FinishedAt) < time.Hour {
+      done++
+      took += j.FinishedAt.Sub(*j.StartedAt)
+    }
+  }
+
+  if done == 0 {
+    return "Nothing done in the last hour"
+  }
+
+  return fmt.Sprintf("%d done in the last hour, %s per job on average", done, (took / time.Duration(done)).Round(time.Second))
+}
+
+func progressBar(percent float64, width int) string {
+  filled := int(percent / 100 * float64(width))
+
+  if filled > width {
+    filled = width
+  }
+
+  if filled < 0 {
+    filled = 0
+  }
+
+  return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+// fit puts s on one line and cuts it to width characters
+func fit(s string, width int) string {
+  s = strings.NewReplacer("\r", "", "\n", " ", "\t", " ").Replace(s)
+
+  if utf8.RuneCountInString(s) <= width {
+    return s
+  }
+
+  runes := []rune(s)
+
+  if width <= 1 {
+    return string(runes[:width])
+  }
+
+  return string(runes[:width-1]) + "…"
+}
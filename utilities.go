@@ -1,38 +1,119 @@
 package main
 
 import (
-  "fmt"
+  "errors"
+  "log/slog"
+  "net"
+  "net/http"
   "os"
+  "path/filepath"
+  "sync"
 )
 
-func dirExists(dirName string) (bool, error) {
-  info, err := os.Stat(dirName)
+// serveHTTP runs an http server on listener, or on addr when it is nil,
+// exiting the program if it cannot listen
+func serveHTTP(name string, addr string, listener net.Listener, handler http.Handler) {
+  if listener != nil {
+    slog.Info("Serving "+name, "addr", listener.Addr().String(), "activated", true)
 
-  if err != nil && !os.IsNotExist(err) {
-    return false, err
+    if err := http.Serve(listener, handler); err != nil {
+      fatal(name+" server error", "error", err)
+    }
+
+    return
+  }
+
+  slog.Info("Serving "+name, "addr", addr)
+
+  if err := http.ListenAndServe(addr, handler); err != nil {
+    fatal(name+" server error", "error", err)
   }
+}
 
-  if os.IsNotExist(err) || !info.IsDir() {
-    return false, nil
+// loopbackAddr puts an address without a host, like ":8080", on the
+// loopback interface rather than on every one
+func loopbackAddr(addr string) string {
+  if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+    return net.JoinHostPort("127.0.0.1", port)
   }
 
-  return true, nil
+  return addr
 }
 
-func createDir(dirName string) error {
-  exists, err := dirExists(dirName)
+// serveSocket serves handler on a unix socket only its user can connect
+// to, exiting the program if it cannot listen. A socket left behind by an
+// earlier run is replaced unless something still answers on it. The
+// returned func removes the socket, fatal does too
+func serveSocket(name string, path string, handler http.Handler) func() {
+  if conn, err := net.Dial("unix", path); err == nil {
+    conn.Close()
+    fatal(name+" socket is in use, is gowatcher already running?", "socket", path)
+  }
+
+  os.Remove(path)
+
+  listener, err := listenPrivate(path)
 
   if err != nil {
-    return err
+    fatal(name+" socket error", "socket", path, "error", err)
   }
 
-  if exists {
-    return nil
+  var once sync.Once
+
+  closeSocket := func() {
+    once.Do(func() {
+      listener.Close()
+      os.Remove(path)
+    })
   }
 
-  if err := os.Mkdir(dirName, os.ModePerm); err != nil {
-    return fmt.Errorf("Could not create dir: %s\n", err)
+  atExit(closeSocket)
+
+  slog.Info("Serving "+name, "socket", path)
+
+  go func() {
+    if err := http.Serve(listener, handler); err != nil && !errors.Is(err, net.ErrClosed) {
+      fatal(name+" server error", "error", err)
+    }
+  }()
+
+  return closeSocket
+}
+
+// listenPrivate listens on a unix socket at path with mode 0600. It is
+// made in a directory only this user can enter and moved to path once its
+// mode is set, so whatever the umask nobody else connects in between
+func listenPrivate(path string) (*net.UnixListener, error) {
+  dir, err := os.MkdirTemp(filepath.Dir(path), ".gowatcher-sock-")
+
+  if err != nil {
+    return nil, err
+  }
+
+  defer os.RemoveAll(dir)
+
+  if err = os.Chmod(dir, 0700); err != nil {
+    return nil, err
+  }
+
+  tmp := filepath.Join(dir, "sock")
+  listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+
+  if err != nil {
+    return nil, err
+  }
+
+  // closing it would remove the temporary path, the socket is moved
+  listener.SetUnlinkOnClose(false)
+
+  if err = os.Chmod(tmp, 0600); err == nil {
+    err = os.Rename(tmp, path)
+  }
+
+  if err != nil {
+    listener.Close()
+    return nil, err
   }
 
-  return nil
+  return listener, nil
 }